@@ -0,0 +1,268 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/mkxxx/grpc-proxy/proxy/acme"
+	"github.com/mkxxx/grpc-proxy/proxy/config"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/alts"
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the configuration file of the proxy. The routing part is
+// that of package config and is reloaded when the file changes, the rest
+// only applies at startup:
+//
+//	listeners:
+//	  - address: :8443
+//	    tls:
+//	      cert_file: /etc/proxy/server.pem
+//	      key_file: /etc/proxy/server-key.pem
+//	  - address: 127.0.0.1:8080
+//	    channelz: true
+//	    health: true
+//	  - address: unix:/run/grpc-proxy.sock
+//	  - address: :9443
+//	    proxy_protocol: true
+//	  - address: :9444
+//	    alts: {}
+//	  - address: :443
+//	    acme:
+//	      hosts: [api.example.com]
+//	      email: ops@example.com
+//	      cache_dir: /var/lib/grpc-proxy/acme
+//	admin:
+//	  address: 127.0.0.1:9090
+//	shutdown_grace: 30s
+//	reload_interval: 5s
+//	via:
+//	  name: edge-1
+//	  max_hops: 4
+//	backends:
+//	  - name: users
+//	    endpoints:
+//	      - address: users.internal:443
+//	routes:
+//	  - method_prefix: /users.UserService/
+//	    backend: users
+type fileConfig struct {
+	Listeners []listenerConfig `yaml:"listeners"`
+	Admin     adminConfig      `yaml:"admin"`
+
+	// ShutdownGrace is how long in-flight streams may run after a shutdown
+	// signal. Defaults to 30s.
+	ShutdownGrace time.Duration `yaml:"shutdown_grace"`
+
+	// ReloadInterval is how often the file is checked for routing changes.
+	// Defaults to 5s, negative disables reloading.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+
+	// Via, if set, adds the proxy to the Via metadata of the calls it
+	// forwards and rejects routing loops between chained proxies, see
+	// proxy.ViaPolicy.
+	Via *viaConfig `yaml:"via"`
+
+	config.Config `yaml:",inline"`
+}
+
+// viaConfig names the proxy in chains of proxies. The name defaults to the
+// host name.
+type viaConfig struct {
+	Name    string `yaml:"name"`
+	MaxHops int    `yaml:"max_hops"`
+}
+
+// listenerConfig is an address the proxy serves gRPC on. Addresses with a
+// "unix:" prefix are Unix socket paths.
+type listenerConfig struct {
+	Address string     `yaml:"address"`
+	TLS     *serverTLS `yaml:"tls"`
+	// ALTS secures the listener with ALTS instead of TLS.
+	ALTS *serverALTS `yaml:"alts"`
+	// ACME secures the listener with certificates obtained from an ACME CA
+	// such as Let's Encrypt instead of from files.
+	ACME *serverACME `yaml:"acme"`
+	// Channelz serves the gRPC Channelz service on the listener.
+	Channelz bool `yaml:"channelz"`
+	// Health serves the gRPC health service on the listener, reporting the
+	// health of the routed backends, see proxy.HealthService.
+	Health bool `yaml:"health"`
+	// ProxyProtocol requires connections to start with a PROXY protocol
+	// header, as sent by L4 load balancers.
+	ProxyProtocol bool `yaml:"proxy_protocol"`
+}
+
+// listen opens the listener.
+func (l *listenerConfig) listen() (net.Listener, error) {
+	network, address := "tcp", l.Address
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+	}
+	lis, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if l.ProxyProtocol {
+		lis = proxy.NewProxyProtocolListener(lis, proxy.ProxyProtocolConfig{Required: true})
+	}
+	return lis, nil
+}
+
+// serverALTS secures a listener with ALTS, as on Google Cloud.
+type serverALTS struct {
+	// HandshakerAddress is the address of the ALTS handshaker service. It
+	// defaults to that of the hypervisor.
+	HandshakerAddress string `yaml:"handshaker_address"`
+}
+
+func (a *serverALTS) credentials() credentials.TransportCredentials {
+	opts := alts.DefaultServerOptions()
+	if a.HandshakerAddress != "" {
+		opts.HandshakerServiceAddress = a.HandshakerAddress
+	}
+	return alts.NewServerCreds(opts)
+}
+
+// serverACME secures a listener with certificates from an ACME CA, see
+// package acme. The listener must be reachable on port 443 of the hosts for
+// the TLS-ALPN-01 challenge.
+type serverACME struct {
+	Hosts        []string      `yaml:"hosts"`
+	Email        string        `yaml:"email"`
+	CacheDir     string        `yaml:"cache_dir"`
+	DirectoryURL string        `yaml:"directory_url"`
+	RenewBefore  time.Duration `yaml:"renew_before"`
+}
+
+func (a *serverACME) provider() (*acme.Provider, error) {
+	return acme.NewProvider(acme.Config{
+		Hosts:        a.Hosts,
+		Email:        a.Email,
+		CacheDir:     a.CacheDir,
+		DirectoryURL: a.DirectoryURL,
+		RenewBefore:  a.RenewBefore,
+	})
+}
+
+// serverTLS secures a listener. With a client CA file, clients must present
+// a certificate signed by it. The certificate is reloaded when its files
+// change or on SIGHUP, see proxy.CertificateManager.
+type serverTLS struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// KeyPasswordFile holds the password of an encrypted key file.
+	KeyPasswordFile string `yaml:"key_password_file"`
+	// OCSPStapleFile is a DER encoded OCSP response stapled to handshakes.
+	OCSPStapleFile string `yaml:"ocsp_staple_file"`
+	ClientCAFile   string `yaml:"client_ca_file"`
+}
+
+// adminConfig is the HTTP server for metrics and health checks. It is
+// disabled if the address is empty.
+type adminConfig struct {
+	Address string `yaml:"address"`
+}
+
+func loadConfig(path string) (*fileConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := parseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+func parseConfig(data []byte) (*fileConfig, error) {
+	cfg := &fileConfig{
+		ShutdownGrace:  30 * time.Second,
+		ReloadInterval: 5 * time.Second,
+	}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *fileConfig) validate() error {
+	if len(c.Listeners) == 0 {
+		return errors.New("no listeners")
+	}
+	if c.Via != nil && c.Via.MaxHops < 0 {
+		return errors.New("via: negative max_hops")
+	}
+	for i, l := range c.Listeners {
+		if l.Address == "" {
+			return fmt.Errorf("listener %d has no address", i)
+		}
+		n := 0
+		for _, set := range []bool{l.TLS != nil, l.ALTS != nil, l.ACME != nil} {
+			if set {
+				n++
+			}
+		}
+		if n > 1 {
+			return fmt.Errorf("listener %s: only one of tls, alts and acme may be set", l.Address)
+		}
+		if l.TLS != nil {
+			if _, _, err := l.TLS.config(); err != nil {
+				return fmt.Errorf("listener %s: %v", l.Address, err)
+			}
+		}
+		if l.ACME != nil {
+			if _, err := l.ACME.provider(); err != nil {
+				return fmt.Errorf("listener %s: %v", l.Address, err)
+			}
+		}
+	}
+	return c.Config.Validate()
+}
+
+func (t *serverTLS) config() (*tls.Config, *proxy.CertificateManager, error) {
+	if t.CertFile == "" || t.KeyFile == "" {
+		return nil, nil, errors.New("cert_file and key_file are required")
+	}
+	certs := &proxy.CertificateManager{CertFile: t.CertFile, KeyFile: t.KeyFile, OCSPStapleFile: t.OCSPStapleFile}
+	if t.KeyPasswordFile != "" {
+		password, err := ioutil.ReadFile(t.KeyPasswordFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		certs.KeyPassword = bytes.TrimRight(password, "\r\n")
+	}
+	if err := certs.Load(); err != nil {
+		return nil, nil, err
+	}
+	cfg := &tls.Config{GetCertificate: certs.GetCertificate}
+	if t.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(t.ClientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates in %s", t.ClientCAFile)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, certs, nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+// Command grpc-proxy is a transparent gRPC proxy configured by a YAML file.
+//
+//	grpc-proxy -config /etc/grpc-proxy.yaml
+//
+// Calls are routed to backends by the routes of the file, which are
+// reloaded when it changes. Metrics are served in the Prometheus format on
+// /metrics of the admin address, along with the /healthz and /readyz probes
+// of package probe, and the API of package admin is served under /admin/.
+// /readyz fails once the proxy is shutting down. On SIGINT or SIGTERM,
+// in-flight streams are given the shutdown grace period to complete.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	configPath := flag.String("config", "grpc-proxy.yaml", "path of the configuration file")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := newServer(cfg)
+	if err := s.start(); err != nil {
+		log.Fatal(err)
+	}
+	for _, lis := range s.listeners {
+		log.Printf("serving gRPC on %s", lis.Addr())
+	}
+	if s.adminLis != nil {
+		log.Printf("serving admin endpoint on %s", s.adminLis.Addr())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.watch(ctx, *configPath, func(err error) {
+		log.Printf("not reloading configuration: %v", err)
+	})
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		log.Printf("received %v, shutting down", sig)
+	case err := <-s.errs:
+		log.Printf("serving failed, shutting down: %v", err)
+	}
+	// A second signal skips the drain.
+	go func() {
+		<-signals
+		cancel()
+	}()
+	if err := s.shutdown(ctx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+}
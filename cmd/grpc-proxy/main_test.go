@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := parseConfig([]byte(`
+listeners:
+  - address: 127.0.0.1:0
+  - address: unix:/run/grpc-proxy.sock
+    proxy_protocol: true
+  - address: 127.0.0.1:0
+    alts:
+      handshaker_address: 127.0.0.1:8080
+  - address: 127.0.0.1:0
+    acme:
+      hosts: [api.example.com]
+      cache_dir: /var/lib/grpc-proxy/acme
+admin:
+  address: 127.0.0.1:0
+shutdown_grace: 2s
+via:
+  name: edge-1
+  max_hops: 4
+backends:
+  - name: users
+    endpoints:
+      - address: users.internal:443
+routes:
+  - method_prefix: /users.UserService/
+    backend: users
+`))
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Second, cfg.ShutdownGrace)
+	assert.Equal(t, 5*time.Second, cfg.ReloadInterval, "default reload interval")
+	assert.Equal(t, &viaConfig{Name: "edge-1", MaxHops: 4}, cfg.Via)
+	require.Len(t, cfg.Listeners, 4)
+	assert.True(t, cfg.Listeners[1].ProxyProtocol)
+	assert.Equal(t, "127.0.0.1:8080", cfg.Listeners[2].ALTS.HandshakerAddress)
+	assert.Equal(t, []string{"api.example.com"}, cfg.Listeners[3].ACME.Hosts)
+	require.Len(t, cfg.Backends, 1, "routing configuration is inline")
+	assert.Equal(t, "users", cfg.Routes[0].Backend)
+
+	for name, data := range map[string]string{
+		"no listeners":  "backends: []",
+		"no address":    "listeners: [{}]",
+		"bad tls":       "listeners: [{address: ':0', tls: {cert_file: missing.pem}}]",
+		"tls and alts":  "listeners: [{address: ':0', tls: {}, alts: {}}]",
+		"alts and acme": "listeners: [{address: ':0', alts: {}, acme: {hosts: [a.example.com], cache_dir: /tmp}}]",
+		"acme no hosts": "listeners: [{address: ':0', acme: {cache_dir: /tmp}}]",
+		"bad routing":   "listeners: [{address: ':0'}]\nroutes: [{backend: missing}]",
+		"bad duration":  "listeners: [{address: ':0'}]\nshutdown_grace: soon",
+		"bad via":       "listeners: [{address: ':0'}]\nvia: {max_hops: -1}",
+		"not a mapping": "- listeners",
+	} {
+		_, err := parseConfig([]byte(data))
+		assert.Error(t, err, name)
+	}
+}
+
+type echoService struct{}
+
+func (echoService) PingEmpty(ctx context.Context, _ *pb.Empty) (*pb.PingResponse, error) {
+	return &pb.PingResponse{}, nil
+}
+
+func (echoService) Ping(ctx context.Context, req *pb.PingRequest) (*pb.PingResponse, error) {
+	return &pb.PingResponse{Value: req.Value}, nil
+}
+
+func (echoService) PingError(ctx context.Context, req *pb.PingRequest) (*pb.Empty, error) {
+	return &pb.Empty{}, nil
+}
+
+func (echoService) PingList(req *pb.PingRequest, stream pb.TestService_PingListServer) error {
+	return nil
+}
+
+func (echoService) PingStream(stream pb.TestService_PingStreamServer) error {
+	return nil
+}
+
+func TestServer(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	backend := grpc.NewServer()
+	pb.RegisterTestServiceServer(backend, echoService{})
+	go backend.Serve(lis)
+	defer backend.Stop()
+
+	cfg, err := parseConfig([]byte(fmt.Sprintf(`
+listeners:
+  - address: 127.0.0.1:0
+    health: true
+admin:
+  address: 127.0.0.1:0
+shutdown_grace: 1s
+backends:
+  - name: test
+    endpoints:
+      - address: %s
+routes:
+  - method_prefix: /vgough.testproto.TestService/
+    backend: test
+`, lis.Addr())))
+	require.NoError(t, err)
+	s := newServer(cfg)
+	require.NoError(t, s.start())
+
+	conn, err := grpc.Dial(s.listeners[0].Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := pb.NewTestServiceClient(conn).Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err)
+	assert.Equal(t, "foo", resp.Value)
+	health, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: "vgough.testproto.TestService"})
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, health.GetStatus())
+
+	admin := "http://" + s.adminLis.Addr().String()
+	body, code := get(t, admin+"/healthz")
+	assert.Equal(t, http.StatusOK, code, body)
+	body, code = get(t, admin+"/readyz")
+	assert.Equal(t, http.StatusOK, code, body)
+	body, _ = get(t, admin+"/metrics")
+	assert.True(t, strings.Contains(body, "grpc_proxy_streams_handled_total"), "metrics must be served")
+	body, code = get(t, admin+"/admin/routes")
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, strings.Contains(body, `"backend": "test"`), body)
+
+	assert.NoError(t, s.shutdown(ctx))
+	assert.True(t, s.drainer.Draining())
+	_, err = http.Get(admin + "/healthz")
+	assert.Error(t, err, "admin endpoint must be stopped")
+}
+
+func get(t *testing.T, url string) (string, int) {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body), resp.StatusCode
+}
@@ -0,0 +1,193 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/mkxxx/grpc-proxy/proxy/admin"
+	"github.com/mkxxx/grpc-proxy/proxy/channelz"
+	"github.com/mkxxx/grpc-proxy/proxy/config"
+	"github.com/mkxxx/grpc-proxy/proxy/probe"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// server runs the listeners of a proxy and its admin endpoint.
+type server struct {
+	cfg      *fileConfig
+	manager  *config.Manager
+	drainer  *proxy.Drainer
+	streams  *proxy.StreamTracker
+	registry *prometheus.Registry
+
+	servers   []*grpc.Server
+	listeners []net.Listener
+	certs     []*proxy.CertificateManager
+	admin     *http.Server
+	adminLis  net.Listener
+
+	// errs receives the first error of each serving listener.
+	errs chan error
+}
+
+func newServer(cfg *fileConfig) *server {
+	return &server{
+		cfg:      cfg,
+		manager:  config.NewManager(),
+		drainer:  &proxy.Drainer{},
+		streams:  &proxy.StreamTracker{},
+		registry: prometheus.NewRegistry(),
+	}
+}
+
+// start applies the routing configuration and starts serving. On error,
+// whatever was started is stopped again.
+func (s *server) start() error {
+	if err := s.manager.Apply(&s.cfg.Config); err != nil {
+		return err
+	}
+	s.registry.MustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	handlerOpts := []proxy.Option{
+		proxy.WithDrainer(s.drainer),
+		proxy.WithStreamTracker(s.streams),
+		proxy.WithMetrics(s.registry),
+	}
+	if v := s.cfg.Via; v != nil {
+		handlerOpts = append(handlerOpts, proxy.WithVia(proxy.ViaPolicy{Name: v.Name, MaxHops: v.MaxHops}))
+	}
+	handler := proxy.TransparentHandler(s.manager.Router().Direct, handlerOpts...)
+
+	health := proxy.NewRouterHealth(s.manager.Router())
+	health.Drainer = s.drainer
+
+	s.errs = make(chan error, len(s.cfg.Listeners)+1)
+	for _, l := range s.cfg.Listeners {
+		opts := []grpc.ServerOption{
+			proxy.ServerOption(),
+			grpc.UnknownServiceHandler(handler),
+		}
+		if l.TLS != nil {
+			tlsConfig, certs, err := l.TLS.config()
+			if err != nil {
+				s.stop()
+				return err
+			}
+			certs.OnError = func(err error) {
+				log.Printf("not reloading certificate: %v", err)
+			}
+			s.certs = append(s.certs, certs)
+			opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+		if l.ALTS != nil {
+			opts = append(opts, grpc.Creds(l.ALTS.credentials()))
+		}
+		if l.ACME != nil {
+			p, err := l.ACME.provider()
+			if err != nil {
+				s.stop()
+				return err
+			}
+			opts = append(opts, grpc.Creds(credentials.NewTLS(p.TLSConfig())))
+		}
+		lis, err := l.listen()
+		if err != nil {
+			s.stop()
+			return err
+		}
+		srv := grpc.NewServer(opts...)
+		if l.Channelz {
+			channelz.Register(srv)
+		}
+		if l.Health {
+			health.Register(srv)
+		}
+		s.servers = append(s.servers, srv)
+		s.listeners = append(s.listeners, lis)
+		go func() { s.errs <- srv.Serve(lis) }()
+	}
+
+	if s.cfg.Admin.Address != "" {
+		lis, err := net.Listen("tcp", s.cfg.Admin.Address)
+		if err != nil {
+			s.stop()
+			return err
+		}
+		mux := http.NewServeMux()
+		probes := &probe.Handler{
+			Config:   s.manager,
+			Router:   s.manager.Router(),
+			Drainer:  s.drainer,
+			Gatherer: s.registry,
+		}
+		mux.Handle("/metrics", probes)
+		mux.Handle("/healthz", probes)
+		mux.Handle("/readyz", probes)
+		mux.Handle("/admin/", http.StripPrefix("/admin", &admin.Handler{
+			Router:  s.manager.Router(),
+			Streams: s.streams,
+			Drainer: s.drainer,
+		}))
+		s.admin = &http.Server{Handler: mux}
+		s.adminLis = lis
+		go func() {
+			if err := s.admin.Serve(lis); err != http.ErrServerClosed {
+				s.errs <- err
+			}
+		}()
+	}
+	return nil
+}
+
+// watch reloads the routing configuration from path and the certificates
+// of the listeners until ctx is done.
+func (s *server) watch(ctx context.Context, path string, onError func(error)) {
+	for _, certs := range s.certs {
+		go certs.Run(ctx)
+	}
+	if s.cfg.ReloadInterval > 0 {
+		s.manager.Watch(ctx, path, s.cfg.ReloadInterval, onError)
+	}
+}
+
+// shutdown drains in-flight streams for up to the shutdown grace period,
+// then stops serving. The readiness check fails from the start of the drain,
+// so that load balancers stop sending new clients.
+func (s *server) shutdown(ctx context.Context) error {
+	err := s.drainer.Drain(ctx, s.cfg.ShutdownGrace)
+	done := make(chan struct{})
+	go func() {
+		for _, srv := range s.servers {
+			srv.GracefulStop()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+	}
+	s.stop()
+	return err
+}
+
+// stop closes all listeners and backend connections at once.
+func (s *server) stop() {
+	for _, srv := range s.servers {
+		srv.Stop()
+	}
+	for _, lis := range s.listeners {
+		lis.Close()
+	}
+	if s.admin != nil {
+		s.admin.Close()
+	}
+	s.manager.Close()
+}
@@ -3,9 +3,19 @@ module github.com/mkxxx/grpc-proxy
 go 1.13
 
 require (
+	github.com/envoyproxy/go-control-plane v0.9.0
 	github.com/gogo/protobuf v1.3.0
 	github.com/golang/protobuf v1.3.2
-	github.com/stretchr/testify v1.4.0
+	github.com/jhump/protoreflect v1.5.0
+	github.com/klauspost/compress v1.10.3
+	github.com/prometheus/client_golang v1.1.0
+	github.com/stretchr/testify v1.7.0
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/sdk v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	golang.org/x/net v0.0.0-20191009170851-d66e71096ffb
+	google.golang.org/genproto v0.0.0-20190819201941-24fa4b261c55
 	google.golang.org/grpc v1.24.0
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
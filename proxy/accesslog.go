@@ -0,0 +1,185 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// AccessLogEntry describes a proxied stream. Messages are counted as
+// received from the client (In) and sent to the client (Out).
+type AccessLogEntry struct {
+	Start   time.Time
+	Method  string
+	PeerIP  string
+	Backend string
+
+	// The following fields are only set on the end event.
+	Duration    time.Duration
+	MessagesIn  int64
+	MessagesOut int64
+	BytesIn     int64
+	BytesOut    int64
+	Code        codes.Code
+	Message     string
+
+	// Annotations holds the annotations of the call's CallInfo.
+	Annotations map[string]interface{}
+}
+
+// AccessLogger receives events for every proxied stream. Implementations
+// must be safe for concurrent use.
+type AccessLogger interface {
+	// StreamStart is called once the backend of a stream has been chosen.
+	StreamStart(ctx context.Context, e *AccessLogEntry)
+
+	// StreamEnd is called when a stream completes. It is called for every
+	// stream, including those rejected before reaching a backend, which
+	// have an empty Backend and no matching StreamStart.
+	StreamEnd(ctx context.Context, e *AccessLogEntry)
+}
+
+// WithAccessLogger sends stream events to l.
+func WithAccessLogger(l AccessLogger) Option {
+	return func(o *options) {
+		o.accessLog = l
+	}
+}
+
+// streamCounts counts the messages forwarded on a stream. The fields are
+// updated atomically, as the copy goroutines may outlive the handler.
+type streamCounts struct {
+	msgsIn, msgsOut   int64
+	bytesIn, bytesOut int64
+}
+
+func (ps *proxiedStream) logEntry() *AccessLogEntry {
+	return &AccessLogEntry{
+		Start:       ps.start,
+		Method:      ps.method,
+		PeerIP:      ps.peerIP,
+		Backend:     ps.backend,
+		Annotations: ps.info.Annotations(),
+	}
+}
+
+// startAccessLog reports the start of a stream and returns a ServerStream
+// which counts the messages forwarded on it.
+func startAccessLog(l AccessLogger, ps *proxiedStream, in grpc.ServerStream) grpc.ServerStream {
+	l.StreamStart(in.Context(), ps.logEntry())
+	return &countingServerStream{ServerStream: in, counts: &ps.counts}
+}
+
+func endAccessLog(ctx context.Context, l AccessLogger, ps *proxiedStream, err error) {
+	e := ps.logEntry()
+	e.Duration = time.Since(ps.start)
+	e.MessagesIn = atomic.LoadInt64(&ps.counts.msgsIn)
+	e.MessagesOut = atomic.LoadInt64(&ps.counts.msgsOut)
+	e.BytesIn = atomic.LoadInt64(&ps.counts.bytesIn)
+	e.BytesOut = atomic.LoadInt64(&ps.counts.bytesOut)
+	st := status.Convert(err)
+	e.Code, e.Message = st.Code(), st.Message()
+	l.StreamEnd(ctx, e)
+}
+
+type countingServerStream struct {
+	grpc.ServerStream
+	counts *streamCounts
+}
+
+func (s *countingServerStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if f, ok := m.(*frame); ok {
+		atomic.AddInt64(&s.counts.msgsIn, 1)
+		atomic.AddInt64(&s.counts.bytesIn, int64(len(f.payload)))
+	}
+	return nil
+}
+
+func (s *countingServerStream) SendMsg(m interface{}) error {
+	if err := s.ServerStream.SendMsg(m); err != nil {
+		return err
+	}
+	if f, ok := m.(*frame); ok {
+		atomic.AddInt64(&s.counts.msgsOut, 1)
+		atomic.AddInt64(&s.counts.bytesOut, int64(len(f.payload)))
+	}
+	return nil
+}
+
+// NewJSONAccessLogger returns an AccessLogger which writes one JSON object
+// per event and line to w.
+func NewJSONAccessLogger(w io.Writer) AccessLogger {
+	return &jsonAccessLogger{enc: json.NewEncoder(w)}
+}
+
+type jsonAccessLogger struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+type jsonAccessLogRecord struct {
+	Event       string  `json:"event"`
+	Time        string  `json:"time"`
+	Method      string  `json:"method"`
+	Peer        string  `json:"peer,omitempty"`
+	Backend     string  `json:"backend,omitempty"`
+	DurationMs  float64 `json:"duration_ms,omitempty"`
+	MessagesIn  int64   `json:"messages_in,omitempty"`
+	MessagesOut int64   `json:"messages_out,omitempty"`
+	BytesIn     int64   `json:"bytes_in,omitempty"`
+	BytesOut    int64   `json:"bytes_out,omitempty"`
+	Code        string  `json:"code,omitempty"`
+	Message     string  `json:"message,omitempty"`
+
+	Annotations map[string]interface{} `json:"annotations,omitempty"`
+}
+
+func (l *jsonAccessLogger) StreamStart(ctx context.Context, e *AccessLogEntry) {
+	l.write(&jsonAccessLogRecord{
+		Event:       "start",
+		Time:        e.Start.UTC().Format(time.RFC3339Nano),
+		Method:      e.Method,
+		Peer:        e.PeerIP,
+		Backend:     e.Backend,
+		Annotations: e.Annotations,
+	})
+}
+
+func (l *jsonAccessLogger) StreamEnd(ctx context.Context, e *AccessLogEntry) {
+	l.write(&jsonAccessLogRecord{
+		Event:       "end",
+		Time:        e.Start.Add(e.Duration).UTC().Format(time.RFC3339Nano),
+		Method:      e.Method,
+		Peer:        e.PeerIP,
+		Backend:     e.Backend,
+		DurationMs:  float64(e.Duration) / float64(time.Millisecond),
+		MessagesIn:  e.MessagesIn,
+		MessagesOut: e.MessagesOut,
+		BytesIn:     e.BytesIn,
+		BytesOut:    e.BytesOut,
+		Code:        e.Code.String(),
+		Message:     e.Message,
+		Annotations: e.Annotations,
+	})
+}
+
+func (l *jsonAccessLogger) write(r *jsonAccessLogRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Write errors cannot be reported to the stream, so they are dropped.
+	_ = l.enc.Encode(r)
+}
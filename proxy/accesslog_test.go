@@ -0,0 +1,120 @@
+package proxy_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+type recordingLogger struct {
+	mu           sync.Mutex
+	starts, ends []proxy.AccessLogEntry
+}
+
+func (l *recordingLogger) StreamStart(ctx context.Context, e *proxy.AccessLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.starts = append(l.starts, *e)
+}
+
+func (l *recordingLogger) StreamEnd(ctx context.Context, e *proxy.AccessLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ends = append(l.ends, *e)
+}
+
+func TestAccessLogger(t *testing.T) {
+	l := &recordingLogger{}
+	svc := &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			if ping.Value == "fail" {
+				return nil, status.Error(codes.FailedPrecondition, "failed")
+			}
+			return &pb.PingResponse{Value: ping.Value}, nil
+		},
+	}
+	env := newTestEnv(t, svc, proxy.WithAccessLogger(l))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err)
+	_, err = env.client.Ping(ctx, &pb.PingRequest{Value: "fail"})
+	require.Error(t, err)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	require.Len(t, l.starts, 2)
+	require.Len(t, l.ends, 2)
+
+	start, end := l.starts[0], l.ends[0]
+	assert.Equal(t, "/vgough.testproto.TestService/Ping", start.Method)
+	assert.Equal(t, "127.0.0.1", start.PeerIP)
+	assert.Equal(t, env.backendConn.Target(), start.Backend)
+	assert.Equal(t, start.Start, end.Start)
+	assert.Equal(t, codes.OK, end.Code)
+	assert.EqualValues(t, 1, end.MessagesIn)
+	assert.EqualValues(t, 1, end.MessagesOut)
+	assert.True(t, end.BytesIn > 0 && end.BytesOut > 0)
+	assert.True(t, end.Duration > 0)
+
+	assert.Equal(t, codes.FailedPrecondition, l.ends[1].Code)
+	assert.Equal(t, "failed", l.ends[1].Message)
+}
+
+func TestAccessLogger_Rejected(t *testing.T) {
+	l := &recordingLogger{}
+	mkDirector := func(*grpc.ClientConn) proxy.StreamDirector {
+		return func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+			return ctx, nil, proxy.Direction{}, status.Error(codes.PermissionDenied, "denied")
+		}
+	}
+	env := newTestEnvWithDirector(t, &pingService{}, mkDirector, proxy.WithAccessLogger(l))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	_, err := env.client.Ping(ctx, &pb.PingRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	assert.Empty(t, l.starts)
+	require.Len(t, l.ends, 1)
+	assert.Empty(t, l.ends[0].Backend)
+	assert.Equal(t, codes.PermissionDenied, l.ends[0].Code)
+}
+
+func TestJSONAccessLogger(t *testing.T) {
+	var buf bytes.Buffer
+	env := newTestEnv(t, &pingService{}, proxy.WithAccessLogger(proxy.NewJSONAccessLogger(&buf)))
+	ctx, cancel := env.ctx()
+	defer cancel()
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err)
+	env.Close()
+
+	dec := json.NewDecoder(&buf)
+	var start, end map[string]interface{}
+	require.NoError(t, dec.Decode(&start))
+	require.NoError(t, dec.Decode(&end))
+	assert.Equal(t, "start", start["event"])
+	assert.Equal(t, "/vgough.testproto.TestService/Ping", start["method"])
+	assert.Equal(t, "127.0.0.1", start["peer"])
+	assert.Equal(t, "end", end["event"])
+	assert.Equal(t, "OK", end["code"])
+	assert.EqualValues(t, 1, end["messages_in"])
+	assert.Contains(t, end, "duration_ms")
+}
@@ -0,0 +1,121 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ACL allows or denies calls by method, client identity and peer address
+// before they reach the director, see WithACL. Rules are evaluated in
+// order, and the first match decides.
+type ACL struct {
+	Rules []ACLRule
+
+	// DefaultAllow allows calls which match no rule. By default they are
+	// denied.
+	DefaultAllow bool
+
+	// Hide rejects denied calls with codes.Unimplemented, as if the method
+	// did not exist, rather than codes.PermissionDenied.
+	Hide bool
+}
+
+// ACLRule is a rule of an ACL. All non-empty fields must match for the rule
+// to apply, so a rule with only Deny set matches every call.
+type ACLRule struct {
+	// Deny rejects matching calls. Otherwise they are allowed.
+	Deny bool
+
+	// Method matches the full method name exactly, such as
+	// "/users.UserService/Get".
+	Method string
+
+	// MethodPrefix matches the beginning of the full method name, such as
+	// "/com.example.internal.".
+	MethodPrefix string
+
+	// MethodRegexp matches the full method name.
+	MethodRegexp *regexp.Regexp
+
+	// Subjects lists identities which match, see Identity. Calls without an
+	// identity never match a rule with subjects.
+	Subjects []string
+
+	// Peers lists the networks of client addresses which match.
+	Peers []*net.IPNet
+}
+
+// WithACL checks every call against acl, after the authenticator and before
+// the director.
+func WithACL(acl *ACL) Option {
+	return func(o *options) {
+		o.acl = acl
+	}
+}
+
+// Allowed reports whether a call to method from the client of ctx, with
+// the given peer IP address, is allowed.
+func (a *ACL) Allowed(ctx context.Context, method string, peerIP string) bool {
+	for i := range a.Rules {
+		if a.Rules[i].matches(ctx, method, peerIP) {
+			return !a.Rules[i].Deny
+		}
+	}
+	return a.DefaultAllow
+}
+
+// check returns the error for a denied call.
+func (a *ACL) check(ctx context.Context, method string, peerIP string) error {
+	if a.Allowed(ctx, method, peerIP) {
+		return nil
+	}
+	if a.Hide {
+		return status.Errorf(codes.Unimplemented, "Unknown method")
+	}
+	return status.Errorf(codes.PermissionDenied, "method %s is not allowed", method)
+}
+
+func (r *ACLRule) matches(ctx context.Context, method string, peerIP string) bool {
+	if r.Method != "" && method != r.Method {
+		return false
+	}
+	if !strings.HasPrefix(method, r.MethodPrefix) {
+		return false
+	}
+	if r.MethodRegexp != nil && !r.MethodRegexp.MatchString(method) {
+		return false
+	}
+	if len(r.Subjects) != 0 {
+		id, ok := IdentityFromContext(ctx)
+		if !ok || !hasValue(r.Subjects, id.Subject) {
+			return false
+		}
+	}
+	if len(r.Peers) != 0 && !inNetworks(r.Peers, peerIP) {
+		return false
+	}
+	return true
+}
+
+// inNetworks reports whether ip is in one of networks.
+func inNetworks(networks []*net.IPNet, ip string) bool {
+	addr := parseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range networks {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
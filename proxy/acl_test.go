@@ -0,0 +1,90 @@
+package proxy_test
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestACL_Allowed(t *testing.T) {
+	acl := &proxy.ACL{
+		Rules: []proxy.ACLRule{
+			{Method: "/users.UserService/Get"},
+			{MethodPrefix: "/com.example.internal.", Subjects: []string{"admin"}},
+			{MethodPrefix: "/com.example.internal.", Peers: []*net.IPNet{mustCIDR(t, "10.0.0.0/8"), mustCIDR(t, "fe80::/10")}},
+			{MethodPrefix: "/com.example.internal.", Deny: true},
+			{MethodRegexp: regexp.MustCompile(`/Delete\w*$`), Deny: true},
+		},
+		DefaultAllow: true,
+	}
+	admin := proxy.NewContextWithIdentity(context.Background(), &proxy.Identity{Subject: "admin"})
+	bob := proxy.NewContextWithIdentity(context.Background(), &proxy.Identity{Subject: "bob"})
+
+	tests := []struct {
+		ctx    context.Context
+		method string
+		peer   string
+		want   bool
+	}{
+		{bob, "/users.UserService/Get", "192.0.2.1", true},
+		{admin, "/com.example.internal.Admin/Reset", "192.0.2.1", true},
+		{bob, "/com.example.internal.Admin/Reset", "10.1.2.3", true},
+		{bob, "/com.example.internal.Admin/Reset", "192.0.2.1", false},
+		{bob, "/com.example.internal.Admin/Reset", "fe80::1%eth0", true},
+		{context.Background(), "/com.example.internal.Admin/Reset", "", false},
+		{bob, "/users.UserService/DeleteAll", "192.0.2.1", false},
+		{bob, "/users.UserService/List", "192.0.2.1", true},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, acl.Allowed(tc.ctx, tc.method, tc.peer), "%s from %s", tc.method, tc.peer)
+	}
+
+	acl.DefaultAllow = false
+	assert.False(t, acl.Allowed(bob, "/users.UserService/List", "192.0.2.1"), "unmatched calls are denied by default")
+}
+
+func TestACL(t *testing.T) {
+	var directed int
+	mkDirector := func(backend *grpc.ClientConn) proxy.StreamDirector {
+		return func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+			directed++
+			return ctx, nil, proxy.Direction{BackendConn: backend}, nil
+		}
+	}
+	acl := &proxy.ACL{Rules: []proxy.ACLRule{
+		{Method: "/vgough.testproto.TestService/Ping", Subjects: []string{"alice"}},
+		{Method: "/vgough.testproto.TestService/PingEmpty", Peers: []*net.IPNet{mustCIDR(t, "127.0.0.0/8")}},
+	}}
+	env := newTestEnvWithDirector(t, &pingService{}, mkDirector, proxy.WithAuthenticator(tokenAuth), proxy.WithACL(acl))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	alice := metadata.AppendToOutgoingContext(ctx, "authorization", "alice")
+	_, err := env.client.Ping(alice, &pb.PingRequest{Value: "alice"})
+	require.NoError(t, err)
+
+	bob := metadata.AppendToOutgoingContext(ctx, "authorization", "bob")
+	_, err = env.client.Ping(bob, &pb.PingRequest{Value: "bob"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = env.client.PingEmpty(bob, &pb.Empty{})
+	assert.NoError(t, err, "local peers may call PingEmpty")
+	_, err = env.client.PingError(alice, &pb.PingRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "unmatched calls are denied")
+	assert.Equal(t, 2, directed, "director is not called for denied calls")
+
+	acl.Hide = true
+	_, err = env.client.PingError(alice, &pb.PingRequest{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
@@ -0,0 +1,83 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package acme
+
+import (
+	"crypto/tls"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Config configures a Provider.
+type Config struct {
+	// Hosts are the domains which certificates are obtained for. Handshakes
+	// for other server names fail.
+	Hosts []string
+
+	// Email, if set, is the contact address of the ACME account, which
+	// the CA sends notices about expiring certificates to.
+	Email string
+
+	// CacheDir is the directory the account key and the certificates are
+	// kept in. It is created if it does not exist.
+	CacheDir string
+
+	// DirectoryURL is the directory of the CA. It defaults to that of Let's
+	// Encrypt. Use the staging directory of Let's Encrypt to try out a
+	// deployment without running into rate limits.
+	DirectoryURL string
+
+	// RenewBefore is how long before they expire certificates are renewed.
+	// It defaults to 30 days.
+	RenewBefore time.Duration
+}
+
+// Provider provides the certificates of Config.Hosts from an ACME CA.
+//
+// A Provider is safe for concurrent use.
+type Provider struct {
+	manager *autocert.Manager
+}
+
+// NewProvider returns a Provider for cfg. Using it implies accepting the
+// terms of service of the CA.
+func NewProvider(cfg Config) (*Provider, error) {
+	if len(cfg.Hosts) == 0 {
+		return nil, errors.New("acme: no hosts")
+	}
+	if cfg.CacheDir == "" {
+		return nil, errors.New("acme: no cache directory")
+	}
+	m := &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(cfg.CacheDir),
+		HostPolicy:  autocert.HostWhitelist(cfg.Hosts...),
+		RenewBefore: cfg.RenewBefore,
+		Email:       cfg.Email,
+	}
+	if cfg.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	}
+	return &Provider{manager: m}, nil
+}
+
+// GetCertificate returns the certificate for the server name of hello,
+// obtaining it first if needed, and answers TLS-ALPN-01 challenges. It is
+// for tls.Config of servers, see TLSConfig.
+func (p *Provider) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return p.manager.GetCertificate(hello)
+}
+
+// TLSConfig returns a configuration for a gRPC listener, which negotiates
+// the ACME challenge protocol besides HTTP/2.
+func (p *Provider) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: p.GetCertificate,
+		NextProtos:     []string{"h2", acme.ALPNProto},
+	}
+}
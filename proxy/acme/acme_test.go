@@ -0,0 +1,110 @@
+package acme_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy/acme"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cacheCert writes a self-signed certificate for host to dir, as the
+// Provider keeps certificates it obtained.
+func cacheCert(t *testing.T, dir, host string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, host), data, 0600))
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestNewProvider(t *testing.T) {
+	_, err := acme.NewProvider(acme.Config{CacheDir: "/tmp"})
+	assert.Error(t, err)
+	_, err = acme.NewProvider(acme.Config{Hosts: []string{"api.example.com"}})
+	assert.Error(t, err)
+}
+
+func TestProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acme")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cert := cacheCert(t, dir, "api.example.com")
+
+	p, err := acme.NewProvider(acme.Config{
+		Hosts:    []string{"api.example.com"},
+		CacheDir: dir,
+		// Nothing must be requested from the CA.
+		DirectoryURL: "http://127.0.0.1:1/directory",
+	})
+	require.NoError(t, err)
+	cfg := p.TLSConfig()
+	assert.Equal(t, []string{"h2", "acme-tls/1"}, cfg.NextProtos)
+
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	require.NoError(t, err)
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	handshake := func(serverName string) (*tls.ConnectionState, error) {
+		roots := x509.NewCertPool()
+		roots.AddCert(cert)
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", lis.Addr().String(), &tls.Config{
+			ServerName: serverName,
+			RootCAs:    roots,
+			NextProtos: []string{"h2"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		state := conn.ConnectionState()
+		return &state, nil
+	}
+
+	// The cached certificate is served.
+	state, err := handshake("api.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, cert.Raw, state.PeerCertificates[0].Raw)
+	assert.Equal(t, "h2", state.NegotiatedProtocol)
+
+	// Other hosts are refused.
+	_, err = handshake("other.example.com")
+	assert.Error(t, err)
+}
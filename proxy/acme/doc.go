@@ -0,0 +1,28 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+/*
+Package acme obtains and renews the server certificates of the proxy from an
+ACME certificate authority, such as Let's Encrypt, so that a standalone
+proxy needs no certificates provisioned for its public listener.
+
+Domains are validated with the TLS-ALPN-01 challenge, which the CA sends to
+port 443 of the domain, so the listener must be reachable on that port:
+
+	p, err := acme.NewProvider(acme.Config{
+		Hosts:    []string{"api.example.com"},
+		Email:    "ops@example.com",
+		CacheDir: "/var/lib/grpc-proxy/acme",
+	})
+	if err != nil {
+		...
+	}
+	s.AddListener(proxy.ServerListener{Listener: lis, TLS: p.TLSConfig()})
+
+Certificates are obtained on the first handshake for a host and renewed in
+the background before they expire. They are kept in CacheDir, so that a
+restarted proxy does not request them again and run into the rate limits of
+the CA.
+*/
+package acme
@@ -0,0 +1,295 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// AdaptiveAlgorithm is the algorithm adjusting the concurrency limits of an
+// AdaptiveLimiter.
+type AdaptiveAlgorithm int
+
+const (
+	// AIMD raises the limit by one while the backend keeps up, and cuts it
+	// by BackoffRatio when a stream is dropped or slower than
+	// LatencyThreshold.
+	AIMD AdaptiveAlgorithm = iota
+
+	// Gradient compares the latency of each stream with the long term
+	// average. The limit shrinks as latency grows above the average, which
+	// is a sign of queueing in the backend, and grows while it does not.
+	Gradient
+)
+
+func (a AdaptiveAlgorithm) String() string {
+	switch a {
+	case AIMD:
+		return "aimd"
+	case Gradient:
+		return "gradient"
+	default:
+		return "unknown"
+	}
+}
+
+// AdaptiveConcurrencyConfig configures the limiters created by
+// WithAdaptiveConcurrency.
+//
+// The latency of a stream is the time until the backend sends its headers,
+// or until the stream ends if it sends none, so that long-lived streams are
+// measured by how fast the backend takes them up.
+type AdaptiveConcurrencyConfig struct {
+	Algorithm AdaptiveAlgorithm
+
+	// InitialLimit is the limit of a backend before any stream completed.
+	// Defaults to 20.
+	InitialLimit int
+
+	// MinLimit and MaxLimit bound the limit. They default to 1 and 1000.
+	MinLimit int
+	MaxLimit int
+
+	// LatencyThreshold, for AIMD, is the latency above which a stream
+	// counts as dropped. Defaults to 1 second.
+	LatencyThreshold time.Duration
+
+	// BackoffRatio, for AIMD, is the factor applied to the limit when a
+	// stream is dropped. Defaults to 0.9.
+	BackoffRatio float64
+
+	// Tolerance, for Gradient, is how much latency may grow above the long
+	// term average before the limit shrinks. Defaults to 1.5.
+	Tolerance float64
+
+	// Smoothing, for Gradient, is the weight of each new limit against the
+	// current one, from 0 to 1. Defaults to 0.2.
+	Smoothing float64
+
+	// LongWindow, for Gradient, is the number of streams averaged in the
+	// long term latency. Defaults to 600.
+	LongWindow int
+
+	// IsDrop classifies the result of a stream. Dropped streams shrink the
+	// limit regardless of their latency. By default codes.ResourceExhausted,
+	// codes.Unavailable and codes.DeadlineExceeded are drops.
+	IsDrop func(err error) bool
+
+	// OnLimitChange, if set, is called whenever the limit of a backend
+	// changes.
+	OnLimitChange func(backend string, limit int)
+}
+
+// WithAdaptiveConcurrency limits the in-flight streams of every backend,
+// keyed by the target of the backend connection, to a limit adjusted by
+// the latency of its streams. Streams beyond the limit fail immediately
+// with codes.ResourceExhausted, shedding load while the backend is
+// degraded.
+func WithAdaptiveConcurrency(cfg AdaptiveConcurrencyConfig) Option {
+	return WithAdaptiveLimiter(NewAdaptiveLimiter(cfg))
+}
+
+// WithAdaptiveLimiter is like WithAdaptiveConcurrency, but uses the limits
+// of l, which may be shared by several handlers and inspected while
+// serving.
+func WithAdaptiveLimiter(l *AdaptiveLimiter) Option {
+	return func(o *options) {
+		o.adaptive = l
+	}
+}
+
+// NewAdaptiveLimiter returns the limiter of cfg, with no backends yet.
+func NewAdaptiveLimiter(cfg AdaptiveConcurrencyConfig) *AdaptiveLimiter {
+	if cfg.MinLimit <= 0 {
+		cfg.MinLimit = 1
+	}
+	if cfg.MaxLimit <= 0 {
+		cfg.MaxLimit = 1000
+	}
+	if cfg.InitialLimit <= 0 {
+		cfg.InitialLimit = 20
+	}
+	if cfg.LatencyThreshold <= 0 {
+		cfg.LatencyThreshold = time.Second
+	}
+	if cfg.BackoffRatio <= 0 || cfg.BackoffRatio >= 1 {
+		cfg.BackoffRatio = 0.9
+	}
+	if cfg.Tolerance < 1 {
+		cfg.Tolerance = 1.5
+	}
+	if cfg.Smoothing <= 0 || cfg.Smoothing > 1 {
+		cfg.Smoothing = 0.2
+	}
+	if cfg.LongWindow <= 0 {
+		cfg.LongWindow = 600
+	}
+	if cfg.IsDrop == nil {
+		cfg.IsDrop = isOverloaded
+	}
+	return &AdaptiveLimiter{cfg: cfg, backends: make(map[string]*adaptiveLimit)}
+}
+
+func isOverloaded(err error) bool {
+	switch status.Code(err) {
+	case codes.ResourceExhausted, codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// AdaptiveLimiter holds the adaptive concurrency limit of each backend, see
+// WithAdaptiveLimiter.
+type AdaptiveLimiter struct {
+	cfg AdaptiveConcurrencyConfig
+
+	mu       sync.Mutex
+	backends map[string]*adaptiveLimit
+}
+
+type adaptiveLimit struct {
+	limit    float64
+	inFlight int
+	// longRTT is the long term average latency in seconds, for Gradient.
+	longRTT float64
+}
+
+// Limit returns the current limit of backend.
+func (l *AdaptiveLimiter) Limit(backend string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.backends[backend]; ok {
+		return int(b.limit)
+	}
+	return l.cfg.InitialLimit
+}
+
+// InFlight returns the number of in-flight streams to backend.
+func (l *AdaptiveLimiter) InFlight(backend string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.backends[backend]; ok {
+		return b.inFlight
+	}
+	return 0
+}
+
+// acquire admits a stream to backend, or fails with
+// codes.ResourceExhausted if the backend is at its limit.
+func (l *AdaptiveLimiter) acquire(backend string) (*adaptiveStream, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.backends[backend]
+	if !ok {
+		b = &adaptiveLimit{limit: float64(l.cfg.InitialLimit)}
+		l.backends[backend] = b
+	}
+	if b.inFlight >= int(b.limit) {
+		return nil, status.Errorf(codes.ResourceExhausted, "backend %s is at its concurrency limit of %d", backend, int(b.limit))
+	}
+	b.inFlight++
+	return &adaptiveStream{l: l, backend: backend, b: b, start: time.Now()}, nil
+}
+
+// adaptiveStream is an admitted stream, whose latency is measured.
+type adaptiveStream struct {
+	l       *AdaptiveLimiter
+	backend string
+	b       *adaptiveLimit
+	start   time.Time
+
+	mu      sync.Mutex
+	latency time.Duration
+}
+
+// answered records the latency when the backend sent its headers.
+func (s *adaptiveStream) answered() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.latency == 0 {
+		s.latency = time.Since(s.start)
+	}
+}
+
+// finish releases the stream and adjusts the limit with its result.
+func (s *adaptiveStream) finish(err error) {
+	s.answered()
+	s.mu.Lock()
+	latency := s.latency
+	s.mu.Unlock()
+	dropped := err != nil && s.l.cfg.IsDrop(err)
+
+	l := s.l
+	l.mu.Lock()
+	s.b.inFlight--
+	before := int(s.b.limit)
+	l.update(s.b, latency, dropped)
+	after := int(s.b.limit)
+	l.mu.Unlock()
+	if before != after && l.cfg.OnLimitChange != nil {
+		l.cfg.OnLimitChange(s.backend, after)
+	}
+}
+
+// update adjusts the limit of b with a sample, with l.mu held.
+func (l *AdaptiveLimiter) update(b *adaptiveLimit, latency time.Duration, dropped bool) {
+	cfg := &l.cfg
+	limit := b.limit
+	switch cfg.Algorithm {
+	case Gradient:
+		rtt := latency.Seconds()
+		if rtt <= 0 {
+			rtt = 1e-6
+		}
+		if b.longRTT == 0 {
+			b.longRTT = rtt
+		} else {
+			b.longRTT += (rtt - b.longRTT) / float64(cfg.LongWindow)
+			if b.longRTT/rtt > 2 {
+				// Latency dropped well below the average, such as after
+				// recovering from an outage; let the average catch up.
+				b.longRTT *= 0.95
+			}
+		}
+		gradient := math.Max(0.5, math.Min(1, cfg.Tolerance*b.longRTT/rtt))
+		if dropped {
+			gradient = 0.5
+		} else if gradient == 1 && float64(b.inFlight+1)*2 < limit {
+			// Only grow while the limit is in use.
+			return
+		}
+		newLimit := limit*gradient + math.Sqrt(limit)
+		limit = limit*(1-cfg.Smoothing) + newLimit*cfg.Smoothing
+	default:
+		if dropped || latency > cfg.LatencyThreshold {
+			limit = math.Floor(limit * cfg.BackoffRatio)
+		} else if float64(b.inFlight+1)*2 >= limit {
+			// Only grow while the limit is in use.
+			limit++
+		}
+	}
+	b.limit = math.Max(float64(cfg.MinLimit), math.Min(float64(cfg.MaxLimit), limit))
+}
+
+// adaptiveClientStream measures the latency of a backend stream.
+type adaptiveClientStream struct {
+	grpc.ClientStream
+	s *adaptiveStream
+}
+
+func (c *adaptiveClientStream) Header() (metadata.MD, error) {
+	md, err := c.ClientStream.Header()
+	if err == nil {
+		c.s.answered()
+	}
+	return md, err
+}
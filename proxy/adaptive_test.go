@@ -0,0 +1,130 @@
+package proxy_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestAdaptiveConcurrency_Sheds(t *testing.T) {
+	l := proxy.NewAdaptiveLimiter(proxy.AdaptiveConcurrencyConfig{InitialLimit: 2})
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	svc := &pingService{
+		pingStream: func(stream pb.TestService_PingStreamServer) error {
+			started <- struct{}{}
+			<-release
+			return nil
+		},
+	}
+	env := newTestEnv(t, svc, proxy.WithAdaptiveLimiter(l))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	for i := 0; i < 2; i++ {
+		stream, err := env.client.PingStream(ctx)
+		require.NoError(t, err)
+		require.NoError(t, stream.Send(&pb.PingRequest{}))
+		<-started
+	}
+	backend := env.backendConn.Target()
+	assert.Equal(t, 2, l.InFlight(backend))
+
+	_, err := env.client.Ping(ctx, &pb.PingRequest{})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "streams beyond the limit are shed")
+	close(release)
+	assert.Eventually(t, func() bool { return l.InFlight(backend) == 0 }, time.Second, 5*time.Millisecond)
+}
+
+func TestAdaptiveConcurrency_AIMD(t *testing.T) {
+	changes := make(chan int, 10)
+	l := proxy.NewAdaptiveLimiter(proxy.AdaptiveConcurrencyConfig{
+		InitialLimit:     2,
+		LatencyThreshold: 20 * time.Millisecond,
+		BackoffRatio:     0.5,
+		OnLimitChange:    func(backend string, limit int) { changes <- limit },
+	})
+	var delay time.Duration
+	var fail error
+	svc := &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			time.Sleep(delay)
+			return &pb.PingResponse{}, fail
+		},
+	}
+	env := newTestEnv(t, svc, proxy.WithAdaptiveLimiter(l))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+	backend := env.backendConn.Target()
+
+	_, err := env.client.Ping(ctx, &pb.PingRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, 3, l.Limit(backend), "the limit grows while it is in use")
+	assert.Equal(t, 3, <-changes)
+
+	_, err = env.client.Ping(ctx, &pb.PingRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, 3, l.Limit(backend), "the limit does not grow beyond twice the streams")
+
+	delay = 30 * time.Millisecond
+	_, err = env.client.Ping(ctx, &pb.PingRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, l.Limit(backend), "slow streams cut the limit")
+	assert.Equal(t, 1, <-changes)
+
+	delay, fail = 0, status.Error(codes.Unavailable, "overloaded")
+	for i := 0; i < 2; i++ {
+		_, err = env.client.Ping(ctx, &pb.PingRequest{})
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	}
+	assert.Equal(t, 1, l.Limit(backend), "the limit stays above MinLimit")
+}
+
+func TestAdaptiveConcurrency_Gradient(t *testing.T) {
+	l := proxy.NewAdaptiveLimiter(proxy.AdaptiveConcurrencyConfig{
+		Algorithm:    proxy.Gradient,
+		InitialLimit: 10,
+		LongWindow:   10,
+	})
+	var delay time.Duration
+	svc := &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			time.Sleep(delay)
+			return &pb.PingResponse{}, nil
+		},
+	}
+	env := newTestEnv(t, svc, proxy.WithAdaptiveLimiter(l))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+	backend := env.backendConn.Target()
+
+	delay = time.Millisecond
+	for i := 0; i < 5; i++ {
+		_, err := env.client.Ping(ctx, &pb.PingRequest{})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 10, l.Limit(backend), "the limit does not grow while it is not in use")
+
+	delay = 50 * time.Millisecond
+	for i := 0; i < 3; i++ {
+		_, err := env.client.Ping(ctx, &pb.PingRequest{})
+		require.NoError(t, err)
+	}
+	assert.True(t, l.Limit(backend) < 10, "rising latency shrinks the limit, got %d", l.Limit(backend))
+}
+
+func TestAdaptiveAlgorithm_String(t *testing.T) {
+	assert.Equal(t, "aimd", proxy.AIMD.String())
+	assert.Equal(t, "gradient", proxy.Gradient.String())
+}
@@ -0,0 +1,58 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+/*
+Package admin serves an HTTP API for inspecting and operating a running
+proxy.
+
+A Handler reports the routes and backends of a proxy.Router, the in-flight
+streams of a proxy.StreamTracker and the circuits of proxy.CircuitBreakers,
+as JSON. It also lets operators drain single backends, shift traffic
+between the backends of a split route, switch routes for blue/green
+deployments, and inject faults to test the resilience of clients:
+
+	router := proxy.NewRouter()
+	streams := &proxy.StreamTracker{}
+	breakers := proxy.NewCircuitBreakers(proxy.CircuitBreakerConfig{ConsecutiveFailures: 5})
+	handler := proxy.TransparentHandler(router.Direct,
+		proxy.WithStreamTracker(streams),
+		proxy.WithCircuitBreakers(breakers),
+	)
+	...
+	a := &admin.Handler{Router: router, Streams: streams, Breakers: breakers}
+	http.Handle("/admin/", http.StripPrefix("/admin", a))
+
+The endpoints are:
+
+	GET  /status                    everything below in one document
+	GET  /routes                    the routing table
+	GET  /backends                  backends and the status of their endpoints
+	GET  /streams                   in-flight streams by method and backend
+	GET  /breakers                  circuit state by backend
+	GET  /switchovers               progress of the latest route switches
+	POST /backends/drain?name=N     stop routing new calls to backend N
+	POST /backends/resume?name=N    route calls to backend N again
+	POST /routes/split?route=R&weights=W[&method=M]
+	                                set the backend weights of route R, such
+	                                as "stable:95,canary:5", or those for
+	                                methods with prefix M
+	POST /routes/switch?route=R&to=B[&grace=D]
+	                                send all calls of route R to backend B,
+	                                cancelling the streams left on the old
+	                                backend after D (30s by default)
+	POST /breakers/reset?backend=B  close the circuit of backend B
+	GET  /faults                    the injected faults
+	POST /faults/set?method=M&...   inject faults into methods with prefix
+	                                M, with the parameters delay, delay_rate,
+	                                abort, abort_message, abort_rate,
+	                                truncate_after and truncate_rate, such
+	                                as "abort=UNAVAILABLE&abort_rate=0.1"
+	POST /faults/remove?method=M    remove the faults of prefix M
+	POST /faults/enable             inject the faults
+	POST /faults/disable            stop injecting faults, keeping them
+
+The API has no authentication of its own, so it should only be served on an
+internal address or behind an authenticating handler.
+*/
+package admin
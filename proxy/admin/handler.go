@@ -0,0 +1,520 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"google.golang.org/grpc/codes"
+)
+
+// Handler is the http.Handler of the admin API. Fields which are nil are
+// left out of the reports, and their actions fail with 404.
+type Handler struct {
+	Router   *proxy.Router
+	Streams  *proxy.StreamTracker
+	Breakers *proxy.CircuitBreakers
+	Drainer  *proxy.Drainer
+	Faults   *proxy.FaultInjector
+}
+
+// Status is the document served on /status.
+type Status struct {
+	Draining bool      `json:"draining"`
+	Active   int       `json:"active_streams"`
+	Routes   []Route   `json:"routes,omitempty"`
+	Backends []Backend `json:"backends,omitempty"`
+	Streams  []Streams `json:"streams,omitempty"`
+	// Breakers maps backend targets to their circuit state.
+	Breakers    map[string]string `json:"breakers,omitempty"`
+	Switchovers []Switchover      `json:"switchovers,omitempty"`
+	Faults      *Faults           `json:"faults,omitempty"`
+}
+
+// Route is a route of the routing table.
+type Route struct {
+	Name         string                    `json:"name,omitempty"`
+	MethodPrefix string                    `json:"method_prefix,omitempty"`
+	Authority    string                    `json:"authority,omitempty"`
+	Metadata     map[string]string         `json:"metadata,omitempty"`
+	Backend      string                    `json:"backend,omitempty"`
+	Split        map[string]int            `json:"split,omitempty"`
+	MethodSplits map[string]map[string]int `json:"method_splits,omitempty"`
+}
+
+// splitWeights maps the backends of a split to their weights.
+func splitWeights(split []proxy.BackendWeight) map[string]int {
+	if len(split) == 0 {
+		return nil
+	}
+	weights := make(map[string]int, len(split))
+	for _, bw := range split {
+		weights[bw.Backend] += bw.Weight
+	}
+	return weights
+}
+
+// Backend is a backend of the router.
+type Backend struct {
+	Name      string     `json:"name"`
+	Draining  bool       `json:"draining"`
+	Endpoints []Endpoint `json:"endpoints,omitempty"`
+}
+
+// Endpoint is an endpoint of a backend.
+type Endpoint struct {
+	Target  string `json:"target"`
+	State   string `json:"state"`
+	Weight  int    `json:"weight"`
+	Active  int    `json:"active_streams"`
+	Ejected bool   `json:"ejected,omitempty"`
+}
+
+// Switchover is the progress of a blue/green switch of a route.
+type Switchover struct {
+	Route     string    `json:"route"`
+	From      string    `json:"from,omitempty"`
+	To        string    `json:"to"`
+	Started   time.Time `json:"started"`
+	Deadline  time.Time `json:"deadline"`
+	Remaining int       `json:"remaining_streams"`
+	Cancelled int       `json:"cancelled_streams"`
+	Done      bool      `json:"done"`
+}
+
+// Streams counts the in-flight streams of a method to a backend.
+type Streams struct {
+	Method  string `json:"method"`
+	Backend string `json:"backend"`
+	Active  int    `json:"active"`
+}
+
+// Faults are the injected faults.
+type Faults struct {
+	Enabled bool    `json:"enabled"`
+	Faults  []Fault `json:"faults"`
+}
+
+// Fault is the fault injected into the methods with a prefix.
+type Fault struct {
+	Method        string  `json:"method"`
+	Delay         string  `json:"delay,omitempty"`
+	DelayRate     float64 `json:"delay_rate,omitempty"`
+	Abort         string  `json:"abort,omitempty"`
+	AbortMessage  string  `json:"abort_message,omitempty"`
+	AbortRate     float64 `json:"abort_rate,omitempty"`
+	TruncateAfter int     `json:"truncate_after,omitempty"`
+	TruncateRate  float64 `json:"truncate_rate,omitempty"`
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/status":
+		h.get(w, r, h.status)
+	case "/routes":
+		h.get(w, r, func() interface{} { return h.routes() })
+	case "/backends":
+		h.get(w, r, func() interface{} { return h.backends() })
+	case "/streams":
+		h.get(w, r, func() interface{} { return h.streams() })
+	case "/breakers":
+		h.get(w, r, func() interface{} { return h.breakers() })
+	case "/switchovers":
+		h.get(w, r, func() interface{} { return h.switchovers() })
+	case "/backends/drain":
+		h.backendAction(w, r, (*proxy.Router).DrainBackend)
+	case "/backends/resume":
+		h.backendAction(w, r, (*proxy.Router).ResumeBackend)
+	case "/routes/split":
+		h.setSplit(w, r)
+	case "/routes/switch":
+		h.switchRoute(w, r)
+	case "/breakers/reset":
+		h.resetBreaker(w, r)
+	case "/faults":
+		if h.Faults == nil {
+			http.NotFound(w, r)
+			return
+		}
+		h.get(w, r, func() interface{} { return h.faults() })
+	case "/faults/set":
+		h.setFault(w, r)
+	case "/faults/remove":
+		h.faultAction(w, r, func(f *proxy.FaultInjector, q url.Values) error {
+			f.Remove(q.Get("method"))
+			return nil
+		})
+	case "/faults/enable":
+		h.faultAction(w, r, func(f *proxy.FaultInjector, q url.Values) error {
+			f.Enable()
+			return nil
+		})
+	case "/faults/disable":
+		h.faultAction(w, r, func(f *proxy.FaultInjector, q url.Values) error {
+			f.Disable()
+			return nil
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *Handler) get(w http.ResponseWriter, r *http.Request, report func() interface{}) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, report())
+}
+
+func (h *Handler) status() interface{} {
+	s := &Status{
+		Routes:   h.routes(),
+		Backends: h.backends(),
+		Streams:  h.streams(),
+		Breakers: h.breakers(),
+
+		Switchovers: h.switchovers(),
+		Faults:      h.faults(),
+	}
+	if h.Drainer != nil {
+		s.Draining = h.Drainer.Draining()
+		s.Active = h.Drainer.Active()
+	} else if h.Streams != nil {
+		s.Active = h.Streams.Active()
+	}
+	return s
+}
+
+func (h *Handler) routes() []Route {
+	if h.Router == nil {
+		return nil
+	}
+	routes := []Route{}
+	for _, r := range h.Router.Routes() {
+		route := Route{
+			Name:         r.Name,
+			MethodPrefix: r.MethodPrefix,
+			Authority:    r.Authority,
+			Metadata:     r.Metadata,
+			Backend:      r.Backend,
+			Split:        splitWeights(r.Split),
+		}
+		for prefix, split := range r.MethodSplits {
+			if route.MethodSplits == nil {
+				route.MethodSplits = make(map[string]map[string]int)
+			}
+			route.MethodSplits[prefix] = splitWeights(split)
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+func (h *Handler) backends() []Backend {
+	if h.Router == nil {
+		return nil
+	}
+	backends := []Backend{}
+	for _, b := range h.Router.Backends() {
+		backend := Backend{Name: b.Name, Draining: b.Draining}
+		for _, ep := range b.Endpoints {
+			backend.Endpoints = append(backend.Endpoints, Endpoint{
+				Target:  ep.Target,
+				State:   ep.State.String(),
+				Weight:  ep.Weight,
+				Active:  ep.Active,
+				Ejected: ep.Ejected,
+			})
+		}
+		backends = append(backends, backend)
+	}
+	return backends
+}
+
+func (h *Handler) switchovers() []Switchover {
+	if h.Router == nil {
+		return nil
+	}
+	switchovers := []Switchover{}
+	for _, s := range h.Router.Switchovers() {
+		switchovers = append(switchovers, switchover(s))
+	}
+	return switchovers
+}
+
+func switchover(s proxy.SwitchoverStatus) Switchover {
+	return Switchover{
+		Route:     s.Route,
+		From:      s.From,
+		To:        s.To,
+		Started:   s.Started,
+		Deadline:  s.Deadline,
+		Remaining: s.Remaining,
+		Cancelled: s.Cancelled,
+		Done:      s.Done,
+	}
+}
+
+func (h *Handler) streams() []Streams {
+	if h.Streams == nil {
+		return nil
+	}
+	streams := []Streams{}
+	for _, s := range h.Streams.Streams() {
+		streams = append(streams, Streams{Method: s.Method, Backend: s.Backend, Active: s.Active})
+	}
+	return streams
+}
+
+func (h *Handler) breakers() map[string]string {
+	if h.Breakers == nil {
+		return nil
+	}
+	states := make(map[string]string)
+	for backend, state := range h.Breakers.States() {
+		states[backend] = state.String()
+	}
+	return states
+}
+
+// backendAction applies action to the backend named by the name parameter.
+func (h *Handler) backendAction(w http.ResponseWriter, r *http.Request, action func(*proxy.Router, string)) {
+	if !requirePost(w, r) {
+		return
+	}
+	if h.Router == nil {
+		http.NotFound(w, r)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "missing name parameter", http.StatusBadRequest)
+		return
+	}
+	action(h.Router, name)
+	writeJSON(w, http.StatusOK, h.backends())
+}
+
+// setSplit changes the weights of a route from the weights parameter, a
+// list such as "stable:95,canary:5". Empty weights remove the split.
+func (h *Handler) setSplit(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	if h.Router == nil {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	route := q.Get("route")
+	if route == "" {
+		http.Error(w, "missing route parameter", http.StatusBadRequest)
+		return
+	}
+	split, err := parseWeights(q.Get("weights"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.Router.SetSplit(route, q.Get("method"), split) {
+		http.Error(w, "no route named "+route, http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, h.routes())
+}
+
+// switchRoute switches a route to another backend. The grace parameter is
+// a duration such as "30s", and defaults to 30 seconds.
+func (h *Handler) switchRoute(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	if h.Router == nil {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	route, to := q.Get("route"), q.Get("to")
+	if route == "" || to == "" {
+		http.Error(w, "missing route or to parameter", http.StatusBadRequest)
+		return
+	}
+	grace := 30 * time.Second
+	if g := q.Get("grace"); g != "" {
+		var err error
+		if grace, err = time.ParseDuration(g); err != nil || grace < 0 {
+			http.Error(w, "bad grace parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	s, err := h.Router.Switch(route, to, grace)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, switchover(s.Status()))
+}
+
+func parseWeights(s string) ([]proxy.BackendWeight, error) {
+	var split []proxy.BackendWeight
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		i := strings.LastIndex(part, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("bad weight %q, want backend:weight", part)
+		}
+		weight, err := strconv.Atoi(part[i+1:])
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("bad weight %q, want backend:weight", part)
+		}
+		split = append(split, proxy.BackendWeight{Backend: part[:i], Weight: weight})
+	}
+	return split, nil
+}
+
+func (h *Handler) resetBreaker(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	if h.Breakers == nil {
+		http.NotFound(w, r)
+		return
+	}
+	backend := r.URL.Query().Get("backend")
+	if backend == "" {
+		http.Error(w, "missing backend parameter", http.StatusBadRequest)
+		return
+	}
+	if !h.Breakers.Reset(backend) {
+		http.Error(w, "no circuit for backend "+backend, http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, h.breakers())
+}
+
+func (h *Handler) faults() *Faults {
+	if h.Faults == nil {
+		return nil
+	}
+	faults := &Faults{Enabled: h.Faults.Enabled(), Faults: []Fault{}}
+	for _, mf := range h.Faults.Faults() {
+		f := Fault{
+			Method:        mf.Prefix,
+			DelayRate:     mf.DelayRate,
+			AbortMessage:  mf.AbortMessage,
+			AbortRate:     mf.AbortRate,
+			TruncateAfter: mf.TruncateAfter,
+			TruncateRate:  mf.TruncateRate,
+		}
+		if mf.Delay > 0 {
+			f.Delay = mf.Delay.String()
+		}
+		if mf.AbortRate > 0 {
+			f.Abort = mf.Abort.String()
+		}
+		faults.Faults = append(faults.Faults, f)
+	}
+	return faults
+}
+
+// faultAction applies action to the fault injector and reports the faults.
+func (h *Handler) faultAction(w http.ResponseWriter, r *http.Request, action func(*proxy.FaultInjector, url.Values) error) {
+	if !requirePost(w, r) {
+		return
+	}
+	if h.Faults == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if err := action(h.Faults, r.URL.Query()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, h.faults())
+}
+
+// setFault sets the fault of the methods with the prefix of the method
+// parameter, which may be empty for all methods. The other parameters are
+// the fields of Fault; abort is a code name such as "UNAVAILABLE", or its
+// number.
+func (h *Handler) setFault(w http.ResponseWriter, r *http.Request) {
+	h.faultAction(w, r, func(faults *proxy.FaultInjector, q url.Values) error {
+		var f proxy.Fault
+		var err error
+		if d := q.Get("delay"); d != "" {
+			if f.Delay, err = time.ParseDuration(d); err != nil || f.Delay < 0 {
+				return fmt.Errorf("bad delay parameter")
+			}
+		}
+		if a := q.Get("abort"); a != "" {
+			if f.Abort, err = parseCode(a); err != nil {
+				return err
+			}
+		}
+		if n := q.Get("truncate_after"); n != "" {
+			if f.TruncateAfter, err = strconv.Atoi(n); err != nil || f.TruncateAfter < 0 {
+				return fmt.Errorf("bad truncate_after parameter")
+			}
+		}
+		f.AbortMessage = q.Get("abort_message")
+		for name, rate := range map[string]*float64{
+			"delay_rate":    &f.DelayRate,
+			"abort_rate":    &f.AbortRate,
+			"truncate_rate": &f.TruncateRate,
+		} {
+			if v := q.Get(name); v != "" {
+				if *rate, err = strconv.ParseFloat(v, 64); err != nil || *rate < 0 || *rate > 1 {
+					return fmt.Errorf("bad %s parameter, want a rate from 0 to 1", name)
+				}
+			}
+		}
+		faults.Set(q.Get("method"), f)
+		return nil
+	})
+}
+
+// parseCode parses a status code by name, in any case and with or without
+// underscores, or by number.
+func parseCode(s string) (codes.Code, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil && n <= uint64(codes.Unauthenticated) {
+		return codes.Code(n), nil
+	}
+	name := strings.Replace(strings.ToLower(s), "_", "", -1)
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		if strings.ToLower(c.String()) == name {
+			return c, nil
+		}
+	}
+	return codes.OK, fmt.Errorf("bad status code %q", s)
+}
+
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
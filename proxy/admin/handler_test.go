@@ -0,0 +1,254 @@
+package admin_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/mkxxx/grpc-proxy/proxy/admin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+type echoService struct{}
+
+func (echoService) PingEmpty(ctx context.Context, _ *pb.Empty) (*pb.PingResponse, error) {
+	return &pb.PingResponse{}, nil
+}
+
+func (echoService) Ping(ctx context.Context, req *pb.PingRequest) (*pb.PingResponse, error) {
+	return &pb.PingResponse{Value: req.Value}, nil
+}
+
+func (echoService) PingError(ctx context.Context, req *pb.PingRequest) (*pb.Empty, error) {
+	return nil, status.Error(codes.Unavailable, req.Value)
+}
+
+func (echoService) PingList(req *pb.PingRequest, stream pb.TestService_PingListServer) error {
+	return nil
+}
+
+func (echoService) PingStream(stream pb.TestService_PingStreamServer) error {
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+		if err := stream.Send(&pb.PingResponse{Value: req.Value}); err != nil {
+			return err
+		}
+	}
+}
+
+func listen(t *testing.T, s *grpc.Server) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(lis)
+	return lis.Addr().String()
+}
+
+func TestHandler(t *testing.T) {
+	backend := grpc.NewServer()
+	pb.RegisterTestServiceServer(backend, echoService{})
+	backendAddr := listen(t, backend)
+	defer backend.Stop()
+	backendConn, err := grpc.Dial(backendAddr, grpc.WithInsecure(), proxy.DialOption())
+	require.NoError(t, err)
+	defer backendConn.Close()
+
+	router := proxy.NewRouter()
+	router.AddBalancedBackend("test", proxy.NewLeastStreamsBalancer(proxy.Endpoints(backendConn)...))
+	router.AddRoute(proxy.Route{MethodPrefix: "/vgough.testproto.TestService/", Backend: "test"})
+	streams := &proxy.StreamTracker{}
+	breakers := proxy.NewCircuitBreakers(proxy.CircuitBreakerConfig{ConsecutiveFailures: 1, OpenTimeout: time.Hour})
+	drainer := &proxy.Drainer{}
+	p := grpc.NewServer(
+		proxy.ServerOption(),
+		grpc.UnknownServiceHandler(proxy.TransparentHandler(router.Direct,
+			proxy.WithStreamTracker(streams),
+			proxy.WithCircuitBreakers(breakers),
+			proxy.WithDrainer(drainer),
+		)),
+	)
+	proxyAddr := listen(t, p)
+	defer p.Stop()
+	conn, err := grpc.Dial(proxyAddr, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	client := pb.NewTestServiceClient(conn)
+
+	srv := httptest.NewServer(&admin.Handler{Router: router, Streams: streams, Breakers: breakers, Drainer: drainer})
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := client.PingStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.PingRequest{Value: "foo"}))
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	var st admin.Status
+	require.Equal(t, http.StatusOK, getJSON(t, srv.URL+"/status", &st))
+	assert.Equal(t, 1, st.Active)
+	assert.False(t, st.Draining)
+	assert.Equal(t, []admin.Route{{MethodPrefix: "/vgough.testproto.TestService/", Backend: "test"}}, st.Routes)
+	require.Len(t, st.Backends, 1)
+	require.Len(t, st.Backends[0].Endpoints, 1)
+	assert.Equal(t, backendAddr, st.Backends[0].Endpoints[0].Target)
+	assert.Equal(t, "READY", st.Backends[0].Endpoints[0].State)
+	assert.Equal(t, 1, st.Backends[0].Endpoints[0].Active)
+	assert.Equal(t, []admin.Streams{{Method: "/vgough.testproto.TestService/PingStream", Backend: backendAddr, Active: 1}}, st.Streams)
+	assert.Equal(t, map[string]string{backendAddr: "closed"}, st.Breakers)
+	require.NoError(t, stream.CloseSend())
+
+	// A failure trips the circuit, which can be reset.
+	_, err = client.PingError(ctx, &pb.PingRequest{Value: "down"})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	var breakerStates map[string]string
+	getJSON(t, srv.URL+"/breakers", &breakerStates)
+	assert.Equal(t, "open", breakerStates[backendAddr])
+	assert.Equal(t, http.StatusOK, post(t, srv.URL+"/breakers/reset?backend="+backendAddr))
+	getJSON(t, srv.URL+"/breakers", &breakerStates)
+	assert.Equal(t, "closed", breakerStates[backendAddr])
+	assert.Equal(t, http.StatusNotFound, post(t, srv.URL+"/breakers/reset?backend=unknown"))
+
+	// A drained backend receives no new calls.
+	assert.Equal(t, http.StatusOK, post(t, srv.URL+"/backends/drain?name=test"))
+	_, err = client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	var backends []admin.Backend
+	getJSON(t, srv.URL+"/backends", &backends)
+	assert.True(t, backends[0].Draining)
+	assert.Equal(t, http.StatusOK, post(t, srv.URL+"/backends/resume?name=test"))
+	_, err = client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusBadRequest, post(t, srv.URL+"/backends/drain"))
+	assert.Equal(t, http.StatusMethodNotAllowed, post(t, srv.URL+"/status"))
+	assert.Equal(t, http.StatusMethodNotAllowed, getJSON(t, srv.URL+"/backends/drain?name=test", nil))
+	assert.Equal(t, http.StatusNotFound, getJSON(t, srv.URL+"/nope", nil))
+}
+
+func TestHandler_Empty(t *testing.T) {
+	srv := httptest.NewServer(&admin.Handler{})
+	defer srv.Close()
+	var st map[string]interface{}
+	require.Equal(t, http.StatusOK, getJSON(t, srv.URL+"/status", &st))
+	assert.Equal(t, map[string]interface{}{"draining": false, "active_streams": 0.0}, st)
+	assert.Equal(t, http.StatusNotFound, post(t, srv.URL+"/backends/drain?name=x"))
+}
+
+func getJSON(t *testing.T, url string, v interface{}) int {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && v != nil {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+	return resp.StatusCode
+}
+
+func post(t *testing.T, url string) int {
+	resp, err := http.Post(url, "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestHandler_Split(t *testing.T) {
+	router := proxy.NewRouter()
+	router.AddRoute(proxy.Route{Name: "users", MethodPrefix: "/users.", Backend: "stable"})
+	srv := httptest.NewServer(&admin.Handler{Router: router})
+	defer srv.Close()
+
+	assert.Equal(t, http.StatusOK, post(t, srv.URL+"/routes/split?route=users&weights=stable:95,canary:5"))
+	assert.Equal(t, http.StatusOK, post(t, srv.URL+"/routes/split?route=users&method=/users.UserService/Delete&weights=stable:1"))
+	var routes []admin.Route
+	getJSON(t, srv.URL+"/routes", &routes)
+	require.Len(t, routes, 1)
+	assert.Equal(t, map[string]int{"stable": 95, "canary": 5}, routes[0].Split)
+	assert.Equal(t, map[string]map[string]int{"/users.UserService/Delete": {"stable": 1}}, routes[0].MethodSplits)
+	assert.Equal(t, []proxy.BackendWeight{{Backend: "stable", Weight: 95}, {Backend: "canary", Weight: 5}}, router.Routes()[0].Split)
+
+	assert.Equal(t, http.StatusOK, post(t, srv.URL+"/routes/split?route=users"))
+	assert.Nil(t, router.Routes()[0].Split, "empty weights remove the split")
+
+	assert.Equal(t, http.StatusNotFound, post(t, srv.URL+"/routes/split?route=missing&weights=a:1"))
+	assert.Equal(t, http.StatusBadRequest, post(t, srv.URL+"/routes/split?route=users&weights=stable"))
+	assert.Equal(t, http.StatusBadRequest, post(t, srv.URL+"/routes/split?route=users&weights=stable:-1"))
+	assert.Equal(t, http.StatusBadRequest, post(t, srv.URL+"/routes/split?weights=stable:1"))
+}
+
+func TestHandler_Switch(t *testing.T) {
+	conn, err := grpc.Dial("127.0.0.1:1", grpc.WithInsecure(), proxy.DialOption())
+	require.NoError(t, err)
+	defer conn.Close()
+	router := proxy.NewRouter()
+	router.AddBackend("blue", conn)
+	router.AddBackend("green", conn)
+	router.AddRoute(proxy.Route{Name: "api", Backend: "blue"})
+	srv := httptest.NewServer(&admin.Handler{Router: router})
+	defer srv.Close()
+
+	assert.Equal(t, http.StatusOK, post(t, srv.URL+"/routes/switch?route=api&to=green&grace=1s"))
+	assert.Equal(t, "green", router.Routes()[0].Backend)
+	var switchovers []admin.Switchover
+	getJSON(t, srv.URL+"/switchovers", &switchovers)
+	require.Len(t, switchovers, 1)
+	assert.Equal(t, "blue", switchovers[0].From)
+	assert.Equal(t, "green", switchovers[0].To)
+
+	assert.Equal(t, http.StatusNotFound, post(t, srv.URL+"/routes/switch?route=api&to=missing"))
+	assert.Equal(t, http.StatusBadRequest, post(t, srv.URL+"/routes/switch?route=api&to=blue&grace=soon"))
+	assert.Equal(t, http.StatusBadRequest, post(t, srv.URL+"/routes/switch?route=api"))
+}
+
+func TestHandler_Faults(t *testing.T) {
+	faults := proxy.NewFaultInjector()
+	srv := httptest.NewServer(&admin.Handler{Faults: faults})
+	defer srv.Close()
+
+	assert.Equal(t, http.StatusOK, post(t, srv.URL+"/faults/set?method=/users.&abort=resource_exhausted&abort_rate=0.5&delay=100ms&delay_rate=1"))
+	assert.Equal(t, http.StatusOK, post(t, srv.URL+"/faults/set?method=/users.UserService/List&truncate_after=3&truncate_rate=0.25"))
+	assert.Equal(t, []proxy.MethodFault{
+		{Prefix: "/users.", Fault: proxy.Fault{Abort: codes.ResourceExhausted, AbortRate: 0.5, Delay: 100 * time.Millisecond, DelayRate: 1}},
+		{Prefix: "/users.UserService/List", Fault: proxy.Fault{TruncateAfter: 3, TruncateRate: 0.25}},
+	}, faults.Faults())
+
+	var got admin.Faults
+	require.Equal(t, http.StatusOK, getJSON(t, srv.URL+"/faults", &got))
+	assert.True(t, got.Enabled)
+	require.Len(t, got.Faults, 2)
+	assert.Equal(t, admin.Fault{Method: "/users.", Delay: "100ms", DelayRate: 1, Abort: "ResourceExhausted", AbortRate: 0.5}, got.Faults[0])
+
+	assert.Equal(t, http.StatusOK, post(t, srv.URL+"/faults/disable"))
+	assert.False(t, faults.Enabled())
+	assert.Equal(t, http.StatusOK, post(t, srv.URL+"/faults/enable"))
+	assert.True(t, faults.Enabled())
+	assert.Equal(t, http.StatusOK, post(t, srv.URL+"/faults/remove?method=/users."))
+	assert.Len(t, faults.Faults(), 1)
+
+	assert.Equal(t, http.StatusOK, post(t, srv.URL+"/faults/set?abort=14&abort_rate=1"))
+	assert.Equal(t, codes.Unavailable, faults.Faults()[0].Abort)
+	assert.Equal(t, http.StatusBadRequest, post(t, srv.URL+"/faults/set?abort=sometimes"))
+	assert.Equal(t, http.StatusBadRequest, post(t, srv.URL+"/faults/set?abort_rate=2"))
+	assert.Equal(t, http.StatusBadRequest, post(t, srv.URL+"/faults/set?delay=soon"))
+	assert.Equal(t, http.StatusBadRequest, post(t, srv.URL+"/faults/set?truncate_after=-1"))
+	assert.Equal(t, http.StatusMethodNotAllowed, getJSON(t, srv.URL+"/faults/enable", nil))
+
+	empty := httptest.NewServer(&admin.Handler{})
+	defer empty.Close()
+	assert.Equal(t, http.StatusNotFound, getJSON(t, empty.URL+"/faults", nil))
+	assert.Equal(t, http.StatusNotFound, post(t, empty.URL+"/faults/enable"))
+}
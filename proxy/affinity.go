@@ -0,0 +1,100 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// AffinityConfig configures NewAffinityBalancer. The session key of a call
+// is the value of MetadataKey, or else of the identity claim Claim.
+type AffinityConfig struct {
+	// MetadataKey is an incoming metadata key identifying the session, such
+	// as "session-id".
+	MetadataKey string
+
+	// Claim is a claim of the client Identity identifying the session, such
+	// as "sub".
+	Claim string
+
+	// Replicas is the number of points of an endpoint on the hash ring, per
+	// unit of weight. More points spread sessions more evenly. Defaults to
+	// 100.
+	Replicas int
+}
+
+// NewAffinityBalancer returns a Balancer which sends all calls of a session
+// to the same endpoint, and calls without a session key to b.
+//
+// Sessions are placed with consistent hashing, so that adding or removing an
+// endpoint only moves the sessions of that endpoint, and endpoints receive
+// sessions in proportion to their weights. Wrap the affinity balancer with
+// NewOutlierBalancer to move the sessions of failing endpoints.
+func NewAffinityBalancer(b Balancer, cfg AffinityConfig) Balancer {
+	if cfg.Replicas <= 0 {
+		cfg.Replicas = 100
+	}
+	return &affinityBalancer{inner: b, cfg: cfg, ring: &hashRing{}}
+}
+
+type affinityBalancer struct {
+	inner Balancer
+	cfg   AffinityConfig
+
+	mu   sync.Mutex
+	ring *hashRing
+}
+
+func (b *affinityBalancer) Pick(ctx context.Context, method string) (*grpc.ClientConn, func(error), error) {
+	key, ok := b.sessionKey(ctx)
+	if !ok {
+		return b.inner.Pick(ctx, method)
+	}
+	b.mu.Lock()
+	ring := b.ring
+	b.mu.Unlock()
+	conn := ring.pick(hashKey(key))
+	if conn == nil {
+		return nil, nil, errNoEndpoints
+	}
+	return conn, nil, nil
+}
+
+func (b *affinityBalancer) sessionKey(ctx context.Context) (string, bool) {
+	if b.cfg.MetadataKey != "" {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if values := md.Get(b.cfg.MetadataKey); len(values) != 0 && values[0] != "" {
+			return values[0], true
+		}
+	}
+	if b.cfg.Claim != "" {
+		if id, ok := IdentityFromContext(ctx); ok {
+			if v, ok := id.Claims[b.cfg.Claim]; ok && v != nil {
+				return fmt.Sprint(v), true
+			}
+		}
+	}
+	return "", false
+}
+
+func (b *affinityBalancer) Update(endpoints []Endpoint) {
+	ring := newHashRing(endpoints, b.cfg.Replicas)
+	b.mu.Lock()
+	b.ring = ring
+	b.mu.Unlock()
+	b.inner.Update(endpoints)
+}
+
+func (b *affinityBalancer) Status() []EndpointStatus {
+	if r, ok := b.inner.(StatusReporter); ok {
+		return r.Status()
+	}
+	return nil
+}
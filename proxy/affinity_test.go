@@ -0,0 +1,95 @@
+package proxy_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func sessionCtx(id string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("session-id", id))
+}
+
+func pickSessions(t *testing.T, b proxy.Balancer, n int) map[string]*grpc.ClientConn {
+	picks := make(map[string]*grpc.ClientConn, n)
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("session-%d", i)
+		conn, _, err := b.Pick(sessionCtx(id), "/svc/method")
+		require.NoError(t, err)
+		picks[id] = conn
+	}
+	return picks
+}
+
+func TestAffinityBalancer(t *testing.T) {
+	conns := idleConns(t, 4)
+	defer closeConns(conns)
+	b := proxy.NewAffinityBalancer(proxy.NewRoundRobinBalancer(proxy.Endpoints(conns...)...),
+		proxy.AffinityConfig{MetadataKey: "session-id"})
+	b.Update(proxy.Endpoints(conns...))
+
+	picks := pickSessions(t, b, 1000)
+	for id, conn := range pickSessions(t, b, 1000) {
+		assert.True(t, picks[id] == conn, "session %s must stick to its endpoint", id)
+	}
+	counts := map[*grpc.ClientConn]int{}
+	for _, conn := range picks {
+		counts[conn]++
+	}
+	for _, conn := range conns {
+		assert.InDelta(t, 250, counts[conn], 100, "sessions are spread evenly")
+	}
+
+	// Removing an endpoint only moves its own sessions.
+	b.Update(proxy.Endpoints(conns[:3]...))
+	for id, conn := range pickSessions(t, b, 1000) {
+		if picks[id] != conns[3] {
+			assert.True(t, picks[id] == conn, "session %s must not move", id)
+		} else {
+			assert.True(t, conns[3] != conn, "session %s must move", id)
+		}
+	}
+
+	// Calls without a session use the inner balancer.
+	assert.Len(t, pickCounts(t, b, 30), 3)
+}
+
+func TestAffinityBalancer_Weights(t *testing.T) {
+	conns := idleConns(t, 2)
+	defer closeConns(conns)
+	endpoints := []proxy.Endpoint{{Conn: conns[0], Weight: 3}, {Conn: conns[1]}}
+	b := proxy.NewAffinityBalancer(proxy.NewRoundRobinBalancer(endpoints...), proxy.AffinityConfig{MetadataKey: "session-id"})
+	b.Update(endpoints)
+
+	counts := map[*grpc.ClientConn]int{}
+	for _, conn := range pickSessions(t, b, 1000) {
+		counts[conn]++
+	}
+	assert.InDelta(t, 750, counts[conns[0]], 100)
+}
+
+func TestAffinityBalancer_Claim(t *testing.T) {
+	conns := idleConns(t, 4)
+	defer closeConns(conns)
+	b := proxy.NewAffinityBalancer(proxy.NewRoundRobinBalancer(), proxy.AffinityConfig{Claim: "sub"})
+	b.Update(proxy.Endpoints(conns...))
+
+	ctx := proxy.NewContextWithIdentity(context.Background(), &proxy.Identity{Claims: map[string]interface{}{"sub": "alice"}})
+	first, _, err := b.Pick(ctx, "/svc/method")
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		conn, _, err := b.Pick(ctx, "/svc/method")
+		require.NoError(t, err)
+		assert.True(t, first == conn)
+	}
+
+	b.Update(nil)
+	_, _, err = b.Pick(ctx, "/svc/method")
+	assert.Error(t, err, "no endpoints")
+}
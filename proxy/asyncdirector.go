@@ -0,0 +1,179 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// AsyncDirectorConfig configures NewAsyncDirector.
+type AsyncDirectorConfig struct {
+	// Timeout limits how long a call waits for the director, including the
+	// wait for a free slot. It is required.
+	Timeout time.Duration
+
+	// MaxConcurrent, if positive, limits the number of directors running at
+	// once. Calls wait for a slot to free up.
+	MaxConcurrent int
+
+	// MaxQueue, if positive, limits the number of calls waiting for a slot.
+	// Further calls fail right away.
+	MaxQueue int
+}
+
+// NewAsyncDirector returns a StreamDirector which runs director with a
+// timeout and bounded concurrency, for directors which make slow lookups,
+// such as calls to a control plane. Calls which are not directed in time
+// fail with codes.Unavailable, so that they do not pile up while the
+// control plane is slow.
+//
+// The context passed to director is done once the timeout passes, even
+// though its deadline is that of the call, so that the backend call is not
+// limited by the timeout. A director which ignores its context keeps its
+// slot until it returns, and anything it returns too late is released: its
+// cancel function is called, and Done with the error of the call.
+func NewAsyncDirector(director StreamDirector, cfg AsyncDirectorConfig) StreamDirector {
+	d := &asyncDirector{director: director, cfg: cfg}
+	if cfg.MaxConcurrent > 0 {
+		d.slots = make(chan struct{}, cfg.MaxConcurrent)
+	}
+	return d.direct
+}
+
+type asyncDirector struct {
+	director StreamDirector
+	cfg      AsyncDirectorConfig
+	slots    chan struct{}
+	// queued is the number of calls waiting for a slot.
+	queued int32
+}
+
+type directorResult struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	dir    Direction
+	err    error
+}
+
+func (d *asyncDirector) direct(ctx context.Context, method string) (context.Context, context.CancelFunc, Direction, error) {
+	timer := time.NewTimer(d.cfg.Timeout)
+	defer timer.Stop()
+	timeoutErr := status.Errorf(codes.Unavailable, "director did not answer within %v", d.cfg.Timeout)
+
+	if d.slots != nil {
+		select {
+		case d.slots <- struct{}{}:
+		default:
+			if n := atomic.AddInt32(&d.queued, 1); d.cfg.MaxQueue > 0 && int(n) > d.cfg.MaxQueue {
+				atomic.AddInt32(&d.queued, -1)
+				return ctx, nil, Direction{}, status.Error(codes.Unavailable, "too many calls waiting for the director")
+			}
+			select {
+			case d.slots <- struct{}{}:
+				atomic.AddInt32(&d.queued, -1)
+			case <-timer.C:
+				atomic.AddInt32(&d.queued, -1)
+				return ctx, nil, Direction{}, timeoutErr
+			case <-ctx.Done():
+				atomic.AddInt32(&d.queued, -1)
+				return ctx, nil, Direction{}, status.FromContextError(ctx.Err()).Err()
+			}
+		}
+	}
+
+	dctx := newDirectorContext(ctx)
+	results := make(chan directorResult)
+	abandoned := make(chan error, 1)
+	go func() {
+		outCtx, cancel, dir, err := d.director(dctx, method)
+		if d.slots != nil {
+			<-d.slots
+		}
+		select {
+		case results <- directorResult{outCtx, cancel, dir, err}:
+		case callErr := <-abandoned:
+			if cancel != nil {
+				cancel()
+			}
+			if err == nil && dir.Done != nil {
+				dir.Done(callErr)
+			}
+		}
+	}()
+
+	var callErr error
+	select {
+	case r := <-results:
+		return r.ctx, r.cancel, r.dir, r.err
+	case <-timer.C:
+		dctx.finish(context.DeadlineExceeded)
+		callErr = timeoutErr
+	case <-ctx.Done():
+		callErr = status.FromContextError(ctx.Err()).Err()
+	}
+	// The director may have answered just now.
+	select {
+	case r := <-results:
+		if r.cancel != nil {
+			r.cancel()
+		}
+		if r.err == nil && r.dir.Done != nil {
+			r.dir.Done(callErr)
+		}
+	default:
+		abandoned <- callErr
+	}
+	return ctx, nil, Direction{}, callErr
+}
+
+// directorContext is the context of an async director. It has the values
+// and deadline of the call, and is done when the call is, or when the
+// director times out.
+type directorContext struct {
+	context.Context
+	done chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+func newDirectorContext(parent context.Context) *directorContext {
+	c := &directorContext{Context: parent, done: make(chan struct{})}
+	if parentDone := parent.Done(); parentDone != nil {
+		go func() {
+			select {
+			case <-parentDone:
+				c.finish(parent.Err())
+			case <-c.done:
+			}
+		}()
+	}
+	return c
+}
+
+func (c *directorContext) finish(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+		close(c.done)
+	}
+}
+
+func (c *directorContext) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *directorContext) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
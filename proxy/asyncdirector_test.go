@@ -0,0 +1,100 @@
+package proxy_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestAsyncDirector_Timeout(t *testing.T) {
+	release := make(chan struct{})
+	directorDone := make(chan error, 1)
+	var lateDone int32
+	env := newTestEnvWithDirector(t, &pingService{}, func(backend *grpc.ClientConn) proxy.StreamDirector {
+		return proxy.NewAsyncDirector(func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+			if method == "/vgough.testproto.TestService/PingEmpty" {
+				<-ctx.Done()
+				directorDone <- ctx.Err()
+				<-release
+				return ctx, nil, proxy.Direction{BackendConn: backend, Done: func(error) { atomic.AddInt32(&lateDone, 1) }}, nil
+			}
+			return ctx, nil, proxy.Direction{BackendConn: backend}, nil
+		}, proxy.AsyncDirectorConfig{Timeout: 50 * time.Millisecond})
+	})
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	start := time.Now()
+	_, err := env.client.PingEmpty(ctx, &pb.Empty{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, context.DeadlineExceeded, <-directorDone, "the director is told to give up")
+	close(release)
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&lateDone) == 1 }, time.Second, 5*time.Millisecond,
+		"late directions are released")
+
+	// The backend call is not limited by the director timeout.
+	stream, err := env.client.PingStream(ctx)
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, stream.Send(&pb.PingRequest{Value: "still here"}))
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, "still here", resp.Value)
+}
+
+func TestAsyncDirector_Concurrency(t *testing.T) {
+	release := make(chan struct{})
+	var running, maxRunning int32
+	director := proxy.NewAsyncDirector(func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		<-release
+		return ctx, nil, proxy.Direction{Method: "/a.A/B"}, nil
+	}, proxy.AsyncDirectorConfig{Timeout: 5 * time.Second, MaxConcurrent: 2, MaxQueue: 1})
+
+	results := make(chan error, 4)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, _, _, err := director(context.Background(), "/a.A/M")
+			results <- err
+		}()
+	}
+	// Two directors run and one call waits, so the next is turned away.
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&running) == 2 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	_, _, _, err := director(context.Background(), "/a.A/M")
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, <-results)
+	}
+	assert.EqualValues(t, 2, atomic.LoadInt32(&maxRunning))
+
+	// A canceled call stops waiting.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, _, err = proxy.NewAsyncDirector(func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+		<-ctx.Done()
+		return ctx, nil, proxy.Direction{}, ctx.Err()
+	}, proxy.AsyncDirectorConfig{Timeout: time.Minute})(ctx, "/a.A/M")
+	assert.Equal(t, codes.Canceled, status.Code(err))
+}
@@ -0,0 +1,274 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/mkxxx/grpc-proxy/proxy/inspect"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Config configures an Auditor.
+type Config struct {
+	// Resolver provides the descriptors to decode payloads. Payloads of
+	// methods it does not know are not recorded.
+	Resolver inspect.Resolver
+
+	// SampleRate is the fraction of calls recorded, from 0 to 1.
+	SampleRate float64
+
+	// Methods lists full method names, or prefixes ending in "/" or ".",
+	// whose calls are always recorded.
+	Methods []string
+
+	// Redact lists the fields masked in recorded payloads, by name, such as
+	// "password", or by full name, such as "users.User.password". Strings
+	// are replaced by "[REDACTED]" and other values are cleared.
+	Redact []string
+
+	// MaxMessages limits the messages recorded per direction of a call.
+	// Defaults to 100.
+	MaxMessages int
+
+	// QueueSize is the number of records waiting for the sink, beyond which
+	// records are dropped. Defaults to 1000.
+	QueueSize int
+
+	// OnError, if set, is called with errors of the sink.
+	OnError func(error)
+}
+
+// Record is the audit record of a call.
+type Record struct {
+	Time    time.Time `json:"time"`
+	Method  string    `json:"method"`
+	Peer    string    `json:"peer,omitempty"`
+	Subject string    `json:"subject,omitempty"`
+	// Backend is the target of the backend connection.
+	Backend    string            `json:"backend,omitempty"`
+	Code       string            `json:"code"`
+	Message    string            `json:"message,omitempty"`
+	DurationMs float64           `json:"duration_ms"`
+	Requests   []json.RawMessage `json:"requests,omitempty"`
+	Responses  []json.RawMessage `json:"responses,omitempty"`
+	// Truncated is set if messages exceeding MaxMessages were left out.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// Auditor records sampled calls. Install its Options on the proxy handler.
+type Auditor struct {
+	cfg       Config
+	sink      Sink
+	redact    redactor
+	marshaler jsonpb.Marshaler
+
+	// calls holds the records of calls in flight by their CallInfo.
+	calls sync.Map
+
+	mu      sync.RWMutex
+	closed  bool
+	queue   chan *Record
+	done    chan struct{}
+	dropped uint64
+}
+
+// activeCall is the record of a call in flight.
+type activeCall struct {
+	mu      sync.Mutex
+	record  *Record
+	sampled bool
+}
+
+// NewAuditor returns an Auditor writing records to sink.
+func NewAuditor(sink Sink, cfg Config) *Auditor {
+	if cfg.MaxMessages <= 0 {
+		cfg.MaxMessages = 100
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 1000
+	}
+	a := &Auditor{
+		cfg:       cfg,
+		sink:      sink,
+		redact:    newRedactor(cfg.Redact),
+		marshaler: jsonpb.Marshaler{OrigName: true},
+		queue:     make(chan *Record, cfg.QueueSize),
+		done:      make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+// Options returns the proxy options installing the auditor.
+func (a *Auditor) Options() []proxy.Option {
+	return []proxy.Option{
+		proxy.WithStreamInterceptor(a.intercept),
+		proxy.WithStatusHook(a.finish),
+	}
+}
+
+// Dropped returns the number of records dropped because the queue was full.
+func (a *Auditor) Dropped() uint64 {
+	return atomic.LoadUint64(&a.dropped)
+}
+
+// Close writes the queued records and stops the auditor. Calls ending
+// afterwards are not recorded.
+func (a *Auditor) Close() {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.queue)
+	}
+	a.mu.Unlock()
+	<-a.done
+}
+
+func (a *Auditor) run() {
+	defer close(a.done)
+	for r := range a.queue {
+		if err := a.sink.Write(r); err != nil && a.cfg.OnError != nil {
+			a.cfg.OnError(err)
+		}
+	}
+}
+
+// call returns the state of the call of info, deciding on first sight
+// whether it is recorded.
+func (a *Auditor) call(info *proxy.CallInfo) *activeCall {
+	if c, ok := a.calls.Load(info); ok {
+		return c.(*activeCall)
+	}
+	c := &activeCall{sampled: a.sampled(info.Method())}
+	if c.sampled {
+		c.record = &Record{Time: info.Start(), Method: info.Method()}
+		if p := info.Peer(); p != nil {
+			c.record.Peer = p.String()
+		}
+	}
+	actual, _ := a.calls.LoadOrStore(info, c)
+	return actual.(*activeCall)
+}
+
+func (a *Auditor) sampled(method string) bool {
+	for _, m := range a.cfg.Methods {
+		if method == m || ((strings.HasSuffix(m, "/") || strings.HasSuffix(m, ".")) && strings.HasPrefix(method, m)) {
+			return true
+		}
+	}
+	return a.cfg.SampleRate > 0 && rand.Float64() < a.cfg.SampleRate
+}
+
+func (a *Auditor) intercept(ctx context.Context, method string, dir proxy.FrameDirection, payload []byte) ([]byte, error) {
+	info := proxy.CallInfoFromContext(ctx)
+	if info == nil {
+		return payload, nil
+	}
+	c := a.call(info)
+	if !c.sampled {
+		return payload, nil
+	}
+	c.mu.Lock()
+	if c.record.Subject == "" {
+		if id, ok := proxy.IdentityFromContext(ctx); ok {
+			c.record.Subject = id.Subject
+		}
+	}
+	msgs := &c.record.Requests
+	if dir == proxy.BackendToClient {
+		msgs = &c.record.Responses
+	}
+	full := len(*msgs) >= a.cfg.MaxMessages
+	if full {
+		c.record.Truncated = true
+	}
+	c.mu.Unlock()
+	if full {
+		return payload, nil
+	}
+	if js := a.decode(ctx, method, dir, payload); js != nil {
+		c.mu.Lock()
+		*msgs = append(*msgs, js)
+		c.mu.Unlock()
+	}
+	// Auditing never changes or fails calls.
+	return payload, nil
+}
+
+// decode returns the redacted JSON of a payload, or nil if it cannot be
+// decoded.
+func (a *Auditor) decode(ctx context.Context, method string, dir proxy.FrameDirection, payload []byte) json.RawMessage {
+	if a.cfg.Resolver == nil {
+		return nil
+	}
+	md, err := a.cfg.Resolver.ResolveMethod(ctx, method)
+	if err != nil || md == nil {
+		return nil
+	}
+	msgType := md.GetInputType()
+	if dir == proxy.BackendToClient {
+		msgType = md.GetOutputType()
+	}
+	msg := dynamic.NewMessage(msgType)
+	if err := msg.Unmarshal(payload); err != nil {
+		return nil
+	}
+	a.redact.apply(msg)
+	js, err := msg.MarshalJSONPB(&a.marshaler)
+	if err != nil {
+		return nil
+	}
+	return js
+}
+
+func (a *Auditor) finish(ctx context.Context, st *status.Status, trailer metadata.MD) (*status.Status, metadata.MD) {
+	info := proxy.CallInfoFromContext(ctx)
+	if info == nil {
+		return st, trailer
+	}
+	c := a.call(info)
+	a.calls.Delete(info)
+	if !c.sampled {
+		return st, trailer
+	}
+	c.mu.Lock()
+	r := c.record
+	c.mu.Unlock()
+	r.Backend = info.Backend()
+	r.Code = st.Code().String()
+	r.Message = st.Message()
+	r.DurationMs = float64(time.Since(info.Start())) / float64(time.Millisecond)
+	if r.Subject == "" {
+		if id, ok := proxy.IdentityFromContext(ctx); ok {
+			r.Subject = id.Subject
+		}
+	}
+	a.emit(r)
+	return st, trailer
+}
+
+func (a *Auditor) emit(r *Record) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return
+	}
+	select {
+	case a.queue <- r:
+	default:
+		atomic.AddUint64(&a.dropped, 1)
+	}
+}
@@ -0,0 +1,252 @@
+package audit_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/mkxxx/grpc-proxy/proxy/audit"
+	"github.com/mkxxx/grpc-proxy/proxy/inspect"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+type pingService struct{}
+
+func (pingService) PingEmpty(ctx context.Context, _ *pb.Empty) (*pb.PingResponse, error) {
+	return &pb.PingResponse{Value: "empty"}, nil
+}
+
+func (pingService) Ping(ctx context.Context, in *pb.PingRequest) (*pb.PingResponse, error) {
+	return &pb.PingResponse{Value: in.Value, Counter: 1}, nil
+}
+
+func (pingService) PingError(ctx context.Context, in *pb.PingRequest) (*pb.Empty, error) {
+	return nil, status.Errorf(codes.FailedPrecondition, "no %s", in.Value)
+}
+
+func (pingService) PingList(in *pb.PingRequest, stream pb.TestService_PingListServer) error {
+	for i := 1; i <= 3; i++ {
+		if err := stream.Send(&pb.PingResponse{Value: in.Value, Counter: int32(i)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pingService) PingStream(stream pb.TestService_PingStreamServer) error {
+	return status.Error(codes.Unimplemented, "not here")
+}
+
+// recorder is a Sink keeping the records.
+type recorder struct {
+	mu      sync.Mutex
+	records []*audit.Record
+}
+
+func (r *recorder) Write(rec *audit.Record) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = append(r.records, rec)
+	return nil
+}
+
+func (r *recorder) get() []*audit.Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*audit.Record(nil), r.records...)
+}
+
+func testFiles(t *testing.T) *inspect.FileResolver {
+	files, err := inspect.ParseFiles([]string{"../../testservice"}, "test.proto")
+	require.NoError(t, err)
+	return files
+}
+
+// startProxy starts a proxy to a pingService backend, audited with cfg.
+// Stopping it closes the auditor.
+func startProxy(t *testing.T, sink audit.Sink, cfg audit.Config) (pb.TestServiceClient, func()) {
+	backendLis := proxy.NewInProcessListener()
+	backend := grpc.NewServer()
+	pb.RegisterTestServiceServer(backend, pingService{})
+	go backend.Serve(backendLis)
+
+	reg := proxy.NewBackendRegistry()
+	reg.Register("ping", backendLis.BackendConfig())
+	director := reg.Director(func(ctx context.Context, method string) (string, error) {
+		return "ping", nil
+	})
+	auditor := audit.NewAuditor(sink, cfg)
+	server := grpc.NewServer(
+		proxy.ServerOption(),
+		grpc.UnknownServiceHandler(proxy.TransparentHandler(director, auditor.Options()...)),
+	)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(lis)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	return pb.NewTestServiceClient(conn), func() {
+		conn.Close()
+		server.Stop()
+		auditor.Close()
+		reg.Close()
+		backend.Stop()
+	}
+}
+
+func testCtx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 10*time.Second)
+}
+
+func TestAuditor_Methods(t *testing.T) {
+	rec := &recorder{}
+	client, stop := startProxy(t, rec, audit.Config{
+		Resolver: testFiles(t),
+		Methods:  []string{"/vgough.testproto.TestService/Ping"},
+		Redact:   []string{"value", "vgough.testproto.PingResponse.counter"},
+	})
+	ctx, cancel := testCtx()
+	defer cancel()
+
+	_, err := client.Ping(ctx, &pb.PingRequest{Value: "secret"})
+	require.NoError(t, err)
+	_, err = client.PingEmpty(ctx, &pb.Empty{})
+	require.NoError(t, err)
+	stop()
+
+	records := rec.get()
+	require.Len(t, records, 1, "only listed methods are recorded")
+	r := records[0]
+	assert.Equal(t, "/vgough.testproto.TestService/Ping", r.Method)
+	assert.Equal(t, "OK", r.Code)
+	assert.Equal(t, "inprocess", r.Backend, "the backend target")
+	assert.NotEmpty(t, r.Peer)
+	assert.False(t, r.Time.IsZero())
+	require.Len(t, r.Requests, 1)
+	assert.JSONEq(t, `{"value": "[REDACTED]"}`, string(r.Requests[0]))
+	require.Len(t, r.Responses, 1)
+	assert.JSONEq(t, `{"Value": "secret"}`, string(r.Responses[0]), "fields match by full name, and names are case sensitive")
+}
+
+func TestAuditor_Sampling(t *testing.T) {
+	rec := &recorder{}
+	client, stop := startProxy(t, rec, audit.Config{Resolver: testFiles(t), SampleRate: 1})
+	ctx, cancel := testCtx()
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		_, err := client.PingEmpty(ctx, &pb.Empty{})
+		require.NoError(t, err)
+	}
+	stop()
+	assert.Len(t, rec.get(), 3)
+
+	rec = &recorder{}
+	client, stop = startProxy(t, rec, audit.Config{Resolver: testFiles(t)})
+	for i := 0; i < 3; i++ {
+		_, err := client.PingEmpty(ctx, &pb.Empty{})
+		require.NoError(t, err)
+	}
+	stop()
+	assert.Empty(t, rec.get(), "calls are not sampled by default")
+}
+
+func TestAuditor_Streaming(t *testing.T) {
+	rec := &recorder{}
+	client, stop := startProxy(t, rec, audit.Config{
+		Resolver:    testFiles(t),
+		Methods:     []string{"/vgough.testproto.TestService/"},
+		MaxMessages: 2,
+	})
+	ctx, cancel := testCtx()
+	defer cancel()
+
+	stream, err := client.PingList(ctx, &pb.PingRequest{Value: "list"})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := stream.Recv()
+		require.NoError(t, err)
+	}
+	_, err = client.PingError(ctx, &pb.PingRequest{Value: "luck"})
+	require.Error(t, err)
+	stop()
+
+	records := rec.get()
+	require.Len(t, records, 2)
+	list, failed := records[0], records[1]
+	if list.Method != "/vgough.testproto.TestService/PingList" {
+		list, failed = failed, list
+	}
+	assert.Len(t, list.Requests, 1)
+	require.Len(t, list.Responses, 2, "messages beyond MaxMessages are left out")
+	assert.JSONEq(t, `{"Value": "list", "counter": 2}`, string(list.Responses[1]))
+	assert.True(t, list.Truncated)
+
+	assert.Equal(t, "FailedPrecondition", failed.Code)
+	assert.Equal(t, "no luck", failed.Message)
+	assert.Empty(t, failed.Responses)
+}
+
+func TestWriterSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := audit.NewWriterSink(&buf)
+	require.NoError(t, sink.Write(&audit.Record{Method: "/a.A/One", Code: "OK"}))
+	require.NoError(t, sink.Write(&audit.Record{Method: "/a.A/Two", Code: "OK", Requests: []json.RawMessage{json.RawMessage(`{"x":1}`)}}))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2, "one record per line")
+	var r audit.Record
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &r))
+	assert.Equal(t, "/a.A/Two", r.Method)
+	assert.JSONEq(t, `{"x":1}`, string(r.Requests[0]))
+}
+
+func TestGRPCSink(t *testing.T) {
+	received := make(chan *structpb.Struct, 1)
+	server := grpc.NewServer(grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(stream)
+		if method != "/audit.Collector/Record" {
+			return status.Error(codes.Unimplemented, method)
+		}
+		var msg structpb.Struct
+		if err := stream.RecvMsg(&msg); err != nil {
+			return err
+		}
+		received <- &msg
+		return stream.SendMsg(&empty.Empty{})
+	}))
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(lis)
+	defer server.Stop()
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	sink := audit.NewGRPCSink(conn, "/audit.Collector/Record", 5*time.Second)
+	require.NoError(t, sink.Write(&audit.Record{
+		Method:   "/a.A/One",
+		Code:     "OK",
+		Requests: []json.RawMessage{json.RawMessage(`{"x":"y"}`)},
+	}))
+	msg := <-received
+	assert.Equal(t, "/a.A/One", msg.Fields["method"].GetStringValue())
+	req := msg.Fields["requests"].GetListValue().Values[0].GetStructValue()
+	assert.Equal(t, "y", req.Fields["x"].GetStringValue())
+
+	err = audit.NewGRPCSink(conn, "/audit.Collector/Other", 5*time.Second).Write(&audit.Record{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
@@ -0,0 +1,31 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+/*
+Package audit records the payloads of proxied calls for auditing, with
+sensitive fields redacted.
+
+An Auditor samples calls, or records all calls of selected methods, and
+decodes their request and response frames with the descriptors of an
+inspect.Resolver. Redacted fields are masked in the decoded copies, the
+forwarded frames are never changed. When the call ends, a Record with the
+client, the status and the JSON payloads is handed to a Sink:
+
+	files, err := inspect.ParseFiles([]string{"protos"}, "users/users.proto")
+	...
+	auditor := audit.NewAuditor(audit.NewWriterSink(logFile), audit.Config{
+		Resolver:   files,
+		SampleRate: 0.01,
+		Methods:    []string{"/users.UserService/Delete"},
+		Redact:     []string{"password", "users.User.ssn"},
+	})
+	defer auditor.Close()
+	handler := proxy.TransparentHandler(director, auditor.Options()...)
+
+Records are written by a background goroutine, so a slow sink never
+delays calls; records which do not fit its queue are dropped and counted.
+Sinks for other systems, such as a Kafka producer, implement Sink.
+NewGRPCSink sends records to a collector service.
+*/
+package audit
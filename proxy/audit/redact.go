@@ -0,0 +1,83 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package audit
+
+import (
+	dpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+)
+
+// redacted replaces the value of redacted string fields.
+const redacted = "[REDACTED]"
+
+// redactor masks fields by name or full name.
+type redactor map[string]bool
+
+func newRedactor(fields []string) redactor {
+	r := make(redactor, len(fields))
+	for _, f := range fields {
+		r[f] = true
+	}
+	return r
+}
+
+func (r redactor) matches(fd *desc.FieldDescriptor) bool {
+	return r[fd.GetName()] || r[fd.GetFullyQualifiedName()]
+}
+
+// apply masks the redacted fields of msg and its nested messages.
+func (r redactor) apply(msg *dynamic.Message) {
+	if len(r) == 0 {
+		return
+	}
+	for _, fd := range msg.GetKnownFields() {
+		if !msg.HasField(fd) {
+			continue
+		}
+		if r.matches(fd) {
+			r.mask(msg, fd)
+			continue
+		}
+		if fd.GetMessageType() == nil {
+			continue
+		}
+		switch {
+		case fd.IsMap():
+			msg.ForEachMapFieldEntry(fd, func(_, v interface{}) bool {
+				if m, ok := v.(*dynamic.Message); ok {
+					r.apply(m)
+				}
+				return true
+			})
+		case fd.IsRepeated():
+			for i := 0; i < msg.FieldLength(fd); i++ {
+				if m, ok := msg.GetRepeatedField(fd, i).(*dynamic.Message); ok {
+					r.apply(m)
+				}
+			}
+		default:
+			if m, ok := msg.GetField(fd).(*dynamic.Message); ok {
+				r.apply(m)
+			}
+		}
+	}
+}
+
+// mask replaces strings by a placeholder, so that their presence is still
+// visible, and clears other values.
+func (r redactor) mask(msg *dynamic.Message, fd *desc.FieldDescriptor) {
+	if fd.GetType() != dpb.FieldDescriptorProto_TYPE_STRING || fd.IsMap() {
+		msg.ClearField(fd)
+		return
+	}
+	if !fd.IsRepeated() {
+		msg.SetField(fd, redacted)
+		return
+	}
+	for i := 0; i < msg.FieldLength(fd); i++ {
+		msg.SetRepeatedField(fd, i, redacted)
+	}
+}
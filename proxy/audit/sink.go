@@ -0,0 +1,78 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/ptypes/empty"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"google.golang.org/grpc"
+)
+
+// Sink receives the records of an Auditor. Records are written one at a
+// time.
+type Sink interface {
+	Write(r *Record) error
+}
+
+// SinkFunc is an adapter allowing the use of ordinary functions as a Sink.
+type SinkFunc func(r *Record) error
+
+// Write calls f(r).
+func (f SinkFunc) Write(r *Record) error {
+	return f(r)
+}
+
+// NewWriterSink returns a Sink writing records to w as JSON, one per line,
+// such as to a log file.
+func NewWriterSink(w io.Writer) Sink {
+	return &writerSink{enc: json.NewEncoder(w)}
+}
+
+type writerSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (s *writerSink) Write(r *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(r)
+}
+
+// NewGRPCSink returns a Sink calling method on conn for each record, such as
+// "/audit.Collector/Record". The method takes the record as a
+// google.protobuf.Struct and returns google.protobuf.Empty. Each call is
+// limited to timeout.
+func NewGRPCSink(conn *grpc.ClientConn, method string, timeout time.Duration) Sink {
+	return &grpcSink{conn: conn, method: method, timeout: timeout}
+}
+
+type grpcSink struct {
+	conn    *grpc.ClientConn
+	method  string
+	timeout time.Duration
+}
+
+func (s *grpcSink) Write(r *Record) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	var msg structpb.Struct
+	if err := jsonpb.Unmarshal(bytes.NewReader(b), &msg); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	return s.conn.Invoke(ctx, s.method, &msg, &empty.Empty{})
+}
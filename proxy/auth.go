@@ -0,0 +1,91 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// AuthInfo describes an incoming stream to an Authenticator.
+type AuthInfo struct {
+	// Method is the full method name requested by the client.
+	Method string
+	// Metadata is the incoming metadata of the stream.
+	Metadata metadata.MD
+	// Peer is the client, if known.
+	Peer *peer.Peer
+}
+
+// Authenticator authenticates incoming streams before the director is
+// invoked, see WithAuthenticator.
+type Authenticator interface {
+	// Authenticate returns the context to use for the rest of the stream,
+	// usually carrying an Identity, or an error to reject the stream. Errors
+	// without a gRPC status are returned as codes.Unauthenticated.
+	Authenticate(ctx context.Context, info *AuthInfo) (context.Context, error)
+}
+
+// AuthenticatorFunc adapts a function to an Authenticator.
+type AuthenticatorFunc func(ctx context.Context, info *AuthInfo) (context.Context, error)
+
+// Authenticate calls f.
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, info *AuthInfo) (context.Context, error) {
+	return f(ctx, info)
+}
+
+// WithAuthenticator authenticates every stream with a before it is passed
+// to the director. The context returned by a is seen by the director and by
+// the rest of the handler.
+func WithAuthenticator(a Authenticator) Option {
+	return func(o *options) {
+		o.authenticator = a
+	}
+}
+
+// Identity is the authenticated identity of a client.
+type Identity struct {
+	// Subject identifies the client, such as a user or service name.
+	Subject string
+	// Tenant is the tenant of the client, for multi-tenant routing.
+	Tenant string
+	// Claims holds any further attributes of the client.
+	Claims map[string]interface{}
+}
+
+type identityKey struct{}
+
+// NewContextWithIdentity returns a copy of ctx carrying id.
+func NewContextWithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// IdentityFromContext returns the identity added by an Authenticator, if any.
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(*Identity)
+	return id, ok && id != nil
+}
+
+// authenticate runs the authenticator of a stream.
+func authenticate(ctx context.Context, a Authenticator, method string) (context.Context, error) {
+	info := &AuthInfo{Method: method}
+	info.Metadata, _ = metadata.FromIncomingContext(ctx)
+	info.Peer, _ = peer.FromContext(ctx)
+	authCtx, err := a.Authenticate(ctx, info)
+	if err != nil {
+		if _, ok := status.FromError(err); !ok {
+			err = status.Error(codes.Unauthenticated, err.Error())
+		}
+		return nil, err
+	}
+	if authCtx == nil {
+		authCtx = ctx
+	}
+	return authCtx, nil
+}
@@ -0,0 +1,58 @@
+package proxy_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+var tokenAuth = proxy.AuthenticatorFunc(func(ctx context.Context, info *proxy.AuthInfo) (context.Context, error) {
+	tokens := info.Metadata.Get("authorization")
+	switch {
+	case len(tokens) == 0:
+		return nil, errors.New("missing token")
+	case tokens[0] == "banned":
+		return nil, status.Error(codes.PermissionDenied, "banned")
+	}
+	return proxy.NewContextWithIdentity(ctx, &proxy.Identity{Subject: tokens[0], Tenant: "acme"}), nil
+})
+
+func TestAuthenticator(t *testing.T) {
+	var seen *proxy.Identity
+	mkDirector := func(backend *grpc.ClientConn) proxy.StreamDirector {
+		return func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+			seen, _ = proxy.IdentityFromContext(ctx)
+			return ctx, nil, proxy.Direction{BackendConn: backend}, nil
+		}
+	}
+	env := newTestEnvWithDirector(t, &pingService{}, mkDirector, proxy.WithAuthenticator(tokenAuth))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "anon"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	assert.Nil(t, seen, "director is not called for rejected streams")
+
+	banned := metadata.AppendToOutgoingContext(ctx, "authorization", "banned")
+	_, err = env.client.Ping(banned, &pb.PingRequest{Value: "banned"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	alice := metadata.AppendToOutgoingContext(ctx, "authorization", "alice")
+	out, err := env.client.Ping(alice, &pb.PingRequest{Value: "alice"})
+	require.NoError(t, err)
+	assert.Equal(t, "alice", out.Value)
+	require.NotNil(t, seen)
+	assert.Equal(t, "alice", seen.Subject)
+	assert.Equal(t, "acme", seen.Tenant)
+}
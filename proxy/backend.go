@@ -0,0 +1,278 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+)
+
+// BackendConfig describes how to dial a backend.
+type BackendConfig struct {
+	// Address is the dial target of the backend. Addresses with the "unix:"
+	// prefix, such as "unix:/run/users.sock", are Unix socket paths, for
+	// backends sharing a host or pod with the proxy.
+	Address string
+
+	// Dialer, if set, opens the connections to Address, for example to
+	// reach a server in the same process, see NewInProcessListener.
+	Dialer func(ctx context.Context, address string) (net.Conn, error)
+
+	// TCP, if set, configures the TCP connections to Address, such as their
+	// source address or firewall mark. It is ignored if Dialer is set.
+	TCP *TCPDialConfig
+
+	// UpstreamProxy, if set, reaches Address through a SOCKS5 or HTTP
+	// CONNECT proxy, which is dialed as configured by TCP. It is ignored if
+	// Dialer is set.
+	UpstreamProxy *UpstreamProxy
+
+	// Credentials secures the connection to the backend. If nil, the
+	// connection is insecure.
+	Credentials credentials.TransportCredentials
+
+	// Authority overrides the :authority sent to the backend. For secure
+	// connections it is also the server name verified by TLS.
+	Authority string
+
+	// Keepalive, if set, enables client keepalive pings to the backend. If
+	// the backend closes the connection for pinging too often, the interval
+	// is doubled on the next connection.
+	Keepalive *keepalive.ClientParameters
+
+	// MaxReconnectBackoff caps the exponential backoff between attempts to
+	// reconnect to the backend. Defaults to grpc's 120 seconds.
+	//
+	// Connections closed by the backend with GOAWAY, as on reaching its
+	// maximum connection age, are re-dialed at once, without backoff.
+	MaxReconnectBackoff time.Duration
+
+	// MaxConnectionAge, if set, makes BackendRegistry and AddressPool
+	// replace connections older than this, give or take 10%, so that calls
+	// spread over backend instances added behind a DNS name or load
+	// balancer. The old connection still serves its in-flight calls for
+	// MaxConnectionAgeGrace, 30 seconds by default, and is closed then.
+	MaxConnectionAge      time.Duration
+	MaxConnectionAgeGrace time.Duration
+
+	// DialOptions are appended to the options derived from the fields above.
+	DialOptions []grpc.DialOption
+}
+
+func (c *BackendConfig) dialOptions() []grpc.DialOption {
+	opts := []grpc.DialOption{DialOption()}
+	authority := c.Authority
+	switch {
+	case c.Dialer != nil:
+		opts = append(opts, grpc.WithContextDialer(c.Dialer))
+	case c.UpstreamProxy != nil && !isUnixAddress(c.Address):
+		up := *c.UpstreamProxy
+		if up.Dialer == nil && c.TCP != nil {
+			up.Dialer = c.TCP.DialContext
+		}
+		opts = append(opts, grpc.WithContextDialer(up.DialContext))
+	case c.TCP != nil && !isUnixAddress(c.Address):
+		opts = append(opts, grpc.WithContextDialer(c.TCP.DialContext))
+	case isUnixAddress(c.Address):
+		opts = append(opts, grpc.WithContextDialer(dialUnix))
+		if authority == "" {
+			// The socket path is no valid :authority.
+			authority = "localhost"
+		}
+	}
+	switch {
+	case c.Credentials != nil && c.Authority != "":
+		// grpc takes the authority of secure connections from the
+		// credentials, so override the server name on a copy.
+		creds := c.Credentials.Clone()
+		creds.OverrideServerName(c.Authority)
+		opts = append(opts, grpc.WithTransportCredentials(creds))
+	case c.Credentials != nil:
+		opts = append(opts, grpc.WithTransportCredentials(c.Credentials))
+	default:
+		opts = append(opts, grpc.WithInsecure())
+		if authority != "" {
+			opts = append(opts, grpc.WithAuthority(authority))
+		}
+	}
+	if c.Keepalive != nil {
+		opts = append(opts, grpc.WithKeepaliveParams(*c.Keepalive))
+	}
+	if c.MaxReconnectBackoff > 0 {
+		opts = append(opts, grpc.WithBackoffMaxDelay(c.MaxReconnectBackoff))
+	}
+	return append(opts, c.DialOptions...)
+}
+
+func isUnixAddress(address string) bool {
+	return strings.HasPrefix(address, "unix:")
+}
+
+// dialUnix dials a "unix:" address, also accepting the "unix://" form of
+// the grpc naming scheme.
+func dialUnix(ctx context.Context, address string) (net.Conn, error) {
+	path := strings.TrimPrefix(strings.TrimPrefix(address, "unix:"), "//")
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", path)
+}
+
+// connectionAge returns the age at which a connection dialed now is
+// replaced, or zero if connections are kept.
+func (c *BackendConfig) connectionAge() time.Duration {
+	if c.MaxConnectionAge <= 0 {
+		return 0
+	}
+	// Jitter by up to 10% either way, so connections dialed together are
+	// not all replaced at once.
+	jitter := time.Duration(rand.Int63n(int64(c.MaxConnectionAge)/5+1)) - c.MaxConnectionAge/10
+	return c.MaxConnectionAge + jitter
+}
+
+// retire closes conn after the grace period for its in-flight calls.
+func (c *BackendConfig) retire(conn *grpc.ClientConn) {
+	grace := c.MaxConnectionAgeGrace
+	if grace <= 0 {
+		grace = 30 * time.Second
+	}
+	time.AfterFunc(grace, func() { conn.Close() })
+}
+
+// Dial returns a new connection to the backend using the proxy codec.
+func (c *BackendConfig) Dial() (*grpc.ClientConn, error) {
+	return grpc.Dial(c.Address, c.dialOptions()...)
+}
+
+// BackendRegistry holds named backends and their connections. Connections
+// are dialed with the proxy codec on first use and shared afterwards.
+//
+// A BackendRegistry is safe for concurrent use.
+type BackendRegistry struct {
+	mu       sync.Mutex
+	backends map[string]*registeredBackend
+	logger   Logger
+}
+
+type registeredBackend struct {
+	cfg     BackendConfig
+	conn    *grpc.ClientConn
+	expires time.Time
+}
+
+// NewBackendRegistry returns an empty BackendRegistry.
+func NewBackendRegistry() *BackendRegistry {
+	return &BackendRegistry{backends: make(map[string]*registeredBackend), logger: loggerOrDefault(nil)}
+}
+
+// SetLogger sends the messages of the registry, such as failures to
+// replace expired connections, to l instead of grpclog.
+func (r *BackendRegistry) SetLogger(l Logger) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.logger = loggerOrDefault(l)
+}
+
+// Register adds a backend under the given name. If a backend with that name
+// was registered before, it is replaced and its connection is closed.
+func (r *BackendRegistry) Register(name string, cfg BackendConfig) {
+	r.mu.Lock()
+	old := r.backends[name]
+	r.backends[name] = &registeredBackend{cfg: cfg}
+	r.mu.Unlock()
+	if old != nil && old.conn != nil {
+		old.conn.Close()
+	}
+}
+
+// Remove removes the named backend and closes its connection.
+func (r *BackendRegistry) Remove(name string) {
+	r.mu.Lock()
+	old := r.backends[name]
+	delete(r.backends, name)
+	r.mu.Unlock()
+	if old != nil && old.conn != nil {
+		old.conn.Close()
+	}
+}
+
+// Conn returns the connection to the named backend, dialing it if needed.
+// Unknown backends fail with codes.Unavailable.
+func (r *BackendRegistry) Conn(name string) (*grpc.ClientConn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.backends[name]
+	if !ok {
+		return nil, status.Errorf(codes.Unavailable, "backend %q is not available", name)
+	}
+	if b.conn != nil && !b.expires.IsZero() && time.Now().After(b.expires) {
+		// Replace the connection, unless the backend cannot be dialed.
+		if conn, err := b.cfg.Dial(); err == nil {
+			b.cfg.retire(b.conn)
+			b.setConn(conn)
+		} else {
+			r.logger.Warn("keeping expired backend connection", "backend", name, "address", b.cfg.Address, "error", err)
+		}
+	}
+	if b.conn == nil {
+		conn, err := b.cfg.Dial()
+		if err != nil {
+			r.logger.Warn("backend dial failed", "backend", name, "address", b.cfg.Address, "error", err)
+			return nil, status.Errorf(codes.Unavailable, "failed to dial backend %q: %v", name, err)
+		}
+		b.setConn(conn)
+	}
+	return b.conn, nil
+}
+
+func (b *registeredBackend) setConn(conn *grpc.ClientConn) {
+	b.conn = conn
+	b.expires = time.Time{}
+	if age := b.cfg.connectionAge(); age > 0 {
+		b.expires = time.Now().Add(age)
+	}
+}
+
+// Close closes all backend connections. Backends stay registered and are
+// dialed again on next use.
+func (r *BackendRegistry) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var firstErr error
+	for _, b := range r.backends {
+		if b.conn == nil {
+			continue
+		}
+		if err := b.conn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		b.conn = nil
+	}
+	return firstErr
+}
+
+// Director returns a StreamDirector which sends each call to the backend
+// named by pick.
+func (r *BackendRegistry) Director(pick func(ctx context.Context, method string) (string, error)) StreamDirector {
+	return func(ctx context.Context, method string) (context.Context, context.CancelFunc, Direction, error) {
+		name, err := pick(ctx, method)
+		if err != nil {
+			return ctx, nil, Direction{}, err
+		}
+		conn, err := r.Conn(name)
+		if err != nil {
+			return ctx, nil, Direction{}, err
+		}
+		return ctx, nil, Direction{BackendConn: conn}, nil
+	}
+}
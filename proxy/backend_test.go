@@ -0,0 +1,185 @@
+package proxy_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// startTLSBackend starts a TLS server for svc with a certificate for
+// backend.test issued by ca.
+func startTLSBackend(t *testing.T, ca *testCA, svc pb.TestServiceServer) (*grpc.Server, string) {
+	creds := credentials.NewServerTLSFromCert(&[]tls.Certificate{ca.issue(nil, "backend.test")}[0])
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer(grpc.Creds(creds))
+	pb.RegisterTestServiceServer(server, svc)
+	go server.Serve(lis)
+	return server, lis.Addr().String()
+}
+
+// startProxy starts a transparent proxy using director and returns a client
+// connection to it.
+func startProxy(t *testing.T, director proxy.StreamDirector) (*grpc.Server, *grpc.ClientConn) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer(
+		proxy.ServerOption(),
+		grpc.UnknownServiceHandler(proxy.TransparentHandler(director)),
+	)
+	go server.Serve(lis)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	return server, conn
+}
+
+func TestBackendRegistry_TLS(t *testing.T) {
+	authorities := make(chan string, 1)
+	svc := &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			md, _ := metadata.FromIncomingContext(ctx)
+			authorities <- md.Get(":authority")[0]
+			return &pb.PingResponse{Value: ping.Value}, nil
+		},
+	}
+	ca := newTestCA(t)
+	backend, addr := startTLSBackend(t, ca, svc)
+	defer backend.Stop()
+
+	creds := credentials.NewClientTLSFromCert(ca.pool, "")
+	reg := proxy.NewBackendRegistry()
+	defer reg.Close()
+	reg.Register("secure", proxy.BackendConfig{
+		Address:     addr,
+		Credentials: creds,
+		Authority:   "backend.test",
+		Keepalive:   &keepalive.ClientParameters{Time: time.Minute},
+	})
+
+	director := reg.Director(func(ctx context.Context, method string) (string, error) {
+		return "secure", nil
+	})
+	server, conn := startProxy(t, director)
+	defer server.Stop()
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	out, err := pb.NewTestServiceClient(conn).Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err)
+	assert.Equal(t, "foo", out.Value)
+	assert.Equal(t, "backend.test", <-authorities)
+}
+
+func TestBackendRegistry_Conn(t *testing.T) {
+	reg := proxy.NewBackendRegistry()
+	defer reg.Close()
+
+	_, err := reg.Conn("missing")
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	reg.Register("b", proxy.BackendConfig{Address: "127.0.0.1:1"})
+	c1, err := reg.Conn("b")
+	require.NoError(t, err)
+	c2, err := reg.Conn("b")
+	require.NoError(t, err)
+	assert.True(t, c1 == c2, "connections must be shared")
+
+	reg.Register("b", proxy.BackendConfig{Address: "127.0.0.1:2"})
+	c3, err := reg.Conn("b")
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:2", c3.Target())
+
+	reg.Remove("b")
+	_, err = reg.Conn("b")
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestBackendRegistry_MaxConnectionAge(t *testing.T) {
+	reg := proxy.NewBackendRegistry()
+	defer reg.Close()
+
+	reg.Register("b", proxy.BackendConfig{
+		Address:               "127.0.0.1:1",
+		MaxConnectionAge:      20 * time.Millisecond,
+		MaxConnectionAgeGrace: 20 * time.Millisecond,
+	})
+	c1, err := reg.Conn("b")
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	c2, err := reg.Conn("b")
+	require.NoError(t, err)
+	assert.True(t, c1 != c2, "expired connections are replaced")
+	assert.NotEqual(t, connectivity.Shutdown, c1.GetState(), "the old connection serves in-flight calls")
+	assert.Eventually(t, func() bool {
+		return c1.GetState() == connectivity.Shutdown
+	}, 5*time.Second, 10*time.Millisecond, "the old connection is closed after the grace")
+}
+
+func TestBackendRegistry_LocalBackends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grpc-proxy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	unixLis, err := net.Listen("unix", filepath.Join(dir, "backend.sock"))
+	require.NoError(t, err)
+	inProcess := proxy.NewInProcessListener()
+
+	reg := proxy.NewBackendRegistry()
+	defer reg.Close()
+	authorities := make(chan string, 1)
+	for name, lis := range map[string]net.Listener{"unix": unixLis, "inprocess": inProcess} {
+		name := name
+		svc := &pingService{
+			ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+				md, _ := metadata.FromIncomingContext(ctx)
+				authorities <- md.Get(":authority")[0]
+				return &pb.PingResponse{Value: name}, nil
+			},
+		}
+		server := grpc.NewServer()
+		pb.RegisterTestServiceServer(server, svc)
+		go server.Serve(lis)
+		defer server.Stop()
+	}
+	reg.Register("unix", proxy.BackendConfig{Address: "unix:" + unixLis.Addr().String()})
+	reg.Register("inprocess", inProcess.BackendConfig())
+
+	director := reg.Director(func(ctx context.Context, method string) (string, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		return md.Get("x-backend")[0], nil
+	})
+	server, conn := startProxy(t, director)
+	defer server.Stop()
+	defer conn.Close()
+
+	for _, name := range []string{"unix", "inprocess"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-backend", name)
+		out, err := pb.NewTestServiceClient(conn).Ping(ctx, &pb.PingRequest{})
+		cancel()
+		require.NoError(t, err, name)
+		assert.Equal(t, name, out.Value)
+		authority := <-authorities
+		if name == "unix" {
+			assert.Equal(t, "localhost", authority, "socket paths are no authority")
+		}
+	}
+}
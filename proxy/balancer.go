@@ -0,0 +1,246 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+)
+
+// Endpoint is one connection of a logical backend.
+type Endpoint struct {
+	Conn *grpc.ClientConn
+
+	// Weight is the relative share of calls for weighted balancers. Values
+	// less than 1 are treated as 1.
+	Weight int
+}
+
+func (e Endpoint) weight() int {
+	if e.Weight < 1 {
+		return 1
+	}
+	return e.Weight
+}
+
+// Endpoints returns equally weighted endpoints for the given connections.
+func Endpoints(conns ...*grpc.ClientConn) []Endpoint {
+	eps := make([]Endpoint, len(conns))
+	for i, conn := range conns {
+		eps[i] = Endpoint{Conn: conn}
+	}
+	return eps
+}
+
+// Balancer picks among the connections of a logical backend.
+//
+// Implementations must be safe for concurrent use.
+type Balancer interface {
+	// Pick returns the connection to use for a call to method. The returned
+	// function, if not nil, must be called with the result of the call.
+	Pick(ctx context.Context, method string) (*grpc.ClientConn, func(error), error)
+
+	// Update replaces the set of endpoints.
+	Update(endpoints []Endpoint)
+}
+
+// EndpointStatus describes an endpoint of a balancer.
+type EndpointStatus struct {
+	// Target is the target of the endpoint's connection.
+	Target string
+	// State is the connectivity state of the connection.
+	State  connectivity.State
+	Weight int
+	// Active is the number of in-flight calls, if the balancer counts them.
+	Active int
+	// Ejected reports whether outlier detection removed the endpoint from
+	// rotation.
+	Ejected bool
+
+	conn *grpc.ClientConn
+}
+
+// StatusReporter is implemented by balancers which describe their
+// endpoints. The balancers of this package implement it.
+type StatusReporter interface {
+	Status() []EndpointStatus
+}
+
+func endpointStatus(ep Endpoint) EndpointStatus {
+	return EndpointStatus{Target: ep.Conn.Target(), State: ep.Conn.GetState(), Weight: ep.weight(), conn: ep.Conn}
+}
+
+var errNoEndpoints = status.Error(codes.Unavailable, "no backend endpoints available")
+
+// NewRoundRobinBalancer returns a Balancer which cycles through the endpoints
+// in order, ignoring their weights.
+func NewRoundRobinBalancer(endpoints ...Endpoint) Balancer {
+	b := &roundRobin{}
+	b.Update(endpoints)
+	return b
+}
+
+type roundRobin struct {
+	mu        sync.Mutex
+	endpoints []Endpoint
+	conns     []*grpc.ClientConn
+	next      int
+}
+
+func (b *roundRobin) Pick(ctx context.Context, method string) (*grpc.ClientConn, func(error), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.conns) == 0 {
+		return nil, nil, errNoEndpoints
+	}
+	conn := b.conns[b.next%len(b.conns)]
+	b.next++
+	return conn, nil, nil
+}
+
+func (b *roundRobin) Update(endpoints []Endpoint) {
+	conns := make([]*grpc.ClientConn, len(endpoints))
+	for i, ep := range endpoints {
+		conns[i] = ep.Conn
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.endpoints = append([]Endpoint(nil), endpoints...)
+	b.conns = conns
+}
+
+func (b *roundRobin) Status() []EndpointStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := make([]EndpointStatus, len(b.endpoints))
+	for i, ep := range b.endpoints {
+		status[i] = endpointStatus(ep)
+	}
+	return status
+}
+
+// NewLeastStreamsBalancer returns a Balancer which picks the endpoint with
+// the fewest in-flight calls, relative to its weight.
+func NewLeastStreamsBalancer(endpoints ...Endpoint) Balancer {
+	b := &leastStreams{active: make(map[*grpc.ClientConn]int)}
+	b.Update(endpoints)
+	return b
+}
+
+type leastStreams struct {
+	mu        sync.Mutex
+	endpoints []Endpoint
+	active    map[*grpc.ClientConn]int
+	next      int
+}
+
+func (b *leastStreams) Pick(ctx context.Context, method string) (*grpc.ClientConn, func(error), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(b.endpoints)
+	if n == 0 {
+		return nil, nil, errNoEndpoints
+	}
+	// Start scanning at a rotating offset so that ties are spread evenly.
+	best := -1
+	var bestLoad float64
+	for i := 0; i < n; i++ {
+		idx := (b.next + i) % n
+		ep := b.endpoints[idx]
+		load := float64(b.active[ep.Conn]) / float64(ep.weight())
+		if best < 0 || load < bestLoad {
+			best, bestLoad = idx, load
+		}
+	}
+	b.next++
+	conn := b.endpoints[best].Conn
+	b.active[conn]++
+
+	var once sync.Once
+	return conn, func(error) {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if b.active[conn]--; b.active[conn] <= 0 {
+				delete(b.active, conn)
+			}
+		})
+	}, nil
+}
+
+func (b *leastStreams) Update(endpoints []Endpoint) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.endpoints = append([]Endpoint(nil), endpoints...)
+}
+
+func (b *leastStreams) Status() []EndpointStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := make([]EndpointStatus, len(b.endpoints))
+	for i, ep := range b.endpoints {
+		status[i] = endpointStatus(ep)
+		status[i].Active = b.active[ep.Conn]
+	}
+	return status
+}
+
+// NewWeightedBalancer returns a Balancer which distributes calls in
+// proportion to the endpoint weights, using smooth weighted round-robin.
+func NewWeightedBalancer(endpoints ...Endpoint) Balancer {
+	b := &weighted{}
+	b.Update(endpoints)
+	return b
+}
+
+type weighted struct {
+	mu        sync.Mutex
+	endpoints []Endpoint
+	current   []int
+	total     int
+}
+
+func (b *weighted) Pick(ctx context.Context, method string) (*grpc.ClientConn, func(error), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.endpoints) == 0 {
+		return nil, nil, errNoEndpoints
+	}
+	best := 0
+	for i, ep := range b.endpoints {
+		b.current[i] += ep.weight()
+		if b.current[i] > b.current[best] {
+			best = i
+		}
+	}
+	b.current[best] -= b.total
+	return b.endpoints[best].Conn, nil, nil
+}
+
+func (b *weighted) Update(endpoints []Endpoint) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.endpoints = append([]Endpoint(nil), endpoints...)
+	b.current = make([]int, len(endpoints))
+	b.total = 0
+	for _, ep := range endpoints {
+		b.total += ep.weight()
+	}
+}
+
+func (b *weighted) Status() []EndpointStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := make([]EndpointStatus, len(b.endpoints))
+	for i, ep := range b.endpoints {
+		status[i] = endpointStatus(ep)
+	}
+	return status
+}
@@ -0,0 +1,131 @@
+package proxy_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// idleConns returns n connections which are never used for calls.
+func idleConns(t *testing.T, n int) []*grpc.ClientConn {
+	var conns []*grpc.ClientConn
+	for i := 0; i < n; i++ {
+		conn, err := grpc.Dial("127.0.0.1:1", grpc.WithInsecure())
+		require.NoError(t, err)
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+func closeConns(conns []*grpc.ClientConn) {
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+func pickCounts(t *testing.T, b proxy.Balancer, n int) map[*grpc.ClientConn]int {
+	counts := map[*grpc.ClientConn]int{}
+	for i := 0; i < n; i++ {
+		conn, done, err := b.Pick(context.Background(), "/svc/method")
+		require.NoError(t, err)
+		counts[conn]++
+		if done != nil {
+			done(nil)
+		}
+	}
+	return counts
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	conns := idleConns(t, 3)
+	defer closeConns(conns)
+	counts := pickCounts(t, proxy.NewRoundRobinBalancer(proxy.Endpoints(conns...)...), 30)
+	for _, conn := range conns {
+		assert.Equal(t, 10, counts[conn])
+	}
+}
+
+func TestWeightedBalancer(t *testing.T) {
+	conns := idleConns(t, 2)
+	defer closeConns(conns)
+	b := proxy.NewWeightedBalancer(
+		proxy.Endpoint{Conn: conns[0], Weight: 3},
+		proxy.Endpoint{Conn: conns[1], Weight: 1},
+	)
+	counts := pickCounts(t, b, 40)
+	assert.Equal(t, 30, counts[conns[0]])
+	assert.Equal(t, 10, counts[conns[1]])
+}
+
+func TestLeastStreamsBalancer(t *testing.T) {
+	conns := idleConns(t, 2)
+	defer closeConns(conns)
+	b := proxy.NewLeastStreamsBalancer(proxy.Endpoints(conns...)...)
+
+	first, done, err := b.Pick(context.Background(), "/svc/method")
+	require.NoError(t, err)
+	// While the first call is in flight, the other endpoint is preferred.
+	for i := 0; i < 3; i++ {
+		conn, otherDone, err := b.Pick(context.Background(), "/svc/method")
+		require.NoError(t, err)
+		assert.NotEqual(t, first, conn)
+		otherDone(nil)
+	}
+	done(nil)
+	done(nil) // Extra calls are ignored.
+	counts := pickCounts(t, b, 10)
+	assert.Equal(t, 5, counts[conns[0]])
+	assert.Equal(t, 5, counts[conns[1]])
+}
+
+func TestBalancer_NoEndpoints(t *testing.T) {
+	for _, b := range []proxy.Balancer{
+		proxy.NewRoundRobinBalancer(),
+		proxy.NewLeastStreamsBalancer(),
+		proxy.NewWeightedBalancer(),
+	} {
+		_, _, err := b.Pick(context.Background(), "/svc/method")
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	}
+}
+
+func TestBalancer_Update(t *testing.T) {
+	conns := idleConns(t, 2)
+	defer closeConns(conns)
+	b := proxy.NewRoundRobinBalancer(proxy.Endpoints(conns[0])...)
+	b.Update(proxy.Endpoints(conns[1]))
+	counts := pickCounts(t, b, 4)
+	assert.Equal(t, 4, counts[conns[1]])
+}
+
+func TestBalancer_Status(t *testing.T) {
+	conns := idleConns(t, 2)
+	defer closeConns(conns)
+	endpoints := []proxy.Endpoint{{Conn: conns[0], Weight: 3}, {Conn: conns[1]}}
+	for _, b := range []proxy.Balancer{
+		proxy.NewRoundRobinBalancer(endpoints...),
+		proxy.NewLeastStreamsBalancer(endpoints...),
+		proxy.NewWeightedBalancer(endpoints...),
+		proxy.NewOutlierBalancer(proxy.NewLeastStreamsBalancer(), proxy.OutlierConfig{}),
+	} {
+		b.Update(endpoints)
+		_, done, err := b.Pick(context.Background(), "/svc/method")
+		require.NoError(t, err)
+
+		status := b.(proxy.StatusReporter).Status()
+		require.Len(t, status, 2)
+		assert.Equal(t, "127.0.0.1:1", status[0].Target)
+		assert.Equal(t, 3, status[0].Weight)
+		assert.Equal(t, 1, status[1].Weight, "default weight")
+		if done != nil {
+			assert.Equal(t, 1, status[0].Active+status[1].Active, "%T counts in-flight calls", b)
+			done(nil)
+		}
+	}
+}
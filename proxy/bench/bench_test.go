@@ -0,0 +1,127 @@
+package bench_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy/bench"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var targets = []bench.Target{bench.Direct, bench.Proxied}
+
+func TestEnv_Calls(t *testing.T) {
+	for _, target := range targets {
+		t.Run(target.String(), func(t *testing.T) {
+			env, err := bench.Start(target)
+			require.NoError(t, err)
+			defer env.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			assert.NoError(t, env.Unary(1024)(ctx))
+			assert.NoError(t, env.Unary(4<<20)(ctx), "large frames must pass every hop")
+			assert.NoError(t, env.ServerStream(64, 10)(ctx))
+			assert.NoError(t, env.BidiStream(64, 10)(ctx))
+		})
+	}
+}
+
+func TestLoad_Run(t *testing.T) {
+	env, err := bench.Start(bench.Proxied)
+	require.NoError(t, err)
+	defer env.Close()
+
+	res := bench.Load{Concurrency: 4, Calls: 100}.Run(context.Background(), env.Unary(16))
+	assert.Equal(t, 100, res.Calls)
+	assert.Equal(t, 0, res.Errors, "first error: %v", res.FirstError)
+	assert.True(t, res.P50 <= res.P99 && res.P99 <= res.Max, "latencies must be ordered: %v", res)
+	assert.True(t, res.Throughput() > 0)
+
+	res = bench.Load{Concurrency: 4, Duration: 50 * time.Millisecond}.Run(context.Background(), env.Unary(16))
+	assert.True(t, res.Calls > 0)
+	assert.Equal(t, 0, res.Errors, "calls cut short by the deadline are not errors: %v", res.FirstError)
+}
+
+// run benchmarks call against each target.
+func run(b *testing.B, call func(env *bench.Env) func(context.Context) error) {
+	for _, target := range targets {
+		b.Run(target.String(), func(b *testing.B) {
+			env, err := bench.Start(target)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer env.Close()
+			fn := call(env)
+			ctx := context.Background()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := fn(ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkUnary(b *testing.B) {
+	for _, size := range []int{16, 1024, 64 << 10} {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			run(b, func(env *bench.Env) func(context.Context) error { return env.Unary(size) })
+		})
+	}
+}
+
+func BenchmarkLargeFrames(b *testing.B) {
+	for _, size := range []int{1 << 20, 4 << 20} {
+		b.Run(fmt.Sprintf("%dMiB", size>>20), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			run(b, func(env *bench.Env) func(context.Context) error { return env.Unary(size) })
+		})
+	}
+}
+
+func BenchmarkServerStream(b *testing.B) {
+	const size, n = 1024, 100
+	b.SetBytes(size * n)
+	run(b, func(env *bench.Env) func(context.Context) error { return env.ServerStream(size, n) })
+}
+
+func BenchmarkBidiStream(b *testing.B) {
+	const size, n = 1024, 100
+	b.SetBytes(size * n)
+	run(b, func(env *bench.Env) func(context.Context) error { return env.BidiStream(size, n) })
+}
+
+func BenchmarkConcurrentStreams(b *testing.B) {
+	for _, streams := range []int{16, 256} {
+		b.Run(fmt.Sprintf("%d", streams), func(b *testing.B) {
+			for _, target := range targets {
+				b.Run(target.String(), func(b *testing.B) {
+					env, err := bench.Start(target)
+					if err != nil {
+						b.Fatal(err)
+					}
+					defer env.Close()
+					call := env.BidiStream(1024, 10)
+					b.ReportAllocs()
+					b.SetParallelism((streams + 1) / 2)
+					b.ResetTimer()
+					b.RunParallel(func(pb *testing.PB) {
+						for pb.Next() {
+							if err := call(context.Background()); err != nil {
+								b.Error(err)
+								return
+							}
+						}
+					})
+				})
+			}
+		})
+	}
+}
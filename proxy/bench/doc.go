@@ -0,0 +1,28 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+/*
+Package bench measures the overhead of the proxy, by running the same calls
+against a backend directly and through a transparent proxy.
+
+The benchmarks of this package cover unary calls, server and bidirectional
+streams, large frames and many concurrent streams, each in a direct and a
+proxied variant:
+
+	go test -run NONE -bench . -count 10 ./proxy/bench > new.txt
+	benchstat old.txt new.txt
+
+An Env can also be used to benchmark other proxy options, and Load runs
+a fixed-concurrency load test reporting throughput and latencies:
+
+	env, err := bench.Start(bench.Proxied, proxy.WithFlowControl(proxy.BackendToClient, fc))
+	...
+	defer env.Close()
+	res := bench.Load{Concurrency: 64, Duration: 10 * time.Second}.Run(ctx, env.Unary(1024))
+	fmt.Println(res)
+
+Payloads are fixed size and contain no randomness, so results only depend
+on the machine and the code under test.
+*/
+package bench
@@ -0,0 +1,188 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package bench
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// Target selects how an Env's client reaches the backend.
+type Target int
+
+const (
+	// Direct connects the client to the backend.
+	Direct Target = iota
+	// Proxied connects the client to a transparent proxy in front of the
+	// backend.
+	Proxied
+)
+
+func (t Target) String() string {
+	if t == Direct {
+		return "direct"
+	}
+	return "proxied"
+}
+
+// maxMessageSize allows the large frame benchmarks on every hop.
+const maxMessageSize = 16 << 20
+
+// Env is a backend serving the TestService and, for Proxied targets, a
+// proxy forwarding every call to it, all on loopback TCP.
+type Env struct {
+	// Client is connected to the backend or the proxy, depending on the
+	// target.
+	Client pb.TestServiceClient
+
+	backend     *grpc.Server
+	backendConn *grpc.ClientConn
+	proxy       *grpc.Server
+	clientConn  *grpc.ClientConn
+}
+
+// Start starts an Env for target. The proxy is configured with opts, which
+// are ignored for Direct targets.
+func Start(target Target, opts ...proxy.Option) (*Env, error) {
+	e := &Env{}
+	addr, err := e.startBackend()
+	if err != nil {
+		return nil, err
+	}
+	if target == Proxied {
+		if addr, err = e.startProxy(addr, opts); err != nil {
+			e.Close()
+			return nil, err
+		}
+	}
+	e.clientConn, err = grpc.Dial(addr, grpc.WithInsecure(),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(maxMessageSize), grpc.MaxCallSendMsgSize(maxMessageSize)))
+	if err != nil {
+		e.Close()
+		return nil, err
+	}
+	e.Client = pb.NewTestServiceClient(e.clientConn)
+	return e, nil
+}
+
+func (e *Env) startBackend() (string, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	e.backend = grpc.NewServer(grpc.MaxRecvMsgSize(maxMessageSize), grpc.MaxSendMsgSize(maxMessageSize))
+	pb.RegisterTestServiceServer(e.backend, echoService{})
+	go e.backend.Serve(lis)
+	return lis.Addr().String(), nil
+}
+
+func (e *Env) startProxy(backend string, opts []proxy.Option) (string, error) {
+	var err error
+	e.backendConn, err = grpc.Dial(backend, grpc.WithInsecure(), proxy.DialOption(),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(maxMessageSize), grpc.MaxCallSendMsgSize(maxMessageSize)))
+	if err != nil {
+		return "", err
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	director := func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+		return ctx, nil, proxy.Direction{BackendConn: e.backendConn}, nil
+	}
+	e.proxy = grpc.NewServer(
+		proxy.ServerOption(),
+		grpc.MaxRecvMsgSize(maxMessageSize),
+		grpc.MaxSendMsgSize(maxMessageSize),
+		grpc.UnknownServiceHandler(proxy.TransparentHandler(director, opts...)),
+	)
+	go e.proxy.Serve(lis)
+	return lis.Addr().String(), nil
+}
+
+// Close stops the servers and closes the connections of e.
+func (e *Env) Close() {
+	if e.clientConn != nil {
+		e.clientConn.Close()
+	}
+	if e.proxy != nil {
+		e.proxy.Stop()
+	}
+	if e.backendConn != nil {
+		e.backendConn.Close()
+	}
+	e.backend.Stop()
+}
+
+// Payload returns a request payload of size bytes.
+func Payload(size int) string {
+	return strings.Repeat("x", size)
+}
+
+// Unary returns a call sending a Ping with a payload of size bytes.
+func (e *Env) Unary(size int) func(ctx context.Context) error {
+	req := &pb.PingRequest{Value: Payload(size)}
+	return func(ctx context.Context) error {
+		_, err := e.Client.Ping(ctx, req)
+		return err
+	}
+}
+
+// ServerStream returns a call receiving n responses of size bytes from
+// PingList.
+func (e *Env) ServerStream(size, n int) func(ctx context.Context) error {
+	req := &pb.PingRequest{Value: Payload(size)}
+	count := strconv.Itoa(n)
+	return func(ctx context.Context) error {
+		ctx = metadata.AppendToOutgoingContext(ctx, responsesKey, count)
+		stream, err := e.Client.PingList(ctx, req)
+		if err != nil {
+			return err
+		}
+		for {
+			if _, err := stream.Recv(); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// BidiStream returns a call exchanging n messages of size bytes over
+// PingStream, one at a time.
+func (e *Env) BidiStream(size, n int) func(ctx context.Context) error {
+	req := &pb.PingRequest{Value: Payload(size)}
+	return func(ctx context.Context) error {
+		stream, err := e.Client.PingStream(ctx)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err := stream.Send(req); err != nil {
+				return err
+			}
+			if _, err := stream.Recv(); err != nil {
+				return err
+			}
+		}
+		if err := stream.CloseSend(); err != nil {
+			return err
+		}
+		if _, err := stream.Recv(); err != io.EOF {
+			return err
+		}
+		return nil
+	}
+}
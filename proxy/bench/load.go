@@ -0,0 +1,124 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package bench
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Load describes a load test: Concurrency workers each make calls one after
+// another until Duration or Calls is reached.
+type Load struct {
+	// Concurrency is the number of concurrent callers. Defaults to 1.
+	Concurrency int
+
+	// Duration bounds the length of the test, if positive.
+	Duration time.Duration
+
+	// Calls bounds the total number of calls, if positive. If neither
+	// Duration nor Calls is set, the test runs until ctx is done.
+	Calls int
+}
+
+// Result summarizes a load test.
+type Result struct {
+	Calls   int
+	Errors  int
+	Elapsed time.Duration
+
+	// Latencies of successful calls.
+	P50, P90, P99, Max time.Duration
+
+	// FirstError is the first error a call returned.
+	FirstError error
+}
+
+// Throughput returns the successful calls per second.
+func (r Result) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Calls-r.Errors) / r.Elapsed.Seconds()
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("%d calls (%d errors) in %v: %.0f/s, p50 %v, p90 %v, p99 %v, max %v",
+		r.Calls, r.Errors, r.Elapsed, r.Throughput(), r.P50, r.P90, r.P99, r.Max)
+}
+
+// Run runs the load test, making each call with call.
+func (l Load) Run(ctx context.Context, call func(ctx context.Context) error) Result {
+	if l.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.Duration)
+		defer cancel()
+	}
+	workers := l.Concurrency
+	if workers <= 0 {
+		workers = 1
+	}
+
+	var (
+		mu        sync.Mutex
+		res       Result
+		latencies []time.Duration
+		wg        sync.WaitGroup
+	)
+	// next reserves a call, reporting false once the test is over.
+	next := func() bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if l.Calls > 0 && res.Calls >= l.Calls {
+			return false
+		}
+		res.Calls++
+		return true
+	}
+	start := time.Now()
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for next() {
+				begin := time.Now()
+				err := call(ctx)
+				took := time.Since(begin)
+				mu.Lock()
+				if err != nil {
+					// Calls cut short by the end of the test are not errors.
+					if ctx.Err() != nil {
+						res.Calls--
+					} else {
+						res.Errors++
+						if res.FirstError == nil {
+							res.FirstError = err
+						}
+					}
+				} else {
+					latencies = append(latencies, took)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	res.Elapsed = time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	if n := len(latencies); n != 0 {
+		res.P50 = latencies[n*50/100]
+		res.P90 = latencies[n*90/100]
+		res.P99 = latencies[n*99/100]
+		res.Max = latencies[n-1]
+	}
+	return res
+}
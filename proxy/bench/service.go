@@ -0,0 +1,72 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package bench
+
+import (
+	"context"
+	"io"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// responsesKey is the metadata key holding the number of PingList
+// responses.
+const responsesKey = "bench-responses"
+
+// echoService is the backend of an Env. It answers each request with its
+// own value and does no other work, so that benchmarks measure transport
+// and proxy costs only.
+type echoService struct{}
+
+func (echoService) PingEmpty(ctx context.Context, _ *pb.Empty) (*pb.PingResponse, error) {
+	return &pb.PingResponse{}, nil
+}
+
+func (echoService) Ping(ctx context.Context, req *pb.PingRequest) (*pb.PingResponse, error) {
+	return &pb.PingResponse{Value: req.Value}, nil
+}
+
+func (echoService) PingError(ctx context.Context, req *pb.PingRequest) (*pb.Empty, error) {
+	return nil, status.Error(codes.Unknown, req.Value)
+}
+
+func (echoService) PingList(req *pb.PingRequest, stream pb.TestService_PingListServer) error {
+	n := 1
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	if v := md.Get(responsesKey); len(v) != 0 {
+		var err error
+		if n, err = strconv.Atoi(v[0]); err != nil {
+			return status.Errorf(codes.InvalidArgument, "bad %s: %v", responsesKey, err)
+		}
+	}
+	resp := &pb.PingResponse{Value: req.Value}
+	for i := 0; i < n; i++ {
+		resp.Counter = int32(i)
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (echoService) PingStream(stream pb.TestService_PingStreamServer) error {
+	for counter := int32(0); ; counter++ {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&pb.PingResponse{Value: req.Value, Counter: counter}); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CircuitState is the state of a backend circuit breaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets all streams through.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects all streams.
+	CircuitOpen
+	// CircuitHalfOpen lets a limited number of probe streams through.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitBreakerConfig configures the circuit breakers created by
+// WithCircuitBreaker. At least one of ConsecutiveFailures or ErrorRate must
+// be set for a circuit to ever trip.
+type CircuitBreakerConfig struct {
+	// ConsecutiveFailures trips the circuit after this many failed streams
+	// in a row.
+	ConsecutiveFailures int
+
+	// ErrorRate trips the circuit when the ratio of failed streams within
+	// Window exceeds it, once at least MinRequests streams were seen.
+	ErrorRate   float64
+	MinRequests int
+
+	// Window is the period over which the error rate is computed. Defaults
+	// to 10 seconds.
+	Window time.Duration
+
+	// OpenTimeout is how long a tripped circuit rejects streams before
+	// probing the backend. Defaults to 5 seconds.
+	OpenTimeout time.Duration
+
+	// HalfOpenProbes is the number of concurrent probe streams allowed while
+	// half-open. Defaults to 1.
+	HalfOpenProbes int
+
+	// IsFailure classifies the result of a stream. By default
+	// codes.Unavailable, codes.DeadlineExceeded and codes.Internal are
+	// failures.
+	IsFailure func(err error) bool
+
+	// OnStateChange, if set, is called whenever the circuit of a backend
+	// changes state.
+	OnStateChange func(backend string, from, to CircuitState)
+}
+
+// WithCircuitBreaker enables a circuit breaker for every backend, keyed by
+// the target of the backend connection. Streams to a backend with an open
+// circuit fail immediately with codes.Unavailable.
+func WithCircuitBreaker(cfg CircuitBreakerConfig) Option {
+	return WithCircuitBreakers(NewCircuitBreakers(cfg))
+}
+
+// WithCircuitBreakers is like WithCircuitBreaker, but uses the circuits of
+// b, which may be shared by several handlers and inspected while serving.
+func WithCircuitBreakers(b *CircuitBreakers) Option {
+	return func(o *options) {
+		o.breakers = b
+	}
+}
+
+// NewCircuitBreakers returns the circuit breakers of cfg, with no circuits
+// yet.
+func NewCircuitBreakers(cfg CircuitBreakerConfig) *CircuitBreakers {
+	if cfg.Window <= 0 {
+		cfg.Window = 10 * time.Second
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = 5 * time.Second
+	}
+	if cfg.HalfOpenProbes <= 0 {
+		cfg.HalfOpenProbes = 1
+	}
+	if cfg.IsFailure == nil {
+		cfg.IsFailure = isBackendFailure
+	}
+	return &CircuitBreakers{cfg: cfg, circuits: make(map[string]*circuit)}
+}
+
+func isBackendFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal:
+		return true
+	}
+	return false
+}
+
+// CircuitBreakers holds a circuit per backend, see WithCircuitBreakers.
+type CircuitBreakers struct {
+	cfg CircuitBreakerConfig
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	state       CircuitState
+	consecutive int
+	windowStart time.Time
+	total       int
+	failures    int
+	openedAt    time.Time
+	probes      int
+}
+
+type stateChange struct {
+	backend  string
+	from, to CircuitState
+}
+
+// allow checks whether a stream to backend may proceed. The returned
+// function must be called with the result of the stream.
+func (b *CircuitBreakers) allow(backend string) (func(error), error) {
+	var changes []stateChange
+	defer b.notify(&changes)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.circuits[backend]
+	if !ok {
+		c = &circuit{windowStart: time.Now()}
+		b.circuits[backend] = c
+	}
+
+	probe := false
+	switch c.state {
+	case CircuitOpen:
+		if time.Since(c.openedAt) < b.cfg.OpenTimeout {
+			return nil, status.Errorf(codes.Unavailable, "circuit breaker for backend %s is open", backend)
+		}
+		b.setState(&changes, backend, c, CircuitHalfOpen)
+		fallthrough
+	case CircuitHalfOpen:
+		if c.probes >= b.cfg.HalfOpenProbes {
+			return nil, status.Errorf(codes.Unavailable, "circuit breaker for backend %s is half-open", backend)
+		}
+		c.probes++
+		probe = true
+	}
+
+	var once sync.Once
+	return func(err error) {
+		once.Do(func() { b.record(backend, c, probe, err) })
+	}, nil
+}
+
+func (b *CircuitBreakers) record(backend string, c *circuit, probe bool, err error) {
+	var changes []stateChange
+	defer b.notify(&changes)
+
+	failed := b.cfg.IsFailure(err)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		c.probes--
+		if c.state != CircuitHalfOpen {
+			return
+		}
+		if failed {
+			b.trip(&changes, backend, c)
+		} else {
+			b.reset(c)
+			b.setState(&changes, backend, c, CircuitClosed)
+		}
+		return
+	}
+	if c.state != CircuitClosed {
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(c.windowStart) > b.cfg.Window {
+		c.windowStart, c.total, c.failures = now, 0, 0
+	}
+	c.total++
+	if !failed {
+		c.consecutive = 0
+		return
+	}
+	c.failures++
+	c.consecutive++
+	if b.cfg.ConsecutiveFailures > 0 && c.consecutive >= b.cfg.ConsecutiveFailures {
+		b.trip(&changes, backend, c)
+		return
+	}
+	if b.cfg.ErrorRate > 0 && c.total >= b.cfg.MinRequests &&
+		float64(c.failures)/float64(c.total) > b.cfg.ErrorRate {
+		b.trip(&changes, backend, c)
+	}
+}
+
+func (b *CircuitBreakers) trip(changes *[]stateChange, backend string, c *circuit) {
+	c.openedAt = time.Now()
+	b.setState(changes, backend, c, CircuitOpen)
+}
+
+func (b *CircuitBreakers) reset(c *circuit) {
+	c.consecutive = 0
+	c.windowStart, c.total, c.failures = time.Now(), 0, 0
+}
+
+func (b *CircuitBreakers) setState(changes *[]stateChange, backend string, c *circuit, to CircuitState) {
+	if c.state == to {
+		return
+	}
+	*changes = append(*changes, stateChange{backend: backend, from: c.state, to: to})
+	c.state = to
+}
+
+// notify reports state changes, outside of the lock.
+func (b *CircuitBreakers) notify(changes *[]stateChange) {
+	if b.cfg.OnStateChange == nil {
+		return
+	}
+	for _, ch := range *changes {
+		b.cfg.OnStateChange(ch.backend, ch.from, ch.to)
+	}
+}
+
+// States returns the state of every circuit, by backend. An open circuit
+// whose timeout has passed is reported as open until the next stream probes
+// the backend.
+func (b *CircuitBreakers) States() map[string]CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	states := make(map[string]CircuitState, len(b.circuits))
+	for backend, c := range b.circuits {
+		states[backend] = c.state
+	}
+	return states
+}
+
+// Reset closes the circuit of backend and clears its failure counts,
+// reporting whether the backend had a circuit.
+func (b *CircuitBreakers) Reset(backend string) bool {
+	var changes []stateChange
+	defer b.notify(&changes)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.circuits[backend]
+	if !ok {
+		return false
+	}
+	b.reset(c)
+	b.setState(&changes, backend, c, CircuitClosed)
+	return true
+}
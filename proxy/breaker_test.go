@@ -0,0 +1,93 @@
+package proxy_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestCircuitBreaker_TripsAndRecovers(t *testing.T) {
+	var calls int32
+	var mu sync.Mutex
+	var changes []proxy.CircuitState
+	env := newTestEnv(t, flakyService(2, codes.Unavailable, &calls), proxy.WithCircuitBreaker(proxy.CircuitBreakerConfig{
+		ConsecutiveFailures: 2,
+		OpenTimeout:         50 * time.Millisecond,
+		OnStateChange: func(backend string, from, to proxy.CircuitState) {
+			mu.Lock()
+			defer mu.Unlock()
+			changes = append(changes, to)
+		},
+	}))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	}
+
+	// The circuit is open, so the backend is not called.
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "circuit breaker")
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+
+	// After the open timeout, a successful probe closes the circuit.
+	time.Sleep(60 * time.Millisecond)
+	_, err = env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	assert.NoError(t, err)
+	_, err = env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	assert.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []proxy.CircuitState{proxy.CircuitOpen, proxy.CircuitHalfOpen, proxy.CircuitClosed}, changes)
+}
+
+func TestCircuitBreaker_ErrorRate(t *testing.T) {
+	var calls int32
+	env := newTestEnv(t, flakyService(100, codes.Internal, &calls), proxy.WithCircuitBreaker(proxy.CircuitBreakerConfig{
+		ErrorRate:   0.5,
+		MinRequests: 4,
+		OpenTimeout: time.Minute,
+	}))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	for i := 0; i < 6; i++ {
+		env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	}
+	assert.EqualValues(t, 4, atomic.LoadInt32(&calls), "circuit must trip once MinRequests is reached")
+}
+
+func TestCircuitBreakers_StatesAndReset(t *testing.T) {
+	var calls int32
+	breakers := proxy.NewCircuitBreakers(proxy.CircuitBreakerConfig{ConsecutiveFailures: 1, OpenTimeout: time.Hour})
+	env := newTestEnv(t, flakyService(1, codes.Unavailable, &calls), proxy.WithCircuitBreakers(breakers))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	target := env.backendConn.Target()
+	assert.Equal(t, map[string]proxy.CircuitState{target: proxy.CircuitOpen}, breakers.States())
+	assert.False(t, breakers.Reset("unknown"))
+	assert.True(t, breakers.Reset(target))
+	assert.Equal(t, proxy.CircuitClosed, breakers.States()[target])
+
+	_, err = env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	assert.NoError(t, err, "a reset circuit lets streams through")
+}
@@ -0,0 +1,257 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"io"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// BroadcastMode controls how responses are combined when a call is broadcast
+// to multiple backends.
+type BroadcastMode int
+
+const (
+	// BroadcastFirst relays the response of the first backend to answer
+	// with a message or a successful status. Responses and errors from the
+	// other backends are discarded, so the call only fails if every backend
+	// failed.
+	BroadcastFirst BroadcastMode = iota
+
+	// BroadcastMerge relays the response messages of all backends, in the
+	// order in which they arrive.
+	BroadcastMerge
+)
+
+// broadcastEvent is a message or final result received from one backend.
+type broadcastEvent struct {
+	idx int
+	f   *frame
+	err error
+}
+
+// broadcastStream is a ClientStream which replicates every client message to
+// several backends and combines their responses.
+//
+// The call only completes once every backend has finished. With
+// BroadcastMerge it succeeds if all backends succeed, otherwise the first
+// error received is returned. With BroadcastFirst the status is that of the
+// winner, the first backend to answer with a message or a successful status,
+// or the first error received if every backend failed.
+type broadcastStream struct {
+	ctx     context.Context
+	streams []grpc.ClientStream
+	mode    BroadcastMode
+	events  chan broadcastEvent
+
+	// Owned by the sending side.
+	sendDone []bool
+
+	// Owned by the receiving side.
+	winner    int
+	winnerErr error
+	pending   *broadcastEvent
+	live      int
+	err       error
+}
+
+var _ grpc.ClientStream = &broadcastStream{}
+
+// newBroadcastStream opens a stream to each of the given backends. The
+// streams are shut down when ctx is cancelled.
+func newBroadcastStream(ctx context.Context, conns []*grpc.ClientConn, mode BroadcastMode, method string, callOpts ...grpc.CallOption) (grpc.ClientStream, error) {
+	s := &broadcastStream{
+		ctx:      ctx,
+		mode:     mode,
+		events:   make(chan broadcastEvent, len(conns)),
+		sendDone: make([]bool, len(conns)),
+		winner:   -1,
+		live:     len(conns),
+	}
+	for _, conn := range conns {
+		out, err := grpc.NewClientStream(ctx, clientStreamDescForProxying, conn, method, callOpts...)
+		if err != nil {
+			// Streams opened so far are released by the caller cancelling ctx.
+			return nil, err
+		}
+		s.streams = append(s.streams, out)
+	}
+	for i, out := range s.streams {
+		go s.recvLoop(i, out)
+	}
+	return s, nil
+}
+
+func (s *broadcastStream) recvLoop(idx int, out grpc.ClientStream) {
+	for {
+		f := &frame{}
+		err := out.RecvMsg(f)
+		select {
+		case s.events <- broadcastEvent{idx: idx, f: f, err: err}:
+		case <-s.ctx.Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// next returns the next event from any backend, or false once all backends
+// have finished.
+func (s *broadcastStream) next() (broadcastEvent, bool) {
+	if s.pending != nil {
+		ev := *s.pending
+		s.pending = nil
+		return ev, true
+	}
+	if s.live == 0 {
+		return broadcastEvent{}, false
+	}
+	select {
+	case ev := <-s.events:
+		if s.winner < 0 && (ev.err == nil || ev.err == io.EOF) {
+			s.winner = ev.idx
+		}
+		return ev, true
+	case <-s.ctx.Done():
+		return broadcastEvent{err: status.FromContextError(s.ctx.Err()).Err()}, true
+	}
+}
+
+func (s *broadcastStream) Header() (metadata.MD, error) {
+	if s.mode == BroadcastMerge {
+		var mds []metadata.MD
+		for _, out := range s.streams {
+			// Errors are reported through RecvMsg.
+			if md, err := out.Header(); err == nil {
+				mds = append(mds, md)
+			}
+		}
+		return metadata.Join(mds...), nil
+	}
+	for s.winner < 0 {
+		ev, ok := s.next()
+		if !ok {
+			// Every backend failed.
+			return nil, s.err
+		}
+		switch {
+		case s.winner >= 0:
+			s.pending = &ev
+		case ev.f == nil:
+			// The context was cancelled.
+			s.pending = &ev
+			return nil, ev.err
+		default:
+			s.finished(ev)
+		}
+	}
+	return s.streams[s.winner].Header()
+}
+
+func (s *broadcastStream) Trailer() metadata.MD {
+	if s.mode == BroadcastMerge || s.winner < 0 {
+		var mds []metadata.MD
+		for _, out := range s.streams {
+			mds = append(mds, out.Trailer())
+		}
+		return metadata.Join(mds...)
+	}
+	return s.streams[s.winner].Trailer()
+}
+
+func (s *broadcastStream) CloseSend() error {
+	var firstErr error
+	for _, out := range s.streams {
+		if err := out.CloseSend(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (s *broadcastStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *broadcastStream) SendMsg(m interface{}) error {
+	sent := false
+	for i, out := range s.streams {
+		if s.sendDone[i] {
+			continue
+		}
+		if err := out.SendMsg(m); err != nil {
+			if err != io.EOF {
+				return err
+			}
+			// The backend finished, its status is reported through RecvMsg.
+			s.sendDone[i] = true
+			continue
+		}
+		sent = true
+	}
+	if !sent {
+		return io.EOF
+	}
+	return nil
+}
+
+func (s *broadcastStream) RecvMsg(m interface{}) error {
+	for {
+		ev, ok := s.next()
+		if !ok {
+			return s.status()
+		}
+		if ev.err != nil {
+			if ev.f == nil {
+				// The context was cancelled.
+				return ev.err
+			}
+			s.finished(ev)
+			continue
+		}
+		if s.mode == BroadcastFirst && ev.idx != s.winner {
+			continue
+		}
+		f, ok := m.(*frame)
+		if !ok {
+			return status.Errorf(codes.Internal, "unexpected message type %T", m)
+		}
+		f.payload = ev.f.payload
+		return nil
+	}
+}
+
+// finished records the final result of a backend.
+func (s *broadcastStream) finished(ev broadcastEvent) {
+	s.live--
+	if ev.err == io.EOF {
+		return
+	}
+	if ev.idx == s.winner {
+		s.winnerErr = ev.err
+	}
+	if s.err == nil {
+		s.err = ev.err
+	}
+}
+
+// status returns the result of the call once every backend has finished.
+func (s *broadcastStream) status() error {
+	err := s.err
+	if s.mode == BroadcastFirst && s.winner >= 0 {
+		err = s.winnerErr
+	}
+	if err != nil {
+		return err
+	}
+	return io.EOF
+}
@@ -0,0 +1,133 @@
+package proxy_test
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// broadcastEnv starts a test environment where every call is broadcast to
+// the main backend and to one replica.
+func broadcastEnv(t *testing.T, svc, replica pb.TestServiceServer, mode proxy.BroadcastMode) (*testEnv, func()) {
+	replicaServer, replicaConn := startBackend(t, replica)
+	env := newTestEnvWithDirector(t, svc, func(backend *grpc.ClientConn) proxy.StreamDirector {
+		return func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+			return ctx, nil, proxy.Direction{
+				BackendConn:   backend,
+				Broadcast:     []*grpc.ClientConn{replicaConn},
+				BroadcastMode: mode,
+			}, nil
+		}
+	})
+	return env, func() {
+		env.Close()
+		replicaConn.Close()
+		replicaServer.Stop()
+	}
+}
+
+func countingService(calls *int32) *pingService {
+	return &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			atomic.AddInt32(calls, 1)
+			return &pb.PingResponse{Value: ping.Value}, nil
+		},
+	}
+}
+
+func TestBroadcast_FirstReachesAllBackends(t *testing.T) {
+	var calls int32
+	env, closeEnv := broadcastEnv(t, countingService(&calls), countingService(&calls), proxy.BroadcastFirst)
+	defer closeEnv()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	out, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err)
+	assert.Equal(t, "foo", out.Value)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls), "every backend must receive the request")
+}
+
+func TestBroadcast_MergeRelaysAllResponses(t *testing.T) {
+	env, closeEnv := broadcastEnv(t, &pingService{}, &pingService{}, proxy.BroadcastMerge)
+	defer closeEnv()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	stream, err := env.client.PingList(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err)
+	count := 0
+	for {
+		_, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		count++
+	}
+	assert.Equal(t, 2*countListResponses, count)
+}
+
+func TestBroadcast_MergeReplicaFailureFailsCall(t *testing.T) {
+	failing := &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			return nil, status.Error(codes.Aborted, "replica failed")
+		},
+	}
+	env, closeEnv := broadcastEnv(t, &pingService{}, failing, proxy.BroadcastMerge)
+	defer closeEnv()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+}
+
+func TestBroadcast_FirstRelaysFirstSuccess(t *testing.T) {
+	slow := &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			// Let the replica fail first.
+			time.Sleep(50 * time.Millisecond)
+			return &pb.PingResponse{Value: ping.Value}, nil
+		},
+	}
+	failing := &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			return nil, status.Error(codes.Aborted, "replica failed")
+		},
+	}
+	env, closeEnv := broadcastEnv(t, slow, failing, proxy.BroadcastFirst)
+	defer closeEnv()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	out, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err, "a failed replica must not fail the call")
+	assert.Equal(t, "foo", out.Value)
+}
+
+func TestBroadcast_FirstFailsWhenAllFail(t *testing.T) {
+	failing := &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			return nil, status.Error(codes.Aborted, "backend failed")
+		},
+	}
+	env, closeEnv := broadcastEnv(t, failing, failing, proxy.BroadcastFirst)
+	defer closeEnv()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+}
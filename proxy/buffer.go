@@ -0,0 +1,76 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"math/bits"
+	"sync"
+)
+
+const (
+	// minBufferClass and maxBufferClass bound the pooled buffer sizes, as
+	// powers of two from 256B to 4MiB. Larger buffers are not pooled.
+	minBufferClass = 8
+	maxBufferClass = 22
+)
+
+// bufferPools recycles scratch buffers in power-of-two size classes.
+//
+// Only buffers whose lifetime the proxy controls are pooled. Messages
+// received from gRPC are forwarded without copying, and gRPC keeps sent
+// messages queued until the transport has written them, so those slices are
+// never returned to a pool.
+var bufferPools [maxBufferClass - minBufferClass + 1]sync.Pool
+
+// bufferClass returns the index of the smallest size class holding n bytes,
+// or -1 if n is too large to pool.
+func bufferClass(n int) int {
+	if n <= 1<<minBufferClass {
+		return 0
+	}
+	c := bits.Len(uint(n - 1))
+	if c > maxBufferClass {
+		return -1
+	}
+	return c - minBufferClass
+}
+
+// getBuffer returns a buffer of length n. It should be returned with
+// putBuffer once it is no longer used.
+func getBuffer(n int) *[]byte {
+	c := bufferClass(n)
+	if c < 0 {
+		b := make([]byte, n)
+		return &b
+	}
+	if b, ok := bufferPools[c].Get().(*[]byte); ok {
+		*b = (*b)[:n]
+		return b
+	}
+	b := make([]byte, n, 1<<uint(c+minBufferClass))
+	return &b
+}
+
+// putBuffer returns a buffer from getBuffer to its pool.
+func putBuffer(b *[]byte) {
+	c := bufferClass(cap(*b))
+	if c < 0 || cap(*b) != 1<<uint(c+minBufferClass) {
+		return
+	}
+	bufferPools[c].Put(b)
+}
+
+// framePool recycles the frames queued between the reading and writing
+// side of a buffered copy.
+var framePool = sync.Pool{New: func() interface{} { return new(frame) }}
+
+func getFrame() *frame {
+	return framePool.Get().(*frame)
+}
+
+func putFrame(f *frame) {
+	f.payload = nil
+	framePool.Put(f)
+}
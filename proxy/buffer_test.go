@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestBufferPool_Classes(t *testing.T) {
+	for _, n := range []int{0, 1, 255, 256, 257, 4096, 1 << 22} {
+		b := getBuffer(n)
+		require.Len(t, *b, n)
+		assert.True(t, cap(*b) >= 256, "size %d", n)
+		assert.Equal(t, 0, cap(*b)&(cap(*b)-1), "capacity of size %d is a power of two", n)
+		putBuffer(b)
+	}
+
+	large := getBuffer(1<<22 + 1)
+	assert.Len(t, *large, 1<<22+1)
+	putBuffer(large)
+
+	// Foreign buffers are dropped rather than pooled in the wrong class.
+	odd := make([]byte, 300)
+	putBuffer(&odd)
+	assert.Equal(t, 256, cap(*getBuffer(200)))
+}
+
+// repeatStream receives the same payload n times.
+type repeatStream struct {
+	payload []byte
+	n       int
+}
+
+func (s *repeatStream) Context() context.Context { return context.Background() }
+func (s *repeatStream) SendMsg(m interface{}) error {
+	return io.ErrClosedPipe
+}
+
+func (s *repeatStream) RecvMsg(m interface{}) error {
+	if s.n == 0 {
+		return io.EOF
+	}
+	s.n--
+	m.(*frame).payload = s.payload
+	return nil
+}
+
+// discardStream drops sent messages.
+type discardStream struct{}
+
+func (discardStream) Context() context.Context     { return context.Background() }
+func (discardStream) SetHeader(metadata.MD) error  { return nil }
+func (discardStream) SendHeader(metadata.MD) error { return nil }
+func (discardStream) SetTrailer(metadata.MD)       {}
+func (discardStream) SendMsg(m interface{}) error  { return nil }
+func (discardStream) RecvMsg(m interface{}) error  { return io.EOF }
+
+func BenchmarkCopyStream(b *testing.B) {
+	payload := make([]byte, 1024)
+	for _, bc := range []struct {
+		name string
+		fc   *FlowControl
+	}{
+		{name: "unbuffered"},
+		{name: "buffered", fc: &FlowControl{Buffer: 16}},
+		{name: "batched", fc: &FlowControl{Buffer: 16, Batch: 8}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(payload)))
+			src := &repeatStream{payload: payload, n: b.N}
+			if err := bc.fc.copyStream(src, discardStream{}); err != io.EOF {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+func BenchmarkTransformedSend(b *testing.B) {
+	b.ReportAllocs()
+	identity := FrameTransformerFunc(func(ctx context.Context, info FrameInfo, payload []byte) ([][]byte, error) {
+		return [][]byte{payload}, nil
+	})
+	s := newTransformedServerStream(discardStream{}, "/svc/Method", []FrameTransformer{identity})
+	f := &frame{payload: make([]byte, 1024)}
+	for i := 0; i < b.N; i++ {
+		if err := s.SendMsg(f); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// discardResponseWriter is an http.ResponseWriter which drops the body.
+type discardResponseWriter struct{ header http.Header }
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardResponseWriter) WriteHeader(int)             {}
+
+func BenchmarkGRPCWebFrame(b *testing.B) {
+	payload := make([]byte, 16<<10)
+	for _, text := range []bool{false, true} {
+		name := "binary"
+		if text {
+			name = "text"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(payload)))
+			s := &webServerStream{text: text, w: &discardResponseWriter{header: make(http.Header)}}
+			for i := 0; i < b.N; i++ {
+				if err := s.writeFrameLocked(0, payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// CachedResponse is a successful response of a unary call, as kept by a
+// ResponseCache.
+type CachedResponse struct {
+	Header  metadata.MD
+	Payload []byte
+	Trailer metadata.MD
+}
+
+// ResponseCache stores responses by key. Implementations backed by shared
+// storage, such as Redis, let several proxies use the same cache.
+type ResponseCache interface {
+	// Get returns the response stored for key, or nil if there is none.
+	Get(ctx context.Context, key string) (*CachedResponse, error)
+	// Set stores resp for key, for at most ttl.
+	Set(ctx context.Context, key string, resp *CachedResponse, ttl time.Duration) error
+}
+
+// CachePolicy describes how the responses of a set of methods are cached.
+//
+// Only successful responses of unary-style calls are cached. Cached
+// responses are served to every call with the same key, so the methods must
+// be idempotent, and metadata which changes the response, such as
+// authorization, must be listed in VaryMetadata.
+//
+// The request is read before the backend is called, until the client
+// half-closes or sends a second message. Caching must not be enabled for
+// methods where clients wait for responses before half-closing.
+type CachePolicy struct {
+	// Cache stores the responses.
+	Cache ResponseCache
+
+	// TTL is how long responses are served from the cache.
+	TTL time.Duration
+
+	// VaryMetadata lists the client metadata keys which are part of the
+	// cache key, besides the method and the request message.
+	VaryMetadata []string
+
+	// MaxResponseSize, if positive, is the size of the largest response
+	// message which is cached.
+	MaxResponseSize int
+}
+
+// WithResponseCache enables caching of the responses of methods whose full
+// method name starts with prefix, such as "/pkg.Service/Method" or
+// "/pkg.Service/". When several prefixes match, the longest wins.
+//
+// Errors of the cache are treated as misses, so that calls still reach the
+// backend.
+func WithResponseCache(prefix string, policy CachePolicy) Option {
+	return func(o *options) {
+		if o.caches == nil {
+			o.caches = make(map[string]*CachePolicy)
+		}
+		o.caches[prefix] = &policy
+	}
+}
+
+// cachePolicy returns the cache policy for method, or nil.
+func (o *options) cachePolicy(method string) *CachePolicy {
+	var best *CachePolicy
+	bestLen := -1
+	for prefix, p := range o.caches {
+		if len(prefix) > bestLen && strings.HasPrefix(method, prefix) {
+			best, bestLen = p, len(prefix)
+		}
+	}
+	return best
+}
+
+// cacheLookup is the cache state of a single stream.
+type cacheLookup struct {
+	policy *CachePolicy
+	// key is empty for calls which are not cached.
+	key string
+	hit *CachedResponse
+}
+
+// lookup reads the request of a call and looks up its response. The
+// returned server stream replays the request for the backend call.
+func (p *CachePolicy) lookup(ctx context.Context, in grpc.ServerStream, method string) (grpc.ServerStream, *cacheLookup, error) {
+	req, unary, err := bufferRequest(in, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	l := &cacheLookup{policy: p}
+	in = &replayServerStream{ServerStream: in, req: req, eof: unary}
+	if !unary || len(req) != 1 {
+		return in, l, nil
+	}
+	l.key = p.key(ctx, method, req[0].payload)
+	if resp, err := p.Cache.Get(ctx, l.key); err == nil {
+		l.hit = resp
+	}
+	return in, l, nil
+}
+
+// key hashes the method, the vary metadata and the request.
+func (p *CachePolicy) key(ctx context.Context, method string, payload []byte) string {
+	return requestKey(ctx, method, p.VaryMetadata, payload)
+}
+
+// requestKey hashes the method, the values of the vary metadata keys in the
+// incoming metadata of ctx, and the request.
+func requestKey(ctx context.Context, method string, vary []string, payload []byte) string {
+	h := sha256.New()
+	io.WriteString(h, method)
+	h.Write([]byte{0})
+	if len(vary) != 0 {
+		md, _ := metadata.FromIncomingContext(ctx)
+		keys := make([]string, len(vary))
+		for i, k := range vary {
+			keys[i] = strings.ToLower(k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			io.WriteString(h, k)
+			for _, v := range md.Get(k) {
+				h.Write([]byte{1})
+				io.WriteString(h, v)
+			}
+			h.Write([]byte{0})
+		}
+	}
+	h.Write(payload)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// record wraps the backend stream of a miss to store its response.
+func (l *cacheLookup) record(ctx context.Context, out grpc.ClientStream) grpc.ClientStream {
+	if l.key == "" || l.hit != nil {
+		return out
+	}
+	p := l.policy
+	return &recordingClientStream{ClientStream: out, maxSize: p.MaxResponseSize, done: func(resp *CachedResponse) {
+		p.Cache.Set(ctx, l.key, resp, p.TTL)
+	}}
+}
+
+// replayServerStream returns buffered request messages before reading from
+// the client. If eof is set the client has already half-closed.
+type replayServerStream struct {
+	grpc.ServerStream
+	req []*frame
+	eof bool
+}
+
+func (s *replayServerStream) RecvMsg(m interface{}) error {
+	if len(s.req) == 0 {
+		if s.eof {
+			return io.EOF
+		}
+		return s.ServerStream.RecvMsg(m)
+	}
+	f, ok := m.(*frame)
+	if !ok {
+		return s.ServerStream.RecvMsg(m)
+	}
+	f.payload = s.req[0].payload
+	s.req = s.req[1:]
+	return nil
+}
+
+// cachedClientStream serves a cached response in place of a backend call.
+type cachedClientStream struct {
+	ctx  context.Context
+	resp *CachedResponse
+	done bool
+}
+
+func (s *cachedClientStream) Header() (metadata.MD, error) { return s.resp.Header.Copy(), nil }
+func (s *cachedClientStream) Trailer() metadata.MD         { return s.resp.Trailer.Copy() }
+func (s *cachedClientStream) CloseSend() error             { return nil }
+func (s *cachedClientStream) Context() context.Context     { return s.ctx }
+func (s *cachedClientStream) SendMsg(m interface{}) error  { return nil }
+
+func (s *cachedClientStream) RecvMsg(m interface{}) error {
+	f, ok := m.(*frame)
+	if s.done || !ok {
+		return io.EOF
+	}
+	s.done = true
+	f.payload = s.resp.Payload
+	return nil
+}
+
+// recordingClientStream keeps the response of a backend call, and passes it
+// to done once the call has succeeded with a single response message of at
+// most maxSize bytes, if maxSize is positive.
+type recordingClientStream struct {
+	grpc.ClientStream
+	maxSize int
+	done    func(*CachedResponse)
+	resp    CachedResponse
+	frames  int
+}
+
+func (s *recordingClientStream) Header() (metadata.MD, error) {
+	md, err := s.ClientStream.Header()
+	if err == nil {
+		s.resp.Header = md.Copy()
+	}
+	return md, err
+}
+
+func (s *recordingClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	switch {
+	case err == io.EOF && s.frames == 1:
+		s.resp.Trailer = s.ClientStream.Trailer().Copy()
+		s.done(&s.resp)
+	case err == nil:
+		s.frames++
+		if f, ok := m.(*frame); ok && s.frames == 1 && (s.maxSize <= 0 || len(f.payload) <= s.maxSize) {
+			s.resp.Payload = append([]byte(nil), f.payload...)
+			break
+		}
+		// Not recordable, make sure done is not called.
+		s.frames = 2
+	}
+	return err
+}
+
+// LRUCache is an in-memory ResponseCache holding a bounded number of
+// responses, evicting the least recently used ones first.
+//
+// An LRUCache is safe for concurrent use.
+type LRUCache struct {
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type lruEntry struct {
+	key     string
+	resp    *CachedResponse
+	expires time.Time
+}
+
+// NewLRUCache returns an LRUCache holding up to maxEntries responses.
+func NewLRUCache(maxEntries int) *LRUCache {
+	return &LRUCache{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// Get implements ResponseCache.
+func (c *LRUCache) Get(ctx context.Context, key string) (*CachedResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	e := el.Value.(*lruEntry)
+	if time.Now().After(e.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, nil
+	}
+	c.order.MoveToFront(el)
+	return e.resp, nil
+}
+
+// Set implements ResponseCache.
+func (c *LRUCache) Set(ctx context.Context, key string, resp *CachedResponse, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &lruEntry{key: key, resp: resp, expires: time.Now().Add(ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return nil
+	}
+	c.entries[key] = c.order.PushFront(e)
+	for c.maxEntries > 0 && c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+	return nil
+}
+
+// Len returns the number of responses held, including expired ones which
+// were not evicted yet.
+func (c *LRUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,152 @@
+package proxy_test
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+const pingMethod = "/vgough.testproto.TestService/Ping"
+
+// cacheableService counts pings, answering with the count, and fails pings
+// for "fail".
+func cacheableService(calls *int32) *pingService {
+	return &pingService{ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+		n := atomic.AddInt32(calls, 1)
+		if ping.Value == "fail" {
+			return nil, status.Error(codes.Unavailable, "failed")
+		}
+		grpc.SetHeader(ctx, metadata.Pairs("x-served-by", "backend"))
+		grpc.SetTrailer(ctx, metadata.Pairs("x-trailer", "done"))
+		md, _ := metadata.FromIncomingContext(ctx)
+		return &pb.PingResponse{Value: ping.Value + ":" + firstValue(md, "tenant"), Counter: n}, nil
+	}}
+}
+
+func firstValue(md metadata.MD, key string) string {
+	if v := md.Get(key); len(v) != 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func TestResponseCache(t *testing.T) {
+	var calls int32
+	cache := proxy.NewLRUCache(100)
+	env := newTestEnv(t, cacheableService(&calls), proxy.WithResponseCache(pingMethod, proxy.CachePolicy{
+		Cache:        cache,
+		TTL:          time.Minute,
+		VaryMetadata: []string{"Tenant"},
+	}))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	ping := func(ctx context.Context, value string) (*pb.PingResponse, metadata.MD, metadata.MD, error) {
+		var header, trailer metadata.MD
+		out, err := env.client.Ping(ctx, &pb.PingRequest{Value: value}, grpc.Header(&header), grpc.Trailer(&trailer))
+		return out, header, trailer, err
+	}
+
+	out, _, _, err := ping(ctx, "foo")
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, out.Counter)
+
+	out, header, trailer, err := ping(ctx, "foo")
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, out.Counter, "identical requests must be served from the cache")
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+	assert.Equal(t, []string{"backend"}, header.Get("x-served-by"), "cached headers must be replayed")
+	assert.Equal(t, []string{"done"}, trailer.Get("x-trailer"), "cached trailers must be replayed")
+
+	out, _, _, err = ping(ctx, "bar")
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, out.Counter, "different requests must not share entries")
+
+	tenantCtx := metadata.AppendToOutgoingContext(ctx, "tenant", "a")
+	out, _, _, err = ping(tenantCtx, "foo")
+	require.NoError(t, err)
+	assert.Equal(t, "foo:a", out.Value, "vary metadata must be part of the key")
+	assert.EqualValues(t, 3, out.Counter)
+
+	_, _, _, err = ping(ctx, "fail")
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	_, _, _, err = ping(ctx, "fail")
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.EqualValues(t, 5, atomic.LoadInt32(&calls), "errors must not be cached")
+	assert.Equal(t, 3, cache.Len())
+}
+
+func TestResponseCache_OnlyConfiguredMethods(t *testing.T) {
+	var calls int32
+	env := newTestEnv(t, cacheableService(&calls),
+		proxy.WithResponseCache("/vgough.testproto.TestService/PingEmpty", proxy.CachePolicy{Cache: proxy.NewLRUCache(10), TTL: time.Minute}))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+		require.NoError(t, err)
+	}
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+}
+
+func TestResponseCache_StreamsPassThrough(t *testing.T) {
+	cache := proxy.NewLRUCache(10)
+	env := newTestEnv(t, &pingService{}, proxy.WithResponseCache("", proxy.CachePolicy{Cache: cache, TTL: time.Minute}))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		stream, err := env.client.PingList(ctx, &pb.PingRequest{Value: "foo"})
+		require.NoError(t, err)
+		n := 0
+		for {
+			_, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			n++
+		}
+		assert.Equal(t, countListResponses, n)
+	}
+
+	assert.Equal(t, 0, cache.Len(), "responses with several messages must not be cached")
+}
+
+func TestLRUCache(t *testing.T) {
+	ctx := context.Background()
+	c := proxy.NewLRUCache(2)
+	resp := func(s string) *proxy.CachedResponse { return &proxy.CachedResponse{Payload: []byte(s)} }
+	require.NoError(t, c.Set(ctx, "a", resp("a"), time.Minute))
+	require.NoError(t, c.Set(ctx, "b", resp("b"), time.Minute))
+	got, err := c.Get(ctx, "a")
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	require.NoError(t, c.Set(ctx, "c", resp("c"), time.Minute))
+
+	got, _ = c.Get(ctx, "b")
+	assert.Nil(t, got, "least recently used entry must be evicted")
+	got, _ = c.Get(ctx, "a")
+	assert.NotNil(t, got)
+
+	require.NoError(t, c.Set(ctx, "d", resp("d"), time.Nanosecond))
+	time.Sleep(time.Millisecond)
+	got, _ = c.Get(ctx, "d")
+	assert.Nil(t, got, "expired entries must not be served")
+}
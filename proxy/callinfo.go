@@ -0,0 +1,110 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/peer"
+)
+
+// CallInfo describes a proxied call. It is created when the call arrives
+// and can be retrieved with CallInfoFromContext from the contexts passed to
+// the director, interceptors, transformers, authenticators and access
+// loggers, so that these hooks can share data through annotations instead
+// of their own context keys.
+//
+// A CallInfo is safe for concurrent use.
+type CallInfo struct {
+	method string
+	peer   net.Addr
+	start  time.Time
+
+	mu          sync.Mutex
+	backend     string
+	annotations map[string]interface{}
+}
+
+type callInfoKey struct{}
+
+// CallInfoFromContext returns the CallInfo of the call handled with ctx, or
+// nil if ctx does not belong to a proxied call.
+func CallInfoFromContext(ctx context.Context) *CallInfo {
+	info, _ := ctx.Value(callInfoKey{}).(*CallInfo)
+	return info
+}
+
+func newCallInfo(ctx context.Context, method string, start time.Time) (context.Context, *CallInfo) {
+	info := &CallInfo{method: method, start: start}
+	if pr, ok := peer.FromContext(ctx); ok {
+		info.peer = pr.Addr
+	}
+	return context.WithValue(ctx, callInfoKey{}, info), info
+}
+
+// Method returns the full method name requested by the client.
+func (c *CallInfo) Method() string {
+	return c.method
+}
+
+// Peer returns the address of the client, or nil if it is unknown.
+func (c *CallInfo) Peer() net.Addr {
+	return c.peer
+}
+
+// Start returns the time the call arrived.
+func (c *CallInfo) Start() time.Time {
+	return c.start
+}
+
+// Backend returns the target of the backend connection, once the director
+// has chosen it.
+func (c *CallInfo) Backend() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.backend
+}
+
+func (c *CallInfo) setBackend(backend string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.backend = backend
+}
+
+// Annotate sets the annotation key to value, replacing any previous value.
+// Keys should be namespaced by the hook setting them, like "auth.subject".
+func (c *CallInfo) Annotate(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.annotations == nil {
+		c.annotations = make(map[string]interface{})
+	}
+	c.annotations[key] = value
+}
+
+// Annotation returns the value of the annotation key.
+func (c *CallInfo) Annotation(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.annotations[key]
+	return v, ok
+}
+
+// Annotations returns a copy of all annotations, or nil if there are none.
+func (c *CallInfo) Annotations() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.annotations) == 0 {
+		return nil
+	}
+	annotations := make(map[string]interface{}, len(c.annotations))
+	for k, v := range c.annotations {
+		annotations[k] = v
+	}
+	return annotations
+}
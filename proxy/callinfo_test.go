@@ -0,0 +1,75 @@
+package proxy_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestCallInfo_SharedBetweenHooks(t *testing.T) {
+	l := &recordingLogger{}
+	var mu sync.Mutex
+	var seenByInterceptor []interface{}
+	var doneBackend string
+	interceptor := func(ctx context.Context, method string, dir proxy.FrameDirection, payload []byte) ([]byte, error) {
+		info := proxy.CallInfoFromContext(ctx)
+		tenant, _ := info.Annotation("test.tenant")
+		mu.Lock()
+		seenByInterceptor = append(seenByInterceptor, tenant)
+		mu.Unlock()
+		info.Annotate("test.frames."+dir.String(), true)
+		return payload, nil
+	}
+
+	env := newTestEnvWithDirector(t, &pingService{}, func(backend *grpc.ClientConn) proxy.StreamDirector {
+		return func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+			info := proxy.CallInfoFromContext(ctx)
+			require.NotNil(t, info, "the director context must carry the call info")
+			assert.Equal(t, method, info.Method())
+			assert.NotNil(t, info.Peer())
+			assert.Empty(t, info.Backend(), "the backend is not known before directing")
+			info.Annotate("test.tenant", "acme")
+			return ctx, nil, proxy.Direction{
+				BackendConn: backend,
+				Done: func(err error) {
+					mu.Lock()
+					defer mu.Unlock()
+					doneBackend = info.Backend()
+				},
+			}, nil
+		}
+	}, proxy.WithStreamInterceptor(interceptor), proxy.WithAccessLogger(l))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err)
+
+	mu.Lock()
+	assert.Equal(t, []interface{}{"acme", "acme"}, seenByInterceptor)
+	assert.Equal(t, env.backendConn.Target(), doneBackend)
+	mu.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	require.Len(t, l.starts, 1)
+	assert.Equal(t, map[string]interface{}{"test.tenant": "acme"}, l.starts[0].Annotations)
+	require.Len(t, l.ends, 1)
+	assert.Equal(t, map[string]interface{}{
+		"test.tenant":                   "acme",
+		"test.frames.client-to-backend": true,
+		"test.frames.backend-to-client": true,
+	}, l.ends[0].Annotations)
+}
+
+func TestCallInfoFromContext_NotProxied(t *testing.T) {
+	assert.Nil(t, proxy.CallInfoFromContext(context.Background()))
+}
@@ -0,0 +1,37 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// propagateCancel calls cancel as soon as the client of a call goes away,
+// even if the director returned a backend context which is not derived from
+// the server context. The returned function stops watching.
+func propagateCancel(serverCtx context.Context, cancel context.CancelFunc) func() {
+	done := serverCtx.Done()
+	if done == nil {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// isCanceled reports whether a call which ended with err was canceled, by
+// the client or by the backend, rather than failed.
+func isCanceled(serverCtx context.Context, err error) bool {
+	return serverCtx.Err() == context.Canceled || status.Code(err) == codes.Canceled
+}
@@ -0,0 +1,133 @@
+package proxy_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// cancelResults records the callbacks of a Direction.
+type cancelResults struct {
+	canceled chan error
+	done     chan error
+}
+
+// cancelDirector directs calls to the backend with a context which is not
+// derived from the client's, so cancellation must be propagated by the
+// proxy.
+func cancelDirector(res *cancelResults) func(*grpc.ClientConn) proxy.StreamDirector {
+	return func(backend *grpc.ClientConn) proxy.StreamDirector {
+		return func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+			return proxy.CopyMetadata(context.Background(), ctx), nil, proxy.Direction{
+				BackendConn: backend,
+				OnCanceled:  func(err error) { res.canceled <- err },
+				Done:        func(err error) { res.done <- err },
+			}, nil
+		}
+	}
+}
+
+func newCancelResults() *cancelResults {
+	return &cancelResults{canceled: make(chan error, 1), done: make(chan error, 1)}
+}
+
+func TestCancel_ClientPropagatesToBackend(t *testing.T) {
+	for _, disconnect := range []bool{false, true} {
+		name := "cancel"
+		if disconnect {
+			name = "disconnect"
+		}
+		t.Run(name, func(t *testing.T) {
+			backendErr := make(chan error, 1)
+			svc := &pingService{
+				pingStream: func(stream pb.TestService_PingStreamServer) error {
+					if err := stream.Send(&pb.PingResponse{Value: "started"}); err != nil {
+						return err
+					}
+					<-stream.Context().Done()
+					backendErr <- stream.Context().Err()
+					return stream.Context().Err()
+				},
+			}
+			res := newCancelResults()
+			env := newTestEnvWithDirector(t, svc, cancelDirector(res))
+			defer env.Close()
+			ctx, cancel := env.ctx()
+			defer cancel()
+
+			stream, err := env.client.PingStream(ctx)
+			require.NoError(t, err)
+			_, err = stream.Recv()
+			require.NoError(t, err)
+			if disconnect {
+				env.clientConn.Close()
+			} else {
+				cancel()
+			}
+
+			select {
+			case err := <-backendErr:
+				assert.Equal(t, context.Canceled, err)
+			case <-time.After(time.Second):
+				t.Fatal("the backend call must be canceled promptly")
+			}
+			assert.Equal(t, codes.Canceled, status.Code(<-res.canceled))
+			assert.Equal(t, codes.Canceled, status.Code(<-res.done), "Done is called as well")
+		})
+	}
+}
+
+func TestCancel_BackendPropagatesToClient(t *testing.T) {
+	svc := &pingService{
+		pingStream: func(stream pb.TestService_PingStreamServer) error {
+			if _, err := stream.Recv(); err != nil {
+				return err
+			}
+			return status.Error(codes.Canceled, "backend gave up")
+		},
+	}
+	res := newCancelResults()
+	env := newTestEnvWithDirector(t, svc, cancelDirector(res))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	stream, err := env.client.PingStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.PingRequest{Value: "x"}))
+	_, err = stream.Recv()
+	assert.Equal(t, status.Error(codes.Canceled, "backend gave up"), err)
+	assert.Equal(t, codes.Canceled, status.Code(<-res.canceled))
+	<-res.done
+}
+
+func TestCancel_ErrorsAreNotCanceled(t *testing.T) {
+	svc := &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			return nil, status.Error(codes.FailedPrecondition, "no")
+		},
+	}
+	res := newCancelResults()
+	env := newTestEnvWithDirector(t, svc, cancelDirector(res))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "x"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(<-res.done))
+	select {
+	case err := <-res.canceled:
+		t.Fatalf("OnCanceled must not be called for errors, got %v", err)
+	default:
+	}
+}
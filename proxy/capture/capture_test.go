@@ -0,0 +1,250 @@
+package capture_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/mkxxx/grpc-proxy/proxy/capture"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// pingService answers with a counter, so that replays can differ from the
+// recordings.
+type pingService struct {
+	counter int32
+}
+
+func (s *pingService) PingEmpty(ctx context.Context, _ *pb.Empty) (*pb.PingResponse, error) {
+	return &pb.PingResponse{Value: "empty", Counter: s.counter}, nil
+}
+
+func (s *pingService) Ping(ctx context.Context, in *pb.PingRequest) (*pb.PingResponse, error) {
+	grpc.SetHeader(ctx, metadata.Pairs("x-served-by", "ping"))
+	grpc.SetTrailer(ctx, metadata.Pairs("x-cost", "1"))
+	return &pb.PingResponse{Value: in.Value, Counter: s.counter}, nil
+}
+
+func (s *pingService) PingError(ctx context.Context, in *pb.PingRequest) (*pb.Empty, error) {
+	return nil, status.Errorf(codes.FailedPrecondition, "no %s", in.Value)
+}
+
+func (s *pingService) PingList(in *pb.PingRequest, stream pb.TestService_PingListServer) error {
+	for i := 1; i <= 2; i++ {
+		if err := stream.Send(&pb.PingResponse{Value: in.Value, Counter: int32(i)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *pingService) PingStream(stream pb.TestService_PingStreamServer) error {
+	for {
+		in, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+		if err := stream.Send(&pb.PingResponse{Value: in.Value, Counter: s.counter}); err != nil {
+			return err
+		}
+	}
+}
+
+// startProxy starts a proxy to svc, recorded with cfg. It returns a client
+// of the proxy and a connection to the backend.
+func startProxy(t *testing.T, svc pb.TestServiceServer, w *capture.Writer, cfg capture.Config) (pb.TestServiceClient, *grpc.ClientConn, func()) {
+	backendLis := proxy.NewInProcessListener()
+	backend := grpc.NewServer()
+	pb.RegisterTestServiceServer(backend, svc)
+	go backend.Serve(backendLis)
+	backendConfig := backendLis.BackendConfig()
+	backendConn, err := backendConfig.Dial()
+	require.NoError(t, err)
+
+	director := func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+		return ctx, nil, proxy.Direction{BackendConn: backendConn}, nil
+	}
+	rec := capture.NewRecorder(w, cfg)
+	server := grpc.NewServer(
+		proxy.ServerOption(),
+		grpc.UnknownServiceHandler(proxy.TransparentHandler(director, rec.Options()...)),
+	)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(lis)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	return pb.NewTestServiceClient(conn), backendConn, func() {
+		conn.Close()
+		server.Stop()
+		backendConn.Close()
+		backend.Stop()
+	}
+}
+
+func testCtx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 10*time.Second)
+}
+
+func readAll(t *testing.T, buf *bytes.Buffer) []*capture.Call {
+	r := capture.NewReader(buf)
+	var calls []*capture.Call
+	for {
+		c, err := r.Read()
+		if err != nil {
+			return calls
+		}
+		calls = append(calls, c)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	var buf bytes.Buffer
+	client, _, stop := startProxy(t, &pingService{counter: 1}, capture.NewWriter(&buf), capture.Config{
+		Methods:      []string{"/vgough.testproto.TestService/Ping"},
+		OmitMetadata: []string{"Authorization"},
+	})
+	defer stop()
+	ctx, cancel := testCtx()
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-user", "alice", "authorization", "Bearer secret")
+
+	_, err := client.Ping(ctx, &pb.PingRequest{Value: "hi"})
+	require.NoError(t, err)
+	_, err = client.PingEmpty(ctx, &pb.Empty{})
+	require.NoError(t, err)
+
+	calls := readAll(t, &buf)
+	require.Len(t, calls, 1, "only listed methods are recorded")
+	c := calls[0]
+	assert.Equal(t, "/vgough.testproto.TestService/Ping", c.Method)
+	assert.Equal(t, codes.OK, c.Code)
+	assert.Equal(t, []string{"alice"}, c.Metadata["x-user"])
+	assert.NotContains(t, c.Metadata, "authorization")
+	assert.Equal(t, []string{"ping"}, c.Header["x-served-by"])
+	assert.Equal(t, []string{"1"}, c.Trailer["x-cost"])
+	assert.True(t, c.Duration > 0)
+	require.Len(t, c.Frames, 2)
+	assert.Equal(t, capture.ClientToBackend, c.Frames[0].Direction)
+	assert.Equal(t, capture.BackendToClient, c.Frames[1].Direction)
+	assert.True(t, c.Frames[0].Offset <= c.Frames[1].Offset)
+	var req pb.PingRequest
+	require.NoError(t, proto.Unmarshal(c.Frames[0].Payload, &req))
+	assert.Equal(t, "hi", req.Value)
+}
+
+func TestRecorder_MaxFrames(t *testing.T) {
+	var buf bytes.Buffer
+	client, _, stop := startProxy(t, &pingService{}, capture.NewWriter(&buf), capture.Config{MaxFrames: 2})
+	defer stop()
+	ctx, cancel := testCtx()
+	defer cancel()
+
+	stream, err := client.PingList(ctx, &pb.PingRequest{Value: "x"})
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err := stream.Recv()
+		require.NoError(t, err)
+	}
+	_, err = stream.Recv()
+	require.Error(t, err)
+
+	calls := readAll(t, &buf)
+	require.Len(t, calls, 1)
+	assert.Len(t, calls[0].Frames, 2)
+	assert.True(t, calls[0].Truncated)
+}
+
+func TestReplayer(t *testing.T) {
+	var buf bytes.Buffer
+	svc := &pingService{counter: 1}
+	client, backendConn, stop := startProxy(t, svc, capture.NewWriter(&buf), capture.Config{})
+	defer stop()
+	ctx, cancel := testCtx()
+	defer cancel()
+
+	stream, err := client.PingStream(ctx)
+	require.NoError(t, err)
+	for _, v := range []string{"a", "b"} {
+		require.NoError(t, stream.Send(&pb.PingRequest{Value: v}))
+		_, err := stream.Recv()
+		require.NoError(t, err)
+	}
+	require.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	require.Error(t, err)
+	_, err = client.PingError(ctx, &pb.PingRequest{Value: "luck"})
+	require.Error(t, err)
+
+	calls := readAll(t, &buf)
+	require.Len(t, calls, 2)
+
+	replayer := capture.NewReplayer(backendConn)
+	replayer.Metadata = func(md metadata.MD) metadata.MD {
+		md.Set("x-replay", "1")
+		return md
+	}
+	for _, c := range calls {
+		got, err := replayer.Replay(ctx, c)
+		require.NoError(t, err)
+		assert.Empty(t, capture.Diff(c, got), c.Method)
+		assert.Equal(t, []string{"1"}, got.Metadata["x-replay"])
+	}
+	bidi := calls[0]
+	if bidi.Method != "/vgough.testproto.TestService/PingStream" {
+		bidi = calls[1]
+	}
+
+	svc.counter = 2
+	got, err := replayer.Replay(ctx, bidi)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"response 0 differs", "response 1 differs"}, capture.Diff(bidi, got))
+}
+
+func TestReplayer_Speed(t *testing.T) {
+	backendLis := proxy.NewInProcessListener()
+	backend := grpc.NewServer()
+	pb.RegisterTestServiceServer(backend, &pingService{})
+	go backend.Serve(backendLis)
+	defer backend.Stop()
+	conn, err := grpc.Dial("inprocess", grpc.WithInsecure(), grpc.WithContextDialer(backendLis.DialContext))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	payload, err := proto.Marshal(&pb.PingRequest{Value: "slow"})
+	require.NoError(t, err)
+	call := &capture.Call{
+		Method: "/vgough.testproto.TestService/PingStream",
+		Frames: []capture.Frame{
+			{Offset: 0, Direction: capture.ClientToBackend, Payload: payload},
+			{Offset: 400 * time.Millisecond, Direction: capture.ClientToBackend, Payload: payload},
+		},
+	}
+	replayer := capture.NewReplayer(conn)
+	replayer.Speed = 2
+	ctx, cancel := testCtx()
+	defer cancel()
+	got, err := replayer.Replay(ctx, call)
+	require.NoError(t, err)
+	assert.Equal(t, codes.OK, got.Code)
+	require.Len(t, got.Requests(), 2)
+	assert.Len(t, got.Responses(), 2)
+	var last capture.Frame
+	for _, f := range got.Frames {
+		if f.Direction == capture.ClientToBackend {
+			last = f
+		}
+	}
+	assert.True(t, last.Offset >= 200*time.Millisecond, "requests keep their scaled timing")
+}
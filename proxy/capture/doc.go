@@ -0,0 +1,40 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+/*
+Package capture records proxied calls to a file and replays them at a
+backend, for debugging and regression testing.
+
+A Recorder captures whole calls: the request metadata, the frames in both
+directions with their timing, the response header and trailer, and the
+final status. Each call is written to a Writer when it ends:
+
+	w := capture.NewWriter(file)
+	rec := capture.NewRecorder(w, capture.Config{
+		Methods:      []string{"/orders.OrderService/"},
+		OmitMetadata: []string{"authorization"},
+	})
+	handler := proxy.TransparentHandler(director, rec.Options()...)
+
+The file holds a line of JSON per call, after a line identifying the
+format. A Replayer sends the recorded requests of a call again, optionally
+with the recorded timing, and captures the new responses, which Diff
+compares with the recorded ones:
+
+	r := capture.NewReader(file)
+	replayer := capture.NewReplayer(backendConn)
+	for {
+		call, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		...
+		got, err := replayer.Replay(ctx, call)
+		...
+		for _, d := range capture.Diff(call, got) {
+			log.Printf("%s: %s", call.Method, d)
+		}
+	}
+*/
+package capture
@@ -0,0 +1,151 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// Format and Version identify capture files. Readers reject files of newer
+// versions.
+const (
+	Format  = "grpc-proxy-capture"
+	Version = 1
+)
+
+// Call is a recorded call.
+type Call struct {
+	Method string    `json:"method"`
+	Start  time.Time `json:"start"`
+	// Duration is the time from the start of the call to its status.
+	Duration time.Duration `json:"duration"`
+	Peer     string        `json:"peer,omitempty"`
+	Backend  string        `json:"backend,omitempty"`
+
+	// Metadata is the request metadata, Header and Trailer the response
+	// metadata.
+	Metadata map[string][]string `json:"metadata,omitempty"`
+	Header   map[string][]string `json:"header,omitempty"`
+	Trailer  map[string][]string `json:"trailer,omitempty"`
+
+	// Frames are the messages in both directions, in the order they were
+	// forwarded.
+	Frames []Frame `json:"frames,omitempty"`
+	// Truncated is set if frames were left out, see Config.MaxFrames.
+	Truncated bool `json:"truncated,omitempty"`
+
+	Code    codes.Code `json:"code"`
+	Message string     `json:"message,omitempty"`
+}
+
+// Direction of a Frame.
+const (
+	ClientToBackend = "client-to-backend"
+	BackendToClient = "backend-to-client"
+)
+
+// Frame is a recorded message.
+type Frame struct {
+	// Offset is the time of the frame since the start of the call.
+	Offset    time.Duration `json:"offset"`
+	Direction string        `json:"direction"`
+	Payload   []byte        `json:"payload"`
+}
+
+// Requests returns the payloads sent by the client.
+func (c *Call) Requests() [][]byte {
+	return c.payloads(ClientToBackend)
+}
+
+// Responses returns the payloads sent by the backend.
+func (c *Call) Responses() [][]byte {
+	return c.payloads(BackendToClient)
+}
+
+func (c *Call) payloads(dir string) [][]byte {
+	var payloads [][]byte
+	for _, f := range c.Frames {
+		if f.Direction == dir {
+			payloads = append(payloads, f.Payload)
+		}
+	}
+	return payloads
+}
+
+type fileHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+// Writer writes calls to a capture file. It is safe for concurrent use.
+type Writer struct {
+	mu      sync.Mutex
+	enc     *json.Encoder
+	started bool
+}
+
+// NewWriter returns a Writer writing to w. The format line is written with
+// the first call.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{enc: json.NewEncoder(w)}
+}
+
+// Write appends c to the file.
+func (w *Writer) Write(c *Call) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.started {
+		if err := w.enc.Encode(fileHeader{Format: Format, Version: Version}); err != nil {
+			return err
+		}
+		w.started = true
+	}
+	return w.enc.Encode(c)
+}
+
+// Reader reads the calls of a capture file.
+type Reader struct {
+	dec     *json.Decoder
+	started bool
+}
+
+// NewReader returns a Reader reading from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{dec: json.NewDecoder(r)}
+}
+
+// Read returns the next call, or io.EOF at the end of the file.
+func (r *Reader) Read() (*Call, error) {
+	if !r.started {
+		var h fileHeader
+		if err := r.dec.Decode(&h); err != nil {
+			if err == io.EOF {
+				return nil, err
+			}
+			return nil, fmt.Errorf("capture: invalid file: %v", err)
+		}
+		if h.Format != Format {
+			return nil, fmt.Errorf("capture: not a capture file")
+		}
+		if h.Version > Version {
+			return nil, fmt.Errorf("capture: unsupported version %d", h.Version)
+		}
+		r.started = true
+	}
+	var c Call
+	if err := r.dec.Decode(&c); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, fmt.Errorf("capture: invalid call: %v", err)
+	}
+	return &c, nil
+}
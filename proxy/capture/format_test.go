@@ -0,0 +1,63 @@
+package capture_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy/capture"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func TestWriterReader(t *testing.T) {
+	calls := []*capture.Call{
+		{
+			Method:   "/a.A/One",
+			Start:    time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC),
+			Duration: 3 * time.Millisecond,
+			Metadata: map[string][]string{"x-user": {"alice"}},
+			Frames: []capture.Frame{
+				{Offset: time.Millisecond, Direction: capture.ClientToBackend, Payload: []byte{1, 2}},
+				{Offset: 2 * time.Millisecond, Direction: capture.BackendToClient, Payload: []byte{3}},
+			},
+			Code: codes.OK,
+		},
+		{Method: "/a.A/Two", Start: time.Date(2018, 6, 1, 12, 0, 1, 0, time.UTC), Code: codes.NotFound, Message: "gone"},
+	}
+	var buf bytes.Buffer
+	w := capture.NewWriter(&buf)
+	for _, c := range calls {
+		require.NoError(t, w.Write(c))
+	}
+	assert.True(t, strings.HasPrefix(buf.String(), `{"format":"grpc-proxy-capture","version":1}`+"\n"))
+
+	r := capture.NewReader(&buf)
+	for _, want := range calls {
+		got, err := r.Read()
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	_, err := r.Read()
+	assert.Equal(t, io.EOF, err)
+
+	assert.Equal(t, [][]byte{{1, 2}}, calls[0].Requests())
+	assert.Equal(t, [][]byte{{3}}, calls[0].Responses())
+}
+
+func TestReader_Invalid(t *testing.T) {
+	_, err := capture.NewReader(strings.NewReader("")).Read()
+	assert.Equal(t, io.EOF, err, "empty files have no calls")
+
+	_, err = capture.NewReader(strings.NewReader(`{"method": "/a.A/One"}`)).Read()
+	assert.EqualError(t, err, "capture: not a capture file")
+
+	_, err = capture.NewReader(strings.NewReader(`{"format":"grpc-proxy-capture","version":2}`)).Read()
+	assert.EqualError(t, err, "capture: unsupported version 2")
+
+	_, err = capture.NewReader(strings.NewReader(`{"format":"grpc-proxy-capture","version":1}` + "\n{")).Read()
+	assert.Error(t, err)
+}
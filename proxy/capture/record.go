@@ -0,0 +1,166 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package capture
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Config configures a Recorder.
+type Config struct {
+	// Methods lists full method names, or prefixes ending in "/" or ".",
+	// whose calls are recorded. If empty, all calls are recorded.
+	Methods []string
+
+	// OmitMetadata lists metadata keys which are not recorded, such as
+	// "authorization".
+	OmitMetadata []string
+
+	// MaxFrames limits the frames recorded per call. Defaults to 10000.
+	MaxFrames int
+
+	// OnError, if set, is called with errors writing calls.
+	OnError func(error)
+}
+
+// Recorder records proxied calls. Install its Options on the proxy handler.
+//
+// Calls are written as they end, so a slow Writer delays the status of
+// calls.
+type Recorder struct {
+	w    *Writer
+	cfg  Config
+	omit map[string]bool
+
+	// calls holds the calls in flight by their CallInfo.
+	calls sync.Map
+}
+
+type recordedCall struct {
+	mu   sync.Mutex
+	call *Call
+}
+
+// NewRecorder returns a Recorder writing to w.
+func NewRecorder(w *Writer, cfg Config) *Recorder {
+	if cfg.MaxFrames <= 0 {
+		cfg.MaxFrames = 10000
+	}
+	omit := make(map[string]bool, len(cfg.OmitMetadata))
+	for _, k := range cfg.OmitMetadata {
+		omit[strings.ToLower(k)] = true
+	}
+	return &Recorder{w: w, cfg: cfg, omit: omit}
+}
+
+// Options returns the proxy options installing the recorder.
+func (r *Recorder) Options() []proxy.Option {
+	return []proxy.Option{
+		proxy.WithStreamInterceptor(r.intercept),
+		proxy.WithResponseHeaderHook(r.header),
+		proxy.WithStatusHook(r.finish),
+	}
+}
+
+func (r *Recorder) recorded(method string) bool {
+	if len(r.cfg.Methods) == 0 {
+		return true
+	}
+	for _, m := range r.cfg.Methods {
+		if method == m || ((strings.HasSuffix(m, "/") || strings.HasSuffix(m, ".")) && strings.HasPrefix(method, m)) {
+			return true
+		}
+	}
+	return false
+}
+
+// call returns the recording of the call of ctx, or nil if it is not
+// recorded.
+func (r *Recorder) call(ctx context.Context) (*recordedCall, *proxy.CallInfo) {
+	info := proxy.CallInfoFromContext(ctx)
+	if info == nil || !r.recorded(info.Method()) {
+		return nil, nil
+	}
+	if c, ok := r.calls.Load(info); ok {
+		return c.(*recordedCall), info
+	}
+	call := &Call{Method: info.Method(), Start: info.Start()}
+	if p := info.Peer(); p != nil {
+		call.Peer = p.String()
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	call.Metadata = r.metadata(md)
+	c, _ := r.calls.LoadOrStore(info, &recordedCall{call: call})
+	return c.(*recordedCall), info
+}
+
+func (r *Recorder) metadata(md metadata.MD) map[string][]string {
+	if len(md) == 0 {
+		return nil
+	}
+	out := make(map[string][]string, len(md))
+	for k, v := range md {
+		if !r.omit[k] {
+			out[k] = append([]string(nil), v...)
+		}
+	}
+	return out
+}
+
+func (r *Recorder) intercept(ctx context.Context, method string, dir proxy.FrameDirection, payload []byte) ([]byte, error) {
+	c, info := r.call(ctx)
+	if c == nil {
+		return payload, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.call.Frames) >= r.cfg.MaxFrames {
+		c.call.Truncated = true
+		return payload, nil
+	}
+	c.call.Frames = append(c.call.Frames, Frame{
+		Offset:    time.Since(info.Start()),
+		Direction: dir.String(),
+		// The frame buffer belongs to the proxy.
+		Payload: append([]byte(nil), payload...),
+	})
+	return payload, nil
+}
+
+func (r *Recorder) header(ctx context.Context, md metadata.MD) metadata.MD {
+	if c, _ := r.call(ctx); c != nil {
+		c.mu.Lock()
+		c.call.Header = r.metadata(md)
+		c.mu.Unlock()
+	}
+	return md
+}
+
+func (r *Recorder) finish(ctx context.Context, st *status.Status, trailer metadata.MD) (*status.Status, metadata.MD) {
+	c, info := r.call(ctx)
+	if c == nil {
+		return st, trailer
+	}
+	r.calls.Delete(info)
+	c.mu.Lock()
+	call := c.call
+	call.Duration = time.Since(info.Start())
+	call.Backend = info.Backend()
+	call.Code = st.Code()
+	call.Message = st.Message()
+	call.Trailer = r.metadata(trailer)
+	c.mu.Unlock()
+	if err := r.w.Write(call); err != nil && r.cfg.OnError != nil {
+		r.cfg.OnError(err)
+	}
+	return st, trailer
+}
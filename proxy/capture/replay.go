@@ -0,0 +1,164 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package capture
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Replayer sends recorded calls to a backend.
+type Replayer struct {
+	conn *grpc.ClientConn
+
+	// Speed scales the recorded timing of the requests, so that 1 replays
+	// them at their original pace and 2 twice as fast. If zero, requests
+	// are sent without waiting.
+	Speed float64
+
+	// Metadata, if set, rewrites the recorded metadata of each call before
+	// it is sent, such as to add fresh credentials.
+	Metadata func(md metadata.MD) metadata.MD
+
+	// CallOptions are added to the replayed calls.
+	CallOptions []grpc.CallOption
+}
+
+// NewReplayer returns a Replayer calling conn. The connection needs no
+// particular codec.
+func NewReplayer(conn *grpc.ClientConn) *Replayer {
+	return &Replayer{conn: conn}
+}
+
+// bytesCodec sends and receives payloads as they are.
+type bytesCodec struct{}
+
+func (bytesCodec) Marshal(v interface{}) ([]byte, error) {
+	return *v.(*[]byte), nil
+}
+
+func (bytesCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*[]byte) = append([]byte(nil), data...)
+	return nil
+}
+
+func (bytesCodec) Name() string {
+	return "proto"
+}
+
+// Replay sends the requests of call and returns the new call as recorded
+// at the client, for comparison with Diff. It fails only if the call could
+// not be started; the status of the call is in the result.
+func (r *Replayer) Replay(ctx context.Context, call *Call) (*Call, error) {
+	md := metadata.MD{}
+	for k, v := range call.Metadata {
+		// Pseudo and transport headers are set by grpc.
+		if strings.HasPrefix(k, ":") || strings.HasPrefix(k, "grpc-") || k == "content-type" || k == "user-agent" || k == "te" {
+			continue
+		}
+		md[k] = append([]string(nil), v...)
+	}
+	if r.Metadata != nil {
+		md = r.Metadata(md)
+	}
+	ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(ctx, md))
+	defer cancel()
+
+	got := &Call{Method: call.Method, Start: time.Now(), Metadata: md}
+	var header, trailer metadata.MD
+	opts := append([]grpc.CallOption{
+		grpc.ForceCodec(bytesCodec{}),
+		grpc.Header(&header),
+		grpc.Trailer(&trailer),
+	}, r.CallOptions...)
+	desc := &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}
+	stream, err := r.conn.NewStream(ctx, desc, call.Method, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	record := func(dir string, payload []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		got.Frames = append(got.Frames, Frame{Offset: time.Since(got.Start), Direction: dir, Payload: payload})
+	}
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for _, f := range call.Frames {
+			if f.Direction != ClientToBackend {
+				continue
+			}
+			if r.Speed > 0 {
+				wait := time.Duration(float64(f.Offset)/r.Speed) - time.Since(got.Start)
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return
+				}
+			}
+			payload := f.Payload
+			if err := stream.SendMsg(&payload); err != nil {
+				// The error is returned by RecvMsg.
+				return
+			}
+			record(ClientToBackend, payload)
+		}
+		stream.CloseSend()
+	}()
+
+	for {
+		var payload []byte
+		if err = stream.RecvMsg(&payload); err != nil {
+			break
+		}
+		record(BackendToClient, payload)
+	}
+	cancel()
+	<-sent
+	if err == io.EOF {
+		err = nil
+	}
+	st := status.Convert(err)
+	got.Duration = time.Since(got.Start)
+	got.Code = st.Code()
+	got.Message = st.Message()
+	got.Header = header
+	got.Trailer = trailer
+	return got, nil
+}
+
+// Diff returns the differences of the responses of got from those of want,
+// or nil if they match: the status code and message, and the response
+// payloads, byte for byte.
+func Diff(want, got *Call) []string {
+	var diffs []string
+	if want.Code != got.Code {
+		diffs = append(diffs, fmt.Sprintf("code %s, want %s", got.Code, want.Code))
+	}
+	if want.Message != got.Message {
+		diffs = append(diffs, fmt.Sprintf("message %q, want %q", got.Message, want.Message))
+	}
+	wantResp, gotResp := want.Responses(), got.Responses()
+	if len(wantResp) != len(gotResp) && !want.Truncated {
+		diffs = append(diffs, fmt.Sprintf("%d responses, want %d", len(gotResp), len(wantResp)))
+	}
+	for i := 0; i < len(wantResp) && i < len(gotResp); i++ {
+		if !bytes.Equal(wantResp[i], gotResp[i]) {
+			diffs = append(diffs, fmt.Sprintf("response %d differs", i))
+		}
+	}
+	return diffs
+}
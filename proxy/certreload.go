@@ -0,0 +1,272 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultCertCheckInterval is how often the files of a CertificateManager
+// are checked for changes when CheckInterval is not set.
+const defaultCertCheckInterval = 10 * time.Second
+
+// CertificateManager keeps a TLS certificate loaded from files and reloads
+// it when they change, without restarting the proxy. Its GetCertificate and
+// GetClientCertificate methods plug into a tls.Config, for the proxy server
+// and for client certificates presented to backends:
+//
+//	certs := &proxy.CertificateManager{CertFile: "server.pem", KeyFile: "server-key.pem"}
+//	if err := certs.Load(); err != nil {
+//		...
+//	}
+//	go certs.Run(ctx)
+//	creds := credentials.NewTLS(&tls.Config{GetCertificate: certs.GetCertificate})
+//
+// The files are checked at most every CheckInterval when a certificate is
+// needed, and by Run also in the background and on SIGHUP. A certificate
+// which fails to load is reported to OnError, and the previous one is kept.
+//
+// A CertificateManager is safe for concurrent use once loaded.
+type CertificateManager struct {
+	// CertFile and KeyFile are the PEM files of the certificate chain and of
+	// its private key.
+	CertFile string
+	KeyFile  string
+
+	// KeyPassword decrypts a private key encrypted with a passphrase, as by
+	// "openssl rsa -aes256", which has a "Proc-Type: 4,ENCRYPTED" header.
+	// Encrypted PKCS #8 keys are not supported.
+	KeyPassword []byte
+
+	// OCSPStapleFile, if set, is a DER encoded OCSP response for the
+	// certificate, as fetched by a cron job, which servers staple to their
+	// handshakes. It is reloaded along with the certificate.
+	OCSPStapleFile string
+
+	// CheckInterval is how often the files are checked for changes. It
+	// defaults to 10 seconds.
+	CheckInterval time.Duration
+
+	// OnReload, if set, is called with every certificate loaded.
+	OnReload func(cert *tls.Certificate)
+
+	// OnError, if set, is called when a changed certificate fails to load.
+	OnError func(err error)
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	versions  []fileVersion
+	failed    []fileVersion
+	lastCheck time.Time
+}
+
+// fileVersion identifies the contents of a file by size and modification
+// time.
+type fileVersion struct {
+	size int64
+	mod  time.Time
+}
+
+// Load loads the certificate, and fails if it cannot.
+func (m *CertificateManager) Load() error {
+	return m.Reload()
+}
+
+// Reload loads the certificate again, whether or not the files changed.
+// The previous certificate is kept if it fails.
+func (m *CertificateManager) Reload() error {
+	versions := m.fileVersions()
+	cert, err := m.load()
+	m.mu.Lock()
+	m.lastCheck = time.Now()
+	if err == nil {
+		m.cert, m.versions, m.failed = cert, versions, nil
+	} else {
+		m.failed = versions
+	}
+	m.mu.Unlock()
+	if err != nil {
+		if m.OnError != nil {
+			m.OnError(err)
+		}
+		return err
+	}
+	if m.OnReload != nil {
+		m.OnReload(cert)
+	}
+	return nil
+}
+
+// Certificate returns the current certificate, reloading it first if the
+// files changed since the last check, which is at least CheckInterval ago.
+// It returns nil if no certificate was loaded.
+func (m *CertificateManager) Certificate() *tls.Certificate {
+	m.mu.Lock()
+	due := time.Since(m.lastCheck) >= m.checkInterval()
+	m.mu.Unlock()
+	if due {
+		m.check()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cert
+}
+
+// GetCertificate returns the current certificate, for tls.Config of
+// servers.
+func (m *CertificateManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return m.current()
+}
+
+// GetClientCertificate returns the current certificate, for tls.Config of
+// clients.
+func (m *CertificateManager) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return m.current()
+}
+
+func (m *CertificateManager) current() (*tls.Certificate, error) {
+	if cert := m.Certificate(); cert != nil {
+		return cert, nil
+	}
+	return nil, fmt.Errorf("no certificate loaded from %s", m.CertFile)
+}
+
+// Run checks the files every CheckInterval and reloads the certificate on
+// every SIGHUP, until ctx is done.
+func (m *CertificateManager) Run(ctx context.Context) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+	ticker := time.NewTicker(m.checkInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sighup:
+			m.Reload()
+		case <-ticker.C:
+			m.check()
+		}
+	}
+}
+
+func (m *CertificateManager) checkInterval() time.Duration {
+	if m.CheckInterval > 0 {
+		return m.CheckInterval
+	}
+	return defaultCertCheckInterval
+}
+
+// check reloads the certificate if the files changed since it was loaded,
+// or since it last failed to load.
+func (m *CertificateManager) check() {
+	versions := m.fileVersions()
+	m.mu.Lock()
+	changed := !sameVersions(versions, m.versions) && !sameVersions(versions, m.failed)
+	m.lastCheck = time.Now()
+	m.mu.Unlock()
+	if changed {
+		m.Reload()
+	}
+}
+
+func (m *CertificateManager) files() []string {
+	files := []string{m.CertFile, m.KeyFile}
+	if m.OCSPStapleFile != "" {
+		files = append(files, m.OCSPStapleFile)
+	}
+	return files
+}
+
+func (m *CertificateManager) fileVersions() []fileVersion {
+	var versions []fileVersion
+	for _, f := range m.files() {
+		var v fileVersion
+		if fi, err := os.Stat(f); err == nil {
+			v = fileVersion{size: fi.Size(), mod: fi.ModTime()}
+		}
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+func sameVersions(a, b []fileVersion) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].size != b[i].size || !a[i].mod.Equal(b[i].mod) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *CertificateManager) load() (*tls.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(m.CertFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(m.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err = decryptKey(keyPEM, m.KeyPassword)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", m.KeyFile, err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", m.CertFile, err)
+	}
+	if m.OCSPStapleFile != "" {
+		staple, err := ioutil.ReadFile(m.OCSPStapleFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(staple) == 0 {
+			return nil, fmt.Errorf("%s: empty OCSP response", m.OCSPStapleFile)
+		}
+		cert.OCSPStaple = staple
+	}
+	return &cert, nil
+}
+
+// decryptKey returns the PEM private key keyPEM, decrypted with password if
+// it is encrypted.
+func decryptKey(keyPEM, password []byte) ([]byte, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("no PEM private key")
+	}
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		return nil, errors.New("encrypted PKCS #8 keys are not supported")
+	}
+	// Legacy PEM encryption is deprecated as insecure, but it is what
+	// "openssl rsa -aes256" and older tools write.
+	if !x509.IsEncryptedPEMBlock(block) {
+		return keyPEM, nil
+	}
+	if len(password) == 0 {
+		return nil, errors.New("private key is encrypted, but no password is set")
+	}
+	der, err := x509.DecryptPEMBlock(block, password)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der}), nil
+}
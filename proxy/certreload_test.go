@@ -0,0 +1,105 @@
+package proxy_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCert writes cert and its key as PEM files, encrypting the key with
+// password if it is set, and moves their modification time to mod.
+func writeCert(t *testing.T, cert tls.Certificate, certFile, keyFile string, password []byte, mod time.Time) {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	der, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	require.NoError(t, err)
+	block := &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	if len(password) != 0 {
+		block, err = x509.EncryptPEMBlock(rand.Reader, block.Type, der, password, x509.PEMCipherAES256)
+		require.NoError(t, err)
+	}
+	require.NoError(t, ioutil.WriteFile(certFile, certPEM, 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600))
+	require.NoError(t, os.Chtimes(certFile, mod, mod))
+	require.NoError(t, os.Chtimes(keyFile, mod, mod))
+}
+
+func TestCertificateManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ca := newTestCA(t)
+	first, second := ca.issue(nil, "first.test"), ca.issue(nil, "second.test")
+	start := time.Now().Add(-time.Hour)
+	writeCert(t, first, certFile, keyFile, nil, start)
+
+	reloads := make(chan *tls.Certificate, 10)
+	errs := make(chan error, 10)
+	m := &proxy.CertificateManager{
+		CertFile:      certFile,
+		KeyFile:       keyFile,
+		CheckInterval: time.Millisecond,
+		OnReload:      func(c *tls.Certificate) { reloads <- c },
+		OnError:       func(err error) { errs <- err },
+	}
+	require.NoError(t, m.Load())
+	<-reloads
+	leaf := func() []byte {
+		cert, err := m.GetCertificate(&tls.ClientHelloInfo{})
+		require.NoError(t, err)
+		return cert.Certificate[0]
+	}
+	assert.Equal(t, first.Certificate[0], leaf())
+
+	writeCert(t, second, certFile, keyFile, nil, start.Add(time.Minute))
+	assert.Eventually(t, func() bool { return bytes.Equal(leaf(), second.Certificate[0]) }, time.Second, time.Millisecond)
+	<-reloads
+
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte("garbage"), 0600))
+	require.NoError(t, os.Chtimes(keyFile, start, start))
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, second.Certificate[0], leaf(), "a broken certificate keeps the previous one")
+	time.Sleep(5 * time.Millisecond)
+	leaf()
+	assert.Len(t, errs, 1, "a broken certificate is reported once")
+	client, err := m.GetClientCertificate(&tls.CertificateRequestInfo{})
+	require.NoError(t, err)
+	assert.Equal(t, second.Certificate[0], client.Certificate[0])
+}
+
+func TestCertificateManager_EncryptedKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cert := newTestCA(t).issue(nil, "proxy.test")
+	writeCert(t, cert, certFile, keyFile, []byte("5ecret"), time.Now())
+
+	m := &proxy.CertificateManager{CertFile: certFile, KeyFile: keyFile}
+	assert.Error(t, m.Load(), "no password")
+	m = &proxy.CertificateManager{CertFile: certFile, KeyFile: keyFile, KeyPassword: []byte("wrong")}
+	assert.Error(t, m.Load(), "wrong password")
+	_, err = m.GetCertificate(&tls.ClientHelloInfo{})
+	assert.Error(t, err, "nothing loaded")
+
+	staple := filepath.Join(dir, "ocsp.der")
+	require.NoError(t, ioutil.WriteFile(staple, []byte{0x30, 0x03, 0x0a, 0x01, 0x00}, 0600))
+	m = &proxy.CertificateManager{CertFile: certFile, KeyFile: keyFile, KeyPassword: []byte("5ecret"), OCSPStapleFile: staple}
+	require.NoError(t, m.Load())
+	got := m.Certificate()
+	require.NotNil(t, got)
+	assert.Equal(t, cert.Certificate[0], got.Certificate[0])
+	assert.Equal(t, []byte{0x30, 0x03, 0x0a, 0x01, 0x00}, got.OCSPStaple)
+}
@@ -0,0 +1,15 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package channelz
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/channelz/service"
+)
+
+// Register registers the Channelz service on s.
+func Register(s *grpc.Server) {
+	service.RegisterChannelzServiceToServer(s)
+}
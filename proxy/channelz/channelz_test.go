@@ -0,0 +1,101 @@
+package channelz_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/mkxxx/grpc-proxy/proxy/channelz"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	channelzpb "google.golang.org/grpc/channelz/grpc_channelz_v1"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+type echoService struct{}
+
+func (echoService) PingEmpty(ctx context.Context, _ *pb.Empty) (*pb.PingResponse, error) {
+	return &pb.PingResponse{}, nil
+}
+
+func (echoService) Ping(ctx context.Context, req *pb.PingRequest) (*pb.PingResponse, error) {
+	return &pb.PingResponse{Value: req.Value}, nil
+}
+
+func (echoService) PingError(ctx context.Context, req *pb.PingRequest) (*pb.Empty, error) {
+	return &pb.Empty{}, nil
+}
+
+func (echoService) PingList(req *pb.PingRequest, stream pb.TestService_PingListServer) error {
+	return nil
+}
+
+func (echoService) PingStream(stream pb.TestService_PingStreamServer) error {
+	return nil
+}
+
+func listen(t *testing.T, s *grpc.Server) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(lis)
+	return lis.Addr().String()
+}
+
+func TestRegister(t *testing.T) {
+	backend := grpc.NewServer()
+	pb.RegisterTestServiceServer(backend, echoService{})
+	backendAddr := listen(t, backend)
+	defer backend.Stop()
+	backendConn, err := grpc.Dial(backendAddr, grpc.WithInsecure(), proxy.DialOption())
+	require.NoError(t, err)
+	defer backendConn.Close()
+
+	director := func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+		return ctx, nil, proxy.Direction{BackendConn: backendConn}, nil
+	}
+	p := grpc.NewServer(
+		proxy.ServerOption(),
+		grpc.UnknownServiceHandler(proxy.TransparentHandler(director)),
+	)
+	channelz.Register(p)
+	proxyAddr := listen(t, p)
+	defer p.Stop()
+	conn, err := grpc.Dial(proxyAddr, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = pb.NewTestServiceClient(conn).Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err)
+
+	cz := channelzpb.NewChannelzClient(conn)
+	channels, err := cz.GetTopChannels(ctx, &channelzpb.GetTopChannelsRequest{})
+	require.NoError(t, err, "channelz must be answered by the proxy")
+	var backendChannel *channelzpb.Channel
+	for _, ch := range channels.Channel {
+		if ch.Data.Target == backendAddr {
+			backendChannel = ch
+		}
+	}
+	require.NotNil(t, backendChannel, "the backend connection must be a top-level channel")
+	assert.EqualValues(t, 1, backendChannel.Data.CallsSucceeded)
+
+	servers, err := cz.GetServers(ctx, &channelzpb.GetServersRequest{})
+	require.NoError(t, err)
+	var streams int64
+	for _, s := range servers.Server {
+		sockets, err := cz.GetServerSockets(ctx, &channelzpb.GetServerSocketsRequest{ServerId: s.Ref.ServerId})
+		require.NoError(t, err)
+		for _, ref := range sockets.SocketRef {
+			socket, err := cz.GetSocket(ctx, &channelzpb.GetSocketRequest{SocketId: ref.SocketId})
+			require.NoError(t, err)
+			streams += socket.Socket.Data.StreamsSucceeded
+		}
+	}
+	assert.True(t, streams >= 1, "the proxied stream must be counted on a server socket")
+}
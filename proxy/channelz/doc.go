@@ -0,0 +1,30 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+/*
+Package channelz exposes the connection state of a proxy through gRPC
+channelz, so that it can be inspected with standard tools such as grpcdebug
+or channelzcli.
+
+Importing the package turns channelz on for the whole process. From then
+on, gRPC records every backend connection as a top-level channel named by
+its target, with its subchannels, sockets and call counts, and every proxy
+server with its listen and client sockets, including the number of streams
+started, succeeded and failed on each of them. Connections which were made
+before the package was initialized are not recorded, so it must be imported
+by the main package rather than loaded late.
+
+Register serves the Channelz service on a server, usually the proxy itself
+or a separate admin server:
+
+	server := grpc.NewServer(
+		proxy.ServerOption(),
+		grpc.UnknownServiceHandler(proxy.TransparentHandler(director)),
+	)
+	channelz.Register(server)
+
+Locally registered services take precedence over the proxy handler, so
+channelz requests are answered by the proxy and not forwarded.
+*/
+package channelz
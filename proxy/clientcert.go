@@ -0,0 +1,155 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"net/url"
+	"strings"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// XForwardedClientCert is the metadata key carrying the client certificate
+// details, in the format used by Envoy.
+const XForwardedClientCert = "x-forwarded-client-cert"
+
+// ClientCertMode selects how a x-forwarded-client-cert entry received from
+// the client is treated.
+type ClientCertMode int
+
+const (
+	// SanitizeClientCert removes the entry and forwards none.
+	SanitizeClientCert ClientCertMode = iota
+	// SetClientCert replaces the entry with the details of the client
+	// certificate.
+	SetClientCert
+	// AppendClientCert appends the details of the client certificate to
+	// the entry. Use it only when clients are trusted proxies.
+	AppendClientCert
+	// ForwardClientCert forwards the entry unchanged.
+	ForwardClientCert
+)
+
+// ClientCertPolicy describes how the identity of clients authenticated with
+// mutual TLS is passed to backends.
+//
+// The client certificate itself cannot be presented to backends, as the
+// proxy does not hold its key. Connections to backends use the proxy's own
+// workload certificate, set with BackendConfig.Credentials, and the client
+// identity is forwarded as metadata. Backends should only trust the entry
+// on connections authenticated as the proxy.
+type ClientCertPolicy struct {
+	Mode ClientCertMode
+
+	// By is the identity of the proxy, such as its SPIFFE ID, present in
+	// every element added.
+	By string
+
+	// The following fields select the details of the certificate included
+	// besides its hash: the PEM encoded certificate, the PEM encoded chain
+	// including it, its subject, its URI SANs and its DNS SANs.
+	Cert, Chain, Subject, URI, DNS bool
+}
+
+// WithClientCertForwarding sets the policy for forwarding client
+// certificates to backends, in the x-forwarded-client-cert entry.
+func WithClientCertForwarding(policy ClientCertPolicy) Option {
+	return func(o *options) {
+		o.clientCert = &policy
+	}
+}
+
+// PeerCertificates returns the certificate chain presented by the client of
+// the server context ctx, leaf first, or nil if it did not present one.
+func PeerCertificates(ctx context.Context) []*x509.Certificate {
+	pr, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	info, ok := pr.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return nil
+	}
+	return info.State.PeerCertificates
+}
+
+// apply sets the x-forwarded-client-cert entry of the outgoing context of
+// clientCtx, for the client of serverCtx.
+func (p *ClientCertPolicy) apply(clientCtx, serverCtx context.Context) context.Context {
+	if p.Mode == ForwardClientCert {
+		return clientCtx
+	}
+	md, _ := metadata.FromOutgoingContext(clientCtx)
+	md = md.Copy()
+	received := md.Get(XForwardedClientCert)
+	delete(md, XForwardedClientCert)
+	var elements []string
+	if p.Mode == AppendClientCert {
+		elements = received
+	}
+	if p.Mode != SanitizeClientCert {
+		if chain := PeerCertificates(serverCtx); len(chain) != 0 {
+			elements = append(elements, p.element(chain))
+		}
+	}
+	if len(elements) != 0 {
+		md.Set(XForwardedClientCert, strings.Join(elements, ","))
+	}
+	return metadata.NewOutgoingContext(clientCtx, md)
+}
+
+// element formats the details of chain as one element of the entry.
+func (p *ClientCertPolicy) element(chain []*x509.Certificate) string {
+	leaf := chain[0]
+	var kv []string
+	if p.By != "" {
+		kv = append(kv, "By="+xfccValue(p.By))
+	}
+	hash := sha256.Sum256(leaf.Raw)
+	kv = append(kv, "Hash="+hex.EncodeToString(hash[:]))
+	if p.Cert {
+		kv = append(kv, `Cert="`+url.PathEscape(pemEncode(leaf))+`"`)
+	}
+	if p.Chain {
+		var b strings.Builder
+		for _, c := range chain {
+			b.WriteString(pemEncode(c))
+		}
+		kv = append(kv, `Chain="`+url.PathEscape(b.String())+`"`)
+	}
+	if p.Subject {
+		kv = append(kv, `Subject="`+strings.Replace(leaf.Subject.String(), `"`, `\"`, -1)+`"`)
+	}
+	if p.URI {
+		for _, u := range leaf.URIs {
+			kv = append(kv, "URI="+xfccValue(u.String()))
+		}
+	}
+	if p.DNS {
+		for _, name := range leaf.DNSNames {
+			kv = append(kv, "DNS="+xfccValue(name))
+		}
+	}
+	return strings.Join(kv, ";")
+}
+
+// xfccValue quotes v if it contains separators.
+func xfccValue(v string) string {
+	if !strings.ContainsAny(v, `,;="`) {
+		return v
+	}
+	return `"` + strings.Replace(v, `"`, `\"`, -1) + `"`
+}
+
+func pemEncode(c *x509.Certificate) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw}))
+}
@@ -0,0 +1,145 @@
+package proxy_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// startMTLSProxy starts a proxy requiring client certificates from ca and
+// returns a client presenting clientCert.
+func startMTLSProxy(t *testing.T, ca *testCA, clientCert tls.Certificate, director proxy.StreamDirector, opts ...proxy.Option) (*grpc.Server, *grpc.ClientConn) {
+	creds := credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{ca.issue(nil, "proxy.test")},
+		ClientCAs:    ca.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer(
+		grpc.Creds(creds),
+		proxy.ServerOption(),
+		grpc.UnknownServiceHandler(proxy.TransparentHandler(director, opts...)),
+	)
+	go server.Serve(lis)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      ca.pool,
+		ServerName:   "proxy.test",
+	})))
+	require.NoError(t, err)
+	return server, conn
+}
+
+func TestClientCertForwarding(t *testing.T) {
+	spiffeID, err := url.Parse("spiffe://example.org/ns/default/sa/client")
+	require.NoError(t, err)
+	ca := newTestCA(t)
+	clientCert := ca.issue(&x509.Certificate{Subject: pkix.Name{CommonName: "client", Organization: []string{"Example"}}, URIs: []*url.URL{spiffeID}}, "client.test")
+	leaf, err := x509.ParseCertificate(clientCert.Certificate[0])
+	require.NoError(t, err)
+	hash := sha256.Sum256(leaf.Raw)
+
+	received := make(chan []string, 1)
+	svc := &pingService{ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		received <- md.Get(proxy.XForwardedClientCert)
+		return &pb.PingResponse{Value: ping.Value}, nil
+	}}
+	backend, backendConn := startBackend(t, svc)
+	defer backend.Stop()
+	defer backendConn.Close()
+	director := func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+		return ctx, nil, proxy.Direction{BackendConn: backendConn}, nil
+	}
+
+	for _, tc := range []struct {
+		name     string
+		policy   proxy.ClientCertPolicy
+		expected func(t *testing.T, xfcc []string)
+	}{
+		{
+			name:   "sanitize",
+			policy: proxy.ClientCertPolicy{Mode: proxy.SanitizeClientCert},
+			expected: func(t *testing.T, xfcc []string) {
+				assert.Empty(t, xfcc)
+			},
+		},
+		{
+			name:   "forward",
+			policy: proxy.ClientCertPolicy{Mode: proxy.ForwardClientCert},
+			expected: func(t *testing.T, xfcc []string) {
+				assert.Equal(t, []string{"Hash=upstream"}, xfcc)
+			},
+		},
+		{
+			name:   "set",
+			policy: proxy.ClientCertPolicy{Mode: proxy.SetClientCert, By: "spiffe://example.org/proxy", Subject: true, URI: true, DNS: true},
+			expected: func(t *testing.T, xfcc []string) {
+				assert.Equal(t, []string{
+					"By=spiffe://example.org/proxy;Hash=" + hex.EncodeToString(hash[:]) +
+						`;Subject="CN=client,O=Example";URI=spiffe://example.org/ns/default/sa/client;DNS=client.test`,
+				}, xfcc)
+			},
+		},
+		{
+			name:   "append with cert",
+			policy: proxy.ClientCertPolicy{Mode: proxy.AppendClientCert, Cert: true},
+			expected: func(t *testing.T, xfcc []string) {
+				require.Len(t, xfcc, 1)
+				elements := strings.SplitN(xfcc[0], ",", 2)
+				require.Len(t, elements, 2)
+				assert.Equal(t, "Hash=upstream", elements[0])
+				assert.True(t, strings.HasPrefix(elements[1], "Hash="+hex.EncodeToString(hash[:])+`;Cert="-----BEGIN%20CERTIFICATE-----%0A`), elements[1])
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server, conn := startMTLSProxy(t, ca, clientCert, director, proxy.WithClientCertForwarding(tc.policy))
+			defer server.Stop()
+			defer conn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			ctx = metadata.AppendToOutgoingContext(ctx, proxy.XForwardedClientCert, "Hash=upstream")
+			_, err := pb.NewTestServiceClient(conn).Ping(ctx, &pb.PingRequest{Value: "foo"})
+			require.NoError(t, err)
+			tc.expected(t, <-received)
+		})
+	}
+}
+
+func TestClientCertForwarding_InsecureClient(t *testing.T) {
+	received := make(chan []string, 1)
+	svc := &pingService{ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		received <- md.Get(proxy.XForwardedClientCert)
+		return &pb.PingResponse{Value: ping.Value}, nil
+	}}
+	env := newTestEnv(t, svc, proxy.WithClientCertForwarding(proxy.ClientCertPolicy{Mode: proxy.SetClientCert}))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, proxy.XForwardedClientCert, "Hash=spoofed")
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err)
+	assert.Empty(t, <-received, "entries of clients without certificates must be dropped")
+}
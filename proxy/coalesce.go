@@ -0,0 +1,149 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CoalescePolicy describes how identical concurrent calls are coalesced.
+//
+// Calls are identical when they have the same method, request message and
+// values of the VaryMetadata keys. While a call is in flight, identical
+// calls wait for it instead of reaching the backend, and get its response
+// or error. Like with caching, only unary-style calls are coalesced and the
+// request is read before the backend is called.
+type CoalescePolicy struct {
+	// VaryMetadata lists the client metadata keys which distinguish calls,
+	// besides the method and the request message.
+	VaryMetadata []string
+}
+
+// WithRequestCoalescing enables coalescing of identical concurrent calls to
+// methods whose full method name starts with prefix, such as
+// "/pkg.Service/Method" or "/pkg.Service/". When several prefixes match,
+// the longest wins.
+func WithRequestCoalescing(prefix string, policy CoalescePolicy) Option {
+	return func(o *options) {
+		if o.coalescers == nil {
+			o.coalescers = make(map[string]*coalescer)
+		}
+		o.coalescers[prefix] = &coalescer{policy: policy, flights: make(map[string]*flight)}
+	}
+}
+
+// coalescer returns the coalescer for method, or nil.
+func (o *options) coalescer(method string) *coalescer {
+	var best *coalescer
+	bestLen := -1
+	for prefix, c := range o.coalescers {
+		if len(prefix) > bestLen && strings.HasPrefix(method, prefix) {
+			best, bestLen = c, len(prefix)
+		}
+	}
+	return best
+}
+
+// coalescer tracks the calls in flight for one policy.
+type coalescer struct {
+	policy CoalescePolicy
+
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a call to the backend shared by identical calls.
+type flight struct {
+	done chan struct{}
+	// resp or err hold the outcome once done is closed. Both are nil if
+	// the outcome cannot be shared.
+	resp *CachedResponse
+	err  error
+}
+
+// coalescedCall is the coalescing state of a single stream.
+type coalescedCall struct {
+	ctx    context.Context
+	c      *coalescer
+	key    string
+	flight *flight
+	leader bool
+}
+
+// join reads the request of a call and joins the flight of an identical
+// call, or starts one. A waiting call returns once the flight's outcome is
+// known. The returned server stream replays the request for the backend
+// call. The returned call is nil for calls which are not coalesced.
+func (c *coalescer) join(ctx context.Context, in grpc.ServerStream, method string) (grpc.ServerStream, *coalescedCall, error) {
+	req, unary, err := bufferRequest(in, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	in = &replayServerStream{ServerStream: in, req: req, eof: unary}
+	if !unary || len(req) != 1 {
+		return in, nil, nil
+	}
+
+	call := &coalescedCall{ctx: ctx, c: c, key: requestKey(ctx, method, c.policy.VaryMetadata, req[0].payload)}
+	c.mu.Lock()
+	call.flight = c.flights[call.key]
+	if call.flight == nil {
+		call.flight = &flight{done: make(chan struct{})}
+		call.leader = true
+		c.flights[call.key] = call.flight
+	}
+	c.mu.Unlock()
+	if call.leader {
+		return in, call, nil
+	}
+	select {
+	case <-call.flight.done:
+		return in, call, nil
+	case <-ctx.Done():
+		return nil, nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// shared reports whether a waiting call has an outcome to use. Otherwise
+// the call goes to the backend itself.
+func (call *coalescedCall) shared() bool {
+	return !call.leader && (call.flight.resp != nil || call.flight.err != nil)
+}
+
+// record wraps the backend stream of the leader to keep its response.
+func (call *coalescedCall) record(out grpc.ClientStream) grpc.ClientStream {
+	if !call.leader {
+		return out
+	}
+	return &recordingClientStream{ClientStream: out, done: func(resp *CachedResponse) {
+		call.flight.resp = resp
+	}}
+}
+
+// finish ends the flight of the leader with the outcome of its call. A
+// recorded response is shared even if relaying it to the leader's client
+// failed. Errors are not shared once the leader's client has gone, as they
+// may be caused by it, so waiting calls go to the backend themselves.
+func (call *coalescedCall) finish(err error) {
+	if !call.leader {
+		return
+	}
+	f := call.flight
+	if f.resp == nil && err != nil && call.ctx.Err() == nil {
+		if code := status.Code(err); code != codes.Canceled && code != codes.DeadlineExceeded {
+			f.err = err
+		}
+	}
+	call.c.mu.Lock()
+	delete(call.c.flights, call.key)
+	call.c.mu.Unlock()
+	close(f.done)
+}
@@ -0,0 +1,154 @@
+package proxy_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// gatedService holds pings until release is closed, counting them.
+type gatedService struct {
+	calls   int32
+	entered chan struct{}
+	release chan struct{}
+}
+
+func newGatedService() *gatedService {
+	return &gatedService{entered: make(chan struct{}, 100), release: make(chan struct{})}
+}
+
+func (g *gatedService) service() *pingService {
+	return &pingService{ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+		n := atomic.AddInt32(&g.calls, 1)
+		g.entered <- struct{}{}
+		select {
+		case <-g.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if ping.Value == "fail" {
+			return nil, status.Error(codes.FailedPrecondition, "failed")
+		}
+		return &pb.PingResponse{Value: ping.Value, Counter: n}, nil
+	}}
+}
+
+// concurrentPings sends n identical pings at once and returns their
+// results once all are done.
+func concurrentPings(ctx context.Context, client pb.TestServiceClient, n int, value string) ([]*pb.PingResponse, []error) {
+	var wg sync.WaitGroup
+	outs := make([]*pb.PingResponse, n)
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			outs[i], errs[i] = client.Ping(ctx, &pb.PingRequest{Value: value})
+		}(i)
+	}
+	wg.Wait()
+	return outs, errs
+}
+
+func TestRequestCoalescing(t *testing.T) {
+	for _, value := range []string{"foo", "fail"} {
+		t.Run(value, func(t *testing.T) {
+			g := newGatedService()
+			env := newTestEnv(t, g.service(), proxy.WithRequestCoalescing(pingMethod, proxy.CoalescePolicy{}))
+			defer env.Close()
+
+			ctx, cancel := env.ctx()
+			defer cancel()
+			go func() {
+				<-g.entered
+				// Give the other calls time to join the flight.
+				time.Sleep(200 * time.Millisecond)
+				close(g.release)
+			}()
+			outs, errs := concurrentPings(ctx, env.client, 5, value)
+			assert.EqualValues(t, 1, atomic.LoadInt32(&g.calls), "identical calls must reach the backend once")
+			for i := range outs {
+				if value == "fail" {
+					assert.Equal(t, codes.FailedPrecondition, status.Code(errs[i]), "errors must be shared")
+					continue
+				}
+				require.NoError(t, errs[i])
+				assert.Equal(t, "foo", outs[i].Value)
+				assert.EqualValues(t, 1, outs[i].Counter)
+			}
+		})
+	}
+}
+
+func TestRequestCoalescing_DistinctRequests(t *testing.T) {
+	g := newGatedService()
+	env := newTestEnv(t, g.service(), proxy.WithRequestCoalescing(pingMethod, proxy.CoalescePolicy{}))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, v := range []string{"a", "b"} {
+		wg.Add(1)
+		go func(v string) {
+			defer wg.Done()
+			out, err := env.client.Ping(ctx, &pb.PingRequest{Value: v})
+			if assert.NoError(t, err) {
+				assert.Equal(t, v, out.Value)
+			}
+		}(v)
+	}
+	<-g.entered
+	<-g.entered
+	close(g.release)
+	wg.Wait()
+	assert.EqualValues(t, 2, atomic.LoadInt32(&g.calls))
+}
+
+func TestRequestCoalescing_LeaderCanceled(t *testing.T) {
+	g := newGatedService()
+	env := newTestEnv(t, g.service(), proxy.WithRequestCoalescing(pingMethod, proxy.CoalescePolicy{}))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	leaderCtx, cancelLeader := context.WithCancel(ctx)
+	leaderDone := make(chan error, 1)
+	go func() {
+		_, err := env.client.Ping(leaderCtx, &pb.PingRequest{Value: "foo"})
+		leaderDone <- err
+	}()
+	<-g.entered
+
+	waiterDone := make(chan *pb.PingResponse, 1)
+	go func() {
+		out, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+		assert.NoError(t, err)
+		waiterDone <- out
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancelLeader()
+	assert.Equal(t, codes.Canceled, status.Code(<-leaderDone))
+
+	// The waiter must make its own call instead of failing with the
+	// leader's cancellation.
+	select {
+	case <-g.entered:
+	case out := <-waiterDone:
+		t.Fatalf("waiter must not share the outcome of a canceled leader, got %v", out)
+	}
+	close(g.release)
+	out := <-waiterDone
+	require.NotNil(t, out)
+	assert.EqualValues(t, 2, out.Counter)
+}
@@ -5,31 +5,73 @@ import (
 
 	"github.com/golang/protobuf/proto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
 )
 
-// Codec returns a proxying grpc.Codec with the default protobuf codec as parent.
+// FrameCodec is the proxying codec. It is both a grpc.Codec and an
+// encoding.Codec, so it can be set with either the old or the new gRPC
+// options. Prefer ServerOption and DialOption, which use the current ones.
+// The buffer based encoding.CodecV2 of later gRPC releases is not
+// available in the version this module requires.
+type FrameCodec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	// String is the name of the codec for grpc.Codec.
+	String() string
+	// Name is the name of the codec for encoding.Codec.
+	Name() string
+}
+
+var (
+	_ grpc.Codec     = FrameCodec(nil)
+	_ encoding.Codec = FrameCodec(nil)
+)
+
+// Codec returns a proxying codec with the default protobuf codec as parent.
 //
 // See CodecWithParent.
-func Codec() grpc.Codec {
+func Codec() FrameCodec {
 	return CodecWithParent(&protoCodec{})
 }
 
-// CodecWithParent returns a proxying grpc.Codec with a user provided codec as parent.
+// CodecWithParent returns a proxying codec with a user provided codec as parent.
 //
 // This codec is *crucial* to the functioning of the proxy. It allows the proxy server to be oblivious
 // to the schema of the forwarded messages. It basically treats a gRPC message frame as raw bytes.
 // However, if the server handler, or the client caller are not proxy-internal functions it will fall back
 // to trying to decode the message using a fallback codec.
-func CodecWithParent(fallback grpc.Codec) grpc.Codec {
+//
+// The name of the codec, which gRPC may use as content-subtype, is that of
+// the parent: its Name if it is an encoding.Codec, or else its String.
+func CodecWithParent(fallback grpc.Codec) FrameCodec {
 	return &rawCodec{fallback}
 }
 
+// ServerOption returns the server option which makes a grpc.Server use the
+// proxying codec, which proxy handlers require.
+//
+// The grpc version this package is built with has no replacement for
+// grpc.CustomCodec on servers yet, so it is used here, where it can be
+// swapped for grpc.ForceServerCodec in one place once it is available.
+func ServerOption() grpc.ServerOption {
+	return grpc.CustomCodec(Codec())
+}
+
+// DialOption returns the dial option which makes backend connections use
+// the proxying codec, see Direction.BackendConn. It replaces the deprecated
+// grpc.WithCodec(proxy.Codec()).
+func DialOption() grpc.DialOption {
+	return grpc.WithDefaultCallOptions(grpc.ForceCodec(Codec()))
+}
+
 type rawCodec struct {
 	parentCodec grpc.Codec
 }
 
 var _ grpc.Codec = &rawCodec{}
 
+// frame holds a raw message. Its payload is the slice gRPC received, which is
+// forwarded as is: the codec never copies messages in either direction.
 type frame struct {
 	payload []byte
 }
@@ -56,6 +98,14 @@ func (c *rawCodec) String() string {
 	return fmt.Sprintf("proxy>%s", c.parentCodec.String())
 }
 
+// Name implements encoding.Codec.
+func (c *rawCodec) Name() string {
+	if ec, ok := c.parentCodec.(encoding.Codec); ok {
+		return ec.Name()
+	}
+	return c.parentCodec.String()
+}
+
 // protoCodec is a Codec implementation with protobuf. It is the default rawCodec for gRPC.
 type protoCodec struct{}
 
@@ -72,3 +122,7 @@ func (protoCodec) Unmarshal(data []byte, v interface{}) error {
 func (protoCodec) String() string {
 	return "proto"
 }
+
+func (protoCodec) Name() string {
+	return "proto"
+}
@@ -22,3 +22,9 @@ func TestCodec_ReadYourWrites(t *testing.T) {
 	require.Equal(t, []byte{0x55}, out, "output and data must be the same")
 
 }
+
+func TestCodec_Name(t *testing.T) {
+	require.Equal(t, "proto", Codec().Name(), "the content-subtype is that of the parent")
+	require.Equal(t, "proxy>proto", Codec().String())
+	require.Equal(t, "proto", CodecWithParent(&protoCodec{}).Name())
+}
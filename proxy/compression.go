@@ -0,0 +1,82 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+
+	// Register the gzip and zstd compressors, so that the proxy accepts
+	// messages compressed with them.
+	_ "github.com/mkxxx/grpc-proxy/proxy/zstd"
+	_ "google.golang.org/grpc/encoding/gzip"
+)
+
+// CompressionPolicy describes how the proxy compresses calls to backends.
+//
+// gRPC decompresses the messages of clients before they reach the proxy,
+// and compresses responses with the encoding of the request, so clients get
+// back what they sent whichever encoding the backend answers with. Towards
+// the backend, calls are sent with the encoding used by the client when the
+// backend accepts it, and transcoded to Fallback when it does not.
+type CompressionPolicy struct {
+	// Accept lists the encodings accepted by backends, such as "gzip" or
+	// "zstd". If empty, calls are always sent with the encoding of the
+	// client. Uncompressed calls are always accepted.
+	Accept []string
+
+	// Fallback is the encoding used for calls whose encoding is not
+	// accepted. Defaults to "identity", which sends them uncompressed.
+	Fallback string
+}
+
+// WithCompression sets the policy for compressing calls to backends.
+// Without it, calls to backends are sent uncompressed unless the director
+// passes grpc.UseCompressor in Direction.CallOptions.
+func WithCompression(policy CompressionPolicy) Option {
+	return func(o *options) {
+		o.compression = &policy
+	}
+}
+
+// backendEncoding returns the encoding to send a call with, given the
+// encoding of the client's call, or "" to send it uncompressed.
+func (p *CompressionPolicy) backendEncoding(clientEncoding string) string {
+	if clientEncoding == "" || clientEncoding == encoding.Identity {
+		return ""
+	}
+	if len(p.Accept) == 0 {
+		return clientEncoding
+	}
+	for _, e := range p.Accept {
+		if e == clientEncoding {
+			return clientEncoding
+		}
+	}
+	if p.Fallback == encoding.Identity {
+		return ""
+	}
+	return p.Fallback
+}
+
+// callOption returns the call option selecting the encoding of the backend
+// call, or nil.
+func (p *CompressionPolicy) callOption(ctx context.Context) grpc.CallOption {
+	if e := p.backendEncoding(recvEncoding(ctx)); e != "" {
+		return grpc.UseCompressor(e)
+	}
+	return nil
+}
+
+// recvEncoding returns the encoding of the messages received on the server
+// stream of ctx. The stream is only known for calls served by a grpc.Server.
+func recvEncoding(ctx context.Context) string {
+	if s, ok := grpc.ServerTransportStreamFromContext(ctx).(interface{ RecvCompress() string }); ok {
+		return s.RecvCompress()
+	}
+	return ""
+}
@@ -0,0 +1,88 @@
+package proxy_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/mkxxx/grpc-proxy/proxy/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding/gzip"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// encodingRecorder is a ping service recording the encoding of the calls it
+// receives.
+type encodingRecorder struct {
+	mu       sync.Mutex
+	encoding string
+}
+
+func (r *encodingRecorder) service() *pingService {
+	return &pingService{ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+		s := grpc.ServerTransportStreamFromContext(ctx).(interface{ RecvCompress() string })
+		r.mu.Lock()
+		r.encoding = s.RecvCompress()
+		r.mu.Unlock()
+		return &pb.PingResponse{Value: ping.Value}, nil
+	}}
+}
+
+func (r *encodingRecorder) last() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.encoding
+}
+
+func TestCompression(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     []proxy.Option
+		client   string
+		expected string
+	}{
+		{name: "default uncompressed", client: gzip.Name, expected: ""},
+		{name: "passthrough gzip", opts: []proxy.Option{proxy.WithCompression(proxy.CompressionPolicy{})}, client: gzip.Name, expected: gzip.Name},
+		{name: "passthrough zstd", opts: []proxy.Option{proxy.WithCompression(proxy.CompressionPolicy{})}, client: zstd.Name, expected: zstd.Name},
+		{name: "passthrough identity", opts: []proxy.Option{proxy.WithCompression(proxy.CompressionPolicy{})}, expected: ""},
+		{
+			name:     "accepted",
+			opts:     []proxy.Option{proxy.WithCompression(proxy.CompressionPolicy{Accept: []string{gzip.Name, zstd.Name}})},
+			client:   zstd.Name,
+			expected: zstd.Name,
+		},
+		{
+			name:     "transcoded to identity",
+			opts:     []proxy.Option{proxy.WithCompression(proxy.CompressionPolicy{Accept: []string{zstd.Name}})},
+			client:   gzip.Name,
+			expected: "",
+		},
+		{
+			name:     "transcoded to fallback",
+			opts:     []proxy.Option{proxy.WithCompression(proxy.CompressionPolicy{Accept: []string{zstd.Name}, Fallback: zstd.Name})},
+			client:   gzip.Name,
+			expected: zstd.Name,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := &encodingRecorder{}
+			env := newTestEnv(t, rec.service(), tc.opts...)
+			defer env.Close()
+
+			ctx, cancel := env.ctx()
+			defer cancel()
+			var callOpts []grpc.CallOption
+			if tc.client != "" {
+				callOpts = append(callOpts, grpc.UseCompressor(tc.client))
+			}
+			out, err := env.client.Ping(ctx, &pb.PingRequest{Value: "compressible compressible compressible"}, callOpts...)
+			require.NoError(t, err)
+			assert.Equal(t, "compressible compressible compressible", out.Value)
+			assert.Equal(t, tc.expected, rec.last())
+		})
+	}
+}
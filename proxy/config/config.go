@@ -0,0 +1,367 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/alts"
+	"google.golang.org/grpc/keepalive"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is a routing configuration, usually loaded from a YAML or JSON
+// file:
+//
+//	backends:
+//	  - name: users
+//	    balancer: least_streams
+//	    affinity:
+//	      metadata_key: session-id
+//	    tls:
+//	      ca_file: /etc/proxy/ca.pem
+//	    keepalive:
+//	      time: 30s
+//	      timeout: 10s
+//	    max_reconnect_backoff: 10s
+//	    endpoints:
+//	      - address: users-1.internal:443
+//	      - address: users-2.internal:443
+//	        weight: 2
+//	routes:
+//	  - method_prefix: /users.UserService/
+//	    backend: users
+//	    metadata_limits:
+//	      max_value_length: 4096
+//	metadata_limits:
+//	  max_size: 16384
+//	  max_keys: 64
+type Config struct {
+	Backends []Backend `yaml:"backends" json:"backends"`
+	Routes   []Route   `yaml:"routes" json:"routes"`
+	// MetadataLimits apply to the calls of routes without limits of their
+	// own, per limit.
+	MetadataLimits *MetadataLimits `yaml:"metadata_limits" json:"metadata_limits"`
+}
+
+// Backend describes a named backend and its endpoints.
+type Backend struct {
+	Name string `yaml:"name" json:"name"`
+	// Balancer is one of "round_robin" (the default), "least_streams",
+	// "weighted", "ring_hash" or "maglev". The hash balancers use the hash a
+	// director sets with proxy.NewContextWithHash.
+	Balancer  string    `yaml:"balancer" json:"balancer"`
+	Affinity  *Affinity `yaml:"affinity" json:"affinity"`
+	Authority string    `yaml:"authority" json:"authority"`
+	TLS       *TLS      `yaml:"tls" json:"tls"`
+	ALTS      *ALTS     `yaml:"alts" json:"alts"`
+	// TransportCredentials names credentials of Manager.TransportCredentials
+	// which secure the connections, for credentials which cannot be
+	// configured in the file. Only one of TLS, ALTS and
+	// TransportCredentials may be set.
+	TransportCredentials string     `yaml:"transport_credentials" json:"transport_credentials"`
+	Keepalive            *Keepalive `yaml:"keepalive" json:"keepalive"`
+	// MaxReconnectBackoff caps the backoff between attempts to reconnect to
+	// an endpoint, see proxy.BackendConfig.
+	MaxReconnectBackoff time.Duration `yaml:"max_reconnect_backoff" json:"max_reconnect_backoff"`
+	Network             *Network      `yaml:"network" json:"network"`
+	// UpstreamProxy is the URL of a SOCKS5 or HTTP CONNECT proxy the
+	// endpoints are reached through, such as socks5://egress:1080, see
+	// proxy.UpstreamProxy.
+	UpstreamProxy string     `yaml:"upstream_proxy" json:"upstream_proxy"`
+	Endpoints     []Endpoint `yaml:"endpoints" json:"endpoints"`
+}
+
+// Network configures the TCP connections to the endpoints of a backend,
+// see proxy.TCPDialConfig:
+//
+//	network:
+//	  source_address: 10.1.0.5
+//	  interface: eth1
+//	  dscp: 46
+//	  mark: 2
+type Network struct {
+	SourceAddress string `yaml:"source_address" json:"source_address"`
+	Interface     string `yaml:"interface" json:"interface"`
+	DSCP          int    `yaml:"dscp" json:"dscp"`
+	Mark          int    `yaml:"mark" json:"mark"`
+}
+
+// Keepalive enables keepalive pings to the endpoints of a backend, see
+// keepalive.ClientParameters. Durations are written as "30s".
+type Keepalive struct {
+	Time                time.Duration `yaml:"time" json:"time"`
+	Timeout             time.Duration `yaml:"timeout" json:"timeout"`
+	PermitWithoutStream bool          `yaml:"permit_without_stream" json:"permit_without_stream"`
+}
+
+func (k *Keepalive) params() *keepalive.ClientParameters {
+	return &keepalive.ClientParameters{Time: k.Time, Timeout: k.Timeout, PermitWithoutStream: k.PermitWithoutStream}
+}
+
+// Affinity sends the calls of a session to the same endpoint, see
+// proxy.NewAffinityBalancer. Calls without a session use the balancer.
+type Affinity struct {
+	MetadataKey string `yaml:"metadata_key" json:"metadata_key"`
+	Claim       string `yaml:"claim" json:"claim"`
+}
+
+// Endpoint is one address of a backend. Addresses with the "unix:" prefix
+// are Unix socket paths.
+type Endpoint struct {
+	Address string `yaml:"address" json:"address"`
+	Weight  int    `yaml:"weight" json:"weight"`
+}
+
+// TLS secures the connections to a backend. Without a CA file the system
+// roots are used. The client certificate is reloaded when its files change,
+// see proxy.CertificateManager.
+type TLS struct {
+	CAFile   string `yaml:"ca_file" json:"ca_file"`
+	CertFile string `yaml:"cert_file" json:"cert_file"`
+	KeyFile  string `yaml:"key_file" json:"key_file"`
+	// KeyPasswordFile holds the password of an encrypted key file.
+	KeyPasswordFile string `yaml:"key_password_file" json:"key_password_file"`
+}
+
+// ALTS secures the connections to a backend with Application Layer
+// Transport Security, as on Google Cloud. The proxy only connects to
+// backends running as one of TargetServiceAccounts, or to any backend if
+// there are none.
+type ALTS struct {
+	TargetServiceAccounts []string `yaml:"target_service_accounts" json:"target_service_accounts"`
+	// HandshakerAddress is the address of the ALTS handshaker service. It
+	// defaults to that of the hypervisor.
+	HandshakerAddress string `yaml:"handshaker_address" json:"handshaker_address"`
+}
+
+func (a *ALTS) credentials() credentials.TransportCredentials {
+	opts := alts.DefaultClientOptions()
+	opts.TargetServiceAccounts = a.TargetServiceAccounts
+	if a.HandshakerAddress != "" {
+		opts.HandshakerServiceAddress = a.HandshakerAddress
+	}
+	return alts.NewClientCreds(opts)
+}
+
+// Route sends matching calls to a backend, or splits them among several,
+// see proxy.Route:
+//
+//	routes:
+//	  - name: users
+//	    method_prefix: /users.
+//	    split:
+//	      - backend: users
+//	        weight: 95
+//	      - backend: users-canary
+//	        weight: 5
+//	    method_splits:
+//	      /users.UserService/Delete:
+//	        - backend: users
+//	          weight: 1
+//	    credentials:
+//	      metadata:
+//	        x-api-key: 5ecret
+type Route struct {
+	Name         string                     `yaml:"name" json:"name"`
+	MethodPrefix string                     `yaml:"method_prefix" json:"method_prefix"`
+	Authority    string                     `yaml:"authority" json:"authority"`
+	Metadata     map[string]string          `yaml:"metadata" json:"metadata"`
+	Backend      string                     `yaml:"backend" json:"backend"`
+	Split        []BackendWeight            `yaml:"split" json:"split"`
+	MethodSplits map[string][]BackendWeight `yaml:"method_splits" json:"method_splits"`
+	Credentials  *Credentials               `yaml:"credentials" json:"credentials"`
+	// MetadataLimits replace the limits of Config.MetadataLimits for the
+	// route. Negative values remove a limit.
+	MetadataLimits *MetadataLimits `yaml:"metadata_limits" json:"metadata_limits"`
+}
+
+// MetadataLimits bound the metadata of client calls, see
+// proxy.MetadataLimits. Calls over a limit fail with ResourceExhausted.
+type MetadataLimits struct {
+	MaxSize        int `yaml:"max_size" json:"max_size"`
+	MaxKeys        int `yaml:"max_keys" json:"max_keys"`
+	MaxValueLength int `yaml:"max_value_length" json:"max_value_length"`
+}
+
+func (l *MetadataLimits) limits() proxy.MetadataLimits {
+	if l == nil {
+		return proxy.MetadataLimits{}
+	}
+	return proxy.MetadataLimits{MaxSize: l.MaxSize, MaxKeys: l.MaxKeys, MaxValueLength: l.MaxValueLength}
+}
+
+// Credentials replace the client metadata with the same keys by fixed
+// values for the backend calls of a route, such as an API key, see
+// proxy.StaticCredentials. Unless AllowInsecure is set, they are only sent
+// to backends with TLS.
+type Credentials struct {
+	Metadata      map[string]string `yaml:"metadata" json:"metadata"`
+	AllowInsecure bool              `yaml:"allow_insecure" json:"allow_insecure"`
+}
+
+// BackendWeight is the share of a backend in the calls of a split route.
+type BackendWeight struct {
+	Backend string `yaml:"backend" json:"backend"`
+	Weight  int    `yaml:"weight" json:"weight"`
+}
+
+// Load reads and validates the configuration at path.
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// Parse parses and validates a YAML or JSON configuration.
+func Parse(data []byte) (*Config, error) {
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks that the configuration can be applied.
+func (c *Config) Validate() error {
+	names := make(map[string]bool)
+	for i, b := range c.Backends {
+		if b.Name == "" {
+			return fmt.Errorf("backend %d has no name", i)
+		}
+		if names[b.Name] {
+			return fmt.Errorf("backend %q is defined twice", b.Name)
+		}
+		names[b.Name] = true
+		switch b.Balancer {
+		case "", "round_robin", "least_streams", "weighted", "ring_hash", "maglev":
+		default:
+			return fmt.Errorf("backend %q: unknown balancer %q", b.Name, b.Balancer)
+		}
+		if b.Affinity != nil && b.Affinity.MetadataKey == "" && b.Affinity.Claim == "" {
+			return fmt.Errorf("backend %q: affinity needs a metadata_key or claim", b.Name)
+		}
+		if b.MaxReconnectBackoff < 0 || (b.Keepalive != nil && (b.Keepalive.Time < 0 || b.Keepalive.Timeout < 0)) {
+			return fmt.Errorf("backend %q: negative duration", b.Name)
+		}
+		if b.Network != nil && (b.Network.DSCP < 0 || b.Network.DSCP > 63) {
+			return fmt.Errorf("backend %q: dscp %d is out of range", b.Name, b.Network.DSCP)
+		}
+		if b.UpstreamProxy != "" {
+			if _, err := proxy.ParseUpstreamProxy(b.UpstreamProxy); err != nil {
+				return fmt.Errorf("backend %q: %v", b.Name, err)
+			}
+		}
+		if len(b.Endpoints) == 0 {
+			return fmt.Errorf("backend %q has no endpoints", b.Name)
+		}
+		for _, ep := range b.Endpoints {
+			if ep.Address == "" {
+				return fmt.Errorf("backend %q has an endpoint without address", b.Name)
+			}
+			if ep.Weight < 0 {
+				return fmt.Errorf("backend %q: negative weight for %s", b.Name, ep.Address)
+			}
+		}
+		secured := 0
+		for _, set := range []bool{b.TLS != nil, b.ALTS != nil, b.TransportCredentials != ""} {
+			if set {
+				secured++
+			}
+		}
+		if secured > 1 {
+			return fmt.Errorf("backend %q: only one of tls, alts and transport_credentials may be set", b.Name)
+		}
+		if b.TLS != nil {
+			if _, err := b.TLS.credentials(); err != nil {
+				return fmt.Errorf("backend %q: %v", b.Name, err)
+			}
+		}
+	}
+	if l := c.MetadataLimits; l != nil && (l.MaxSize < 0 || l.MaxKeys < 0 || l.MaxValueLength < 0) {
+		return errors.New("negative metadata limit")
+	}
+	for i, r := range c.Routes {
+		if r.Backend == "" && len(r.Split) == 0 {
+			return fmt.Errorf("route %d has no backend", i)
+		}
+		if r.Backend != "" && !names[r.Backend] {
+			return fmt.Errorf("route %d: unknown backend %q", i, r.Backend)
+		}
+		if err := validateSplit(r.Split, names); err != nil {
+			return fmt.Errorf("route %d: %v", i, err)
+		}
+		for prefix, split := range r.MethodSplits {
+			if err := validateSplit(split, names); err != nil {
+				return fmt.Errorf("route %d, method %s: %v", i, prefix, err)
+			}
+		}
+		if r.Credentials != nil && len(r.Credentials.Metadata) == 0 {
+			return fmt.Errorf("route %d: credentials without metadata", i)
+		}
+	}
+	return nil
+}
+
+func validateSplit(split []BackendWeight, names map[string]bool) error {
+	for _, bw := range split {
+		if !names[bw.Backend] {
+			return fmt.Errorf("unknown backend %q", bw.Backend)
+		}
+		if bw.Weight < 0 {
+			return fmt.Errorf("negative weight for %s", bw.Backend)
+		}
+	}
+	return nil
+}
+
+func (t *TLS) credentials() (credentials.TransportCredentials, error) {
+	cfg := &tls.Config{}
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", t.CAFile)
+		}
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		if t.CertFile == "" || t.KeyFile == "" {
+			return nil, errors.New("cert_file and key_file must be set together")
+		}
+		certs := &proxy.CertificateManager{CertFile: t.CertFile, KeyFile: t.KeyFile}
+		if t.KeyPasswordFile != "" {
+			password, err := ioutil.ReadFile(t.KeyPasswordFile)
+			if err != nil {
+				return nil, err
+			}
+			certs.KeyPassword = bytes.TrimRight(password, "\r\n")
+		}
+		if err := certs.Load(); err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = certs.GetClientCertificate
+	}
+	return credentials.NewTLS(cfg), nil
+}
@@ -0,0 +1,103 @@
+package config_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	cfg, err := config.Parse([]byte(`
+backends:
+  - name: users
+    balancer: weighted
+    affinity:
+      metadata_key: session-id
+    authority: users.internal
+    keepalive:
+      time: 30s
+      timeout: 10s
+    max_reconnect_backoff: 5s
+    network:
+      source_address: 10.0.0.100
+      dscp: 46
+    endpoints:
+      - address: 10.0.0.1:443
+        weight: 3
+      - address: 10.0.0.2:443
+routes:
+  - method_prefix: /users.
+    metadata:
+      x-env: canary
+    backend: users
+    credentials:
+      metadata:
+        x-api-key: k
+    metadata_limits:
+      max_value_length: -1
+metadata_limits:
+  max_size: 16384
+  max_keys: 64
+`))
+	require.NoError(t, err)
+	require.Len(t, cfg.Backends, 1)
+	assert.Equal(t, "weighted", cfg.Backends[0].Balancer)
+	assert.Equal(t, 3, cfg.Backends[0].Endpoints[0].Weight)
+	assert.Equal(t, "session-id", cfg.Backends[0].Affinity.MetadataKey)
+	assert.Equal(t, 30*time.Second, cfg.Backends[0].Keepalive.Time)
+	assert.Equal(t, 5*time.Second, cfg.Backends[0].MaxReconnectBackoff)
+	assert.Equal(t, &config.Network{SourceAddress: "10.0.0.100", DSCP: 46}, cfg.Backends[0].Network)
+	assert.Equal(t, "canary", cfg.Routes[0].Metadata["x-env"])
+	assert.Equal(t, "k", cfg.Routes[0].Credentials.Metadata["x-api-key"])
+	assert.Equal(t, -1, cfg.Routes[0].MetadataLimits.MaxValueLength)
+	assert.Equal(t, &config.MetadataLimits{MaxSize: 16384, MaxKeys: 64}, cfg.MetadataLimits)
+
+	_, err = config.Parse([]byte(`{"backends": [{"name": "a", "endpoints": [{"address": "a:1"}]}], "routes": [{"backend": "a"}]}`))
+	assert.NoError(t, err, "JSON is accepted")
+
+	cfg, err = config.Parse([]byte(`
+backends:
+  - name: stable
+    endpoints: [{address: 10.0.0.1:443}]
+  - name: canary
+    endpoints: [{address: 10.0.0.2:443}]
+routes:
+  - name: users
+    split:
+      - {backend: stable, weight: 95}
+      - {backend: canary, weight: 5}
+    method_splits:
+      /users.UserService/Delete: [{backend: stable, weight: 1}]
+`))
+	require.NoError(t, err)
+	assert.Equal(t, []config.BackendWeight{{Backend: "stable", Weight: 95}, {Backend: "canary", Weight: 5}}, cfg.Routes[0].Split)
+	assert.Len(t, cfg.Routes[0].MethodSplits["/users.UserService/Delete"], 1)
+}
+
+func TestValidate(t *testing.T) {
+	tests := map[string]string{
+		"unnamed backend":   `{"backends": [{"endpoints": [{"address": "a:1"}]}]}`,
+		"duplicate backend": `{"backends": [{"name": "a", "endpoints": [{"address": "a:1"}]}, {"name": "a", "endpoints": [{"address": "a:1"}]}]}`,
+		"no endpoints":      `{"backends": [{"name": "a"}]}`,
+		"bad balancer":      `{"backends": [{"name": "a", "balancer": "random", "endpoints": [{"address": "a:1"}]}]}`,
+		"empty affinity":    `{"backends": [{"name": "a", "affinity": {}, "endpoints": [{"address": "a:1"}]}]}`,
+		"missing ca":        `{"backends": [{"name": "a", "tls": {"ca_file": "/nonexistent"}, "endpoints": [{"address": "a:1"}]}]}`,
+		"tls and alts":      `{"backends": [{"name": "a", "tls": {}, "alts": {}, "endpoints": [{"address": "a:1"}]}]}`,
+		"unknown backend":   `{"routes": [{"backend": "a"}]}`,
+		"unknown split":     `{"backends": [{"name": "a", "endpoints": [{"address": "a:1"}]}], "routes": [{"split": [{"backend": "b", "weight": 1}]}]}`,
+		"negative split":    `{"backends": [{"name": "a", "endpoints": [{"address": "a:1"}]}], "routes": [{"split": [{"backend": "a", "weight": -1}]}]}`,
+		"negative backoff":  `{"backends": [{"name": "a", "max_reconnect_backoff": "-1s", "endpoints": [{"address": "a:1"}]}]}`,
+		"bad dscp":          `{"backends": [{"name": "a", "network": {"dscp": 64}, "endpoints": [{"address": "a:1"}]}]}`,
+		"bad upstream":      `{"backends": [{"name": "a", "upstream_proxy": "ftp://egress", "endpoints": [{"address": "a:1"}]}]}`,
+		"empty credentials": `{"backends": [{"name": "a", "endpoints": [{"address": "a:1"}]}], "routes": [{"backend": "a", "credentials": {}}]}`,
+		"negative limit":    `{"metadata_limits": {"max_keys": -1}}`,
+		"malformed":         `{"backends": [`,
+	}
+	for name, data := range tests {
+		_, err := config.Parse([]byte(data))
+		assert.Error(t, err, name)
+	}
+}
@@ -0,0 +1,13 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+/*
+Package config loads the routes and backends of a proxy.Router from a file.
+
+A Manager applies configurations to its Router, keeping the connections of
+unchanged backends and draining those of removed ones. It can watch the
+configuration file and apply changes as they are made. A configuration which
+fails validation is never applied, the previous one stays in use.
+*/
+package config
@@ -0,0 +1,409 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// Manager applies configurations to a proxy.Router.
+type Manager struct {
+	// DrainTimeout bounds how long connections of removed backends are kept
+	// open for their in-flight calls. If zero, they are kept for a minute.
+	DrainTimeout time.Duration
+	// DialOptions are used for all backend connections.
+	DialOptions []grpc.DialOption
+	// UpstreamProxy, if set, is used for the backends without their own
+	// upstream_proxy.
+	UpstreamProxy *proxy.UpstreamProxy
+	// TransportCredentials are the credentials which backends may refer to
+	// by name with transport_credentials, such as those of a service mesh.
+	TransportCredentials map[string]credentials.TransportCredentials
+
+	router *proxy.Router
+
+	mu       sync.Mutex
+	backends map[string]*backend
+	applied  []byte
+	loaded   bool
+	loadErr  error
+}
+
+// backend holds the connections of a configured backend.
+type backend struct {
+	spec     Backend
+	conns    []*grpc.ClientConn
+	balancer *trackingBalancer
+}
+
+// NewManager returns a Manager with an empty Router.
+func NewManager() *Manager {
+	return &Manager{router: proxy.NewRouter(), backends: make(map[string]*backend)}
+}
+
+// Router returns the Router configured by m. Use its Direct method as the
+// director of the proxy.
+func (m *Manager) Router() *proxy.Router {
+	return m.router
+}
+
+// Apply validates cfg and swaps it in. Backends whose configuration did not
+// change keep their connections. Connections of removed or changed backends
+// are closed once their in-flight calls are done, or after DrainTimeout.
+func (m *Manager) Apply(cfg *Config) error {
+	err := m.apply(cfg)
+	m.recordLoad(err)
+	return err
+}
+
+func (m *Manager) apply(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	next := make(map[string]*backend, len(cfg.Backends))
+	for _, spec := range cfg.Backends {
+		if old, ok := m.backends[spec.Name]; ok && reflect.DeepEqual(old.spec, spec) {
+			next[spec.Name] = old
+			continue
+		}
+		b, err := m.dial(spec)
+		if err != nil {
+			for name, b := range next {
+				if m.backends[name] != b {
+					b.close()
+				}
+			}
+			return err
+		}
+		next[spec.Name] = b
+	}
+
+	routes := make([]proxy.Route, len(cfg.Routes))
+	for i, r := range cfg.Routes {
+		routes[i] = proxy.Route{
+			Name:         r.Name,
+			MethodPrefix: r.MethodPrefix,
+			Authority:    r.Authority,
+			Metadata:     r.Metadata,
+			Backend:      r.Backend,
+			Split:        split(r.Split),
+		}
+		if limits := r.MetadataLimits.limits().Merge(cfg.MetadataLimits.limits()); limits != (proxy.MetadataLimits{}) {
+			routes[i].MetadataLimits = limits
+		}
+		if r.Credentials != nil {
+			routes[i].Credentials = proxy.StaticCredentials{Metadata: r.Credentials.Metadata, AllowInsecure: r.Credentials.AllowInsecure}
+		}
+		for prefix, s := range r.MethodSplits {
+			if routes[i].MethodSplits == nil {
+				routes[i].MethodSplits = make(map[string][]proxy.BackendWeight)
+			}
+			routes[i].MethodSplits[prefix] = split(s)
+		}
+	}
+	balancers := make(map[string]proxy.Balancer, len(next))
+	for name, b := range next {
+		balancers[name] = b.balancer
+	}
+	m.router.Replace(routes, balancers)
+
+	for name, old := range m.backends {
+		if next[name] != old {
+			go old.drain(m.drainTimeout())
+		}
+	}
+	m.backends = next
+	return nil
+}
+
+// LoadStatus reports whether a configuration has been applied, and the
+// error of the latest load, apply or Watch check if it failed. A failed
+// reload leaves the previous configuration in place, so the proxy may be
+// serving even though err is not nil.
+func (m *Manager) LoadStatus() (loaded bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.loaded, m.loadErr
+}
+
+func (m *Manager) recordLoad(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err == nil {
+		m.loaded = true
+	}
+	m.loadErr = err
+}
+
+func split(weights []BackendWeight) []proxy.BackendWeight {
+	if len(weights) == 0 {
+		return nil
+	}
+	out := make([]proxy.BackendWeight, len(weights))
+	for i, bw := range weights {
+		out[i] = proxy.BackendWeight{Backend: bw.Backend, Weight: bw.Weight}
+	}
+	return out
+}
+
+func (m *Manager) drainTimeout() time.Duration {
+	if m.DrainTimeout > 0 {
+		return m.DrainTimeout
+	}
+	return time.Minute
+}
+
+func (m *Manager) dial(spec Backend) (*backend, error) {
+	bc := proxy.BackendConfig{
+		Authority:           spec.Authority,
+		MaxReconnectBackoff: spec.MaxReconnectBackoff,
+		DialOptions:         m.DialOptions,
+	}
+	if spec.Keepalive != nil {
+		bc.Keepalive = spec.Keepalive.params()
+	}
+	if n := spec.Network; n != nil {
+		bc.TCP = &proxy.TCPDialConfig{LocalAddr: n.SourceAddress, Interface: n.Interface, DSCP: n.DSCP, Mark: n.Mark}
+	}
+	bc.UpstreamProxy = m.UpstreamProxy
+	if spec.UpstreamProxy != "" {
+		up, err := proxy.ParseUpstreamProxy(spec.UpstreamProxy)
+		if err != nil {
+			return nil, fmt.Errorf("backend %q: %v", spec.Name, err)
+		}
+		bc.UpstreamProxy = up
+	}
+	if spec.TLS != nil {
+		creds, err := spec.TLS.credentials()
+		if err != nil {
+			return nil, fmt.Errorf("backend %q: %v", spec.Name, err)
+		}
+		bc.Credentials = creds
+	}
+	if spec.ALTS != nil {
+		bc.Credentials = spec.ALTS.credentials()
+	}
+	if name := spec.TransportCredentials; name != "" {
+		creds, ok := m.TransportCredentials[name]
+		if !ok {
+			return nil, fmt.Errorf("backend %q: unknown transport credentials %q", spec.Name, name)
+		}
+		bc.Credentials = creds
+	}
+	b := &backend{spec: spec}
+	var endpoints []proxy.Endpoint
+	for _, ep := range spec.Endpoints {
+		bc.Address = ep.Address
+		conn, err := bc.Dial()
+		if err != nil {
+			b.close()
+			return nil, fmt.Errorf("backend %q: failed to dial %s: %v", spec.Name, ep.Address, err)
+		}
+		b.conns = append(b.conns, conn)
+		endpoints = append(endpoints, proxy.Endpoint{Conn: conn, Weight: ep.Weight})
+	}
+	var balancer proxy.Balancer
+	switch spec.Balancer {
+	case "least_streams":
+		balancer = proxy.NewLeastStreamsBalancer(endpoints...)
+	case "weighted":
+		balancer = proxy.NewWeightedBalancer(endpoints...)
+	case "ring_hash":
+		balancer = proxy.NewRingHashBalancer(endpoints...)
+	case "maglev":
+		balancer = proxy.NewMaglevBalancer(endpoints...)
+	default:
+		balancer = proxy.NewRoundRobinBalancer(endpoints...)
+	}
+	if a := spec.Affinity; a != nil {
+		balancer = proxy.NewAffinityBalancer(balancer, proxy.AffinityConfig{MetadataKey: a.MetadataKey, Claim: a.Claim})
+		balancer.Update(endpoints)
+	}
+	b.balancer = &trackingBalancer{Balancer: balancer}
+	return b, nil
+}
+
+// LoadFile loads the configuration at path and applies it.
+func (m *Manager) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		m.recordLoad(err)
+		return err
+	}
+	return m.applyData(path, data)
+}
+
+func (m *Manager) applyData(path string, data []byte) error {
+	cfg, err := Parse(data)
+	if err != nil {
+		err = fmt.Errorf("%s: %v", path, err)
+		m.recordLoad(err)
+		return err
+	}
+	if err := m.Apply(cfg); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	m.mu.Lock()
+	m.applied = data
+	m.mu.Unlock()
+	return nil
+}
+
+// Watch checks the file at path every interval and applies its contents
+// when they change, until ctx is done. Errors, including configurations
+// which fail validation, are passed to onError if it is not nil, and leave
+// the current configuration in place.
+//
+// Watch does not load the file up front, use LoadFile for that.
+func (m *Manager) Watch(ctx context.Context, path string, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var lastMod time.Time
+	var lastSize int64 = -1
+	var lastErr []byte
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			m.recordLoad(err)
+			if onError != nil {
+				onError(err)
+			}
+			continue
+		}
+		if fi.ModTime().Equal(lastMod) && fi.Size() == lastSize {
+			continue
+		}
+		lastMod, lastSize = fi.ModTime(), fi.Size()
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			m.recordLoad(err)
+			if onError != nil {
+				onError(err)
+			}
+			continue
+		}
+		m.mu.Lock()
+		same := bytes.Equal(data, m.applied)
+		m.mu.Unlock()
+		if same {
+			// Back to the applied configuration.
+			m.recordLoad(nil)
+			continue
+		}
+		if bytes.Equal(data, lastErr) {
+			continue
+		}
+		lastErr = nil
+		if err := m.applyData(path, data); err != nil {
+			lastErr = data
+			if onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// Close closes all backend connections.
+func (m *Manager) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.router.Replace(nil, nil)
+	for _, b := range m.backends {
+		b.close()
+	}
+	m.backends = make(map[string]*backend)
+}
+
+func (b *backend) close() {
+	for _, conn := range b.conns {
+		conn.Close()
+	}
+}
+
+// drain closes the connections once the in-flight calls are done, or after
+// timeout.
+func (b *backend) drain(timeout time.Duration) {
+	select {
+	case <-b.balancer.idle():
+	case <-time.After(timeout):
+	}
+	b.close()
+}
+
+// trackingBalancer counts the in-flight calls of a balancer.
+type trackingBalancer struct {
+	proxy.Balancer
+
+	mu       sync.Mutex
+	inflight int
+	idleCh   chan struct{}
+}
+
+func (b *trackingBalancer) Pick(ctx context.Context, method string) (*grpc.ClientConn, func(error), error) {
+	conn, done, err := b.Balancer.Pick(ctx, method)
+	if err != nil {
+		return nil, nil, err
+	}
+	b.mu.Lock()
+	b.inflight++
+	b.mu.Unlock()
+	var once sync.Once
+	return conn, func(err error) {
+		once.Do(func() {
+			if done != nil {
+				done(err)
+			}
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.inflight--
+			if b.inflight == 0 && b.idleCh != nil {
+				close(b.idleCh)
+				b.idleCh = nil
+			}
+		})
+	}, nil
+}
+
+// idle returns a channel which is closed once there are no calls in flight.
+func (b *trackingBalancer) idle() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan struct{})
+	if b.inflight == 0 {
+		close(ch)
+		return ch
+	}
+	if b.idleCh == nil {
+		b.idleCh = ch
+	}
+	return b.idleCh
+}
+
+// Status implements proxy.StatusReporter for the wrapped balancer.
+func (b *trackingBalancer) Status() []proxy.EndpointStatus {
+	if r, ok := b.Balancer.(proxy.StatusReporter); ok {
+		return r.Status()
+	}
+	return nil
+}
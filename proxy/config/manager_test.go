@@ -0,0 +1,192 @@
+package config_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/mkxxx/grpc-proxy/proxy/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// namedService answers pings with its name.
+type namedService struct {
+	pb.TestServiceServer
+	name string
+}
+
+func (s *namedService) Ping(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+	return &pb.PingResponse{Value: s.name}, nil
+}
+
+func startBackend(t *testing.T, name string) (*grpc.Server, string) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	pb.RegisterTestServiceServer(server, &namedService{name: name})
+	go server.Serve(lis)
+	return server, lis.Addr().String()
+}
+
+func startProxy(t *testing.T, m *config.Manager) (*grpc.Server, pb.TestServiceClient) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer(
+		proxy.ServerOption(),
+		grpc.UnknownServiceHandler(proxy.TransparentHandler(m.Router().Direct)),
+	)
+	go server.Serve(lis)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	return server, pb.NewTestServiceClient(conn)
+}
+
+func routeTo(name, addr string) string {
+	return fmt.Sprintf(`
+backends:
+  - name: %s
+    endpoints:
+      - address: %s
+routes:
+  - backend: %s
+`, name, addr, name)
+}
+
+func TestManagerWatch(t *testing.T) {
+	blue, blueAddr := startBackend(t, "blue")
+	defer blue.Stop()
+	green, greenAddr := startBackend(t, "green")
+	defer green.Stop()
+
+	dir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxy.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(routeTo("blue", blueAddr)), 0644))
+
+	m := config.NewManager()
+	m.DrainTimeout = time.Second
+	defer m.Close()
+	require.NoError(t, m.LoadFile(path))
+	server, client := startProxy(t, m)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ping := func() string {
+		out, err := client.Ping(ctx, &pb.PingRequest{})
+		if err != nil {
+			return status.Code(err).String()
+		}
+		return out.Value
+	}
+	assert.Equal(t, "blue", ping())
+
+	errs := make(chan error, 10)
+	go m.Watch(ctx, path, 10*time.Millisecond, func(err error) { errs <- err })
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(routeTo("green", greenAddr)), 0644))
+	assert.Eventually(t, func() bool { return ping() == "green" }, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("routes:\n  - backend: missing\n"), 0644))
+	select {
+	case err := <-errs:
+		assert.Contains(t, err.Error(), "unknown backend")
+	case <-time.After(5 * time.Second):
+		t.Fatal("broken config was not reported")
+	}
+	assert.Equal(t, "green", ping(), "broken config is not applied")
+	loaded, err := m.LoadStatus()
+	assert.True(t, loaded)
+	assert.Error(t, err, "the failed reload is reported")
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(routeTo("blue", blueAddr)), 0644))
+	assert.Eventually(t, func() bool {
+		_, err := m.LoadStatus()
+		return err == nil && ping() == "blue"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestManagerApply(t *testing.T) {
+	blue, blueAddr := startBackend(t, "blue")
+	defer blue.Stop()
+
+	m := config.NewManager()
+	defer m.Close()
+	cfg, err := config.Parse([]byte(routeTo("blue", blueAddr)))
+	require.NoError(t, err)
+	require.NoError(t, m.Apply(cfg))
+	server, client := startProxy(t, m)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = client.Ping(ctx, &pb.PingRequest{})
+	require.NoError(t, err)
+
+	require.NoError(t, m.Apply(&config.Config{}))
+	_, err = client.Ping(ctx, &pb.PingRequest{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err), "removed routes no longer match")
+}
+
+// countingCreds are transport credentials which count handshakes and leave
+// the connection as is.
+type countingCreds struct {
+	handshakes int32
+}
+
+func (c *countingCreds) ClientHandshake(ctx context.Context, addr string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	atomic.AddInt32(&c.handshakes, 1)
+	return conn, nil, nil
+}
+
+func (c *countingCreds) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return conn, nil, nil
+}
+
+func (c *countingCreds) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "counting"}
+}
+
+func (c *countingCreds) Clone() credentials.TransportCredentials { return c }
+
+func (c *countingCreds) OverrideServerName(string) error { return nil }
+
+func TestManagerTransportCredentials(t *testing.T) {
+	blue, blueAddr := startBackend(t, "blue")
+	defer blue.Stop()
+
+	creds := &countingCreds{}
+	m := config.NewManager()
+	m.TransportCredentials = map[string]credentials.TransportCredentials{"mesh": creds}
+	defer m.Close()
+	cfg, err := config.Parse([]byte(routeTo("blue", blueAddr)))
+	require.NoError(t, err)
+	cfg.Backends[0].TransportCredentials = "mesh"
+	require.NoError(t, m.Apply(cfg))
+	server, client := startProxy(t, m)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = client.Ping(ctx, &pb.PingRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&creds.handshakes), "the named credentials secure the backend")
+
+	cfg.Backends[0].TransportCredentials = "missing"
+	assert.Error(t, m.Apply(cfg), "unknown credentials")
+}
@@ -0,0 +1,258 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Client accesses the Consul HTTP API.
+type Client struct {
+	// Address is the base URL of the agent. If empty,
+	// "http://127.0.0.1:8500" is used.
+	Address string
+	// Token, if set, is sent as the ACL token.
+	Token string
+	// Datacenter, if set, selects the datacenter to query.
+	Datacenter string
+	// HTTPClient is used for requests. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+type serviceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Weights struct {
+			Passing int
+		}
+	}
+}
+
+// health runs a blocking query for the passing instances of service.
+func (c *Client) health(ctx context.Context, service, tag string, index uint64, wait time.Duration) ([]serviceEntry, uint64, error) {
+	base := c.Address
+	if base == "" {
+		base = "http://127.0.0.1:8500"
+	}
+	query := url.Values{"passing": {"true"}}
+	if tag != "" {
+		query.Set("tag", tag)
+	}
+	if c.Datacenter != "" {
+		query.Set("dc", c.Datacenter)
+	}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", fmt.Sprintf("%ds", int(wait/time.Second)))
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(base, "/")+"/v1/health/service/"+url.PathEscape(service)+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, 0, fmt.Errorf("consul error %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var entries []serviceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, fmt.Errorf("invalid consul response: %v", err)
+	}
+	next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	return entries, next, nil
+}
+
+// Discovery keeps a balancer for each Consul service it is asked about,
+// holding the instances which pass their health checks.
+type Discovery struct {
+	// Tag, if set, only uses instances with the tag.
+	Tag string
+	// Dial connects to an instance address. If nil, addresses are dialed
+	// insecurely with the proxy codec.
+	Dial func(address string) (*grpc.ClientConn, error)
+	// NewBalancer returns the balancer of a service. If nil, services are
+	// balanced with proxy.NewWeightedBalancer, using the passing weights
+	// of the instances.
+	NewBalancer func() proxy.Balancer
+	// OnError, if set, is called when a query fails. The instances are
+	// left unchanged until a query succeeds.
+	OnError func(service string, err error)
+	// Wait is the maximum duration of a blocking query. If zero, five
+	// minutes.
+	Wait time.Duration
+	// RetryDelay is the wait before retrying a failed query. If zero, one
+	// second is used.
+	RetryDelay time.Duration
+
+	client *Client
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	services map[string]*service
+	wg       sync.WaitGroup
+}
+
+type service struct {
+	balancer proxy.Balancer
+	pool     *proxy.AddressPool
+	// ready is closed once the first query has succeeded.
+	ready chan struct{}
+}
+
+// New returns a Discovery using c.
+func New(c *Client) *Discovery {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Discovery{client: c, ctx: ctx, cancel: cancel, services: make(map[string]*service)}
+}
+
+// Balancer returns the balancer of the named service, starting to watch
+// the service on first use. Until the first query completes, the balancer
+// has no endpoints.
+func (d *Discovery) Balancer(name string) proxy.Balancer {
+	return d.service(name).balancer
+}
+
+func (d *Discovery) service(name string) *service {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if s, ok := d.services[name]; ok {
+		return s
+	}
+	var b proxy.Balancer
+	if d.NewBalancer != nil {
+		b = d.NewBalancer()
+	} else {
+		b = proxy.NewWeightedBalancer()
+	}
+	s := &service{balancer: b, pool: proxy.NewAddressPool(b), ready: make(chan struct{})}
+	s.pool.Dial = d.dial
+	d.services[name] = s
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.watch(name, s)
+	}()
+	return s
+}
+
+func (d *Discovery) dial(addr string) (*grpc.ClientConn, error) {
+	if d.Dial != nil {
+		return d.Dial(addr)
+	}
+	return (&proxy.BackendConfig{Address: addr}).Dial()
+}
+
+func (d *Discovery) watch(name string, s *service) {
+	defer s.pool.Close()
+	wait := d.Wait
+	if wait <= 0 {
+		wait = 5 * time.Minute
+	}
+	delay := d.RetryDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	var index uint64
+	for d.ctx.Err() == nil {
+		entries, next, err := d.client.health(d.ctx, name, d.Tag, index, wait)
+		if err != nil {
+			if d.ctx.Err() != nil {
+				return
+			}
+			if d.OnError != nil {
+				d.OnError(name, err)
+			}
+			select {
+			case <-d.ctx.Done():
+			case <-time.After(delay):
+			}
+			continue
+		}
+		// Consul's index may go backwards, in which case it must be reset.
+		if next < index {
+			next = 0
+		}
+		index = next
+
+		weights := make(map[string]int, len(entries))
+		for _, e := range entries {
+			host := e.Service.Address
+			if host == "" {
+				host = e.Node.Address
+			}
+			weight := e.Service.Weights.Passing
+			if weight < 1 {
+				weight = 1
+			}
+			weights[net.JoinHostPort(host, strconv.Itoa(e.Service.Port))] = weight
+		}
+		s.pool.Update(weights)
+		select {
+		case <-s.ready:
+		default:
+			close(s.ready)
+		}
+	}
+}
+
+// Director returns a StreamDirector which sends each call to an instance of
+// the service named by pick. Calls made while a service is first looked up
+// wait for the lookup, within their deadline.
+func (d *Discovery) Director(pick func(ctx context.Context, method string) (string, error)) proxy.StreamDirector {
+	return func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+		name, err := pick(ctx, method)
+		if err != nil {
+			return ctx, nil, proxy.Direction{}, err
+		}
+		s := d.service(name)
+		select {
+		case <-s.ready:
+		case <-ctx.Done():
+			return ctx, nil, proxy.Direction{}, status.Errorf(codes.Unavailable, "service %q is not resolved", name)
+		}
+		conn, done, err := s.balancer.Pick(ctx, method)
+		if err != nil {
+			return ctx, nil, proxy.Direction{}, err
+		}
+		return ctx, nil, proxy.Direction{BackendConn: conn, Done: done}, nil
+	}
+}
+
+// Close stops watching all services and closes their connections.
+func (d *Discovery) Close() {
+	d.cancel()
+	d.wg.Wait()
+}
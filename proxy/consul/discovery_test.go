@@ -0,0 +1,132 @@
+package consul_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/mkxxx/grpc-proxy/proxy/consul"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// fakeConsul serves the health endpoint of one service, answering blocking
+// queries when the instances change.
+type fakeConsul struct {
+	mu        sync.Mutex
+	index     int
+	instances []string
+	changed   chan struct{}
+}
+
+func (c *fakeConsul) set(addrs ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.index++
+	c.instances = addrs
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/health/service/users" || r.URL.Query().Get("passing") != "true" {
+		http.NotFound(w, r)
+		return
+	}
+	c.mu.Lock()
+	if strconv.Itoa(c.index) == r.URL.Query().Get("index") {
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+		c.mu.Lock()
+	}
+	var entries []map[string]interface{}
+	for _, addr := range c.instances {
+		host, port, _ := net.SplitHostPort(addr)
+		p, _ := strconv.Atoi(port)
+		entries = append(entries, map[string]interface{}{
+			"Node":    map[string]interface{}{"Address": host},
+			"Service": map[string]interface{}{"Port": p},
+		})
+	}
+	w.Header().Set("X-Consul-Index", strconv.Itoa(c.index))
+	c.mu.Unlock()
+	json.NewEncoder(w).Encode(entries)
+}
+
+type namedService struct {
+	pb.TestServiceServer
+	name string
+}
+
+func (s *namedService) Ping(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+	return &pb.PingResponse{Value: s.name}, nil
+}
+
+func listen(t *testing.T, server *grpc.Server) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(lis)
+	return lis.Addr().String()
+}
+
+func TestDiscovery(t *testing.T) {
+	blue := grpc.NewServer()
+	pb.RegisterTestServiceServer(blue, &namedService{name: "blue"})
+	blueAddr := listen(t, blue)
+	defer blue.Stop()
+	green := grpc.NewServer()
+	pb.RegisterTestServiceServer(green, &namedService{name: "green"})
+	greenAddr := listen(t, green)
+	defer green.Stop()
+
+	fake := &fakeConsul{changed: make(chan struct{})}
+	fake.set(blueAddr)
+	api := httptest.NewServer(fake)
+	defer api.Close()
+
+	d := consul.New(&consul.Client{Address: api.URL})
+	defer d.Close()
+	director := d.Director(func(ctx context.Context, method string) (string, error) {
+		return "users", nil
+	})
+	proxySrv := grpc.NewServer(
+		proxy.ServerOption(),
+		grpc.UnknownServiceHandler(proxy.TransparentHandler(director)),
+	)
+	proxyAddr := listen(t, proxySrv)
+	defer proxySrv.Stop()
+	conn, err := grpc.Dial(proxyAddr, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	client := pb.NewTestServiceClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ping := func() string {
+		out, err := client.Ping(ctx, &pb.PingRequest{})
+		if err != nil {
+			return err.Error()
+		}
+		return out.Value
+	}
+	assert.Equal(t, "blue", ping(), "the first call waits for the service lookup")
+
+	fake.set(greenAddr)
+	assert.Eventually(t, func() bool { return ping() == "green" }, 5*time.Second, 10*time.Millisecond,
+		"blocking queries pick up instance changes")
+}
@@ -0,0 +1,12 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+/*
+Package consul discovers proxy backends from the Consul health API.
+
+A Discovery maintains the passing instances of each service it is asked
+about using blocking queries, so directors can refer to backends by their
+logical Consul service name.
+*/
+package consul
@@ -6,58 +6,126 @@ package proxy
 
 import (
 	"io"
+	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // biDirCopy connects an incoming ServerStream with an outgoing ClientStream.
 // This acts as a middleman, passing messages from streams in both directions.
-func biDirCopy(in grpc.ServerStream, out grpc.ClientStream) error {
-	done := make(chan error)
+//
+// The copy completes as soon as the backend has finished, even if the client
+// is still sending. If forwarding from the client fails, abort is called to
+// cancel the backend call instead of waiting for the backend to finish on its
+// own.
+//
+// When the backend finishes first, the copy from the client may still be
+// blocked in in.RecvMsg after biDirCopy returns, until grpc ends the stream
+// along with the handler. Streams not served by grpc, and wrappers of in,
+// must therefore allow RecvMsg to run after the handler has returned, without
+// touching state which does not outlive the call.
+//
+// Messages are copied in each direction as configured by flow, and the
+// half-close of the client is passed on as configured by hc, which may be
+// nil. The copy goroutines are tracked by leaks, which may be nil too.
+func biDirCopy(in grpc.ServerStream, out grpc.ClientStream, abort func(), flow flowControls, hc *HalfClosePolicy, leaks *leakStream) error {
+	outDone := make(chan error, 1)
+	inDone := make(chan error, 1)
+	deferClose := hc != nil && hc.Defer
+	leaks.enter(ClientToBackend)
 	go func() {
-		done <- forwardIn(in, out)
+		defer leaks.exit(ClientToBackend)
+		defer recoverTo(outDone, panicInClientToBackend)
+		outDone <- forwardOut(in, out, flow[ClientToBackend], deferClose)
 	}()
-	err := forwardOut(in, out)
-	err2 := <-done
-	if err != io.EOF {
+	leaks.enter(BackendToClient)
+	go func() {
+		defer leaks.exit(BackendToClient)
+		defer recoverTo(inDone, panicInBackendToClient)
+		inDone <- forwardIn(in, out, flow[BackendToClient])
+	}()
+
+	select {
+	case err := <-inDone:
 		return err
+	case err := <-outDone:
+		if err != io.EOF {
+			abort()
+			<-inDone
+			return err
+		}
+		if hc == nil || hc.Timeout <= 0 {
+			return <-inDone
+		}
+		timer := time.NewTimer(hc.Timeout)
+		defer timer.Stop()
+		select {
+		case err := <-inDone:
+			return err
+		case <-timer.C:
+			abort()
+			<-inDone
+			return status.Errorf(codes.DeadlineExceeded, "backend did not finish within %v after the client half-closed", hc.Timeout)
+		}
 	}
-	return err2
 }
 
-// forward from input to destination.
-func forwardOut(in grpc.ServerStream, out grpc.ClientStream) error {
-	err := copyStream(in, out)
-	err2 := out.CloseSend()
+// forward from input to destination. The destination is half-closed at the
+// end of the input, unless deferClose is set.
+func forwardOut(in grpc.ServerStream, out grpc.ClientStream, fc *FlowControl, deferClose bool) error {
+	err := fc.copyStream(in, out)
+	var err2 error
+	if err != io.EOF || !deferClose {
+		err2 = out.CloseSend()
+	}
 
 	switch err {
 	case io.EOF:
 		return err
 	case nil:
-		return err2
+		if err2 != nil {
+			return newStreamError(ErrForwardClientToBackend, "", err2)
+		}
+		return nil
 	default:
-		return grpc.Errorf(codes.Internal, "failed proxying s2c: %s", err)
+		return newStreamError(ErrForwardClientToBackend, "", err)
 	}
 }
 
 // forward from output back to caller.
-func forwardIn(in grpc.ServerStream, out grpc.ClientStream) error {
-	// Forward header first.
+func forwardIn(in grpc.ServerStream, out grpc.ClientStream, fc *FlowControl) error {
+	// Forward header first. A backend which fails without sending headers
+	// may still have sent trailers, which must reach the client.
 	md, err := out.Header()
 	if err != nil {
+		in.SetTrailer(out.Trailer())
 		return err
 	}
 	if err := in.SendHeader(md); err != nil {
-		return err
+		return newStreamError(ErrForwardBackendToClient, "", err)
 	}
 
-	err = copyStream(out, in)
+	err = fc.copyStream(out, clientSender{in})
 	in.SetTrailer(out.Trailer())
 
 	return err
 }
 
+// clientSender wraps the errors of sending messages to the client, to tell
+// them from the status of the backend.
+type clientSender struct {
+	grpc.ServerStream
+}
+
+func (s clientSender) SendMsg(m interface{}) error {
+	if err := s.ServerStream.SendMsg(m); err != nil {
+		return newStreamError(ErrForwardBackendToClient, "", err)
+	}
+	return nil
+}
+
 func copyStream(src grpc.Stream, dst grpc.Stream) error {
 	var f frame
 	for {
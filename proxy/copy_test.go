@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"errors"
 	"io"
 	"testing"
 	"time"
@@ -8,7 +9,9 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
 	metadata "google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 func TestBiDirCopy_ClientEOF(t *testing.T) {
@@ -28,12 +31,16 @@ func TestBiDirCopy_ClientEOF(t *testing.T) {
 		assert.EqualValues(t, header, md)
 	}).Return(nil).Once()
 
+	closed := make(chan time.Time)
+
 	// Client immediately sends EOF.
 	req.On("RecvMsg", mock.AnythingOfType("*proxy.frame")).Return(io.EOF).Once()
-	dest.On("CloseSend").Return(nil).Once()
+	dest.On("CloseSend").Run(func(args mock.Arguments) {
+		close(closed)
+	}).Return(nil).Once()
 
-	// Server message is forwarded to client.
-	dest.On("RecvMsg", mock.AnythingOfType("*proxy.frame")).Run(func(args mock.Arguments) {
+	// Server message is forwarded to client, once the client side is closed.
+	dest.On("RecvMsg", mock.AnythingOfType("*proxy.frame")).WaitUntil(closed).Run(func(args mock.Arguments) {
 		frame := args.Get(0).(*frame)
 		frame.payload = []byte{0x01, 0x02}
 	}).Return(nil).Once()
@@ -50,7 +57,7 @@ func TestBiDirCopy_ClientEOF(t *testing.T) {
 		assert.EqualValues(t, trailer, md)
 	}).Return(nil).Once()
 
-	err := biDirCopy(req, dest)
+	err := biDirCopy(req, dest, func() {}, flowControls{}, nil, nil)
 	require.EqualError(t, err, io.EOF.Error())
 
 	req.AssertExpectations(t)
@@ -85,9 +92,41 @@ func TestBiDirCopy_ClientFail(t *testing.T) {
 	dest.On("Trailer").Return(trailer, nil).Once()
 	req.On("SetTrailer", mock.AnythingOfType("metadata.MD")).Return(nil).Once()
 
-	err := biDirCopy(req, dest)
+	err := biDirCopy(req, dest, func() {}, flowControls{}, nil, nil)
 	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrForwardClientToBackend))
+	assert.True(t, errors.Is(err, io.ErrNoProgress), "the cause is wrapped")
+	assert.Equal(t, codes.Internal, status.Code(err))
 
 	req.AssertExpectations(t)
 	dest.AssertExpectations(t)
 }
+
+func TestBiDirCopy_SendToClientFail(t *testing.T) {
+	req := &ServerStream{}  // requestor side
+	dest := &ClientStream{} // dest side
+
+	dest.On("Header").Return(metadata.MD{}, nil).Once()
+	req.On("SendHeader", mock.AnythingOfType("metadata.MD")).Return(nil).Once()
+
+	// The client sends nothing until the backend call is aborted.
+	aborted := make(chan time.Time)
+	req.On("RecvMsg", mock.AnythingOfType("*proxy.frame")).WaitUntil(aborted).Return(status.Error(codes.Canceled, "aborted")).Once()
+	dest.On("CloseSend").Return(nil).Once()
+
+	// Sending the response to the client fails.
+	dest.On("RecvMsg", mock.AnythingOfType("*proxy.frame")).Return(nil).Once()
+	req.On("SendMsg", mock.AnythingOfType("*proxy.frame")).Return(io.ErrClosedPipe).Once()
+	dest.On("Trailer").Return(metadata.MD{}, nil).Once()
+	req.On("SetTrailer", mock.AnythingOfType("metadata.MD")).Return(nil).Once()
+
+	err := biDirCopy(req, dest, func() {}, flowControls{}, nil, nil)
+	close(aborted)
+	require.Error(t, err)
+	var streamErr *StreamError
+	require.True(t, errors.As(err, &streamErr))
+	assert.Equal(t, ErrForwardBackendToClient, streamErr.Kind)
+	assert.Equal(t, BackendToClient, streamErr.Direction)
+	assert.Equal(t, io.ErrClosedPipe, streamErr.Err)
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
@@ -0,0 +1,172 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Token is a credential for calls to backends, such as an OAuth2 access
+// token.
+type Token struct {
+	AccessToken string
+
+	// TokenType is the authorization scheme. Defaults to "Bearer".
+	TokenType string
+
+	// Expiry is when the token expires. The zero time means never.
+	Expiry time.Time
+}
+
+// TokenSource returns tokens for calls to backends.
+type TokenSource interface {
+	Token(ctx context.Context) (*Token, error)
+}
+
+// TokenSourceFunc is an adapter allowing the use of ordinary functions as a
+// TokenSource.
+type TokenSourceFunc func(ctx context.Context) (*Token, error)
+
+// Token calls f(ctx).
+func (f TokenSourceFunc) Token(ctx context.Context) (*Token, error) {
+	return f(ctx)
+}
+
+// TokenCredentials are PerRPCCredentials sending the tokens of a TokenSource
+// as authorization metadata. Tokens are cached until shortly before they
+// expire, and concurrent calls wait for a single refresh.
+type TokenCredentials struct {
+	source TokenSource
+
+	// RefreshMargin is how long before its expiry a token is refreshed.
+	// Until it expires, a token is still used if the refresh fails.
+	// Defaults to 30 seconds.
+	RefreshMargin time.Duration
+
+	// AllowInsecure sends tokens to backends over insecure connections.
+	AllowInsecure bool
+
+	mu    sync.Mutex
+	token *Token
+}
+
+var _ credentials.PerRPCCredentials = (*TokenCredentials)(nil)
+
+// NewTokenCredentials returns TokenCredentials for the tokens of src.
+func NewTokenCredentials(src TokenSource) *TokenCredentials {
+	return &TokenCredentials{source: src, RefreshMargin: 30 * time.Second}
+}
+
+// GetRequestMetadata implements credentials.PerRPCCredentials.
+func (c *TokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	tok, err := c.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	typ := tok.TokenType
+	if typ == "" {
+		typ = "Bearer"
+	}
+	return map[string]string{"authorization": typ + " " + tok.AccessToken}, nil
+}
+
+// RequireTransportSecurity implements credentials.PerRPCCredentials.
+func (c *TokenCredentials) RequireTransportSecurity() bool {
+	return !c.AllowInsecure
+}
+
+// Token returns the cached token, refreshing it if needed.
+func (c *TokenCredentials) Token(ctx context.Context) (*Token, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if c.token != nil && (c.token.Expiry.IsZero() || now.Add(c.RefreshMargin).Before(c.token.Expiry)) {
+		return c.token, nil
+	}
+	tok, err := c.source.Token(ctx)
+	if err != nil {
+		if c.token != nil && now.Before(c.token.Expiry) {
+			return c.token, nil
+		}
+		return nil, err
+	}
+	c.token = tok
+	return tok, nil
+}
+
+// StaticCredentials are PerRPCCredentials sending fixed metadata, such as an
+// API key.
+type StaticCredentials struct {
+	Metadata map[string]string
+
+	// AllowInsecure sends the metadata to backends over insecure
+	// connections.
+	AllowInsecure bool
+}
+
+var _ credentials.PerRPCCredentials = StaticCredentials{}
+
+// GetRequestMetadata implements credentials.PerRPCCredentials.
+func (c StaticCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return c.Metadata, nil
+}
+
+// RequireTransportSecurity implements credentials.PerRPCCredentials.
+func (c StaticCredentials) RequireTransportSecurity() bool {
+	return !c.AllowInsecure
+}
+
+// applyCredentials fetches the metadata of creds for a backend call. The
+// forwarded client metadata with the same keys, such as the authorization of
+// the client, is removed, and the returned call option sends the fetched
+// metadata, enforcing the transport security required by creds.
+func applyCredentials(ctx context.Context, creds credentials.PerRPCCredentials, conn *grpc.ClientConn, method string) (context.Context, grpc.CallOption, error) {
+	uri := "https://"
+	if conn != nil {
+		uri += conn.Target()
+	}
+	if i := strings.LastIndex(method, "/"); i > 0 {
+		uri += method[:i]
+	}
+	values, err := creds.GetRequestMetadata(ctx, uri)
+	if err != nil {
+		if _, ok := status.FromError(err); !ok {
+			err = status.Errorf(codes.Unavailable, "failed to get backend credentials: %v", err)
+		}
+		return ctx, nil, err
+	}
+	if md, ok := metadata.FromOutgoingContext(ctx); ok {
+		md = md.Copy()
+		for k := range values {
+			delete(md, strings.ToLower(k))
+		}
+		ctx = metadata.NewOutgoingContext(ctx, md)
+	}
+	fetched := fetchedCredentials{values: values, secure: creds.RequireTransportSecurity()}
+	return ctx, grpc.PerRPCCredentials(fetched), nil
+}
+
+// fetchedCredentials send metadata fetched before the call.
+type fetchedCredentials struct {
+	values map[string]string
+	secure bool
+}
+
+func (c fetchedCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return c.values, nil
+}
+
+func (c fetchedCredentials) RequireTransportSecurity() bool {
+	return c.secure
+}
@@ -0,0 +1,126 @@
+package proxy_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestTokenCredentials(t *testing.T) {
+	var calls int32
+	var fail atomic.Value
+	fail.Store(false)
+	expiry := time.Now().Add(time.Hour)
+	creds := proxy.NewTokenCredentials(proxy.TokenSourceFunc(func(ctx context.Context) (*proxy.Token, error) {
+		n := atomic.AddInt32(&calls, 1)
+		if fail.Load().(bool) {
+			return nil, errors.New("token endpoint is down")
+		}
+		return &proxy.Token{AccessToken: string('a' + rune(n-1)), Expiry: expiry}, nil
+	}))
+	assert.True(t, creds.RequireTransportSecurity())
+
+	md, err := creds.GetRequestMetadata(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"authorization": "Bearer a"}, md)
+	md, err = creds.GetRequestMetadata(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer a", md["authorization"], "tokens are cached")
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+
+	creds.RefreshMargin = 2 * time.Hour
+	md, err = creds.GetRequestMetadata(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer b", md["authorization"], "tokens are refreshed ahead of expiry")
+
+	fail.Store(true)
+	md, err = creds.GetRequestMetadata(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer b", md["authorization"], "valid tokens are used if the refresh fails")
+
+	expiry = time.Now().Add(-time.Second)
+	fail.Store(false)
+	_, err = creds.GetRequestMetadata(context.Background())
+	require.NoError(t, err)
+	fail.Store(true)
+	_, err = creds.GetRequestMetadata(context.Background())
+	assert.Error(t, err, "expired tokens are not used")
+}
+
+// authorizationService returns the authorization metadata of calls.
+func authorizationService() *pingService {
+	return &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			md, _ := metadata.FromIncomingContext(ctx)
+			values := md.Get("authorization")
+			if len(values) != 1 {
+				return nil, status.Errorf(codes.InvalidArgument, "got authorization %q", values)
+			}
+			return &pb.PingResponse{Value: values[0]}, nil
+		},
+	}
+}
+
+func TestDirection_Credentials(t *testing.T) {
+	creds := proxy.StaticCredentials{Metadata: map[string]string{"authorization": "Bearer backend"}}
+	mkDirector := func(backend *grpc.ClientConn) proxy.StreamDirector {
+		return func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+			c := creds
+			md, _ := metadata.FromIncomingContext(ctx)
+			c.AllowInsecure = len(md.Get("x-insecure")) != 0
+			return ctx, nil, proxy.Direction{BackendConn: backend, Credentials: c}, nil
+		}
+	}
+	env := newTestEnvWithDirector(t, authorizationService(), mkDirector)
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer client")
+
+	out, err := env.client.Ping(metadata.AppendToOutgoingContext(ctx, "x-insecure", "1"), &pb.PingRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer backend", out.Value, "the client credentials are replaced")
+
+	_, err = env.client.Ping(ctx, &pb.PingRequest{})
+	assert.Error(t, err, "credentials are not sent over insecure connections")
+}
+
+func TestRoute_Credentials(t *testing.T) {
+	failing := proxy.NewTokenCredentials(proxy.TokenSourceFunc(func(ctx context.Context) (*proxy.Token, error) {
+		return nil, errors.New("token endpoint is down")
+	}))
+	failing.AllowInsecure = true
+	mkDirector := func(backend *grpc.ClientConn) proxy.StreamDirector {
+		router := proxy.NewRouter()
+		router.AddBackend("b", backend)
+		router.AddRoute(proxy.Route{Metadata: map[string]string{"x-route": "failing"}, Backend: "b", Credentials: failing})
+		router.AddRoute(proxy.Route{Backend: "b", Credentials: proxy.StaticCredentials{
+			Metadata:      map[string]string{"authorization": "ApiKey k"},
+			AllowInsecure: true,
+		}})
+		return router.Direct
+	}
+	env := newTestEnvWithDirector(t, authorizationService(), mkDirector)
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	out, err := env.client.Ping(ctx, &pb.PingRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, "ApiKey k", out.Value)
+
+	_, err = env.client.Ping(metadata.AppendToOutgoingContext(ctx, "x-route", "failing"), &pb.PingRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
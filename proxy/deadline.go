@@ -0,0 +1,88 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"time"
+)
+
+// DeadlinePolicy controls the deadline of backend calls. By default the
+// backend call inherits the deadline sent by the client, if any.
+type DeadlinePolicy struct {
+	// DefaultTimeout is applied to backend calls when the client did not
+	// send a deadline.
+	DefaultTimeout time.Duration
+
+	// MaxTimeout caps the time allowed for backend calls, whatever the
+	// client asked for.
+	MaxTimeout time.Duration
+
+	// StripIncoming stops the client deadline from being forwarded to the
+	// backend. The backend call is still cancelled when the client stream
+	// ends.
+	StripIncoming bool
+
+	// HopBudget is subtracted from the client deadline forwarded to the
+	// backend, for the time the proxy takes to relay the response, so that
+	// the deadline of the client holds across chains of proxies. Calls with
+	// less time left than the budget fail with codes.DeadlineExceeded. It
+	// does not shorten DefaultTimeout and MaxTimeout.
+	HopBudget time.Duration
+}
+
+// WithDeadlinePolicy sets the policy used to derive backend deadlines.
+func WithDeadlinePolicy(p DeadlinePolicy) Option {
+	return func(o *options) {
+		o.deadlines = &p
+	}
+}
+
+// directorContext returns the context passed to the director.
+func (p *DeadlinePolicy) directorContext(ctx context.Context) context.Context {
+	if p.StripIncoming {
+		if _, ok := ctx.Deadline(); ok {
+			return noDeadlineContext{ctx}
+		}
+	}
+	return ctx
+}
+
+// apply sets the deadline of the backend call context according to the
+// policy. The returned cancel function is nil if ctx was not changed.
+func (p *DeadlinePolicy) apply(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := time.Duration(0)
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		timeout = p.DefaultTimeout
+	}
+	if p.MaxTimeout > 0 {
+		if ok && time.Until(deadline) > p.MaxTimeout {
+			timeout = p.MaxTimeout
+		} else if !ok && (timeout <= 0 || timeout > p.MaxTimeout) {
+			timeout = p.MaxTimeout
+		}
+	}
+	if ok && p.HopBudget > 0 {
+		deadline = deadline.Add(-p.HopBudget)
+		if timeout <= 0 || time.Until(deadline) < timeout {
+			return context.WithDeadline(ctx, deadline)
+		}
+	}
+	if timeout <= 0 {
+		return ctx, nil
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// noDeadlineContext hides the deadline of its parent, while still being
+// cancelled along with it.
+type noDeadlineContext struct {
+	context.Context
+}
+
+func (noDeadlineContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
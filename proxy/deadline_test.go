@@ -0,0 +1,90 @@
+package proxy_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// deadlineService reports the remaining backend deadline in milliseconds, or
+// "none".
+func deadlineService() *pingService {
+	return &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			deadline, ok := ctx.Deadline()
+			if !ok {
+				return &pb.PingResponse{Value: "none"}, nil
+			}
+			return &pb.PingResponse{Value: "set", Counter: int32(time.Until(deadline) / time.Millisecond)}, nil
+		},
+	}
+}
+
+func TestDeadlinePolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		policy        proxy.DeadlinePolicy
+		clientTimeout time.Duration
+		wantSet       bool
+		wantMaxMs     int32
+	}{
+		{"inherits", proxy.DeadlinePolicy{}, time.Minute, true, 60000},
+		{"default", proxy.DeadlinePolicy{DefaultTimeout: time.Second}, 0, true, 1000},
+		{"default ignored", proxy.DeadlinePolicy{DefaultTimeout: time.Second}, time.Minute, true, 60000},
+		{"clamped", proxy.DeadlinePolicy{MaxTimeout: 2 * time.Second}, time.Minute, true, 2000},
+		{"max without deadline", proxy.DeadlinePolicy{MaxTimeout: 2 * time.Second}, 0, true, 2000},
+		{"stripped", proxy.DeadlinePolicy{StripIncoming: true}, time.Minute, false, 0},
+		{"stripped with default", proxy.DeadlinePolicy{StripIncoming: true, DefaultTimeout: time.Second}, time.Minute, true, 1000},
+		{"hop budget", proxy.DeadlinePolicy{HopBudget: 20 * time.Second}, time.Minute, true, 40000},
+		{"hop budget within max", proxy.DeadlinePolicy{HopBudget: 20 * time.Second, MaxTimeout: 50 * time.Second}, time.Minute, true, 40000},
+		{"hop budget over max", proxy.DeadlinePolicy{HopBudget: 20 * time.Second, MaxTimeout: 2 * time.Second}, time.Minute, true, 2000},
+		{"hop budget without deadline", proxy.DeadlinePolicy{HopBudget: 20 * time.Second, DefaultTimeout: time.Second}, 0, true, 1000},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			env := newTestEnv(t, deadlineService(), proxy.WithDeadlinePolicy(tc.policy))
+			defer env.Close()
+
+			ctx := context.Background()
+			if tc.clientTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.clientTimeout)
+				defer cancel()
+			}
+			out, err := env.client.Ping(ctx, &pb.PingRequest{})
+			require.NoError(t, err)
+			if !tc.wantSet {
+				assert.Equal(t, "none", out.Value)
+				return
+			}
+			require.Equal(t, "set", out.Value)
+			assert.True(t, out.Counter <= tc.wantMaxMs, "deadline %dms must not exceed %dms", out.Counter, tc.wantMaxMs)
+			assert.True(t, out.Counter > tc.wantMaxMs/2, "deadline %dms must be close to %dms", out.Counter, tc.wantMaxMs)
+		})
+	}
+}
+
+func TestDeadlinePolicy_HopBudgetExhausted(t *testing.T) {
+	called := false
+	svc := &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			called = true
+			return &pb.PingResponse{}, nil
+		},
+	}
+	env := newTestEnv(t, svc, proxy.WithDeadlinePolicy(proxy.DeadlinePolicy{HopBudget: time.Minute}))
+	defer env.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := env.client.Ping(ctx, &pb.PingRequest{})
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assert.False(t, called, "the backend must not be called")
+}
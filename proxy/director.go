@@ -7,7 +7,13 @@ package proxy
 
 import (
 	"context"
+	"time"
+
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 // StreamDirector manages gRPC Client connections for forwarding requests.
@@ -48,5 +54,158 @@ type StreamDirector func(ctx context.Context, method string) (context.Context, c
 type Direction struct {
 	BackendConn *grpc.ClientConn
 	Method      string
-	Done        func(error)
+
+	// Done, if set, is called with the final result of the call. It is called
+	// once the director returns successfully, even if the backend stream
+	// cannot be opened.
+	Done func(error)
+
+	// OnCanceled, if set, is called with the result of a call which was
+	// canceled rather than failed: the client canceled the call or went
+	// away, or the backend ended it with codes.Canceled. It is called before
+	// Done, which is called as well.
+	OnCanceled func(error)
+
+	// CallOptions are passed to the backend when opening the client stream.
+	CallOptions []grpc.CallOption
+
+	// Broadcast lists additional backends which receive a copy of every
+	// client message along with BackendConn. BroadcastMode controls how their
+	// responses are combined.
+	Broadcast     []*grpc.ClientConn
+	BroadcastMode BroadcastMode
+
+	// Shadows lists backends which receive a copy of the client messages
+	// for dark-launch testing. Their responses and errors are ignored and
+	// never affect the client.
+	Shadows []*grpc.ClientConn
+
+	// Failover lists backends which are tried in order when the call to
+	// BackendConn, or to the previous failover backend, fails with
+	// codes.Unavailable before any response was relayed to the client.
+	// Client messages are buffered until a backend responds, so they can be
+	// replayed. Failover takes precedence over WithRetry, and is ignored
+	// for broadcast calls.
+	Failover []*grpc.ClientConn
+
+	// Hedges lists the backends of hedged attempts, see WithHedging.
+	Hedges []*grpc.ClientConn
+
+	// MaxRecvSize and MaxSendSize override the message size limits set by
+	// WithMaxRecvSize and WithMaxSendSize for this call. Negative values
+	// remove the limit.
+	MaxRecvSize int
+	MaxSendSize int
+
+	// MetadataLimits override the limits set by WithMetadataLimits for this
+	// call, per limit. Negative values remove the limit.
+	MetadataLimits MetadataLimits
+
+	// Credentials, if set, authenticate the proxy to the backend in place
+	// of the client, see TokenCredentials. Forwarded client metadata with
+	// the keys they set, such as authorization, is dropped.
+	Credentials credentials.PerRPCCredentials
+}
+
+// DirectorV2 is an alternative to StreamDirector which describes the backend
+// call with a Destination, so that new per-call settings can be added without
+// changing the signature. Use FromDirectorV2 to obtain a StreamDirector.
+type DirectorV2 interface {
+	// Direct returns the destination for the given method, or an error if the
+	// call should not be handled.
+	//
+	// Method is the gRPC request path, which is in the form "/service/method".
+	Direct(ctx context.Context, method string) (*Destination, error)
+}
+
+// DirectorV2Func is an adapter allowing the use of ordinary functions as a
+// DirectorV2.
+type DirectorV2Func func(ctx context.Context, method string) (*Destination, error)
+
+// Direct calls f(ctx, method).
+func (f DirectorV2Func) Direct(ctx context.Context, method string) (*Destination, error) {
+	return f(ctx, method)
+}
+
+// Destination describes where and how a proxied call is forwarded.
+type Destination struct {
+	// Conn is the backend connection. It is required.
+	Conn *grpc.ClientConn
+
+	// Method overrides the full method name used for the backend call.
+	Method string
+
+	// Metadata is added to the metadata forwarded from the client.
+	Metadata metadata.MD
+
+	// Timeout, when positive, limits the duration of the backend call.
+	Timeout time.Duration
+
+	// OnDone is called with the final result of the call.
+	OnDone func(error)
+
+	// OnCanceled is called with the result of a canceled call, see
+	// Direction.OnCanceled.
+	OnCanceled func(error)
+
+	// CallOptions are passed to the backend when opening the client stream.
+	CallOptions []grpc.CallOption
+
+	// Credentials authenticate the proxy to the backend, see
+	// Direction.Credentials.
+	Credentials credentials.PerRPCCredentials
+
+	// Broadcast and BroadcastMode, Shadows, Failover and Hedges list
+	// additional backends of the call, see the Direction fields of the
+	// same names.
+	Broadcast     []*grpc.ClientConn
+	BroadcastMode BroadcastMode
+	Shadows       []*grpc.ClientConn
+	Failover      []*grpc.ClientConn
+	Hedges        []*grpc.ClientConn
+
+	// MaxRecvSize, MaxSendSize and MetadataLimits override the limits of
+	// the handler options for this call, see Direction.
+	MaxRecvSize    int
+	MaxSendSize    int
+	MetadataLimits MetadataLimits
+}
+
+// FromDirectorV2 returns a StreamDirector which delegates to d.
+func FromDirectorV2(d DirectorV2) StreamDirector {
+	return func(ctx context.Context, method string) (context.Context, context.CancelFunc, Direction, error) {
+		dest, err := d.Direct(ctx, method)
+		if err != nil {
+			return ctx, nil, Direction{}, err
+		}
+		if dest == nil {
+			return ctx, nil, Direction{}, status.Errorf(codes.Internal, "director returned no destination for %s", method)
+		}
+		outCtx := ctx
+		if len(dest.Metadata) != 0 {
+			outCtx = CopyMetadata(ctx, ctx)
+			md, _ := metadata.FromOutgoingContext(outCtx)
+			outCtx = metadata.NewOutgoingContext(outCtx, metadata.Join(md, dest.Metadata))
+		}
+		var cancel context.CancelFunc
+		if dest.Timeout > 0 {
+			outCtx, cancel = context.WithTimeout(outCtx, dest.Timeout)
+		}
+		return outCtx, cancel, Direction{
+			BackendConn:    dest.Conn,
+			Method:         dest.Method,
+			Done:           dest.OnDone,
+			OnCanceled:     dest.OnCanceled,
+			CallOptions:    dest.CallOptions,
+			Credentials:    dest.Credentials,
+			Broadcast:      dest.Broadcast,
+			BroadcastMode:  dest.BroadcastMode,
+			Shadows:        dest.Shadows,
+			Failover:       dest.Failover,
+			Hedges:         dest.Hedges,
+			MaxRecvSize:    dest.MaxRecvSize,
+			MaxSendSize:    dest.MaxSendSize,
+			MetadataLimits: dest.MetadataLimits,
+		}, nil
+	}
 }
@@ -0,0 +1,88 @@
+package proxy_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestFromDirectorV2_AppliesDestination(t *testing.T) {
+	var gotMD metadata.MD
+	var gotDeadline bool
+	svc := &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			gotMD, _ = metadata.FromIncomingContext(ctx)
+			_, gotDeadline = ctx.Deadline()
+			return &pb.PingResponse{Value: ping.Value}, nil
+		},
+	}
+
+	var doneErr error
+	doneCalled := make(chan struct{})
+	env := newTestEnvWithDirector(t, svc, func(backend *grpc.ClientConn) proxy.StreamDirector {
+		return proxy.FromDirectorV2(proxy.DirectorV2Func(func(ctx context.Context, method string) (*proxy.Destination, error) {
+			return &proxy.Destination{
+				Conn:     backend,
+				Metadata: metadata.Pairs("x-added", "yes"),
+				Timeout:  time.Minute,
+				OnDone: func(err error) {
+					doneErr = err
+					close(doneCalled)
+				},
+			}, nil
+		}))
+	})
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, clientMdKey, "true")
+	out, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err)
+	assert.Equal(t, "foo", out.Value)
+	assert.Equal(t, []string{"yes"}, gotMD.Get("x-added"), "destination metadata must be forwarded")
+	assert.Equal(t, []string{"true"}, gotMD.Get(clientMdKey), "client metadata must still be forwarded")
+	assert.True(t, gotDeadline, "destination timeout must set a backend deadline")
+
+	<-doneCalled
+	assert.NoError(t, doneErr)
+}
+
+func TestFromDirectorV2_Limits(t *testing.T) {
+	env := newTestEnvWithDirector(t, &pingService{}, func(backend *grpc.ClientConn) proxy.StreamDirector {
+		return proxy.FromDirectorV2(proxy.DirectorV2Func(func(ctx context.Context, method string) (*proxy.Destination, error) {
+			return &proxy.Destination{Conn: backend, MaxRecvSize: 16}, nil
+		}))
+	})
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: strings.Repeat("x", 100)})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "destination limits apply")
+}
+
+func TestFromDirectorV2_NilDestination(t *testing.T) {
+	env := newTestEnvWithDirector(t, &pingService{}, func(backend *grpc.ClientConn) proxy.StreamDirector {
+		return proxy.FromDirectorV2(proxy.DirectorV2Func(func(ctx context.Context, method string) (*proxy.Destination, error) {
+			return nil, nil
+		}))
+	})
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
@@ -0,0 +1,192 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// DirectorCacheConfig configures a DirectorCache.
+type DirectorCacheConfig struct {
+	// TTL is how long a direction is used before the director is asked
+	// again. It is required.
+	TTL time.Duration
+
+	// ErrorTTL, if positive, also caches the errors of the director for
+	// this long, such as permission denials. Errors are not cached by
+	// default.
+	ErrorTTL time.Duration
+
+	// Metadata lists the metadata keys whose values are part of the cache
+	// key, along with the method and the :authority of the call. Calls
+	// which differ in any other way share directions.
+	Metadata []string
+
+	// MaxEntries bounds the number of cached directions, evicting the least
+	// recently used ones first. It defaults to 10000.
+	MaxEntries int
+}
+
+// DirectorCache is a StreamDirector which caches the directions of another
+// director, for directors whose decisions are stable but expensive, such as
+// directors which call a database or an IAM service.
+//
+// Only the Direction and the error of the director are cached. The context
+// returned by the director is not: hits go on with the context of the call,
+// so directors should not return per-call changes in it beyond what the
+// handler does itself. Done and OnCanceled belong to the call the director
+// was called for, and are left out of cached directions. Concurrent misses
+// for the same key each call the director.
+//
+// A DirectorCache is safe for concurrent use.
+type DirectorCache struct {
+	director StreamDirector
+	cfg      DirectorCacheConfig
+	metadata []string
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type directorCacheEntry struct {
+	key     string
+	method  string
+	dir     Direction
+	err     error
+	expires time.Time
+}
+
+// NewDirectorCache returns a DirectorCache for director.
+func NewDirectorCache(director StreamDirector, cfg DirectorCacheConfig) *DirectorCache {
+	if cfg.MaxEntries <= 0 {
+		cfg.MaxEntries = 10000
+	}
+	keys := make([]string, len(cfg.Metadata))
+	for i, k := range cfg.Metadata {
+		keys[i] = strings.ToLower(k)
+	}
+	sort.Strings(keys)
+	return &DirectorCache{
+		director: director,
+		cfg:      cfg,
+		metadata: keys,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Direct implements StreamDirector.
+func (c *DirectorCache) Direct(ctx context.Context, method string) (context.Context, context.CancelFunc, Direction, error) {
+	key := c.key(ctx, method)
+	if e, ok := c.get(key); ok {
+		return ctx, nil, e.dir, e.err
+	}
+	outCtx, cancel, dir, err := c.director(ctx, method)
+	switch {
+	case err != nil && c.cfg.ErrorTTL > 0 && cacheableError(ctx, err):
+		c.set(&directorCacheEntry{key: key, method: method, err: err}, c.cfg.ErrorTTL)
+	case err == nil:
+		cached := dir
+		cached.Done = nil
+		cached.OnCanceled = nil
+		c.set(&directorCacheEntry{key: key, method: method, dir: cached}, c.cfg.TTL)
+	}
+	return outCtx, cancel, dir, err
+}
+
+// cacheableError reports whether err of the director may be served to other
+// callers. Errors caused by the context of the caller are not.
+func cacheableError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	code := status.Code(err)
+	return code != codes.Canceled && code != codes.DeadlineExceeded
+}
+
+// Invalidate removes the cached directions of the methods whose full method
+// name starts with prefix. An empty prefix removes all of them.
+func (c *DirectorCache) Invalidate(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, el := range c.entries {
+		if strings.HasPrefix(el.Value.(*directorCacheEntry).method, prefix) {
+			c.order.Remove(el)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Len returns the number of cached directions, including expired ones which
+// were not evicted yet.
+func (c *DirectorCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *DirectorCache) key(ctx context.Context, method string) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var b strings.Builder
+	b.WriteString(method)
+	b.WriteByte(0)
+	for _, v := range md.Get(":authority") {
+		b.WriteString(v)
+		b.WriteByte(1)
+	}
+	for _, k := range c.metadata {
+		b.WriteByte(0)
+		b.WriteString(k)
+		for _, v := range md.Get(k) {
+			b.WriteByte(1)
+			b.WriteString(v)
+		}
+	}
+	return b.String()
+}
+
+func (c *DirectorCache) get(key string) (*directorCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*directorCacheEntry)
+	if time.Now().After(e.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return e, true
+}
+
+func (c *DirectorCache) set(e *directorCacheEntry, ttl time.Duration) {
+	e.expires = time.Now().Add(ttl)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[e.key] = c.order.PushFront(e)
+	for c.order.Len() > c.cfg.MaxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*directorCacheEntry).key)
+	}
+}
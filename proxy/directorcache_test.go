@@ -0,0 +1,126 @@
+package proxy_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestDirectorCache(t *testing.T) {
+	var calls, done int32
+	var cache *proxy.DirectorCache
+	env := newTestEnvWithDirector(t, &pingService{}, func(backend *grpc.ClientConn) proxy.StreamDirector {
+		cache = proxy.NewDirectorCache(func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+			atomic.AddInt32(&calls, 1)
+			if method == "/vgough.testproto.TestService/PingEmpty" {
+				return ctx, nil, proxy.Direction{}, status.Error(codes.PermissionDenied, "denied")
+			}
+			return ctx, nil, proxy.Direction{
+				BackendConn: backend,
+				Done:        func(error) { atomic.AddInt32(&done, 1) },
+			}, nil
+		}, proxy.DirectorCacheConfig{TTL: time.Minute, Metadata: []string{"X-Tenant"}})
+		return cache.Direct
+	})
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	for i := 0; i < 3; i++ {
+		_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "x"})
+		require.NoError(t, err)
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls), "stable directions are cached")
+	assert.EqualValues(t, 1, atomic.LoadInt32(&done), "Done is only called for the call it belongs to")
+
+	_, err := env.client.Ping(metadata.AppendToOutgoingContext(ctx, "x-tenant", "a"), &pb.PingRequest{Value: "x"})
+	require.NoError(t, err)
+	list, err := env.client.PingList(ctx, &pb.PingRequest{Value: "x"})
+	require.NoError(t, err)
+	_, err = list.Recv()
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&calls), "selected metadata and methods are part of the key")
+
+	for i := 0; i < 2; i++ {
+		_, err := env.client.PingEmpty(ctx, &pb.Empty{})
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	}
+	assert.EqualValues(t, 5, atomic.LoadInt32(&calls), "errors are not cached by default")
+
+	cache.Invalidate("/vgough.testproto.TestService/Ping")
+	assert.Equal(t, 0, cache.Len(), "prefixes match PingList too")
+	_, err = env.client.Ping(ctx, &pb.PingRequest{Value: "x"})
+	require.NoError(t, err)
+	assert.EqualValues(t, 6, atomic.LoadInt32(&calls))
+}
+
+func TestDirectorCache_TTL(t *testing.T) {
+	var calls int32
+	director := func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return ctx, nil, proxy.Direction{}, status.Error(codes.PermissionDenied, "denied")
+		}
+		return ctx, nil, proxy.Direction{Method: "/a.A/Backend"}, nil
+	}
+	cache := proxy.NewDirectorCache(director, proxy.DirectorCacheConfig{TTL: 50 * time.Millisecond, ErrorTTL: 50 * time.Millisecond, MaxEntries: 1})
+	md := metadata.Pairs(":authority", "one.example.com")
+	ctx := metadata.NewIncomingContext(context.Background(), md)
+
+	_, _, _, err := cache.Direct(ctx, "/a.A/M")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, _, _, err = cache.Direct(ctx, "/a.A/M")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "errors are cached with ErrorTTL")
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+
+	time.Sleep(60 * time.Millisecond)
+	_, _, dir, err := cache.Direct(ctx, "/a.A/M")
+	require.NoError(t, err, "entries expire")
+	assert.Equal(t, "/a.A/Backend", dir.Method)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+
+	other := metadata.NewIncomingContext(context.Background(), metadata.Pairs(":authority", "two.example.com"))
+	_, _, _, err = cache.Direct(other, "/a.A/M")
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&calls), "the authority is part of the key")
+	assert.Equal(t, 1, cache.Len(), "the least recently used entry is evicted")
+}
+
+func TestDirectorCache_ContextErrorsAreNotCached(t *testing.T) {
+	var calls int32
+	director := func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+		atomic.AddInt32(&calls, 1)
+		if err := ctx.Err(); err != nil {
+			return ctx, nil, proxy.Direction{}, status.FromContextError(err).Err()
+		}
+		if method == "/a.A/Slow" {
+			return ctx, nil, proxy.Direction{}, status.Error(codes.DeadlineExceeded, "lookup timed out")
+		}
+		return ctx, nil, proxy.Direction{Method: "/a.A/Backend"}, nil
+	}
+	cache := proxy.NewDirectorCache(director, proxy.DirectorCacheConfig{TTL: time.Minute, ErrorTTL: time.Minute})
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, _, err := cache.Direct(canceled, "/a.A/M")
+	assert.Equal(t, codes.Canceled, status.Code(err))
+	_, _, dir, err := cache.Direct(context.Background(), "/a.A/M")
+	require.NoError(t, err, "the error of a canceled caller is not served to others")
+	assert.Equal(t, "/a.A/Backend", dir.Method)
+
+	for i := 0; i < 2; i++ {
+		_, _, _, err = cache.Direct(context.Background(), "/a.A/Slow")
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	}
+	assert.EqualValues(t, 4, atomic.LoadInt32(&calls), "deadline errors are not cached")
+}
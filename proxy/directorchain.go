@@ -0,0 +1,60 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DirectorFunc is an adapter allowing the use of functions which only pick
+// the backend connection of a call as a StreamDirector, see Direct.
+type DirectorFunc func(ctx context.Context, method string) (*grpc.ClientConn, error)
+
+// Direct implements StreamDirector, forwarding calls to the connection
+// returned by f.
+func (f DirectorFunc) Direct(ctx context.Context, method string) (context.Context, context.CancelFunc, Direction, error) {
+	conn, err := f(ctx, method)
+	if err != nil {
+		return ctx, nil, Direction{}, err
+	}
+	return ctx, nil, Direction{BackendConn: conn}, nil
+}
+
+// DirectorMiddleware wraps a StreamDirector, such as to check calls before
+// they are routed, or to adjust the Direction of the routed ones.
+type DirectorMiddleware func(next StreamDirector) StreamDirector
+
+// ChainDirectors returns director wrapped by middleware, so that calls pass
+// through the middleware in order before reaching director. For example,
+// to check an ACL before routing, and to then pin the calls of a tenant:
+//
+//	director := proxy.ChainDirectors(router.Direct, checkACL, pinTenant)
+func ChainDirectors(director StreamDirector, middleware ...DirectorMiddleware) StreamDirector {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		director = middleware[i](director)
+	}
+	return director
+}
+
+// DirectorWithFallback returns a StreamDirector which directs calls with
+// primary, and with fallback the calls which primary does not handle, that
+// is which it rejects with codes.Unimplemented. Other errors of primary
+// fail the call.
+func DirectorWithFallback(primary, fallback StreamDirector) StreamDirector {
+	return func(ctx context.Context, method string) (context.Context, context.CancelFunc, Direction, error) {
+		outCtx, cancel, dir, err := primary(ctx, method)
+		if status.Code(err) != codes.Unimplemented {
+			return outCtx, cancel, dir, err
+		}
+		if cancel != nil {
+			cancel()
+		}
+		return fallback(ctx, method)
+	}
+}
@@ -0,0 +1,86 @@
+package proxy_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestChainDirectors(t *testing.T) {
+	var order []string
+	record := func(name string) proxy.DirectorMiddleware {
+		return func(next proxy.StreamDirector) proxy.StreamDirector {
+			return func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+				order = append(order, name)
+				return next(ctx, method)
+			}
+		}
+	}
+	denyErrors := func(next proxy.StreamDirector) proxy.StreamDirector {
+		return func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+			if strings.HasSuffix(method, "/PingError") {
+				return ctx, nil, proxy.Direction{}, status.Error(codes.PermissionDenied, "denied")
+			}
+			return next(ctx, method)
+		}
+	}
+	env := newTestEnvWithDirector(t, &pingService{}, func(backend *grpc.ClientConn) proxy.StreamDirector {
+		base := proxy.DirectorFunc(func(ctx context.Context, method string) (*grpc.ClientConn, error) {
+			order = append(order, "director")
+			return backend, nil
+		})
+		return proxy.ChainDirectors(base.Direct, record("first"), denyErrors, record("second"))
+	})
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	out, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err)
+	assert.Equal(t, "foo", out.Value)
+	assert.Equal(t, []string{"first", "second", "director"}, order)
+
+	order = nil
+	_, err = env.client.PingError(ctx, &pb.PingRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Equal(t, []string{"first"}, order, "the chain stops at the failing middleware")
+}
+
+func TestDirectorWithFallback(t *testing.T) {
+	otherServer, otherConn := startBackend(t, namedService("fallback"))
+	defer otherServer.Stop()
+	defer otherConn.Close()
+
+	env := newTestEnvWithDirector(t, namedService("primary"), func(backend *grpc.ClientConn) proxy.StreamDirector {
+		r := proxy.NewRouter()
+		r.AddBackend("primary", backend)
+		r.AddRoute(proxy.Route{MethodPrefix: "/vgough.testproto.TestService/PingEmpty", Backend: "missing"})
+		r.AddRoute(proxy.Route{MethodPrefix: "/vgough.testproto.TestService/PingError", Backend: "primary"})
+		fallback := proxy.DirectorFunc(func(ctx context.Context, method string) (*grpc.ClientConn, error) {
+			return otherConn, nil
+		})
+		return proxy.DirectorWithFallback(r.Direct, fallback.Direct)
+	})
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	_, err := env.client.PingError(ctx, &pb.PingRequest{})
+	require.NoError(t, err, "routed by the primary director")
+
+	out, err := env.client.Ping(ctx, &pb.PingRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, "fallback", out.Value, "calls without a route go to the fallback")
+
+	_, err = env.client.PingEmpty(ctx, &pb.Empty{})
+	assert.Equal(t, codes.Unavailable, status.Code(err), "other errors of the primary director fail the call")
+}
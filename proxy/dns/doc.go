@@ -0,0 +1,12 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+/*
+Package dns keeps the endpoints of a proxy.Balancer in sync with DNS.
+
+This suits backends with changing addresses, such as Kubernetes headless
+services, where grpc would otherwise keep using the addresses it resolved
+when it connected.
+*/
+package dns
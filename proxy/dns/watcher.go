@@ -0,0 +1,141 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package dns
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"google.golang.org/grpc"
+)
+
+// Resolver looks up DNS records. *net.Resolver implements it.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// Watcher periodically resolves a target and updates the endpoints of a
+// balancer with one connection per address. Connections of addresses which
+// disappear are closed, those of remaining addresses are kept.
+//
+// The target is either "host:port", resolved with A and AAAA records, or an
+// SRV name such as "_grpc._tcp.backend.example.com". Of the SRV records,
+// only those with the lowest priority are used, weighted by their weight.
+type Watcher struct {
+	// Resolver is used for lookups. If nil, net.DefaultResolver is used.
+	Resolver Resolver
+	// Interval is the time between resolutions. If zero, 30 seconds.
+	Interval time.Duration
+	// Dial connects to an address. If nil, addresses are dialed insecurely
+	// with the proxy codec.
+	Dial func(address string) (*grpc.ClientConn, error)
+	// OnError, if set, is called with failed resolutions. The endpoints are
+	// left unchanged when resolution fails.
+	OnError func(error)
+
+	target string
+	pool   *proxy.AddressPool
+}
+
+// NewWatcher returns a Watcher updating b with the addresses of target.
+func NewWatcher(target string, b proxy.Balancer) *Watcher {
+	w := &Watcher{target: target, pool: proxy.NewAddressPool(b)}
+	w.pool.Dial = w.dial
+	return w
+}
+
+// Run resolves the target immediately and then every Interval, until ctx is
+// done. The connections are closed when Run returns.
+func (w *Watcher) Run(ctx context.Context) {
+	defer w.pool.Close()
+	interval := w.Interval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := w.Resolve(ctx); err != nil && w.OnError != nil && ctx.Err() == nil {
+			w.OnError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Resolve resolves the target once and updates the balancer.
+func (w *Watcher) Resolve(ctx context.Context) error {
+	weights, err := w.lookup(ctx)
+	if err != nil {
+		return err
+	}
+	w.pool.Update(weights)
+	return nil
+}
+
+// lookup returns the weight of each address of the target.
+func (w *Watcher) lookup(ctx context.Context) (map[string]int, error) {
+	r := w.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	weights := make(map[string]int)
+	if host, port, err := net.SplitHostPort(w.target); err == nil {
+		hosts, err := r.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range hosts {
+			weights[net.JoinHostPort(h, port)] = 1
+		}
+		return weights, nil
+	}
+
+	_, srvs, err := r.LookupSRV(ctx, "", "", w.target)
+	if err != nil {
+		return nil, err
+	}
+	if len(srvs) == 0 {
+		return weights, nil
+	}
+	priority := srvs[0].Priority
+	for _, srv := range srvs {
+		if srv.Priority < priority {
+			priority = srv.Priority
+		}
+	}
+	for _, srv := range srvs {
+		if srv.Priority != priority {
+			continue
+		}
+		hosts, err := r.LookupHost(ctx, strings.TrimSuffix(srv.Target, "."))
+		if err != nil {
+			return nil, err
+		}
+		weight := int(srv.Weight)
+		if weight < 1 {
+			weight = 1
+		}
+		for _, h := range hosts {
+			weights[net.JoinHostPort(h, strconv.Itoa(int(srv.Port)))] += weight
+		}
+	}
+	return weights, nil
+}
+
+func (w *Watcher) dial(addr string) (*grpc.ClientConn, error) {
+	if w.Dial != nil {
+		return w.Dial(addr)
+	}
+	return (&proxy.BackendConfig{Address: addr}).Dial()
+}
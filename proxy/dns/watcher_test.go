@@ -0,0 +1,113 @@
+package dns_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/mkxxx/grpc-proxy/proxy/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+type fakeResolver struct {
+	mu    sync.Mutex
+	hosts map[string][]string
+	srvs  map[string][]*net.SRV
+	err   error
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.hosts[host], nil
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return "", nil, r.err
+	}
+	return name, r.srvs[name], nil
+}
+
+// recordingBalancer records the endpoints it is updated with.
+type recordingBalancer struct {
+	proxy.Balancer
+	endpoints []proxy.Endpoint
+}
+
+func (b *recordingBalancer) Update(endpoints []proxy.Endpoint) {
+	b.endpoints = endpoints
+}
+
+func (b *recordingBalancer) targets() []string {
+	var out []string
+	for _, ep := range b.endpoints {
+		out = append(out, ep.Conn.Target())
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestWatcherHost(t *testing.T) {
+	r := &fakeResolver{hosts: map[string][]string{"backend": {"10.0.0.1", "10.0.0.2"}}}
+	b := &recordingBalancer{}
+	w := dns.NewWatcher("backend:443", b)
+	w.Resolver = r
+	ctx := context.Background()
+
+	require.NoError(t, w.Resolve(ctx))
+	assert.Equal(t, []string{"10.0.0.1:443", "10.0.0.2:443"}, b.targets())
+	kept := b.endpoints[1].Conn
+
+	r.hosts["backend"] = []string{"10.0.0.2", "::1"}
+	require.NoError(t, w.Resolve(ctx))
+	assert.Equal(t, []string{"10.0.0.2:443", "[::1]:443"}, b.targets())
+	var reused bool
+	for _, ep := range b.endpoints {
+		reused = reused || ep.Conn == kept
+	}
+	assert.True(t, reused, "connections of remaining addresses are kept")
+
+	r.err = errors.New("SERVFAIL")
+	assert.Error(t, w.Resolve(ctx))
+	assert.Len(t, b.endpoints, 2, "failed resolutions keep the endpoints")
+}
+
+func TestWatcherSRV(t *testing.T) {
+	r := &fakeResolver{
+		hosts: map[string][]string{"a.internal": {"10.0.0.1"}, "b.internal": {"10.0.0.2"}, "c.internal": {"10.0.0.3"}},
+		srvs: map[string][]*net.SRV{"_grpc._tcp.backend": {
+			{Target: "a.internal.", Port: 8080, Priority: 1, Weight: 10},
+			{Target: "b.internal.", Port: 8081, Priority: 1, Weight: 5},
+			{Target: "c.internal.", Port: 8082, Priority: 2, Weight: 1},
+		}},
+	}
+	b := &recordingBalancer{}
+	var dialed []string
+	w := dns.NewWatcher("_grpc._tcp.backend", b)
+	w.Resolver = r
+	w.Dial = func(addr string) (*grpc.ClientConn, error) {
+		dialed = append(dialed, addr)
+		return (&proxy.BackendConfig{Address: addr}).Dial()
+	}
+
+	require.NoError(t, w.Resolve(context.Background()))
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8081"}, b.targets(), "only the lowest priority is used")
+	assert.Len(t, dialed, 2)
+	for _, ep := range b.endpoints {
+		if ep.Conn.Target() == "10.0.0.1:8080" {
+			assert.Equal(t, 10, ep.Weight)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// retryPushbackKey is the trailer used by gRPC clients as a retry delay hint.
+const retryPushbackKey = "grpc-retry-pushback-ms"
+
+// Drainer tracks the in-flight streams of one or more proxy handlers and
+// allows them to be drained, e.g. before the proxy is shut down.
+//
+// While draining, new streams are rejected with codes.Unavailable. Existing
+// streams are given a grace period to complete, after which they are
+// cancelled. The zero value is ready to use.
+type Drainer struct {
+	// RetryPushback, if positive, is sent to rejected clients as a retry
+	// delay hint in the grpc-retry-pushback-ms trailer.
+	RetryPushback time.Duration
+
+	mu       sync.Mutex
+	draining bool
+	streams  map[*drainedStream]struct{}
+	idle     chan struct{}
+}
+
+// WithDrainer registers the handler's streams with d.
+func WithDrainer(d *Drainer) Option {
+	return func(o *options) {
+		o.drainer = d
+	}
+}
+
+type drainedStream struct {
+	cancel context.CancelFunc
+	forced bool
+}
+
+// enter registers a new stream. The returned context is cancelled if the
+// stream outlives the grace period of a drain, and the returned function
+// must be called once the stream is done. It reports whether the stream was
+// cancelled by the drain.
+func (d *Drainer) enter(ctx context.Context) (context.Context, func() bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		if d.RetryPushback > 0 {
+			ms := strconv.FormatInt(int64(d.RetryPushback/time.Millisecond), 10)
+			grpc.SetTrailer(ctx, metadata.Pairs(retryPushbackKey, ms))
+		}
+		return nil, nil, status.Error(codes.Unavailable, "proxy is draining")
+	}
+	if d.streams == nil {
+		d.streams = make(map[*drainedStream]struct{})
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	s := &drainedStream{cancel: cancel}
+	d.streams[s] = struct{}{}
+
+	return ctx, func() bool {
+		cancel()
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.streams, s)
+		if d.draining && len(d.streams) == 0 && d.idle != nil {
+			close(d.idle)
+			d.idle = nil
+		}
+		return s.forced
+	}, nil
+}
+
+// Drain starts draining. It waits for in-flight streams to complete for up
+// to grace, then cancels the remaining streams and waits for them to exit.
+//
+// Drain returns early with the context error if ctx is done first. The
+// Drainer remains in the draining state until Resume is called.
+func (d *Drainer) Drain(ctx context.Context, grace time.Duration) error {
+	d.mu.Lock()
+	d.draining = true
+	idle := d.idle
+	if idle == nil {
+		idle = make(chan struct{})
+		if len(d.streams) == 0 {
+			close(idle)
+		} else {
+			d.idle = idle
+		}
+	}
+	d.mu.Unlock()
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+	}
+
+	d.mu.Lock()
+	for s := range d.streams {
+		s.forced = true
+		s.cancel()
+	}
+	d.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Resume stops draining, so that new streams are accepted again.
+func (d *Drainer) Resume() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.draining = false
+	if d.idle != nil {
+		close(d.idle)
+		d.idle = nil
+	}
+}
+
+// Draining reports whether a drain has been started.
+func (d *Drainer) Draining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.draining
+}
+
+// Active returns the number of in-flight streams.
+func (d *Drainer) Active() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.streams)
+}
@@ -0,0 +1,86 @@
+package proxy_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestDrainer_RejectsNewAndCancelsLingeringStreams(t *testing.T) {
+	drainer := &proxy.Drainer{RetryPushback: 250 * time.Millisecond}
+	env := newTestEnv(t, &pingService{}, proxy.WithDrainer(drainer))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	stream, err := env.client.PingStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.PingRequest{Value: "foo"}))
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, 1, drainer.Active())
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- drainer.Drain(ctx, 100*time.Millisecond)
+	}()
+	for !drainer.Draining() {
+		time.Sleep(time.Millisecond)
+	}
+
+	var trailer metadata.MD
+	_, err = env.client.Ping(ctx, &pb.PingRequest{Value: "foo"}, grpc.Trailer(&trailer))
+	assert.Equal(t, codes.Unavailable, status.Code(err), "new streams must be rejected")
+	assert.Equal(t, []string{"250"}, trailer.Get("grpc-retry-pushback-ms"))
+
+	// The open stream is cancelled after the grace period.
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	require.NoError(t, <-drained)
+	assert.Equal(t, 0, drainer.Active())
+
+	drainer.Resume()
+	_, err = env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	assert.NoError(t, err, "streams must be accepted after Resume")
+}
+
+func TestDrainer_WaitsForStreamsWithinGrace(t *testing.T) {
+	drainer := &proxy.Drainer{}
+	env := newTestEnv(t, &pingService{}, proxy.WithDrainer(drainer))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	stream, err := env.client.PingStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.PingRequest{Value: "foo"}))
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- drainer.Drain(context.Background(), time.Minute)
+	}()
+
+	require.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	assert.Equal(t, io.EOF, err, "stream must complete normally")
+
+	select {
+	case err := <-drained:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain did not complete once the stream finished")
+	}
+}
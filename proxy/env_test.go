@@ -0,0 +1,134 @@
+package proxy_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// testEnv wires a client through a transparent proxy to a single backend
+// serving the TestService.
+type testEnv struct {
+	t *testing.T
+
+	backend     *grpc.Server
+	backendConn *grpc.ClientConn
+	director    proxy.StreamDirector
+	proxy       *grpc.Server
+	clientConn  *grpc.ClientConn
+	client      pb.TestServiceClient
+}
+
+// newTestEnv starts a backend serving svc and a proxy forwarding all calls to
+// it, configured with opts.
+func newTestEnv(t *testing.T, svc pb.TestServiceServer, opts ...proxy.Option) *testEnv {
+	return newTestEnvWithDirector(t, svc, nil, opts...)
+}
+
+// newTestEnvWithDirector is like newTestEnv, but routes calls using the
+// director returned by mkDirector. A nil mkDirector sends every call to the
+// backend.
+func newTestEnvWithDirector(t *testing.T, svc pb.TestServiceServer,
+	mkDirector func(backend *grpc.ClientConn) proxy.StreamDirector, opts ...proxy.Option) *testEnv {
+	e := &testEnv{t: t}
+	e.backend, e.backendConn = startBackend(t, svc)
+	e.director = e.direct
+	if mkDirector != nil {
+		e.director = mkDirector(e.backendConn)
+	}
+
+	proxyLis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port for the proxy")
+	e.proxy = grpc.NewServer(
+		proxy.ServerOption(),
+		grpc.UnknownServiceHandler(proxy.TransparentHandler(e.director, opts...)),
+	)
+	go e.proxy.Serve(proxyLis)
+
+	e.clientConn, err = grpc.Dial(proxyLis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err, "must not error on deferred client Dial")
+	e.client = pb.NewTestServiceClient(e.clientConn)
+	return e
+}
+
+// startBackend starts a server for svc and returns it along with a proxy
+// connection to it.
+func startBackend(t *testing.T, svc pb.TestServiceServer) (*grpc.Server, *grpc.ClientConn) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port for the backend")
+	server := grpc.NewServer()
+	pb.RegisterTestServiceServer(server, svc)
+	go server.Serve(lis)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure(), proxy.DialOption())
+	require.NoError(t, err, "must not error on deferred backend Dial")
+	return server, conn
+}
+
+func (e *testEnv) direct(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+	return ctx, nil, proxy.Direction{BackendConn: e.backendConn}, nil
+}
+
+func (e *testEnv) ctx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 10*time.Second)
+}
+
+func (e *testEnv) Close() {
+	e.clientConn.Close()
+	e.proxy.Stop()
+	e.backendConn.Close()
+	e.backend.Stop()
+}
+
+// pingService is a TestService whose handlers can be replaced by tests.
+// Handlers which are not set echo the request.
+type pingService struct {
+	ping       func(context.Context, *pb.PingRequest) (*pb.PingResponse, error)
+	pingStream func(pb.TestService_PingStreamServer) error
+}
+
+func (s *pingService) PingEmpty(ctx context.Context, _ *pb.Empty) (*pb.PingResponse, error) {
+	return &pb.PingResponse{Value: pingDefaultValue}, nil
+}
+
+func (s *pingService) Ping(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+	if s.ping != nil {
+		return s.ping(ctx, ping)
+	}
+	return &pb.PingResponse{Value: ping.Value}, nil
+}
+
+func (s *pingService) PingError(ctx context.Context, ping *pb.PingRequest) (*pb.Empty, error) {
+	return &pb.Empty{}, nil
+}
+
+func (s *pingService) PingList(ping *pb.PingRequest, stream pb.TestService_PingListServer) error {
+	for i := 0; i < countListResponses; i++ {
+		if err := stream.Send(&pb.PingResponse{Value: ping.Value, Counter: int32(i)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *pingService) PingStream(stream pb.TestService_PingStreamServer) error {
+	if s.pingStream != nil {
+		return s.pingStream(stream)
+	}
+	for counter := int32(0); ; counter++ {
+		ping, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+		if err := stream.Send(&pb.PingResponse{Value: ping.Value, Counter: counter}); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// ErrorSource tells where the error of a call originated.
+type ErrorSource int
+
+const (
+	// ErrorSourceProxy is an error of the proxy itself, such as a call
+	// rejected by a limit or a failure of the client's stream.
+	ErrorSourceProxy ErrorSource = iota
+	// ErrorSourceDirector is an error returned by the StreamDirector.
+	ErrorSourceDirector
+	// ErrorSourceConnection is a failure to reach the backend: its stream
+	// could not be opened, or failed before the backend answered.
+	ErrorSourceConnection
+	// ErrorSourceBackend is a status returned by the backend.
+	ErrorSourceBackend
+)
+
+func (s ErrorSource) String() string {
+	switch s {
+	case ErrorSourceProxy:
+		return "proxy"
+	case ErrorSourceDirector:
+		return "director"
+	case ErrorSourceConnection:
+		return "connection"
+	case ErrorSourceBackend:
+		return "backend"
+	default:
+		return "unknown"
+	}
+}
+
+// ErrorMapper translates the error of a call before it is returned to the
+// client, for example to hide internal details. It is called with the
+// context of the call and is only called for failed calls.
+type ErrorMapper func(ctx context.Context, src ErrorSource, err error) error
+
+// WithErrorMapper translates the errors returned to clients with m. Several
+// mappers are applied in the order they are given. Access logs, metrics and
+// traces still record the original error.
+func WithErrorMapper(m ErrorMapper) Option {
+	return func(o *options) {
+		o.errorMappers = append(o.errorMappers, m)
+	}
+}
+
+// SanitizeErrors returns an ErrorMapper which keeps internal details, such
+// as the backend addresses of dial errors, from reaching clients.
+//
+// Connection errors become codes.Unavailable with a generic message.
+// Director errors with codes.Unknown, codes.Internal or codes.Unavailable
+// keep their code with a generic message, other director errors are
+// meant for the client and kept. Backend and proxy errors are kept as well.
+func SanitizeErrors() ErrorMapper {
+	return func(ctx context.Context, src ErrorSource, err error) error {
+		switch src {
+		case ErrorSourceConnection:
+			return status.Error(codes.Unavailable, genericMessage(codes.Unavailable))
+		case ErrorSourceDirector:
+			switch code := status.Code(err); code {
+			case codes.Unknown, codes.Internal, codes.Unavailable:
+				return status.Error(code, genericMessage(code))
+			}
+		}
+		return err
+	}
+}
+
+func genericMessage(code codes.Code) string {
+	switch code {
+	case codes.Unavailable:
+		return "service unavailable"
+	case codes.Internal:
+		return "internal error"
+	default:
+		return "unknown error"
+	}
+}
+
+// mapError applies the error mappers to the error of ps.
+func (h *handler) mapError(ctx context.Context, ps *proxiedStream, err error) error {
+	for _, m := range h.opts.errorMappers {
+		if err == nil {
+			break
+		}
+		err = m(ctx, ps.errSource, err)
+	}
+	return err
+}
+
+// errorTrackingClientStream records the errors of a backend stream, to tell
+// connection failures from statuses of the backend.
+type errorTrackingClientStream struct {
+	grpc.ClientStream
+
+	mu         sync.Mutex
+	answered   bool
+	connErr    error
+	backendErr error
+}
+
+func (s *errorTrackingClientStream) Header() (metadata.MD, error) {
+	md, err := s.ClientStream.Header()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.connErr = err
+	} else {
+		s.answered = true
+	}
+	return md, err
+}
+
+func (s *errorTrackingClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil && err != io.EOF {
+		s.mu.Lock()
+		if s.answered {
+			s.backendErr = err
+		} else {
+			s.connErr = err
+		}
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// source returns the source of err. Errors which were not returned by the
+// stream are errors of the proxy or the client.
+func (s *errorTrackingClientStream) source(err error) ErrorSource {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.backendErr != nil && err == s.backendErr:
+		return ErrorSourceBackend
+	case s.connErr != nil && err == s.connErr:
+		return ErrorSourceConnection
+	}
+	return ErrorSourceProxy
+}
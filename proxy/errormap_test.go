@@ -0,0 +1,102 @@
+package proxy_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// sourceRecorder is an ErrorMapper recording the sources of errors.
+type sourceRecorder struct {
+	mu      sync.Mutex
+	sources []proxy.ErrorSource
+}
+
+func (r *sourceRecorder) mapError(ctx context.Context, src proxy.ErrorSource, err error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sources = append(r.sources, src)
+	return err
+}
+
+func (r *sourceRecorder) last() proxy.ErrorSource {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sources[len(r.sources)-1]
+}
+
+func TestErrorMapper_Sources(t *testing.T) {
+	deadConns := idleConns(t, 1)
+	defer closeConns(deadConns)
+	rec := &sourceRecorder{}
+	l := &recordingLogger{}
+	svc := &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			return nil, status.Error(codes.Internal, "backend detail")
+		},
+	}
+	env := newTestEnvWithDirector(t, svc, func(backend *grpc.ClientConn) proxy.StreamDirector {
+		return func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+			switch proxy.CallInfoFromContext(ctx).Method() {
+			case "/vgough.testproto.TestService/PingEmpty":
+				return ctx, nil, proxy.Direction{}, status.Error(codes.Internal, "failed to dial 10.1.2.3:443")
+			case "/vgough.testproto.TestService/PingError":
+				return ctx, nil, proxy.Direction{BackendConn: deadConns[0]}, nil
+			}
+			return ctx, nil, proxy.Direction{BackendConn: backend}, nil
+		}
+	}, proxy.WithErrorMapper(rec.mapError), proxy.WithErrorMapper(proxy.SanitizeErrors()), proxy.WithAccessLogger(l))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	_, err := env.client.PingEmpty(ctx, &pb.Empty{})
+	assert.Equal(t, proxy.ErrorSourceDirector, rec.last())
+	assert.Equal(t, status.Error(codes.Internal, "internal error"), err, "director details are hidden")
+
+	_, err = env.client.PingError(ctx, &pb.PingRequest{})
+	assert.Equal(t, proxy.ErrorSourceConnection, rec.last())
+	assert.Equal(t, status.Error(codes.Unavailable, "service unavailable"), err, "connection details are hidden")
+
+	_, err = env.client.Ping(ctx, &pb.PingRequest{})
+	assert.Equal(t, proxy.ErrorSourceBackend, rec.last())
+	assert.Equal(t, status.Error(codes.Internal, "backend detail"), err, "backend statuses are kept")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	require.Len(t, l.ends, 3)
+	assert.Equal(t, "failed to dial 10.1.2.3:443", l.ends[0].Message, "access logs see the original error")
+}
+
+func TestErrorMapper_ProxyErrors(t *testing.T) {
+	rec := &sourceRecorder{}
+	env := newTestEnv(t, &pingService{}, proxy.WithErrorMapper(rec.mapError), proxy.WithMaxRecvSize(8))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "a value which is too large"})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, proxy.ErrorSourceProxy, rec.last())
+}
+
+func TestErrorMapper_NotCalledOnSuccess(t *testing.T) {
+	env := newTestEnv(t, &pingService{}, proxy.WithErrorMapper(func(ctx context.Context, src proxy.ErrorSource, err error) error {
+		return status.Errorf(codes.Aborted, "%s: %s", src, status.Convert(err).Message())
+	}))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	_, err := env.client.PingError(ctx, &pb.PingRequest{})
+	assert.NoError(t, err, "mappers are not called for successful calls")
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The kinds of StreamError, for errors.Is.
+var (
+	// ErrBackendDial is a failure to open the stream to the backend.
+	ErrBackendDial = errors.New("backend stream failed")
+
+	// ErrForwardClientToBackend is a failure to receive messages from the
+	// client or to send them to the backend.
+	ErrForwardClientToBackend = errors.New("forwarding from client to backend failed")
+
+	// ErrForwardBackendToClient is a failure to send the headers or messages
+	// of the backend to the client. Statuses of the backend are returned as
+	// they are, not as this error.
+	ErrForwardBackendToClient = errors.New("forwarding from backend to client failed")
+)
+
+// StreamError is an error of the handler which is not the status of the
+// backend, so that callers, error mappers and loggers can tell failure modes
+// apart with errors.Is and errors.As:
+//
+//	if errors.Is(err, proxy.ErrBackendDial) { ... }
+//
+// Its gRPC status is that of Err if it has one, so clients see the same
+// status as without the wrapping.
+type StreamError struct {
+	// Kind is one of ErrBackendDial, ErrForwardClientToBackend and
+	// ErrForwardBackendToClient.
+	Kind error
+
+	// Direction is the direction of the failed copy. It is ClientToBackend
+	// for ErrBackendDial.
+	Direction FrameDirection
+
+	// Backend is the target of the backend connection, if known.
+	Backend string
+
+	// Err is the underlying error.
+	Err error
+}
+
+func newStreamError(kind error, backend string, err error) *StreamError {
+	dir := ClientToBackend
+	if kind == ErrForwardBackendToClient {
+		dir = BackendToClient
+	}
+	return &StreamError{Kind: kind, Direction: dir, Backend: backend, Err: err}
+}
+
+func (e *StreamError) Error() string {
+	if e.Backend != "" {
+		return fmt.Sprintf("%v (backend %q): %v", e.Kind, e.Backend, e.Err)
+	}
+	return fmt.Sprintf("%v: %v", e.Kind, e.Err)
+}
+
+// Unwrap returns Err.
+func (e *StreamError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the Kind of e.
+func (e *StreamError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// GRPCStatus returns the status of Err. Errors without a status become
+// codes.Unavailable for ErrBackendDial and codes.Internal otherwise.
+func (e *StreamError) GRPCStatus() *status.Status {
+	if s, ok := status.FromError(e.Err); ok {
+		return s
+	}
+	switch e.Kind {
+	case ErrBackendDial:
+		return status.Newf(codes.Unavailable, "failed to open backend stream: %v", e.Err)
+	case ErrForwardBackendToClient:
+		return status.Newf(codes.Internal, "failed proxying c2s: %v", e.Err)
+	}
+	return status.Newf(codes.Internal, "failed proxying s2c: %v", e.Err)
+}
@@ -0,0 +1,72 @@
+package proxy_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestStreamError(t *testing.T) {
+	tests := []struct {
+		err  *proxy.StreamError
+		code codes.Code
+		msg  string
+	}{
+		{&proxy.StreamError{Kind: proxy.ErrBackendDial, Backend: "api:443", Err: io.ErrClosedPipe}, codes.Unavailable,
+			`backend stream failed (backend "api:443"): io: read/write on closed pipe`},
+		{&proxy.StreamError{Kind: proxy.ErrForwardClientToBackend, Err: io.ErrUnexpectedEOF}, codes.Internal,
+			`forwarding from client to backend failed: unexpected EOF`},
+		{&proxy.StreamError{Kind: proxy.ErrForwardBackendToClient, Err: status.Error(codes.ResourceExhausted, "too big")}, codes.ResourceExhausted,
+			`forwarding from backend to client failed: rpc error: code = ResourceExhausted desc = too big`},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.code, status.Code(tc.err), tc.msg)
+		assert.Equal(t, tc.msg, tc.err.Error())
+		assert.True(t, errors.Is(tc.err, tc.err.Kind))
+		assert.True(t, errors.Is(tc.err, tc.err.Err), "the cause is wrapped")
+	}
+	assert.False(t, errors.Is(tests[0].err, proxy.ErrForwardClientToBackend))
+	assert.Equal(t, "too big", status.Convert(tests[2].err).Message(), "the status of the cause is kept")
+}
+
+func TestStreamError_BackendDial(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := lis.Addr().String()
+	lis.Close()
+	unreachable, err := grpc.Dial(addr, grpc.WithInsecure(), proxy.DialOption())
+	require.NoError(t, err)
+	defer unreachable.Close()
+
+	mapped := make(chan error, 1)
+	env := newTestEnvWithDirector(t, &pingService{}, func(*grpc.ClientConn) proxy.StreamDirector {
+		return func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+			return ctx, nil, proxy.Direction{BackendConn: unreachable}, nil
+		}
+	}, proxy.WithErrorMapper(func(ctx context.Context, src proxy.ErrorSource, err error) error {
+		mapped <- err
+		return err
+	}))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	_, err = env.client.Ping(ctx, &pb.PingRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err), "clients see the status of the cause")
+
+	var streamErr *proxy.StreamError
+	require.True(t, errors.As(<-mapped, &streamErr))
+	assert.Equal(t, proxy.ErrBackendDial, streamErr.Kind)
+	assert.Equal(t, addr, streamErr.Backend)
+}
@@ -7,21 +7,25 @@ package proxy_test
 
 import (
 	"context"
-	"strings"
+	"net"
+	"time"
 
 	"github.com/mkxxx/grpc-proxy/proxy"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
 )
 
 var (
-	director proxy.StreamDirector
+	director      proxy.StreamDirector
+	authenticator proxy.Authenticator
 )
 
 func ExampleRegisterService() {
 	// A gRPC server with the proxying codec enabled.
-	server := grpc.NewServer(grpc.CustomCodec(proxy.Codec()))
+	server := grpc.NewServer(proxy.ServerOption())
 	// Register a TestService with 4 of its methods explicitly.
 	proxy.RegisterService(server, director,
 		"vgough.testproto.TestService",
@@ -30,20 +34,17 @@ func ExampleRegisterService() {
 
 func ExampleTransparentHandler() {
 	grpc.NewServer(
-		grpc.CustomCodec(proxy.Codec()),
+		proxy.ServerOption(),
 		grpc.UnknownServiceHandler(proxy.TransparentHandler(director)))
 }
 
-// Provide sa simple example of a director that shields internal services and dials a staging or production backend.
+// Provide sa simple example of a director that dials a staging or production backend.
 // This is a *very naive* implementation that creates a new connection on every request. Consider using pooling.
+// Internal services are best shielded with an ACL, see ExampleWithACL.
 type ExampleDirector struct {
 }
 
 func ClientConn(ctx context.Context, method string) (context.Context, context.CancelFunc, *grpc.ClientConn, error) {
-	// Make sure we never forward internal services.
-	if strings.HasPrefix(method, "/com.example.internal.") {
-		return nil, nil, nil, grpc.Errorf(codes.Unimplemented, "Unknown method")
-	}
 	var addr string
 	if md, ok := metadata.FromIncomingContext(ctx); ok {
 		// Decide on which backend to dial
@@ -56,6 +57,96 @@ func ClientConn(ctx context.Context, method string) (context.Context, context.Ca
 	if len(addr) == 0 {
 		return nil, nil, nil, grpc.Errorf(codes.Unimplemented, "Unknown method")
 	}
-	conn, err := grpc.DialContext(ctx, addr, grpc.WithCodec(proxy.Codec()))
+	conn, err := grpc.DialContext(ctx, addr, proxy.DialOption())
 	return context.Background(), nil, conn, err
 }
+
+func ExampleRouter() {
+	staging, _ := grpc.Dial("api-service.staging.svc.local", proxy.DialOption())
+	prod, _ := grpc.Dial("api-service.prod.svc.local", proxy.DialOption())
+
+	router := proxy.NewRouter()
+	router.AddBackend("staging", staging)
+	router.AddBackend("prod", prod)
+	router.AddRoute(proxy.Route{Authority: "staging.api.example.com", Backend: "staging"})
+	router.AddRoute(proxy.Route{Authority: "api.example.com", Backend: "prod"})
+
+	grpc.NewServer(
+		proxy.ServerOption(),
+		grpc.UnknownServiceHandler(proxy.TransparentHandler(router.Direct)))
+}
+
+func ExampleBackendRegistry() {
+	creds, _ := credentials.NewClientTLSFromFile("/etc/ssl/internal-ca.pem", "")
+
+	backends := proxy.NewBackendRegistry()
+	backends.Register("api", proxy.BackendConfig{
+		Address:     "api-service.prod.svc.local:443",
+		Credentials: creds,
+		Authority:   "api.internal.example.com",
+		Keepalive:   &keepalive.ClientParameters{Time: time.Minute},
+	})
+	director := backends.Director(func(ctx context.Context, method string) (string, error) {
+		return "api", nil
+	})
+
+	grpc.NewServer(
+		proxy.ServerOption(),
+		grpc.UnknownServiceHandler(proxy.TransparentHandler(director)))
+}
+
+func ExampleWithACL() {
+	_, office, _ := net.ParseCIDR("10.20.0.0/16")
+	acl := &proxy.ACL{
+		Rules: []proxy.ACLRule{
+			// Internal services may only be called by the admin service,
+			// from the office network.
+			{MethodPrefix: "/com.example.internal.", Subjects: []string{"admin"}, Peers: []*net.IPNet{office}},
+			// Make sure we never forward them otherwise.
+			{MethodPrefix: "/com.example.internal.", Deny: true},
+		},
+		DefaultAllow: true,
+		Hide:         true,
+	}
+
+	grpc.NewServer(
+		proxy.ServerOption(),
+		grpc.UnknownServiceHandler(proxy.TransparentHandler(director, proxy.WithACL(acl))))
+}
+
+func ExampleNewMaglevBalancer() {
+	cache1, _ := grpc.Dial("cache-1.internal:443", proxy.DialOption())
+	cache2, _ := grpc.Dial("cache-2.internal:443", proxy.DialOption())
+
+	router := proxy.NewRouter()
+	router.AddBalancedBackend("cache", proxy.NewMaglevBalancer(proxy.Endpoints(cache1, cache2)...))
+	router.AddRoute(proxy.Route{MethodPrefix: "/cache.CacheService/", Backend: "cache"})
+
+	// Send all calls for a shard to the same cache.
+	director := func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+		if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("x-shard")) != 0 {
+			ctx = proxy.NewContextWithHashKey(ctx, md.Get("x-shard")[0])
+		}
+		return router.Direct(ctx, method)
+	}
+
+	grpc.NewServer(
+		proxy.ServerOption(),
+		grpc.UnknownServiceHandler(proxy.TransparentHandler(director)))
+}
+
+func ExampleWithTunnel() {
+	// Authenticated clients may reach the database through the proxy.
+	grpc.NewServer(
+		proxy.ServerOption(),
+		grpc.UnknownServiceHandler(proxy.TransparentHandler(director,
+			proxy.WithAuthenticator(authenticator),
+			proxy.WithTunnel("/tunnel.Tunnel/Postgres", proxy.TCPTunnel("db.internal:5432")))))
+
+	// Clients get a net.Conn for the database driver.
+	gateway, _ := grpc.Dial("gateway.example.com:443", grpc.WithInsecure())
+	conn, err := proxy.DialTunnel(context.Background(), gateway, "/tunnel.Tunnel/Postgres")
+	if err == nil {
+		conn.Close()
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// maxFailoverMessages and maxFailoverBytes limit the client messages a
+	// failoverStream buffers for replay. Past either, the call stays with
+	// the current backend.
+	maxFailoverMessages = 64
+	maxFailoverBytes    = 1 << 20
+)
+
+// failoverStream is a ClientStream which moves the call to the next backend
+// when the current one fails with codes.Unavailable before responding.
+//
+// Until the first response message or final status is received, client
+// messages are buffered and a failed send is not reported, as the messages
+// are replayed to the next backend. When the buffer would grow past
+// maxFailoverMessages or maxFailoverBytes, it is dropped and the call is
+// committed to the current backend.
+type failoverStream struct {
+	ctx      context.Context
+	method   string
+	callOpts []grpc.CallOption
+	backends []*grpc.ClientConn
+
+	mu        sync.Mutex
+	cur       grpc.ClientStream
+	sent      []*frame
+	sentBytes int
+	closed    bool
+	committed bool
+	// full is set when the messages sent no longer fit the buffer, so the
+	// call can not fail over.
+	full bool
+
+	primeOnce sync.Once
+	primed    bool
+	first     *frame
+	firstErr  error
+	openErr   error
+}
+
+func newFailoverStream(ctx context.Context, conns []*grpc.ClientConn, method string, callOpts ...grpc.CallOption) (grpc.ClientStream, error) {
+	s := &failoverStream{ctx: ctx, method: method, callOpts: callOpts, backends: conns}
+	if err := s.failover(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// failover opens a stream to the next backend and replays the buffered
+// messages. It must be called with s.mu held, or before s is shared.
+func (s *failoverStream) failover() error {
+	for {
+		conn := s.backends[0]
+		s.backends = s.backends[1:]
+		out, err := replayStream(s.ctx, conn, s.method, s.sent, s.closed, s.callOpts...)
+		if err == nil {
+			s.cur = out
+			return nil
+		}
+		if !s.canFailover(err) {
+			return err
+		}
+	}
+}
+
+func (s *failoverStream) canFailover(err error) bool {
+	return !s.full && len(s.backends) != 0 && status.Code(err) == codes.Unavailable && s.ctx.Err() == nil
+}
+
+// prime receives the first response message, failing over as needed.
+func (s *failoverStream) prime() {
+	s.primeOnce.Do(func() {
+		for {
+			s.mu.Lock()
+			cur := s.cur
+			s.mu.Unlock()
+
+			f := &frame{}
+			err := cur.RecvMsg(f)
+			s.mu.Lock()
+			if err == nil || err == io.EOF || !s.canFailover(err) {
+				s.commit(f, err)
+				s.mu.Unlock()
+				return
+			}
+			if err := s.failover(); err != nil {
+				s.openErr = err
+				s.commit(nil, err)
+				s.mu.Unlock()
+				return
+			}
+			s.mu.Unlock()
+		}
+	})
+}
+
+// commit ends buffering, with the first response of the call.
+func (s *failoverStream) commit(first *frame, err error) {
+	s.committed = true
+	s.sent, s.sentBytes = nil, 0
+	s.primed = true
+	s.first, s.firstErr = first, err
+}
+
+func (s *failoverStream) current() grpc.ClientStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cur
+}
+
+func (s *failoverStream) Header() (metadata.MD, error) {
+	s.prime()
+	if s.openErr != nil {
+		return nil, s.openErr
+	}
+	return s.current().Header()
+}
+
+func (s *failoverStream) Trailer() metadata.MD {
+	return s.current().Trailer()
+}
+
+func (s *failoverStream) Context() context.Context {
+	return s.current().Context()
+}
+
+func (s *failoverStream) SendMsg(m interface{}) error {
+	s.mu.Lock()
+	if s.committed {
+		cur := s.cur
+		s.mu.Unlock()
+		return cur.SendMsg(m)
+	}
+	if f, ok := m.(*frame); ok && !s.full {
+		if len(s.sent) >= maxFailoverMessages || s.sentBytes+len(f.payload) > maxFailoverBytes {
+			s.full, s.sent, s.sentBytes = true, nil, 0
+		} else {
+			// The caller may reuse the frame for the next message.
+			s.sent = append(s.sent, &frame{payload: f.payload})
+			s.sentBytes += len(f.payload)
+		}
+	}
+	// The send may block on flow control until the response is read, so
+	// it must not hold s.mu, which prime needs. If the call fails over in
+	// the meantime, the message is replayed from the buffer.
+	cur := s.cur
+	s.mu.Unlock()
+	if err := cur.SendMsg(m); err != nil && err != io.EOF {
+		return err
+	}
+	// A failed send is reported through RecvMsg, and either fails over or
+	// ends the call.
+	return nil
+}
+
+func (s *failoverStream) CloseSend() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return s.cur.CloseSend()
+}
+
+func (s *failoverStream) RecvMsg(m interface{}) error {
+	s.prime()
+	s.mu.Lock()
+	primed, first, err := s.primed, s.first, s.firstErr
+	s.primed = false
+	s.mu.Unlock()
+	if !primed {
+		return s.current().RecvMsg(m)
+	}
+	if err != nil {
+		return err
+	}
+	f, ok := m.(*frame)
+	if !ok {
+		return status.Errorf(codes.Internal, "unexpected message type %T", m)
+	}
+	f.payload = first.payload
+	return nil
+}
@@ -0,0 +1,220 @@
+package proxy_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// failingService fails every call with the given code, after reading the
+// first stream message.
+func failingService(code codes.Code, calls *int32) *pingService {
+	return &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			atomic.AddInt32(calls, 1)
+			return nil, status.Error(code, "failing")
+		},
+		pingStream: func(stream pb.TestService_PingStreamServer) error {
+			atomic.AddInt32(calls, 1)
+			if _, err := stream.Recv(); err != nil {
+				return err
+			}
+			return status.Error(code, "failing")
+		},
+	}
+}
+
+// deadConn returns a connection to a port nobody listens on.
+func deadConn(t *testing.T) *grpc.ClientConn {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := lis.Addr().String()
+	lis.Close()
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), proxy.DialOption())
+	require.NoError(t, err)
+	return conn
+}
+
+func failoverEnv(t *testing.T, primary pb.TestServiceServer, failover ...*grpc.ClientConn) *testEnv {
+	return newTestEnvWithDirector(t, primary, func(backend *grpc.ClientConn) proxy.StreamDirector {
+		return func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+			return ctx, nil, proxy.Direction{BackendConn: backend, Failover: failover}, nil
+		}
+	})
+}
+
+func TestFailover_Unary(t *testing.T) {
+	dead := deadConn(t)
+	defer dead.Close()
+	secondaryServer, secondary := startBackend(t, namedService("secondary"))
+	defer secondaryServer.Stop()
+	defer secondary.Close()
+
+	var calls int32
+	env := failoverEnv(t, failingService(codes.Unavailable, &calls), dead, secondary)
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	out, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err)
+	assert.Equal(t, "secondary", out.Value)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+}
+
+func TestFailover_StreamReplaysMessages(t *testing.T) {
+	secondaryServer, secondary := startBackend(t, &pingService{})
+	defer secondaryServer.Stop()
+	defer secondary.Close()
+
+	var calls int32
+	env := failoverEnv(t, failingService(codes.Unavailable, &calls), secondary)
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	stream, err := env.client.PingStream(ctx)
+	require.NoError(t, err)
+	values := []string{"a", "b", "c"}
+	for _, v := range values {
+		require.NoError(t, stream.Send(&pb.PingRequest{Value: v}))
+	}
+	require.NoError(t, stream.CloseSend())
+	for i, v := range values {
+		out, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, v, out.Value)
+		assert.EqualValues(t, i, out.Counter)
+	}
+	_, err = stream.Recv()
+	assert.Equal(t, io.EOF, err)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+}
+
+func TestFailover_OnlyOnUnavailable(t *testing.T) {
+	var secondaryCalls, calls int32
+	secondaryServer, secondary := startBackend(t, countingService(&secondaryCalls))
+	defer secondaryServer.Stop()
+	defer secondary.Close()
+
+	env := failoverEnv(t, failingService(codes.FailedPrecondition, &calls), secondary)
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.EqualValues(t, 0, atomic.LoadInt32(&secondaryCalls))
+}
+
+func TestFailover_AllBackendsDown(t *testing.T) {
+	dead := deadConn(t)
+	defer dead.Close()
+	var calls int32
+	env := failoverEnv(t, failingService(codes.Unavailable, &calls), dead)
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestFailover_BufferLimit(t *testing.T) {
+	secondaryServer, secondary := startBackend(t, &pingService{})
+	defer secondaryServer.Stop()
+	defer secondary.Close()
+
+	// The primary reads the whole request before failing.
+	primary := &pingService{
+		pingStream: func(stream pb.TestService_PingStreamServer) error {
+			for {
+				if _, err := stream.Recv(); err == io.EOF {
+					return status.Error(codes.Unavailable, "failing")
+				} else if err != nil {
+					return err
+				}
+			}
+		},
+	}
+	env := failoverEnv(t, primary, secondary)
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	stream, err := env.client.PingStream(ctx)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, stream.Send(&pb.PingRequest{Value: "foo"}))
+	}
+	require.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err), "too many messages to replay")
+}
+
+func TestFailover_BidiAnswersBeforeReading(t *testing.T) {
+	dead := deadConn(t)
+	defer dead.Close()
+
+	read := make(chan struct{})
+	primary := &pingService{
+		pingStream: func(stream pb.TestService_PingStreamServer) error {
+			if _, err := stream.Recv(); err != nil {
+				return err
+			}
+			// Answer once the proxy is blocked sending the request.
+			time.Sleep(100 * time.Millisecond)
+			if err := stream.Send(&pb.PingResponse{Value: "first"}); err != nil {
+				return err
+			}
+			// Leave the rest of the request unread until the client has
+			// the response, so that flow control blocks the proxy.
+			<-read
+			for {
+				if _, err := stream.Recv(); err == io.EOF {
+					return nil
+				} else if err != nil {
+					return err
+				}
+			}
+		},
+	}
+	env := failoverEnv(t, primary, dead)
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	stream, err := env.client.PingStream(ctx)
+	require.NoError(t, err)
+	sent := make(chan error, 1)
+	go func() {
+		value := strings.Repeat("x", 256<<10)
+		for i := 0; i < 64; i++ {
+			if err := stream.Send(&pb.PingRequest{Value: value}); err != nil {
+				sent <- err
+				return
+			}
+		}
+		sent <- stream.CloseSend()
+	}()
+	out, err := stream.Recv()
+	require.NoError(t, err, "the response must arrive while the request is blocked")
+	assert.Equal(t, "first", out.Value)
+	close(read)
+	require.NoError(t, <-sent)
+	_, err = stream.Recv()
+	assert.Equal(t, io.EOF, err)
+}
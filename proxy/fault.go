@@ -0,0 +1,205 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Fault describes the faults injected into calls, for testing the
+// resilience of clients. Each kind of fault is injected into a call with
+// its own probability, from 0 to 1.
+type Fault struct {
+	// Delay holds calls back before they are directed, with probability
+	// DelayRate.
+	Delay     time.Duration
+	DelayRate float64
+
+	// Abort fails calls before they reach the backend, with probability
+	// AbortRate. If Abort is codes.OK, calls fail with codes.Unavailable.
+	Abort        codes.Code
+	AbortMessage string
+	AbortRate    float64
+
+	// TruncateAfter cuts the response stream of calls after this many
+	// messages, with probability TruncateRate. The client then gets
+	// codes.Unavailable, as if the backend went away.
+	TruncateAfter int
+	TruncateRate  float64
+}
+
+// FaultInjector holds the faults of methods, which may be changed while
+// serving, see WithFaultInjector.
+type FaultInjector struct {
+	mu       sync.RWMutex
+	disabled bool
+	faults   map[string]Fault
+}
+
+// NewFaultInjector returns an enabled FaultInjector without faults.
+func NewFaultInjector() *FaultInjector {
+	return &FaultInjector{faults: make(map[string]Fault)}
+}
+
+// WithFaultInjector injects the faults of f into calls. Faults are applied
+// after authentication and the ACL, so only authorized calls see them.
+func WithFaultInjector(f *FaultInjector) Option {
+	return func(o *options) {
+		o.faults = f
+	}
+}
+
+// Set sets the fault of methods whose full method name starts with prefix.
+// An empty prefix matches every method. When several prefixes match, the
+// longest wins.
+func (f *FaultInjector) Set(prefix string, fault Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults[prefix] = fault
+}
+
+// Remove removes the fault set for prefix.
+func (f *FaultInjector) Remove(prefix string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.faults, prefix)
+}
+
+// Enable injects the faults again after Disable.
+func (f *FaultInjector) Enable() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.disabled = false
+}
+
+// Disable stops injecting faults, keeping them for Enable.
+func (f *FaultInjector) Disable() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.disabled = true
+}
+
+// Enabled reports whether faults are injected.
+func (f *FaultInjector) Enabled() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return !f.disabled
+}
+
+// MethodFault is a fault and its method prefix.
+type MethodFault struct {
+	Prefix string
+	Fault
+}
+
+// Faults returns the faults, ordered by prefix.
+func (f *FaultInjector) Faults() []MethodFault {
+	f.mu.RLock()
+	faults := make([]MethodFault, 0, len(f.faults))
+	for prefix, fault := range f.faults {
+		faults = append(faults, MethodFault{Prefix: prefix, Fault: fault})
+	}
+	f.mu.RUnlock()
+	sort.Slice(faults, func(i, j int) bool { return faults[i].Prefix < faults[j].Prefix })
+	return faults
+}
+
+// injectedFault is the fault picked for a single call.
+type injectedFault struct {
+	delay time.Duration
+	abort error
+	// truncateAfter is negative if the responses are not truncated.
+	truncateAfter int
+}
+
+// pick rolls the faults of a call to method, returning nil if none is
+// injected.
+func (f *FaultInjector) pick(method string) *injectedFault {
+	f.mu.RLock()
+	if f.disabled {
+		f.mu.RUnlock()
+		return nil
+	}
+	var fault Fault
+	found := false
+	bestLen := -1
+	for prefix, ft := range f.faults {
+		if len(prefix) > bestLen && strings.HasPrefix(method, prefix) {
+			fault, found, bestLen = ft, true, len(prefix)
+		}
+	}
+	f.mu.RUnlock()
+	if !found {
+		return nil
+	}
+	inj := &injectedFault{truncateAfter: -1}
+	injected := false
+	if fault.Delay > 0 && roll(fault.DelayRate) {
+		inj.delay = fault.Delay
+		injected = true
+	}
+	if roll(fault.AbortRate) {
+		code := fault.Abort
+		if code == codes.OK {
+			code = codes.Unavailable
+		}
+		msg := fault.AbortMessage
+		if msg == "" {
+			msg = "fault injected by proxy"
+		}
+		inj.abort = status.Error(code, msg)
+		injected = true
+	}
+	if fault.TruncateAfter >= 0 && roll(fault.TruncateRate) {
+		inj.truncateAfter = fault.TruncateAfter
+		injected = true
+	}
+	if !injected {
+		return nil
+	}
+	return inj
+}
+
+func roll(rate float64) bool {
+	return rate > 0 && (rate >= 1 || rand.Float64() < rate)
+}
+
+// inject applies the delay and abort of the fault.
+func (inj *injectedFault) inject(ctx context.Context) error {
+	if inj.delay > 0 {
+		timer := time.NewTimer(inj.delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	return inj.abort
+}
+
+// truncatedServerStream fails the response stream after a number of
+// messages.
+type truncatedServerStream struct {
+	grpc.ServerStream
+	remaining int
+}
+
+func (s *truncatedServerStream) SendMsg(m interface{}) error {
+	if s.remaining <= 0 {
+		return status.Error(codes.Unavailable, "stream truncated by proxy fault injection")
+	}
+	s.remaining--
+	return s.ServerStream.SendMsg(m)
+}
@@ -0,0 +1,93 @@
+package proxy_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestFaultInjector_Abort(t *testing.T) {
+	calls := 0
+	svc := &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			calls++
+			return &pb.PingResponse{Value: ping.Value}, nil
+		},
+	}
+	faults := proxy.NewFaultInjector()
+	faults.Set("/vgough.testproto.TestService/", proxy.Fault{Abort: codes.ResourceExhausted, AbortMessage: "chaos", AbortRate: 1})
+	faults.Set("/vgough.testproto.TestService/PingEmpty", proxy.Fault{AbortRate: 1})
+	env := newTestEnv(t, svc, proxy.WithFaultInjector(faults))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "x"})
+	assert.Equal(t, status.Error(codes.ResourceExhausted, "chaos"), err)
+	assert.Equal(t, 0, calls, "aborted calls do not reach the backend")
+	_, err = env.client.PingEmpty(ctx, &pb.Empty{})
+	assert.Equal(t, codes.Unavailable, status.Code(err), "the longest prefix wins")
+
+	faults.Disable()
+	assert.False(t, faults.Enabled())
+	_, err = env.client.Ping(ctx, &pb.PingRequest{Value: "x"})
+	assert.NoError(t, err)
+	faults.Enable()
+	faults.Remove("/vgough.testproto.TestService/")
+	_, err = env.client.Ping(ctx, &pb.PingRequest{Value: "x"})
+	assert.NoError(t, err)
+	_, err = env.client.PingEmpty(ctx, &pb.Empty{})
+	assert.Error(t, err)
+
+	assert.Equal(t, []proxy.MethodFault{{Prefix: "/vgough.testproto.TestService/PingEmpty", Fault: proxy.Fault{AbortRate: 1}}}, faults.Faults())
+}
+
+func TestFaultInjector_Delay(t *testing.T) {
+	faults := proxy.NewFaultInjector()
+	faults.Set("", proxy.Fault{Delay: 100 * time.Millisecond, DelayRate: 1})
+	env := newTestEnv(t, &pingService{}, proxy.WithFaultInjector(faults))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	start := time.Now()
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "x"})
+	require.NoError(t, err)
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+
+	faults.Set("", proxy.Fault{Delay: time.Minute, DelayRate: 1})
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = env.client.Ping(short, &pb.PingRequest{Value: "x"})
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err), "delays end with the call")
+
+	faults.Set("", proxy.Fault{Delay: time.Minute})
+	_, err = env.client.Ping(ctx, &pb.PingRequest{Value: "x"})
+	assert.NoError(t, err, "faults with a zero rate are never injected")
+}
+
+func TestFaultInjector_Truncate(t *testing.T) {
+	faults := proxy.NewFaultInjector()
+	faults.Set("/vgough.testproto.TestService/PingList", proxy.Fault{TruncateAfter: 2, TruncateRate: 1})
+	env := newTestEnv(t, &pingService{}, proxy.WithFaultInjector(faults))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	stream, err := env.client.PingList(ctx, &pb.PingRequest{Value: "x"})
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err := stream.Recv()
+		require.NoError(t, err)
+	}
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
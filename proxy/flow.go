@@ -0,0 +1,305 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// FlowControl tunes how messages are copied in one direction of a stream.
+//
+// By default each message is forwarded before the next one is read, so a
+// slow receiver immediately slows down the sender. Buffering lets the proxy
+// read ahead of the receiver to absorb bursts, while the limits keep memory
+// bounded: once they are reached, reading from the sender blocks until the
+// receiver catches up.
+//
+// The rates throttle each stream on its own, to simulate constrained
+// networks or to protect backends from bulk streaming clients. Throttled
+// messages wait before they are forwarded, which in turn slows down the
+// sender through flow control.
+type FlowControl struct {
+	// Buffer is the number of messages read ahead of the receiver.
+	Buffer int
+
+	// MaxBufferedBytes, if positive, also limits the total size of the
+	// messages read ahead. A single message larger than the limit is still
+	// forwarded, on its own.
+	MaxBufferedBytes int
+
+	// Batch, if greater than one, writes read-ahead messages to the
+	// receiver in batches of up to Batch messages, which the transport
+	// sends with fewer writes. Buffer is raised to Batch if lower.
+	Batch int
+
+	// BatchDelay is how long a batch waits for more messages after the
+	// first one. If zero, a batch only holds the messages already read.
+	BatchDelay time.Duration
+
+	// MessageRate, if positive, limits the messages forwarded per second.
+	MessageRate float64
+
+	// ByteRate, if positive, limits the payload bytes forwarded per second.
+	// A message is forwarded at once, and the next one waits for the time
+	// its size takes at this rate.
+	ByteRate int
+
+	// Jitter, if positive, delays every message by a random duration of up
+	// to Jitter.
+	Jitter time.Duration
+}
+
+// WithFlowControl sets the flow control of the given direction of streams.
+func WithFlowControl(dir FrameDirection, fc FlowControl) Option {
+	if fc.Batch > fc.Buffer {
+		fc.Buffer = fc.Batch
+	}
+	return func(o *options) {
+		o.flow[dir] = &fc
+	}
+}
+
+// flowControls holds the flow control of each direction, nil for
+// unbuffered copying.
+type flowControls [2]*FlowControl
+
+// copyStream copies messages from src to dst until either fails, using fc
+// if it is set.
+func (fc *FlowControl) copyStream(src grpc.Stream, dst grpc.Stream) error {
+	if fc == nil {
+		return copyStream(src, dst)
+	}
+	sh := fc.newShaper(dst.Context())
+	if fc.Buffer <= 0 {
+		if sh == nil {
+			return copyStream(src, dst)
+		}
+		return sh.copyStream(src, dst)
+	}
+
+	queue := make(chan *frame, fc.Buffer)
+	budget := newByteBudget(fc.MaxBufferedBytes)
+	recvErr := make(chan error, 1)
+	where := panicInClientToBackend
+	if _, ok := src.(grpc.ClientStream); ok {
+		where = panicInBackendToClient
+	}
+	go func() {
+		defer close(queue)
+		defer recoverTo(recvErr, where)
+		for {
+			f := getFrame()
+			if err := src.RecvMsg(f); err != nil {
+				putFrame(f)
+				recvErr <- err
+				return
+			}
+			if !budget.acquire(len(f.payload)) {
+				putFrame(f)
+				return
+			}
+			queue <- f
+		}
+	}()
+
+	// Once sending fails, nothing drains the queue; closing the budget
+	// and draining lets the reader exit when its next read returns.
+	fail := func(err error) error {
+		budget.close()
+		go func() {
+			for f := range queue {
+				putFrame(f)
+			}
+		}()
+		return err
+	}
+	batch := make([]*frame, 0, fc.Batch)
+	for f := range queue {
+		batch = append(batch[:0], f)
+		batch = fc.fillBatch(batch, queue)
+		for i, f := range batch {
+			err := sh.wait(len(f.payload))
+			if err == nil {
+				err = dst.SendMsg(f)
+			}
+			budget.release(len(f.payload))
+			putFrame(f)
+			if err != nil {
+				for _, f := range batch[i+1:] {
+					putFrame(f)
+				}
+				return fail(err)
+			}
+		}
+	}
+	return <-recvErr
+}
+
+// fillBatch adds queued messages to batch, up to the batch size.
+func (fc *FlowControl) fillBatch(batch []*frame, queue <-chan *frame) []*frame {
+	if fc.Batch <= 1 {
+		return batch
+	}
+	var timeout <-chan time.Time
+	if fc.BatchDelay > 0 {
+		timer := time.NewTimer(fc.BatchDelay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for len(batch) < fc.Batch {
+		var f *frame
+		ok := true
+		if timeout == nil {
+			select {
+			case f, ok = <-queue:
+			default:
+				return batch
+			}
+		} else {
+			select {
+			case f, ok = <-queue:
+			case <-timeout:
+				return batch
+			}
+		}
+		if !ok {
+			return batch
+		}
+		batch = append(batch, f)
+	}
+	return batch
+}
+
+// shaper paces the messages of a stream to the rates of a FlowControl.
+type shaper struct {
+	ctx         context.Context
+	messageRate float64
+	byteRate    int
+	jitter      time.Duration
+
+	// next is the earliest time the next message may be sent.
+	next time.Time
+}
+
+// newShaper returns the shaper of a stream with context ctx, or nil if fc
+// does not throttle.
+func (fc *FlowControl) newShaper(ctx context.Context) *shaper {
+	if fc.MessageRate <= 0 && fc.ByteRate <= 0 && fc.Jitter <= 0 {
+		return nil
+	}
+	return &shaper{ctx: ctx, messageRate: fc.MessageRate, byteRate: fc.ByteRate, jitter: fc.Jitter}
+}
+
+// wait blocks until a message of n bytes may be sent, or the stream ends.
+// A nil shaper never waits.
+func (s *shaper) wait(n int) error {
+	if s == nil {
+		return nil
+	}
+	now := time.Now()
+	if s.next.Before(now) {
+		s.next = now
+	}
+	delay := s.next.Sub(now)
+	if s.jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(s.jitter)))
+	}
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-s.ctx.Done():
+			timer.Stop()
+			return status.FromContextError(s.ctx.Err()).Err()
+		}
+	}
+	var interval time.Duration
+	if s.messageRate > 0 {
+		interval = time.Duration(float64(time.Second) / s.messageRate)
+	}
+	if s.byteRate > 0 {
+		if d := time.Duration(n) * time.Second / time.Duration(s.byteRate); d > interval {
+			interval = d
+		}
+	}
+	s.next = s.next.Add(interval)
+	return nil
+}
+
+// copyStream is the unbuffered copyStream with throttling.
+func (s *shaper) copyStream(src grpc.Stream, dst grpc.Stream) error {
+	var f frame
+	for {
+		if err := src.RecvMsg(&f); err != nil {
+			return err
+		}
+		if err := s.wait(len(f.payload)); err != nil {
+			return err
+		}
+		if err := dst.SendMsg(&f); err != nil {
+			return err
+		}
+	}
+}
+
+// byteBudget limits the bytes read ahead. A zero max means no limit.
+type byteBudget struct {
+	max int
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	used   int
+	closed bool
+}
+
+func newByteBudget(max int) *byteBudget {
+	b := &byteBudget{max: max}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire waits until n bytes fit in the budget, or anything if nothing is
+// buffered. It returns false once the budget is closed.
+func (b *byteBudget) acquire(n int) bool {
+	if b.max <= 0 {
+		return !b.isClosed()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for !b.closed && b.used > 0 && b.used+n > b.max {
+		b.cond.Wait()
+	}
+	b.used += n
+	return !b.closed
+}
+
+func (b *byteBudget) release(n int) {
+	if b.max <= 0 {
+		return
+	}
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+func (b *byteBudget) close() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+func (b *byteBudget) isClosed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closed
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// sourceStream produces count messages of size bytes, counting reads.
+type sourceStream struct {
+	count, size int
+	reads       int32
+}
+
+func (s *sourceStream) Context() context.Context { return context.Background() }
+func (s *sourceStream) SendMsg(m interface{}) error {
+	return errors.New("not implemented")
+}
+
+func (s *sourceStream) RecvMsg(m interface{}) error {
+	n := int(atomic.AddInt32(&s.reads, 1))
+	if n > s.count {
+		return io.EOF
+	}
+	payload := make([]byte, s.size)
+	payload[0] = byte(n)
+	m.(*frame).payload = payload
+	return nil
+}
+
+// sinkStream records messages, blocking sends until release is closed.
+type sinkStream struct {
+	release chan struct{}
+	fail    error
+	ctx     context.Context
+
+	mu       sync.Mutex
+	received []byte
+	sends    []time.Time
+}
+
+func (s *sinkStream) SetHeader(metadata.MD) error { return nil }
+func (s *sinkStream) Context() context.Context {
+	if s.ctx != nil {
+		return s.ctx
+	}
+	return context.Background()
+}
+func (s *sinkStream) RecvMsg(m interface{}) error {
+	return errors.New("not implemented")
+}
+
+func (s *sinkStream) SendMsg(m interface{}) error {
+	if s.release != nil {
+		<-s.release
+	}
+	if s.fail != nil {
+		return s.fail
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.received = append(s.received, m.(*frame).payload[0])
+	s.sends = append(s.sends, time.Now())
+	return nil
+}
+
+func TestFlowControl_PreservesOrder(t *testing.T) {
+	for _, fc := range []*FlowControl{
+		nil,
+		{Buffer: 4},
+		{Buffer: 4, Batch: 3},
+		{Buffer: 2, Batch: 3, BatchDelay: time.Millisecond},
+		{Buffer: 8, MaxBufferedBytes: 64},
+		{MessageRate: 10000},
+		{Buffer: 4, Jitter: time.Microsecond},
+	} {
+		src := &sourceStream{count: 50, size: 16}
+		dst := &sinkStream{}
+		err := fc.copyStream(src, dst)
+		assert.Equal(t, io.EOF, err)
+		require.Len(t, dst.received, 50)
+		for i, b := range dst.received {
+			assert.Equal(t, byte(i+1), b, "messages must be forwarded in order")
+		}
+	}
+}
+
+func TestFlowControl_BlocksReadsWhenReceiverLags(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		fc       *FlowControl
+		maxReads int32
+	}{
+		// The receiver holds one message, the queue holds Buffer and the
+		// reader holds one waiting to be queued, plus the read in progress.
+		{name: "unbuffered", fc: nil, maxReads: 1},
+		{name: "buffer", fc: &FlowControl{Buffer: 3}, maxReads: 1 + 3 + 1 + 1},
+		{name: "bytes", fc: &FlowControl{Buffer: 100, MaxBufferedBytes: 3 * 16}, maxReads: 1 + 3 + 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src := &sourceStream{count: 1000, size: 16}
+			dst := &sinkStream{release: make(chan struct{})}
+			done := make(chan error, 1)
+			go func() { done <- tc.fc.copyStream(src, dst) }()
+
+			time.Sleep(50 * time.Millisecond)
+			assert.True(t, atomic.LoadInt32(&src.reads) <= tc.maxReads,
+				"read %d messages ahead of a blocked receiver", atomic.LoadInt32(&src.reads))
+			close(dst.release)
+			assert.Equal(t, io.EOF, <-done)
+			assert.Len(t, dst.received, 1000)
+		})
+	}
+}
+
+func TestFlowControl_Batching(t *testing.T) {
+	src := &sourceStream{count: 4, size: 1}
+	dst := &sinkStream{}
+	fc := &FlowControl{Buffer: 4, Batch: 4, BatchDelay: 20 * time.Millisecond}
+	require.Equal(t, io.EOF, fc.copyStream(src, dst))
+	require.Len(t, dst.sends, 4)
+	assert.True(t, dst.sends[3].Sub(dst.sends[0]) < 10*time.Millisecond, "batched messages must be written back to back")
+}
+
+func TestFlowControl_SendFailure(t *testing.T) {
+	src := &sourceStream{count: 1000, size: 16}
+	dst := &sinkStream{fail: errors.New("receiver gone")}
+	fc := &FlowControl{Buffer: 4, MaxBufferedBytes: 32}
+	assert.EqualError(t, fc.copyStream(src, dst), "receiver gone")
+}
+
+func TestFlowControl_Throttling(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		fc   *FlowControl
+	}{
+		{name: "messages", fc: &FlowControl{MessageRate: 50}},
+		{name: "bytes", fc: &FlowControl{ByteRate: 50 * 100}},
+		{name: "buffered", fc: &FlowControl{Buffer: 4, MessageRate: 50}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src := &sourceStream{count: 5, size: 100}
+			dst := &sinkStream{}
+			require.Equal(t, io.EOF, tc.fc.copyStream(src, dst))
+			require.Len(t, dst.sends, 5)
+			for i := 1; i < 5; i++ {
+				assert.True(t, dst.sends[i].Sub(dst.sends[i-1]) >= 15*time.Millisecond,
+					"message %d sent %v after the previous one", i, dst.sends[i].Sub(dst.sends[i-1]))
+			}
+		})
+	}
+}
+
+func TestFlowControl_ThrottlingEndsWithStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	src := &sourceStream{count: 5, size: 1}
+	dst := &sinkStream{ctx: ctx}
+	fc := &FlowControl{MessageRate: 0.1}
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	err := fc.copyStream(src, dst)
+	assert.Equal(t, codes.Canceled, status.Code(err))
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Len(t, dst.received, 1)
+}
@@ -0,0 +1,152 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// Forwarded is the metadata key of the RFC 7239 Forwarded header.
+const Forwarded = "Forwarded"
+
+// ForwardingPolicy configures how CopyMetadata reports the client address to
+// backends, see WithForwarding.
+type ForwardingPolicy struct {
+	// TrustedProxies lists the networks of peers whose X-Forwarded-For and
+	// Forwarded metadata is forwarded. For any other peer, the metadata is
+	// replaced by the peer address, so that clients cannot spoof their
+	// address. When nil, every peer is trusted.
+	TrustedProxies []*net.IPNet
+
+	// Replace drops the incoming X-Forwarded-For and Forwarded metadata
+	// even from trusted peers, so backends only see the peer address.
+	Replace bool
+
+	// MaxChain limits the number of addresses forwarded. The oldest
+	// addresses are dropped first. Zero means no limit.
+	MaxChain int
+
+	// Forwarded also adds RFC 7239 Forwarded metadata, with the peer
+	// address, the :authority of the call and the protocol.
+	Forwarded bool
+
+	// Normalize forwards the peer address in canonical form: without its
+	// zone, and IPv4-mapped IPv6 addresses as IPv4.
+	Normalize bool
+
+	// IPv4Prefix and IPv6Prefix, if set, anonymize the forwarded peer
+	// address by keeping only its first bits, such as 24 for IPv4 and 64
+	// for IPv6. The address is also normalized. TrustedProxies still
+	// applies to the full address.
+	IPv4Prefix int
+	IPv6Prefix int
+}
+
+// WithForwarding sets the policy used by CopyMetadata, both for the
+// metadata the handler copies and for directors calling CopyMetadata with
+// the context of a call. Without it, the peer address is appended to
+// X-Forwarded-For of every call.
+func WithForwarding(p *ForwardingPolicy) Option {
+	return func(o *options) {
+		o.forwarding = p
+	}
+}
+
+type forwardingKey struct{}
+
+func forwardingFromContext(ctx context.Context) *ForwardingPolicy {
+	p, _ := ctx.Value(forwardingKey{}).(*ForwardingPolicy)
+	return p
+}
+
+// trusts reports whether forwarding metadata from the peer at ip is kept.
+func (p *ForwardingPolicy) trusts(ip string) bool {
+	if p.Replace {
+		return false
+	}
+	return p.TrustedProxies == nil || inNetworks(p.TrustedProxies, ip)
+}
+
+// apply updates the forwarding metadata in md for a call from serverCtx.
+func (p *ForwardingPolicy) apply(md metadata.MD, serverCtx context.Context, remoteIp string) {
+	if !p.trusts(remoteIp) {
+		delete(md, strings.ToLower(XForwardedFor))
+		delete(md, strings.ToLower(Forwarded))
+	}
+	if len(remoteIp) != 0 {
+		if p.Normalize || p.IPv4Prefix > 0 || p.IPv6Prefix > 0 {
+			remoteIp = AnonymizeIP(remoteIp, p.IPv4Prefix, p.IPv6Prefix)
+		}
+		md.Append(XForwardedFor, remoteIp)
+		if p.Forwarded {
+			md.Append(Forwarded, forwardedElement(serverCtx, md, remoteIp))
+		}
+	}
+	if p.MaxChain > 0 {
+		limitChain(md, XForwardedFor, p.MaxChain)
+		limitChain(md, Forwarded, p.MaxChain)
+	}
+}
+
+// AnonymizeIP returns ip in canonical form, keeping only the first
+// ipv4Prefix bits of IPv4 addresses and ipv6Prefix bits of IPv6 addresses.
+// A prefix of zero keeps the whole address. The zone of ip is dropped, and
+// IPv4-mapped IPv6 addresses are treated as IPv4. If ip is not an IP
+// address, it is returned unchanged.
+func AnonymizeIP(ip string, ipv4Prefix, ipv6Prefix int) string {
+	addr := parseIP(ip)
+	if addr == nil {
+		return ip
+	}
+	if v4 := addr.To4(); v4 != nil {
+		if ipv4Prefix > 0 && ipv4Prefix < 32 {
+			v4 = v4.Mask(net.CIDRMask(ipv4Prefix, 32))
+		}
+		return v4.String()
+	}
+	if ipv6Prefix > 0 && ipv6Prefix < 128 {
+		addr = addr.Mask(net.CIDRMask(ipv6Prefix, 128))
+	}
+	return addr.String()
+}
+
+// forwardedElement formats a Forwarded element for the peer at remoteIp.
+func forwardedElement(serverCtx context.Context, md metadata.MD, remoteIp string) string {
+	node := remoteIp
+	if strings.Contains(node, ":") {
+		node = `"[` + node + `]"`
+	}
+	elem := "for=" + node
+	if host := md.Get(":authority"); len(host) != 0 {
+		elem += `;host="` + host[0] + `"`
+	}
+	proto := "http"
+	if pr, ok := peer.FromContext(serverCtx); ok && pr.AuthInfo != nil {
+		proto = "https"
+	}
+	return elem + ";proto=" + proto
+}
+
+// limitChain keeps the last max comma-separated entries of key in md.
+func limitChain(md metadata.MD, key string, max int) {
+	key = strings.ToLower(key)
+	var entries []string
+	for _, v := range md[key] {
+		for _, e := range strings.Split(v, ",") {
+			if e = strings.TrimSpace(e); len(e) != 0 {
+				entries = append(entries, e)
+			}
+		}
+	}
+	if len(entries) <= max {
+		return
+	}
+	md[key] = entries[len(entries)-max:]
+}
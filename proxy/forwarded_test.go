@@ -0,0 +1,127 @@
+package proxy_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	require.NoError(t, err)
+	return n
+}
+
+func TestForwarding(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    *proxy.ForwardingPolicy
+		incoming  []string
+		want      []string
+		forwarded string
+	}{
+		{
+			name:     "default appends",
+			incoming: []string{"10.0.0.1"},
+			want:     []string{"10.0.0.1", "127.0.0.1"},
+		},
+		{
+			name:     "trusted peer",
+			policy:   &proxy.ForwardingPolicy{TrustedProxies: []*net.IPNet{mustCIDR(t, "127.0.0.0/8")}},
+			incoming: []string{"10.0.0.1"},
+			want:     []string{"10.0.0.1", "127.0.0.1"},
+		},
+		{
+			name:     "untrusted peer",
+			policy:   &proxy.ForwardingPolicy{TrustedProxies: []*net.IPNet{mustCIDR(t, "10.0.0.0/8")}},
+			incoming: []string{"10.0.0.1"},
+			want:     []string{"127.0.0.1"},
+		},
+		{
+			name:     "replace",
+			policy:   &proxy.ForwardingPolicy{Replace: true},
+			incoming: []string{"10.0.0.1"},
+			want:     []string{"127.0.0.1"},
+		},
+		{
+			name:     "max chain",
+			policy:   &proxy.ForwardingPolicy{MaxChain: 2},
+			incoming: []string{"10.0.0.1, 10.0.0.2", "10.0.0.3"},
+			want:     []string{"10.0.0.3", "127.0.0.1"},
+		},
+		{
+			name:      "forwarded",
+			policy:    &proxy.ForwardingPolicy{Forwarded: true},
+			want:      []string{"127.0.0.1"},
+			forwarded: `^for=127\.0\.0\.1;host="127\.0\.0\.1:\d+";proto=http$`,
+		},
+		{
+			name:      "anonymized",
+			policy:    &proxy.ForwardingPolicy{TrustedProxies: []*net.IPNet{mustCIDR(t, "127.0.0.1/32")}, IPv4Prefix: 24, Forwarded: true},
+			incoming:  []string{"10.0.0.1"},
+			want:      []string{"10.0.0.1", "127.0.0.0"},
+			forwarded: `^for=127\.0\.0\.0;`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got metadata.MD
+			svc := &pingService{
+				ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+					got, _ = metadata.FromIncomingContext(ctx)
+					return &pb.PingResponse{}, nil
+				},
+			}
+			var opts []proxy.Option
+			if tc.policy != nil {
+				opts = append(opts, proxy.WithForwarding(tc.policy))
+			}
+			env := newTestEnv(t, svc, opts...)
+			defer env.Close()
+			ctx, cancel := env.ctx()
+			defer cancel()
+			for _, v := range tc.incoming {
+				ctx = metadata.AppendToOutgoingContext(ctx, proxy.XForwardedFor, v)
+			}
+			ctx = metadata.AppendToOutgoingContext(ctx, proxy.Forwarded, "for=10.9.9.9")
+
+			_, err := env.client.Ping(ctx, &pb.PingRequest{})
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got.Get(proxy.XForwardedFor))
+			if tc.forwarded != "" {
+				fwd := got.Get(proxy.Forwarded)
+				require.Len(t, fwd, 2)
+				assert.Equal(t, "for=10.9.9.9", fwd[0])
+				assert.Regexp(t, tc.forwarded, fwd[1])
+			}
+		})
+	}
+}
+
+func TestAnonymizeIP(t *testing.T) {
+	tests := []struct {
+		ip, want   string
+		ipv4, ipv6 int
+	}{
+		{ip: "192.0.2.57", want: "192.0.2.57"},
+		{ip: "192.0.2.57", ipv4: 24, want: "192.0.2.0"},
+		{ip: "192.0.2.57", ipv4: 16, ipv6: 64, want: "192.0.0.0"},
+		{ip: "::ffff:192.0.2.57", ipv4: 24, want: "192.0.2.0"},
+		{ip: "2001:0db8:0:0:1:2:3:4", want: "2001:db8::1:2:3:4"},
+		{ip: "2001:db8:0:0:1:2:3:4", ipv4: 24, ipv6: 64, want: "2001:db8::"},
+		{ip: "fe80::1%eth0", want: "fe80::1"},
+		{ip: "fe80::1:2%eth0", ipv6: 112, want: "fe80::1:0"},
+		{ip: "192.0.2.57", ipv4: 32, want: "192.0.2.57"},
+		{ip: "not-an-ip", ipv4: 24, want: "not-an-ip"},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, proxy.AnonymizeIP(tc.ip, tc.ipv4, tc.ipv6), "%s /%d /%d", tc.ip, tc.ipv4, tc.ipv6)
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	grpcWebContentType     = "application/grpc-web"
+	grpcWebTextContentType = "application/grpc-web-text"
+
+	// grpcWebTrailerFlag marks a frame holding the trailers.
+	grpcWebTrailerFlag = 0x80
+	// grpcWebCompressedFlag marks a compressed message frame.
+	grpcWebCompressedFlag = 0x01
+
+	// defaultGRPCWebMaxRecvSize is the request message size limit of a
+	// GRPCWebHandler when MaxRecvSize is not set, the default of gRPC
+	// servers.
+	defaultGRPCWebMaxRecvSize = 4 << 20
+)
+
+// GRPCWebHandler is an http.Handler which accepts gRPC-Web requests, in
+// binary or text mode, and serves them with a proxy stream handler. This
+// lets browsers call arbitrary backends through the same director and
+// options as native gRPC clients.
+type GRPCWebHandler struct {
+	handler grpc.StreamHandler
+
+	// AllowOrigin reports whether cross-origin requests from origin are
+	// allowed. If nil, cross-origin requests are not answered with CORS
+	// headers, so browsers only allow same-origin calls.
+	AllowOrigin func(origin string) bool
+
+	// MaxRecvSize limits the size of request messages, which are read
+	// whole before they are forwarded. Larger messages fail the call with
+	// codes.ResourceExhausted. It defaults to 4 MiB.
+	MaxRecvSize int
+}
+
+// NewGRPCWebHandler returns a GRPCWebHandler serving requests with h, which
+// is usually the result of TransparentHandler.
+func NewGRPCWebHandler(h grpc.StreamHandler) *GRPCWebHandler {
+	return &GRPCWebHandler{handler: h}
+}
+
+// IsGRPCWebRequest reports whether r is a gRPC-Web request, including CORS
+// preflight requests for one.
+func IsGRPCWebRequest(r *http.Request) bool {
+	if r.Method == http.MethodOptions {
+		return strings.Contains(strings.ToLower(r.Header.Get("Access-Control-Request-Headers")), "x-grpc-web")
+	}
+	return r.Method == http.MethodPost && strings.HasPrefix(r.Header.Get("Content-Type"), grpcWebContentType)
+}
+
+// ServeHTTP implements http.Handler.
+func (h *GRPCWebHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" && h.AllowOrigin != nil && h.AllowOrigin(origin) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Add("Vary", "Origin")
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "POST")
+			w.Header().Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	if !IsGRPCWebRequest(r) || r.Method != http.MethodPost {
+		http.Error(w, "not a gRPC-Web request", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	maxRecv := h.MaxRecvSize
+	if maxRecv <= 0 {
+		maxRecv = defaultGRPCWebMaxRecvSize
+	}
+	s, err := newWebServerStream(w, r, maxRecv)
+	if err != nil {
+		s.finish(err)
+		return
+	}
+	s.finish(h.handler(nil, s))
+}
+
+// webServerStream adapts a gRPC-Web HTTP exchange to a grpc.ServerStream.
+type webServerStream struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	method string
+	text   bool
+	body   *bufio.Reader
+	w      http.ResponseWriter
+	// maxRecv limits the size of request messages.
+	maxRecv int
+	// reqBody is the request body, which must not be read once the
+	// handler has returned. reads tracks the RecvMsg calls reading it.
+	reqBody io.ReadCloser
+	reads   sync.WaitGroup
+
+	mu          sync.Mutex
+	header      metadata.MD
+	trailer     metadata.MD
+	headerSent  bool
+	done        bool
+	contentType string
+}
+
+func newWebServerStream(w http.ResponseWriter, r *http.Request, maxRecv int) (*webServerStream, error) {
+	contentType := r.Header.Get("Content-Type")
+	s := &webServerStream{
+		method:      r.URL.Path,
+		maxRecv:     maxRecv,
+		reqBody:     r.Body,
+		text:        strings.HasPrefix(contentType, grpcWebTextContentType),
+		w:           w,
+		contentType: contentType,
+	}
+	var body io.Reader = r.Body
+	if s.text {
+		body = &base64Reader{r: r.Body}
+	}
+	s.body = bufio.NewReader(body)
+
+	var err error
+	s.ctx, s.cancel, err = httpStreamContext(r, s.method, s)
+	return s, err
+}
+
+func (s *webServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *webServerStream) SetHeader(md metadata.MD) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.headerSent {
+		return status.Error(codes.Internal, "header already sent")
+	}
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func (s *webServerStream) SendHeader(md metadata.MD) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.headerSent {
+		return status.Error(codes.Internal, "header already sent")
+	}
+	s.header = metadata.Join(s.header, md)
+	s.writeHeaderLocked()
+	return nil
+}
+
+func (s *webServerStream) SetTrailer(md metadata.MD) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trailer = metadata.Join(s.trailer, md)
+}
+
+func (s *webServerStream) writeHeaderLocked() {
+	if s.headerSent {
+		return
+	}
+	s.headerSent = true
+	h := s.w.Header()
+	h.Set("Content-Type", s.contentType)
+	expose := []string{"grpc-status", "grpc-message"}
+	for k, values := range s.header {
+		for _, v := range values {
+			h.Add(k, encodeMetadataValue(k, v))
+		}
+		expose = append(expose, k)
+	}
+	if h.Get("Access-Control-Allow-Origin") != "" {
+		h.Set("Access-Control-Expose-Headers", strings.Join(expose, ", "))
+	}
+	s.w.WriteHeader(http.StatusOK)
+}
+
+func (s *webServerStream) SendMsg(m interface{}) error {
+	f, ok := m.(*frame)
+	if !ok {
+		return status.Errorf(codes.Internal, "unexpected message type %T", m)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return status.Error(codes.Canceled, "stream is done")
+	}
+	s.writeHeaderLocked()
+	return s.writeFrameLocked(0, f.payload)
+}
+
+func (s *webServerStream) writeFrameLocked(flag byte, payload []byte) error {
+	raw := getBuffer(5 + len(payload))
+	defer putBuffer(raw)
+	buf := *raw
+	buf[0] = flag
+	binary.BigEndian.PutUint32(buf[1:5], uint32(len(payload)))
+	copy(buf[5:], payload)
+	if s.text {
+		enc := getBuffer(base64.StdEncoding.EncodedLen(len(buf)))
+		defer putBuffer(enc)
+		base64.StdEncoding.Encode(*enc, buf)
+		buf = *enc
+	}
+	if _, err := s.w.Write(buf); err != nil {
+		return status.Errorf(codes.Unavailable, "failed writing to client: %v", err)
+	}
+	if fl, ok := s.w.(http.Flusher); ok {
+		fl.Flush()
+	}
+	return nil
+}
+
+func (s *webServerStream) RecvMsg(m interface{}) error {
+	f, ok := m.(*frame)
+	if !ok {
+		return status.Errorf(codes.Internal, "unexpected message type %T", m)
+	}
+	s.mu.Lock()
+	if s.done {
+		s.mu.Unlock()
+		return status.Error(codes.Canceled, "stream is done")
+	}
+	s.reads.Add(1)
+	s.mu.Unlock()
+	defer s.reads.Done()
+
+	var hdr [5]byte
+	if _, err := io.ReadFull(s.body, hdr[:]); err != nil {
+		if err == io.EOF {
+			return io.EOF
+		}
+		return status.Errorf(codes.Internal, "failed reading request: %v", err)
+	}
+	if hdr[0]&grpcWebCompressedFlag != 0 {
+		return status.Error(codes.Unimplemented, "compressed gRPC-Web requests are not supported")
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if uint64(n) > uint64(s.maxRecv) {
+		return status.Errorf(codes.ResourceExhausted, "received message larger than max (%d vs. %d)", n, s.maxRecv)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(s.body, payload); err != nil {
+		return status.Errorf(codes.Internal, "failed reading request: %v", err)
+	}
+	f.payload = payload
+	return nil
+}
+
+// finish writes the status and trailers of the call. Messages sent or
+// received after finish are rejected, and finish waits for reads of the
+// request body which are still running, since the body must not be used
+// after ServeHTTP returns.
+func (s *webServerStream) finish(err error) {
+	defer s.reads.Wait()
+	defer s.reqBody.Close()
+	s.cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done = true
+	s.writeHeaderLocked()
+
+	st := status.Convert(err)
+	var b strings.Builder
+	fmt.Fprintf(&b, "grpc-status: %d\r\n", st.Code())
+	if msg := st.Message(); msg != "" {
+		fmt.Fprintf(&b, "grpc-message: %s\r\n", encodeGRPCMessage(msg))
+	}
+	for k, values := range s.trailer {
+		for _, v := range values {
+			fmt.Fprintf(&b, "%s: %s\r\n", k, encodeMetadataValue(k, v))
+		}
+	}
+	s.writeFrameLocked(grpcWebTrailerFlag, []byte(b.String()))
+}
+
+// encodeGRPCMessage percent-encodes msg as required for grpc-message.
+func encodeGRPCMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// base64Reader decodes gRPC-Web text bodies, which may be the concatenation
+// of separately padded base64 chunks.
+type base64Reader struct {
+	r   io.Reader
+	in  [4]byte
+	n   int
+	dec [3]byte
+	out []byte
+}
+
+func (b *base64Reader) Read(p []byte) (int, error) {
+	for len(b.out) == 0 {
+		n, err := b.r.Read(b.in[b.n:])
+		b.n += n
+		if b.n == len(b.in) {
+			m, derr := base64.StdEncoding.Decode(b.dec[:], b.in[:])
+			if derr != nil {
+				return 0, derr
+			}
+			b.out, b.n = b.dec[:m], 0
+			continue
+		}
+		if err == io.EOF && b.n != 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, b.out)
+	b.out = b.out[n:]
+	return n, nil
+}
@@ -0,0 +1,288 @@
+package proxy_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// webEnv serves gRPC-Web requests with a proxy to a test backend.
+type webEnv struct {
+	*testEnv
+	server *httptest.Server
+}
+
+func newWebEnv(t *testing.T, svc pb.TestServiceServer) *webEnv {
+	e := &webEnv{testEnv: newTestEnv(t, svc)}
+	web := proxy.NewGRPCWebHandler(proxy.TransparentHandler(e.director))
+	web.AllowOrigin = func(origin string) bool { return origin == "https://app.example.com" }
+	e.server = httptest.NewServer(web)
+	return e
+}
+
+func (e *webEnv) Close() {
+	e.server.Close()
+	e.testEnv.Close()
+}
+
+// call sends the messages as a gRPC-Web request and returns the response.
+func (e *webEnv) call(t *testing.T, method, contentType string, header http.Header, msgs ...proto.Message) *http.Response {
+	var body bytes.Buffer
+	for _, m := range msgs {
+		b, err := proto.Marshal(m)
+		require.NoError(t, err)
+		var hdr [5]byte
+		binary.BigEndian.PutUint32(hdr[1:], uint32(len(b)))
+		body.Write(hdr[:])
+		body.Write(b)
+	}
+	var r io.Reader = &body
+	if strings.HasPrefix(contentType, "application/grpc-web-text") {
+		r = strings.NewReader(base64.StdEncoding.EncodeToString(body.Bytes()))
+	}
+	req, err := http.NewRequest(http.MethodPost, e.server.URL+method, r)
+	require.NoError(t, err)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Grpc-Web", "1")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	return resp
+}
+
+type webResponse struct {
+	messages [][]byte
+	trailer  http.Header
+}
+
+func readWebResponse(t *testing.T, resp *http.Response) *webResponse {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/grpc-web-text") {
+		var dec []byte
+		// Frames are encoded separately, so decode chunk by chunk.
+		for len(body) > 0 {
+			n := bytes.IndexByte(body, '=')
+			end := len(body)
+			if n >= 0 {
+				end = n
+				for end < len(body) && body[end] == '=' {
+					end++
+				}
+			}
+			chunk, err := base64.StdEncoding.DecodeString(string(body[:end]))
+			require.NoError(t, err)
+			dec = append(dec, chunk...)
+			body = body[end:]
+		}
+		body = dec
+	}
+	out := &webResponse{trailer: http.Header{}}
+	for len(body) > 0 {
+		require.True(t, len(body) >= 5, "truncated frame")
+		n := binary.BigEndian.Uint32(body[1:5])
+		payload := body[5 : 5+n]
+		if body[0]&0x80 != 0 {
+			for _, line := range strings.Split(strings.TrimSpace(string(payload)), "\r\n") {
+				kv := strings.SplitN(line, ": ", 2)
+				out.trailer.Add(kv[0], kv[1])
+			}
+		} else {
+			out.messages = append(out.messages, payload)
+		}
+		body = body[5+n:]
+	}
+	return out
+}
+
+func TestGRPCWeb_Unary(t *testing.T) {
+	for _, contentType := range []string{"application/grpc-web+proto", "application/grpc-web-text"} {
+		t.Run(contentType, func(t *testing.T) {
+			env := newWebEnv(t, metadataService())
+			defer env.Close()
+
+			resp := env.call(t, "/vgough.testproto.TestService/Ping", contentType, nil, &pb.PingRequest{Value: "foo"})
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, contentType, resp.Header.Get("Content-Type"))
+			assert.Equal(t, "h", resp.Header.Get("X-Header"))
+
+			out := readWebResponse(t, resp)
+			require.Len(t, out.messages, 1)
+			var ping pb.PingResponse
+			require.NoError(t, proto.Unmarshal(out.messages[0], &ping))
+			assert.Equal(t, "foo", ping.Value)
+			assert.Equal(t, "0", out.trailer.Get("grpc-status"))
+			assert.Equal(t, "t", out.trailer.Get("x-trailer"))
+		})
+	}
+}
+
+func TestGRPCWeb_ServerStream(t *testing.T) {
+	env := newWebEnv(t, &pingService{})
+	defer env.Close()
+
+	resp := env.call(t, "/vgough.testproto.TestService/PingList", "application/grpc-web", nil, &pb.PingRequest{Value: "foo"})
+	out := readWebResponse(t, resp)
+	assert.Len(t, out.messages, countListResponses)
+	assert.Equal(t, "0", out.trailer.Get("grpc-status"))
+}
+
+func TestGRPCWeb_Error(t *testing.T) {
+	svc := &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			return nil, status.Error(codes.FailedPrecondition, "100% broken")
+		},
+	}
+	env := newWebEnv(t, svc)
+	defer env.Close()
+
+	resp := env.call(t, "/vgough.testproto.TestService/Ping", "application/grpc-web", nil, &pb.PingRequest{Value: "foo"})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	out := readWebResponse(t, resp)
+	assert.Empty(t, out.messages)
+	assert.Equal(t, "9", out.trailer.Get("grpc-status"))
+	assert.Equal(t, "100%25 broken", out.trailer.Get("grpc-message"))
+}
+
+func TestGRPCWeb_MetadataAndCORS(t *testing.T) {
+	received := make(chan string, 1)
+	svc := &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			_, hasDeadline := ctx.Deadline()
+			md, _ := metadata.FromIncomingContext(ctx)
+			received <- md.Get("x-user")[0]
+			if !hasDeadline {
+				return nil, status.Error(codes.Internal, "no deadline")
+			}
+			return &pb.PingResponse{Value: ping.Value}, nil
+		},
+	}
+	env := newWebEnv(t, svc)
+	defer env.Close()
+
+	header := http.Header{}
+	header.Set("X-User", "alice")
+	header.Set("Grpc-Timeout", "5S")
+	header.Set("Origin", "https://app.example.com")
+	resp := env.call(t, "/vgough.testproto.TestService/Ping", "application/grpc-web", header, &pb.PingRequest{Value: "foo"})
+	assert.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, resp.Header.Get("Access-Control-Expose-Headers"), "grpc-status")
+	out := readWebResponse(t, resp)
+	assert.Equal(t, "0", out.trailer.Get("grpc-status"))
+	assert.Equal(t, "alice", <-received)
+
+	req, err := http.NewRequest(http.MethodOptions, env.server.URL+"/vgough.testproto.TestService/Ping", nil)
+	require.NoError(t, err)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Headers", "content-type,x-grpc-web")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "content-type,x-grpc-web", resp.Header.Get("Access-Control-Allow-Headers"))
+}
+
+func TestGRPCWeb_MaxRecvSize(t *testing.T) {
+	env := newWebEnv(t, &pingService{})
+	defer env.Close()
+
+	// A frame header announcing a 4 GiB message, without the message.
+	body := []byte{0, 0xff, 0xff, 0xff, 0xff}
+	req, err := http.NewRequest(http.MethodPost, env.server.URL+"/vgough.testproto.TestService/Ping", bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/grpc-web+proto")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	out := readWebResponse(t, resp)
+	assert.Equal(t, "8", out.trailer.Get("grpc-status"))
+}
+
+// blockingBody returns its data, then blocks until it is closed. It records
+// whether a read is running.
+type blockingBody struct {
+	data   []byte
+	closed chan struct{}
+	active int32
+}
+
+func (b *blockingBody) Read(p []byte) (int, error) {
+	atomic.AddInt32(&b.active, 1)
+	defer atomic.AddInt32(&b.active, -1)
+	if len(b.data) > 0 {
+		n := copy(p, b.data)
+		b.data = b.data[n:]
+		return n, nil
+	}
+	<-b.closed
+	return 0, errors.New("body closed")
+}
+
+func (b *blockingBody) Close() error {
+	close(b.closed)
+	return nil
+}
+
+func TestGRPCWeb_BodyNotReadAfterReturn(t *testing.T) {
+	svc := &pingService{
+		pingStream: func(stream pb.TestService_PingStreamServer) error {
+			if _, err := stream.Recv(); err != nil {
+				return err
+			}
+			return stream.Send(&pb.PingResponse{Value: "done"})
+		},
+	}
+	env := newTestEnv(t, svc)
+	defer env.Close()
+	web := proxy.NewGRPCWebHandler(proxy.TransparentHandler(env.director))
+
+	b, err := proto.Marshal(&pb.PingRequest{Value: "foo"})
+	require.NoError(t, err)
+	var hdr [5]byte
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(b)))
+	// The client keeps the request open after the first message.
+	body := &blockingBody{data: append(hdr[:], b...), closed: make(chan struct{})}
+	req := httptest.NewRequest(http.MethodPost, "/vgough.testproto.TestService/PingStream", body)
+	req.Header.Set("Content-Type", "application/grpc-web+proto")
+	rec := httptest.NewRecorder()
+	web.ServeHTTP(rec, req)
+	assert.EqualValues(t, 0, atomic.LoadInt32(&body.active), "the body is not read after ServeHTTP returns")
+
+	out := readWebResponse(t, rec.Result())
+	assert.Len(t, out.messages, 1)
+	assert.Equal(t, "0", out.trailer.Get("grpc-status"))
+}
+
+func TestGRPCWeb_Timeout(t *testing.T) {
+	env := newWebEnv(t, &pingService{})
+	defer env.Close()
+
+	for v, code := range map[string]string{"99999999H": "0", "5S": "0", "123456789S": "3", "-1S": "3"} {
+		header := http.Header{}
+		header.Set("Grpc-Timeout", v)
+		resp := env.call(t, "/vgough.testproto.TestService/Ping", "application/grpc-web", header, &pb.PingRequest{Value: "foo"})
+		out := readWebResponse(t, resp)
+		assert.Equal(t, code, out.trailer.Get("grpc-status"), "grpc-timeout %s", v)
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import "time"
+
+// HalfClosePolicy controls what happens when the client finishes sending
+// while the backend is still answering.
+//
+// By default the half-close of the client is passed on to the backend as
+// soon as the messages before it are forwarded, and the responses of the
+// backend are forwarded until it ends the call.
+type HalfClosePolicy struct {
+	// Defer keeps the stream to the backend open for sending until the
+	// backend ends the call, for backends which take a half-close for a
+	// cancellation. The backend must end the call on its own.
+	Defer bool
+
+	// Timeout, if positive, limits how long the backend may take to end the
+	// call after the client half-closed. The backend call is then
+	// cancelled, and the client gets codes.DeadlineExceeded.
+	Timeout time.Duration
+}
+
+// WithHalfClose sets the half-close policy of streams.
+func WithHalfClose(p HalfClosePolicy) Option {
+	return func(o *options) {
+		o.halfClose = &p
+	}
+}
@@ -0,0 +1,210 @@
+package proxy_test
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// halfCloseService answers the requests of PingStream after the client
+// half-closed, or fails after the first request if early is set.
+func halfCloseService(early bool) *pingService {
+	return &pingService{
+		pingStream: func(stream pb.TestService_PingStreamServer) error {
+			var values []string
+			for {
+				ping, err := stream.Recv()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				if early {
+					return status.Error(codes.FailedPrecondition, "enough")
+				}
+				values = append(values, ping.Value)
+			}
+			for i, v := range values {
+				if err := stream.Send(&pb.PingResponse{Value: v, Counter: int32(i)}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// TestHalfClose_Conformance checks the streaming semantics the proxy must
+// keep, with and without read-ahead buffers.
+func TestHalfClose_Conformance(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []proxy.Option
+	}{
+		{name: "unbuffered"},
+		{name: "buffered", opts: []proxy.Option{
+			proxy.WithFlowControl(proxy.ClientToBackend, proxy.FlowControl{Buffer: 4}),
+			proxy.WithFlowControl(proxy.BackendToClient, proxy.FlowControl{Buffer: 4, Batch: 2}),
+		}},
+	} {
+		t.Run(tc.name+"/client-stream", func(t *testing.T) {
+			env := newTestEnv(t, halfCloseService(false), tc.opts...)
+			defer env.Close()
+			ctx, cancel := env.ctx()
+			defer cancel()
+
+			stream, err := env.client.PingStream(ctx)
+			require.NoError(t, err)
+			for i := 0; i < 10; i++ {
+				require.NoError(t, stream.Send(&pb.PingRequest{Value: fmt.Sprint(i)}))
+			}
+			require.NoError(t, stream.CloseSend())
+			for i := 0; i < 10; i++ {
+				resp, err := stream.Recv()
+				require.NoError(t, err, "responses after the half-close are forwarded")
+				assert.Equal(t, fmt.Sprint(i), resp.Value, "the half-close follows all requests")
+			}
+			_, err = stream.Recv()
+			assert.Equal(t, io.EOF, err)
+		})
+
+		t.Run(tc.name+"/server-stream", func(t *testing.T) {
+			env := newTestEnv(t, &pingService{}, tc.opts...)
+			defer env.Close()
+			ctx, cancel := env.ctx()
+			defer cancel()
+
+			stream, err := env.client.PingList(ctx, &pb.PingRequest{Value: "list"})
+			require.NoError(t, err)
+			for i := 0; i < countListResponses; i++ {
+				resp, err := stream.Recv()
+				require.NoError(t, err)
+				assert.EqualValues(t, i, resp.Counter)
+			}
+			_, err = stream.Recv()
+			assert.Equal(t, io.EOF, err)
+		})
+
+		t.Run(tc.name+"/bidi", func(t *testing.T) {
+			env := newTestEnv(t, &pingService{}, tc.opts...)
+			defer env.Close()
+			ctx, cancel := env.ctx()
+			defer cancel()
+
+			stream, err := env.client.PingStream(ctx)
+			require.NoError(t, err)
+			for i := 0; i < 5; i++ {
+				require.NoError(t, stream.Send(&pb.PingRequest{Value: fmt.Sprint(i)}))
+				resp, err := stream.Recv()
+				require.NoError(t, err)
+				assert.Equal(t, fmt.Sprint(i), resp.Value)
+			}
+			require.NoError(t, stream.CloseSend())
+			for {
+				if _, err = stream.Recv(); err != nil {
+					break
+				}
+			}
+			assert.Equal(t, io.EOF, err)
+		})
+
+		t.Run(tc.name+"/early-backend-close", func(t *testing.T) {
+			env := newTestEnv(t, halfCloseService(true), tc.opts...)
+			defer env.Close()
+			ctx, cancel := env.ctx()
+			defer cancel()
+
+			stream, err := env.client.PingStream(ctx)
+			require.NoError(t, err)
+			require.NoError(t, stream.Send(&pb.PingRequest{Value: "first"}))
+			_, err = stream.Recv()
+			assert.Equal(t, status.Error(codes.FailedPrecondition, "enough"), err,
+				"the backend status ends the call while the client is still sending")
+			// Sending on the ended stream fails without blocking.
+			for i := 0; i < 10; i++ {
+				if err := stream.Send(&pb.PingRequest{Value: "more"}); err != nil {
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestHalfClose_Defer(t *testing.T) {
+	gotEOF := make(chan bool, 1)
+	svc := &pingService{
+		pingStream: func(stream pb.TestService_PingStreamServer) error {
+			if _, err := stream.Recv(); err != nil {
+				return err
+			}
+			eof := make(chan struct{})
+			go func() {
+				if _, err := stream.Recv(); err == io.EOF {
+					close(eof)
+				}
+			}()
+			select {
+			case <-eof:
+				gotEOF <- true
+			case <-time.After(100 * time.Millisecond):
+				gotEOF <- false
+			}
+			return stream.Send(&pb.PingResponse{Value: "done"})
+		},
+	}
+	env := newTestEnv(t, svc, proxy.WithHalfClose(proxy.HalfClosePolicy{Defer: true}))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	stream, err := env.client.PingStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.PingRequest{Value: "x"}))
+	require.NoError(t, stream.CloseSend())
+	assert.False(t, <-gotEOF, "the half-close is held back")
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, "done", resp.Value)
+	_, err = stream.Recv()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestHalfClose_Timeout(t *testing.T) {
+	svc := &pingService{
+		pingStream: func(stream pb.TestService_PingStreamServer) error {
+			for {
+				if _, err := stream.Recv(); err != nil {
+					break
+				}
+			}
+			// Never finish after the half-close.
+			<-stream.Context().Done()
+			return stream.Context().Err()
+		},
+	}
+	env := newTestEnv(t, svc, proxy.WithHalfClose(proxy.HalfClosePolicy{Timeout: 50 * time.Millisecond}))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	stream, err := env.client.PingStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.PingRequest{Value: "x"}))
+	// The timeout only starts with the half-close.
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, stream.CloseSend())
+	start := time.Now()
+	_, err = stream.Recv()
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assert.True(t, time.Since(start) < time.Second)
+}
@@ -7,13 +7,17 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
 	"strings"
+	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
 var (
@@ -26,9 +30,15 @@ var (
 // RegisterService sets up a proxy handler for a particular gRPC service and method.
 // The behavior is the same as if you were registering a handler method, e.g. from a codegenerated pb.go file.
 //
-// This can *only* be used if the `server` also uses proxy.CodecForServer() ServerOption.
+// This can *only* be used if the `server` also uses proxy.ServerOption().
 func RegisterService(server *grpc.Server, director StreamDirector, serviceName string, methodNames ...string) {
-	streamer := &handler{director}
+	RegisterServiceWithOptions(server, director, nil, serviceName, methodNames...)
+}
+
+// RegisterServiceWithOptions is like RegisterService, but additionally configures the proxy handler using the provided
+// options.
+func RegisterServiceWithOptions(server *grpc.Server, director StreamDirector, opts []Option, serviceName string, methodNames ...string) {
+	streamer := &handler{director: director, opts: newOptions(opts)}
 	fakeDesc := &grpc.ServiceDesc{
 		ServiceName: serviceName,
 		HandlerType: (*interface{})(nil),
@@ -49,88 +59,476 @@ func RegisterService(server *grpc.Server, director StreamDirector, serviceName s
 // The indented use here is as a transparent proxy, where the server doesn't know about the services implemented by the
 // backends. It should be used as a `grpc.UnknownServiceHandler`.
 //
-// This can *only* be used if the `server` also uses proxy.CodecForServer() ServerOption.
-func TransparentHandler(director StreamDirector) grpc.StreamHandler {
-	streamer := &handler{director}
+// This can *only* be used if the `server` also uses proxy.ServerOption().
+func TransparentHandler(director StreamDirector, opts ...Option) grpc.StreamHandler {
+	streamer := &handler{director: director, opts: newOptions(opts)}
 	return streamer.handler
 }
 
 type handler struct {
 	director StreamDirector
+	opts     options
+}
+
+// proxiedStream holds the state of a single proxied stream which is shared
+// between the optional features of the handler.
+type proxiedStream struct {
+	// counts is first to keep its fields 64-bit aligned for atomic access.
+	counts streamCounts
+	// method is the full method name requested by the client.
+	method string
+	// backend is the target of the backend connection, once it is known.
+	backend string
+	peerIP  string
+	start   time.Time
+	info    *CallInfo
+	// errSource is where the error of the stream originated.
+	errSource ErrorSource
 }
 
 // handler is where the real magic of proxying happens.
 // It is invoked like any gRPC server stream and uses the gRPC server framing to get and receive bytes from the wire,
 // forwarding it to a ClientStream established against the relevant ClientConn.
-func (h *handler) handler(srv interface{}, serverStream grpc.ServerStream) error {
+func (h *handler) handler(srv interface{}, serverStream grpc.ServerStream) (handlerErr error) {
+	ss := grpc.ServerTransportStreamFromContext(serverStream.Context())
+	ps := &proxiedStream{method: ss.Method(), peerIP: RemoteIp(serverStream.Context()), start: time.Now()}
+	defer func() {
+		if v := recover(); v != nil {
+			pe := newPanicError(panicInHandler, v)
+			h.reportPanic(serverStream.Context(), ps.method, pe)
+			handlerErr = pe
+		}
+	}()
+	ctx, info := newCallInfo(serverStream.Context(), ps.method, ps.start)
+	ps.info = info
+	if h.opts.forwarding != nil {
+		ctx = context.WithValue(ctx, forwardingKey{}, h.opts.forwarding)
+	}
+	serverStream = &contextServerStream{ServerStream: serverStream, ctx: ctx}
+	var trailers *trailerBufferServerStream
+	if len(h.opts.statusHooks) != 0 {
+		trailers = &trailerBufferServerStream{ServerStream: serverStream}
+		serverStream = trailers
+	}
+	var err error
+	if h.opts.tracing != nil {
+		var endSpan func(error)
+		serverStream, endSpan = h.opts.tracing.start(ps, serverStream)
+		defer func() { endSpan(err) }()
+	}
+	err = h.proxy(ps, serverStream)
+	var pe *panicError
+	if errors.As(err, &pe) {
+		h.reportPanic(serverStream.Context(), ps.method, pe)
+	} else if err != nil {
+		h.logError(ps, err)
+	}
+	if h.opts.metrics != nil {
+		h.opts.metrics.finish(ps, err)
+	}
+	if h.opts.accessLog != nil {
+		endAccessLog(serverStream.Context(), h.opts.accessLog, ps, err)
+	}
+	clientErr := h.mapError(serverStream.Context(), ps, err)
+	if trailers != nil {
+		return trailers.finish(h.opts.statusHooks, clientErr)
+	}
+	return clientErr
+}
+
+// logError logs the failure of a stream. Failures to reach the backend and
+// to forward messages are warnings, as clients only see their status code.
+func (h *handler) logError(ps *proxiedStream, err error) {
+	code := status.Code(err)
+	switch {
+	case code == codes.Canceled:
+	case errors.Is(err, ErrBackendDial):
+		h.opts.logger.Warn("backend stream failed", "method", ps.method, "backend", ps.backend, "error", err)
+	case errors.Is(err, ErrForwardClientToBackend), errors.Is(err, ErrForwardBackendToClient):
+		h.opts.logger.Warn("proxying failed", "method", ps.method, "backend", ps.backend, "peer", ps.peerIP, "error", err)
+	default:
+		h.opts.logger.Debug("stream failed", "method", ps.method, "backend", ps.backend, "code", code, "error", err)
+	}
+}
+
+func (h *handler) proxy(ps *proxiedStream, serverStream grpc.ServerStream) (err error) {
+	policy, err := h.callPolicy(ps.method)
+	if err != nil {
+		return err
+	}
+	if h.opts.drainer != nil {
+		ctx, leave, drainErr := h.opts.drainer.enter(serverStream.Context())
+		if drainErr != nil {
+			return drainErr
+		}
+		serverStream = &contextServerStream{ServerStream: serverStream, ctx: ctx}
+		defer func() {
+			if leave() && err != nil {
+				err = status.Error(codes.Unavailable, "stream cancelled by proxy drain")
+			}
+		}()
+	}
+	if h.opts.authenticator != nil {
+		ctx, authErr := authenticate(serverStream.Context(), h.opts.authenticator, ps.method)
+		if authErr != nil {
+			return authErr
+		}
+		serverStream = &contextServerStream{ServerStream: serverStream, ctx: ctx}
+	}
+	if h.opts.acl != nil {
+		if aclErr := h.opts.acl.check(serverStream.Context(), ps.method, ps.peerIP); aclErr != nil {
+			return aclErr
+		}
+	}
+	if h.opts.via != nil {
+		if viaErr := h.opts.via.check(serverStream.Context()); viaErr != nil {
+			return viaErr
+		}
+	}
+	if dial, ok := h.opts.tunnels[ps.method]; ok {
+		return h.tunnel(ps, serverStream, dial)
+	}
+	var fault *injectedFault
+	if h.opts.faults != nil {
+		if fault = h.opts.faults.pick(ps.method); fault != nil {
+			if faultErr := fault.inject(serverStream.Context()); faultErr != nil {
+				return faultErr
+			}
+		}
+	}
 	serverCtx := serverStream.Context()
-	ss := grpc.ServerTransportStreamFromContext(serverCtx)
-	fullMethodName := ss.Method()
-	clientCtx, clientCancel, dir, err := h.director(serverCtx, fullMethodName)
+	directorCtx := serverCtx
+	if policy.deadlines != nil {
+		directorCtx = policy.deadlines.directorContext(serverCtx)
+	}
+	fullMethodName := ps.method
+	ps.errSource = ErrorSourceDirector
+	clientCtx, clientCancel, dir, err := h.callDirector(directorCtx, fullMethodName)
 	if err != nil {
 		return err
 	}
+	ps.errSource = ErrorSourceProxy
+	if policy.deadlines != nil {
+		var cancel context.CancelFunc
+		if clientCtx, cancel = policy.deadlines.apply(clientCtx); cancel != nil {
+			defer cancel()
+		}
+	}
 	if clientCancel == nil {
 		clientCtx, clientCancel = context.WithCancel(clientCtx)
 	}
 	defer clientCancel()
+	defer propagateCancel(serverCtx, clientCancel)()
+	if dir.Done != nil || dir.OnCanceled != nil {
+		defer func() {
+			if dir.OnCanceled != nil && isCanceled(serverCtx, err) {
+				dir.OnCanceled(err)
+			}
+			if dir.Done != nil {
+				dir.Done(err)
+			}
+		}()
+	}
+	if limits := dir.MetadataLimits.Merge(h.opts.metadataLimits); limits != (MetadataLimits{}) {
+		incoming, _ := metadata.FromIncomingContext(serverCtx)
+		if err = limits.check(incoming); err != nil {
+			return err
+		}
+	}
 	if _, ok := metadata.FromOutgoingContext(clientCtx); !ok {
 		clientCtx = CopyMetadata(clientCtx, serverCtx)
 	}
+	if h.opts.clientCert != nil {
+		clientCtx = h.opts.clientCert.apply(clientCtx, serverCtx)
+	}
+	if h.opts.via != nil {
+		clientCtx = h.opts.via.apply(clientCtx)
+	}
+	if h.opts.tracing != nil {
+		clientCtx = h.opts.tracing.inject(serverCtx, clientCtx)
+	}
 	if len(dir.Method) != 0 {
 		fullMethodName = dir.Method
 	}
-	clientStream, err := grpc.NewClientStream(clientCtx, clientStreamDescForProxying, dir.BackendConn, fullMethodName)
+	if dir.BackendConn != nil {
+		ps.backend = dir.BackendConn.Target()
+		ps.info.setBackend(ps.backend)
+	}
+	if opt := contentSubtypeOption(serverCtx); opt != nil {
+		n := len(dir.CallOptions)
+		dir.CallOptions = append(dir.CallOptions[:n:n], opt)
+	}
+	if h.opts.compression != nil {
+		if opt := h.opts.compression.callOption(serverCtx); opt != nil {
+			n := len(dir.CallOptions)
+			dir.CallOptions = append(dir.CallOptions[:n:n], opt)
+		}
+	}
+	var vars func(string) string
+	if len(h.opts.requestRules) != 0 || len(h.opts.responseRules) != 0 {
+		incoming, _ := metadata.FromIncomingContext(serverCtx)
+		vars = metadataVars(ps, incoming)
+	}
+	if len(h.opts.requestRules) != 0 {
+		clientCtx = applyRequestRules(clientCtx, h.opts.requestRules, vars)
+	}
+	if dir.Credentials != nil {
+		var opt grpc.CallOption
+		if clientCtx, opt, err = applyCredentials(clientCtx, dir.Credentials, dir.BackendConn, fullMethodName); err != nil {
+			return err
+		}
+		n := len(dir.CallOptions)
+		dir.CallOptions = append(dir.CallOptions[:n:n], opt)
+	}
+	for _, l := range policy.rateLimits {
+		if limitErr := l.allow(serverCtx, ps); limitErr != nil {
+			return limitErr
+		}
+	}
+	if h.opts.breakers != nil {
+		record, breakerErr := h.opts.breakers.allow(ps.backend)
+		if breakerErr != nil {
+			return breakerErr
+		}
+		defer func() { record(err) }()
+	}
+	if h.opts.limiter != nil {
+		release, limitErr := h.opts.limiter.acquire(serverCtx, dir.BackendConn)
+		if limitErr != nil {
+			return limitErr
+		}
+		defer release()
+	}
+	var adaptive *adaptiveStream
+	if h.opts.adaptive != nil {
+		if adaptive, err = h.opts.adaptive.acquire(ps.backend); err != nil {
+			return err
+		}
+		defer func() { adaptive.finish(err) }()
+	}
+	if h.opts.quotas != nil {
+		var release func()
+		if serverStream, release, err = h.opts.quotas.start(serverCtx, ps, serverStream); err != nil {
+			return err
+		}
+		defer release()
+	}
+	if h.opts.tracker != nil {
+		defer h.opts.tracker.start(ps)()
+	}
+	if h.opts.metrics != nil {
+		serverStream = h.opts.metrics.start(ps, serverStream)
+	}
+	if h.opts.accessLog != nil {
+		serverStream = startAccessLog(h.opts.accessLog, ps, serverStream)
+	}
+	if maxRecv, maxSend := pickLimit(dir.MaxRecvSize, policy.maxRecvSize), pickLimit(dir.MaxSendSize, policy.maxSendSize); maxRecv > 0 || maxSend > 0 {
+		serverStream = &sizeLimitedServerStream{ServerStream: serverStream, maxRecv: maxRecv, maxSend: maxSend}
+	}
+	if headerHooks, trailerHooks := h.responseHooks(vars); len(headerHooks) != 0 || len(trailerHooks) != 0 {
+		serverStream = &metadataHookServerStream{
+			ServerStream: serverStream,
+			header:       headerHooks,
+			trailer:      trailerHooks,
+		}
+	}
+	if len(h.opts.transformers) != 0 {
+		serverStream = newTransformedServerStream(serverStream, ps.method, h.opts.transformers)
+	}
+	if fault != nil && fault.truncateAfter >= 0 {
+		serverStream = &truncatedServerStream{ServerStream: serverStream, remaining: fault.truncateAfter}
+	}
+	if len(dir.Shadows) != 0 {
+		serverStream = newShadowServerStream(clientCtx, serverStream, dir.Shadows, h.opts.shadowTimeout, h.opts.logger, fullMethodName, dir.CallOptions...)
+	}
+	var cache *cacheLookup
+	if p := h.opts.cachePolicy(ps.method); p != nil {
+		if serverStream, cache, err = p.lookup(serverCtx, serverStream, fullMethodName); err != nil {
+			return err
+		}
+	}
+	var coalesced *coalescedCall
+	if c := h.opts.coalescer(ps.method); c != nil && (cache == nil || cache.hit == nil) {
+		if serverStream, coalesced, err = c.join(serverCtx, serverStream, fullMethodName); err != nil {
+			return err
+		}
+		if coalesced != nil {
+			defer func() { coalesced.finish(err) }()
+			if coalesced.shared() && coalesced.flight.err != nil {
+				ps.errSource = ErrorSourceBackend
+				return coalesced.flight.err
+			}
+		}
+	}
+	hedging := h.opts.hedgingPolicy(ps.method)
+	var clientStream grpc.ClientStream
+	switch {
+	case cache != nil && cache.hit != nil:
+		clientStream = &cachedClientStream{ctx: clientCtx, resp: cache.hit}
+	case coalesced != nil && coalesced.shared():
+		clientStream = &cachedClientStream{ctx: clientCtx, resp: coalesced.flight.resp}
+	case len(dir.Broadcast) != 0:
+		conns := append([]*grpc.ClientConn{dir.BackendConn}, dir.Broadcast...)
+		clientStream, err = newBroadcastStream(clientCtx, conns, dir.BroadcastMode, fullMethodName, dir.CallOptions...)
+	case len(dir.Failover) != 0:
+		conns := append([]*grpc.ClientConn{dir.BackendConn}, dir.Failover...)
+		clientStream, err = newFailoverStream(clientCtx, conns, fullMethodName, dir.CallOptions...)
+	case hedging != nil:
+		clientStream, err = hedging.newStream(clientCtx, serverStream, dir.BackendConn, dir.Hedges, fullMethodName, dir.CallOptions...)
+	case policy.retry != nil:
+		clientStream, err = policy.retry.newStream(clientCtx, serverStream, dir.BackendConn, fullMethodName, dir.CallOptions...)
+	default:
+		clientStream, err = grpc.NewClientStream(clientCtx, clientStreamDescForProxying, dir.BackendConn, fullMethodName, dir.CallOptions...)
+	}
 	if err != nil {
-		return err
+		ps.errSource = ErrorSourceConnection
+		return newStreamError(ErrBackendDial, ps.backend, err)
+	}
+	if adaptive != nil {
+		clientStream = &adaptiveClientStream{ClientStream: clientStream, s: adaptive}
+	}
+	if h.opts.priority != nil && dir.BackendConn != nil {
+		clientStream = h.opts.priority.wrap(serverCtx, ps.method, dir.BackendConn.Target(), clientStream)
+	}
+	if cache != nil {
+		clientStream = cache.record(serverCtx, clientStream)
+	}
+	if coalesced != nil {
+		clientStream = coalesced.record(clientStream)
 	}
 
-	err = biDirCopy(serverStream, clientStream)
+	var tracked *errorTrackingClientStream
+	if len(h.opts.errorMappers) != 0 {
+		tracked = &errorTrackingClientStream{ClientStream: clientStream}
+		clientStream = tracked
+	}
+	var limited *limitedServerStream
+	if policy.limits != nil {
+		limited = limitStream(serverStream, policy.limits, clientCancel)
+		serverStream = limited
+	}
+	var idle *idleWatchdog
+	if h.opts.idleTimeout > 0 {
+		idle = startIdleWatchdog(serverStream, h.opts.idleTimeout, clientCancel)
+		serverStream = idle
+	}
+	var leaks *leakStream
+	if h.opts.leaks != nil {
+		leaks = h.opts.leaks.start(ps, h.opts.logger)
+		defer leaks.end()
+	}
+	err = biDirCopy(serverStream, clientStream, clientCancel, h.opts.flow, h.opts.halfClose, leaks)
 	if err == io.EOF {
 		err = nil
 	}
-	if dir.Done != nil {
-		dir.Done(err)
+	var streamErr *StreamError
+	if errors.As(err, &streamErr) {
+		streamErr.Backend = ps.backend
+	}
+	var limitErr error
+	if limited != nil {
+		limitErr = limited.stop()
+	}
+	if idle != nil && idle.stop() {
+		return h.opts.idleError()
+	}
+	if limitErr != nil {
+		return limitErr
+	}
+	if tracked != nil && err != nil {
+		ps.errSource = tracked.source(err)
 	}
 	return err
 }
 
+// contextServerStream overrides the context of a ServerStream.
+type contextServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextServerStream) Context() context.Context {
+	return s.ctx
+}
+
 const XForwardedFor = "X-Forwarded-For"
 
-// copyMetadata takes the new client (outgoing) context, a server (incoming)
+// CopyMetadata takes the new client (outgoing) context, a server (incoming)
 // context, and returns a new outgoing context which contains all the incoming
 // metadata.
 //
 // An additional X-Forwarded-For metadata entry is added or appended to with
 // the peer address from the server context. See https://en.wikipedia.org/wiki/X-Forwarded-For.
+// For proxied calls, this follows the ForwardingPolicy of the handler, see
+// WithForwarding.
 func CopyMetadata(ctx context.Context, serverCtx context.Context) context.Context {
 	remoteIp := RemoteIp(serverCtx)
-	if md, ok := metadata.FromIncomingContext(serverCtx); ok {
-		md := md.Copy()
-		if len(remoteIp) != 0 {
-			md.Append(XForwardedFor, remoteIp)
-		}
-		return metadata.NewOutgoingContext(ctx, md)
-	}
-	if len(remoteIp) == 0 {
+	md, ok := metadata.FromIncomingContext(serverCtx)
+	if !ok && len(remoteIp) == 0 {
 		return ctx
 	}
-	return metadata.NewOutgoingContext(ctx, metadata.Pairs(XForwardedFor, remoteIp))
+	md = md.Copy()
+	if p := forwardingFromContext(serverCtx); p != nil {
+		p.apply(md, serverCtx, remoteIp)
+	} else if len(remoteIp) != 0 {
+		md.Append(XForwardedFor, remoteIp)
+	}
+	return metadata.NewOutgoingContext(ctx, md)
 }
 
+// RemoteIp returns the IP address of the peer of ctx, or an empty string if
+// it is unknown. See AddrIP.
 func RemoteIp(ctx context.Context) string {
 	pr, ok := peer.FromContext(ctx)
 	if !ok {
 		return ""
 	}
-	addr := pr.Addr
-	if addr, ok := addr.(*net.TCPAddr); ok {
-		return addr.IP.String()
+	return AddrIP(pr.Addr)
+}
+
+// AddrIP returns the IP address of addr, with its zone if any, such as
+// "fe80::1%eth0". IPv6 addresses are returned without brackets. Peers
+// connected over Unix sockets have no IP address, so it returns an empty
+// string for them. Behind a load balancer, use NewProxyProtocolListener for
+// the address of the client rather than that of the load balancer.
+func AddrIP(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case nil:
+		return ""
+	case *net.TCPAddr:
+		return zonedIP(addr.IP, addr.Zone)
+	case *net.UDPAddr:
+		return zonedIP(addr.IP, addr.Zone)
+	case *net.IPAddr:
+		return zonedIP(addr.IP, addr.Zone)
+	case *net.UnixAddr:
+		return ""
 	}
 	s := addr.String()
-	i := strings.LastIndex(s, ":")
-	if i < 0 {
-		return s
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
+	}
+	// Addresses without a port, such as "[2001:db8::1]".
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+func zonedIP(ip net.IP, zone string) string {
+	if ip == nil {
+		return ""
+	}
+	if zone != "" {
+		return ip.String() + "%" + zone
+	}
+	return ip.String()
+}
+
+// parseIP parses an IP address as returned by AddrIP, ignoring its zone.
+func parseIP(s string) net.IP {
+	if i := strings.IndexByte(s, '%'); i >= 0 {
+		s = s[:i]
 	}
-	return s[:i]
+	return net.ParseIP(s)
 }
@@ -107,12 +107,22 @@ type ProxyHappySuite struct {
 
 	client     *grpc.ClientConn
 	testClient pb.TestServiceClient
+
+	testCtx    context.Context
+	testCancel context.CancelFunc
+}
+
+func (s *ProxyHappySuite) SetupTest() {
+	// Make all RPC calls last at most 120 sec, meaning all async issues or deadlock will not kill tests.
+	s.testCtx, s.testCancel = context.WithTimeout(context.TODO(), 120*time.Second)
+}
+
+func (s *ProxyHappySuite) TearDownTest() {
+	s.testCancel()
 }
 
 func (s *ProxyHappySuite) ctx() context.Context {
-	// Make all RPC calls last at most 1 sec, meaning all async issues or deadlock will not kill tests.
-	ctx, _ := context.WithTimeout(context.TODO(), 120*time.Second)
-	return ctx
+	return s.testCtx
 }
 
 func (s *ProxyHappySuite) TestPingEmptyCarriesClientMetadata() {
@@ -221,11 +231,11 @@ func (s *ProxyHappySuite) SetupSuite() {
 	pb.RegisterTestServiceServer(s.server, &assertingService{t: s.T()})
 
 	// Setup of the proxy's Director.
-	s.serverClientConn, err = grpc.Dial(s.serverListener.Addr().String(), grpc.WithInsecure(), grpc.WithCodec(proxy.Codec()))
+	s.serverClientConn, err = grpc.Dial(s.serverListener.Addr().String(), grpc.WithInsecure(), proxy.DialOption())
 	require.NoError(s.T(), err, "must not error on deferred client Dial")
 	director := &checkingDirector{conn: s.serverClientConn}
 	s.proxy = grpc.NewServer(
-		grpc.CustomCodec(proxy.Codec()),
+		proxy.ServerOption(),
 		grpc.UnknownServiceHandler(proxy.TransparentHandler(director.ClientConn)),
 	)
 	// Ping handler is handled as an explicit registration and not as a TransparentHandler.
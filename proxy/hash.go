@@ -0,0 +1,250 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+)
+
+type hashCtxKey struct{}
+
+// NewContextWithHash returns a copy of ctx carrying the hash of a call for
+// the ring hash and maglev balancers. Directors set it before picking a
+// backend, for example with the shard of a request.
+func NewContextWithHash(ctx context.Context, h uint64) context.Context {
+	return context.WithValue(ctx, hashCtxKey{}, h)
+}
+
+// NewContextWithHashKey is like NewContextWithHash, with the hash of key.
+func NewContextWithHashKey(ctx context.Context, key string) context.Context {
+	return NewContextWithHash(ctx, hashKey(key))
+}
+
+// HashFromContext returns the hash set by NewContextWithHash, if any.
+func HashFromContext(ctx context.Context) (uint64, bool) {
+	h, ok := ctx.Value(hashCtxKey{}).(uint64)
+	return h, ok
+}
+
+// callHash returns the hash of the call, or a different hash for every
+// call without one, so that those are spread over the endpoints.
+func callHash(ctx context.Context, counter *uint64) uint64 {
+	if h, ok := HashFromContext(ctx); ok {
+		return h
+	}
+	return hashKey(strconv.FormatUint(atomic.AddUint64(counter, 1), 10))
+}
+
+// NewRingHashBalancer returns a Balancer which picks endpoints by consistent
+// hashing on the hash of each call, see NewContextWithHash. Calls with the
+// same hash go to the same endpoint, and adding or removing an endpoint only
+// moves the hashes of that endpoint. Endpoints get shares of the ring in
+// proportion to their weights.
+func NewRingHashBalancer(endpoints ...Endpoint) Balancer {
+	b := &ringHash{}
+	b.Update(endpoints)
+	return b
+}
+
+type ringHash struct {
+	calls uint64
+
+	mu        sync.Mutex
+	endpoints []Endpoint
+	ring      *hashRing
+}
+
+// ringReplicas is the number of points of an endpoint on a ring, per unit of
+// weight.
+const ringReplicas = 100
+
+func (b *ringHash) Pick(ctx context.Context, method string) (*grpc.ClientConn, func(error), error) {
+	b.mu.Lock()
+	ring := b.ring
+	b.mu.Unlock()
+	conn := ring.pick(callHash(ctx, &b.calls))
+	if conn == nil {
+		return nil, nil, errNoEndpoints
+	}
+	return conn, nil, nil
+}
+
+func (b *ringHash) Update(endpoints []Endpoint) {
+	ring := newHashRing(endpoints, ringReplicas)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.endpoints = append([]Endpoint(nil), endpoints...)
+	b.ring = ring
+}
+
+func (b *ringHash) Status() []EndpointStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := make([]EndpointStatus, len(b.endpoints))
+	for i, ep := range b.endpoints {
+		status[i] = endpointStatus(ep)
+	}
+	return status
+}
+
+// maglevTableSize is the size of the lookup table of the maglev balancer. It
+// must be prime, and much larger than the number of endpoints.
+const maglevTableSize = 65537
+
+// NewMaglevBalancer returns a Balancer which picks endpoints on the hash of
+// each call, see NewContextWithHash, with Google's Maglev hashing. Compared
+// to NewRingHashBalancer, picks take constant time and the load is spread
+// more evenly, but a change of endpoints moves slightly more hashes.
+func NewMaglevBalancer(endpoints ...Endpoint) Balancer {
+	b := &maglev{}
+	b.Update(endpoints)
+	return b
+}
+
+type maglev struct {
+	calls uint64
+
+	mu        sync.Mutex
+	endpoints []Endpoint
+	table     []*grpc.ClientConn
+}
+
+func (b *maglev) Pick(ctx context.Context, method string) (*grpc.ClientConn, func(error), error) {
+	b.mu.Lock()
+	table := b.table
+	b.mu.Unlock()
+	if len(table) == 0 {
+		return nil, nil, errNoEndpoints
+	}
+	return table[callHash(ctx, &b.calls)%uint64(len(table))], nil, nil
+}
+
+func (b *maglev) Update(endpoints []Endpoint) {
+	table := newMaglevTable(endpoints, maglevTableSize)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.endpoints = append([]Endpoint(nil), endpoints...)
+	b.table = table
+}
+
+func (b *maglev) Status() []EndpointStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := make([]EndpointStatus, len(b.endpoints))
+	for i, ep := range b.endpoints {
+		status[i] = endpointStatus(ep)
+	}
+	return status
+}
+
+// newMaglevTable fills a lookup table of size m, which must be prime. Every
+// endpoint walks its own permutation of the table, derived from its target,
+// and claims the next free entry, once per unit of weight in each round.
+func newMaglevTable(endpoints []Endpoint, m int) []*grpc.ClientConn {
+	if len(endpoints) == 0 {
+		return nil
+	}
+	offsets := make([]uint64, len(endpoints))
+	skips := make([]uint64, len(endpoints))
+	next := make([]uint64, len(endpoints))
+	seen := make(map[string]int)
+	for i, ep := range endpoints {
+		id := endpointID(ep, seen)
+		offsets[i] = hashKey("offset-"+id) % uint64(m)
+		skips[i] = hashKey("skip-"+id)%uint64(m-1) + 1
+	}
+	table := make([]*grpc.ClientConn, m)
+	filled := 0
+	for {
+		for i, ep := range endpoints {
+			for w := ep.weight(); w > 0; w-- {
+				slot := (offsets[i] + next[i]*skips[i]) % uint64(m)
+				for table[slot] != nil {
+					next[i]++
+					slot = (offsets[i] + next[i]*skips[i]) % uint64(m)
+				}
+				table[slot] = ep.Conn
+				next[i]++
+				if filled++; filled == m {
+					return table
+				}
+			}
+		}
+	}
+}
+
+// endpointID returns a stable identifier for ep, its target with the number
+// of endpoints with the same target seen before.
+func endpointID(ep Endpoint, seen map[string]int) string {
+	target := ep.Conn.Target()
+	id := target + "#" + strconv.Itoa(seen[target])
+	seen[target]++
+	return id
+}
+
+// hashRing places endpoints on a ring of 64 bit hashes for consistent
+// hashing. A key belongs to the first point at or after its hash.
+type hashRing struct {
+	hashes []uint64
+	conns  []*grpc.ClientConn
+}
+
+// newHashRing returns a ring with replicas points per unit of weight for
+// every endpoint. Points are derived from the endpoint targets, so that
+// they do not depend on the order of endpoints.
+func newHashRing(endpoints []Endpoint, replicas int) *hashRing {
+	type point struct {
+		hash uint64
+		conn *grpc.ClientConn
+	}
+	var points []point
+	seen := make(map[string]int)
+	for _, ep := range endpoints {
+		id := endpointID(ep, seen)
+		for i := 0; i < replicas*ep.weight(); i++ {
+			points = append(points, point{hashKey(id + "-" + strconv.Itoa(i)), ep.Conn})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+	r := &hashRing{hashes: make([]uint64, len(points)), conns: make([]*grpc.ClientConn, len(points))}
+	for i, p := range points {
+		r.hashes[i], r.conns[i] = p.hash, p.conn
+	}
+	return r
+}
+
+// pick returns the connection owning hash h, or nil if the ring is empty.
+func (r *hashRing) pick(h uint64) *grpc.ClientConn {
+	if len(r.hashes) == 0 {
+		return nil
+	}
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.conns[i]
+}
+
+// hashKey hashes s with FNV-1a, mixed so that similar keys spread over the
+// whole ring.
+func hashKey(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	// splitmix64 finalizer.
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
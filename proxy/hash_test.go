@@ -0,0 +1,77 @@
+package proxy_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func pickHashes(t *testing.T, b proxy.Balancer, n int) []*grpc.ClientConn {
+	picks := make([]*grpc.ClientConn, n)
+	for i := range picks {
+		ctx := proxy.NewContextWithHashKey(context.Background(), fmt.Sprintf("shard-%d", i))
+		conn, _, err := b.Pick(ctx, "/svc/method")
+		require.NoError(t, err)
+		picks[i] = conn
+	}
+	return picks
+}
+
+func TestHashBalancers(t *testing.T) {
+	balancers := map[string]func(...proxy.Endpoint) proxy.Balancer{
+		"ring_hash": proxy.NewRingHashBalancer,
+		"maglev":    proxy.NewMaglevBalancer,
+	}
+	for name, newBalancer := range balancers {
+		t.Run(name, func(t *testing.T) {
+			conns := idleConns(t, 4)
+			defer closeConns(conns)
+			b := newBalancer(proxy.Endpoints(conns...)...)
+
+			picks := pickHashes(t, b, 1000)
+			counts := map[*grpc.ClientConn]int{}
+			for i, conn := range pickHashes(t, b, 1000) {
+				assert.True(t, picks[i] == conn, "hash %d must keep its endpoint", i)
+				counts[conn]++
+			}
+			for _, conn := range conns {
+				assert.InDelta(t, 250, counts[conn], 100, "hashes are spread evenly")
+			}
+
+			b.Update(proxy.Endpoints(conns[:3]...))
+			moved := 0
+			for i, conn := range pickHashes(t, b, 1000) {
+				if picks[i] == conns[3] {
+					assert.True(t, conn != conns[3], "hash %d must move", i)
+				} else if picks[i] != conn {
+					moved++
+				}
+			}
+			assert.True(t, moved < 50, "%d hashes of remaining endpoints moved", moved)
+
+			assert.Len(t, pickCounts(t, b, 300), 3, "calls without a hash are spread")
+
+			b.Update(nil)
+			_, _, err := b.Pick(context.Background(), "/svc/method")
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestHashBalancers_Weights(t *testing.T) {
+	conns := idleConns(t, 2)
+	defer closeConns(conns)
+	endpoints := []proxy.Endpoint{{Conn: conns[0], Weight: 3}, {Conn: conns[1]}}
+	for _, b := range []proxy.Balancer{proxy.NewRingHashBalancer(endpoints...), proxy.NewMaglevBalancer(endpoints...)} {
+		counts := map[*grpc.ClientConn]int{}
+		for _, conn := range pickHashes(t, b, 1000) {
+			counts[conn]++
+		}
+		assert.InDelta(t, 750, counts[conns[0]], 100)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// MetadataHook inspects or rewrites the headers or trailers sent by a backend
+// before they are forwarded to the client. It receives a copy of the
+// metadata, which it may modify in place, and returns the metadata to
+// forward.
+type MetadataHook func(ctx context.Context, md metadata.MD) metadata.MD
+
+// WithResponseHeaderHook adds a hook for backend response headers. Hooks run
+// in the order they were added.
+func WithResponseHeaderHook(h MetadataHook) Option {
+	return func(o *options) {
+		o.headerHooks = append(o.headerHooks, h)
+	}
+}
+
+// WithResponseTrailerHook adds a hook for backend response trailers. Hooks
+// run in the order they were added.
+func WithResponseTrailerHook(h MetadataHook) Option {
+	return func(o *options) {
+		o.trailerHooks = append(o.trailerHooks, h)
+	}
+}
+
+// AllowMetadata returns a MetadataHook which only keeps the given keys.
+// Keys are case insensitive.
+func AllowMetadata(keys ...string) MetadataHook {
+	allowed := keySet(keys)
+	return func(ctx context.Context, md metadata.MD) metadata.MD {
+		for k := range md {
+			if _, ok := allowed[k]; !ok {
+				delete(md, k)
+			}
+		}
+		return md
+	}
+}
+
+// DropMetadata returns a MetadataHook which removes the given keys. Keys are
+// case insensitive.
+func DropMetadata(keys ...string) MetadataHook {
+	dropped := keySet(keys)
+	return func(ctx context.Context, md metadata.MD) metadata.MD {
+		for k := range dropped {
+			delete(md, k)
+		}
+		return md
+	}
+}
+
+func keySet(keys []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(keys))
+	for _, k := range keys {
+		set[strings.ToLower(k)] = struct{}{}
+	}
+	return set
+}
+
+// responseHooks returns the header and trailer hooks of a stream, including
+// the response metadata rules.
+func (h *handler) responseHooks(vars func(string) string) (header, trailer []MetadataHook) {
+	header, trailer = h.opts.headerHooks, h.opts.trailerHooks
+	if len(h.opts.responseRules) != 0 {
+		hook := responseRulesHook(h.opts.responseRules, vars)
+		header = append(header[:len(header):len(header)], hook)
+		trailer = append(trailer[:len(trailer):len(trailer)], hook)
+	}
+	return header, trailer
+}
+
+// metadataHookServerStream applies hooks to the headers and trailers sent to
+// the client.
+type metadataHookServerStream struct {
+	grpc.ServerStream
+	header, trailer []MetadataHook
+}
+
+func (s *metadataHookServerStream) apply(hooks []MetadataHook, md metadata.MD) metadata.MD {
+	if len(hooks) == 0 {
+		return md
+	}
+	md = md.Copy()
+	ctx := s.Context()
+	for _, h := range hooks {
+		md = h(ctx, md)
+	}
+	return md
+}
+
+func (s *metadataHookServerStream) SetHeader(md metadata.MD) error {
+	return s.ServerStream.SetHeader(s.apply(s.header, md))
+}
+
+func (s *metadataHookServerStream) SendHeader(md metadata.MD) error {
+	return s.ServerStream.SendHeader(s.apply(s.header, md))
+}
+
+func (s *metadataHookServerStream) SetTrailer(md metadata.MD) {
+	s.ServerStream.SetTrailer(s.apply(s.trailer, md))
+}
@@ -0,0 +1,101 @@
+package proxy_test
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// metadataService sends custom headers and trailers. A "fail" ping fails
+// without sending any header.
+func metadataService() *pingService {
+	return &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			grpc.SetTrailer(ctx, metadata.Pairs("x-trailer", "t", "x-secret-trailer", "s"))
+			if ping.Value == "fail" {
+				return nil, status.Error(codes.FailedPrecondition, "failed")
+			}
+			grpc.SetHeader(ctx, metadata.Pairs("x-header", "h", "x-secret", "s"))
+			return &pb.PingResponse{Value: ping.Value}, nil
+		},
+		pingStream: func(stream pb.TestService_PingStreamServer) error {
+			stream.SetTrailer(metadata.Pairs("x-trailer", "t"))
+			if err := stream.SendHeader(metadata.Pairs("x-header", "h")); err != nil {
+				return err
+			}
+			for {
+				ping, err := stream.Recv()
+				if err != nil {
+					return nil
+				}
+				if err := stream.Send(&pb.PingResponse{Value: ping.Value}); err != nil {
+					return err
+				}
+			}
+		},
+	}
+}
+
+func TestResponseMetadata_Forwarded(t *testing.T) {
+	env := newTestEnv(t, metadataService())
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	var header, trailer metadata.MD
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"}, grpc.Header(&header), grpc.Trailer(&trailer))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"h"}, header.Get("x-header"))
+	assert.Equal(t, []string{"t"}, trailer.Get("x-trailer"))
+
+	trailer = nil
+	_, err = env.client.Ping(ctx, &pb.PingRequest{Value: "fail"}, grpc.Trailer(&trailer))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Equal(t, []string{"t"}, trailer.Get("x-trailer"), "trailers of a failed call")
+
+	stream, err := env.client.PingStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.PingRequest{Value: "foo"}))
+	header, err = stream.Header()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"h"}, header.Get("x-header"))
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	require.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+	assert.Equal(t, []string{"t"}, stream.Trailer().Get("x-trailer"))
+}
+
+func TestResponseMetadata_Hooks(t *testing.T) {
+	env := newTestEnv(t, metadataService(),
+		proxy.WithResponseHeaderHook(proxy.AllowMetadata("X-Header")),
+		proxy.WithResponseTrailerHook(proxy.DropMetadata("x-secret-trailer")),
+		proxy.WithResponseTrailerHook(func(ctx context.Context, md metadata.MD) metadata.MD {
+			md.Set("x-proxy", "yes")
+			return md
+		}),
+	)
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	var header, trailer metadata.MD
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"}, grpc.Header(&header), grpc.Trailer(&trailer))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"h"}, header.Get("x-header"))
+	assert.Empty(t, header.Get("x-secret"))
+	assert.Equal(t, []string{"t"}, trailer.Get("x-trailer"))
+	assert.Empty(t, trailer.Get("x-secret-trailer"))
+	assert.Equal(t, []string{"yes"}, trailer.Get("x-proxy"))
+}
@@ -0,0 +1,176 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// defaultHealthInterval is how often Watch reevaluates the health of a
+// service when HealthService.Interval is not set.
+const defaultHealthInterval = time.Second
+
+// HealthService is a grpc.health.v1.Health service for the proxy itself,
+// so that load balancers in front of the proxy can health check it. The
+// serving status of a service is computed from the backends its calls are
+// routed to:
+//
+// A backend is healthy unless it is draining, or all of its endpoints are
+// failing to connect or ejected by outlier detection. Backends whose
+// balancer is not a StatusReporter are assumed healthy. A service is
+// SERVING if any backend its routes may pick is healthy, and NOT_SERVING
+// otherwise. Services which no route matches are unknown, and checks fail
+// with codes.NotFound as per the health checking protocol. The empty
+// service is the health of the proxy as a whole, SERVING if any routed
+// backend is healthy.
+//
+// Once registered, health checks are answered by the proxy instead of
+// being forwarded to a backend.
+type HealthService struct {
+	// Interval is how often Watch reevaluates the status. It defaults to 1
+	// second.
+	Interval time.Duration
+
+	// Drainer, if set, reports all services as NOT_SERVING while it is
+	// draining, so that load balancers move traffic off the proxy.
+	Drainer *Drainer
+
+	router *Router
+}
+
+// NewRouterHealth returns a HealthService reporting the health of the
+// routes and backends of r.
+func NewRouterHealth(r *Router) *HealthService {
+	return &HealthService{router: r}
+}
+
+// Register registers the service as the health service of s.
+func (h *HealthService) Register(s *grpc.Server) {
+	healthpb.RegisterHealthServer(s, h)
+}
+
+// Status returns the serving status of service, and false if the service
+// is unknown.
+func (h *HealthService) Status(service string) (healthpb.HealthCheckResponse_ServingStatus, bool) {
+	backends, ok := h.router.serviceBackends(service)
+	if !ok {
+		return healthpb.HealthCheckResponse_SERVICE_UNKNOWN, false
+	}
+	if h.Drainer != nil && h.Drainer.Draining() {
+		return healthpb.HealthCheckResponse_NOT_SERVING, true
+	}
+	for _, name := range backends {
+		if h.router.backendHealthy(name) {
+			return healthpb.HealthCheckResponse_SERVING, true
+		}
+	}
+	return healthpb.HealthCheckResponse_NOT_SERVING, true
+}
+
+// Check implements the health service.
+func (h *HealthService) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	s, ok := h.Status(req.GetService())
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown service %q", req.GetService())
+	}
+	return &healthpb.HealthCheckResponse{Status: s}, nil
+}
+
+// Watch implements the health service. It sends the status of the service
+// when the stream starts and whenever it changes. Unknown services are
+// reported as SERVICE_UNKNOWN, and may become known when routes change.
+func (h *HealthService) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	interval := h.Interval
+	if interval <= 0 {
+		interval = defaultHealthInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := healthpb.HealthCheckResponse_ServingStatus(-1)
+	for {
+		if s, _ := h.Status(req.GetService()); s != last {
+			if err := stream.Send(&healthpb.HealthCheckResponse{Status: s}); err != nil {
+				return err
+			}
+			last = s
+		}
+		select {
+		case <-ticker.C:
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		}
+	}
+}
+
+// serviceBackends returns the backends which the routes of r may pick for
+// the methods of service, and false if no route matches any of them. The
+// empty service stands for all routes.
+func (r *Router) serviceBackends(service string) ([]string, bool) {
+	prefix := "/" + service + "/"
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var backends []string
+	matched := false
+	for i := range r.routes {
+		route := &r.routes[i]
+		whole := strings.HasPrefix(prefix, route.MethodPrefix)
+		if service != "" && !whole && !strings.HasPrefix(route.MethodPrefix, prefix) {
+			continue
+		}
+		matched = true
+		if len(route.Split) == 0 && route.Backend != "" {
+			backends = append(backends, route.Backend)
+		}
+		for _, bw := range route.Split {
+			if bw.Weight > 0 {
+				backends = append(backends, bw.Backend)
+			}
+		}
+		for _, split := range route.MethodSplits {
+			for _, bw := range split {
+				if bw.Weight > 0 {
+					backends = append(backends, bw.Backend)
+				}
+			}
+		}
+		if service != "" && whole && route.Authority == "" && len(route.Metadata) == 0 {
+			// Routes after one taking all calls of the service are never
+			// used for it.
+			break
+		}
+	}
+	return backends, matched
+}
+
+// backendHealthy reports whether the named backend can take calls.
+func (r *Router) backendHealthy(name string) bool {
+	r.mu.RLock()
+	b, ok := r.backends[name]
+	draining := r.draining[name]
+	r.mu.RUnlock()
+	if !ok || draining {
+		return false
+	}
+	sr, ok := b.(StatusReporter)
+	if !ok {
+		return true
+	}
+	for _, ep := range sr.Status() {
+		if !ep.Ejected && ep.State != connectivity.TransientFailure && ep.State != connectivity.Shutdown {
+			return true
+		}
+	}
+	return false
+}
+
+var _ healthpb.HealthServer = (*HealthService)(nil)
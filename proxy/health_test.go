@@ -0,0 +1,110 @@
+package proxy_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestRouterHealth(t *testing.T) {
+	backend, pingConn := startReflectionBackend(t, func(s *grpc.Server) {
+		pb.RegisterTestServiceServer(s, &pingService{})
+	})
+	defer backend.Stop()
+	defer pingConn.Close()
+
+	// A backend whose server is gone fails to connect.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, lis.Close())
+	downConn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure(), proxy.DialOption())
+	require.NoError(t, err)
+	defer downConn.Close()
+
+	router := proxy.NewRouter()
+	router.AddBackend("ping", pingConn)
+	router.AddBackend("down", downConn)
+	router.AddBackend("canary", pingConn)
+	router.AddRoute(proxy.Route{MethodPrefix: "/vgough.testproto.TestService/", Backend: "ping"})
+	router.AddRoute(proxy.Route{MethodPrefix: "/down.Service/", Backend: "down"})
+	router.AddRoute(proxy.Route{MethodPrefix: "/split.Service/", Split: []proxy.BackendWeight{{Backend: "down", Weight: 90}, {Backend: "canary", Weight: 10}}})
+	router.AddRoute(proxy.Route{MethodPrefix: "/missing.Service/Get", Backend: "missing"})
+
+	drainer := &proxy.Drainer{}
+	h := proxy.NewRouterHealth(router)
+	h.Interval = 10 * time.Millisecond
+	h.Drainer = drainer
+	lis, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer(
+		proxy.ServerOption(),
+		grpc.UnknownServiceHandler(proxy.TransparentHandler(router.Direct)),
+	)
+	h.Register(server)
+	go server.Serve(lis)
+	defer server.Stop()
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Make the down backend try to connect.
+	failCtx, failCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	_, _ = pb.NewTestServiceClient(downConn).PingEmpty(failCtx, &pb.Empty{})
+	failCancel()
+	require.Eventually(t, func() bool { return downConn.GetState() == connectivity.TransientFailure }, 5*time.Second, 10*time.Millisecond)
+
+	check := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		require.NoError(t, err, service)
+		return resp.GetStatus()
+	}
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, check(""))
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, check("vgough.testproto.TestService"))
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check("down.Service"))
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, check("split.Service"), "one healthy backend of a split suffices")
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check("missing.Service"), "unregistered backends are not healthy")
+
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{Service: "unknown.Service"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	router.DrainBackend("canary")
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check("split.Service"), "draining backends are not healthy")
+	router.ResumeBackend("canary")
+
+	watch, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: "vgough.testproto.TestService"})
+	require.NoError(t, err)
+	resp, err := watch.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.GetStatus())
+
+	router.DrainBackend("ping")
+	resp, err = watch.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, resp.GetStatus())
+	router.ResumeBackend("ping")
+	resp, err = watch.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.GetStatus())
+
+	require.NoError(t, drainer.Drain(ctx, 0))
+	resp, err = watch.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, resp.GetStatus(), "a draining proxy is not serving")
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check(""))
+}
@@ -0,0 +1,176 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// HedgingPolicy describes how calls are hedged. Hedging sends additional
+// attempts of a call when the previous one did not respond in time, uses
+// whichever attempt responds first and cancels the others.
+//
+// Like retries, hedging only applies to single-request calls, which the
+// proxy buffers to send to every attempt.
+type HedgingPolicy struct {
+	// Delay is the time to wait for a response before starting the next
+	// attempt.
+	Delay time.Duration
+
+	// MaxAttempts is the total number of attempts, including the original
+	// call. Defaults to 2.
+	MaxAttempts int
+
+	// NonFatalCodes lists status codes which do not end the call, so that
+	// other attempts are waited for and the next attempt starts at once.
+	// Defaults to codes.Unavailable.
+	NonFatalCodes []codes.Code
+}
+
+// WithHedging enables hedging of calls whose full method name starts with
+// prefix, such as "/pkg.Service/Method" or "/pkg.Service/". An empty prefix
+// matches every method. When several prefixes match, the longest wins.
+//
+// Hedged attempts go to the backends listed in Direction.Hedges in order, or
+// to BackendConn if there are none.
+func WithHedging(prefix string, policy HedgingPolicy) Option {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = 2
+	}
+	return func(o *options) {
+		if o.hedging == nil {
+			o.hedging = make(map[string]*HedgingPolicy)
+		}
+		o.hedging[prefix] = &policy
+	}
+}
+
+// hedgingPolicy returns the policy for method, or nil.
+func (o *options) hedgingPolicy(method string) *HedgingPolicy {
+	var best *HedgingPolicy
+	bestLen := -1
+	for prefix, p := range o.hedging {
+		if len(prefix) > bestLen && strings.HasPrefix(method, prefix) {
+			best, bestLen = p, len(prefix)
+		}
+	}
+	return best
+}
+
+func (p *HedgingPolicy) fatal(err error) bool {
+	if err == nil || err == io.EOF {
+		return true
+	}
+	code := status.Code(err)
+	if len(p.NonFatalCodes) == 0 {
+		return code != codes.Unavailable
+	}
+	for _, c := range p.NonFatalCodes {
+		if c == code {
+			return false
+		}
+	}
+	return true
+}
+
+type hedgeResult struct {
+	attempt int
+	out     grpc.ClientStream
+	first   *frame
+	err     error
+}
+
+// newStream opens the backend stream for a hedged call. Like with retries,
+// the returned stream has already received the first response.
+func (p *HedgingPolicy) newStream(ctx context.Context, in grpc.ServerStream, conn *grpc.ClientConn, hedges []*grpc.ClientConn, method string, callOpts ...grpc.CallOption) (grpc.ClientStream, error) {
+	req, unary, err := bufferRequest(in, 1)
+	if err != nil {
+		return nil, err
+	}
+	if !unary || p.MaxAttempts < 2 {
+		return replayStream(ctx, conn, method, req, false, callOpts...)
+	}
+
+	results := make(chan hedgeResult, p.MaxAttempts)
+	cancels := make([]context.CancelFunc, 0, p.MaxAttempts)
+	start := func() {
+		attempt := len(cancels)
+		target := conn
+		if len(hedges) != 0 && attempt > 0 {
+			target = hedges[(attempt-1)%len(hedges)]
+		}
+		actx, cancel := context.WithCancel(ctx)
+		cancels = append(cancels, cancel)
+		go func() {
+			out, err := replayStream(actx, target, method, req, true, callOpts...)
+			first := &frame{}
+			if err == nil {
+				err = out.RecvMsg(first)
+			}
+			results <- hedgeResult{attempt: attempt, out: out, first: first, err: err}
+		}()
+	}
+	cancelOthers := func(winner int) {
+		for i, cancel := range cancels {
+			if i != winner {
+				cancel()
+			}
+		}
+	}
+
+	start()
+	timer := time.NewTimer(p.Delay)
+	defer timer.Stop()
+	pending := 1
+	var last hedgeResult
+	for {
+		select {
+		case <-ctx.Done():
+			cancelOthers(-1)
+			return nil, status.FromContextError(ctx.Err()).Err()
+		case <-timer.C:
+			if len(cancels) < p.MaxAttempts {
+				start()
+				pending++
+				timer.Reset(p.Delay)
+			}
+		case r := <-results:
+			pending--
+			if p.fatal(r.err) {
+				cancelOthers(r.attempt)
+				if r.out == nil {
+					return nil, r.err
+				}
+				return &primedClientStream{ClientStream: r.out, first: r.first, err: r.err, primed: true}, nil
+			}
+			last = r
+			if len(cancels) < p.MaxAttempts {
+				start()
+				pending++
+				// The timer may have fired while the result was handled,
+				// which must not start the next attempt early.
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(p.Delay)
+			} else if pending == 0 {
+				if last.out == nil {
+					return nil, last.err
+				}
+				return &primedClientStream{ClientStream: last.out, first: last.first, err: last.err, primed: true}, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package proxy_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// slowService answers Ping with its name after delay, or once the call is
+// cancelled, which it records.
+func slowService(name string, delay time.Duration, cancelled *int32) *pingService {
+	return &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			select {
+			case <-time.After(delay):
+				return &pb.PingResponse{Value: name}, nil
+			case <-ctx.Done():
+				atomic.AddInt32(cancelled, 1)
+				return nil, ctx.Err()
+			}
+		},
+	}
+}
+
+func hedgingEnv(t *testing.T, primary pb.TestServiceServer, hedges []*grpc.ClientConn, opts ...proxy.Option) *testEnv {
+	return newTestEnvWithDirector(t, primary, func(backend *grpc.ClientConn) proxy.StreamDirector {
+		return func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+			return ctx, nil, proxy.Direction{BackendConn: backend, Hedges: hedges}, nil
+		}
+	}, opts...)
+}
+
+func TestHedging_FastestWins(t *testing.T) {
+	var cancelled int32
+	fastServer, fast := startBackend(t, slowService("fast", 0, &cancelled))
+	defer fastServer.Stop()
+	defer fast.Close()
+
+	env := hedgingEnv(t, slowService("slow", 5*time.Second, &cancelled), []*grpc.ClientConn{fast},
+		proxy.WithHedging("/vgough.testproto.TestService/Ping", proxy.HedgingPolicy{Delay: 20 * time.Millisecond}))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	start := time.Now()
+	out, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err)
+	assert.Equal(t, "fast", out.Value)
+	assert.True(t, time.Since(start) < time.Second, "the hedged attempt must answer")
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&cancelled) == 1 }, time.Second, 10*time.Millisecond,
+		"the slow attempt must be cancelled")
+}
+
+func TestHedging_NoHedgeWhenFast(t *testing.T) {
+	var hedgeCalls, cancelled int32
+	hedgeServer, hedge := startBackend(t, countingService(&hedgeCalls))
+	defer hedgeServer.Stop()
+	defer hedge.Close()
+
+	env := hedgingEnv(t, slowService("primary", 0, &cancelled), []*grpc.ClientConn{hedge},
+		proxy.WithHedging("", proxy.HedgingPolicy{Delay: time.Second}))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	out, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err)
+	assert.Equal(t, "primary", out.Value)
+	assert.EqualValues(t, 0, atomic.LoadInt32(&hedgeCalls))
+}
+
+func TestHedging_NonFatalStartsNextAttempt(t *testing.T) {
+	var calls, cancelled int32
+	hedgeServer, hedge := startBackend(t, slowService("hedge", 0, &cancelled))
+	defer hedgeServer.Stop()
+	defer hedge.Close()
+
+	env := hedgingEnv(t, failingService(codes.Unavailable, &calls), []*grpc.ClientConn{hedge},
+		proxy.WithHedging("/vgough.testproto.TestService/", proxy.HedgingPolicy{Delay: time.Minute}))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	out, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err)
+	assert.Equal(t, "hedge", out.Value)
+}
+
+func TestHedging_DelayAfterNonFatal(t *testing.T) {
+	var mu sync.Mutex
+	var starts []time.Time
+	hedgeServer, hedge := startBackend(t, &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			mu.Lock()
+			starts = append(starts, time.Now())
+			n := len(starts)
+			mu.Unlock()
+			if n < 2 {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			return &pb.PingResponse{Value: "hedge"}, nil
+		},
+	})
+	defer hedgeServer.Stop()
+	defer hedge.Close()
+
+	const delay = 100 * time.Millisecond
+	var calls int32
+	env := hedgingEnv(t, failingService(codes.Unavailable, &calls), []*grpc.ClientConn{hedge},
+		proxy.WithHedging("/vgough.testproto.TestService/", proxy.HedgingPolicy{Delay: delay, MaxAttempts: 3}))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	out, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err)
+	assert.Equal(t, "hedge", out.Value)
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, starts, 2)
+	assert.True(t, starts[1].Sub(starts[0]) >= delay*9/10,
+		"the attempt after a non-fatal failure waits for the delay, got %v", starts[1].Sub(starts[0]))
+}
+
+func TestHedging_PerMethod(t *testing.T) {
+	var calls, hedgeCalls int32
+	hedgeServer, hedge := startBackend(t, countingService(&hedgeCalls))
+	defer hedgeServer.Stop()
+	defer hedge.Close()
+
+	env := hedgingEnv(t, failingService(codes.Unavailable, &calls), []*grpc.ClientConn{hedge},
+		proxy.WithHedging("/vgough.testproto.TestService/PingEmpty", proxy.HedgingPolicy{Delay: time.Millisecond}))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	assert.Equal(t, codes.Unavailable, status.Code(err), "Ping is not hedged")
+	assert.EqualValues(t, 0, atomic.LoadInt32(&hedgeCalls))
+}
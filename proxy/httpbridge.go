@@ -0,0 +1,165 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// httpStreamContext returns the context of a stream bridged from an HTTP
+// request. It carries the request headers as incoming metadata, the client
+// address and the grpc-timeout deadline. The context is valid even if an
+// error is returned.
+func httpStreamContext(r *http.Request, method string, stream grpc.ServerStream) (context.Context, context.CancelFunc, error) {
+	ctx := r.Context()
+	ctx = metadata.NewIncomingContext(ctx, headerMetadata(r))
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: httpRemoteAddr(r.RemoteAddr)})
+	ctx = grpc.NewContextWithServerTransportStream(ctx, &httpTransportStream{method: method, stream: stream})
+	if v := r.Header.Get("Grpc-Timeout"); v != "" {
+		timeout, err := parseGRPCTimeout(v)
+		if err != nil {
+			ctx, cancel := context.WithCancel(ctx)
+			return ctx, cancel, status.Errorf(codes.InvalidArgument, "malformed grpc-timeout: %v", err)
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		return ctx, cancel, nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return ctx, cancel, nil
+}
+
+// reservedHeaders are not forwarded as metadata.
+var reservedHeaders = map[string]bool{
+	"content-type":      true,
+	"content-length":    true,
+	"connection":        true,
+	"keep-alive":        true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+	"proxy-connection":  true,
+	"te":                true,
+	"host":              true,
+	"grpc-timeout":      true,
+	"grpc-encoding":     true,
+	"x-grpc-web":        true,
+}
+
+func headerMetadata(r *http.Request) metadata.MD {
+	md := metadata.MD{}
+	for k, values := range r.Header {
+		k = strings.ToLower(k)
+		if reservedHeaders[k] {
+			continue
+		}
+		for _, v := range values {
+			if strings.HasSuffix(k, "-bin") {
+				if b, err := decodeBinHeader(v); err == nil {
+					v = string(b)
+				}
+			}
+			md[k] = append(md[k], v)
+		}
+	}
+	md[":authority"] = []string{r.Host}
+	return md
+}
+
+func decodeBinHeader(v string) ([]byte, error) {
+	if len(v)%4 == 0 {
+		return base64.StdEncoding.DecodeString(v)
+	}
+	return base64.RawStdEncoding.DecodeString(v)
+}
+
+func httpRemoteAddr(addr string) net.Addr {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+}
+
+// parseGRPCTimeout parses the value of a grpc-timeout header.
+func parseGRPCTimeout(v string) (time.Duration, error) {
+	if len(v) < 2 {
+		return 0, fmt.Errorf("timeout %q is too short", v)
+	}
+	// The value has at most 8 digits.
+	if len(v) > 9 {
+		return 0, fmt.Errorf("timeout %q is too long", v)
+	}
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad timeout value %q", v)
+	}
+	var unit time.Duration
+	switch v[len(v)-1] {
+	case 'H':
+		unit = time.Hour
+	case 'M':
+		unit = time.Minute
+	case 'S':
+		unit = time.Second
+	case 'm':
+		unit = time.Millisecond
+	case 'u':
+		unit = time.Microsecond
+	case 'n':
+		unit = time.Nanosecond
+	default:
+		return 0, fmt.Errorf("bad timeout unit in %q", v)
+	}
+	if n > math.MaxInt64/int64(unit) {
+		return math.MaxInt64, nil
+	}
+	return time.Duration(n) * unit, nil
+}
+
+func encodeMetadataValue(k, v string) string {
+	if strings.HasSuffix(k, "-bin") {
+		return base64.RawStdEncoding.EncodeToString([]byte(v))
+	}
+	return v
+}
+
+// httpTransportStream exposes a bridged stream through
+// grpc.ServerTransportStreamFromContext, so grpc.SetHeader and
+// grpc.SetTrailer work on calls received over HTTP.
+type httpTransportStream struct {
+	method string
+	stream grpc.ServerStream
+}
+
+func (t *httpTransportStream) Method() string {
+	return t.method
+}
+
+func (t *httpTransportStream) SetHeader(md metadata.MD) error {
+	return t.stream.SetHeader(md)
+}
+
+func (t *httpTransportStream) SendHeader(md metadata.MD) error {
+	return t.stream.SendHeader(md)
+}
+
+func (t *httpTransportStream) SetTrailer(md metadata.MD) error {
+	t.stream.SetTrailer(md)
+	return nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// WithIdleTimeout ends streams which forwarded no message in either
+// direction for d, so that leaked long-lived streams do not pin backend
+// resources. This includes calls waiting for a slow backend to answer. The
+// backend call is cancelled and the client gets st, or
+// codes.DeadlineExceeded if st is nil.
+func WithIdleTimeout(d time.Duration, st *status.Status) Option {
+	return func(o *options) {
+		o.idleTimeout = d
+		o.idleStatus = st
+	}
+}
+
+// idleWatchdog cancels a stream once it has been idle for its timeout.
+type idleWatchdog struct {
+	grpc.ServerStream
+
+	// last is the time of the last message, in Unix nanoseconds.
+	last    int64
+	timeout time.Duration
+	cancel  context.CancelFunc
+
+	mu    sync.Mutex
+	timer *time.Timer
+	idle  bool
+}
+
+// startIdleWatchdog watches the messages of ss, calling cancel once none
+// was forwarded for timeout.
+func startIdleWatchdog(ss grpc.ServerStream, timeout time.Duration, cancel context.CancelFunc) *idleWatchdog {
+	w := &idleWatchdog{ServerStream: ss, last: time.Now().UnixNano(), timeout: timeout, cancel: cancel}
+	w.mu.Lock()
+	w.timer = time.AfterFunc(timeout, w.check)
+	w.mu.Unlock()
+	return w
+}
+
+// check cancels the stream if it is idle, or else waits for the rest of the
+// timeout after the last message.
+func (w *idleWatchdog) check() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer == nil {
+		return
+	}
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&w.last)))
+	if idle < w.timeout {
+		w.timer.Reset(w.timeout - idle)
+		return
+	}
+	w.idle = true
+	w.cancel()
+}
+
+func (w *idleWatchdog) touch() {
+	atomic.StoreInt64(&w.last, time.Now().UnixNano())
+}
+
+func (w *idleWatchdog) RecvMsg(m interface{}) error {
+	err := w.ServerStream.RecvMsg(m)
+	if err == nil {
+		w.touch()
+	}
+	return err
+}
+
+func (w *idleWatchdog) SendMsg(m interface{}) error {
+	err := w.ServerStream.SendMsg(m)
+	if err == nil {
+		w.touch()
+	}
+	return err
+}
+
+// stop stops the watchdog and reports whether it ended the stream.
+func (w *idleWatchdog) stop() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	return w.idle
+}
+
+// idleError is the error of a stream ended by the idle timeout.
+func (o *options) idleError() error {
+	if o.idleStatus != nil {
+		return o.idleStatus.Err()
+	}
+	return status.Errorf(codes.DeadlineExceeded, "stream idle for %v", o.idleTimeout)
+}
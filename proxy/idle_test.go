@@ -0,0 +1,65 @@
+package proxy_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	backendDone := make(chan error, 1)
+	svc := &pingService{
+		pingStream: func(stream pb.TestService_PingStreamServer) error {
+			for {
+				ping, err := stream.Recv()
+				if err != nil {
+					backendDone <- stream.Context().Err()
+					return err
+				}
+				if err := stream.Send(&pb.PingResponse{Value: ping.Value}); err != nil {
+					return err
+				}
+			}
+		},
+	}
+	env := newTestEnv(t, svc, proxy.WithIdleTimeout(100*time.Millisecond, nil))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	stream, err := env.client.PingStream(ctx)
+	require.NoError(t, err)
+	// Messages keep the stream alive past the timeout.
+	for i := 0; i < 4; i++ {
+		require.NoError(t, stream.Send(&pb.PingRequest{Value: "alive"}))
+		_, err := stream.Recv()
+		require.NoError(t, err)
+		time.Sleep(50 * time.Millisecond)
+	}
+	start := time.Now()
+	_, err = stream.Recv()
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Error(t, <-backendDone, "the backend call is cancelled")
+}
+
+func TestIdleTimeout_Status(t *testing.T) {
+	env := newTestEnv(t, &pingService{}, proxy.WithIdleTimeout(50*time.Millisecond, status.New(codes.Unavailable, "idle")))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "quick"})
+	require.NoError(t, err)
+	stream, err := env.client.PingStream(ctx)
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, status.Error(codes.Unavailable, "idle"), err)
+}
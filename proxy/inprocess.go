@@ -0,0 +1,63 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"net"
+
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// inProcessBufferSize is the buffer size of each direction of an in-process
+// connection.
+const inProcessBufferSize = 1 << 20
+
+// InProcessListener is a listener for a grpc.Server running in the proxy
+// process, whose connections are in-memory pipes rather than sockets:
+//
+//	lis := proxy.NewInProcessListener()
+//	go server.Serve(lis)
+//	registry.Register("local", lis.BackendConfig())
+type InProcessListener struct {
+	*bufconn.Listener
+}
+
+// NewInProcessListener returns a new InProcessListener.
+func NewInProcessListener() *InProcessListener {
+	return &InProcessListener{Listener: bufconn.Listen(inProcessBufferSize)}
+}
+
+// DialContext connects to the listener. The address is ignored.
+func (l *InProcessListener) DialContext(ctx context.Context, address string) (net.Conn, error) {
+	// bufconn has no dial timeout, so give up on connections the server
+	// does not accept in time.
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := l.Listener.Dial()
+		done <- result{conn, err}
+	}()
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// BackendConfig returns the configuration of a backend served by the
+// listener.
+func (l *InProcessListener) BackendConfig() BackendConfig {
+	return BackendConfig{Address: "inprocess", Dialer: l.DialContext}
+}
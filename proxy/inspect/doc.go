@@ -0,0 +1,29 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+/*
+Package inspect decodes the frames forwarded by a proxy into dynamic proto
+messages, for logging, validation or transformation.
+
+The proxy itself never decodes payloads. A PayloadInspector is installed as
+a stream interceptor and only costs anything for the methods its Resolver
+knows about; frames of other methods are forwarded as raw bytes.
+
+	files, err := inspect.ParseFiles([]string{"protos"}, "api/service.proto")
+	...
+	pi := inspect.NewPayloadInspector(files, func(ctx context.Context, m *inspect.Message) error {
+		b, _ := m.Msg.MarshalJSON()
+		log.Printf("%s %s %s", m.Method, m.Direction, b)
+		return nil
+	})
+	handler := proxy.TransparentHandler(director, proxy.WithStreamInterceptor(pi.Interceptor()))
+
+The interceptor is chained with the proxy's frame transformers in the order
+the options are given, so frames may be inspected before or after they are
+rewritten.
+
+Descriptors come from proto source files, from descriptors compiled into
+the program, or from the server reflection service of a backend.
+*/
+package inspect
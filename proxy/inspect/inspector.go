@@ -0,0 +1,87 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package inspect
+
+import (
+	"context"
+
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Message is a decoded frame passed to an InspectFunc.
+type Message struct {
+	// Method is the full method name requested by the client.
+	Method string
+	// Direction is the direction the frame is forwarded in.
+	Direction proxy.FrameDirection
+	// Msg is the decoded frame, a request message for frames sent by the
+	// client and a response message for the others.
+	Msg *dynamic.Message
+
+	// Modified is set by the InspectFunc after changing Msg, so that the
+	// message is encoded again and forwarded in place of the original
+	// frame. Unmodified frames are forwarded as received.
+	Modified bool
+}
+
+// InspectFunc is called with every decoded frame. Returning an error aborts
+// the stream; errors created with the status package are returned to the
+// client as is.
+type InspectFunc func(ctx context.Context, m *Message) error
+
+// PayloadInspector decodes the frames of methods known to its Resolver and
+// hands them to an InspectFunc.
+type PayloadInspector struct {
+	resolver Resolver
+	inspect  InspectFunc
+}
+
+// NewPayloadInspector returns a PayloadInspector decoding frames with the
+// descriptors of r.
+func NewPayloadInspector(r Resolver, inspect InspectFunc) *PayloadInspector {
+	return &PayloadInspector{resolver: r, inspect: inspect}
+}
+
+// Interceptor returns the stream interceptor to install with
+// proxy.WithStreamInterceptor.
+func (p *PayloadInspector) Interceptor() proxy.StreamInterceptor {
+	return p.intercept
+}
+
+func (p *PayloadInspector) intercept(ctx context.Context, method string, dir proxy.FrameDirection, payload []byte) ([]byte, error) {
+	md, err := p.resolver.ResolveMethod(ctx, method)
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.Unavailable, "inspect: resolving %s: %v", method, err)
+	}
+	if md == nil {
+		return payload, nil
+	}
+
+	msgType, code := md.GetInputType(), codes.InvalidArgument
+	if dir == proxy.BackendToClient {
+		msgType, code = md.GetOutputType(), codes.Internal
+	}
+	m := &Message{Method: method, Direction: dir, Msg: dynamic.NewMessage(msgType)}
+	if err := m.Msg.Unmarshal(payload); err != nil {
+		return nil, status.Errorf(code, "inspect: decoding %s: %v", msgType.GetFullyQualifiedName(), err)
+	}
+	if err := p.inspect(ctx, m); err != nil {
+		return nil, err
+	}
+	if !m.Modified {
+		return payload, nil
+	}
+	out, err := m.Msg.Marshal()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "inspect: encoding %s: %v", msgType.GetFullyQualifiedName(), err)
+	}
+	return out, nil
+}
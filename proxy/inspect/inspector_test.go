@@ -0,0 +1,213 @@
+package inspect_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/mkxxx/grpc-proxy/proxy/inspect"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// echoService echoes ping values back.
+type echoService struct {
+	pb.TestServiceServer
+}
+
+func (s *echoService) Ping(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+	return &pb.PingResponse{Value: ping.Value, Counter: 1}, nil
+}
+
+func (s *echoService) PingStream(stream pb.TestService_PingStreamServer) error {
+	var counter int32
+	for {
+		ping, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		counter++
+		if err := stream.Send(&pb.PingResponse{Value: ping.Value, Counter: counter}); err != nil {
+			return err
+		}
+	}
+}
+
+func listen(t *testing.T, server *grpc.Server) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(lis)
+	return lis.Addr().String()
+}
+
+// startProxy starts a backend and a proxy in front of it, inspecting frames
+// with pi.
+func startProxy(t *testing.T, pi *inspect.PayloadInspector) (pb.TestServiceClient, func()) {
+	backend := grpc.NewServer()
+	pb.RegisterTestServiceServer(backend, &echoService{})
+	backendConn, err := grpc.Dial(listen(t, backend), grpc.WithInsecure(), proxy.DialOption())
+	require.NoError(t, err)
+
+	director := func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+		return ctx, nil, proxy.Direction{BackendConn: backendConn}, nil
+	}
+	server := grpc.NewServer(
+		proxy.ServerOption(),
+		grpc.UnknownServiceHandler(proxy.TransparentHandler(director, proxy.WithStreamInterceptor(pi.Interceptor()))),
+	)
+	conn, err := grpc.Dial(listen(t, server), grpc.WithInsecure())
+	require.NoError(t, err)
+	return pb.NewTestServiceClient(conn), func() {
+		conn.Close()
+		server.Stop()
+		backendConn.Close()
+		backend.Stop()
+	}
+}
+
+func testFiles(t *testing.T) *inspect.FileResolver {
+	files, err := inspect.ParseFiles([]string{"../../testservice"}, "test.proto")
+	require.NoError(t, err)
+	return files
+}
+
+func TestPayloadInspector_DecodesAndRewrites(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	pi := inspect.NewPayloadInspector(testFiles(t), func(ctx context.Context, m *inspect.Message) error {
+		mu.Lock()
+		seen = append(seen, m.Direction.String()+" "+m.Msg.GetMessageDescriptor().GetName())
+		mu.Unlock()
+		switch m.Msg.GetMessageDescriptor().GetName() {
+		case "PingRequest":
+			if m.Msg.GetFieldByName("value") == "forbidden" {
+				return status.Error(codes.PermissionDenied, "value not allowed")
+			}
+		case "PingResponse":
+			m.Msg.SetFieldByName("Value", m.Msg.GetFieldByName("Value").(string)+"!")
+			m.Modified = true
+		}
+		return nil
+	})
+	client, stop := startProxy(t, pi)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err)
+	assert.Equal(t, "foo!", out.Value)
+	assert.EqualValues(t, 1, out.Counter, "unmodified fields must survive re-encoding")
+
+	_, err = client.Ping(ctx, &pb.PingRequest{Value: "forbidden"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{
+		"client-to-backend PingRequest",
+		"backend-to-client PingResponse",
+		"client-to-backend PingRequest",
+	}, seen)
+}
+
+func TestPayloadInspector_Streaming(t *testing.T) {
+	var mu sync.Mutex
+	var values []string
+	pi := inspect.NewPayloadInspector(testFiles(t), func(ctx context.Context, m *inspect.Message) error {
+		if m.Direction == proxy.ClientToBackend {
+			mu.Lock()
+			values = append(values, m.Msg.GetFieldByName("value").(string))
+			mu.Unlock()
+		}
+		return nil
+	})
+	client, stop := startProxy(t, pi)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.PingStream(ctx)
+	require.NoError(t, err)
+	for _, v := range []string{"a", "b", "c"} {
+		require.NoError(t, stream.Send(&pb.PingRequest{Value: v}))
+		out, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, v, out.Value)
+	}
+	require.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	assert.Equal(t, io.EOF, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"a", "b", "c"}, values)
+}
+
+func TestPayloadInspector_UnknownMethodsPassThrough(t *testing.T) {
+	called := false
+	pi := inspect.NewPayloadInspector(inspect.NewFileResolver(), func(ctx context.Context, m *inspect.Message) error {
+		called = true
+		return nil
+	})
+	client, stop := startProxy(t, pi)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err)
+	assert.Equal(t, "foo", out.Value)
+	assert.False(t, called)
+}
+
+func TestPayloadInspector_InvalidRequest(t *testing.T) {
+	pi := inspect.NewPayloadInspector(testFiles(t), func(ctx context.Context, m *inspect.Message) error {
+		return nil
+	})
+	intercept := pi.Interceptor()
+	_, err := intercept(context.Background(), "/vgough.testproto.TestService/Ping", proxy.ClientToBackend, []byte{0xff, 0xff})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = intercept(context.Background(), "/vgough.testproto.TestService/Ping", proxy.BackendToClient, []byte{0xff, 0xff})
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
+
+func TestReflectionResolver(t *testing.T) {
+	backend := grpc.NewServer()
+	healthpb.RegisterHealthServer(backend, health.NewServer())
+	reflection.Register(backend)
+	defer backend.Stop()
+	conn, err := grpc.Dial(listen(t, backend), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r := inspect.NewReflectionResolver(conn)
+	md, err := r.ResolveMethod(ctx, "/grpc.health.v1.Health/Check")
+	require.NoError(t, err)
+	require.NotNil(t, md)
+	assert.Equal(t, "grpc.health.v1.HealthCheckRequest", md.GetInputType().GetFullyQualifiedName())
+
+	md, err = r.ResolveMethod(ctx, "/grpc.health.v1.Health/Unknown")
+	require.NoError(t, err)
+	assert.Nil(t, md)
+	md, err = r.ResolveMethod(ctx, "/unknown.Service/Method")
+	require.NoError(t, err)
+	assert.Nil(t, md)
+}
@@ -0,0 +1,154 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package inspect
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/jhump/protoreflect/grpcreflect"
+	"google.golang.org/grpc"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+)
+
+// Resolver looks up the descriptor of a method by its full name, such as
+// "/pkg.Service/Method". It returns a nil descriptor and no error for
+// methods it does not know.
+type Resolver interface {
+	ResolveMethod(ctx context.Context, method string) (*desc.MethodDescriptor, error)
+}
+
+// FileResolver resolves the methods of the services of a fixed set of files.
+type FileResolver struct {
+	methods map[string]*desc.MethodDescriptor
+}
+
+// NewFileResolver returns a FileResolver for the services defined in files.
+func NewFileResolver(files ...*desc.FileDescriptor) *FileResolver {
+	r := &FileResolver{methods: make(map[string]*desc.MethodDescriptor)}
+	for _, fd := range files {
+		for _, sd := range fd.GetServices() {
+			for _, md := range sd.GetMethods() {
+				r.methods["/"+sd.GetFullyQualifiedName()+"/"+md.GetName()] = md
+			}
+		}
+	}
+	return r
+}
+
+// ParseFiles parses the named proto source files, looking for them and
+// their imports in importPaths, and returns a FileResolver for their
+// services.
+func ParseFiles(importPaths []string, names ...string) (*FileResolver, error) {
+	p := protoparse.Parser{ImportPaths: importPaths}
+	files, err := p.ParseFiles(names...)
+	if err != nil {
+		return nil, err
+	}
+	return NewFileResolver(files...), nil
+}
+
+// LoadFiles returns a FileResolver for the services of the named proto
+// files compiled into the program with github.com/golang/protobuf.
+func LoadFiles(names ...string) (*FileResolver, error) {
+	files := make([]*desc.FileDescriptor, 0, len(names))
+	for _, name := range names {
+		fd, err := desc.LoadFileDescriptor(name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, fd)
+	}
+	return NewFileResolver(files...), nil
+}
+
+// ResolveMethod implements Resolver.
+func (r *FileResolver) ResolveMethod(ctx context.Context, method string) (*desc.MethodDescriptor, error) {
+	return r.methods[method], nil
+}
+
+// ReflectionResolver resolves methods using the server reflection service
+// of a backend. Services are looked up once and cached.
+type ReflectionResolver struct {
+	conn *grpc.ClientConn
+
+	// NotFoundTTL is how long a service unknown to the backend is
+	// remembered as such. Defaults to one minute.
+	NotFoundTTL time.Duration
+
+	mu       sync.Mutex
+	services map[string]*desc.ServiceDescriptor
+	missing  map[string]time.Time
+}
+
+// NewReflectionResolver returns a ReflectionResolver asking the backend
+// behind conn.
+func NewReflectionResolver(conn *grpc.ClientConn) *ReflectionResolver {
+	return &ReflectionResolver{
+		conn:        conn,
+		NotFoundTTL: time.Minute,
+		services:    make(map[string]*desc.ServiceDescriptor),
+		missing:     make(map[string]time.Time),
+	}
+}
+
+// ResolveMethod implements Resolver.
+func (r *ReflectionResolver) ResolveMethod(ctx context.Context, method string) (*desc.MethodDescriptor, error) {
+	service, name, ok := splitMethod(method)
+	if !ok {
+		return nil, nil
+	}
+	r.mu.Lock()
+	sd, cached := r.services[service]
+	if until, miss := r.missing[service]; miss && time.Now().Before(until) {
+		cached = true
+	}
+	r.mu.Unlock()
+	if !cached {
+		var err error
+		if sd, err = r.resolveService(ctx, service); err != nil {
+			return nil, err
+		}
+	}
+	if sd == nil {
+		return nil, nil
+	}
+	return sd.FindMethodByName(name), nil
+}
+
+func (r *ReflectionResolver) resolveService(ctx context.Context, service string) (*desc.ServiceDescriptor, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	client := grpcreflect.NewClient(ctx, rpb.NewServerReflectionClient(r.conn))
+	defer client.Reset()
+	sd, err := client.ResolveService(service)
+	if err != nil && !grpcreflect.IsElementNotFoundError(err) {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if sd == nil {
+		r.missing[service] = time.Now().Add(r.NotFoundTTL)
+		return nil, nil
+	}
+	delete(r.missing, service)
+	r.services[service] = sd
+	return sd, nil
+}
+
+// splitMethod splits "/pkg.Service/Method" into service and method names.
+func splitMethod(method string) (service, name string, ok bool) {
+	method = strings.TrimPrefix(method, "/")
+	i := strings.LastIndex(method, "/")
+	if i <= 0 || i == len(method)-1 {
+		return "", "", false
+	}
+	return method[:i], method[i+1:], true
+}
@@ -0,0 +1,62 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import "context"
+
+// FrameDirection identifies the direction in which a frame is forwarded.
+type FrameDirection int
+
+const (
+	// ClientToBackend frames are sent by the client towards the backend.
+	ClientToBackend FrameDirection = iota
+	// BackendToClient frames are sent by the backend towards the client.
+	BackendToClient
+)
+
+func (d FrameDirection) String() string {
+	switch d {
+	case ClientToBackend:
+		return "client-to-backend"
+	case BackendToClient:
+		return "backend-to-client"
+	default:
+		return "unknown"
+	}
+}
+
+// StreamInterceptor is called for every frame forwarded by the proxy, with the
+// context of the incoming stream and the full method name requested by the
+// client.
+//
+// The returned payload is forwarded in place of the original. Returning an
+// error aborts the stream; errors created with the status package are
+// returned to the client as is.
+type StreamInterceptor func(ctx context.Context, method string, dir FrameDirection, payload []byte) ([]byte, error)
+
+// ChainStreamInterceptors returns a StreamInterceptor which runs the given
+// interceptors in order, passing the payload returned by each to the next.
+func ChainStreamInterceptors(interceptors ...StreamInterceptor) StreamInterceptor {
+	return func(ctx context.Context, method string, dir FrameDirection, payload []byte) ([]byte, error) {
+		var err error
+		for _, i := range interceptors {
+			if payload, err = i(ctx, method, dir, payload); err != nil {
+				return nil, err
+			}
+		}
+		return payload, nil
+	}
+}
+
+// WithStreamInterceptor adds interceptors which are run for every frame. It
+// may be used multiple times, interceptors are chained in the order given,
+// together with those added by WithFrameTransformer.
+func WithStreamInterceptor(interceptors ...StreamInterceptor) Option {
+	return func(o *options) {
+		for _, i := range interceptors {
+			o.transformers = append(o.transformers, interceptorTransformer(i))
+		}
+	}
+}
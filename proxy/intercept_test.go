@@ -0,0 +1,61 @@
+package proxy_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestStreamInterceptor_ObservesAndRewritesFrames(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[proxy.FrameDirection]int{}
+	observe := func(ctx context.Context, method string, dir proxy.FrameDirection, payload []byte) ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, "/vgough.testproto.TestService/Ping", method)
+		seen[dir]++
+		return payload, nil
+	}
+	rewrite := func(ctx context.Context, method string, dir proxy.FrameDirection, payload []byte) ([]byte, error) {
+		if dir != proxy.ClientToBackend {
+			return payload, nil
+		}
+		return proto.Marshal(&pb.PingRequest{Value: "scrubbed"})
+	}
+	env := newTestEnv(t, &pingService{}, proxy.WithStreamInterceptor(observe, rewrite))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	out, err := env.client.Ping(ctx, &pb.PingRequest{Value: "secret"})
+	require.NoError(t, err)
+	assert.Equal(t, "scrubbed", out.Value, "backend must see the rewritten request")
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, seen[proxy.ClientToBackend])
+	assert.Equal(t, 1, seen[proxy.BackendToClient])
+}
+
+func TestStreamInterceptor_ErrorAbortsStream(t *testing.T) {
+	reject := func(ctx context.Context, method string, dir proxy.FrameDirection, payload []byte) ([]byte, error) {
+		return nil, status.Error(codes.PermissionDenied, "payload rejected")
+	}
+	env := newTestEnv(t, &pingService{}, proxy.WithStreamInterceptor(reject))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.Error(t, err)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
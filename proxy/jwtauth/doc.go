@@ -0,0 +1,13 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+/*
+Package jwtauth validates JWT bearer tokens for the proxy.
+
+A Validator is a proxy.Authenticator, for use with proxy.WithAuthenticator.
+Tokens are verified with keys from a KeySource, such as a JWKS that fetches
+and caches keys from JSON Web Key Set endpoints. RS256, RS384, RS512, ES256,
+ES384 and ES512 signatures are supported.
+*/
+package jwtauth
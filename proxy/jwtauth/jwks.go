@@ -0,0 +1,259 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package jwtauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// KeySource looks up the public keys used to verify tokens.
+type KeySource interface {
+	// Key returns the key with the given key ID. An empty kid asks for the
+	// only key of the source.
+	Key(ctx context.Context, kid string) (crypto.PublicKey, error)
+}
+
+// defaultJWKSClient is used by a JWKS without a Client, so that a hanging
+// key server does not block authentication forever.
+var defaultJWKSClient = &http.Client{Timeout: 10 * time.Second}
+
+// JWKS is a KeySource which fetches JSON Web Key Sets from one or more URLs.
+// Keys are cached, and the sets are fetched again when they are older than
+// RefreshInterval or when an unknown key ID is seen, so that rotated keys
+// are picked up without a restart.
+type JWKS struct {
+	// Client is used for fetching. If nil, a client with a 10 second
+	// timeout is used.
+	Client *http.Client
+	// RefreshInterval is the maximum age of the cached keys. If zero, keys
+	// are kept for an hour.
+	RefreshInterval time.Duration
+	// MinRefreshInterval limits how often fetches are made, whether they
+	// are caused by unknown key IDs or retry a failed fetch. If zero, at
+	// most one fetch is made every 10 seconds.
+	MinRefreshInterval time.Duration
+
+	urls []string
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetched   time.Time
+	attempted time.Time
+	lastErr   error
+	// inflight is closed when the running fetch, shared by all callers
+	// waiting for it, is done.
+	inflight chan struct{}
+}
+
+// NewJWKS returns a JWKS fetching the key sets at urls.
+func NewJWKS(urls ...string) *JWKS {
+	return &JWKS{urls: urls}
+}
+
+// Key implements KeySource.
+func (j *JWKS) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	refresh := j.RefreshInterval
+	if refresh <= 0 {
+		refresh = time.Hour
+	}
+	minRefresh := j.MinRefreshInterval
+	if minRefresh <= 0 {
+		minRefresh = 10 * time.Second
+	}
+
+	j.mu.Lock()
+	_, ok := j.lookup(kid)
+	stale := j.keys == nil || time.Since(j.fetched) > refresh || !ok
+	var done chan struct{}
+	if stale {
+		done = j.inflight
+		if done == nil && time.Since(j.attempted) > minRefresh {
+			done = make(chan struct{})
+			j.inflight = done
+			j.attempted = time.Now()
+			go j.fetch(done)
+		}
+	}
+	j.mu.Unlock()
+
+	if done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.keys == nil && j.lastErr != nil {
+		return nil, j.lastErr
+	}
+	key, ok := j.lookup(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+func (j *JWKS) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(j.keys) == 1 {
+		for _, key := range j.keys {
+			return key, true
+		}
+	}
+	key, ok := j.keys[kid]
+	return key, ok
+}
+
+// fetch fetches the key sets and replaces the cached keys. On failure the
+// old keys are kept. The fetch is not tied to the context of any one caller,
+// since others may be waiting for it.
+func (j *JWKS) fetch(done chan struct{}) {
+	keys, err := j.fetchKeys(context.Background())
+	j.mu.Lock()
+	if err == nil {
+		j.keys = keys
+		j.fetched = time.Now()
+	}
+	j.lastErr = err
+	j.inflight = nil
+	j.mu.Unlock()
+	close(done)
+}
+
+func (j *JWKS) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	client := j.Client
+	if client == nil {
+		client = defaultJWKSClient
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, url := range j.urls {
+		set, err := fetchKeySet(ctx, client, url)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range set.Keys {
+			key, err := k.publicKey()
+			if err != nil {
+				// Keys of unsupported types are skipped.
+				continue
+			}
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+type keySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func fetchKeySet(ctx context.Context, client *http.Client, url string) (*keySet, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed fetching %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed fetching %s: %s", url, resp.Status)
+	}
+	var set keySet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("invalid key set at %s: %v", url, err)
+	}
+	return &set, nil
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	if k.Use != "" && k.Use != "sig" {
+		return nil, errors.New("not a signing key")
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// StaticKeys is a KeySource holding fixed keys by key ID.
+type StaticKeys map[string]crypto.PublicKey
+
+// Key implements KeySource.
+func (s StaticKeys) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	if kid == "" && len(s) == 1 {
+		for _, key := range s {
+			return key, nil
+		}
+	}
+	if key, ok := s[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
@@ -0,0 +1,179 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package jwtauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256" // register hashes
+	_ "crypto/sha512"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+var algHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// splitToken decodes the header and claims of a compact JWT, without
+// verifying it.
+func splitToken(token string) (*header, map[string]interface{}, string, []byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil, "", nil, errors.New("malformed token")
+	}
+	var hdr header
+	if err := decodeSegment(parts[0], &hdr); err != nil {
+		return nil, nil, "", nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, nil, "", nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, "", nil, fmt.Errorf("malformed token signature: %v", err)
+	}
+	return &hdr, claims, parts[0] + "." + parts[1], sig, nil
+}
+
+func decodeSegment(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(strings.NewReader(string(b)))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+// verify checks the signature of signed, which is the encoded header and
+// claims, against key.
+func verify(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	hash, ok := algHashes[alg]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg[:2] != "RS" {
+			break
+		}
+		return rsa.VerifyPKCS1v15(key, hash, digest, sig)
+	case *ecdsa.PublicKey:
+		if alg[:2] != "ES" {
+			break
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("key of type %T does not match algorithm %q", key, alg)
+}
+
+// Signer issues tokens, see Validator.Resign.
+type Signer interface {
+	Sign(claims map[string]interface{}) (string, error)
+}
+
+// NewSigner returns a Signer using an RSA or ECDSA private key, signing
+// with RS256, or ES256, ES384 or ES512 depending on the curve. The kid is
+// put in the token header if it is not empty.
+func NewSigner(key crypto.Signer, kid string) (Signer, error) {
+	s := &keySigner{key: key, kid: kid}
+	switch key := key.Public().(type) {
+	case *rsa.PublicKey:
+		s.alg = "RS256"
+	case *ecdsa.PublicKey:
+		switch key.Curve.Params().BitSize {
+		case 256:
+			s.alg = "ES256"
+		case 384:
+			s.alg = "ES384"
+		case 521:
+			s.alg = "ES512"
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", key.Curve.Params().Name)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return s, nil
+}
+
+type keySigner struct {
+	key crypto.Signer
+	alg string
+	kid string
+}
+
+func (s *keySigner) Sign(claims map[string]interface{}) (string, error) {
+	hdr, err := json.Marshal(&header{Alg: s.alg, Kid: s.kid, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(hdr) + "." + base64.RawURLEncoding.EncodeToString(body)
+
+	hash := algHashes[s.alg]
+	h := hash.New()
+	h.Write([]byte(signed))
+	sig, err := s.key.Sign(rand.Reader, h.Sum(nil), hash)
+	if err != nil {
+		return "", err
+	}
+	if key, ok := s.key.Public().(*ecdsa.PublicKey); ok {
+		if sig, err = ecdsaRawSignature(sig, (key.Curve.Params().BitSize+7)/8); err != nil {
+			return "", err
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// ecdsaRawSignature converts an ASN.1 ECDSA signature to the fixed size
+// form used by JWS.
+func ecdsaRawSignature(der []byte, size int) ([]byte, error) {
+	var rs struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(der, &rs); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 2*size)
+	rb, sb := rs.R.Bytes(), rs.S.Bytes()
+	copy(out[size-len(rb):size], rb)
+	copy(out[2*size-len(sb):], sb)
+	return out, nil
+}
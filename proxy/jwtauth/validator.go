@@ -0,0 +1,148 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package jwtauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Validator is a proxy.Authenticator which validates JWT bearer tokens.
+// The verified claims are added to the context as a proxy.Identity, with
+// the "sub" claim as the subject.
+type Validator struct {
+	// Keys verifies token signatures.
+	Keys KeySource
+	// Issuer, if set, must match the "iss" claim.
+	Issuer string
+	// Audience, if set, must be one of the "aud" claim.
+	Audience string
+	// Leeway is allowed when checking the "exp" and "nbf" claims.
+	Leeway time.Duration
+	// Header is the metadata key holding the token, as "Bearer <token>".
+	// If empty, "authorization" is used.
+	Header string
+	// TenantClaim, if set, names the claim used as the identity tenant.
+	TenantClaim string
+	// Optional lets streams without a token through unauthenticated.
+	// Streams with an invalid token are always rejected.
+	Optional bool
+
+	// Strip removes the token before the stream is forwarded.
+	Strip bool
+	// Resign, if set, replaces the token with one issued by the signer for
+	// the verified claims, so that backends only need to trust the proxy.
+	Resign Signer
+}
+
+// Authenticate implements proxy.Authenticator.
+func (v *Validator) Authenticate(ctx context.Context, info *proxy.AuthInfo) (context.Context, error) {
+	key := v.Header
+	if key == "" {
+		key = "authorization"
+	}
+	values := info.Metadata.Get(key)
+	if len(values) == 0 {
+		if v.Optional {
+			return ctx, nil
+		}
+		return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+	token := values[0]
+	if len(token) < 7 || !strings.EqualFold(token[:7], "bearer ") {
+		return nil, status.Error(codes.Unauthenticated, "malformed bearer token")
+	}
+	claims, err := v.Verify(ctx, strings.TrimSpace(token[7:]))
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid token: %v", err)
+	}
+
+	if v.Strip || v.Resign != nil {
+		md := info.Metadata.Copy()
+		delete(md, strings.ToLower(key))
+		if v.Resign != nil {
+			signed, err := v.Resign.Sign(claims)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "failed re-signing token: %v", err)
+			}
+			md.Set(key, "Bearer "+signed)
+		}
+		ctx = metadata.NewIncomingContext(ctx, md)
+	}
+
+	id := &proxy.Identity{Claims: claims}
+	id.Subject, _ = claims["sub"].(string)
+	if v.TenantClaim != "" {
+		id.Tenant, _ = claims[v.TenantClaim].(string)
+	}
+	return proxy.NewContextWithIdentity(ctx, id), nil
+}
+
+// Verify checks the signature and the registered claims of token and
+// returns its claims.
+func (v *Validator) Verify(ctx context.Context, token string) (map[string]interface{}, error) {
+	hdr, claims, signed, sig, err := splitToken(token)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := v.Keys.Key(ctx, hdr.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verify(hdr.Alg, pub, signed, sig); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if exp, ok := numericDate(claims["exp"]); ok && now.After(exp.Add(v.Leeway)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if nbf, ok := numericDate(claims["nbf"]); ok && now.Add(v.Leeway).Before(nbf) {
+		return nil, fmt.Errorf("token not yet valid")
+	}
+	if v.Issuer != "" && claims["iss"] != v.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %v", claims["iss"])
+	}
+	if v.Audience != "" && !hasAudience(claims["aud"], v.Audience) {
+		return nil, fmt.Errorf("token is not for audience %q", v.Audience)
+	}
+	return claims, nil
+}
+
+func numericDate(v interface{}) (time.Time, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(f*float64(time.Second))), true
+}
+
+func hasAudience(aud interface{}, want string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == want
+	case []interface{}:
+		for _, a := range aud {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var _ proxy.Authenticator = (*Validator)(nil)
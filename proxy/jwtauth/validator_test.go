@@ -0,0 +1,225 @@
+package jwtauth_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/mkxxx/grpc-proxy/proxy/jwtauth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// keyServer serves a JWKS of its current keys.
+type keyServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetches int
+	fail    bool
+}
+
+func newKeyServer() *keyServer {
+	ks := &keyServer{keys: make(map[string]crypto.PublicKey)}
+	ks.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ks.mu.Lock()
+		defer ks.mu.Unlock()
+		ks.fetches++
+		if ks.fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var keys []map[string]string
+		enc := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+		for kid, key := range ks.keys {
+			switch key := key.(type) {
+			case *rsa.PublicKey:
+				keys = append(keys, map[string]string{
+					"kty": "RSA", "kid": kid, "use": "sig",
+					"n": enc(key.N.Bytes()), "e": enc(big.NewInt(int64(key.E)).Bytes()),
+				})
+			case *ecdsa.PublicKey:
+				keys = append(keys, map[string]string{
+					"kty": "EC", "kid": kid, "crv": "P-256",
+					"x": enc(key.X.Bytes()), "y": enc(key.Y.Bytes()),
+				})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	return ks
+}
+
+func (ks *keyServer) add(kid string, key crypto.PublicKey) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys[kid] = key
+}
+
+func newSigner(t *testing.T, ks *keyServer, kid string, ec bool) jwtauth.Signer {
+	var key crypto.Signer
+	var err error
+	if ec {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	} else {
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	require.NoError(t, err)
+	if ks != nil {
+		ks.add(kid, key.Public())
+	}
+	s, err := jwtauth.NewSigner(key, kid)
+	require.NoError(t, err)
+	return s
+}
+
+func authInfo(md ...string) *proxy.AuthInfo {
+	return &proxy.AuthInfo{Method: "/test/Method", Metadata: metadata.Pairs(md...)}
+}
+
+func bearer(t *testing.T, s jwtauth.Signer, claims map[string]interface{}) *proxy.AuthInfo {
+	token, err := s.Sign(claims)
+	require.NoError(t, err)
+	return authInfo("authorization", "Bearer "+token)
+}
+
+func TestValidator(t *testing.T) {
+	ks := newKeyServer()
+	defer ks.Close()
+	rsaSigner := newSigner(t, ks, "rsa", false)
+	ecSigner := newSigner(t, ks, "ec", true)
+	v := &jwtauth.Validator{
+		Keys:        jwtauth.NewJWKS(ks.URL),
+		Issuer:      "https://issuer.test",
+		Audience:    "proxy",
+		TenantClaim: "tenant",
+	}
+	ctx := context.Background()
+	exp := time.Now().Add(time.Hour).Unix()
+
+	for _, s := range []jwtauth.Signer{rsaSigner, ecSigner} {
+		authCtx, err := v.Authenticate(ctx, bearer(t, s, map[string]interface{}{
+			"sub": "alice", "iss": "https://issuer.test", "aud": []string{"proxy"}, "exp": exp, "tenant": "acme",
+		}))
+		require.NoError(t, err)
+		id, ok := proxy.IdentityFromContext(authCtx)
+		require.True(t, ok)
+		assert.Equal(t, "alice", id.Subject)
+		assert.Equal(t, "acme", id.Tenant)
+	}
+
+	tests := map[string]*proxy.AuthInfo{
+		"missing":      authInfo(),
+		"not bearer":   authInfo("authorization", "Basic Zm9vOmJhcg=="),
+		"expired":      bearer(t, rsaSigner, map[string]interface{}{"iss": "https://issuer.test", "aud": "proxy", "exp": time.Now().Add(-time.Hour).Unix()}),
+		"wrong issuer": bearer(t, rsaSigner, map[string]interface{}{"iss": "https://other.test", "aud": "proxy"}),
+		"wrong aud":    bearer(t, rsaSigner, map[string]interface{}{"iss": "https://issuer.test", "aud": "other"}),
+		"unknown key":  bearer(t, newSigner(t, nil, "rogue", false), map[string]interface{}{"iss": "https://issuer.test", "aud": "proxy"}),
+	}
+	for name, info := range tests {
+		_, err := v.Authenticate(ctx, info)
+		assert.Equal(t, codes.Unauthenticated, status.Code(err), name)
+	}
+}
+
+func TestJWKSRotation(t *testing.T) {
+	ks := newKeyServer()
+	defer ks.Close()
+	old := newSigner(t, ks, "old", false)
+	jwks := jwtauth.NewJWKS(ks.URL)
+	jwks.MinRefreshInterval = time.Nanosecond
+	v := &jwtauth.Validator{Keys: jwks}
+	ctx := context.Background()
+
+	_, err := v.Authenticate(ctx, bearer(t, old, map[string]interface{}{"sub": "a"}))
+	require.NoError(t, err)
+	_, err = v.Authenticate(ctx, bearer(t, old, map[string]interface{}{"sub": "b"}))
+	require.NoError(t, err)
+	assert.Equal(t, 1, ks.fetches, "keys are cached")
+
+	rotated := newSigner(t, ks, "new", false)
+	_, err = v.Authenticate(ctx, bearer(t, rotated, map[string]interface{}{"sub": "c"}))
+	require.NoError(t, err, "unknown key IDs refresh the key set")
+	assert.Equal(t, 2, ks.fetches)
+}
+
+func TestJWKSFailedFetch(t *testing.T) {
+	ks := newKeyServer()
+	defer ks.Close()
+	signer := newSigner(t, ks, "a", true)
+	jwks := jwtauth.NewJWKS(ks.URL)
+	jwks.MinRefreshInterval = 200 * time.Millisecond
+	v := &jwtauth.Validator{Keys: jwks}
+	ctx := context.Background()
+
+	_, err := v.Authenticate(ctx, bearer(t, signer, map[string]interface{}{"sub": "a"}))
+	require.NoError(t, err)
+	ks.mu.Lock()
+	ks.fail = true
+	ks.mu.Unlock()
+	time.Sleep(250 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := jwks.Key(ctx, fmt.Sprintf("unknown-%d", i))
+			assert.Error(t, err)
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 10; i++ {
+		_, err := jwks.Key(ctx, fmt.Sprintf("other-%d", i))
+		assert.Error(t, err)
+	}
+	ks.mu.Lock()
+	assert.Equal(t, 2, ks.fetches, "failed fetches are not retried before MinRefreshInterval")
+	ks.mu.Unlock()
+
+	_, err = v.Authenticate(ctx, bearer(t, signer, map[string]interface{}{"sub": "b"}))
+	assert.NoError(t, err, "cached keys are kept")
+}
+
+func TestValidatorStripAndResign(t *testing.T) {
+	ks := newKeyServer()
+	defer ks.Close()
+	signer := newSigner(t, ks, "client", false)
+	ctx := context.Background()
+
+	strip := &jwtauth.Validator{Keys: jwtauth.NewJWKS(ks.URL), Strip: true}
+	authCtx, err := strip.Authenticate(ctx, bearer(t, signer, map[string]interface{}{"sub": "alice"}))
+	require.NoError(t, err)
+	md, _ := metadata.FromIncomingContext(authCtx)
+	assert.Empty(t, md.Get("authorization"))
+
+	proxyStore := newKeyServer()
+	defer proxyStore.Close()
+	resign := &jwtauth.Validator{Keys: jwtauth.NewJWKS(ks.URL), Resign: newSigner(t, proxyStore, "proxy", true)}
+	authCtx, err = resign.Authenticate(ctx, bearer(t, signer, map[string]interface{}{"sub": "alice"}))
+	require.NoError(t, err)
+	md, _ = metadata.FromIncomingContext(authCtx)
+	require.Len(t, md.Get("authorization"), 1)
+
+	backend := &jwtauth.Validator{Keys: jwtauth.NewJWKS(proxyStore.URL)}
+	claims, err := backend.Verify(ctx, strings.TrimPrefix(md.Get("authorization")[0], "Bearer "))
+	require.NoError(t, err, "re-signed token verifies with the proxy key")
+	assert.Equal(t, "alice", claims["sub"])
+}
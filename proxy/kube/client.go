@@ -0,0 +1,109 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package kube
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Client accesses the Kubernetes API.
+type Client struct {
+	// Host is the base URL of the API server.
+	Host string
+	// HTTPClient is used for requests. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+	// Token, if set, is sent as a bearer token.
+	Token string
+	// TokenFile, if set, is read for every request and takes precedence
+	// over Token, so that rotated service account tokens are used.
+	TokenFile string
+}
+
+// InClusterClient returns a Client using the service account of the pod it
+// runs in.
+func InClusterClient() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes cluster")
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("invalid service account CA")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &Client{
+		Host:       "https://" + net.JoinHostPort(host, port),
+		HTTPClient: &http.Client{Transport: transport},
+		TokenFile:  serviceAccountDir + "/token",
+	}, nil
+}
+
+// InClusterNamespace returns the namespace of the pod the proxy runs in.
+func InClusterNamespace() (string, error) {
+	ns, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(ns)), nil
+}
+
+// get starts a GET request for path, which includes the query.
+func (c *Client) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(c.Host, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	token := c.Token
+	if c.TokenFile != "" {
+		b, err := ioutil.ReadFile(c.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("Accept", "application/json")
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, &apiError{code: resp.StatusCode, message: strings.TrimSpace(string(body))}
+	}
+	return resp, nil
+}
+
+type apiError struct {
+	code    int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("kubernetes API error %d: %s", e.code, e.message)
+}
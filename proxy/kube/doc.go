@@ -0,0 +1,13 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+/*
+Package kube keeps proxy backends in sync with the EndpointSlices of
+Kubernetes services, so the proxy can run in a cluster as an L7 gRPC gateway
+without external service discovery.
+
+It talks to the Kubernetes API directly and needs permission to list and
+watch endpointslices in the namespace of the services.
+*/
+package kube
@@ -0,0 +1,233 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"google.golang.org/grpc"
+)
+
+// Watcher keeps the endpoints of a balancer in sync with the ready
+// endpoints of a Kubernetes service.
+//
+// Endpoints which are not ready, including pods whose readiness gates are
+// not passed and pods which are terminating, receive no calls.
+type Watcher struct {
+	// Dial connects to an endpoint address. If nil, addresses are dialed
+	// insecurely with the proxy codec.
+	Dial func(address string) (*grpc.ClientConn, error)
+	// OnError, if set, is called when listing or watching fails. The
+	// endpoints are left unchanged until the watch is re-established.
+	OnError func(error)
+	// RetryDelay is the wait before retrying after an error. If zero, one
+	// second is used.
+	RetryDelay time.Duration
+
+	client    *Client
+	namespace string
+	service   string
+	port      string
+	pool      *proxy.AddressPool
+	slices    map[string]*endpointSlice
+}
+
+// NewWatcher returns a Watcher updating b with the endpoints of the service
+// in namespace. The port is the name of the service port to use, or empty
+// if the service has only one.
+func NewWatcher(c *Client, namespace, service, port string, b proxy.Balancer) *Watcher {
+	w := &Watcher{
+		client:    c,
+		namespace: namespace,
+		service:   service,
+		port:      port,
+		pool:      proxy.NewAddressPool(b),
+	}
+	w.pool.Dial = w.dial
+	return w
+}
+
+func (w *Watcher) dial(addr string) (*grpc.ClientConn, error) {
+	if w.Dial != nil {
+		return w.Dial(addr)
+	}
+	return (&proxy.BackendConfig{Address: addr}).Dial()
+}
+
+type objectMeta struct {
+	Name            string `json:"name"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+type endpointSlice struct {
+	Metadata  objectMeta      `json:"metadata"`
+	Endpoints []sliceEndpoint `json:"endpoints"`
+	Ports     []slicePort     `json:"ports"`
+}
+
+type sliceEndpoint struct {
+	Addresses  []string `json:"addresses"`
+	Conditions struct {
+		Ready       *bool `json:"ready"`
+		Terminating *bool `json:"terminating"`
+	} `json:"conditions"`
+}
+
+type slicePort struct {
+	Name *string `json:"name"`
+	Port *int32  `json:"port"`
+}
+
+type sliceList struct {
+	Metadata objectMeta      `json:"metadata"`
+	Items    []endpointSlice `json:"items"`
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// Run lists and watches the endpoint slices of the service until ctx is
+// done. The connections are closed when Run returns.
+func (w *Watcher) Run(ctx context.Context) {
+	defer w.pool.Close()
+	delay := w.RetryDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	for {
+		err := w.listAndWatch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil && w.OnError != nil {
+			w.OnError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (w *Watcher) path(query url.Values) string {
+	query.Set("labelSelector", "kubernetes.io/service-name="+w.service)
+	return fmt.Sprintf("/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?%s",
+		url.PathEscape(w.namespace), query.Encode())
+}
+
+func (w *Watcher) listAndWatch(ctx context.Context) error {
+	resp, err := w.client.get(ctx, w.path(url.Values{}))
+	if err != nil {
+		return err
+	}
+	var list sliceList
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("invalid endpoint slice list: %v", err)
+	}
+	w.slices = make(map[string]*endpointSlice)
+	for i := range list.Items {
+		w.slices[list.Items[i].Metadata.Name] = &list.Items[i]
+	}
+	w.update()
+
+	version := list.Metadata.ResourceVersion
+	for {
+		query := url.Values{"watch": {"true"}, "resourceVersion": {version}, "allowWatchBookmarks": {"true"}}
+		resp, err := w.client.get(ctx, w.path(query))
+		if err != nil {
+			return err
+		}
+		version, err = w.watch(resp.Body, version)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// watch applies the events of a watch response until it ends, and returns
+// the last resource version seen. Expired versions are returned as errors,
+// so that the slices are listed again.
+func (w *Watcher) watch(body io.Reader, version string) (string, error) {
+	d := json.NewDecoder(body)
+	for {
+		var ev watchEvent
+		if err := d.Decode(&ev); err != nil {
+			// The server ends watches after a while, which is not an error.
+			return version, nil
+		}
+		if ev.Type == "ERROR" {
+			return version, fmt.Errorf("watch failed: %s", ev.Object)
+		}
+		var slice endpointSlice
+		if err := json.Unmarshal(ev.Object, &slice); err != nil {
+			return version, fmt.Errorf("invalid watch event: %v", err)
+		}
+		version = slice.Metadata.ResourceVersion
+		switch ev.Type {
+		case "ADDED", "MODIFIED":
+			w.slices[slice.Metadata.Name] = &slice
+		case "DELETED":
+			delete(w.slices, slice.Metadata.Name)
+		default:
+			continue
+		}
+		w.update()
+	}
+}
+
+// update sets the pool to the ready endpoints of all slices.
+func (w *Watcher) update() {
+	weights := make(map[string]int)
+	for _, slice := range w.slices {
+		port, ok := slice.port(w.port)
+		if !ok {
+			continue
+		}
+		for _, ep := range slice.Endpoints {
+			if !ep.ready() {
+				continue
+			}
+			for _, addr := range ep.Addresses {
+				weights[net.JoinHostPort(addr, strconv.Itoa(int(port)))] = 1
+			}
+		}
+	}
+	w.pool.Update(weights)
+}
+
+func (s *endpointSlice) port(name string) (int32, bool) {
+	for _, p := range s.Ports {
+		if p.Port == nil {
+			continue
+		}
+		if name == "" || (p.Name != nil && *p.Name == name) {
+			return *p.Port, true
+		}
+	}
+	return 0, false
+}
+
+// ready reports whether an endpoint should receive calls. An unknown
+// readiness is treated as ready, as Kubernetes does.
+func (e *sliceEndpoint) ready() bool {
+	if e.Conditions.Terminating != nil && *e.Conditions.Terminating {
+		return false
+	}
+	return e.Conditions.Ready == nil || *e.Conditions.Ready
+}
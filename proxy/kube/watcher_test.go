@@ -0,0 +1,113 @@
+package kube_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/mkxxx/grpc-proxy/proxy/kube"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingBalancer records the endpoints it is updated with.
+type recordingBalancer struct {
+	proxy.Balancer
+	mu      sync.Mutex
+	targets []string
+}
+
+func (b *recordingBalancer) Update(endpoints []proxy.Endpoint) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.targets = nil
+	for _, ep := range endpoints {
+		b.targets = append(b.targets, ep.Conn.Target())
+	}
+	sort.Strings(b.targets)
+}
+
+func (b *recordingBalancer) get() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.targets
+}
+
+func slice(name, version string, ready map[string]bool) string {
+	var eps string
+	for addr, r := range ready {
+		if eps != "" {
+			eps += ","
+		}
+		eps += fmt.Sprintf(`{"addresses": [%q], "conditions": {"ready": %v}}`, addr, r)
+	}
+	return fmt.Sprintf(`{"metadata": {"name": %q, "resourceVersion": %q}, "endpoints": [%s],
+		"ports": [{"name": "http", "port": 80}, {"name": "grpc", "port": 9000}]}`, name, version, eps)
+}
+
+func TestWatcher(t *testing.T) {
+	events := make(chan string, 10)
+	var watches []string
+	var mu sync.Mutex
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/apis/discovery.k8s.io/v1/namespaces/prod/endpointslices", r.URL.Path)
+		assert.Equal(t, "kubernetes.io/service-name=users", r.URL.Query().Get("labelSelector"))
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		if r.URL.Query().Get("watch") != "true" {
+			fmt.Fprintf(w, `{"metadata": {"resourceVersion": "10"}, "items": [%s]}`,
+				slice("users-a", "9", map[string]bool{"10.0.0.1": true, "10.0.0.2": false}))
+			return
+		}
+		mu.Lock()
+		watches = append(watches, r.URL.Query().Get("resourceVersion"))
+		mu.Unlock()
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case ev := <-events:
+				fmt.Fprintln(w, ev)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer api.Close()
+
+	b := &recordingBalancer{}
+	w := kube.NewWatcher(&kube.Client{Host: api.URL, Token: "secret"}, "prod", "users", "grpc", b)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	require.Eventually(t, func() bool { return len(b.get()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"10.0.0.1:9000"}, b.get(), "endpoints which are not ready are left out")
+
+	events <- fmt.Sprintf(`{"type": "MODIFIED", "object": %s}`,
+		slice("users-a", "11", map[string]bool{"10.0.0.1": true, "10.0.0.2": true}))
+	events <- fmt.Sprintf(`{"type": "ADDED", "object": %s}`,
+		slice("users-b", "12", map[string]bool{"10.0.1.1": true}))
+	require.Eventually(t, func() bool { return len(b.get()) == 3 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"10.0.0.1:9000", "10.0.0.2:9000", "10.0.1.1:9000"}, b.get())
+
+	events <- fmt.Sprintf(`{"type": "DELETED", "object": %s}`, slice("users-a", "13", nil))
+	require.Eventually(t, func() bool { return len(b.get()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"10.0.1.1:9000"}, b.get())
+
+	mu.Lock()
+	assert.Equal(t, []string{"10"}, watches, "the watch starts at the listed version")
+	mu.Unlock()
+}
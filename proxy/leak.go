@@ -0,0 +1,193 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultLeakThreshold is the LeakDetector threshold when none is set.
+const defaultLeakThreshold = 10 * time.Second
+
+// LeakDetector is a debugging aid which tracks the two goroutines copying
+// the messages of every stream, one for each direction. Copy goroutines
+// which are still running Threshold after their stream ended are reported
+// as leaked, which points to a bug in the shutdown of streams, such as a
+// wrapped stream whose RecvMsg ignores the end of the call.
+//
+// A LeakDetector may be shared by several handlers, see WithLeakDetector.
+// The zero value is ready to use.
+type LeakDetector struct {
+	// Threshold is how long copy goroutines may outlive their stream. The
+	// default is 10 seconds.
+	Threshold time.Duration
+
+	// OnLeak, if set, is called for every leaked goroutine, in addition to
+	// the warning logged by the handler.
+	OnLeak func(l Leak)
+
+	mu         sync.Mutex
+	streams    int
+	goroutines int
+	leaked     int
+}
+
+// Leak is a copy goroutine which outlived its stream.
+type Leak struct {
+	Method    string
+	Backend   string
+	Direction FrameDirection
+	// Ended is when the stream ended.
+	Ended time.Time
+}
+
+// WithLeakDetector tracks the copy goroutines of the handler's streams with
+// d. Leaks are logged as warnings, see WithLogger.
+func WithLeakDetector(d *LeakDetector) Option {
+	return func(o *options) {
+		o.leaks = d
+	}
+}
+
+// Streams returns the number of live proxied streams.
+func (d *LeakDetector) Streams() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.streams
+}
+
+// Goroutines returns the number of running copy goroutines, including
+// leaked ones.
+func (d *LeakDetector) Goroutines() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.goroutines
+}
+
+// Leaked returns the number of copy goroutines which outlived their stream
+// by more than the threshold and are still running.
+func (d *LeakDetector) Leaked() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.leaked
+}
+
+// Register exports the counts of d as gauges to r.
+func (d *LeakDetector) Register(r prometheus.Registerer) {
+	count := func(n *int) func() float64 {
+		return func() float64 {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			return float64(*n)
+		}
+	}
+	register(r, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "grpc_proxy_live_streams",
+		Help: "Number of live proxied streams.",
+	}, count(&d.streams)))
+	register(r, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "grpc_proxy_copy_goroutines",
+		Help: "Number of running goroutines copying stream messages.",
+	}, count(&d.goroutines)))
+	register(r, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "grpc_proxy_leaked_copy_goroutines",
+		Help: "Number of copy goroutines still running after the leak threshold.",
+	}, count(&d.leaked)))
+}
+
+// start tracks the copy goroutines of ps until the stream ends.
+func (d *LeakDetector) start(ps *proxiedStream, logger Logger) *leakStream {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.streams++
+	return &leakStream{d: d, method: ps.method, backend: ps.backend, logger: logger}
+}
+
+// leakStream tracks the copy goroutines of a stream. Its methods may be
+// called on nil, without tracking.
+type leakStream struct {
+	d               *LeakDetector
+	method, backend string
+	logger          Logger
+
+	// Guarded by d.mu.
+	running [2]bool
+	leaked  [2]bool
+	ended   time.Time
+}
+
+// enter counts the copy goroutine of dir as running. It is called before
+// the goroutine starts, so that end sees it.
+func (s *leakStream) enter(dir FrameDirection) {
+	if s == nil {
+		return
+	}
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	s.running[dir] = true
+	s.d.goroutines++
+}
+
+// exit counts the copy goroutine of dir as done.
+func (s *leakStream) exit(dir FrameDirection) {
+	if s == nil {
+		return
+	}
+	s.d.mu.Lock()
+	s.running[dir] = false
+	s.d.goroutines--
+	leaked := s.leaked[dir]
+	if leaked {
+		s.d.leaked--
+	}
+	ended := s.ended
+	s.d.mu.Unlock()
+	if leaked {
+		s.logger.Info("leaked copy goroutine exited", "method", s.method, "backend", s.backend, "direction", dir, "after", time.Since(ended))
+	}
+}
+
+// end marks the stream as ended, and checks its copy goroutines after the
+// threshold.
+func (s *leakStream) end() {
+	if s == nil {
+		return
+	}
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	s.d.streams--
+	s.ended = time.Now()
+	if s.running[ClientToBackend] || s.running[BackendToClient] {
+		threshold := s.d.Threshold
+		if threshold <= 0 {
+			threshold = defaultLeakThreshold
+		}
+		time.AfterFunc(threshold, s.check)
+	}
+}
+
+// check reports the copy goroutines which are still running.
+func (s *leakStream) check() {
+	var leaks []Leak
+	s.d.mu.Lock()
+	for _, dir := range []FrameDirection{ClientToBackend, BackendToClient} {
+		if s.running[dir] && !s.leaked[dir] {
+			s.leaked[dir] = true
+			s.d.leaked++
+			leaks = append(leaks, Leak{Method: s.method, Backend: s.backend, Direction: dir, Ended: s.ended})
+		}
+	}
+	onLeak := s.d.OnLeak
+	s.d.mu.Unlock()
+	for _, l := range leaks {
+		s.logger.Warn("copy goroutine outlived its stream", "method", l.Method, "backend", l.Backend, "direction", l.Direction, "after", time.Since(l.Ended))
+		if onLeak != nil {
+			onLeak(l)
+		}
+	}
+}
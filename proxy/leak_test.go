@@ -0,0 +1,110 @@
+package proxy_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestLeakDetector_Counts(t *testing.T) {
+	d := &proxy.LeakDetector{}
+	reg := prometheus.NewPedanticRegistry()
+	d.Register(reg)
+	env := newTestEnv(t, &pingService{}, proxy.WithLeakDetector(d))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	stream, err := env.client.PingStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.PingRequest{Value: "live"}))
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, 1, d.Streams())
+	assert.Equal(t, 2, d.Goroutines(), "one copy goroutine per direction")
+	assert.Equal(t, float64(1), metricValue(t, reg, "grpc_proxy_live_streams", nil))
+	assert.Equal(t, float64(2), metricValue(t, reg, "grpc_proxy_copy_goroutines", nil))
+
+	require.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	require.Error(t, err)
+	assert.Eventually(t, func() bool {
+		return d.Streams() == 0 && d.Goroutines() == 0
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 0, d.Leaked())
+	assert.Equal(t, float64(0), metricValue(t, reg, "grpc_proxy_leaked_copy_goroutines", nil))
+}
+
+func TestLeakDetector_Leak(t *testing.T) {
+	leaks := make(chan proxy.Leak, 2)
+	d := &proxy.LeakDetector{Threshold: 20 * time.Millisecond, OnLeak: func(l proxy.Leak) { leaks <- l }}
+
+	// The second request blocks in an interceptor which ignores the end of
+	// the stream, holding up the client to backend copy.
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	svc := &pingService{
+		pingStream: func(stream pb.TestService_PingStreamServer) error {
+			if _, err := stream.Recv(); err != nil {
+				return err
+			}
+			<-blocked
+			return nil
+		},
+	}
+	messages := 0
+	logs := &logRecorder{}
+	env := newTestEnv(t, svc, proxy.WithLeakDetector(d), proxy.WithLogger(logs.logger()),
+		proxy.WithStreamInterceptor(func(ctx context.Context, method string, dir proxy.FrameDirection, payload []byte) ([]byte, error) {
+			if dir == proxy.ClientToBackend {
+				if messages++; messages == 2 {
+					close(blocked)
+					<-release
+				}
+			}
+			return payload, nil
+		}))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	stream, err := env.client.PingStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.PingRequest{}))
+	require.NoError(t, stream.Send(&pb.PingRequest{}))
+	_, err = stream.Recv()
+	require.Error(t, err, "the backend ended the stream")
+
+	l := <-leaks
+	assert.Equal(t, "/vgough.testproto.TestService/PingStream", l.Method)
+	assert.Equal(t, proxy.ClientToBackend, l.Direction)
+	assert.False(t, l.Ended.IsZero())
+	assert.Equal(t, 1, d.Leaked())
+	assert.Equal(t, 0, d.Streams())
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		return d.Leaked() == 0 && d.Goroutines() == 0
+	}, time.Second, 5*time.Millisecond, "leaked goroutines are counted until they exit")
+	select {
+	case l := <-leaks:
+		t.Errorf("unexpected leak %+v", l)
+	default:
+	}
+
+	var warned bool
+	for _, r := range logs.get() {
+		if r.msg == "copy goroutine outlived its stream" {
+			warned = true
+			assert.Equal(t, proxy.LevelWarn, r.level)
+		}
+	}
+	assert.True(t, warned, "leaks are logged")
+}
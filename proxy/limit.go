@@ -0,0 +1,82 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// WithMaxConcurrentStreams limits the number of in-flight proxied streams per
+// backend. Backends are told apart by the target of their connection, so
+// connections to the same target share the limit. If max is zero or
+// negative, streams are not limited.
+//
+// When a backend is at the limit, new streams wait for up to queueTimeout for
+// a slot to free up. If queueTimeout is zero, or no slot frees up in time,
+// the stream fails with codes.ResourceExhausted.
+func WithMaxConcurrentStreams(max int, queueTimeout time.Duration) Option {
+	return func(o *options) {
+		if max <= 0 {
+			o.limiter = nil
+			return
+		}
+		o.limiter = &concurrencyLimiter{
+			max:          max,
+			queueTimeout: queueTimeout,
+			slots:        make(map[string]chan struct{}),
+		}
+	}
+}
+
+type concurrencyLimiter struct {
+	max          int
+	queueTimeout time.Duration
+
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+func (l *concurrencyLimiter) backendSlots(conn *grpc.ClientConn) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	slots, ok := l.slots[conn.Target()]
+	if !ok {
+		slots = make(chan struct{}, l.max)
+		l.slots[conn.Target()] = slots
+	}
+	return slots
+}
+
+// acquire reserves a slot for a stream to conn. The returned function
+// releases the slot.
+func (l *concurrencyLimiter) acquire(ctx context.Context, conn *grpc.ClientConn) (func(), error) {
+	slots := l.backendSlots(conn)
+	release := func() { <-slots }
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if l.queueTimeout <= 0 {
+		return nil, status.Errorf(codes.ResourceExhausted, "backend %s has too many concurrent streams", conn.Target())
+	}
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, status.Errorf(codes.ResourceExhausted, "timed out waiting for backend %s", conn.Target())
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
@@ -0,0 +1,113 @@
+package proxy_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestMaxConcurrentStreams_FastFails(t *testing.T) {
+	env := newTestEnv(t, &pingService{}, proxy.WithMaxConcurrentStreams(1, 0))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	stream, err := env.client.PingStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.PingRequest{Value: "foo"}))
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	_, err = env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "backend is at its limit")
+
+	require.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+	// The slot is released shortly after the stream completes.
+	require.Eventually(t, func() bool {
+		_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestMaxConcurrentStreams_Queues(t *testing.T) {
+	env := newTestEnv(t, &pingService{}, proxy.WithMaxConcurrentStreams(1, 5*time.Second))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	stream, err := env.client.PingStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.PingRequest{Value: "foo"}))
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("call must wait for a free slot, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, stream.CloseSend())
+	assert.NoError(t, <-done, "queued call must proceed once the slot is free")
+}
+
+func TestMaxConcurrentStreams_NoLimit(t *testing.T) {
+	env := newTestEnv(t, &pingService{}, proxy.WithMaxConcurrentStreams(0, 0))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	stream, err := env.client.PingStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.PingRequest{Value: "foo"}))
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	_, err = env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	assert.NoError(t, err, "zero means no limit")
+	require.NoError(t, stream.CloseSend())
+}
+
+func TestMaxConcurrentStreams_PerTarget(t *testing.T) {
+	// The director dials the backend for every call, so the limit must
+	// apply to the target, not the connection.
+	env := newTestEnvWithDirector(t, &pingService{}, func(backend *grpc.ClientConn) proxy.StreamDirector {
+		return func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+			conn, err := grpc.Dial(backend.Target(), grpc.WithInsecure(), proxy.DialOption())
+			if err != nil {
+				return ctx, nil, proxy.Direction{}, err
+			}
+			return ctx, func() { conn.Close() }, proxy.Direction{BackendConn: conn}, nil
+		}
+	}, proxy.WithMaxConcurrentStreams(1, 0))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	stream, err := env.client.PingStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.PingRequest{Value: "foo"}))
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	_, err = env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "connections to the same target share the limit")
+	require.NoError(t, stream.CloseSend())
+}
@@ -0,0 +1,186 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/grpclog"
+)
+
+// Level is the severity of a log message. The levels have the values of
+// those of log/slog.
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func (l Level) String() string {
+	switch {
+	case l < LevelInfo:
+		return "DEBUG"
+	case l < LevelWarn:
+		return "INFO"
+	case l < LevelError:
+		return "WARN"
+	}
+	return "ERROR"
+}
+
+// Logger receives the internal warnings of the proxy, such as backends
+// which cannot be dialed, failed copies and abandoned shadow calls. The
+// arguments after the message are alternating keys and values, as for
+// *slog.Logger, which implements Logger.
+//
+// Without a Logger, messages go to grpclog, see WithLogger.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// WithLogger sends the internal messages of the handler to l. By default,
+// they are written to grpclog.
+func WithLogger(l Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// loggerOrDefault returns l, or a Logger writing to grpclog if l is nil.
+func loggerOrDefault(l Logger) Logger {
+	if l == nil {
+		return grpcLogger{}
+	}
+	return l
+}
+
+type grpcLogger struct{}
+
+func (grpcLogger) Debug(msg string, keyvals ...interface{}) {
+	if grpclog.V(2) {
+		grpclog.Info(formatLog(msg, keyvals))
+	}
+}
+
+func (grpcLogger) Info(msg string, keyvals ...interface{}) {
+	grpclog.Info(formatLog(msg, keyvals))
+}
+
+func (grpcLogger) Warn(msg string, keyvals ...interface{}) {
+	grpclog.Warning(formatLog(msg, keyvals))
+}
+
+func (grpcLogger) Error(msg string, keyvals ...interface{}) {
+	grpclog.Error(formatLog(msg, keyvals))
+}
+
+// formatLog formats a message and its keys and values as text, such as
+// `dial failed backend=api error="connection refused"`.
+func formatLog(msg string, keyvals []interface{}) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		key, value := logKeyValue(keyvals, i)
+		v := fmt.Sprint(value)
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(&b, " %s=%s", key, v)
+	}
+	return b.String()
+}
+
+// logKeyValue returns the key and value at index i of keyvals. As with
+// slog, a key without a value is logged under "!BADKEY".
+func logKeyValue(keyvals []interface{}, i int) (string, interface{}) {
+	if i+1 >= len(keyvals) {
+		return "!BADKEY", keyvals[i]
+	}
+	if key, ok := keyvals[i].(string); ok {
+		return key, keyvals[i+1]
+	}
+	return fmt.Sprint(keyvals[i]), keyvals[i+1]
+}
+
+// ZapSugaredLogger is the part of *zap.SugaredLogger used by
+// NewZapLogger.
+type ZapSugaredLogger interface {
+	Debugw(msg string, keysAndValues ...interface{})
+	Infow(msg string, keysAndValues ...interface{})
+	Warnw(msg string, keysAndValues ...interface{})
+	Errorw(msg string, keysAndValues ...interface{})
+}
+
+// NewZapLogger returns a Logger writing to a zap logger, such as
+//
+//	proxy.NewZapLogger(zapLogger.Sugar())
+func NewZapLogger(l ZapSugaredLogger) Logger {
+	return zapLogger{l}
+}
+
+type zapLogger struct {
+	l ZapSugaredLogger
+}
+
+func (z zapLogger) Debug(msg string, keyvals ...interface{}) { z.l.Debugw(msg, keyvals...) }
+func (z zapLogger) Info(msg string, keyvals ...interface{})  { z.l.Infow(msg, keyvals...) }
+func (z zapLogger) Warn(msg string, keyvals ...interface{})  { z.l.Warnw(msg, keyvals...) }
+func (z zapLogger) Error(msg string, keyvals ...interface{}) { z.l.Errorw(msg, keyvals...) }
+
+// LogrusEntry is the part of *logrus.Entry used by NewLogrusLogger.
+type LogrusEntry interface {
+	Debug(args ...interface{})
+	Info(args ...interface{})
+	Warn(args ...interface{})
+	Error(args ...interface{})
+}
+
+// NewLogrusLogger returns a Logger writing to the logrus entries returned
+// by withFields for the keys and values of each message, such as
+//
+//	proxy.NewLogrusLogger(func(fields map[string]interface{}) proxy.LogrusEntry {
+//		return logrusLogger.WithFields(fields)
+//	})
+func NewLogrusLogger(withFields func(fields map[string]interface{}) LogrusEntry) Logger {
+	return logrusLogger{withFields}
+}
+
+type logrusLogger struct {
+	withFields func(fields map[string]interface{}) LogrusEntry
+}
+
+func (l logrusLogger) entry(keyvals []interface{}) LogrusEntry {
+	fields := make(map[string]interface{}, (len(keyvals)+1)/2)
+	for i := 0; i < len(keyvals); i += 2 {
+		key, value := logKeyValue(keyvals, i)
+		fields[key] = value
+	}
+	return l.withFields(fields)
+}
+
+func (l logrusLogger) Debug(msg string, keyvals ...interface{}) { l.entry(keyvals).Debug(msg) }
+func (l logrusLogger) Info(msg string, keyvals ...interface{})  { l.entry(keyvals).Info(msg) }
+func (l logrusLogger) Warn(msg string, keyvals ...interface{})  { l.entry(keyvals).Warn(msg) }
+func (l logrusLogger) Error(msg string, keyvals ...interface{}) { l.entry(keyvals).Error(msg) }
+
+// NewFuncLogger returns a Logger calling log for every message, for other
+// logging libraries.
+func NewFuncLogger(log func(level Level, msg string, keyvals ...interface{})) Logger {
+	return funcLogger(log)
+}
+
+type funcLogger func(level Level, msg string, keyvals ...interface{})
+
+func (f funcLogger) Debug(msg string, keyvals ...interface{}) { f(LevelDebug, msg, keyvals...) }
+func (f funcLogger) Info(msg string, keyvals ...interface{})  { f(LevelInfo, msg, keyvals...) }
+func (f funcLogger) Warn(msg string, keyvals ...interface{})  { f(LevelWarn, msg, keyvals...) }
+func (f funcLogger) Error(msg string, keyvals ...interface{}) { f(LevelError, msg, keyvals...) }
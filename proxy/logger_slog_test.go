@@ -0,0 +1,29 @@
+//go:build go1.21
+// +build go1.21
+
+package proxy_test
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger_Slog(t *testing.T) {
+	var buf bytes.Buffer
+	var l proxy.Logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+	l.Warn("backend dial failed", "backend", "api")
+	assert.Equal(t, "level=WARN msg=\"backend dial failed\" backend=api\n", buf.String())
+	assert.Equal(t, slog.LevelWarn.String(), proxy.LevelWarn.String(), "the levels match")
+	assert.Equal(t, int(slog.LevelError), int(proxy.LevelError))
+}
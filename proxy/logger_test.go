@@ -0,0 +1,140 @@
+package proxy_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+type logRecord struct {
+	level   proxy.Level
+	msg     string
+	keyvals []interface{}
+}
+
+// logRecorder keeps the messages logged through NewFuncLogger.
+type logRecorder struct {
+	mu      sync.Mutex
+	records []logRecord
+}
+
+func (r *logRecorder) logger() proxy.Logger {
+	return proxy.NewFuncLogger(func(level proxy.Level, msg string, keyvals ...interface{}) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.records = append(r.records, logRecord{level, msg, keyvals})
+	})
+}
+
+func (r *logRecorder) get() []logRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]logRecord(nil), r.records...)
+}
+
+func TestWithLogger(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := lis.Addr().String()
+	lis.Close()
+	unreachable, err := grpc.Dial(addr, grpc.WithInsecure(), proxy.DialOption())
+	require.NoError(t, err)
+	defer unreachable.Close()
+
+	rec := &logRecorder{}
+	svc := &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			return nil, status.Error(codes.FailedPrecondition, "not now")
+		},
+	}
+	env := newTestEnvWithDirector(t, svc, func(backend *grpc.ClientConn) proxy.StreamDirector {
+		return func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+			if method == "/vgough.testproto.TestService/PingEmpty" {
+				return ctx, nil, proxy.Direction{BackendConn: unreachable}, nil
+			}
+			return ctx, nil, proxy.Direction{BackendConn: backend}, nil
+		}
+	}, proxy.WithLogger(rec.logger()))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	_, err = env.client.PingEmpty(ctx, &pb.Empty{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	_, err = env.client.Ping(ctx, &pb.PingRequest{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	records := rec.get()
+	require.Len(t, records, 2)
+	assert.Equal(t, proxy.LevelWarn, records[0].level)
+	assert.Equal(t, "backend stream failed", records[0].msg)
+	assert.Equal(t, []interface{}{"method", "/vgough.testproto.TestService/PingEmpty", "backend", addr}, records[0].keyvals[:4])
+	assert.Equal(t, proxy.LevelDebug, records[1].level, "errors of backends are not warnings")
+}
+
+type zapRecorder struct {
+	logRecorder
+}
+
+func (z *zapRecorder) Debugw(msg string, kv ...interface{}) { z.logRecorder.logger().Debug(msg, kv...) }
+func (z *zapRecorder) Infow(msg string, kv ...interface{})  { z.logRecorder.logger().Info(msg, kv...) }
+func (z *zapRecorder) Warnw(msg string, kv ...interface{})  { z.logRecorder.logger().Warn(msg, kv...) }
+func (z *zapRecorder) Errorw(msg string, kv ...interface{}) { z.logRecorder.logger().Error(msg, kv...) }
+
+func TestNewZapLogger(t *testing.T) {
+	z := &zapRecorder{}
+	l := proxy.NewZapLogger(z)
+	l.Warn("dial failed", "backend", "api")
+	l.Error("broken")
+	assert.Equal(t, []logRecord{
+		{proxy.LevelWarn, "dial failed", []interface{}{"backend", "api"}},
+		{proxy.LevelError, "broken", nil},
+	}, z.get())
+}
+
+type logrusEntry struct {
+	fields map[string]interface{}
+	logged *[]string
+}
+
+func (e logrusEntry) log(level string, args []interface{}) {
+	*e.logged = append(*e.logged, level+" "+args[0].(string))
+}
+
+func (e logrusEntry) Debug(args ...interface{}) { e.log("debug", args) }
+func (e logrusEntry) Info(args ...interface{})  { e.log("info", args) }
+func (e logrusEntry) Warn(args ...interface{})  { e.log("warn", args) }
+func (e logrusEntry) Error(args ...interface{}) { e.log("error", args) }
+
+func TestNewLogrusLogger(t *testing.T) {
+	var logged []string
+	var fields []map[string]interface{}
+	l := proxy.NewLogrusLogger(func(f map[string]interface{}) proxy.LogrusEntry {
+		fields = append(fields, f)
+		return logrusEntry{fields: f, logged: &logged}
+	})
+	l.Info("dialing", "backend", "api", "attempt", 2)
+	l.Debug("odd", "dangling")
+	assert.Equal(t, []string{"info dialing", "debug odd"}, logged)
+	assert.Equal(t, []map[string]interface{}{
+		{"backend": "api", "attempt": 2},
+		{"!BADKEY": "dangling"},
+	}, fields)
+}
+
+func TestLevel_String(t *testing.T) {
+	assert.Equal(t, "DEBUG", proxy.LevelDebug.String())
+	assert.Equal(t, "INFO", proxy.LevelInfo.String())
+	assert.Equal(t, "WARN", proxy.LevelWarn.String())
+	assert.Equal(t, "ERROR", proxy.LevelError.String())
+}
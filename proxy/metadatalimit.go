@@ -0,0 +1,67 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// MetadataLimits bound the metadata of client calls, which the proxy would
+// otherwise forward to backends however large. Calls over a limit fail with
+// codes.ResourceExhausted before the backend stream is opened. The limits
+// count all incoming metadata, including that set by gRPC such as
+// user-agent. Zero means no limit.
+type MetadataLimits struct {
+	// MaxSize limits the total size of the metadata, the lengths of all
+	// keys and values.
+	MaxSize int
+
+	// MaxKeys limits the number of distinct keys.
+	MaxKeys int
+
+	// MaxValueLength limits the length of each value.
+	MaxValueLength int
+}
+
+// WithMetadataLimits limits the metadata of client calls. Directors may
+// override the limits with Direction.MetadataLimits, as Router does for
+// routes with their own limits.
+func WithMetadataLimits(l MetadataLimits) Option {
+	return func(o *options) {
+		o.metadataLimits = l
+	}
+}
+
+// Merge returns l with its unset limits taken from def. Negative values
+// remove a limit of def.
+func (l MetadataLimits) Merge(def MetadataLimits) MetadataLimits {
+	return MetadataLimits{
+		MaxSize:        pickLimit(l.MaxSize, def.MaxSize),
+		MaxKeys:        pickLimit(l.MaxKeys, def.MaxKeys),
+		MaxValueLength: pickLimit(l.MaxValueLength, def.MaxValueLength),
+	}
+}
+
+// check returns an error if md exceeds a limit.
+func (l MetadataLimits) check(md metadata.MD) error {
+	if l.MaxKeys > 0 && len(md) > l.MaxKeys {
+		return status.Errorf(codes.ResourceExhausted, "metadata has more keys than max (%d vs. %d)", len(md), l.MaxKeys)
+	}
+	size := 0
+	for k, vs := range md {
+		for _, v := range vs {
+			if l.MaxValueLength > 0 && len(v) > l.MaxValueLength {
+				return status.Errorf(codes.ResourceExhausted, "metadata value of %q longer than max (%d vs. %d)", k, len(v), l.MaxValueLength)
+			}
+			size += len(k) + len(v)
+		}
+	}
+	if l.MaxSize > 0 && size > l.MaxSize {
+		return status.Errorf(codes.ResourceExhausted, "metadata larger than max (%d vs. %d)", size, l.MaxSize)
+	}
+	return nil
+}
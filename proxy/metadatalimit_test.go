@@ -0,0 +1,75 @@
+package proxy_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestMetadataLimits(t *testing.T) {
+	env := newTestEnv(t, &pingService{}, proxy.WithMetadataLimits(proxy.MetadataLimits{
+		MaxSize:        512,
+		MaxKeys:        8,
+		MaxValueLength: 100,
+	}))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	_, err := env.client.Ping(metadata.AppendToOutgoingContext(ctx, "tenant", "a"), &pb.PingRequest{})
+	require.NoError(t, err)
+
+	_, err = env.client.Ping(metadata.AppendToOutgoingContext(ctx, "tenant", strings.Repeat("x", 101)), &pb.PingRequest{})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "value too long")
+
+	var kv []string
+	for _, k := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		kv = append(kv, k, "1")
+	}
+	_, err = env.client.Ping(metadata.AppendToOutgoingContext(ctx, kv...), &pb.PingRequest{})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "too many keys")
+
+	kv = nil
+	for i := 0; i < 6; i++ {
+		kv = append(kv, "big", strings.Repeat("x", 100))
+	}
+	_, err = env.client.Ping(metadata.AppendToOutgoingContext(ctx, kv...), &pb.PingRequest{})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "too large")
+}
+
+func TestMetadataLimits_Route(t *testing.T) {
+	env := newTestEnvWithDirector(t, &pingService{}, func(backend *grpc.ClientConn) proxy.StreamDirector {
+		r := proxy.NewRouter()
+		r.AddBackend("main", backend)
+		r.AddRoute(proxy.Route{
+			MethodPrefix:   "/vgough.testproto.TestService/PingError",
+			Backend:        "main",
+			MetadataLimits: proxy.MetadataLimits{MaxValueLength: 10},
+		})
+		r.AddRoute(proxy.Route{
+			MethodPrefix:   "/vgough.testproto.TestService/Ping",
+			Backend:        "main",
+			MetadataLimits: proxy.MetadataLimits{MaxValueLength: -1},
+		})
+		return r.Direct
+	}, proxy.WithMetadataLimits(proxy.MetadataLimits{MaxValueLength: 50}))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "tenant", strings.Repeat("x", 60))
+	_, err := env.client.Ping(ctx, &pb.PingRequest{})
+	require.NoError(t, err, "the route removes the limit")
+
+	_, err = env.client.PingError(ctx, &pb.PingRequest{})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "the route tightens the limit")
+}
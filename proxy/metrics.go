@@ -0,0 +1,179 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// WithMetrics enables Prometheus metrics for proxied streams, registered with
+// r. The following metrics are exported:
+//
+//	grpc_proxy_streams_started_total{method,backend}
+//	grpc_proxy_streams_handled_total{method,backend,code}
+//	grpc_proxy_stream_duration_seconds{method,backend}
+//	grpc_proxy_messages_total{method,backend,direction}
+//	grpc_proxy_bytes_total{method,backend,direction}
+//
+// The backend label is the target of the backend connection, and is empty
+// for streams rejected by the director. Handlers sharing a registerer share
+// the same metrics.
+//
+// Clients choose the method names, so the method label is bounded: methods
+// lists the full method names, or service prefixes ending in "/", which are
+// labeled by name, and others are labeled "unknown". If methods is empty,
+// the first 500 methods seen are labeled by name.
+func WithMetrics(r prometheus.Registerer, methods ...string) Option {
+	m := newMetrics(r)
+	m.methods = append([]string(nil), methods...)
+	return func(o *options) {
+		o.metrics = m
+	}
+}
+
+// unknownMethodLabel is the method label of methods which are not labeled
+// by name.
+const unknownMethodLabel = "unknown"
+
+// maxMetricsMethods is the number of methods labeled by name when
+// WithMetrics is given no methods.
+const maxMetricsMethods = 500
+
+type metrics struct {
+	started  *prometheus.CounterVec
+	handled  *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	messages *prometheus.CounterVec
+	bytes    *prometheus.CounterVec
+
+	methods []string
+
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func newMetrics(r prometheus.Registerer) *metrics {
+	m := &metrics{
+		started: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_proxy_streams_started_total",
+			Help: "Total number of streams forwarded to a backend.",
+		}, []string{"method", "backend"}),
+		handled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_proxy_streams_handled_total",
+			Help: "Total number of completed streams, by status code.",
+		}, []string{"method", "backend", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "grpc_proxy_stream_duration_seconds",
+			Help:    "Duration of proxied streams.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "backend"}),
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_proxy_messages_total",
+			Help: "Total number of messages forwarded, by direction.",
+		}, []string{"method", "backend", "direction"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_proxy_bytes_total",
+			Help: "Total number of message bytes forwarded, by direction.",
+		}, []string{"method", "backend", "direction"}),
+	}
+	m.started = register(r, m.started).(*prometheus.CounterVec)
+	m.handled = register(r, m.handled).(*prometheus.CounterVec)
+	m.duration = register(r, m.duration).(*prometheus.HistogramVec)
+	m.messages = register(r, m.messages).(*prometheus.CounterVec)
+	m.bytes = register(r, m.bytes).(*prometheus.CounterVec)
+	return m
+}
+
+// register adds c to r, returning the existing collector if an identical one
+// was registered before.
+func register(r prometheus.Registerer, c prometheus.Collector) prometheus.Collector {
+	if err := r.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+		panic(err)
+	}
+	return c
+}
+
+// methodLabel returns the method label of method.
+func (m *metrics) methodLabel(method string) string {
+	if len(m.methods) != 0 {
+		for _, p := range m.methods {
+			if method == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(method, p)) {
+				return method
+			}
+		}
+		return unknownMethodLabel
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.seen[method] {
+		if len(m.seen) >= maxMetricsMethods {
+			return unknownMethodLabel
+		}
+		if m.seen == nil {
+			m.seen = make(map[string]bool)
+		}
+		m.seen[method] = true
+	}
+	return method
+}
+
+// start counts a stream as started and returns a ServerStream which counts
+// the forwarded messages.
+func (m *metrics) start(ps *proxiedStream, in grpc.ServerStream) grpc.ServerStream {
+	method := m.methodLabel(ps.method)
+	m.started.WithLabelValues(method, ps.backend).Inc()
+	c2b, b2c := ClientToBackend.String(), BackendToClient.String()
+	return &metricsServerStream{
+		ServerStream: in,
+		msgsIn:       m.messages.WithLabelValues(method, ps.backend, c2b),
+		bytesIn:      m.bytes.WithLabelValues(method, ps.backend, c2b),
+		msgsOut:      m.messages.WithLabelValues(method, ps.backend, b2c),
+		bytesOut:     m.bytes.WithLabelValues(method, ps.backend, b2c),
+	}
+}
+
+func (m *metrics) finish(ps *proxiedStream, err error) {
+	code := status.Code(err).String()
+	method := m.methodLabel(ps.method)
+	m.handled.WithLabelValues(method, ps.backend, code).Inc()
+	m.duration.WithLabelValues(method, ps.backend).Observe(time.Since(ps.start).Seconds())
+}
+
+type metricsServerStream struct {
+	grpc.ServerStream
+	msgsIn, bytesIn   prometheus.Counter
+	msgsOut, bytesOut prometheus.Counter
+}
+
+func (s *metricsServerStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if f, ok := m.(*frame); ok {
+		s.msgsIn.Inc()
+		s.bytesIn.Add(float64(len(f.payload)))
+	}
+	return nil
+}
+
+func (s *metricsServerStream) SendMsg(m interface{}) error {
+	if err := s.ServerStream.SendMsg(m); err != nil {
+		return err
+	}
+	if f, ok := m.(*frame); ok {
+		s.msgsOut.Inc()
+		s.bytesOut.Add(float64(len(f.payload)))
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package proxy_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// metricValue returns the value of the counter or gauge or the sample count
+// of the histogram with the given name and labels, or -1 if there is none.
+func metricValue(t *testing.T, g prometheus.Gatherer, name string, labels map[string]string) float64 {
+	families, err := g.Gather()
+	require.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+	next:
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if v, ok := labels[l.GetName()]; ok && v != l.GetValue() {
+					continue next
+				}
+			}
+			if m.GetHistogram() != nil {
+				return float64(m.GetHistogram().GetSampleCount())
+			}
+			if m.GetGauge() != nil {
+				return m.GetGauge().GetValue()
+			}
+			return m.GetCounter().GetValue()
+		}
+	}
+	return -1
+}
+
+func TestMetrics_CountsProxiedStreams(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	env := newTestEnv(t, &pingService{}, proxy.WithMetrics(reg))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err)
+
+	labels := map[string]string{
+		"method":  "/vgough.testproto.TestService/Ping",
+		"backend": env.backendConn.Target(),
+	}
+	assert.EqualValues(t, 1, metricValue(t, reg, "grpc_proxy_streams_started_total", labels))
+	assert.EqualValues(t, 1, metricValue(t, reg, "grpc_proxy_stream_duration_seconds", labels))
+
+	labels["code"] = "OK"
+	assert.EqualValues(t, 1, metricValue(t, reg, "grpc_proxy_streams_handled_total", labels))
+
+	delete(labels, "code")
+	labels["direction"] = proxy.ClientToBackend.String()
+	assert.EqualValues(t, 1, metricValue(t, reg, "grpc_proxy_messages_total", labels))
+	assert.True(t, metricValue(t, reg, "grpc_proxy_bytes_total", labels) > 0)
+	labels["direction"] = proxy.BackendToClient.String()
+	assert.EqualValues(t, 1, metricValue(t, reg, "grpc_proxy_messages_total", labels))
+}
+
+func TestMetrics_SharedRegistry(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	proxy.WithMetrics(reg)
+	assert.NotPanics(t, func() { proxy.WithMetrics(reg) }, "handlers must be able to share a registry")
+}
+
+func TestMetrics_MethodLabelsAreBounded(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	env := newTestEnv(t, &pingService{}, proxy.WithMetrics(reg, "/vgough.testproto.TestService/Ping"))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		err := env.clientConn.Invoke(ctx, fmt.Sprintf("/random.Service/Method%d", i), &pb.Empty{}, &pb.Empty{})
+		require.Error(t, err)
+	}
+
+	assert.EqualValues(t, 1, metricValue(t, reg, "grpc_proxy_streams_started_total",
+		map[string]string{"method": "/vgough.testproto.TestService/Ping"}))
+	assert.EqualValues(t, 10, metricValue(t, reg, "grpc_proxy_streams_started_total",
+		map[string]string{"method": "unknown"}))
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() == "grpc_proxy_streams_started_total" {
+			assert.Len(t, f.GetMetric(), 2, "unlisted methods share a label")
+		}
+	}
+}
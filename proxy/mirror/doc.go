@@ -0,0 +1,24 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+/*
+Package mirror publishes copies of proxied messages to an event bus, for
+event sourcing or analytics pipelines fed by the traffic of the proxy.
+
+A Mirror copies every frame forwarded for the selected methods into a
+Message, with the call, the method, the direction and the incoming
+metadata, and hands the messages to a Publisher from a background
+goroutine, so that calls never wait for the bus:
+
+	m := mirror.New(mirror.NewNATSPublisher("nats.internal:4222", "grpc"), mirror.Config{
+		Methods: []string{"/orders.OrderService/"},
+	})
+	defer m.Close()
+	handler := proxy.TransparentHandler(director, m.Options()...)
+
+NewNATSPublisher speaks the NATS client protocol, and NewKafkaPublisher
+produces to Kafka through the Confluent REST Proxy. Messages are encoded as
+JSON, with the payload in base64.
+*/
+package mirror
@@ -0,0 +1,55 @@
+package mirror_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy/mirror"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKafkaPublisher(t *testing.T) {
+	var got []*mirror.Message
+	var keys []string
+	restProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/topics/grpc-traffic", r.URL.Path)
+		assert.Equal(t, "application/vnd.kafka.binary.v2+json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "Basic abc", r.Header.Get("Authorization"))
+		var body struct {
+			Records []struct {
+				Key, Value []byte
+			}
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		for _, rec := range body.Records {
+			var msg mirror.Message
+			require.NoError(t, json.Unmarshal(rec.Value, &msg))
+			got = append(got, &msg)
+			keys = append(keys, string(rec.Key))
+		}
+		if len(got) > 2 {
+			w.Write([]byte(`{"offsets": [{"error_code": 40403, "error": "topic not found"}]}`))
+			return
+		}
+		w.Write([]byte(`{"offsets": [{"partition": 0, "offset": 1}, {"partition": 0, "offset": 2}]}`))
+	}))
+	defer restProxy.Close()
+
+	pub := mirror.NewKafkaPublisher(restProxy.URL, "grpc-traffic")
+	pub.Header = http.Header{"Authorization": {"Basic abc"}}
+	msgs := []*mirror.Message{
+		{CallID: "c1", Method: "/a.A/B", Direction: "client-to-backend", Payload: []byte("req")},
+		{CallID: "c1", Sequence: 1, Method: "/a.A/B", Direction: "backend-to-client", Payload: []byte("resp")},
+	}
+	require.NoError(t, pub.Publish(context.Background(), msgs))
+	assert.Equal(t, msgs, got)
+	assert.Equal(t, []string{"c1", "c1"}, keys, "messages are keyed by call")
+
+	err := pub.Publish(context.Background(), msgs[:1])
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "topic not found")
+}
@@ -0,0 +1,277 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package mirror
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Message is the copy of a forwarded frame.
+type Message struct {
+	// CallID identifies the call of the message, and Sequence numbers the
+	// messages of the call in both directions, from 0.
+	CallID    string    `json:"call_id"`
+	Sequence  int       `json:"sequence"`
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Direction string    `json:"direction"`
+	// Metadata is the incoming metadata of the call, see Config.Metadata.
+	Metadata map[string][]string `json:"metadata,omitempty"`
+	// Payload is the serialized message as forwarded.
+	Payload []byte `json:"payload"`
+}
+
+// Publisher sends messages to an event bus.
+type Publisher interface {
+	// Publish sends the messages in order. It is never called concurrently
+	// by a Mirror.
+	Publish(ctx context.Context, msgs []*Message) error
+	// Close releases the resources of the publisher.
+	Close() error
+}
+
+// Config configures a Mirror.
+type Config struct {
+	// Methods lists full method names, or prefixes ending in "/" or ".",
+	// whose messages are mirrored. If empty, all messages are mirrored.
+	Methods []string
+
+	// Metadata lists the metadata keys copied into messages. If empty, all
+	// keys but "authorization" and "cookie" are copied.
+	Metadata []string
+
+	// QueueSize is the number of messages waiting to be published, beyond
+	// which messages are dropped. Defaults to 10000.
+	QueueSize int
+
+	// BatchSize limits the messages given to one Publish. Defaults to 100.
+	BatchSize int
+
+	// Timeout limits each Publish. Defaults to 10 seconds.
+	Timeout time.Duration
+
+	// OnError, if set, is called with errors of the publisher. The failed
+	// messages are not published again.
+	OnError func(error)
+}
+
+// Mirror publishes copies of the forwarded messages. Install its Options on
+// the proxy handler.
+type Mirror struct {
+	cfg Config
+	pub Publisher
+
+	// calls holds the state of calls in flight by their CallInfo. Entries
+	// are removed when the context of the call is done, since frames may
+	// still be copied after the call has finished.
+	calls sync.Map
+
+	mu      sync.RWMutex
+	closed  bool
+	queue   chan *Message
+	done    chan struct{}
+	dropped uint64
+}
+
+type mirroredCall struct {
+	id  string
+	seq int32
+	// finished is set by the status hook, after which frames are not
+	// mirrored.
+	finished int32
+}
+
+// New returns a Mirror publishing to pub.
+func New(pub Publisher, cfg Config) *Mirror {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 10000
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	m := &Mirror{
+		cfg:   cfg,
+		pub:   pub,
+		queue: make(chan *Message, cfg.QueueSize),
+		done:  make(chan struct{}),
+	}
+	go m.run()
+	return m
+}
+
+// Options returns the proxy options installing the mirror.
+func (m *Mirror) Options() []proxy.Option {
+	return []proxy.Option{
+		proxy.WithStreamInterceptor(m.intercept),
+		proxy.WithStatusHook(m.finish),
+	}
+}
+
+// Dropped returns the number of messages dropped because the queue was
+// full.
+func (m *Mirror) Dropped() uint64 {
+	return atomic.LoadUint64(&m.dropped)
+}
+
+// Close publishes the queued messages, then closes the publisher. Messages
+// forwarded afterwards are not mirrored.
+func (m *Mirror) Close() error {
+	m.mu.Lock()
+	if !m.closed {
+		m.closed = true
+		close(m.queue)
+	}
+	m.mu.Unlock()
+	<-m.done
+	return m.pub.Close()
+}
+
+func (m *Mirror) run() {
+	defer close(m.done)
+	for msg := range m.queue {
+		batch := []*Message{msg}
+	fill:
+		for len(batch) < m.cfg.BatchSize {
+			select {
+			case msg, ok := <-m.queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, msg)
+			default:
+				break fill
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), m.cfg.Timeout)
+		err := m.pub.Publish(ctx, batch)
+		cancel()
+		if err != nil && m.cfg.OnError != nil {
+			m.cfg.OnError(err)
+		}
+	}
+}
+
+func (m *Mirror) mirrored(method string) bool {
+	if len(m.cfg.Methods) == 0 {
+		return true
+	}
+	for _, p := range m.cfg.Methods {
+		if method == p || ((strings.HasSuffix(p, "/") || strings.HasSuffix(p, ".")) && strings.HasPrefix(method, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// call returns the state of the call of ctx, or nil if the call has
+// finished.
+func (m *Mirror) call(ctx context.Context, info *proxy.CallInfo) *mirroredCall {
+	v, ok := m.calls.Load(info)
+	if !ok {
+		if ctx.Err() != nil {
+			return nil
+		}
+		var loaded bool
+		v, loaded = m.calls.LoadOrStore(info, &mirroredCall{id: newCallID()})
+		if !loaded {
+			go func() {
+				<-ctx.Done()
+				m.calls.Delete(info)
+			}()
+		}
+	}
+	c := v.(*mirroredCall)
+	if atomic.LoadInt32(&c.finished) != 0 {
+		return nil
+	}
+	return c
+}
+
+func newCallID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func (m *Mirror) metadata(ctx context.Context) map[string][]string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if len(md) == 0 {
+		return nil
+	}
+	out := make(map[string][]string, len(md))
+	if len(m.cfg.Metadata) != 0 {
+		for _, k := range m.cfg.Metadata {
+			if v := md.Get(k); len(v) != 0 {
+				out[strings.ToLower(k)] = v
+			}
+		}
+		return out
+	}
+	for k, v := range md {
+		if k != "authorization" && k != "cookie" {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+func (m *Mirror) intercept(ctx context.Context, method string, dir proxy.FrameDirection, payload []byte) ([]byte, error) {
+	info := proxy.CallInfoFromContext(ctx)
+	if info == nil || !m.mirrored(method) {
+		return payload, nil
+	}
+	c := m.call(ctx, info)
+	if c == nil {
+		return payload, nil
+	}
+	msg := &Message{
+		CallID:    c.id,
+		Sequence:  int(atomic.AddInt32(&c.seq, 1) - 1),
+		Time:      time.Now(),
+		Method:    method,
+		Direction: dir.String(),
+		Metadata:  m.metadata(ctx),
+		// The frame buffer belongs to the proxy.
+		Payload: append([]byte(nil), payload...),
+	}
+	m.emit(msg)
+	// Mirroring never changes or fails calls.
+	return payload, nil
+}
+
+func (m *Mirror) finish(ctx context.Context, st *status.Status, trailer metadata.MD) (*status.Status, metadata.MD) {
+	if info := proxy.CallInfoFromContext(ctx); info != nil {
+		if c, ok := m.calls.Load(info); ok {
+			atomic.StoreInt32(&c.(*mirroredCall).finished, 1)
+		}
+	}
+	return st, trailer
+}
+
+func (m *Mirror) emit(msg *Message) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return
+	}
+	select {
+	case m.queue <- msg:
+	default:
+		atomic.AddUint64(&m.dropped, 1)
+	}
+}
@@ -0,0 +1,160 @@
+package mirror_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/mkxxx/grpc-proxy/proxy/mirror"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+type pingService struct{}
+
+func (pingService) PingEmpty(ctx context.Context, _ *pb.Empty) (*pb.PingResponse, error) {
+	return &pb.PingResponse{Value: "empty"}, nil
+}
+
+func (pingService) Ping(ctx context.Context, in *pb.PingRequest) (*pb.PingResponse, error) {
+	return &pb.PingResponse{Value: in.Value, Counter: 1}, nil
+}
+
+func (pingService) PingError(ctx context.Context, in *pb.PingRequest) (*pb.Empty, error) {
+	return &pb.Empty{}, nil
+}
+
+func (pingService) PingList(in *pb.PingRequest, stream pb.TestService_PingListServer) error {
+	for i := 1; i <= 2; i++ {
+		if err := stream.Send(&pb.PingResponse{Value: in.Value, Counter: int32(i)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pingService) PingStream(stream pb.TestService_PingStreamServer) error {
+	return nil
+}
+
+// recorder is a Publisher keeping the messages.
+type recorder struct {
+	mu     sync.Mutex
+	msgs   []*mirror.Message
+	closed bool
+}
+
+func (r *recorder) Publish(ctx context.Context, msgs []*mirror.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.msgs = append(r.msgs, msgs...)
+	return nil
+}
+
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return nil
+}
+
+// startProxy starts a proxy to a pingService backend, mirrored to pub.
+// Stopping it closes the mirror.
+func startProxy(t *testing.T, pub mirror.Publisher, cfg mirror.Config) (pb.TestServiceClient, func()) {
+	backendLis := proxy.NewInProcessListener()
+	backend := grpc.NewServer()
+	pb.RegisterTestServiceServer(backend, pingService{})
+	go backend.Serve(backendLis)
+
+	reg := proxy.NewBackendRegistry()
+	reg.Register("ping", backendLis.BackendConfig())
+	director := reg.Director(func(ctx context.Context, method string) (string, error) {
+		return "ping", nil
+	})
+	m := mirror.New(pub, cfg)
+	server := grpc.NewServer(
+		proxy.ServerOption(),
+		grpc.UnknownServiceHandler(proxy.TransparentHandler(director, m.Options()...)),
+	)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(lis)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	return pb.NewTestServiceClient(conn), func() {
+		conn.Close()
+		server.Stop()
+		assert.NoError(t, m.Close())
+		reg.Close()
+		backend.Stop()
+	}
+}
+
+func testCtx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 10*time.Second)
+}
+
+func TestMirror(t *testing.T) {
+	rec := &recorder{}
+	client, stop := startProxy(t, rec, mirror.Config{Methods: []string{"/vgough.testproto.TestService/PingList"}})
+	ctx, cancel := testCtx()
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-tenant", "acme", "authorization", "Bearer secret")
+
+	stream, err := client.PingList(ctx, &pb.PingRequest{Value: "copy"})
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err := stream.Recv()
+		require.NoError(t, err)
+	}
+	_, err = client.Ping(ctx, &pb.PingRequest{Value: "not mirrored"})
+	require.NoError(t, err)
+	stop()
+
+	assert.True(t, rec.closed, "Close closes the publisher")
+	require.Len(t, rec.msgs, 3, "only listed methods are mirrored")
+	for i, msg := range rec.msgs {
+		assert.Equal(t, "/vgough.testproto.TestService/PingList", msg.Method)
+		assert.Equal(t, rec.msgs[0].CallID, msg.CallID)
+		assert.Equal(t, i, msg.Sequence)
+		assert.Equal(t, []string{"acme"}, msg.Metadata["x-tenant"])
+		assert.NotContains(t, msg.Metadata, "authorization", "credentials are left out")
+	}
+	assert.NotEmpty(t, rec.msgs[0].CallID)
+	assert.Equal(t, proxy.ClientToBackend.String(), rec.msgs[0].Direction)
+	var req pb.PingRequest
+	require.NoError(t, proto.Unmarshal(rec.msgs[0].Payload, &req))
+	assert.Equal(t, "copy", req.Value)
+
+	assert.Equal(t, proxy.BackendToClient.String(), rec.msgs[2].Direction)
+	var resp pb.PingResponse
+	require.NoError(t, proto.Unmarshal(rec.msgs[2].Payload, &resp))
+	assert.EqualValues(t, 2, resp.Counter)
+}
+
+func TestMirror_Metadata(t *testing.T) {
+	rec := &recorder{}
+	client, stop := startProxy(t, rec, mirror.Config{Metadata: []string{"X-Tenant"}})
+	ctx, cancel := testCtx()
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-tenant", "acme", "x-other", "1")
+
+	_, err := client.Ping(ctx, &pb.PingRequest{Value: "a"})
+	require.NoError(t, err)
+	_, err = client.Ping(ctx, &pb.PingRequest{Value: "b"})
+	require.NoError(t, err)
+	stop()
+
+	require.Len(t, rec.msgs, 4)
+	assert.Equal(t, map[string][]string{"x-tenant": {"acme"}}, rec.msgs[0].Metadata)
+	assert.NotEqual(t, rec.msgs[0].CallID, rec.msgs[2].CallID, "calls have their own IDs")
+	assert.Equal(t, 0, rec.msgs[2].Sequence)
+}
@@ -0,0 +1,228 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package mirror
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NATSPublisher publishes messages to a NATS server, each on the subject
+// made of Subject and the method, such as "grpc.orders.OrderService.Get",
+// so that subscribers may select services and methods with wildcards.
+//
+// The connection is opened on first use, and opened again after errors.
+type NATSPublisher struct {
+	// Address is the host and port of the server.
+	Address string
+	// Subject is the prefix of the subjects.
+	Subject string
+
+	// User and Password, or Token, authenticate the publisher if set.
+	User, Password string
+	Token          string
+
+	// Dial opens the connection to Address. If nil, a net.Dialer is used.
+	Dial func(ctx context.Context, address string) (net.Conn, error)
+
+	mu         sync.Mutex
+	conn       *natsConn
+	maxPayload int
+}
+
+// NewNATSPublisher returns a NATSPublisher for the server at address.
+func NewNATSPublisher(address, subject string) *NATSPublisher {
+	return &NATSPublisher{Address: address, Subject: subject}
+}
+
+// natsConn is a connection to the server. The reader answers the pings of
+// the server and records its errors.
+type natsConn struct {
+	conn net.Conn
+
+	mu  sync.Mutex
+	w   *bufio.Writer
+	err error
+}
+
+type natsInfo struct {
+	MaxPayload int `json:"max_payload"`
+}
+
+// Publish implements Publisher.
+func (p *NATSPublisher) Publish(ctx context.Context, msgs []*Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		if err := p.connect(ctx); err != nil {
+			return err
+		}
+	}
+	c := p.conn
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetWriteDeadline(deadline)
+		defer c.conn.SetWriteDeadline(time.Time{})
+	}
+	c.mu.Lock()
+	err := c.err
+	// tooLarge reports messages over the maximum payload, which are
+	// skipped while the rest of the batch is published.
+	var tooLarge error
+	for _, msg := range msgs {
+		if err != nil {
+			break
+		}
+		var data []byte
+		if data, err = json.Marshal(msg); err != nil {
+			break
+		}
+		if p.maxPayload > 0 && len(data) > p.maxPayload {
+			// Only this message is lost, the connection is fine.
+			tooLarge = fmt.Errorf("nats: message of %d bytes exceeds the maximum payload of %d bytes", len(data), p.maxPayload)
+			continue
+		}
+		fmt.Fprintf(c.w, "PUB %s %d\r\n", natsSubject(p.Subject, msg.Method), len(data))
+		c.w.Write(data)
+		_, err = c.w.WriteString("\r\n")
+	}
+	if err == nil {
+		err = c.w.Flush()
+	}
+	c.mu.Unlock()
+	if err != nil {
+		c.conn.Close()
+		p.conn = nil
+		return fmt.Errorf("nats: %v", err)
+	}
+	return tooLarge
+}
+
+// natsSubject returns the subject of method.
+func natsSubject(prefix, method string) string {
+	s := strings.Replace(strings.TrimPrefix(method, "/"), "/", ".", -1)
+	// Whitespace and wildcards are not allowed in subjects.
+	s = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n', '*', '>':
+			return '_'
+		}
+		return r
+	}, s)
+	if prefix == "" {
+		return s
+	}
+	return prefix + "." + s
+}
+
+// connect opens the connection and waits for the server to accept it.
+func (p *NATSPublisher) connect(ctx context.Context) error {
+	dial := p.Dial
+	if dial == nil {
+		var d net.Dialer
+		dial = func(ctx context.Context, address string) (net.Conn, error) {
+			return d.DialContext(ctx, "tcp", address)
+		}
+	}
+	conn, err := dial(ctx, p.Address)
+	if err != nil {
+		return fmt.Errorf("nats: %v", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("nats: no server info from %s", p.Address)
+	}
+	var info natsInfo
+	json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info)
+
+	opts, _ := json.Marshal(map[string]interface{}{
+		"verbose":    false,
+		"pedantic":   false,
+		"name":       "grpc-proxy",
+		"user":       p.User,
+		"pass":       p.Password,
+		"auth_token": p.Token,
+	})
+	// The PONG confirms the CONNECT, or else the server sends an error.
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", opts); err != nil {
+		conn.Close()
+		return fmt.Errorf("nats: %v", err)
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("nats: %v", err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return fmt.Errorf("nats: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	c := &natsConn{conn: conn, w: bufio.NewWriter(conn)}
+	go c.read(r)
+	p.conn = c
+	p.maxPayload = info.MaxPayload
+	return nil
+}
+
+func (c *natsConn) read(r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PING":
+			c.mu.Lock()
+			c.w.WriteString("PONG\r\n")
+			c.w.Flush()
+			c.mu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			// The server closes the connection after errors, except for
+			// invalid subjects.
+			c.fail(errors.New(strings.TrimSpace(strings.TrimPrefix(line, "-ERR"))))
+		}
+	}
+}
+
+func (c *natsConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// Close implements Publisher.
+func (p *NATSPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		return nil
+	}
+	err := p.conn.conn.Close()
+	p.conn = nil
+	return err
+}
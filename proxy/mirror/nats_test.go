@@ -0,0 +1,130 @@
+package mirror_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy/mirror"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type natsPub struct {
+	subject string
+	data    []byte
+}
+
+// startNATS starts a minimal NATS server. It requires the token, if set,
+// and pings clients once after their first message.
+func startNATS(t *testing.T, token string) (string, <-chan natsPub, <-chan string) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	pubs := make(chan natsPub, 10)
+	pongs := make(chan string, 10)
+	go func() {
+		defer lis.Close()
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go serveNATS(conn, token, pubs, pongs)
+		}
+	}()
+	return lis.Addr().String(), pubs, pongs
+}
+
+func serveNATS(conn net.Conn, token string, pubs chan<- natsPub, pongs chan<- string) {
+	defer conn.Close()
+	io.WriteString(conn, `INFO {"server_id":"test","max_payload":1024}`+"\r\n")
+	r := bufio.NewReader(conn)
+	pinged := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "CONNECT":
+			var opts struct {
+				AuthToken string `json:"auth_token"`
+			}
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "CONNECT ")), &opts)
+			if opts.AuthToken != token {
+				io.WriteString(conn, "-ERR 'Authorization Violation'\r\n")
+				return
+			}
+		case "PING":
+			io.WriteString(conn, "PONG\r\n")
+		case "PONG":
+			pongs <- "PONG"
+		case "PUB":
+			n, _ := strconv.Atoi(fields[len(fields)-1])
+			data := make([]byte, n+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			pubs <- natsPub{subject: fields[1], data: data[:n]}
+			if !pinged {
+				pinged = true
+				io.WriteString(conn, "PING\r\n")
+			}
+		}
+	}
+}
+
+func TestNATSPublisher(t *testing.T) {
+	addr, pubs, pongs := startNATS(t, "s3cret")
+	pub := mirror.NewNATSPublisher(addr, "grpc")
+	pub.Token = "s3cret"
+	defer pub.Close()
+
+	msgs := []*mirror.Message{
+		{CallID: "c1", Method: "/orders.OrderService/Get", Payload: []byte{1, 2}},
+		{CallID: "c1", Sequence: 1, Method: "/orders.OrderService/Get"},
+	}
+	require.NoError(t, pub.Publish(context.Background(), msgs))
+	for i := 0; i < 2; i++ {
+		p := <-pubs
+		assert.Equal(t, "grpc.orders.OrderService.Get", p.subject)
+		var msg mirror.Message
+		require.NoError(t, json.Unmarshal(p.data, &msg))
+		assert.Equal(t, *msgs[i], msg)
+	}
+	assert.Equal(t, "PONG", <-pongs, "pings of the server are answered")
+
+	big := &mirror.Message{Method: "/a.A/B", Payload: make([]byte, 2048)}
+	assert.Error(t, pub.Publish(context.Background(), []*mirror.Message{msgs[0], big, msgs[1]}), "limited to the maximum payload of the server")
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, "grpc.orders.OrderService.Get", (<-pubs).subject, "the rest of the batch is published")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	require.NoError(t, pub.Publish(ctx, msgs[:1]))
+	cancel()
+	<-pubs
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, pub.Publish(context.Background(), msgs[:1]), "the deadline of an earlier publish does not apply")
+	assert.Equal(t, "grpc.orders.OrderService.Get", (<-pubs).subject)
+}
+
+func TestNATSPublisher_Unauthorized(t *testing.T) {
+	addr, _, _ := startNATS(t, "s3cret")
+	pub := mirror.NewNATSPublisher(addr, "grpc")
+	defer pub.Close()
+
+	err := pub.Publish(context.Background(), []*mirror.Message{{Method: "/a.A/B"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Authorization Violation")
+}
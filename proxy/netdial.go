@@ -0,0 +1,95 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// TCPDialConfig configures the TCP connections to a backend, for routing
+// egress over specific networks of multi-homed hosts, see
+// BackendConfig.TCP.
+type TCPDialConfig struct {
+	// Dialer, if set, is the base dialer, for its timeout, keepalive and
+	// control function. Its LocalAddr is replaced if LocalAddr is set.
+	Dialer *net.Dialer
+
+	// LocalAddr is the source IP address of the connections, optionally with
+	// a port, such as "10.1.0.5" or "[fd00::5]:0".
+	LocalAddr string
+
+	// Interface binds the connections to the named network interface, so
+	// that they leave through it whatever the routing table says. Linux
+	// only.
+	Interface string
+
+	// DSCP marks the packets with a Differentiated Services code point,
+	// from 0 (the default) to 63.
+	DSCP int
+
+	// Mark sets the firewall mark of the connections, SO_MARK, for policy
+	// routing. Linux only, and needs CAP_NET_ADMIN.
+	Mark int
+}
+
+// DialContext opens a TCP connection to address.
+func (c *TCPDialConfig) DialContext(ctx context.Context, address string) (net.Conn, error) {
+	d, err := c.dialer()
+	if err != nil {
+		return nil, err
+	}
+	return d.DialContext(ctx, "tcp", address)
+}
+
+func (c *TCPDialConfig) dialer() (*net.Dialer, error) {
+	var d net.Dialer
+	if c.Dialer != nil {
+		d = *c.Dialer
+	}
+	if c.LocalAddr != "" {
+		addr, err := parseLocalAddr(c.LocalAddr)
+		if err != nil {
+			return nil, err
+		}
+		d.LocalAddr = addr
+	}
+	if c.DSCP < 0 || c.DSCP > 63 {
+		return nil, fmt.Errorf("proxy: DSCP %d is out of range", c.DSCP)
+	}
+	if c.Interface == "" && c.DSCP == 0 && c.Mark == 0 {
+		return &d, nil
+	}
+	control := d.Control
+	d.Control = func(network, address string, raw syscall.RawConn) error {
+		if control != nil {
+			if err := control(network, address, raw); err != nil {
+				return err
+			}
+		}
+		var sockErr error
+		err := raw.Control(func(fd uintptr) {
+			sockErr = c.setSockopts(network, fd)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+	return &d, nil
+}
+
+func parseLocalAddr(s string) (*net.TCPAddr, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return &net.TCPAddr{IP: ip}, nil
+	}
+	addr, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: invalid local address %q: %v", s, err)
+	}
+	return addr, nil
+}
@@ -0,0 +1,38 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+func (c *TCPDialConfig) setSockopts(network string, fd uintptr) error {
+	s := int(fd)
+	if c.Interface != "" {
+		if err := syscall.BindToDevice(s, c.Interface); err != nil {
+			return fmt.Errorf("proxy: binding to interface %s: %v", c.Interface, err)
+		}
+	}
+	if c.DSCP != 0 {
+		tos := c.DSCP << 2
+		var err error
+		if strings.HasSuffix(network, "6") {
+			err = syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+		} else {
+			err = syscall.SetsockoptInt(s, syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+		}
+		if err != nil {
+			return fmt.Errorf("proxy: setting DSCP %d: %v", c.DSCP, err)
+		}
+	}
+	if c.Mark != 0 {
+		if err := syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_MARK, c.Mark); err != nil {
+			return fmt.Errorf("proxy: setting mark %d: %v", c.Mark, err)
+		}
+	}
+	return nil
+}
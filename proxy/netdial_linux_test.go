@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func sockopt(t *testing.T, conn net.Conn, level, opt int) int {
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	require.NoError(t, err)
+	var v int
+	var sockErr error
+	require.NoError(t, raw.Control(func(fd uintptr) {
+		v, sockErr = syscall.GetsockoptInt(int(fd), level, opt)
+	}))
+	require.NoError(t, sockErr)
+	return v
+}
+
+func TestTCPDialConfig_Sockopts(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := (&TCPDialConfig{DSCP: 46}).DialContext(ctx, lis.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, 46<<2, sockopt(t, conn, syscall.IPPROTO_IP, syscall.IP_TOS))
+
+	conn, err = (&TCPDialConfig{Mark: 7}).DialContext(ctx, lis.Addr().String())
+	if err != nil {
+		t.Skipf("setting marks needs CAP_NET_ADMIN: %v", err)
+	}
+	defer conn.Close()
+	assert.Equal(t, 7, sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_MARK))
+}
+
+type peerService struct {
+	pb.TestServiceServer
+}
+
+func (peerService) Ping(ctx context.Context, _ *pb.PingRequest) (*pb.PingResponse, error) {
+	p, _ := peer.FromContext(ctx)
+	return &pb.PingResponse{Value: AddrIP(p.Addr)}, nil
+}
+
+func TestBackendConfig_TCP(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	pb.RegisterTestServiceServer(server, peerService{})
+	go server.Serve(lis)
+	defer server.Stop()
+
+	// Any address of 127.0.0.0/8 is local on Linux.
+	cfg := BackendConfig{Address: lis.Addr().String(), TCP: &TCPDialConfig{LocalAddr: "127.0.0.2"}}
+	conn, err := cfg.Dial()
+	require.NoError(t, err)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := pb.NewTestServiceClient(conn).Ping(ctx, &pb.PingRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.2", resp.Value)
+}
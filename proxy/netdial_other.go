@@ -0,0 +1,14 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import "errors"
+
+func (c *TCPDialConfig) setSockopts(network string, fd uintptr) error {
+	return errors.New("proxy: interface binding, DSCP and marks are only supported on Linux")
+}
@@ -0,0 +1,38 @@
+package proxy_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTCPDialConfig(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		if conn, err := lis.Accept(); err == nil {
+			accepted <- conn.RemoteAddr()
+			conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cfg := &proxy.TCPDialConfig{Dialer: &net.Dialer{Timeout: time.Second}, LocalAddr: "127.0.0.1"}
+	conn, err := cfg.DialContext(ctx, lis.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "127.0.0.1", proxy.AddrIP(<-accepted), "connections come from LocalAddr")
+
+	_, err = (&proxy.TCPDialConfig{LocalAddr: "nowhere:x"}).DialContext(ctx, lis.Addr().String())
+	assert.Error(t, err)
+	_, err = (&proxy.TCPDialConfig{DSCP: 64}).DialContext(ctx, lis.Addr().String())
+	assert.Error(t, err, "DSCP has 6 bits")
+}
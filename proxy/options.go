@@ -0,0 +1,79 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/status"
+)
+
+// Option configures the behavior of a proxy handler created by
+// TransparentHandler or RegisterServiceWithOptions.
+type Option func(*options)
+
+// options holds the configuration shared by all streams of a handler.
+type options struct {
+	retry         *RetryPolicy
+	shadowTimeout time.Duration
+	transformers  []FrameTransformer
+	metrics       *metrics
+	tracing       *tracing
+	drainer       *Drainer
+	tracker       *StreamTracker
+	limiter       *concurrencyLimiter
+	breakers      *CircuitBreakers
+	deadlines     *DeadlinePolicy
+	maxRecvSize   int
+	maxSendSize   int
+	accessLog     AccessLogger
+	headerHooks   []MetadataHook
+	trailerHooks  []MetadataHook
+	requestRules  []MetadataRules
+	responseRules []MetadataRules
+	hedging       map[string]*HedgingPolicy
+	rateLimits    []*RateLimit
+	authenticator Authenticator
+	compression   *CompressionPolicy
+	clientCert    *ClientCertPolicy
+	caches        map[string]*CachePolicy
+	coalescers    map[string]*coalescer
+	flow          flowControls
+	errorMappers  []ErrorMapper
+	statusHooks   []StatusHook
+	forwarding    *ForwardingPolicy
+	acl           *ACL
+	tunnels       map[string]TunnelDialer
+	faults        *FaultInjector
+	idleTimeout   time.Duration
+	idleStatus    *status.Status
+	streamLimits  *StreamLimits
+	halfClose     *HalfClosePolicy
+	logger        Logger
+	panicHandler  func(ctx context.Context, p *Panic)
+	leaks         *LeakDetector
+	priority      *PriorityPolicy
+	adaptive      *AdaptiveLimiter
+	quotas        *QuotaPolicy
+
+	methodPolicies map[string]*MethodPolicy
+	metadataLimits MetadataLimits
+	via            *ViaPolicy
+	allowedMethods []string
+}
+
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	o.logger = loggerOrDefault(o.logger)
+	if o.tracing != nil && o.tracing.tracer == nil {
+		// A propagator alone does not enable tracing.
+		o.tracing = nil
+	}
+	return o
+}
@@ -0,0 +1,272 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// OutlierConfig configures outlier detection, see NewOutlierBalancer. At
+// least one of ConsecutiveFailures, ErrorRate or MaxLatency must be set for
+// an endpoint to ever be ejected.
+type OutlierConfig struct {
+	// ConsecutiveFailures ejects an endpoint after this many failed calls
+	// in a row.
+	ConsecutiveFailures int
+
+	// ErrorRate ejects an endpoint when the ratio of failed calls within an
+	// Interval exceeds it, once at least MinRequests calls were seen.
+	ErrorRate   float64
+	MinRequests int
+
+	// MaxLatency ejects an endpoint when the mean duration of its calls
+	// within an Interval exceeds it, once at least MinRequests calls were
+	// seen. The duration of a call is the whole stream, so this suits
+	// unary methods.
+	MaxLatency time.Duration
+
+	// Interval is the period over which error rates and latencies are
+	// computed. Defaults to 10 seconds.
+	Interval time.Duration
+
+	// BaseEjectionTime is how long an endpoint is ejected for the first
+	// time. Each further ejection adds BaseEjectionTime, up to
+	// MaxEjectionTime, and every Interval without ejection takes one back.
+	// Defaults are 30 seconds and 5 minutes.
+	BaseEjectionTime time.Duration
+	MaxEjectionTime  time.Duration
+
+	// MaxEjectionPercent limits the share of endpoints ejected at once.
+	// Defaults to 50.
+	MaxEjectionPercent int
+
+	// SlowStart, if set, ramps the weight of a reinstated endpoint up from
+	// its minimum over this duration. Only weighted balancers are affected.
+	SlowStart time.Duration
+
+	// IsFailure classifies the result of a call. By default
+	// codes.Unavailable, codes.DeadlineExceeded and codes.Internal are
+	// failures.
+	IsFailure func(err error) bool
+}
+
+// NewOutlierBalancer returns a Balancer which picks endpoints with b, but
+// temporarily removes endpoints which fail or respond slowly from its
+// rotation.
+//
+// Results are only seen for calls whose done function is called, as it is
+// by Router.
+func NewOutlierBalancer(b Balancer, cfg OutlierConfig) Balancer {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Second
+	}
+	if cfg.BaseEjectionTime <= 0 {
+		cfg.BaseEjectionTime = 30 * time.Second
+	}
+	if cfg.MaxEjectionTime <= 0 {
+		cfg.MaxEjectionTime = 5 * time.Minute
+	}
+	if cfg.MaxEjectionPercent <= 0 {
+		cfg.MaxEjectionPercent = 50
+	}
+	if cfg.IsFailure == nil {
+		cfg.IsFailure = isBackendFailure
+	}
+	return &outlierBalancer{inner: b, cfg: cfg, stats: make(map[*grpc.ClientConn]*endpointStats)}
+}
+
+type outlierBalancer struct {
+	inner Balancer
+	cfg   OutlierConfig
+
+	mu        sync.Mutex
+	endpoints []Endpoint
+	stats     map[*grpc.ClientConn]*endpointStats
+	nextEval  time.Time
+	ramping   bool
+}
+
+type endpointStats struct {
+	consecutive int
+	calls       int
+	failures    int
+	latency     time.Duration
+
+	ejections    int
+	ejectedUntil time.Time
+	reinstated   time.Time
+}
+
+func (s *endpointStats) ejected(now time.Time) bool {
+	return now.Before(s.ejectedUntil)
+}
+
+func (b *outlierBalancer) Pick(ctx context.Context, method string) (*grpc.ClientConn, func(error), error) {
+	b.mu.Lock()
+	now := time.Now()
+	if !now.Before(b.nextEval) {
+		b.evaluate(now)
+	}
+	b.mu.Unlock()
+
+	conn, done, err := b.inner.Pick(ctx, method)
+	if err != nil {
+		return nil, nil, err
+	}
+	start := time.Now()
+	var once sync.Once
+	return conn, func(err error) {
+		once.Do(func() {
+			if done != nil {
+				done(err)
+			}
+			b.record(conn, err, time.Since(start))
+		})
+	}, nil
+}
+
+func (b *outlierBalancer) Update(endpoints []Endpoint) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.endpoints = append([]Endpoint(nil), endpoints...)
+	stats := make(map[*grpc.ClientConn]*endpointStats, len(endpoints))
+	for _, ep := range endpoints {
+		if s, ok := b.stats[ep.Conn]; ok {
+			stats[ep.Conn] = s
+		} else {
+			stats[ep.Conn] = &endpointStats{}
+		}
+	}
+	b.stats = stats
+	b.push(time.Now())
+}
+
+func (b *outlierBalancer) record(conn *grpc.ClientConn, err error, latency time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.stats[conn]
+	if !ok {
+		return
+	}
+	s.calls++
+	s.latency += latency
+	if !b.cfg.IsFailure(err) {
+		s.consecutive = 0
+		return
+	}
+	s.failures++
+	s.consecutive++
+	now := time.Now()
+	if b.cfg.ConsecutiveFailures > 0 && s.consecutive >= b.cfg.ConsecutiveFailures && !s.ejected(now) {
+		if b.eject(s, now) {
+			b.push(now)
+		}
+	}
+}
+
+// evaluate checks the error rates and latencies of the last interval, and
+// reinstates endpoints whose ejection is over.
+func (b *outlierBalancer) evaluate(now time.Time) {
+	b.nextEval = now.Add(b.cfg.Interval)
+	changed := b.ramping
+	for _, s := range b.stats {
+		if !s.ejectedUntil.IsZero() && !s.ejected(now) {
+			s.ejectedUntil = time.Time{}
+			s.reinstated = now
+			changed = true
+		}
+		if s.ejected(now) {
+			continue
+		}
+		if s.calls >= b.cfg.MinRequests && s.calls > 0 {
+			rate := float64(s.failures) / float64(s.calls)
+			mean := s.latency / time.Duration(s.calls)
+			if (b.cfg.ErrorRate > 0 && rate > b.cfg.ErrorRate) || (b.cfg.MaxLatency > 0 && mean > b.cfg.MaxLatency) {
+				if b.eject(s, now) {
+					changed = true
+					continue
+				}
+			}
+		}
+		if s.ejections > 0 && now.Sub(s.reinstated) >= b.cfg.Interval {
+			s.ejections--
+		}
+		s.calls, s.failures, s.latency = 0, 0, 0
+	}
+	if changed {
+		b.push(now)
+	}
+}
+
+// eject removes an endpoint from the rotation, unless too many are ejected
+// already. It reports whether the endpoint was ejected.
+func (b *outlierBalancer) eject(s *endpointStats, now time.Time) bool {
+	ejected := 0
+	for _, other := range b.stats {
+		if other.ejected(now) {
+			ejected++
+		}
+	}
+	if (ejected+1)*100 > len(b.stats)*b.cfg.MaxEjectionPercent {
+		return false
+	}
+	s.ejections++
+	d := time.Duration(s.ejections) * b.cfg.BaseEjectionTime
+	if d > b.cfg.MaxEjectionTime {
+		d = b.cfg.MaxEjectionTime
+	}
+	s.ejectedUntil = now.Add(d)
+	s.consecutive, s.calls, s.failures, s.latency = 0, 0, 0, 0
+	if b.nextEval.After(s.ejectedUntil) {
+		b.nextEval = s.ejectedUntil
+	}
+	return true
+}
+
+// push updates the inner balancer with the endpoints in rotation.
+func (b *outlierBalancer) push(now time.Time) {
+	b.ramping = false
+	endpoints := make([]Endpoint, 0, len(b.endpoints))
+	for _, ep := range b.endpoints {
+		s := b.stats[ep.Conn]
+		if s.ejected(now) {
+			continue
+		}
+		if b.cfg.SlowStart > 0 && !s.reinstated.IsZero() {
+			if since := now.Sub(s.reinstated); since < b.cfg.SlowStart {
+				ep.Weight = int(float64(ep.weight()) * float64(since) / float64(b.cfg.SlowStart))
+				b.ramping = true
+			}
+		}
+		endpoints = append(endpoints, ep)
+	}
+	if step := now.Add(b.cfg.SlowStart / 10); b.ramping && b.nextEval.After(step) {
+		b.nextEval = step
+	}
+	b.inner.Update(endpoints)
+}
+
+func (b *outlierBalancer) Status() []EndpointStatus {
+	active := make(map[*grpc.ClientConn]int)
+	if r, ok := b.inner.(StatusReporter); ok {
+		for _, s := range r.Status() {
+			active[s.conn] = s.Active
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	status := make([]EndpointStatus, len(b.endpoints))
+	for i, ep := range b.endpoints {
+		status[i] = endpointStatus(ep)
+		status[i].Active = active[ep.Conn]
+		status[i].Ejected = b.stats[ep.Conn].ejected(now)
+	}
+	return status
+}
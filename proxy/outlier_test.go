@@ -0,0 +1,91 @@
+package proxy_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func dialEndpoints(t *testing.T, n int) ([]proxy.Endpoint, func()) {
+	var eps []proxy.Endpoint
+	for i := 0; i < n; i++ {
+		conn, err := grpc.Dial("127.0.0.1:1", grpc.WithInsecure())
+		require.NoError(t, err)
+		eps = append(eps, proxy.Endpoint{Conn: conn})
+	}
+	return eps, func() {
+		for _, ep := range eps {
+			ep.Conn.Close()
+		}
+	}
+}
+
+// pickResults picks n times, failing calls to bad, and returns how often
+// each connection was picked.
+func pickResults(t *testing.T, b proxy.Balancer, n int, bad *grpc.ClientConn) map[*grpc.ClientConn]int {
+	counts := make(map[*grpc.ClientConn]int)
+	for i := 0; i < n; i++ {
+		conn, done, err := b.Pick(context.Background(), "/svc/Method")
+		require.NoError(t, err)
+		counts[conn]++
+		if conn == bad {
+			done(status.Error(codes.Unavailable, "down"))
+		} else {
+			done(nil)
+		}
+	}
+	return counts
+}
+
+func TestOutlierBalancer_ConsecutiveFailures(t *testing.T) {
+	eps, closeAll := dialEndpoints(t, 3)
+	defer closeAll()
+	b := proxy.NewOutlierBalancer(proxy.NewRoundRobinBalancer(), proxy.OutlierConfig{
+		ConsecutiveFailures: 2,
+		BaseEjectionTime:    50 * time.Millisecond,
+	})
+	b.Update(eps)
+	bad := eps[1].Conn
+
+	counts := pickResults(t, b, 30, bad)
+	assert.Equal(t, 2, counts[bad], "endpoint is ejected after two failures")
+
+	time.Sleep(60 * time.Millisecond)
+	counts = pickResults(t, b, 3, nil)
+	assert.Equal(t, 1, counts[bad], "endpoint is reinstated after the ejection time")
+}
+
+func TestOutlierBalancer_ErrorRate(t *testing.T) {
+	eps, closeAll := dialEndpoints(t, 2)
+	defer closeAll()
+	b := proxy.NewOutlierBalancer(proxy.NewRoundRobinBalancer(), proxy.OutlierConfig{
+		ErrorRate:        0.5,
+		MinRequests:      5,
+		Interval:         20 * time.Millisecond,
+		BaseEjectionTime: time.Minute,
+	})
+	b.Update(eps)
+	bad := eps[0].Conn
+
+	pickResults(t, b, 20, bad)
+	time.Sleep(30 * time.Millisecond)
+	counts := pickResults(t, b, 10, nil)
+	assert.Equal(t, 0, counts[bad], "endpoint above the error rate is ejected")
+}
+
+func TestOutlierBalancer_MaxEjectionPercent(t *testing.T) {
+	eps, closeAll := dialEndpoints(t, 1)
+	defer closeAll()
+	b := proxy.NewOutlierBalancer(proxy.NewRoundRobinBalancer(), proxy.OutlierConfig{ConsecutiveFailures: 1})
+	b.Update(eps)
+
+	counts := pickResults(t, b, 5, eps[0].Conn)
+	assert.Equal(t, 5, counts[eps[0].Conn], "the only endpoint is never ejected")
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Panic is a panic recovered by the handler. Panics of the director, of the
+// goroutines copying messages and of the rest of the handler fail the stream
+// with codes.Internal instead of crashing the process. They are logged as
+// errors, see WithLogger and WithPanicHandler.
+type Panic struct {
+	// Method is the full method name of the stream.
+	Method string
+
+	// Where is "director", "client to backend", "backend to client" or
+	// "handler".
+	Where string
+
+	// Value is the value passed to panic.
+	Value interface{}
+
+	// Stack is the stack trace of the panicking goroutine.
+	Stack []byte
+}
+
+// WithPanicHandler calls f for every panic recovered by the handler, such as
+// to report it to an error tracker. The stream has failed with
+// codes.Internal by then. The panic is also logged.
+func WithPanicHandler(f func(ctx context.Context, p *Panic)) Option {
+	return func(o *options) {
+		o.panicHandler = f
+	}
+}
+
+const (
+	panicInDirector        = "director"
+	panicInClientToBackend = "client to backend"
+	panicInBackendToClient = "backend to client"
+	panicInHandler         = "handler"
+)
+
+// panicError is a recovered panic returned as an error. Clients only see
+// codes.Internal, not the value of the panic.
+type panicError struct {
+	where string
+	value interface{}
+	stack []byte
+}
+
+func newPanicError(where string, value interface{}) *panicError {
+	return &panicError{where: where, value: value, stack: debug.Stack()}
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic in %s: %v", e.where, e.value)
+}
+
+func (e *panicError) GRPCStatus() *status.Status {
+	return status.New(codes.Internal, "internal proxy error")
+}
+
+// recoverTo sends a recovered panic to errs. It must be deferred by the
+// goroutine, which would otherwise send its result to errs.
+func recoverTo(errs chan<- error, where string) {
+	if v := recover(); v != nil {
+		errs <- newPanicError(where, v)
+	}
+}
+
+// callDirector calls the director, returning its panic as an error.
+func (h *handler) callDirector(ctx context.Context, method string) (outCtx context.Context, cancel context.CancelFunc, dir Direction, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			outCtx, cancel, dir, err = ctx, nil, Direction{}, newPanicError(panicInDirector, v)
+		}
+	}()
+	return h.director(ctx, method)
+}
+
+// reportPanic logs a recovered panic and passes it to the panic handler.
+func (h *handler) reportPanic(ctx context.Context, method string, pe *panicError) {
+	h.opts.logger.Error("recovered panic", "method", method, "where", pe.where, "panic", pe.value, "stack", string(pe.stack))
+	if h.opts.panicHandler != nil {
+		h.opts.panicHandler(ctx, &Panic{Method: method, Where: pe.where, Value: pe.value, Stack: pe.stack})
+	}
+}
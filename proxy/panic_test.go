@@ -0,0 +1,111 @@
+package proxy_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// panicRecorder keeps the panics passed to WithPanicHandler.
+type panicRecorder struct {
+	mu     sync.Mutex
+	panics []*proxy.Panic
+}
+
+func (r *panicRecorder) handle(ctx context.Context, p *proxy.Panic) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.panics = append(r.panics, p)
+}
+
+func (r *panicRecorder) get() []*proxy.Panic {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*proxy.Panic(nil), r.panics...)
+}
+
+func TestPanicRecovery_Director(t *testing.T) {
+	rec := &panicRecorder{}
+	logs := &logRecorder{}
+	env := newTestEnvWithDirector(t, &pingService{}, func(backend *grpc.ClientConn) proxy.StreamDirector {
+		return func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+			if method == "/vgough.testproto.TestService/PingEmpty" {
+				var dir *proxy.Direction
+				return ctx, nil, *dir, nil
+			}
+			return ctx, nil, proxy.Direction{BackendConn: backend}, nil
+		}
+	}, proxy.WithPanicHandler(rec.handle), proxy.WithLogger(logs.logger()))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	_, err := env.client.PingEmpty(ctx, &pb.Empty{})
+	assert.Equal(t, status.Error(codes.Internal, "internal proxy error"), err, "the panic is not shown to clients")
+	_, err = env.client.Ping(ctx, &pb.PingRequest{Value: "still here"})
+	require.NoError(t, err, "the proxy keeps serving")
+
+	panics := rec.get()
+	require.Len(t, panics, 1)
+	p := panics[0]
+	assert.Equal(t, "/vgough.testproto.TestService/PingEmpty", p.Method)
+	assert.Equal(t, "director", p.Where)
+	assert.Contains(t, p.Value.(error).Error(), "nil pointer dereference")
+	assert.Contains(t, string(p.Stack), "panic_test.go", "the stack is that of the panic")
+
+	records := logs.get()
+	require.Len(t, records, 1)
+	assert.Equal(t, proxy.LevelError, records[0].level)
+	assert.Equal(t, "recovered panic", records[0].msg)
+}
+
+func TestPanicRecovery_Copy(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		dir   proxy.FrameDirection
+		where string
+		flow  *proxy.FlowControl
+	}{
+		{"client to backend", proxy.ClientToBackend, "client to backend", nil},
+		{"backend to client", proxy.BackendToClient, "backend to client", nil},
+		{"buffered client to backend", proxy.ClientToBackend, "client to backend", &proxy.FlowControl{Buffer: 4}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := &panicRecorder{}
+			opts := []proxy.Option{
+				proxy.WithPanicHandler(rec.handle),
+				proxy.WithLogger(proxy.NewFuncLogger(func(proxy.Level, string, ...interface{}) {})),
+				proxy.WithStreamInterceptor(func(ctx context.Context, method string, dir proxy.FrameDirection, payload []byte) ([]byte, error) {
+					if dir == tc.dir {
+						panic("buggy interceptor")
+					}
+					return payload, nil
+				}),
+			}
+			if tc.flow != nil {
+				opts = append(opts, proxy.WithFlowControl(tc.dir, *tc.flow))
+			}
+			env := newTestEnv(t, &pingService{}, opts...)
+			defer env.Close()
+			ctx, cancel := env.ctx()
+			defer cancel()
+
+			_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "boom"})
+			assert.Equal(t, codes.Internal, status.Code(err))
+
+			panics := rec.get()
+			require.Len(t, panics, 1)
+			assert.Equal(t, tc.where, panics[0].Where)
+			assert.Equal(t, "buggy interceptor", panics[0].Value)
+		})
+	}
+}
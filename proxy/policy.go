@@ -0,0 +1,145 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// MethodPolicy holds the proxy policy of a set of methods, see
+// WithMethodPolicy. Unset fields fall back to the handler options.
+type MethodPolicy struct {
+	// Deny rejects calls with codes.PermissionDenied before the director is
+	// invoked. Denying the empty prefix and adding policies for allowed
+	// prefixes gives an allow list.
+	Deny bool
+
+	// Deadlines replaces the policy of WithDeadlinePolicy.
+	Deadlines *DeadlinePolicy
+
+	// Retry replaces the policy of WithRetry. If its Methods are not set,
+	// it retries the methods of the policy prefix, which must then only
+	// match unary and server-streaming methods.
+	Retry *RetryPolicy
+
+	// MaxRecvSize and MaxSendSize replace the limits of WithMaxRecvSize
+	// and WithMaxSendSize. Directions still take precedence. Negative
+	// values remove the limit.
+	MaxRecvSize int
+	MaxSendSize int
+
+	// RateLimits are checked in addition to those of WithRateLimit.
+	RateLimits []RateLimit
+
+	// StreamLimits replaces the limits of WithStreamLimits.
+	StreamLimits *StreamLimits
+}
+
+// WithMethodPolicy sets the policy of methods whose full method name starts
+// with prefix, such as "/pkg.Service/Method" or "/pkg.Service/". An empty
+// prefix matches every method. When several prefixes match, the longest
+// wins, policies are not merged.
+func WithMethodPolicy(prefix string, p MethodPolicy) Option {
+	return func(o *options) {
+		if o.methodPolicies == nil {
+			o.methodPolicies = make(map[string]*MethodPolicy)
+		}
+		if p.Retry != nil && len(p.Retry.Methods) == 0 {
+			retry := *p.Retry
+			retry.Methods = []string{prefix}
+			p.Retry = &retry
+		}
+		o.methodPolicies[prefix] = &p
+	}
+}
+
+// WithAllowedMethods rejects calls to methods which start with none of the
+// prefixes with codes.PermissionDenied, before anything else is done for
+// them, such as tunnels, fault injection and the director.
+func WithAllowedMethods(prefixes ...string) Option {
+	return func(o *options) {
+		o.allowedMethods = append([]string(nil), prefixes...)
+	}
+}
+
+// methodAllowed reports whether method may be called under
+// WithAllowedMethods.
+func (o *options) methodAllowed(method string) bool {
+	if o.allowedMethods == nil {
+		return true
+	}
+	for _, prefix := range o.allowedMethods {
+		if strings.HasPrefix(method, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// methodPolicy returns the policy for method, or nil.
+func (o *options) methodPolicy(method string) *MethodPolicy {
+	var best *MethodPolicy
+	bestLen := -1
+	for prefix, p := range o.methodPolicies {
+		if len(prefix) > bestLen && strings.HasPrefix(method, prefix) {
+			best, bestLen = p, len(prefix)
+		}
+	}
+	return best
+}
+
+// callPolicy is the effective policy of a single stream.
+type callPolicy struct {
+	deadlines   *DeadlinePolicy
+	retry       *RetryPolicy
+	maxRecvSize int
+	maxSendSize int
+	rateLimits  []*RateLimit
+	limits      *StreamLimits
+}
+
+// callPolicy resolves the policy of a stream to method.
+func (h *handler) callPolicy(method string) (*callPolicy, error) {
+	if !h.opts.methodAllowed(method) {
+		return nil, status.Errorf(codes.PermissionDenied, "method %s is not allowed on this listener", method)
+	}
+	cp := &callPolicy{
+		deadlines:   h.opts.deadlines,
+		retry:       h.opts.retry,
+		maxRecvSize: h.opts.maxRecvSize,
+		maxSendSize: h.opts.maxSendSize,
+		rateLimits:  h.opts.rateLimits,
+		limits:      h.opts.streamLimits,
+	}
+	p := h.opts.methodPolicy(method)
+	if p == nil {
+		return cp, nil
+	}
+	if p.Deny {
+		return nil, status.Errorf(codes.PermissionDenied, "method %s is not allowed", method)
+	}
+	if p.Deadlines != nil {
+		cp.deadlines = p.Deadlines
+	}
+	if p.Retry != nil {
+		cp.retry = p.Retry
+	}
+	if p.StreamLimits != nil {
+		cp.limits = p.StreamLimits
+	}
+	cp.maxRecvSize = pickLimit(p.MaxRecvSize, cp.maxRecvSize)
+	cp.maxSendSize = pickLimit(p.MaxSendSize, cp.maxSendSize)
+	if len(p.RateLimits) != 0 {
+		limits := append([]*RateLimit(nil), cp.rateLimits...)
+		for i := range p.RateLimits {
+			limits = append(limits, &p.RateLimits[i])
+		}
+		cp.rateLimits = limits
+	}
+	return cp, nil
+}
@@ -0,0 +1,80 @@
+package proxy_test
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestMethodPolicy_AllowList(t *testing.T) {
+	env := newTestEnv(t, &pingService{},
+		proxy.WithMethodPolicy("", proxy.MethodPolicy{Deny: true}),
+		proxy.WithMethodPolicy("/vgough.testproto.TestService/PingEmpty", proxy.MethodPolicy{}),
+	)
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	_, err := env.client.PingEmpty(ctx, &pb.Empty{})
+	assert.NoError(t, err)
+	_, err = env.client.Ping(ctx, &pb.PingRequest{Value: "denied"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestMethodPolicy_Overrides(t *testing.T) {
+	svc := &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			if ping.Value == "slow" {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			return &pb.PingResponse{Value: ping.Value}, nil
+		},
+	}
+	env := newTestEnv(t, svc,
+		proxy.WithMaxRecvSize(16),
+		proxy.WithMethodPolicy("/vgough.testproto.TestService/Ping", proxy.MethodPolicy{
+			Deadlines: &proxy.DeadlinePolicy{MaxTimeout: 50 * time.Millisecond},
+		}),
+		proxy.WithMethodPolicy("/vgough.testproto.TestService/PingError", proxy.MethodPolicy{MaxRecvSize: -1}),
+	)
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	big := strings.Repeat("x", 100)
+	_, err := env.client.PingError(ctx, &pb.PingRequest{Value: big})
+	assert.NoError(t, err, "the method policy removes the size limit")
+	_, err = env.client.Ping(ctx, &pb.PingRequest{Value: big})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "unset policy fields fall back to the options")
+
+	_, err = env.client.Ping(ctx, &pb.PingRequest{Value: "slow"})
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+}
+
+func TestMethodPolicy_Retry(t *testing.T) {
+	var calls int32
+	env := newTestEnv(t, flakyService(1, codes.Unavailable, &calls),
+		proxy.WithMethodPolicy("/vgough.testproto.TestService/Ping", proxy.MethodPolicy{
+			Retry: &proxy.RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond},
+		}),
+	)
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	out, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err, "the retry applies to the methods of the policy")
+	assert.Equal(t, "foo", out.Value)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+}
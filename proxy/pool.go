@@ -0,0 +1,132 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// AddressPool keeps the endpoints of a Balancer in sync with a changing set
+// of addresses, as reported by service discovery. Each address is dialed
+// once, and its connection is closed when the address is removed.
+type AddressPool struct {
+	// Dial connects to an address. If nil, addresses are dialed with
+	// Config, with the proxy codec.
+	Dial func(address string) (*grpc.ClientConn, error)
+
+	// Config configures the connections of the pool, such as keepalive
+	// and reconnect backoff. Its Address is replaced by those of the pool.
+	// MaxConnectionAge applies to connections from Dial as well.
+	Config BackendConfig
+
+	balancer Balancer
+
+	mu      sync.Mutex
+	conns   map[string]*pooledConn
+	weights map[string]int
+}
+
+// pooledConn is a connection of an AddressPool.
+type pooledConn struct {
+	conn *grpc.ClientConn
+	// timer replaces the connection at its maximum age.
+	timer *time.Timer
+}
+
+// NewAddressPool returns an AddressPool updating b.
+func NewAddressPool(b Balancer) *AddressPool {
+	return &AddressPool{balancer: b, conns: make(map[string]*pooledConn)}
+}
+
+// Update sets the addresses of the pool, mapped to their endpoint weights.
+// Addresses which fail to dial are left out.
+func (p *AddressPool) Update(weights map[string]int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	next := make(map[string]*pooledConn, len(weights))
+	for addr := range weights {
+		pc, ok := p.conns[addr]
+		if !ok {
+			conn, err := p.dial(addr)
+			if err != nil {
+				continue
+			}
+			pc = p.add(addr, conn)
+		}
+		next[addr] = pc
+	}
+	old := p.conns
+	p.conns, p.weights = next, weights
+	p.push()
+	for addr, pc := range old {
+		if _, ok := next[addr]; !ok {
+			if pc.timer != nil {
+				pc.timer.Stop()
+			}
+			pc.conn.Close()
+		}
+	}
+}
+
+// add wraps a new connection to addr, scheduling its replacement.
+func (p *AddressPool) add(addr string, conn *grpc.ClientConn) *pooledConn {
+	pc := &pooledConn{conn: conn}
+	if age := p.Config.connectionAge(); age > 0 {
+		pc.timer = time.AfterFunc(age, func() { p.replace(addr, pc) })
+	}
+	return pc
+}
+
+// replace dials a new connection to addr in place of pc, which is retired.
+func (p *AddressPool) replace(addr string, pc *pooledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conns[addr] != pc {
+		return
+	}
+	conn, err := p.dial(addr)
+	if err != nil {
+		// Keep the old connection and try again later.
+		pc.timer.Reset(p.Config.connectionAge())
+		return
+	}
+	p.conns[addr] = p.add(addr, conn)
+	p.push()
+	p.Config.retire(pc.conn)
+}
+
+// push updates the balancer with the connections of the pool, ordered by
+// address.
+func (p *AddressPool) push() {
+	addrs := make([]string, 0, len(p.conns))
+	for addr := range p.conns {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	endpoints := make([]Endpoint, 0, len(addrs))
+	for _, addr := range addrs {
+		endpoints = append(endpoints, Endpoint{Conn: p.conns[addr].conn, Weight: p.weights[addr]})
+	}
+	p.balancer.Update(endpoints)
+}
+
+func (p *AddressPool) dial(addr string) (*grpc.ClientConn, error) {
+	if p.Dial != nil {
+		return p.Dial(addr)
+	}
+	cfg := p.Config
+	cfg.Address = addr
+	return cfg.Dial()
+}
+
+// Close removes all endpoints from the balancer and closes their
+// connections.
+func (p *AddressPool) Close() {
+	p.Update(nil)
+}
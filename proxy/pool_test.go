@@ -0,0 +1,74 @@
+package proxy_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/connectivity"
+)
+
+// endpointRecorder records the endpoints it is updated with.
+type endpointRecorder struct {
+	proxy.Balancer
+	mu        sync.Mutex
+	endpoints []proxy.Endpoint
+}
+
+func (b *endpointRecorder) Update(endpoints []proxy.Endpoint) {
+	b.mu.Lock()
+	b.endpoints = endpoints
+	b.mu.Unlock()
+}
+
+func (b *endpointRecorder) current() []proxy.Endpoint {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.endpoints
+}
+
+func TestAddressPool(t *testing.T) {
+	b := &endpointRecorder{}
+	pool := proxy.NewAddressPool(b)
+	defer pool.Close()
+
+	pool.Update(map[string]int{"127.0.0.1:1": 1, "127.0.0.1:2": 3})
+	assert.Len(t, b.endpoints, 2)
+	assert.Equal(t, "127.0.0.1:2", b.endpoints[1].Conn.Target())
+	assert.Equal(t, 3, b.endpoints[1].Weight)
+	removed, kept := b.endpoints[0].Conn, b.endpoints[1].Conn
+
+	pool.Update(map[string]int{"127.0.0.1:2": 1})
+	assert.Len(t, b.endpoints, 1)
+	assert.True(t, b.endpoints[0].Conn == kept, "connections of remaining addresses are kept")
+	assert.Equal(t, connectivity.Shutdown, removed.GetState())
+	assert.NotEqual(t, connectivity.Shutdown, kept.GetState())
+
+	pool.Close()
+	assert.Empty(t, b.endpoints)
+	assert.Equal(t, connectivity.Shutdown, kept.GetState())
+}
+
+func TestAddressPool_MaxConnectionAge(t *testing.T) {
+	b := &endpointRecorder{}
+	pool := proxy.NewAddressPool(b)
+	pool.Config = proxy.BackendConfig{
+		MaxConnectionAge:      50 * time.Millisecond,
+		MaxConnectionAgeGrace: 50 * time.Millisecond,
+	}
+	defer pool.Close()
+
+	pool.Update(map[string]int{"127.0.0.1:1": 2})
+	first := b.current()[0].Conn
+	assert.Eventually(t, func() bool {
+		return b.current()[0].Conn != first
+	}, 5*time.Second, 10*time.Millisecond, "the connection is replaced")
+	next := b.current()[0]
+	assert.Equal(t, "127.0.0.1:1", next.Conn.Target())
+	assert.Equal(t, 2, next.Weight, "the weight is kept")
+	assert.Eventually(t, func() bool {
+		return first.GetState() == connectivity.Shutdown
+	}, 5*time.Second, 10*time.Millisecond, "the old connection is closed after the grace")
+}
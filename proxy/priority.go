@@ -0,0 +1,277 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"container/heap"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// defaultPriorityHold bounds how long a send holds its slot, see
+// PriorityPolicy.MaxHold.
+const defaultPriorityHold = 50 * time.Millisecond
+
+// PriorityClass is a class of streams sharing a weight.
+type PriorityClass struct {
+	Name string
+	// Weight is the share of the class in the messages sent to a backend
+	// connection while it applies backpressure. It defaults to 1.
+	Weight int
+}
+
+// PriorityPolicy prioritizes the messages which streams of different
+// classes send to a shared backend connection. The proxy sends at most
+// InFlight messages to a connection at a time; when the backend applies
+// flow control backpressure and messages queue up, they are sent by
+// weighted fair queueing: each class gets a share of the bytes sent in
+// proportion to its weight. Without backpressure, messages do not wait.
+//
+// Streams are classified by the Metadata key if set, by method prefix
+// otherwise, and fall back to Default.
+type PriorityPolicy struct {
+	Classes []PriorityClass
+
+	// Methods maps method prefixes to class names. The longest matching
+	// prefix wins.
+	Methods map[string]string
+
+	// Metadata, if set, is a metadata key whose value names the class of
+	// the stream. Unknown classes are ignored.
+	Metadata string
+
+	// Default is the class of streams which are not otherwise classified.
+	// If empty, they get a weight of 1.
+	Default string
+
+	// InFlight is the number of messages sent to a backend at the same
+	// time. Backends are told apart by the target of their connection. It
+	// defaults to 1.
+	InFlight int
+
+	// MaxHold is how long a blocked send holds its slot before the next
+	// message may go ahead, so that a stream which is stalled on its own
+	// flow control window does not hold up the others. It defaults to 50ms.
+	MaxHold time.Duration
+
+	mu         sync.Mutex
+	schedulers map[string]*sendScheduler
+}
+
+// WithPriority schedules the messages sent to backends as configured by p.
+func WithPriority(p *PriorityPolicy) Option {
+	return func(o *options) {
+		o.priority = p
+	}
+}
+
+// classify returns the class and weight of a stream.
+func (p *PriorityPolicy) classify(ctx context.Context, method string) (string, int) {
+	class := ""
+	if p.Metadata != "" {
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if v := md.Get(p.Metadata); len(v) != 0 && p.known(v[0]) {
+				class = v[0]
+			}
+		}
+	}
+	if class == "" {
+		best := -1
+		for prefix, c := range p.Methods {
+			if len(prefix) > best && strings.HasPrefix(method, prefix) {
+				best, class = len(prefix), c
+			}
+		}
+	}
+	if class == "" {
+		class = p.Default
+	}
+	for _, c := range p.Classes {
+		if c.Name == class && c.Weight > 0 {
+			return class, c.Weight
+		}
+	}
+	return class, 1
+}
+
+func (p *PriorityPolicy) known(class string) bool {
+	for _, c := range p.Classes {
+		if c.Name == class {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *PriorityPolicy) scheduler(target string) *sendScheduler {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.schedulers == nil {
+		p.schedulers = make(map[string]*sendScheduler)
+	}
+	s, ok := p.schedulers[target]
+	if !ok {
+		inFlight := p.InFlight
+		if inFlight <= 0 {
+			inFlight = 1
+		}
+		s = &sendScheduler{max: inFlight, finish: make(map[string]float64)}
+		p.schedulers[target] = s
+	}
+	return s
+}
+
+// wrap returns a ClientStream whose messages to the backend at target are
+// scheduled.
+func (p *PriorityPolicy) wrap(ctx context.Context, method string, target string, cs grpc.ClientStream) grpc.ClientStream {
+	class, weight := p.classify(ctx, method)
+	hold := p.MaxHold
+	if hold <= 0 {
+		hold = defaultPriorityHold
+	}
+	return &prioritizedClientStream{ClientStream: cs, sched: p.scheduler(target), class: class, weight: weight, hold: hold}
+}
+
+type prioritizedClientStream struct {
+	grpc.ClientStream
+	sched  *sendScheduler
+	class  string
+	weight int
+	hold   time.Duration
+}
+
+func (s *prioritizedClientStream) SendMsg(m interface{}) error {
+	size := 1
+	if f, ok := m.(*frame); ok && len(f.payload) > size {
+		size = len(f.payload)
+	}
+	release, err := s.sched.acquire(s.Context(), s.class, s.weight, size)
+	if err != nil {
+		return status.FromContextError(err).Err()
+	}
+	timer := time.AfterFunc(s.hold, release)
+	err = s.ClientStream.SendMsg(m)
+	timer.Stop()
+	release()
+	return err
+}
+
+// sendScheduler grants send slots of a backend connection by weighted fair
+// queueing. Every message gets a virtual finish time, its size divided by
+// the weight of its class after the previous message of the class, and
+// waiting messages are sent in order of finish time.
+type sendScheduler struct {
+	mu       sync.Mutex
+	max      int
+	inFlight int
+	vtime    float64
+	finish   map[string]float64
+	queue    sendQueue
+	seq      uint64
+}
+
+type sendWaiter struct {
+	start, finish float64
+	seq           uint64
+	ready         chan struct{}
+	index         int
+}
+
+// acquire waits for a send slot. The returned function releases it, and
+// may be called more than once.
+func (s *sendScheduler) acquire(ctx context.Context, class string, weight, size int) (func(), error) {
+	s.mu.Lock()
+	start := s.vtime
+	if f := s.finish[class]; f > start {
+		start = f
+	}
+	w := &sendWaiter{start: start, finish: start + float64(size)/float64(weight), seq: s.seq, ready: make(chan struct{})}
+	s.seq++
+	s.finish[class] = w.finish
+	if s.inFlight < s.max && s.queue.Len() == 0 {
+		s.inFlight++
+		s.vtime = w.start
+		s.mu.Unlock()
+		return s.releaser(), nil
+	}
+	heap.Push(&s.queue, w)
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return s.releaser(), nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if w.index < 0 {
+			// Granted while giving up, pass the slot on.
+			s.releaseLocked()
+		} else {
+			heap.Remove(&s.queue, w.index)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (s *sendScheduler) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.releaseLocked()
+		})
+	}
+}
+
+// releaseLocked hands a slot to the next waiter, or frees it.
+func (s *sendScheduler) releaseLocked() {
+	if s.queue.Len() == 0 {
+		s.inFlight--
+		return
+	}
+	w := heap.Pop(&s.queue).(*sendWaiter)
+	s.vtime = w.start
+	close(w.ready)
+}
+
+// sendQueue is a heap of waiters ordered by finish time, then arrival.
+type sendQueue []*sendWaiter
+
+func (q sendQueue) Len() int { return len(q) }
+
+func (q sendQueue) Less(i, j int) bool {
+	if q[i].finish != q[j].finish {
+		return q[i].finish < q[j].finish
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q sendQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *sendQueue) Push(x interface{}) {
+	w := x.(*sendWaiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *sendQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*q = old[:len(old)-1]
+	return w
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestSendScheduler_WeightedFairQueueing(t *testing.T) {
+	s := &sendScheduler{max: 1, finish: make(map[string]float64)}
+	hold, err := s.acquire(context.Background(), "", 1, 1)
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	queue := func(class string, weight int) {
+		wg.Add(1)
+		queued := s.queueLen()
+		go func() {
+			defer wg.Done()
+			release, err := s.acquire(context.Background(), class, weight, 100)
+			if !assert.NoError(t, err) {
+				return
+			}
+			mu.Lock()
+			order = append(order, class)
+			mu.Unlock()
+			release()
+		}()
+		// Queue in a known order.
+		for s.queueLen() == queued {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		queue("low", 1)
+	}
+	for i := 0; i < 4; i++ {
+		queue("high", 3)
+	}
+	hold()
+	wg.Wait()
+	assert.Equal(t, []string{"high", "high", "low", "high", "high", "low", "low", "low"}, order,
+		"high gets three times the share of low while both are queued")
+}
+
+func TestSendScheduler_Cancel(t *testing.T) {
+	s := &sendScheduler{max: 1, finish: make(map[string]float64)}
+	hold, err := s.acquire(context.Background(), "", 1, 1)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = s.acquire(ctx, "", 1, 1)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 0, s.queueLen(), "the waiter left the queue")
+
+	hold()
+	hold()
+	release, err := s.acquire(context.Background(), "", 1, 1)
+	require.NoError(t, err, "releasing twice frees the slot once")
+	release()
+	assert.Equal(t, 0, s.inFlight)
+}
+
+func TestPriorityPolicy_Classify(t *testing.T) {
+	p := &PriorityPolicy{
+		Classes:  []PriorityClass{{Name: "interactive", Weight: 8}, {Name: "batch"}},
+		Methods:  map[string]string{"/batch.": "batch", "/batch.Jobs/Urgent": "interactive"},
+		Metadata: "x-priority",
+		Default:  "batch",
+	}
+	ctx := context.Background()
+	tests := []struct {
+		ctx    context.Context
+		method string
+		class  string
+		weight int
+	}{
+		{ctx, "/batch.Jobs/Run", "batch", 1},
+		{ctx, "/batch.Jobs/Urgent", "interactive", 8},
+		{ctx, "/other.Service/Call", "batch", 1},
+		{metadata.NewIncomingContext(ctx, metadata.Pairs("x-priority", "interactive")), "/batch.Jobs/Run", "interactive", 8},
+		{metadata.NewIncomingContext(ctx, metadata.Pairs("x-priority", "vip")), "/batch.Jobs/Urgent", "interactive", 8},
+	}
+	for _, tc := range tests {
+		class, weight := p.classify(tc.ctx, tc.method)
+		assert.Equal(t, tc.class, class, tc.method)
+		assert.Equal(t, tc.weight, weight, tc.method)
+	}
+}
+
+func TestPrioritizedClientStream_MaxHold(t *testing.T) {
+	p := &PriorityPolicy{MaxHold: 10 * time.Millisecond}
+	stalled := make(chan time.Time)
+	defer close(stalled)
+	cs := &ClientStream{}
+	cs.On("Context").Return(context.Background())
+	cs.On("SendMsg", mock.Anything).WaitUntil(stalled).Return(nil).Once()
+	cs.On("SendMsg", mock.Anything).Return(nil)
+
+	stuck := p.wrap(context.Background(), "/a.A/Stuck", "backend", cs)
+	go stuck.SendMsg(&frame{payload: []byte("stalled")})
+	time.Sleep(time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.wrap(context.Background(), "/a.A/Other", "backend", cs).SendMsg(&frame{payload: []byte("next")})
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("a stalled send holds up the connection")
+	}
+}
+
+func (s *sendScheduler) queueLen() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queue.Len()
+}
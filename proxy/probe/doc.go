@@ -0,0 +1,34 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+/*
+Package probe serves the HTTP endpoints which orchestrators such as
+Kubernetes probe, so that a gateway built with package proxy needs no
+sidecar for them:
+
+	GET /healthz    liveness, fine as long as the process serves HTTP
+	GET /readyz     readiness, see below
+	GET /metrics    the metrics of a Prometheus gatherer
+
+The proxy is ready once its configuration is loaded, while it is not
+draining and while at least one of its routed backends is healthy, as
+reported by proxy.HealthService for the empty service. Handler fields
+which are nil are not checked:
+
+	manager := config.NewManager()
+	drainer := &proxy.Drainer{}
+	registry := prometheus.NewRegistry()
+	...
+	probes, err := probe.Listen(":8086", &probe.Handler{
+		Config:   manager,
+		Router:   manager.Router(),
+		Drainer:  drainer,
+		Gatherer: registry,
+	})
+
+The body of /readyz lists each check as "[+]name ok" or "[-]name failed:
+reason". A failed reload of the configuration leaves the previous one in
+place, so it is listed without failing readiness.
+*/
+package probe
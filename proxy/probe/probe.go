@@ -0,0 +1,169 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/mkxxx/grpc-proxy/proxy/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Handler is the http.Handler of the probe endpoints. It serves them at
+// /healthz, /readyz and /metrics of any prefix, so that it may be mounted
+// on a mux with http.StripPrefix or for the three paths alone.
+type Handler struct {
+	// Config, if set, is not ready until a configuration is applied.
+	Config *config.Manager
+
+	// Router, if set, is not ready unless one of its routed backends is
+	// healthy.
+	Router *proxy.Router
+
+	// Drainer, if set, is not ready while draining.
+	Drainer *proxy.Drainer
+
+	// Checks are further readiness checks by name, which fail readiness if
+	// they return an error.
+	Checks map[string]func() error
+
+	// Gatherer, if set, is served on /metrics.
+	Gatherer prometheus.Gatherer
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/healthz"):
+		w.Write([]byte("ok\n"))
+	case strings.HasSuffix(r.URL.Path, "/readyz"):
+		h.ready(w)
+	case strings.HasSuffix(r.URL.Path, "/metrics") && h.Gatherer != nil:
+		promhttp.HandlerFor(h.Gatherer, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// check is the result of a readiness check. A failed check with warn set
+// is listed, but does not fail readiness.
+type check struct {
+	name string
+	err  error
+	warn bool
+}
+
+// Ready returns nil if the proxy is ready, or an error listing the failed
+// checks.
+func (h *Handler) Ready() error {
+	var failed []string
+	for _, c := range h.checks() {
+		if c.err != nil && !c.warn {
+			failed = append(failed, fmt.Sprintf("%s: %v", c.name, c.err))
+		}
+	}
+	if len(failed) != 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func (h *Handler) checks() []check {
+	var checks []check
+	if h.Config != nil {
+		loaded, err := h.Config.LoadStatus()
+		if !loaded {
+			if err == nil {
+				err = errors.New("not loaded yet")
+			}
+			checks = append(checks, check{name: "config", err: err})
+		} else {
+			checks = append(checks, check{name: "config", err: err, warn: true})
+		}
+	}
+	if h.Drainer != nil {
+		var err error
+		if h.Drainer.Draining() {
+			err = errors.New("draining")
+		}
+		checks = append(checks, check{name: "drain", err: err})
+	}
+	if h.Router != nil {
+		var err error
+		if s, _ := proxy.NewRouterHealth(h.Router).Status(""); s != healthpb.HealthCheckResponse_SERVING {
+			err = errors.New("no healthy backend")
+		}
+		checks = append(checks, check{name: "backends", err: err})
+	}
+	names := make([]string, 0, len(h.Checks))
+	for name := range h.Checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		checks = append(checks, check{name: name, err: h.Checks[name]()})
+	}
+	return checks
+}
+
+func (h *Handler) ready(w http.ResponseWriter) {
+	var b strings.Builder
+	ready := true
+	for _, c := range h.checks() {
+		switch {
+		case c.err == nil:
+			fmt.Fprintf(&b, "[+]%s ok\n", c.name)
+		case c.warn:
+			fmt.Fprintf(&b, "[+]%s ok, with warning: %v\n", c.name, c.err)
+		default:
+			fmt.Fprintf(&b, "[-]%s failed: %v\n", c.name, c.err)
+			ready = false
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		b.WriteString("not ready\n")
+	} else {
+		b.WriteString("ready\n")
+	}
+	w.Write([]byte(b.String()))
+}
+
+// Server is an HTTP listener serving a Handler.
+type Server struct {
+	srv *http.Server
+	lis net.Listener
+}
+
+// Listen starts serving h on the TCP address addr, until Shutdown.
+func Listen(addr string, h *Handler) (*Server, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{srv: &http.Server{Handler: h}, lis: lis}
+	go s.srv.Serve(lis)
+	return s, nil
+}
+
+// Addr returns the address of the listener.
+func (s *Server) Addr() net.Addr {
+	return s.lis.Addr()
+}
+
+// Shutdown stops the listener, waiting for in-flight probes until ctx is
+// done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
@@ -0,0 +1,98 @@
+package probe_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/mkxxx/grpc-proxy/proxy/config"
+	"github.com/mkxxx/grpc-proxy/proxy/probe"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func get(t *testing.T, url string) (string, int) {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body), resp.StatusCode
+}
+
+func TestHandler(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	backend := grpc.NewServer()
+	go backend.Serve(lis)
+	defer backend.Stop()
+
+	manager := config.NewManager()
+	defer manager.Close()
+	drainer := &proxy.Drainer{}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: "probe_test_total", Help: "Test counter."}))
+	extra := errors.New("warming up")
+	s, err := probe.Listen("127.0.0.1:0", &probe.Handler{
+		Config:   manager,
+		Router:   manager.Router(),
+		Drainer:  drainer,
+		Checks:   map[string]func() error{"cache": func() error { return extra }},
+		Gatherer: registry,
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	defer s.Shutdown(ctx)
+	base := "http://" + s.Addr().String()
+
+	body, code := get(t, base+"/healthz")
+	assert.Equal(t, http.StatusOK, code, body)
+	body, code = get(t, base+"/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, strings.Contains(body, "probe_test_total"), body)
+
+	body, code = get(t, base+"/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "[-]config failed: not loaded yet")
+	assert.Contains(t, body, "[-]backends failed: no healthy backend")
+	assert.Contains(t, body, "[+]drain ok")
+	assert.Contains(t, body, "[-]cache failed: warming up")
+
+	extra = nil
+	cfg, err := config.Parse([]byte("backends:\n  - name: b\n    endpoints:\n      - address: " + lis.Addr().String() + "\nroutes:\n  - backend: b\n"))
+	require.NoError(t, err)
+	require.NoError(t, manager.Apply(cfg))
+	body, code = get(t, base+"/readyz")
+	assert.Equal(t, http.StatusOK, code, body)
+
+	assert.Error(t, manager.LoadFile("/nonexistent/proxy.yaml"))
+	body, code = get(t, base+"/readyz")
+	assert.Equal(t, http.StatusOK, code, "failed reloads keep the configuration")
+	assert.Contains(t, body, "[+]config ok, with warning")
+
+	require.NoError(t, drainer.Drain(ctx, 0))
+	body, code = get(t, base+"/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "[-]drain failed: draining")
+	body, code = get(t, base+"/healthz")
+	assert.Equal(t, http.StatusOK, code, "a draining proxy is alive")
+}
+
+func TestHandlerEmpty(t *testing.T) {
+	h := &probe.Handler{}
+	assert.NoError(t, h.Ready())
+	s, err := probe.Listen("127.0.0.1:0", h)
+	require.NoError(t, err)
+	defer s.Shutdown(context.Background())
+	_, code := get(t, "http://"+s.Addr().String()+"/metrics")
+	assert.Equal(t, http.StatusNotFound, code)
+}
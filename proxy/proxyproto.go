@@ -0,0 +1,244 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyProtocolConfig configures NewProxyProtocolListener.
+type ProxyProtocolConfig struct {
+	// TrustedProxies lists the networks of load balancers allowed to send
+	// a PROXY protocol header. Connections from other peers are served
+	// as they are, so a header they send fails the connection. When nil,
+	// every peer is trusted.
+	TrustedProxies []*net.IPNet
+
+	// Required fails connections from trusted peers which do not start
+	// with a PROXY protocol header.
+	Required bool
+
+	// HeaderTimeout limits the time to read the header. Defaults to 10
+	// seconds.
+	HeaderTimeout time.Duration
+}
+
+// NewProxyProtocolListener returns a listener which reads the PROXY protocol
+// header, version 1 or 2, sent by L4 load balancers such as HAProxy or AWS
+// NLB at the start of connections. The RemoteAddr and LocalAddr of accepted
+// connections are those of the original client connection, so RemoteIp and
+// X-Forwarded-For report the client. See
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt.
+//
+// The header is read on the first use of the connection rather than by
+// Accept, so slow peers do not hold up other connections.
+func NewProxyProtocolListener(l net.Listener, cfg ProxyProtocolConfig) net.Listener {
+	if cfg.HeaderTimeout <= 0 {
+		cfg.HeaderTimeout = 10 * time.Second
+	}
+	return &proxyProtocolListener{Listener: l, cfg: cfg}
+}
+
+type proxyProtocolListener struct {
+	net.Listener
+	cfg ProxyProtocolConfig
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusts(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyProtocolConn{Conn: conn, cfg: &l.cfg}, nil
+}
+
+func (l *proxyProtocolListener) trusts(addr net.Addr) bool {
+	return l.cfg.TrustedProxies == nil || inNetworks(l.cfg.TrustedProxies, AddrIP(addr))
+}
+
+// proxyProtocolConn is a connection starting with a PROXY protocol header.
+type proxyProtocolConn struct {
+	net.Conn
+	cfg *ProxyProtocolConfig
+
+	once   sync.Once
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+	err    error
+}
+
+func (c *proxyProtocolConn) init() {
+	c.once.Do(func() {
+		c.r = bufio.NewReaderSize(c.Conn, 256)
+		c.Conn.SetReadDeadline(time.Now().Add(c.cfg.HeaderTimeout))
+		c.remote, c.local, c.err = readProxyHeader(c.r, c.cfg.Required)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	c.init()
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+var (
+	proxyV1Prefix  = []byte("PROXY ")
+	proxyV2Sig     = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	errNoProxyHdr  = errors.New("proxy protocol: missing header")
+	errBadProxyHdr = errors.New("proxy protocol: malformed header")
+)
+
+// readProxyHeader reads a PROXY protocol header from r. The addresses are
+// nil if the header carries none, as for health checks of the load
+// balancer.
+func readProxyHeader(r *bufio.Reader, required bool) (remote, local net.Addr, err error) {
+	sig, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		if required || err != io.EOF {
+			return nil, nil, errNoProxyHdr
+		}
+		return nil, nil, nil
+	}
+	switch {
+	case bytes.Equal(sig, proxyV1Prefix):
+		return readProxyV1(r)
+	case bytes.Equal(sig, proxyV2Sig[:len(sig)]):
+		return readProxyV2(r)
+	case required:
+		return nil, nil, errNoProxyHdr
+	}
+	return nil, nil, nil
+}
+
+// readProxyV1 reads a text header such as
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func readProxyV1(r *bufio.Reader) (remote, local net.Addr, err error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errBadProxyHdr
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errBadProxyHdr
+	}
+	src, srcErr := parseTCPAddr(fields[2], fields[4])
+	dst, dstErr := parseTCPAddr(fields[3], fields[5])
+	if srcErr != nil || dstErr != nil {
+		return nil, nil, errBadProxyHdr
+	}
+	return src, dst, nil
+}
+
+func parseTCPAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("bad address %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readProxyV2 reads a binary header.
+func readProxyV2(r *bufio.Reader) (remote, local net.Addr, err error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil || !bytes.Equal(hdr[:12], proxyV2Sig) {
+		return nil, nil, errBadProxyHdr
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, nil, errBadProxyHdr
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, errBadProxyHdr
+	}
+	switch hdr[12] & 0xf {
+	case 0: // LOCAL, sent by the load balancer itself.
+		return nil, nil, nil
+	case 1: // PROXY
+	default:
+		return nil, nil, errBadProxyHdr
+	}
+	switch hdr[13] {
+	case 0x11, 0x12: // TCP or UDP over IPv4
+		if len(body) < 12 {
+			return nil, nil, errBadProxyHdr
+		}
+		return v2Addr(hdr[13], body[0:4], body[8:10]), v2Addr(hdr[13], body[4:8], body[10:12]), nil
+	case 0x21, 0x22: // TCP or UDP over IPv6
+		if len(body) < 36 {
+			return nil, nil, errBadProxyHdr
+		}
+		return v2Addr(hdr[13], body[0:16], body[32:34]), v2Addr(hdr[13], body[16:32], body[34:36]), nil
+	case 0x31, 0x32: // Unix stream or datagram
+		if len(body) < 216 {
+			return nil, nil, errBadProxyHdr
+		}
+		return unixAddr(hdr[13], body[:108]), unixAddr(hdr[13], body[108:216]), nil
+	}
+	// Unspecified or unknown families carry no usable address.
+	return nil, nil, nil
+}
+
+func v2Addr(family byte, ip, port []byte) net.Addr {
+	addr := net.IP(append([]byte(nil), ip...))
+	p := int(binary.BigEndian.Uint16(port))
+	if family&0xf == 2 {
+		return &net.UDPAddr{IP: addr, Port: p}
+	}
+	return &net.TCPAddr{IP: addr, Port: p}
+}
+
+func unixAddr(family byte, path []byte) net.Addr {
+	if i := bytes.IndexByte(path, 0); i >= 0 {
+		path = path[:i]
+	}
+	network := "unix"
+	if family&0xf == 2 {
+		network = "unixgram"
+	}
+	return &net.UnixAddr{Name: string(path), Net: network}
+}
@@ -0,0 +1,153 @@
+package proxy_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// acceptWith writes data to a connection accepted by lis and returns the
+// accepted connection.
+func acceptWith(t *testing.T, lis net.Listener, data []byte) net.Conn {
+	client, err := net.Dial("tcp", lis.Addr().String())
+	require.NoError(t, err)
+	_, err = client.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+	conn, err := lis.Accept()
+	require.NoError(t, err)
+	return conn
+}
+
+func proxyV2Header(cmd, family byte, addrs []byte) []byte {
+	hdr := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	hdr = append(hdr, 0x20|cmd, family, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:], uint16(len(addrs)))
+	return append(hdr, addrs...)
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x01, 0xbb}
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::1"))
+	copy(v6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(v6[32:], 56324)
+	binary.BigEndian.PutUint16(v6[34:], 443)
+	unix := make([]byte, 216)
+	copy(unix, "/run/client.sock")
+	copy(unix[108:], "/run/proxy.sock")
+
+	tests := []struct {
+		name     string
+		cfg      proxy.ProxyProtocolConfig
+		data     string
+		remote   string
+		local    string
+		rest     string
+		wantFail bool
+	}{
+		{name: "v1 tcp4", data: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\nhello",
+			remote: "192.0.2.1:56324", local: "192.0.2.2:443", rest: "hello"},
+		{name: "v1 tcp6", data: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\nhello",
+			remote: "[2001:db8::1]:56324", local: "[2001:db8::2]:443", rest: "hello"},
+		{name: "v1 unknown", data: "PROXY UNKNOWN\r\nhello", rest: "hello"},
+		{name: "v1 malformed", data: "PROXY TCP4 192.0.2.1\r\nhello", wantFail: true},
+		{name: "v2 tcp4", data: string(proxyV2Header(1, 0x11, v4)) + "hello",
+			remote: "192.0.2.1:56324", local: "192.0.2.2:443", rest: "hello"},
+		{name: "v2 tcp6", data: string(proxyV2Header(1, 0x21, v6)) + "hello",
+			remote: "[2001:db8::1]:56324", local: "[2001:db8::2]:443", rest: "hello"},
+		{name: "v2 unix", data: string(proxyV2Header(1, 0x31, unix)) + "hello",
+			remote: "/run/client.sock", local: "/run/proxy.sock", rest: "hello"},
+		{name: "v2 local", data: string(proxyV2Header(0, 0, nil)) + "hello", rest: "hello"},
+		{name: "no header", data: "hello", rest: "hello"},
+		{name: "required", cfg: proxy.ProxyProtocolConfig{Required: true}, data: "hello", wantFail: true},
+		{name: "untrusted", cfg: proxy.ProxyProtocolConfig{TrustedProxies: []*net.IPNet{mustCIDR(t, "10.0.0.0/8")}},
+			data: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", rest: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			raw, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			lis := proxy.NewProxyProtocolListener(raw, tc.cfg)
+			defer lis.Close()
+
+			conn := acceptWith(t, lis, []byte(tc.data))
+			defer conn.Close()
+			rest, err := ioutil.ReadAll(conn)
+			if tc.wantFail {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.rest, string(rest))
+			if tc.remote == "" {
+				assert.Equal(t, "127.0.0.1", proxy.AddrIP(conn.RemoteAddr()), "the real address is kept")
+				return
+			}
+			assert.Equal(t, tc.remote, conn.RemoteAddr().String())
+			assert.Equal(t, tc.local, conn.LocalAddr().String())
+		})
+	}
+}
+
+func TestAddrIP(t *testing.T) {
+	assert.Equal(t, "192.0.2.1", proxy.AddrIP(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 80}))
+	assert.Equal(t, "2001:db8::1", proxy.AddrIP(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80}))
+	assert.Equal(t, "", proxy.AddrIP(&net.UnixAddr{Name: "/run/proxy.sock", Net: "unix"}), "unix peers have no IP")
+	assert.Equal(t, "", proxy.AddrIP(nil))
+	assert.Equal(t, "fe80::1%eth0", proxy.AddrIP(&net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 80, Zone: "eth0"}), "zones are kept")
+	assert.Equal(t, "2001:db8::1", proxy.AddrIP(stringAddr("[2001:db8::1]:80")))
+	assert.Equal(t, "2001:db8::1", proxy.AddrIP(stringAddr("[2001:db8::1]")), "brackets are removed without a port")
+	assert.Equal(t, "fe80::1%eth0", proxy.AddrIP(stringAddr("[fe80::1%eth0]:80")))
+	assert.Equal(t, "2001:db8::1", proxy.AddrIP(stringAddr("2001:db8::1")))
+	assert.Equal(t, "192.0.2.1", proxy.AddrIP(stringAddr("192.0.2.1:80")))
+}
+
+// stringAddr is a net.Addr of another type than those of package net.
+type stringAddr string
+
+func (a stringAddr) Network() string { return "test" }
+func (a stringAddr) String() string  { return string(a) }
+
+func TestProxyProtocolListener_GRPC(t *testing.T) {
+	got := make(chan string, 1)
+	svc := &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			got <- proxy.RemoteIp(ctx)
+			return &pb.PingResponse{}, nil
+		},
+	}
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	pb.RegisterTestServiceServer(server, svc)
+	go server.Serve(proxy.NewProxyProtocolListener(raw, proxy.ProxyProtocolConfig{Required: true}))
+	defer server.Stop()
+
+	conn, err := grpc.Dial(raw.Addr().String(), grpc.WithInsecure(),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			c, err := net.DialTimeout("tcp", addr, timeout)
+			if err != nil {
+				return nil, err
+			}
+			_, err = c.Write([]byte("PROXY TCP4 203.0.113.7 192.0.2.2 56324 443\r\n"))
+			return c, err
+		}))
+	require.NoError(t, err)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = pb.NewTestServiceClient(conn).Ping(ctx, &pb.PingRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, "203.0.113.7", <-got)
+}
@@ -0,0 +1,204 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxytest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Script is the answer of a ScriptedBackend to a call.
+type Script struct {
+	// Header is sent before the responses, if set.
+	Header metadata.MD
+	// Responses are sent in order, each after Delay.
+	Responses []proto.Message
+	Delay     time.Duration
+	// WaitForHalfClose holds the responses back until the client has sent
+	// all its requests.
+	WaitForHalfClose bool
+	// Trailer and Err end the call.
+	Trailer metadata.MD
+	Err     error
+}
+
+// ScriptedCall is a call received by a ScriptedBackend.
+type ScriptedCall struct {
+	Method   string
+	Metadata metadata.MD
+	// Requests are the encoded request messages received until the call
+	// ended. Requests still in flight when a script ends are lost, unless
+	// the script waits for the half-close.
+	Requests [][]byte
+}
+
+// ScriptedBackend is an in-memory gRPC server which answers calls of any
+// method with scripts. Successive calls to a method play its scripts in
+// order, and the last script is repeated once all were played. Methods
+// without scripts fail with codes.Unimplemented.
+type ScriptedBackend struct {
+	lis    *proxy.InProcessListener
+	server *grpc.Server
+	conn   *grpc.ClientConn
+
+	mu      sync.Mutex
+	scripts map[string][]Script
+	played  map[string]int
+	calls   []*ScriptedCall
+}
+
+// NewScriptedBackend starts a ScriptedBackend without scripts.
+func NewScriptedBackend() *ScriptedBackend {
+	b := &ScriptedBackend{
+		lis:     proxy.NewInProcessListener(),
+		scripts: make(map[string][]Script),
+		played:  make(map[string]int),
+	}
+	b.server = grpc.NewServer(grpc.CustomCodec(scriptCodec{}), grpc.UnknownServiceHandler(b.handle))
+	go b.server.Serve(b.lis)
+	conn, err := grpc.Dial("inprocess",
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(b.lis.DialContext),
+		proxy.DialOption())
+	if err != nil {
+		// Dial does not connect, so it only fails on invalid options.
+		panic(err)
+	}
+	b.conn = conn
+	return b
+}
+
+// Script appends scripts for calls to the full method name.
+func (b *ScriptedBackend) Script(method string, scripts ...Script) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.scripts[method] = append(b.scripts[method], scripts...)
+}
+
+// Conn returns a connection to the backend using the proxy codec, for
+// directors.
+func (b *ScriptedBackend) Conn() *grpc.ClientConn {
+	return b.conn
+}
+
+// Listener returns the listener the backend serves on.
+func (b *ScriptedBackend) Listener() *proxy.InProcessListener {
+	return b.lis
+}
+
+// Calls returns copies of the calls received so far, in order.
+func (b *ScriptedBackend) Calls() []ScriptedCall {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	calls := make([]ScriptedCall, len(b.calls))
+	for i, c := range b.calls {
+		calls[i] = *c
+		calls[i].Requests = append([][]byte(nil), c.Requests...)
+	}
+	return calls
+}
+
+// Close stops the backend.
+func (b *ScriptedBackend) Close() {
+	b.conn.Close()
+	b.server.Stop()
+}
+
+// next returns the script of the next call to method, and records the call.
+func (b *ScriptedBackend) next(call *ScriptedCall) (Script, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls = append(b.calls, call)
+	scripts := b.scripts[call.Method]
+	if len(scripts) == 0 {
+		return Script{}, false
+	}
+	i := b.played[call.Method]
+	if i < len(scripts)-1 {
+		b.played[call.Method]++
+	}
+	return scripts[i], true
+}
+
+func (b *ScriptedBackend) handle(srv interface{}, stream grpc.ServerStream) error {
+	method, _ := grpc.MethodFromServerStream(stream)
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	call := &ScriptedCall{Method: method, Metadata: md}
+	script, ok := b.next(call)
+	if !ok {
+		return status.Errorf(codes.Unimplemented, "no script for %s", method)
+	}
+
+	halfClosed := make(chan struct{})
+	go func() {
+		defer close(halfClosed)
+		for {
+			var req []byte
+			if err := stream.RecvMsg(&req); err != nil {
+				return
+			}
+			b.mu.Lock()
+			call.Requests = append(call.Requests, req)
+			b.mu.Unlock()
+		}
+	}()
+	if script.WaitForHalfClose {
+		select {
+		case <-halfClosed:
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		}
+	}
+	if script.Header != nil {
+		if err := stream.SendHeader(script.Header); err != nil {
+			return err
+		}
+	}
+	for _, resp := range script.Responses {
+		if script.Delay > 0 {
+			select {
+			case <-time.After(script.Delay):
+			case <-stream.Context().Done():
+				return status.FromContextError(stream.Context().Err()).Err()
+			}
+		}
+		if err := stream.SendMsg(resp); err != nil {
+			return err
+		}
+	}
+	if script.Trailer != nil {
+		stream.SetTrailer(script.Trailer)
+	}
+	return script.Err
+}
+
+// scriptCodec receives requests as bytes and sends protobuf responses.
+type scriptCodec struct{}
+
+func (scriptCodec) Marshal(v interface{}) ([]byte, error) {
+	if b, ok := v.(*[]byte); ok {
+		return *b, nil
+	}
+	return proto.Marshal(v.(proto.Message))
+}
+
+func (scriptCodec) Unmarshal(data []byte, v interface{}) error {
+	if b, ok := v.(*[]byte); ok {
+		*b = append([]byte(nil), data...)
+		return nil
+	}
+	return proto.Unmarshal(data, v.(proto.Message))
+}
+
+func (scriptCodec) String() string {
+	return "proto"
+}
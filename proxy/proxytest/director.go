@@ -0,0 +1,222 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxytest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// MockDirector is a proxy.StreamDirector which directs calls according to
+// expectations. Expectations are matched in the order they were added, and
+// the first which matches a call and is not used up directs it. Calls which
+// match no expectation fail with codes.Unimplemented and are reported by
+// Verify.
+//
+// Backends and expectations should be added before calls are directed.
+type MockDirector struct {
+	mu           sync.Mutex
+	backends     map[string]*grpc.ClientConn
+	expectations []*Expectation
+	calls        []Call
+}
+
+// Call is a call directed by a MockDirector.
+type Call struct {
+	Method   string
+	Metadata metadata.MD
+	// Backend is the name of the backend of the call, if any.
+	Backend string
+	// Err is the error returned by the director, if any.
+	Err error
+	// Unexpected is set if the call matched no expectation.
+	Unexpected bool
+}
+
+// Expectation describes calls expected by a MockDirector and how they are
+// directed. By default an expected call is expected at least once, and is
+// sent to the only backend.
+type Expectation struct {
+	method   string
+	metadata map[string]string
+	backend  string
+	err      error
+	times    int
+	count    int
+}
+
+// NewMockDirector returns a MockDirector without backends or expectations.
+func NewMockDirector() *MockDirector {
+	return &MockDirector{backends: make(map[string]*grpc.ClientConn)}
+}
+
+// AddBackend registers a backend connection under the given name. The
+// connection must use the proxy codec.
+func (m *MockDirector) AddBackend(name string, conn *grpc.ClientConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.backends[name] = conn
+}
+
+// Expect adds an expectation for calls to method, which is a full method
+// name, or a prefix of the method names ending in "/" or ".".
+func (m *MockDirector) Expect(method string) *Expectation {
+	e := &Expectation{method: method}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expectations = append(m.expectations, e)
+	return e
+}
+
+// Metadata requires calls to have the metadata key. If value is not
+// empty, the key must also have that value.
+func (e *Expectation) Metadata(key, value string) *Expectation {
+	if e.metadata == nil {
+		e.metadata = make(map[string]string)
+	}
+	e.metadata[strings.ToLower(key)] = value
+	return e
+}
+
+// Backend sends the calls to the named backend.
+func (e *Expectation) Backend(name string) *Expectation {
+	e.backend = name
+	return e
+}
+
+// Error fails the calls with err instead of directing them.
+func (e *Expectation) Error(err error) *Expectation {
+	e.err = err
+	return e
+}
+
+// Times expects exactly n calls. Further calls are left to the following
+// expectations.
+func (e *Expectation) Times(n int) *Expectation {
+	e.times = n
+	return e
+}
+
+func (e *Expectation) matches(method string, md metadata.MD) bool {
+	if e.times > 0 && e.count >= e.times {
+		return false
+	}
+	if !matchMethod(e.method, method) {
+		return false
+	}
+	for k, v := range e.metadata {
+		values := md.Get(k)
+		if len(values) == 0 || (v != "" && !contains(values, v)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *Expectation) String() string {
+	s := e.method
+	if len(e.metadata) != 0 {
+		s += fmt.Sprintf(" with metadata %v", e.metadata)
+	}
+	return s
+}
+
+func matchMethod(pattern, method string) bool {
+	if strings.HasSuffix(pattern, "/") || strings.HasSuffix(pattern, ".") {
+		return strings.HasPrefix(method, pattern)
+	}
+	return pattern == method
+}
+
+func contains(values []string, want string) bool {
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
+
+// Direct implements proxy.StreamDirector.
+func (m *MockDirector) Direct(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	call := Call{Method: method, Metadata: md.Copy()}
+	dir, err := m.direct(&call, md)
+	call.Err = err
+	m.calls = append(m.calls, call)
+	return ctx, nil, dir, err
+}
+
+func (m *MockDirector) direct(call *Call, md metadata.MD) (proxy.Direction, error) {
+	var e *Expectation
+	for _, exp := range m.expectations {
+		if exp.matches(call.Method, md) {
+			e = exp
+			break
+		}
+	}
+	if e == nil {
+		call.Unexpected = true
+		return proxy.Direction{}, status.Errorf(codes.Unimplemented, "unexpected call to %s", call.Method)
+	}
+	e.count++
+	if e.err != nil {
+		return proxy.Direction{}, e.err
+	}
+	name := e.backend
+	if name == "" && len(m.backends) == 1 {
+		for n := range m.backends {
+			name = n
+		}
+	}
+	conn, ok := m.backends[name]
+	if !ok {
+		return proxy.Direction{}, status.Errorf(codes.Unavailable, "backend %q is not available", name)
+	}
+	call.Backend = name
+	return proxy.Direction{BackendConn: conn}, nil
+}
+
+// Calls returns the calls directed so far, in order.
+func (m *MockDirector) Calls() []Call {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Call(nil), m.calls...)
+}
+
+// Verify returns an error describing the unexpected calls and the unmet
+// expectations, or nil if there are none.
+func (m *MockDirector) Verify() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var problems []string
+	for _, c := range m.calls {
+		if c.Unexpected {
+			problems = append(problems, "unexpected call to "+c.Method)
+		}
+	}
+	for _, e := range m.expectations {
+		switch {
+		case e.times > 0 && e.count != e.times:
+			problems = append(problems, fmt.Sprintf("expected %d calls to %s, got %d", e.times, e, e.count))
+		case e.times <= 0 && e.count == 0:
+			problems = append(problems, fmt.Sprintf("expected a call to %s", e))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("proxytest: %s", strings.Join(problems, "; "))
+}
@@ -0,0 +1,35 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+/*
+Package proxytest provides a mock director and a scripted backend for
+integration tests of routing logic.
+
+A MockDirector directs calls according to expectations, which match calls
+by method and metadata and send them to a named backend or fail them, and
+checks afterwards that every expectation was met:
+
+	director := proxytest.NewMockDirector()
+	director.AddBackend("orders", orders.Conn())
+	director.Expect("/orders.OrderService/").Backend("orders")
+	director.Expect("/admin.").Error(status.Error(codes.PermissionDenied, "no"))
+	...
+	if err := director.Verify(); err != nil {
+		t.Error(err)
+	}
+
+A ScriptedBackend answers any method with a predefined sequence of
+headers, responses, trailers and a status, and records the requests it
+receives:
+
+	orders := proxytest.NewScriptedBackend()
+	defer orders.Close()
+	orders.Script("/orders.OrderService/List", proxytest.Script{
+		Responses: []proto.Message{&pb.Order{Id: "1"}, &pb.Order{Id: "2"}},
+		Err:       status.Error(codes.Unavailable, "gone"),
+	})
+
+Both work with proxy.NewTestProxy and the proxytesting package.
+*/
+package proxytest
@@ -0,0 +1,182 @@
+package proxytest_test
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/mkxxx/grpc-proxy/proxy/proxytest"
+	proxytesting "github.com/mkxxx/grpc-proxy/proxy/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+const (
+	pingMethod   = "/vgough.testproto.TestService/Ping"
+	listMethod   = "/vgough.testproto.TestService/PingList"
+	streamMethod = "/vgough.testproto.TestService/PingStream"
+)
+
+func TestMockDirector(t *testing.T) {
+	blue, green := proxytest.NewScriptedBackend(), proxytest.NewScriptedBackend()
+	defer blue.Close()
+	defer green.Close()
+	blue.Script(pingMethod, proxytest.Script{Responses: []proto.Message{&pb.PingResponse{Value: "blue"}}})
+	green.Script(pingMethod, proxytest.Script{Responses: []proto.Message{&pb.PingResponse{Value: "green"}}})
+
+	director := proxytest.NewMockDirector()
+	director.AddBackend("blue", blue.Conn())
+	director.AddBackend("green", green.Conn())
+	director.Expect(pingMethod).Metadata("x-color", "green").Backend("green")
+	director.Expect(pingMethod).Backend("blue").Times(2)
+	director.Expect("/vgough.testproto.").Error(status.Error(codes.PermissionDenied, "denied"))
+	tp := proxy.NewTestProxy(director.Direct)
+	defer tp.Close()
+	client := pb.NewTestServiceClient(tp.ClientConn)
+	ctx, cancel := proxytesting.Context()
+	defer cancel()
+
+	resp, err := client.Ping(metadata.AppendToOutgoingContext(ctx, "x-color", "green"), &pb.PingRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, "green", resp.Value, "expectations match metadata")
+	for i := 0; i < 2; i++ {
+		resp, err = client.Ping(ctx, &pb.PingRequest{})
+		require.NoError(t, err)
+		assert.Equal(t, "blue", resp.Value)
+	}
+	_, err = client.Ping(ctx, &pb.PingRequest{})
+	assert.Equal(t, status.Error(codes.PermissionDenied, "denied"), err, "used up expectations are skipped")
+	assert.NoError(t, director.Verify())
+
+	_, err = client.PingEmpty(ctx, &pb.Empty{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "prefixes match")
+	calls := director.Calls()
+	require.Len(t, calls, 5)
+	assert.Equal(t, "green", calls[0].Backend)
+	assert.Equal(t, "blue", calls[1].Backend)
+	assert.Equal(t, []string{"green"}, calls[0].Metadata.Get("x-color"))
+	assert.Error(t, calls[3].Err)
+}
+
+func TestMockDirector_Verify(t *testing.T) {
+	backend := proxytest.NewScriptedBackend()
+	defer backend.Close()
+	backend.Script(pingMethod, proxytest.Script{Responses: []proto.Message{&pb.PingResponse{}}})
+
+	director := proxytest.NewMockDirector()
+	director.AddBackend("only", backend.Conn())
+	director.Expect(pingMethod)
+	director.Expect(listMethod).Times(2)
+	tp := proxy.NewTestProxy(director.Direct)
+	defer tp.Close()
+	client := pb.NewTestServiceClient(tp.ClientConn)
+	ctx, cancel := proxytesting.Context()
+	defer cancel()
+
+	_, err := client.Ping(ctx, &pb.PingRequest{})
+	require.NoError(t, err, "calls go to the only backend by default")
+	_, err = client.PingEmpty(ctx, &pb.Empty{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+
+	err = director.Verify()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unexpected call to /vgough.testproto.TestService/PingEmpty")
+	assert.Contains(t, err.Error(), "expected 2 calls to "+listMethod+", got 0")
+	assert.NotContains(t, err.Error(), pingMethod+",")
+}
+
+func TestScriptedBackend_Sequences(t *testing.T) {
+	backend := proxytest.NewScriptedBackend()
+	defer backend.Close()
+	backend.Script(listMethod,
+		proxytest.Script{
+			WaitForHalfClose: true,
+			Header:           metadata.Pairs("x-attempt", "1"),
+			Responses:        []proto.Message{&pb.PingResponse{Counter: 1}},
+			Err:              status.Error(codes.Unavailable, "try again"),
+		},
+		proxytest.Script{
+			Responses: []proto.Message{&pb.PingResponse{Counter: 1}, &pb.PingResponse{Counter: 2}},
+			Trailer:   metadata.Pairs("x-done", "yes"),
+		})
+	tp := proxy.NewTestProxy(func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+		return ctx, nil, proxy.Direction{BackendConn: backend.Conn()}, nil
+	})
+	defer tp.Close()
+	client := pb.NewTestServiceClient(tp.ClientConn)
+	ctx, cancel := proxytesting.Context()
+	defer cancel()
+
+	recvAll := func() ([]int32, metadata.MD, metadata.MD, error) {
+		stream, err := client.PingList(ctx, &pb.PingRequest{Value: "list"})
+		require.NoError(t, err)
+		var counters []int32
+		for {
+			resp, err := stream.Recv()
+			if err != nil {
+				header, _ := stream.Header()
+				if err == io.EOF {
+					err = nil
+				}
+				return counters, header, stream.Trailer(), err
+			}
+			counters = append(counters, resp.Counter)
+		}
+	}
+	counters, header, _, err := recvAll()
+	assert.Equal(t, []int32{1}, counters)
+	assert.Equal(t, []string{"1"}, header.Get("x-attempt"))
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	for i := 0; i < 2; i++ {
+		counters, _, trailer, err := recvAll()
+		require.NoError(t, err)
+		assert.Equal(t, []int32{1, 2}, counters, "the last script is repeated")
+		assert.Equal(t, []string{"yes"}, trailer.Get("x-done"))
+	}
+
+	calls := backend.Calls()
+	require.Len(t, calls, 3)
+	require.Len(t, calls[0].Requests, 1)
+	var req pb.PingRequest
+	require.NoError(t, proto.Unmarshal(calls[0].Requests[0], &req))
+	assert.Equal(t, "list", req.Value)
+
+	_, err = client.Ping(ctx, &pb.PingRequest{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err), "methods without scripts are not implemented")
+}
+
+func TestScriptedBackend_WaitForHalfClose(t *testing.T) {
+	backend := proxytest.NewScriptedBackend()
+	defer backend.Close()
+	backend.Script(streamMethod, proxytest.Script{
+		WaitForHalfClose: true,
+		Responses:        []proto.Message{&pb.PingResponse{Value: "all received"}},
+	})
+	conn, err := grpc.Dial("inprocess", grpc.WithInsecure(), grpc.WithContextDialer(backend.Listener().DialContext))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := pb.NewTestServiceClient(conn)
+	ctx, cancel := proxytesting.Context()
+	defer cancel()
+
+	stream, err := client.PingStream(ctx)
+	require.NoError(t, err)
+	for _, v := range []string{"a", "b", "c"} {
+		require.NoError(t, stream.Send(&pb.PingRequest{Value: v}))
+	}
+	require.NoError(t, stream.CloseSend())
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, "all received", resp.Value)
+	_, err = stream.Recv()
+	assert.Equal(t, io.EOF, err)
+	assert.Len(t, backend.Calls()[0].Requests, 3)
+}
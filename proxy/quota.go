@@ -0,0 +1,188 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Classifier returns the class of a stream, such as "interactive" or
+// "batch". It is called with the context of the call once it is directed.
+type Classifier func(ctx context.Context, method string) string
+
+// MethodClassifier returns a Classifier which classifies streams by the
+// longest matching method prefix in classes, and as def otherwise.
+func MethodClassifier(classes map[string]string, def string) Classifier {
+	return func(ctx context.Context, method string) string {
+		class, best := def, -1
+		for prefix, c := range classes {
+			if len(prefix) > best && strings.HasPrefix(method, prefix) {
+				class, best = c, len(prefix)
+			}
+		}
+		return class
+	}
+}
+
+// ClassQuota limits the streams of a class to each backend.
+type ClassQuota struct {
+	// MaxStreams limits the in-flight streams of the class per backend.
+	// Streams over the quota fail with codes.ResourceExhausted. Zero means
+	// no limit.
+	MaxStreams int
+
+	// ByteRate limits the message bytes per second of the class per
+	// backend, in both directions. Messages over the rate wait, which slows
+	// down the streams of the class through flow control. Zero means no
+	// limit.
+	ByteRate int
+}
+
+// QuotaPolicy enforces quotas per class of stream and backend, so that,
+// say, batch streaming jobs cannot starve interactive calls through the
+// proxy. Backends are keyed by the target of the backend connection.
+// Classes without a quota are not limited.
+type QuotaPolicy struct {
+	Classify Classifier
+	Quotas   map[string]ClassQuota
+
+	mu     sync.Mutex
+	usages map[quotaKey]*quotaUsage
+}
+
+type quotaKey struct {
+	class, backend string
+}
+
+type quotaUsage struct {
+	streams int
+	// next is when the next message of the class may be forwarded.
+	next time.Time
+}
+
+// WithQuotas enforces the quotas of p.
+func WithQuotas(p *QuotaPolicy) Option {
+	return func(o *options) {
+		o.quotas = p
+	}
+}
+
+// InFlight returns the number of in-flight streams of class to backend.
+func (p *QuotaPolicy) InFlight(class, backend string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if u, ok := p.usages[quotaKey{class, backend}]; ok {
+		return u.streams
+	}
+	return 0
+}
+
+// start admits a stream to ps.backend within the quota of its class. The
+// returned ServerStream paces the messages of the class, and release must
+// be called when the stream ends.
+func (p *QuotaPolicy) start(ctx context.Context, ps *proxiedStream, in grpc.ServerStream) (grpc.ServerStream, func(), error) {
+	class := ""
+	if p.Classify != nil {
+		class = p.Classify(ctx, ps.method)
+	}
+	quota, ok := p.Quotas[class]
+	if !ok || (quota.MaxStreams <= 0 && quota.ByteRate <= 0) {
+		return in, func() {}, nil
+	}
+	key := quotaKey{class, ps.backend}
+	p.mu.Lock()
+	if p.usages == nil {
+		p.usages = make(map[quotaKey]*quotaUsage)
+	}
+	u, ok := p.usages[key]
+	if !ok {
+		u = &quotaUsage{}
+		p.usages[key] = u
+	}
+	if quota.MaxStreams > 0 && u.streams >= quota.MaxStreams {
+		p.mu.Unlock()
+		return nil, nil, status.Errorf(codes.ResourceExhausted, "quota of %d %q streams to backend %s exceeded", quota.MaxStreams, class, ps.backend)
+	}
+	u.streams++
+	p.mu.Unlock()
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if u.streams--; u.streams == 0 && !u.next.After(time.Now()) {
+				delete(p.usages, key)
+			}
+		})
+	}
+	if quota.ByteRate > 0 {
+		in = &quotaServerStream{ServerStream: in, p: p, u: u, rate: quota.ByteRate}
+	}
+	return in, release, nil
+}
+
+// reserve returns how long a message of n bytes must wait for the byte
+// rate of u.
+func (p *QuotaPolicy) reserve(u *quotaUsage, rate, n int) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if u.next.Before(now) {
+		u.next = now
+	}
+	delay := u.next.Sub(now)
+	u.next = u.next.Add(time.Duration(float64(n) / float64(rate) * float64(time.Second)))
+	return delay
+}
+
+// quotaServerStream paces the messages of a stream to the byte rate of
+// its class, shared with the other streams of the class to the backend.
+type quotaServerStream struct {
+	grpc.ServerStream
+	p    *QuotaPolicy
+	u    *quotaUsage
+	rate int
+}
+
+func (s *quotaServerStream) wait(m interface{}) error {
+	f, ok := m.(*frame)
+	if !ok {
+		return nil
+	}
+	delay := s.p.reserve(s.u, s.rate, len(f.payload))
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-s.Context().Done():
+		return status.FromContextError(s.Context().Err()).Err()
+	}
+}
+
+func (s *quotaServerStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return s.wait(m)
+}
+
+func (s *quotaServerStream) SendMsg(m interface{}) error {
+	if err := s.wait(m); err != nil {
+		return err
+	}
+	return s.ServerStream.SendMsg(m)
+}
@@ -0,0 +1,101 @@
+package proxy_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestMethodClassifier(t *testing.T) {
+	classify := proxy.MethodClassifier(map[string]string{
+		"/reports.":                "batch",
+		"/reports.Reports/Summary": "interactive",
+	}, "interactive")
+	ctx := context.Background()
+	assert.Equal(t, "batch", classify(ctx, "/reports.Reports/Export"))
+	assert.Equal(t, "interactive", classify(ctx, "/reports.Reports/Summary"))
+	assert.Equal(t, "interactive", classify(ctx, "/users.Users/Get"))
+}
+
+func TestQuotas_MaxStreams(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	svc := &pingService{
+		pingStream: func(stream pb.TestService_PingStreamServer) error {
+			started <- struct{}{}
+			<-release
+			return nil
+		},
+	}
+	quotas := &proxy.QuotaPolicy{
+		Classify: func(ctx context.Context, method string) string {
+			md, _ := metadata.FromIncomingContext(ctx)
+			if len(md.Get("x-class")) != 0 {
+				return md.Get("x-class")[0]
+			}
+			return "interactive"
+		},
+		Quotas: map[string]proxy.ClassQuota{"batch": {MaxStreams: 1}},
+	}
+	env := newTestEnv(t, svc, proxy.WithQuotas(quotas))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+	batchCtx := metadata.AppendToOutgoingContext(ctx, "x-class", "batch")
+
+	stream, err := env.client.PingStream(batchCtx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.PingRequest{}))
+	<-started
+	backend := env.backendConn.Target()
+	assert.Equal(t, 1, quotas.InFlight("batch", backend))
+
+	_, err = env.client.Ping(batchCtx, &pb.PingRequest{})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "the batch quota is used up")
+	_, err = env.client.Ping(ctx, &pb.PingRequest{})
+	assert.NoError(t, err, "other classes are not limited")
+
+	close(release)
+	_, err = stream.Recv()
+	require.Error(t, err)
+	assert.Eventually(t, func() bool { return quotas.InFlight("batch", backend) == 0 }, time.Second, 5*time.Millisecond)
+	_, err = env.client.Ping(batchCtx, &pb.PingRequest{})
+	assert.NoError(t, err, "the quota is freed with the stream")
+}
+
+func TestQuotas_ByteRate(t *testing.T) {
+	quotas := &proxy.QuotaPolicy{
+		Classify: proxy.MethodClassifier(map[string]string{"/vgough.testproto.TestService/Ping": "batch"}, "interactive"),
+		Quotas:   map[string]proxy.ClassQuota{"batch": {ByteRate: 10000}},
+	}
+	env := newTestEnv(t, &pingService{}, proxy.WithQuotas(quotas))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	// Each message takes about 50ms of the rate.
+	value := strings.Repeat("x", 500)
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		_, err := env.client.Ping(ctx, &pb.PingRequest{Value: value})
+		require.NoError(t, err)
+	}
+	assert.True(t, time.Since(start) >= 140*time.Millisecond, "messages of the class are paced, took %v", time.Since(start))
+
+	start = time.Now()
+	for i := 0; i < 2; i++ {
+		_, err := env.client.PingEmpty(ctx, &pb.Empty{})
+		require.NoError(t, err)
+	}
+	assert.True(t, time.Since(start) < 140*time.Millisecond, "other classes are not paced")
+}
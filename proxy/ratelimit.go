@@ -0,0 +1,171 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// RateLimiter decides whether a call may proceed. Implementations may be
+// local or backed by a shared store, and must be safe for concurrent use.
+type RateLimiter interface {
+	// Allow consumes one unit for key. If the call is not allowed,
+	// retryAfter is a hint for when it may be retried.
+	Allow(ctx context.Context, key string) (ok bool, retryAfter time.Duration, err error)
+}
+
+// RateLimit configures a rate limit, see WithRateLimit. The dimensions
+// which are set make up the key passed to the limiter, so that each
+// distinct peer, metadata value, method or backend gets its own limit. With
+// no dimension set, the limit is global.
+type RateLimit struct {
+	Limiter RateLimiter
+
+	// ByPeer keys the limit by client IP address.
+	ByPeer bool
+
+	// ByMetadata keys the limit by the value of an incoming metadata key,
+	// such as an API key. Calls without the key share a limit.
+	ByMetadata string
+
+	// ByMethod keys the limit by full method name.
+	ByMethod bool
+
+	// ByBackend keys the limit by the target of the backend connection.
+	ByBackend bool
+
+	// FailOpen lets calls through when the limiter fails. By default they
+	// are rejected with codes.Unavailable.
+	FailOpen bool
+}
+
+// WithRateLimit adds a rate limit. Calls over the limit fail with
+// codes.ResourceExhausted and a retry-after trailer holding the number of
+// seconds to wait, along with grpc-retry-pushback-ms.
+func WithRateLimit(l RateLimit) Option {
+	return func(o *options) {
+		o.rateLimits = append(o.rateLimits, &l)
+	}
+}
+
+func (l *RateLimit) key(ctx context.Context, ps *proxiedStream) string {
+	var parts []string
+	if l.ByPeer {
+		parts = append(parts, "peer="+ps.peerIP)
+	}
+	if l.ByMetadata != "" {
+		md, _ := metadata.FromIncomingContext(ctx)
+		var v string
+		if values := md.Get(l.ByMetadata); len(values) != 0 {
+			v = values[0]
+		}
+		parts = append(parts, "md:"+strings.ToLower(l.ByMetadata)+"="+v)
+	}
+	if l.ByMethod {
+		parts = append(parts, "method="+ps.method)
+	}
+	if l.ByBackend {
+		parts = append(parts, "backend="+ps.backend)
+	}
+	return strings.Join(parts, "|")
+}
+
+// allow checks the limit for a stream.
+func (l *RateLimit) allow(ctx context.Context, ps *proxiedStream) error {
+	ok, retryAfter, err := l.Limiter.Allow(ctx, l.key(ctx, ps))
+	if err != nil {
+		if l.FailOpen {
+			return nil
+		}
+		return status.Errorf(codes.Unavailable, "rate limiter failed: %v", err)
+	}
+	if ok {
+		return nil
+	}
+	if retryAfter > 0 {
+		secs := int64(math.Ceil(retryAfter.Seconds()))
+		ms := int64(retryAfter / time.Millisecond)
+		grpc.SetTrailer(ctx, metadata.Pairs(
+			"retry-after", strconv.FormatInt(secs, 10),
+			retryPushbackKey, strconv.FormatInt(ms, 10)))
+	}
+	return status.Error(codes.ResourceExhausted, "rate limit exceeded")
+}
+
+// NewTokenBucketLimiter returns a local RateLimiter with a token bucket per
+// key, refilled at rate tokens per second and holding up to burst tokens.
+//
+// At most 10000 buckets are kept. Beyond that, the least recently used
+// bucket is forgotten, so that clients choosing many keys do not grow the
+// limiter without bound.
+func NewTokenBucketLimiter(rate float64, burst int) RateLimiter {
+	return &tokenBuckets{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// maxTokenBuckets is the number of buckets kept by a token bucket limiter.
+const maxTokenBuckets = 10000
+
+type tokenBuckets struct {
+	rate  float64
+	burst float64
+
+	mu sync.Mutex
+	// buckets holds the elements of order, which is sorted by last use,
+	// most recent first.
+	buckets map[string]*list.Element
+	order   *list.List
+}
+
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+func (t *tokenBuckets) Allow(ctx context.Context, key string) (bool, time.Duration, error) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var b *tokenBucket
+	if el, ok := t.buckets[key]; ok {
+		t.order.MoveToFront(el)
+		b = el.Value.(*tokenBucket)
+	} else {
+		b = &tokenBucket{key: key, tokens: t.burst, last: now}
+		t.buckets[key] = t.order.PushFront(b)
+		if t.order.Len() > maxTokenBuckets {
+			oldest := t.order.Back()
+			t.order.Remove(oldest)
+			delete(t.buckets, oldest.Value.(*tokenBucket).key)
+		}
+	}
+	b.tokens = math.Min(t.burst, b.tokens+now.Sub(b.last).Seconds()*t.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+	if t.rate <= 0 {
+		return false, 0, nil
+	}
+	wait := time.Duration((1 - b.tokens) / t.rate * float64(time.Second))
+	return false, wait, nil
+}
@@ -0,0 +1,99 @@
+package proxy_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestRateLimitByMetadata(t *testing.T) {
+	env := newTestEnv(t, &pingService{}, proxy.WithRateLimit(proxy.RateLimit{
+		Limiter:    proxy.NewTokenBucketLimiter(0.1, 1),
+		ByMetadata: "x-api-key",
+	}))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	alice := metadata.AppendToOutgoingContext(ctx, "x-api-key", "alice")
+	bob := metadata.AppendToOutgoingContext(ctx, "x-api-key", "bob")
+
+	_, err := env.client.Ping(alice, &pb.PingRequest{Value: "1"})
+	require.NoError(t, err)
+
+	var trailer metadata.MD
+	_, err = env.client.Ping(alice, &pb.PingRequest{Value: "2"}, grpc.Trailer(&trailer))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, []string{"10"}, trailer.Get("retry-after"))
+
+	_, err = env.client.Ping(bob, &pb.PingRequest{Value: "1"})
+	assert.NoError(t, err, "each key has its own bucket")
+}
+
+type failingLimiter struct{}
+
+func (failingLimiter) Allow(ctx context.Context, key string) (bool, time.Duration, error) {
+	return false, 0, errors.New("store is down")
+}
+
+func TestRateLimitFailure(t *testing.T) {
+	env := newTestEnv(t, &pingService{}, proxy.WithRateLimit(proxy.RateLimit{Limiter: failingLimiter{}}))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "1"})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	open := newTestEnv(t, &pingService{}, proxy.WithRateLimit(proxy.RateLimit{Limiter: failingLimiter{}, FailOpen: true}))
+	defer open.Close()
+	_, err = open.client.Ping(ctx, &pb.PingRequest{Value: "1"})
+	assert.NoError(t, err)
+}
+
+func TestTokenBucketLimiter(t *testing.T) {
+	l := proxy.NewTokenBucketLimiter(1000, 2)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		ok, _, err := l.Allow(ctx, "k")
+		require.NoError(t, err)
+		assert.True(t, ok)
+	}
+	ok, retryAfter, _ := l.Allow(ctx, "k")
+	assert.False(t, ok)
+	assert.True(t, retryAfter > 0 && retryAfter <= time.Millisecond, "retry after %v", retryAfter)
+
+	time.Sleep(5 * time.Millisecond)
+	ok, _, _ = l.Allow(ctx, "k")
+	assert.True(t, ok, "bucket refills over time")
+}
+
+func TestTokenBucketLimiter_ForgetsLeastRecentlyUsed(t *testing.T) {
+	l := proxy.NewTokenBucketLimiter(0, 1)
+	ctx := context.Background()
+	ok, _, _ := l.Allow(ctx, "first")
+	assert.True(t, ok)
+	ok, _, _ = l.Allow(ctx, "recent")
+	assert.True(t, ok)
+	// Drained buckets of attacker chosen keys do not accumulate.
+	for i := 0; i < 9998; i++ {
+		l.Allow(ctx, strconv.Itoa(i))
+	}
+	ok, _, _ = l.Allow(ctx, "recent")
+	assert.False(t, ok, "recently used buckets are kept")
+	l.Allow(ctx, "new")
+	ok, _, _ = l.Allow(ctx, "first")
+	assert.True(t, ok, "the least recently used bucket is forgotten")
+}
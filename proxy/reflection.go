@@ -0,0 +1,213 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+)
+
+// ReflectionAggregator is a gRPC server reflection service which presents
+// the services of several backends as one, so reflection clients such as
+// grpcurl can explore everything reachable through the proxy.
+//
+// Service lists are merged. Symbol lookups go to the backend which listed
+// the service, other lookups are tried on each backend in turn until one
+// succeeds.
+type ReflectionAggregator struct {
+	backends func(ctx context.Context) []*grpc.ClientConn
+}
+
+// NewReflectionAggregator returns a ReflectionAggregator for the given
+// backend connections, which must serve server reflection.
+func NewReflectionAggregator(conns ...*grpc.ClientConn) *ReflectionAggregator {
+	return &ReflectionAggregator{backends: func(context.Context) []*grpc.ClientConn { return conns }}
+}
+
+// NewRouterReflection returns a ReflectionAggregator for the backends of r.
+// The backends are looked up for every reflection stream, using one
+// connection of each.
+func NewRouterReflection(r *Router) *ReflectionAggregator {
+	return &ReflectionAggregator{backends: r.reflectionConns}
+}
+
+// Register registers the aggregator as the reflection service of s.
+func (a *ReflectionAggregator) Register(s *grpc.Server) {
+	rpb.RegisterServerReflectionServer(s, a)
+}
+
+const reflectionMethod = "/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo"
+
+// reflectionConns returns one connection for each backend, ordered by
+// backend name.
+func (r *Router) reflectionConns(ctx context.Context) []*grpc.ClientConn {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.backends))
+	for name := range r.backends {
+		names = append(names, name)
+	}
+	r.mu.RUnlock()
+	sort.Strings(names)
+
+	var conns []*grpc.ClientConn
+	for _, name := range names {
+		r.mu.RLock()
+		b, ok := r.backends[name]
+		r.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		conn, done, err := b.Pick(ctx, reflectionMethod)
+		if err != nil {
+			continue
+		}
+		if done != nil {
+			done(nil)
+		}
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// reflectionSession holds the backend streams of one client stream.
+type reflectionSession struct {
+	ctx      context.Context
+	conns    []*grpc.ClientConn
+	streams  []rpb.ServerReflection_ServerReflectionInfoClient
+	services map[string]int
+}
+
+// ServerReflectionInfo implements the reflection service.
+func (a *ReflectionAggregator) ServerReflectionInfo(stream rpb.ServerReflection_ServerReflectionInfoServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	s := &reflectionSession{
+		ctx:      CopyMetadata(ctx, ctx),
+		conns:    a.backends(ctx),
+		services: make(map[string]int),
+	}
+	s.streams = make([]rpb.ServerReflection_ServerReflectionInfoClient, len(s.conns))
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		resp := s.handle(req)
+		resp.ValidHost = req.GetHost()
+		resp.OriginalRequest = req
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *reflectionSession) handle(req *rpb.ServerReflectionRequest) *rpb.ServerReflectionResponse {
+	if _, ok := req.GetMessageRequest().(*rpb.ServerReflectionRequest_ListServices); ok {
+		return s.listServices(req)
+	}
+	if symbol := req.GetFileContainingSymbol(); symbol != "" {
+		if i, ok := s.serviceBackend(symbol); ok {
+			if resp, err := s.ask(i, req); err == nil && resp.GetErrorResponse() == nil {
+				return resp
+			}
+		}
+	}
+	var last *rpb.ServerReflectionResponse
+	for i := range s.conns {
+		resp, err := s.ask(i, req)
+		if err != nil {
+			continue
+		}
+		if resp.GetErrorResponse() == nil {
+			return resp
+		}
+		last = resp
+	}
+	if last != nil {
+		return last
+	}
+	return reflectionError(codes.NotFound, "no backend could answer the request")
+}
+
+func (s *reflectionSession) listServices(req *rpb.ServerReflectionRequest) *rpb.ServerReflectionResponse {
+	var services []*rpb.ServiceResponse
+	seen := make(map[string]bool)
+	for i := range s.conns {
+		resp, err := s.ask(i, req)
+		if err != nil {
+			continue
+		}
+		for _, svc := range resp.GetListServicesResponse().GetService() {
+			if seen[svc.GetName()] {
+				continue
+			}
+			seen[svc.GetName()] = true
+			s.services[svc.GetName()] = i
+			services = append(services, svc)
+		}
+	}
+	if len(s.conns) != 0 && len(services) == 0 {
+		return reflectionError(codes.Unavailable, "no backend answered the request")
+	}
+	return &rpb.ServerReflectionResponse{
+		MessageResponse: &rpb.ServerReflectionResponse_ListServicesResponse{
+			ListServicesResponse: &rpb.ListServiceResponse{Service: services},
+		},
+	}
+}
+
+// serviceBackend returns the backend which listed the service of symbol.
+// The symbol is either a service or one of its methods.
+func (s *reflectionSession) serviceBackend(symbol string) (int, bool) {
+	if i, ok := s.services[symbol]; ok {
+		return i, true
+	}
+	if dot := strings.LastIndex(symbol, "."); dot > 0 {
+		i, ok := s.services[symbol[:dot]]
+		return i, ok
+	}
+	return 0, false
+}
+
+// ask sends req to backend i, opening its stream on first use. A failed
+// stream is dropped, so that it is opened again on next use.
+func (s *reflectionSession) ask(i int, req *rpb.ServerReflectionRequest) (*rpb.ServerReflectionResponse, error) {
+	if s.streams[i] == nil {
+		stream, err := rpb.NewServerReflectionClient(s.conns[i]).ServerReflectionInfo(s.ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.streams[i] = stream
+	}
+	err := s.streams[i].Send(req)
+	var resp *rpb.ServerReflectionResponse
+	if err == nil {
+		resp, err = s.streams[i].Recv()
+	}
+	if err != nil {
+		s.streams[i] = nil
+		return nil, err
+	}
+	return resp, nil
+}
+
+func reflectionError(code codes.Code, msg string) *rpb.ServerReflectionResponse {
+	return &rpb.ServerReflectionResponse{
+		MessageResponse: &rpb.ServerReflectionResponse_ErrorResponse{
+			ErrorResponse: &rpb.ErrorResponse{ErrorCode: int32(code), ErrorMessage: msg},
+		},
+	}
+}
+
+var _ rpb.ServerReflectionServer = (*ReflectionAggregator)(nil)
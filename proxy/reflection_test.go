@@ -0,0 +1,104 @@
+package proxy_test
+
+import (
+	"context"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// startReflectionBackend starts a server with reflection enabled, on which
+// register registers its services.
+func startReflectionBackend(t *testing.T, register func(*grpc.Server)) (*grpc.Server, *grpc.ClientConn) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	register(server)
+	reflection.Register(server)
+	go server.Serve(lis)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure(), proxy.DialOption())
+	require.NoError(t, err)
+	return server, conn
+}
+
+func TestRouterReflection(t *testing.T) {
+	s1, healthConn := startReflectionBackend(t, func(s *grpc.Server) {
+		healthpb.RegisterHealthServer(s, health.NewServer())
+	})
+	defer s1.Stop()
+	defer healthConn.Close()
+	s2, pingConn := startReflectionBackend(t, func(s *grpc.Server) {
+		pb.RegisterTestServiceServer(s, &pingService{})
+	})
+	defer s2.Stop()
+	defer pingConn.Close()
+
+	router := proxy.NewRouter()
+	router.AddBackend("a-ping", pingConn)
+	router.AddBackend("b-health", healthConn)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer(
+		proxy.ServerOption(),
+		grpc.UnknownServiceHandler(proxy.TransparentHandler(router.Direct)),
+	)
+	proxy.NewRouterReflection(router).Register(server)
+	go server.Serve(lis)
+	defer server.Stop()
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	require.NoError(t, err)
+	ask := func(req *rpb.ServerReflectionRequest) *rpb.ServerReflectionResponse {
+		require.NoError(t, stream.Send(req))
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := ask(&rpb.ServerReflectionRequest{MessageRequest: &rpb.ServerReflectionRequest_ListServices{}})
+	var names []string
+	for _, svc := range resp.GetListServicesResponse().GetService() {
+		names = append(names, svc.GetName())
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{
+		"grpc.health.v1.Health",
+		"grpc.reflection.v1alpha.ServerReflection",
+		"vgough.testproto.TestService",
+	}, names)
+
+	resp = ask(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: "grpc.health.v1.Health.Check"},
+	})
+	assert.Nil(t, resp.GetErrorResponse())
+	assert.NotEmpty(t, resp.GetFileDescriptorResponse().GetFileDescriptorProto())
+
+	resp = ask(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: "grpc/health/v1/health.proto"},
+	})
+	assert.Nil(t, resp.GetErrorResponse())
+	assert.NotEmpty(t, resp.GetFileDescriptorResponse().GetFileDescriptorProto())
+
+	resp = ask(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: "missing.proto"},
+	})
+	assert.NotNil(t, resp.GetErrorResponse())
+}
@@ -0,0 +1,550 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	dpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/mkxxx/grpc-proxy/proxy/inspect"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// maxErrorBody limits the part of an error response read for its message.
+const maxErrorBody = 64 << 10
+
+// Backend answers gRPC calls by calling an HTTP/JSON service.
+type Backend struct {
+	base     *url.URL
+	resolver inspect.Resolver
+
+	// Client sends the HTTP requests. It defaults to http.DefaultClient.
+	Client *http.Client
+
+	// Marshaler formats JSON requests. It defaults to using the original
+	// proto field names.
+	Marshaler *jsonpb.Marshaler
+
+	mu     sync.Mutex
+	lis    *proxy.InProcessListener
+	server *grpc.Server
+}
+
+// NewBackend returns a Backend calling the HTTP service at baseURL, such as
+// "http://users.internal:8080", with request and response messages decoded
+// using the method descriptors of resolver.
+func NewBackend(baseURL string, resolver inspect.Resolver) (*Backend, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("base URL %q is not http or https", baseURL)
+	}
+	return &Backend{
+		base:      base,
+		resolver:  resolver,
+		Client:    http.DefaultClient,
+		Marshaler: &jsonpb.Marshaler{OrigName: true},
+	}, nil
+}
+
+// BackendConfig returns the configuration of a proxy backend served by b,
+// for a proxy.BackendRegistry. The first call starts serving.
+func (b *Backend) BackendConfig() proxy.BackendConfig {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.lis == nil {
+		b.lis = proxy.NewInProcessListener()
+		b.server = grpc.NewServer(grpc.UnknownServiceHandler(b.Handle))
+		go b.server.Serve(b.lis)
+	}
+	return b.lis.BackendConfig()
+}
+
+// Close stops serving, failing calls in flight.
+func (b *Backend) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.server != nil {
+		b.server.Stop()
+		b.server, b.lis = nil, nil
+	}
+}
+
+// Handle serves a call as a grpc.StreamHandler, for use as the unknown
+// service handler of a grpc.Server.
+func (b *Backend) Handle(srv interface{}, stream grpc.ServerStream) error {
+	ctx := stream.Context()
+	method, ok := grpc.MethodFromServerStream(stream)
+	if !ok {
+		return status.Error(codes.Internal, "method name is unknown")
+	}
+	md, err := b.resolver.ResolveMethod(ctx, method)
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "failed resolving method %s: %v", method, err)
+	}
+	if md == nil {
+		return status.Errorf(codes.Unimplemented, "unknown method %s", method)
+	}
+	if md.IsClientStreaming() {
+		return status.Errorf(codes.Unimplemented, "client streaming method %s cannot be bridged", method)
+	}
+	bd, err := methodBinding(md)
+	if err != nil {
+		return status.Errorf(codes.Internal, "method %s: %v", method, err)
+	}
+
+	in := dynamic.NewMessage(md.GetInputType())
+	if err := stream.RecvMsg(in); err != nil {
+		return err
+	}
+	req, err := b.newRequest(ctx, bd, in)
+	if err != nil {
+		return err
+	}
+	resp, err := b.Client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return status.FromContextError(ctx.Err()).Err()
+		}
+		return status.Errorf(codes.Unavailable, "HTTP request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	header, trailer := responseMetadata(resp.Header)
+	stream.SetTrailer(trailer)
+	if err := stream.SetHeader(header); err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return responseError(resp)
+	}
+	if !md.IsServerStreaming() {
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return status.Errorf(codes.Unavailable, "failed reading HTTP response: %v", err)
+		}
+		out, err := decodeResponse(md.GetOutputType(), bd.responseBody, data)
+		if err != nil {
+			return err
+		}
+		return stream.SendMsg(out)
+	}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var data json.RawMessage
+		if err := dec.Decode(&data); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return status.Errorf(codes.Internal, "invalid JSON response: %v", err)
+		}
+		if err := streamError(data); err != nil {
+			return err
+		}
+		out, err := decodeResponse(md.GetOutputType(), bd.responseBody, data)
+		if err != nil {
+			return err
+		}
+		if err := stream.SendMsg(out); err != nil {
+			return err
+		}
+	}
+}
+
+// binding is the HTTP request of a method.
+type binding struct {
+	verb         string
+	path         string
+	body         string
+	responseBody string
+}
+
+// methodBinding returns the binding of the google.api.http annotation of
+// md, or else a POST of the whole request to the full method name.
+func methodBinding(md *desc.MethodDescriptor) (binding, error) {
+	opts := md.GetMethodOptions()
+	if opts == nil || !proto.HasExtension(opts, annotations.E_Http) {
+		path := "/" + md.GetService().GetFullyQualifiedName() + "/" + md.GetName()
+		return binding{verb: http.MethodPost, path: path, body: "*"}, nil
+	}
+	ext, err := proto.GetExtension(opts, annotations.E_Http)
+	if err != nil {
+		return binding{}, err
+	}
+	rule := ext.(*annotations.HttpRule)
+	bd := binding{body: rule.GetBody(), responseBody: rule.GetResponseBody()}
+	switch p := rule.GetPattern().(type) {
+	case *annotations.HttpRule_Get:
+		bd.verb, bd.path = http.MethodGet, p.Get
+	case *annotations.HttpRule_Put:
+		bd.verb, bd.path = http.MethodPut, p.Put
+	case *annotations.HttpRule_Post:
+		bd.verb, bd.path = http.MethodPost, p.Post
+	case *annotations.HttpRule_Delete:
+		bd.verb, bd.path = http.MethodDelete, p.Delete
+	case *annotations.HttpRule_Patch:
+		bd.verb, bd.path = http.MethodPatch, p.Patch
+	case *annotations.HttpRule_Custom:
+		bd.verb, bd.path = p.Custom.GetKind(), p.Custom.GetPath()
+	default:
+		return binding{}, fmt.Errorf("http rule has no pattern")
+	}
+	return bd, nil
+}
+
+// newRequest builds the HTTP request for msg. Fields bound to the path are
+// left out of the body, and without a "*" body the remaining scalar fields
+// are sent as query parameters.
+func (b *Backend) newRequest(ctx context.Context, bd binding, msg *dynamic.Message) (*http.Request, error) {
+	path, used, err := expandPath(bd.path, msg)
+	if err != nil {
+		return nil, err
+	}
+	for name := range used {
+		if !strings.Contains(name, ".") {
+			msg.ClearFieldByName(name)
+		}
+	}
+	var body []byte
+	if bd.body != "" {
+		if body, err = b.encodeBody(msg, bd.body); err != nil {
+			return nil, err
+		}
+	}
+	u := *b.base
+	u.RawQuery = ""
+	target := strings.TrimSuffix(u.String(), "/") + path
+	if bd.body != "*" {
+		if q := queryParams(msg, bd.body).Encode(); q != "" {
+			target += "?" + q
+		}
+	}
+
+	req, err := http.NewRequest(bd.verb, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "invalid HTTP request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header = requestHeaders(ctx)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// encodeBody returns the JSON of msg, or of its field for bodies other
+// than "*".
+func (b *Backend) encodeBody(msg *dynamic.Message, field string) ([]byte, error) {
+	data, err := msg.MarshalJSONPB(b.Marshaler)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed encoding request: %v", err)
+	}
+	if field == "*" {
+		return data, nil
+	}
+	fd := msg.GetMessageDescriptor().FindFieldByName(field)
+	if fd == nil {
+		return nil, status.Errorf(codes.Internal, "unknown body field %q", field)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed encoding request: %v", err)
+	}
+	name := fd.GetJSONName()
+	if b.Marshaler.OrigName {
+		name = fd.GetName()
+	}
+	if v, ok := fields[name]; ok {
+		return v, nil
+	}
+	return []byte("null"), nil
+}
+
+// expandPath fills the variables of a path template, such as
+// "/v1/{name=shelves/*}/books/{book}", with fields of msg. It returns the
+// expanded escaped path and the fields used.
+func expandPath(tmpl string, msg *dynamic.Message) (string, map[string]bool, error) {
+	var buf strings.Builder
+	used := make(map[string]bool)
+	for {
+		i := strings.IndexByte(tmpl, '{')
+		if i < 0 {
+			buf.WriteString(tmpl)
+			return buf.String(), used, nil
+		}
+		end := strings.IndexByte(tmpl[i:], '}')
+		if end < 0 {
+			return "", nil, status.Errorf(codes.Internal, "unterminated variable in path template %q", tmpl)
+		}
+		buf.WriteString(tmpl[:i])
+		field := tmpl[i+1 : i+end]
+		if k := strings.IndexByte(field, '='); k >= 0 {
+			field = field[:k]
+		}
+		v, err := fieldString(msg, strings.Split(field, "."))
+		if err != nil {
+			return "", nil, err
+		}
+		if v == "" {
+			return "", nil, status.Errorf(codes.InvalidArgument, "path field %s is empty", field)
+		}
+		used[field] = true
+		buf.WriteString(escapedPath(v))
+		tmpl = tmpl[i+end+1:]
+	}
+}
+
+// escapedPath escapes the segments of a field value, keeping the slashes of
+// multi-segment variables such as {name=shelves/*}.
+func escapedPath(path string) string {
+	segs := strings.Split(path, "/")
+	for i, seg := range segs {
+		segs[i] = url.PathEscape(seg)
+	}
+	return strings.Join(segs, "/")
+}
+
+// fieldString returns the value of a nested scalar field as a string.
+func fieldString(msg *dynamic.Message, path []string) (string, error) {
+	for i, name := range path {
+		fd := msg.GetMessageDescriptor().FindFieldByName(name)
+		if fd == nil || fd.IsRepeated() {
+			return "", status.Errorf(codes.Internal, "path field %s is not a singular field", strings.Join(path, "."))
+		}
+		v := msg.GetField(fd)
+		if i == len(path)-1 {
+			return scalarString(fd, v), nil
+		}
+		next, ok := v.(*dynamic.Message)
+		if !ok {
+			return "", status.Errorf(codes.Internal, "path field %s is not a message", strings.Join(path[:i+1], "."))
+		}
+		msg = next
+	}
+	return "", nil
+}
+
+func scalarString(fd *desc.FieldDescriptor, v interface{}) string {
+	switch v := v.(type) {
+	case []byte:
+		return base64.URLEncoding.EncodeToString(v)
+	case int32:
+		if fd.GetType() == dpb.FieldDescriptorProto_TYPE_ENUM {
+			if ev := fd.GetEnumType().FindValueByNumber(v); ev != nil {
+				return ev.GetName()
+			}
+		}
+	}
+	return fmt.Sprint(v)
+}
+
+// queryParams returns the set scalar fields of msg other than the body
+// field. The path fields were already cleared.
+func queryParams(msg *dynamic.Message, body string) url.Values {
+	q := url.Values{}
+	for _, fd := range msg.GetKnownFields() {
+		name := fd.GetName()
+		if name == body || fd.IsMap() || fd.GetMessageType() != nil || !msg.HasField(fd) {
+			continue
+		}
+		if !fd.IsRepeated() {
+			q.Add(name, scalarString(fd, msg.GetField(fd)))
+			continue
+		}
+		n := msg.FieldLength(fd)
+		for i := 0; i < n; i++ {
+			q.Add(name, scalarString(fd, msg.GetRepeatedField(fd, i)))
+		}
+	}
+	return q
+}
+
+// reservedMetadata is not sent as HTTP headers.
+var reservedMetadata = map[string]bool{
+	"content-type":   true,
+	"content-length": true,
+	"connection":     true,
+	"te":             true,
+	"host":           true,
+	"user-agent":     true,
+	"accept":         true,
+	"grpc-timeout":   true,
+	"grpc-encoding":  true,
+}
+
+// requestHeaders returns the incoming metadata of ctx as HTTP headers.
+func requestHeaders(ctx context.Context) http.Header {
+	h := http.Header{}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for k, values := range md {
+		if strings.HasPrefix(k, ":") || reservedMetadata[k] {
+			continue
+		}
+		for _, v := range values {
+			if strings.HasSuffix(k, "-bin") {
+				v = base64.RawStdEncoding.EncodeToString([]byte(v))
+			}
+			h.Add(k, v)
+		}
+	}
+	return h
+}
+
+// responseMetadata returns the metadata carried by Grpc-Metadata-<key> and
+// Grpc-Trailer-<key> response headers, as written by proxy.Transcoder.
+func responseMetadata(h http.Header) (header, trailer metadata.MD) {
+	header, trailer = metadata.MD{}, metadata.MD{}
+	for k, values := range h {
+		k = strings.ToLower(k)
+		md := header
+		switch {
+		case strings.HasPrefix(k, "grpc-metadata-"):
+			k = strings.TrimPrefix(k, "grpc-metadata-")
+		case strings.HasPrefix(k, "grpc-trailer-"):
+			k, md = strings.TrimPrefix(k, "grpc-trailer-"), trailer
+		default:
+			continue
+		}
+		for _, v := range values {
+			if strings.HasSuffix(k, "-bin") {
+				if b, err := decodeBase64(v); err == nil {
+					v = string(b)
+				}
+			}
+			md[k] = append(md[k], v)
+		}
+	}
+	return header, trailer
+}
+
+func decodeBase64(v string) ([]byte, error) {
+	if len(v)%4 == 0 {
+		return base64.StdEncoding.DecodeString(v)
+	}
+	return base64.RawStdEncoding.DecodeString(v)
+}
+
+// decodeResponse decodes a JSON response, or the JSON of its field
+// responseBody, into a message of type md.
+func decodeResponse(md *desc.MessageDescriptor, responseBody string, data []byte) (*dynamic.Message, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		data = []byte("{}")
+	}
+	if responseBody != "" {
+		wrapped, err := json.Marshal(map[string]json.RawMessage{responseBody: data})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "invalid JSON response: %v", err)
+		}
+		data = wrapped
+	}
+	out := dynamic.NewMessage(md)
+	u := jsonpb.Unmarshaler{AllowUnknownFields: true}
+	if err := out.UnmarshalJSONPB(&u, data); err != nil {
+		return nil, status.Errorf(codes.Internal, "invalid JSON response: %v", err)
+	}
+	return out, nil
+}
+
+// errorBody is a JSON error response, as written by proxy.Transcoder.
+type errorBody struct {
+	Code    *int   `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *errorBody) status(fallback codes.Code) error {
+	code := fallback
+	if e.Code != nil && *e.Code > 0 && *e.Code <= 16 {
+		code = codes.Code(*e.Code)
+	}
+	return status.Error(code, e.Message)
+}
+
+// responseError returns the status of an error response.
+func responseError(resp *http.Response) error {
+	code := CodeFromHTTPStatus(resp.StatusCode)
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	var e errorBody
+	if json.Unmarshal(data, &e) == nil && e.Message != "" {
+		return e.status(code)
+	}
+	msg := strings.TrimSpace(string(data))
+	if msg == "" {
+		msg = http.StatusText(resp.StatusCode)
+	}
+	return status.Errorf(code, "HTTP status %d: %s", resp.StatusCode, msg)
+}
+
+// streamError returns the in-band error of a streaming response, written
+// by proxy.Transcoder as {"error": {"code": 5, "message": "..."}}.
+func streamError(data []byte) error {
+	var line struct {
+		Error *errorBody `json:"error"`
+	}
+	if json.Unmarshal(data, &line) != nil || line.Error == nil {
+		return nil
+	}
+	return line.Error.status(codes.Unknown)
+}
+
+// CodeFromHTTPStatus returns the gRPC status code for an HTTP status code,
+// the reverse of proxy.HTTPStatusFromCode.
+func CodeFromHTTPStatus(code int) codes.Code {
+	switch code {
+	case http.StatusOK:
+		return codes.OK
+	case 499:
+		return codes.Canceled
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.AlreadyExists
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusPreconditionFailed:
+		return codes.FailedPrecondition
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusServiceUnavailable, http.StatusBadGateway:
+		return codes.Unavailable
+	}
+	switch {
+	case code >= 200 && code < 300:
+		return codes.OK
+	case code >= 400 && code < 500:
+		return codes.FailedPrecondition
+	case code >= 500:
+		return codes.Internal
+	}
+	return codes.Unknown
+}
@@ -0,0 +1,219 @@
+package rest_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/mkxxx/grpc-proxy/proxy/inspect"
+	"github.com/mkxxx/grpc-proxy/proxy/rest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// annotatedFiles returns the TestService with HTTP bindings added to its
+// methods. PingEmpty is left without a binding.
+func annotatedFiles(t *testing.T) *inspect.FileResolver {
+	files, err := inspect.ParseFiles([]string{"../../testservice"}, "test.proto")
+	require.NoError(t, err)
+	md, err := files.ResolveMethod(context.Background(), "/vgough.testproto.TestService/Ping")
+	require.NoError(t, err)
+	rules := map[string]*annotations.HttpRule{
+		"Ping":      {Pattern: &annotations.HttpRule_Get{Get: "/v1/ping/{value}"}},
+		"PingError": {Pattern: &annotations.HttpRule_Post{Post: "/v1/{value=errors/**}:fail"}, Body: "*"},
+		"PingList":  {Pattern: &annotations.HttpRule_Get{Get: "/v1/list"}},
+	}
+	for _, m := range md.GetService().GetMethods() {
+		if rule, ok := rules[m.GetName()]; ok {
+			opts := &dpb.MethodOptions{}
+			require.NoError(t, proto.SetExtension(opts, annotations.E_Http, rule))
+			m.AsMethodDescriptorProto().Options = opts
+		}
+	}
+	return files
+}
+
+// startProxy starts a proxy whose only backend is a rest.Backend calling
+// the HTTP service h.
+func startProxy(t *testing.T, h http.Handler) (pb.TestServiceClient, func()) {
+	httpServer := httptest.NewServer(h)
+	backend, err := rest.NewBackend(httpServer.URL, annotatedFiles(t))
+	require.NoError(t, err)
+
+	reg := proxy.NewBackendRegistry()
+	reg.Register("legacy", backend.BackendConfig())
+	director := reg.Director(func(ctx context.Context, method string) (string, error) {
+		return "legacy", nil
+	})
+	server := grpc.NewServer(
+		proxy.ServerOption(),
+		grpc.UnknownServiceHandler(proxy.TransparentHandler(director)),
+	)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(lis)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	return pb.NewTestServiceClient(conn), func() {
+		conn.Close()
+		server.Stop()
+		reg.Close()
+		backend.Close()
+		httpServer.Close()
+	}
+}
+
+func testCtx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 10*time.Second)
+}
+
+func TestBackend_Unary(t *testing.T) {
+	client, stop := startProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.EscapedPath() != "/v1/ping/a%20b" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Grpc-Metadata-x-served-by", "legacy")
+		w.Header().Set("Grpc-Trailer-x-cost", "3")
+		fmt.Fprintf(w, `{"Value": %q, "counter": 7, "unknown": true}`, r.Header.Get("x-user"))
+	}))
+	defer stop()
+	ctx, cancel := testCtx()
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-user", "alice")
+
+	var header, trailer metadata.MD
+	out, err := client.Ping(ctx, &pb.PingRequest{Value: "a b"}, grpc.Header(&header), grpc.Trailer(&trailer))
+	require.NoError(t, err)
+	assert.Equal(t, "alice", out.Value, "metadata is sent as headers")
+	assert.EqualValues(t, 7, out.Counter)
+	assert.Equal(t, []string{"legacy"}, header.Get("x-served-by"))
+	assert.Equal(t, []string{"3"}, trailer.Get("x-cost"))
+}
+
+func TestBackend_DefaultBinding(t *testing.T) {
+	client, stop := startProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/vgough.testproto.TestService/PingEmpty" {
+			http.NotFound(w, r)
+			return
+		}
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		w.Write([]byte(`{"Value": "empty"}`))
+	}))
+	defer stop()
+	ctx, cancel := testCtx()
+	defer cancel()
+
+	out, err := client.PingEmpty(ctx, &pb.Empty{})
+	require.NoError(t, err)
+	assert.Equal(t, "empty", out.Value)
+}
+
+func TestBackend_Errors(t *testing.T) {
+	client, stop := startProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/v1/errors/missing:fail":
+			assert.JSONEq(t, `{}`, string(body), "path fields are not repeated in the body")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message": "no such thing"}`))
+		case "/v1/errors/typed:fail":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"code": 9, "message": "not now"}`))
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("upstream is down\n"))
+		}
+	}))
+	defer stop()
+	ctx, cancel := testCtx()
+	defer cancel()
+
+	tests := []struct {
+		value string
+		code  codes.Code
+		msg   string
+	}{
+		{"errors/missing", codes.NotFound, "no such thing"},
+		{"errors/typed", codes.FailedPrecondition, "not now"},
+		{"errors/other", codes.Unavailable, "HTTP status 502: upstream is down"},
+	}
+	for _, tc := range tests {
+		_, err := client.PingError(ctx, &pb.PingRequest{Value: tc.value})
+		assert.Equal(t, tc.code, status.Code(err), tc.value)
+		assert.Equal(t, tc.msg, status.Convert(err).Message(), tc.value)
+	}
+	_, err := client.PingError(ctx, &pb.PingRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "path fields must be set")
+}
+
+func TestBackend_ServerStreaming(t *testing.T) {
+	client, stop := startProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/list", r.URL.Path)
+		value := r.URL.Query().Get("value")
+		enc := json.NewEncoder(w)
+		for i := 1; i <= 2; i++ {
+			enc.Encode(map[string]interface{}{"Value": value, "counter": i})
+		}
+		enc.Encode(map[string]interface{}{"error": map[string]interface{}{"code": 8, "message": "enough"}})
+	}))
+	defer stop()
+	ctx, cancel := testCtx()
+	defer cancel()
+
+	stream, err := client.PingList(ctx, &pb.PingRequest{Value: "q"})
+	require.NoError(t, err)
+	for i := 1; i <= 2; i++ {
+		out, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, "q", out.Value, "fields are sent as query parameters")
+		assert.EqualValues(t, i, out.Counter)
+	}
+	_, err = stream.Recv()
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "in-band errors end the stream")
+	assert.Equal(t, "enough", status.Convert(err).Message())
+}
+
+func TestBackend_ClientStreaming(t *testing.T) {
+	client, stop := startProxy(t, http.NotFoundHandler())
+	defer stop()
+	ctx, cancel := testCtx()
+	defer cancel()
+
+	stream, err := client.PingStream(ctx)
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.NotEqual(t, io.EOF, err)
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestNewBackend(t *testing.T) {
+	_, err := rest.NewBackend("ftp://example.com", annotatedFiles(t))
+	assert.Error(t, err)
+}
+
+func TestCodeFromHTTPStatus(t *testing.T) {
+	for _, code := range []codes.Code{codes.InvalidArgument, codes.NotFound, codes.PermissionDenied,
+		codes.Unauthenticated, codes.ResourceExhausted, codes.Unimplemented, codes.Unavailable, codes.DeadlineExceeded} {
+		assert.Equal(t, code, rest.CodeFromHTTPStatus(proxy.HTTPStatusFromCode(code)), code.String())
+	}
+	assert.Equal(t, codes.FailedPrecondition, rest.CodeFromHTTPStatus(http.StatusGone))
+	assert.Equal(t, codes.Internal, rest.CodeFromHTTPStatus(http.StatusInternalServerError))
+}
@@ -0,0 +1,32 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+/*
+Package rest bridges gRPC calls to HTTP/1.1 JSON services, so that legacy
+REST services can sit behind a gRPC façade.
+
+A Backend decodes the request of a call using its method descriptor, issues
+the HTTP request given by the google.api.http annotation of the method, and
+encodes the JSON response back to the response message. It is the reverse
+of proxy.Transcoder. Methods without an annotation are posted as JSON to
+the full method name, such as "/users.UserService/Get".
+
+Backends are served in process and registered like any other backend:
+
+	files, err := inspect.ParseFiles([]string{"protos"}, "users/users.proto")
+	...
+	legacy, err := rest.NewBackend("http://users-legacy.internal:8080", files)
+	...
+	registry.Register("users", legacy.BackendConfig())
+
+Incoming metadata is sent as HTTP request headers. Response headers named
+Grpc-Metadata-<key> and Grpc-Trailer-<key> are returned as header and
+trailer metadata. Error responses are mapped to the gRPC status matching
+their HTTP status, with the message of a JSON error body such as
+{"code": 5, "message": "user not found"}.
+
+Unary and server streaming methods are supported. Server streaming
+responses are read as one JSON object per line.
+*/
+package rest
@@ -0,0 +1,208 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPolicy describes how failed backend calls are retried.
+//
+// Retries only apply to the methods listed in Methods, which must be unary or
+// server-streaming: the proxy reads the request of the client up to its
+// half-close before opening the backend stream, and replays it on every
+// attempt. Streams which send more than one message are forwarded once,
+// without retries. Streams of other methods are forwarded right away, so
+// that bidirectional streams, where the client waits for a response before
+// sending more, are not held up.
+type RetryPolicy struct {
+	// Methods lists the prefixes of the full method names which are
+	// retried, such as "/pkg.Service/Get". The proxy cannot tell the type
+	// of a method, so these must only match unary and server-streaming
+	// methods.
+	Methods []string
+
+	// MaxAttempts is the total number of attempts, including the original
+	// call. Values less than 2 disable retries.
+	MaxAttempts int
+
+	// InitialBackoff is the upper bound of the randomized delay before the
+	// first retry.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the delay between attempts. Zero means no cap.
+	MaxBackoff time.Duration
+
+	// BackoffMultiplier grows the delay after each attempt. Defaults to 2.
+	BackoffMultiplier float64
+
+	// RetryableCodes lists the status codes which trigger a retry. Defaults
+	// to codes.Unavailable.
+	RetryableCodes []codes.Code
+}
+
+// WithRetry enables retrying of the backend calls of policy.Methods using
+// the given policy.
+func WithRetry(policy RetryPolicy) Option {
+	return func(o *options) {
+		o.retry = &policy
+	}
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	code := status.Code(err)
+	if len(p.RetryableCodes) == 0 {
+		return code == codes.Unavailable
+	}
+	for _, c := range p.RetryableCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// retries reports whether calls to method are retried.
+func (p *RetryPolicy) retries(method string) bool {
+	if p.MaxAttempts < 2 {
+		return false
+	}
+	for _, prefix := range p.Methods {
+		if strings.HasPrefix(method, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay before the given retry, starting at 1.
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	mult := p.BackoffMultiplier
+	if mult <= 0 {
+		mult = 2
+	}
+	d := float64(p.InitialBackoff) * math.Pow(mult, float64(retry-1))
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	if d < 1 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// newStream opens a backend stream for the call, retrying failed attempts of
+// unary-style calls according to the policy.
+//
+// The returned stream has already received the first response message (or
+// final status), so nothing has been relayed to the client yet when an
+// attempt is retried.
+func (p *RetryPolicy) newStream(ctx context.Context, in grpc.ServerStream, conn *grpc.ClientConn, method string, callOpts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if !p.retries(method) {
+		return replayStream(ctx, conn, method, nil, false, callOpts...)
+	}
+	req, unary, err := bufferRequest(in, 1)
+	if err != nil {
+		return nil, err
+	}
+	if !unary {
+		return replayStream(ctx, conn, method, req, false, callOpts...)
+	}
+
+	for attempt := 1; ; attempt++ {
+		out, err := replayStream(ctx, conn, method, req, true, callOpts...)
+		if err == nil {
+			first := &frame{}
+			err = out.RecvMsg(first)
+			if err == nil || err == io.EOF || attempt >= p.MaxAttempts || !p.retryable(err) {
+				return &primedClientStream{ClientStream: out, first: first, err: err, primed: true}, nil
+			}
+		} else if attempt >= p.MaxAttempts || !p.retryable(err) {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		case <-time.After(p.backoff(attempt)):
+		}
+	}
+}
+
+// bufferRequest reads up to max messages from the client. The returned bool
+// reports whether the client half-closed within that limit.
+func bufferRequest(in grpc.ServerStream, max int) ([]*frame, bool, error) {
+	var req []*frame
+	for len(req) <= max {
+		f := &frame{}
+		if err := in.RecvMsg(f); err != nil {
+			if err == io.EOF {
+				return req, true, nil
+			}
+			return nil, false, err
+		}
+		req = append(req, f)
+	}
+	return req, false, nil
+}
+
+// replayStream opens a new backend stream and sends the buffered request
+// messages. If closeSend is set, the stream is half-closed afterwards.
+func replayStream(ctx context.Context, conn *grpc.ClientConn, method string, req []*frame, closeSend bool, callOpts ...grpc.CallOption) (grpc.ClientStream, error) {
+	out, err := grpc.NewClientStream(ctx, clientStreamDescForProxying, conn, method, callOpts...)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range req {
+		if err := out.SendMsg(f); err != nil {
+			if err == io.EOF {
+				// The backend has already finished; its status is available
+				// from RecvMsg.
+				break
+			}
+			return nil, err
+		}
+	}
+	if closeSend {
+		if err := out.CloseSend(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// primedClientStream is a ClientStream where the first message (or error) has
+// already been received from the backend.
+type primedClientStream struct {
+	grpc.ClientStream
+	first  *frame
+	err    error
+	primed bool
+}
+
+func (s *primedClientStream) RecvMsg(m interface{}) error {
+	if !s.primed {
+		return s.ClientStream.RecvMsg(m)
+	}
+	s.primed = false
+	if s.err != nil {
+		return s.err
+	}
+	f, ok := m.(*frame)
+	if !ok {
+		return status.Errorf(codes.Internal, "unexpected message type %T", m)
+	}
+	f.payload = s.first.payload
+	return nil
+}
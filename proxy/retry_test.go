@@ -0,0 +1,127 @@
+package proxy_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// flakyService fails the first `failures` Ping calls with the given code.
+func flakyService(failures int32, code codes.Code, calls *int32) *pingService {
+	return &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			if atomic.AddInt32(calls, 1) <= failures {
+				return nil, status.Error(code, "try again")
+			}
+			return &pb.PingResponse{Value: ping.Value}, nil
+		},
+	}
+}
+
+func TestRetry_RecoversFromTransientFailures(t *testing.T) {
+	var calls int32
+	env := newTestEnv(t, flakyService(2, codes.Unavailable, &calls), proxy.WithRetry(proxy.RetryPolicy{
+		Methods:        []string{"/vgough.testproto.TestService/Ping"},
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+	}))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	out, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err, "third attempt should succeed")
+	assert.Equal(t, "foo", out.Value)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&calls))
+}
+
+func TestRetry_GivesUpAfterMaxAttempts(t *testing.T) {
+	var calls int32
+	env := newTestEnv(t, flakyService(5, codes.Unavailable, &calls), proxy.WithRetry(proxy.RetryPolicy{
+		Methods:        []string{"/vgough.testproto.TestService/Ping"},
+		MaxAttempts:    2,
+		InitialBackoff: time.Millisecond,
+	}))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.Error(t, err)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+}
+
+func TestRetry_IgnoresNonRetryableCodes(t *testing.T) {
+	var calls int32
+	env := newTestEnv(t, flakyService(1, codes.InvalidArgument, &calls), proxy.WithRetry(proxy.RetryPolicy{
+		Methods:        []string{"/vgough.testproto.TestService/Ping"},
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+	}))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+}
+
+func TestRetry_StreamsAreForwardedOnce(t *testing.T) {
+	env := newTestEnv(t, &pingService{}, proxy.WithRetry(proxy.RetryPolicy{
+		Methods: []string{
+			"/vgough.testproto.TestService/PingEmpty",
+			"/vgough.testproto.TestService/PingError",
+		},
+		MaxAttempts: 3,
+	}))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	stream, err := env.client.PingStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.PingRequest{Value: "foo"}))
+	resp, err := stream.Recv()
+	require.NoError(t, err, "streams outside Methods are not buffered")
+	assert.EqualValues(t, 0, resp.Counter)
+	for i := 1; i < 3; i++ {
+		require.NoError(t, stream.Send(&pb.PingRequest{Value: "foo"}))
+	}
+	require.NoError(t, stream.CloseSend())
+	for i := 1; i < 3; i++ {
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		assert.EqualValues(t, i, resp.Counter)
+	}
+}
+
+func TestRetry_PingPongStream(t *testing.T) {
+	env := newTestEnv(t, &pingService{}, proxy.WithRetry(proxy.RetryPolicy{
+		Methods:     []string{"/vgough.testproto.TestService/PingError"},
+		MaxAttempts: 3,
+	}))
+	defer env.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := env.client.PingStream(ctx)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, stream.Send(&pb.PingRequest{Value: "foo"}))
+		resp, err := stream.Recv()
+		require.NoError(t, err, "each message must be answered before the next is sent")
+		assert.EqualValues(t, i, resp.Counter)
+	}
+	require.NoError(t, stream.CloseSend())
+}
@@ -0,0 +1,123 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// MetadataRules is a declarative set of metadata transformations. Rules are
+// applied in field order: keys are dropped, then renamed, then Set and Add
+// are applied. Keys are case insensitive.
+//
+// Values of Set and Add may reference variables as ${name}, which expand to
+// an empty string when unknown:
+//
+//	${method}       the full method name requested by the client
+//	${peer}         the IP address of the client
+//	${authority}    the :authority requested by the client
+//	${backend}      the target of the backend connection
+//	${hostname}     the host name of the proxy
+//	${md:<key>}     the first value of an incoming metadata key
+type MetadataRules struct {
+	// Drop lists keys to remove.
+	Drop []string
+
+	// Rename maps keys to their new name. Values are appended to any
+	// existing values of the new key.
+	Rename map[string]string
+
+	// Set replaces the values of keys.
+	Set map[string]string
+
+	// Add appends values to keys.
+	Add map[string]string
+}
+
+// WithRequestMetadataRules applies rules to the metadata sent to backends.
+func WithRequestMetadataRules(rules MetadataRules) Option {
+	return func(o *options) {
+		o.requestRules = append(o.requestRules, rules)
+	}
+}
+
+// WithResponseMetadataRules applies rules to the headers and trailers sent to
+// clients. They apply after any response metadata hooks.
+func WithResponseMetadataRules(rules MetadataRules) Option {
+	return func(o *options) {
+		o.responseRules = append(o.responseRules, rules)
+	}
+}
+
+// apply transforms md in place.
+func (r *MetadataRules) apply(md metadata.MD, vars func(string) string) {
+	for _, k := range r.Drop {
+		delete(md, strings.ToLower(k))
+	}
+	for from, to := range r.Rename {
+		from, to = strings.ToLower(from), strings.ToLower(to)
+		if v, ok := md[from]; ok && from != to {
+			delete(md, from)
+			md[to] = append(md[to], v...)
+		}
+	}
+	for k, v := range r.Set {
+		md.Set(k, os.Expand(v, vars))
+	}
+	for k, v := range r.Add {
+		md.Append(k, os.Expand(v, vars))
+	}
+}
+
+var hostname, _ = os.Hostname()
+
+// metadataVars returns the variables available to rules for a stream.
+func metadataVars(ps *proxiedStream, incoming metadata.MD) func(string) string {
+	return func(name string) string {
+		switch name {
+		case "method":
+			return ps.method
+		case "peer":
+			return ps.peerIP
+		case "backend":
+			return ps.backend
+		case "hostname":
+			return hostname
+		case "authority":
+			name = "md::authority"
+		}
+		if strings.HasPrefix(name, "md:") {
+			if v := incoming.Get(name[len("md:"):]); len(v) != 0 {
+				return v[0]
+			}
+		}
+		return ""
+	}
+}
+
+// applyRequestRules rewrites the outgoing metadata of ctx.
+func applyRequestRules(ctx context.Context, rules []MetadataRules, vars func(string) string) context.Context {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	for i := range rules {
+		rules[i].apply(md, vars)
+	}
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// responseRulesHook returns a MetadataHook applying rules to the response
+// metadata of a stream.
+func responseRulesHook(rules []MetadataRules, vars func(string) string) MetadataHook {
+	return func(ctx context.Context, md metadata.MD) metadata.MD {
+		for i := range rules {
+			rules[i].apply(md, vars)
+		}
+		return md
+	}
+}
@@ -0,0 +1,74 @@
+package proxy_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestRequestMetadataRules(t *testing.T) {
+	received := make(chan metadata.MD, 1)
+	svc := &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			md, _ := metadata.FromIncomingContext(ctx)
+			received <- md
+			return &pb.PingResponse{Value: ping.Value}, nil
+		},
+	}
+	env := newTestEnv(t, svc, proxy.WithRequestMetadataRules(proxy.MetadataRules{
+		Drop:   []string{"Authorization"},
+		Rename: map[string]string{"x-user": "x-forwarded-user"},
+		Set: map[string]string{
+			"x-proxy-id": "proxy-1",
+			"x-route":    "${method} from ${peer} via ${md:x-tenant}",
+		},
+		Add: map[string]string{"x-tenant": "default"},
+	}))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	ctx = metadata.AppendToOutgoingContext(ctx,
+		"authorization", "Bearer secret",
+		"x-user", "alice",
+		"x-tenant", "acme",
+	)
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err)
+
+	md := <-received
+	assert.Empty(t, md.Get("authorization"))
+	assert.Empty(t, md.Get("x-user"))
+	assert.Equal(t, []string{"alice"}, md.Get("x-forwarded-user"))
+	assert.Equal(t, []string{"proxy-1"}, md.Get("x-proxy-id"))
+	assert.Equal(t, []string{"/vgough.testproto.TestService/Ping from 127.0.0.1 via acme"}, md.Get("x-route"))
+	assert.Equal(t, []string{"acme", "default"}, md.Get("x-tenant"))
+}
+
+func TestResponseMetadataRules(t *testing.T) {
+	env := newTestEnv(t, metadataService(), proxy.WithResponseMetadataRules(proxy.MetadataRules{
+		Drop:   []string{"x-secret", "x-secret-trailer"},
+		Rename: map[string]string{"x-header": "x-backend-header"},
+		Set:    map[string]string{"x-served-by": "${backend}"},
+	}))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	var header, trailer metadata.MD
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"}, grpc.Header(&header), grpc.Trailer(&trailer))
+	require.NoError(t, err)
+	assert.Empty(t, header.Get("x-secret"))
+	assert.Empty(t, header.Get("x-header"))
+	assert.Equal(t, []string{"h"}, header.Get("x-backend-header"))
+	assert.Equal(t, []string{env.backendConn.Target()}, header.Get("x-served-by"))
+	assert.Empty(t, trailer.Get("x-secret-trailer"))
+	assert.Equal(t, []string{env.backendConn.Target()}, trailer.Get("x-served-by"))
+}
@@ -0,0 +1,341 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Route is a routing rule which sends matching calls to a named backend.
+// All non-empty fields must match for the route to apply.
+type Route struct {
+	// MethodPrefix matches the beginning of the full method name, which is in
+	// the form "/service/method".
+	MethodPrefix string
+
+	// Authority matches the :authority of the call.
+	Authority string
+
+	// Metadata lists metadata keys which must be present in the call. If a
+	// value is not empty, the key must also have that value.
+	Metadata map[string]string
+
+	// Backend is the name of the backend which receives matching calls.
+	Backend string
+
+	// Split, if set, divides matching calls among several backends in
+	// proportion to their weights instead, such as 95% to a stable version
+	// and 5% to a canary.
+	Split []BackendWeight
+
+	// MethodSplits overrides Split for the methods with the given prefixes.
+	// The longest matching prefix wins.
+	MethodSplits map[string][]BackendWeight
+
+	// Name identifies the route for SetSplit.
+	Name string
+
+	// Credentials, if set, authenticate the proxy to the backends of the
+	// route, see Direction.Credentials.
+	Credentials credentials.PerRPCCredentials
+
+	// MetadataLimits, if set, replace the limits of WithMetadataLimits for
+	// calls of the route, see Direction.MetadataLimits.
+	MetadataLimits MetadataLimits
+}
+
+// BackendWeight is the share of a backend in the calls of a Route.
+type BackendWeight struct {
+	Backend string
+	Weight  int
+}
+
+// split returns the backend weights for method, or nil if the route sends
+// all calls to Backend.
+func (r *Route) split(method string) []BackendWeight {
+	best := -1
+	var split []BackendWeight
+	for prefix, s := range r.MethodSplits {
+		if len(prefix) > best && strings.HasPrefix(method, prefix) {
+			best, split = len(prefix), s
+		}
+	}
+	if len(split) != 0 {
+		return split
+	}
+	return r.Split
+}
+
+func (r *Route) matches(method string, md metadata.MD) bool {
+	if !strings.HasPrefix(method, r.MethodPrefix) {
+		return false
+	}
+	if r.Authority != "" && !hasValue(md.Get(":authority"), r.Authority) {
+		return false
+	}
+	for k, v := range r.Metadata {
+		values := md.Get(k)
+		if len(values) == 0 || (v != "" && !hasValue(values, v)) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasValue(values []string, want string) bool {
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
+
+// Router is a StreamDirector built from a table of routes. Routes are
+// evaluated in the order they were added, and the first match wins.
+//
+// A Router is safe for concurrent use, routes and backends may be changed
+// while it is serving.
+type Router struct {
+	mu       sync.RWMutex
+	routes   []Route
+	backends map[string]Balancer
+	draining map[string]bool
+
+	// calls are the in-flight calls of named routes, for switchovers.
+	callsMu     sync.Mutex
+	calls       map[*routedCall]struct{}
+	switchovers []*Switchover
+}
+
+// NewRouter returns an empty Router.
+func NewRouter() *Router {
+	return &Router{backends: make(map[string]Balancer), draining: make(map[string]bool)}
+}
+
+// AddBackend registers a backend connection under the given name, replacing
+// any previous backend with that name.
+//
+// The connection must use the proxy codec, see Codec.
+func (r *Router) AddBackend(name string, conn *grpc.ClientConn) {
+	r.AddBalancedBackend(name, NewRoundRobinBalancer(Endpoints(conn)...))
+}
+
+// AddBalancedBackend registers a backend under the given name whose
+// connection is picked by b for every call, replacing any previous backend
+// with that name.
+func (r *Router) AddBalancedBackend(name string, b Balancer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.backends[name] = b
+}
+
+// RemoveBackend removes the named backend. Calls routed to it fail with
+// codes.Unavailable.
+func (r *Router) RemoveBackend(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.backends, name)
+}
+
+// AddRoute appends a route to the routing table.
+func (r *Router) AddRoute(route Route) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes = append(r.routes, route)
+}
+
+// Replace atomically replaces the routing table and all backends. Calls
+// directed after Replace returns use only the new routes and backends.
+func (r *Router) Replace(routes []Route, backends map[string]Balancer) {
+	newBackends := make(map[string]Balancer, len(backends))
+	for name, b := range backends {
+		newBackends[name] = b
+	}
+	newRoutes := append([]Route(nil), routes...)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes = newRoutes
+	r.backends = newBackends
+}
+
+// Direct implements StreamDirector.
+//
+// Calls which match no route are rejected with codes.Unimplemented. Calls
+// routed to a backend which is not registered fail with codes.Unavailable.
+// Routes to draining backends are skipped, so calls go to the next matching
+// route, or fail with codes.Unavailable if there is none. Draining backends
+// of a split get no share of its calls.
+func (r *Router) Direct(ctx context.Context, method string) (context.Context, context.CancelFunc, Direction, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	drained := ""
+	for i := range r.routes {
+		route := &r.routes[i]
+		if !route.matches(method, md) {
+			continue
+		}
+		name, ok := r.pickBackend(route, method)
+		if !ok {
+			if drained == "" {
+				drained = name
+			}
+			continue
+		}
+		b, ok := r.backends[name]
+		if !ok {
+			return ctx, nil, Direction{}, status.Errorf(codes.Unavailable, "backend %q is not available", name)
+		}
+		conn, done, err := b.Pick(ctx, method)
+		if err != nil {
+			return ctx, nil, Direction{}, err
+		}
+		if route.Name != "" {
+			ctx, cancel, dir, err := r.track(ctx, route.Name, name, conn, done)
+			dir.Credentials = route.Credentials
+			dir.MetadataLimits = route.MetadataLimits
+			return ctx, cancel, dir, err
+		}
+		return ctx, nil, Direction{BackendConn: conn, Done: done, Credentials: route.Credentials, MetadataLimits: route.MetadataLimits}, nil
+	}
+	if drained != "" {
+		return ctx, nil, Direction{}, status.Errorf(codes.Unavailable, "backend %q is draining", drained)
+	}
+	return ctx, nil, Direction{}, status.Errorf(codes.Unimplemented, "Unknown method")
+}
+
+// pickBackend returns the backend of route for a call to method. If the
+// backend is draining, it returns its name and false.
+func (r *Router) pickBackend(route *Route, method string) (string, bool) {
+	split := route.split(method)
+	if len(split) == 0 {
+		return route.Backend, !r.draining[route.Backend]
+	}
+	total := 0
+	for _, bw := range split {
+		if bw.Weight > 0 && !r.draining[bw.Backend] {
+			total += bw.Weight
+		}
+	}
+	if total == 0 {
+		return split[0].Backend, false
+	}
+	n := rand.Intn(total)
+	picked := ""
+	for _, bw := range split {
+		if bw.Weight <= 0 || r.draining[bw.Backend] {
+			continue
+		}
+		picked = bw.Backend
+		if n -= bw.Weight; n < 0 {
+			break
+		}
+	}
+	return picked, true
+}
+
+// SetSplit changes the backend weights of the route with the given name
+// while it is serving. With an empty method the default Split of the route
+// is set, otherwise its split for the method prefix. A nil split removes
+// the method override, or the default split so that calls go to Backend
+// again. It returns false if there is no such route. Replace discards the
+// change along with the old routes.
+func (r *Router) SetSplit(route, method string, split []BackendWeight) bool {
+	split = append([]BackendWeight(nil), split...)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	found := false
+	for i := range r.routes {
+		rt := &r.routes[i]
+		if rt.Name != route {
+			continue
+		}
+		found = true
+		if method == "" {
+			if len(split) == 0 {
+				split = nil
+			}
+			rt.Split = split
+			continue
+		}
+		// Routes returned by Routes share the map, so it is copied.
+		splits := make(map[string][]BackendWeight, len(rt.MethodSplits)+1)
+		for prefix, s := range rt.MethodSplits {
+			splits[prefix] = s
+		}
+		if len(split) == 0 {
+			delete(splits, method)
+		} else {
+			splits[method] = split
+		}
+		rt.MethodSplits = splits
+	}
+	return found
+}
+
+// DrainBackend stops routing new calls to the named backend, whether or not
+// it is registered, until ResumeBackend is called. In-flight calls are not
+// affected. Draining survives Replace.
+func (r *Router) DrainBackend(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.draining == nil {
+		r.draining = make(map[string]bool)
+	}
+	r.draining[name] = true
+}
+
+// ResumeBackend routes calls to the named backend again after DrainBackend.
+func (r *Router) ResumeBackend(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.draining, name)
+}
+
+// Routes returns a copy of the routing table.
+func (r *Router) Routes() []Route {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]Route(nil), r.routes...)
+}
+
+// BackendStatus describes a backend of a Router.
+type BackendStatus struct {
+	Name     string
+	Draining bool
+	// Endpoints is only set if the backend's balancer is a StatusReporter.
+	Endpoints []EndpointStatus
+}
+
+// Backends returns the status of the registered backends, ordered by name.
+func (r *Router) Backends() []BackendStatus {
+	r.mu.RLock()
+	backends := make(map[string]Balancer, len(r.backends))
+	statuses := make([]BackendStatus, 0, len(r.backends))
+	for name, b := range r.backends {
+		backends[name] = b
+		statuses = append(statuses, BackendStatus{Name: name, Draining: r.draining[name]})
+	}
+	r.mu.RUnlock()
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	for i := range statuses {
+		if sr, ok := backends[statuses[i].Name].(StatusReporter); ok {
+			statuses[i].Endpoints = sr.Status()
+		}
+	}
+	return statuses
+}
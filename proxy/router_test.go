@@ -0,0 +1,192 @@
+package proxy_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// namedService answers Ping with its name.
+func namedService(name string) *pingService {
+	return &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			return &pb.PingResponse{Value: name}, nil
+		},
+	}
+}
+
+func TestRouter_RoutesByRules(t *testing.T) {
+	otherServer, otherConn := startBackend(t, namedService("other"))
+	defer otherServer.Stop()
+	defer otherConn.Close()
+
+	env := newTestEnvWithDirector(t, namedService("main"), func(backend *grpc.ClientConn) proxy.StreamDirector {
+		r := proxy.NewRouter()
+		r.AddBackend("main", backend)
+		r.AddBackend("other", otherConn)
+		r.AddRoute(proxy.Route{Metadata: map[string]string{"tenant": "other"}, Backend: "other"})
+		r.AddRoute(proxy.Route{Authority: "other.example.com", Backend: "other"})
+		r.AddRoute(proxy.Route{Metadata: map[string]string{"missing-backend": ""}, Backend: "nope"})
+		r.AddRoute(proxy.Route{MethodPrefix: "/vgough.testproto.TestService/Ping", Backend: "main"})
+		return r.Direct
+	})
+	defer env.Close()
+
+	ping := func(ctx context.Context, opts ...grpc.CallOption) (string, error) {
+		out, err := env.client.Ping(ctx, &pb.PingRequest{}, opts...)
+		if err != nil {
+			return "", err
+		}
+		return out.Value, nil
+	}
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	got, err := ping(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "main", got, "method prefix route")
+
+	got, err = ping(metadata.AppendToOutgoingContext(ctx, "tenant", "other"))
+	require.NoError(t, err)
+	assert.Equal(t, "other", got, "metadata route")
+
+	got, err = ping(metadata.AppendToOutgoingContext(ctx, "tenant", "unknown"))
+	require.NoError(t, err)
+	assert.Equal(t, "main", got, "metadata values must match")
+
+	_, err = ping(metadata.AppendToOutgoingContext(ctx, "missing-backend", "x"))
+	assert.Equal(t, codes.Unavailable, status.Code(err), "unregistered backend")
+
+	err = env.clientConn.Invoke(ctx, "/unknown.Service/Call", &pb.Empty{}, &pb.Empty{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err), "no route must reject the call")
+}
+
+func TestRouter_MatchesAuthority(t *testing.T) {
+	otherServer, otherConn := startBackend(t, namedService("other"))
+	defer otherServer.Stop()
+	defer otherConn.Close()
+
+	env := newTestEnvWithDirector(t, namedService("main"), func(backend *grpc.ClientConn) proxy.StreamDirector {
+		r := proxy.NewRouter()
+		r.AddBackend("main", backend)
+		r.AddBackend("other", otherConn)
+		r.AddRoute(proxy.Route{Authority: "other.example.com", Backend: "other"})
+		r.AddRoute(proxy.Route{Backend: "main"})
+		return r.Direct
+	})
+	defer env.Close()
+
+	conn, err := grpc.Dial(env.clientConn.Target(), grpc.WithInsecure(), grpc.WithAuthority("other.example.com"))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	out, err := pb.NewTestServiceClient(conn).Ping(ctx, &pb.PingRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, "other", out.Value)
+
+	out, err = env.client.Ping(ctx, &pb.PingRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, "main", out.Value)
+}
+
+func TestRouter_DrainBackend(t *testing.T) {
+	otherServer, otherConn := startBackend(t, namedService("other"))
+	defer otherServer.Stop()
+	defer otherConn.Close()
+
+	r := proxy.NewRouter()
+	env := newTestEnvWithDirector(t, namedService("main"), func(backend *grpc.ClientConn) proxy.StreamDirector {
+		r.AddBackend("main", backend)
+		r.AddBackend("other", otherConn)
+		r.AddRoute(proxy.Route{Metadata: map[string]string{"tenant": "main"}, Backend: "main"})
+		r.AddRoute(proxy.Route{Backend: "other"})
+		return r.Direct
+	})
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "tenant", "main")
+
+	r.DrainBackend("main")
+	out, err := env.client.Ping(ctx, &pb.PingRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, "other", out.Value, "calls fall through to the next route")
+
+	r.DrainBackend("other")
+	_, err = env.client.Ping(ctx, &pb.PingRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), `"main" is draining`)
+
+	r.Replace(r.Routes(), map[string]proxy.Balancer{
+		"main": proxy.NewRoundRobinBalancer(proxy.Endpoints(env.backendConn)...),
+	})
+	backends := r.Backends()
+	require.Len(t, backends, 1)
+	assert.True(t, backends[0].Draining, "draining survives Replace")
+	assert.Len(t, backends[0].Endpoints, 1)
+
+	r.ResumeBackend("main")
+	out, err = env.client.Ping(ctx, &pb.PingRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, "main", out.Value)
+}
+
+func TestRouter_Split(t *testing.T) {
+	conns := idleConns(t, 2)
+	defer closeConns(conns)
+	stable, canary := conns[0], conns[1]
+	r := proxy.NewRouter()
+	r.AddBackend("stable", stable)
+	r.AddBackend("canary", canary)
+	r.AddRoute(proxy.Route{
+		Name:         "users",
+		MethodPrefix: "/users.",
+		Backend:      "stable",
+		Split:        []proxy.BackendWeight{{Backend: "stable", Weight: 95}, {Backend: "canary", Weight: 5}},
+		MethodSplits: map[string][]proxy.BackendWeight{
+			"/users.UserService/Delete": {{Backend: "stable", Weight: 1}},
+		},
+	})
+	canaryShare := func(method string) int {
+		n := 0
+		for i := 0; i < 2000; i++ {
+			_, _, dir, err := r.Direct(context.Background(), method)
+			require.NoError(t, err)
+			if dir.BackendConn == canary {
+				n++
+			}
+		}
+		return n
+	}
+
+	assert.InDelta(t, 100, canaryShare("/users.UserService/Get"), 60)
+	assert.Equal(t, 0, canaryShare("/users.UserService/Delete"), "method overrides win")
+
+	require.True(t, r.SetSplit("users", "", []proxy.BackendWeight{{Backend: "stable", Weight: 1}, {Backend: "canary", Weight: 1}}))
+	assert.InDelta(t, 1000, canaryShare("/users.UserService/Get"), 150)
+	require.True(t, r.SetSplit("users", "/users.UserService/Delete", nil))
+	assert.InDelta(t, 1000, canaryShare("/users.UserService/Delete"), 150, "override removed")
+	assert.False(t, r.SetSplit("missing", "", nil))
+
+	r.DrainBackend("canary")
+	assert.Equal(t, 0, canaryShare("/users.UserService/Get"), "draining backends get no share")
+	r.DrainBackend("stable")
+	_, _, _, err := r.Direct(context.Background(), "/users.UserService/Get")
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	require.True(t, r.SetSplit("users", "", nil))
+	r.ResumeBackend("stable")
+	r.ResumeBackend("canary")
+	assert.Equal(t, 0, canaryShare("/users.UserService/Get"), "without a split calls go to Backend")
+}
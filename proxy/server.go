@@ -0,0 +1,350 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	// defaultShutdownGrace is how long Shutdown waits for in-flight streams
+	// when Server.ShutdownGrace is not set.
+	defaultShutdownGrace = 30 * time.Second
+
+	// defaultStopTimeout is how long Shutdown waits for the gRPC server to
+	// stop gracefully when Server.StopTimeout is not set.
+	defaultStopTimeout = time.Second
+)
+
+// errServerStopped is returned by Run if its gRPC server was stopped other
+// than by Shutdown.
+var errServerStopped = errors.New("proxy: gRPC server stopped")
+
+// Server runs a proxy: gRPC servers with the proxy codec and a transparent
+// handler, stopped in order when Run is interrupted or Shutdown is called:
+//
+//  1. The handler's Drainer starts draining, rejecting new streams with
+//     codes.Unavailable while in-flight streams get ShutdownGrace to
+//     complete. Streams which outlive it are cancelled.
+//  2. The gRPC servers stop gracefully, or forcibly after StopTimeout, such
+//     as for streams of services added with Register.
+//  3. The shutdown hooks run in the order they were added, such as to close
+//     backend connections and flush metrics.
+//
+// A Server may accept on several listeners, each with its own policies, see
+// AddListener. All listeners share the director and so the routing table,
+// and the Drainer. For example, with an internal plaintext listener and an
+// external mTLS listener which only allows the public API:
+//
+//	router := proxy.NewRouter()
+//	backends := proxy.NewBackendRegistry()
+//	...
+//	s := proxy.NewServer(router.Direct, []proxy.Option{proxy.WithMetrics(reg)})
+//	s.Register(proxy.NewRouterHealth(router).Register)
+//	s.AddListener(proxy.ServerListener{Listener: internal})
+//	s.AddListener(proxy.ServerListener{
+//		Listener:   external,
+//		TLS:        mtlsConfig,
+//		Methods:    []string{"/shop.api."},
+//		RateLimits: []proxy.RateLimit{{Limiter: limiter, ByPeer: true}},
+//	})
+//	s.OnShutdown(func(context.Context) error { return backends.Close() })
+//	s.OnShutdown(pushMetrics)
+//	err := s.Run(context.Background())
+type Server struct {
+	// ShutdownGrace is how long in-flight streams may take to complete once
+	// the shutdown started. It defaults to 30 seconds.
+	ShutdownGrace time.Duration
+
+	// StopTimeout is how long the gRPC servers may take to stop gracefully
+	// after the drain. It defaults to 1 second.
+	StopTimeout time.Duration
+
+	// Signals start a shutdown of Run. They default to SIGINT and SIGTERM.
+	Signals []os.Signal
+
+	director   StreamDirector
+	opts       []Option
+	serverOpts []grpc.ServerOption
+	drainer    *Drainer
+	logger     Logger
+
+	mu        sync.Mutex
+	listeners []ServerListener
+	registers []func(*grpc.Server)
+	servers   []*grpc.Server
+	hooks     []func(ctx context.Context) error
+	stopping  chan struct{}
+	stopped   chan struct{}
+	err       error
+}
+
+// ServerListener is a listener of a Server with its own policies, which
+// apply in addition to the options of the Server.
+type ServerListener struct {
+	// Listener accepts the connections, such as from Listen.
+	Listener net.Listener
+
+	// TLS, if set, secures the connections. Set its ClientAuth to require
+	// client certificates.
+	TLS *tls.Config
+
+	// Credentials, if set, secure the connections instead of TLS, such as
+	// with ALTS.
+	Credentials credentials.TransportCredentials
+
+	// Methods, if set, lists the method prefixes which may be called on the
+	// listener, including tunnels, see WithAllowedMethods. Services added
+	// with Register are not restricted.
+	Methods []string
+
+	// RateLimits limit the calls of the listener, see WithRateLimit.
+	RateLimits []RateLimit
+
+	// Options are further handler options of the listener.
+	Options []Option
+}
+
+// Listen listens on address, which is a TCP address or "unix:" followed by
+// the path of a unix socket.
+func Listen(address string) (net.Listener, error) {
+	if isUnixAddress(address) {
+		return net.Listen("unix", strings.TrimPrefix(address, "unix:"))
+	}
+	return net.Listen("tcp", address)
+}
+
+// NewServer returns a Server which directs calls with director, through
+// handlers of TransparentHandler configured with opts. The gRPC servers are
+// created with the proxy codec, the handler and serverOpts.
+//
+// If opts has no WithDrainer, the server drains with a Drainer of its own.
+func NewServer(director StreamDirector, opts []Option, serverOpts ...grpc.ServerOption) *Server {
+	o := newOptions(opts)
+	drainer := o.drainer
+	if drainer == nil {
+		drainer = &Drainer{}
+		opts = append(append([]Option(nil), opts...), WithDrainer(drainer))
+	}
+	return &Server{
+		director:   director,
+		opts:       opts,
+		serverOpts: serverOpts,
+		drainer:    drainer,
+		logger:     o.logger,
+		stopping:   make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+}
+
+// AddListener adds a listener which Run accepts on.
+func (s *Server) AddListener(l ServerListener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, l)
+}
+
+// Register adds a function which registers services, such as HealthService,
+// on the gRPC server of every listener before Run serves. Calls to
+// registered services are not proxied.
+func (s *Server) Register(f func(*grpc.Server)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.registers = append(s.registers, f)
+}
+
+// Drainer returns the Drainer of the handlers, such as for the probes of
+// package probe.
+func (s *Server) Drainer() *Drainer {
+	return s.drainer
+}
+
+// OnShutdown adds a hook which runs once the gRPC servers stopped. Hooks
+// run in the order they were added, with the context of Shutdown; an error
+// does not keep the later hooks from running.
+func (s *Server) OnShutdown(f func(ctx context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, f)
+}
+
+// newGRPCServer returns the gRPC server of l.
+func (s *Server) newGRPCServer(l *ServerListener) *grpc.Server {
+	opts := append([]Option(nil), s.opts...)
+	if len(l.Methods) != 0 {
+		opts = append(opts, WithAllowedMethods(l.Methods...))
+	}
+	for _, rl := range l.RateLimits {
+		opts = append(opts, WithRateLimit(rl))
+	}
+	opts = append(opts, l.Options...)
+	serverOpts := append([]grpc.ServerOption{
+		ServerOption(),
+		grpc.UnknownServiceHandler(TransparentHandler(s.director, opts...)),
+	}, s.serverOpts...)
+	switch {
+	case l.Credentials != nil:
+		serverOpts = append(serverOpts, grpc.Creds(l.Credentials))
+	case l.TLS != nil:
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(l.TLS)))
+	}
+	server := grpc.NewServer(serverOpts...)
+	for _, register := range s.registers {
+		register(server)
+	}
+	return server
+}
+
+// Run serves the listeners added with AddListener and those passed to it,
+// which have no policies of their own, until ctx is done, one of the
+// Signals is received, a listener fails or Shutdown is called, and then
+// shuts down. It returns the error of the failed listener or of the
+// shutdown, or nil. Run may only be called once.
+func (s *Server) Run(ctx context.Context, listeners ...net.Listener) error {
+	s.mu.Lock()
+	select {
+	case <-s.stopping:
+		s.mu.Unlock()
+		<-s.stopped
+		return s.err
+	default:
+	}
+	all := append([]ServerListener(nil), s.listeners...)
+	for _, lis := range listeners {
+		all = append(all, ServerListener{Listener: lis})
+	}
+	errs := make(chan error, len(all))
+	for i := range all {
+		server := s.newGRPCServer(&all[i])
+		s.servers = append(s.servers, server)
+		go func(lis net.Listener) {
+			errs <- server.Serve(lis)
+		}(all[i].Listener)
+	}
+	s.mu.Unlock()
+
+	signals := s.Signals
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, signals...)
+	defer signal.Stop(sigs)
+
+	var serveErr error
+	select {
+	case <-ctx.Done():
+		s.logger.Info("shutting down", "reason", ctx.Err())
+	case sig := <-sigs:
+		s.logger.Info("shutting down", "signal", sig)
+	case err := <-errs:
+		select {
+		case <-s.stopping:
+			// Stopped by Shutdown.
+			<-s.stopped
+			return s.err
+		default:
+		}
+		serveErr = err
+		if err == nil {
+			// Only the gRPC server being stopped ends Serve without error.
+			serveErr = errServerStopped
+		}
+		s.logger.Error("listener failed, shutting down", "err", serveErr)
+	case <-s.stopping:
+		<-s.stopped
+		return s.err
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		return err
+	}
+	return serveErr
+}
+
+// Shutdown stops the server in order, see Server, and returns the first
+// error of the drain or the shutdown hooks. If ctx is done first, the
+// remaining streams are cut off and the hooks run with ctx, so that they may
+// give up quickly. Later calls wait for the first shutdown and return its
+// result.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	select {
+	case <-s.stopping:
+		s.mu.Unlock()
+		select {
+		case <-s.stopped:
+			return s.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	default:
+	}
+	close(s.stopping)
+	hooks := append([]func(context.Context) error(nil), s.hooks...)
+	servers := append([]*grpc.Server(nil), s.servers...)
+	s.mu.Unlock()
+
+	grace := s.ShutdownGrace
+	if grace <= 0 {
+		grace = defaultShutdownGrace
+	}
+	err := s.drainer.Drain(ctx, grace)
+
+	stopTimeout := s.StopTimeout
+	if stopTimeout <= 0 {
+		stopTimeout = defaultStopTimeout
+	}
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, server := range servers {
+			wg.Add(1)
+			go func(server *grpc.Server) {
+				defer wg.Done()
+				server.GracefulStop()
+			}(server)
+		}
+		wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(stopTimeout)
+	select {
+	case <-done:
+	case <-timer.C:
+		for _, server := range servers {
+			server.Stop()
+		}
+	case <-ctx.Done():
+		for _, server := range servers {
+			server.Stop()
+		}
+	}
+	timer.Stop()
+	<-done
+
+	for _, hook := range hooks {
+		if hookErr := hook(ctx); hookErr != nil {
+			s.logger.Warn("shutdown hook failed", "err", hookErr)
+			if err == nil {
+				err = hookErr
+			}
+		}
+	}
+	s.err = err
+	close(s.stopped)
+	return err
+}
@@ -0,0 +1,292 @@
+package proxy_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func startServer(t *testing.T, svc *pingService) (*proxy.Server, net.Listener, func()) {
+	backend, backendConn := startReflectionBackend(t, func(s *grpc.Server) {
+		pb.RegisterTestServiceServer(s, svc)
+	})
+	director := func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+		return ctx, nil, proxy.Direction{BackendConn: backendConn}, nil
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	return proxy.NewServer(director, nil), lis, func() {
+		backendConn.Close()
+		backend.Stop()
+	}
+}
+
+func TestServer_Run(t *testing.T) {
+	started := make(chan struct{})
+	svc := &pingService{
+		pingStream: func(stream pb.TestService_PingStreamServer) error {
+			close(started)
+			_, err := stream.Recv()
+			if err != nil {
+				return err
+			}
+			return stream.Send(&pb.PingResponse{Value: "done"})
+		},
+	}
+	s, lis, stop := startServer(t, svc)
+	defer stop()
+	var order []string
+	s.OnShutdown(func(context.Context) error {
+		order = append(order, "close backends")
+		return nil
+	})
+	s.OnShutdown(func(context.Context) error {
+		order = append(order, "flush metrics")
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx, lis) }()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	client := pb.NewTestServiceClient(conn)
+	callCtx, callCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer callCancel()
+	stream, err := client.PingStream(callCtx)
+	require.NoError(t, err)
+	<-started
+
+	cancel()
+	assert.Eventually(t, s.Drainer().Draining, time.Second, time.Millisecond)
+	_, err = client.Ping(callCtx, &pb.PingRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err), "new streams are rejected while draining")
+
+	// The in-flight stream completes within the grace period.
+	require.NoError(t, stream.Send(&pb.PingRequest{}))
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, "done", resp.Value)
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return")
+	}
+	assert.Equal(t, []string{"close backends", "flush metrics"}, order)
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	started := make(chan struct{})
+	svc := &pingService{
+		pingStream: func(stream pb.TestService_PingStreamServer) error {
+			close(started)
+			<-stream.Context().Done()
+			return nil
+		},
+	}
+	s, lis, stop := startServer(t, svc)
+	defer stop()
+	s.ShutdownGrace = 50 * time.Millisecond
+	hookErr := errors.New("flush failed")
+	s.OnShutdown(func(context.Context) error { return hookErr })
+
+	done := make(chan error, 1)
+	go func() { done <- s.Run(context.Background(), lis) }()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := pb.NewTestServiceClient(conn).PingStream(ctx)
+	require.NoError(t, err)
+	<-started
+
+	assert.Equal(t, hookErr, s.Shutdown(ctx), "hook errors are returned")
+	_, err = stream.Recv()
+	assert.Error(t, err, "streams outliving the grace period are cancelled")
+	assert.Equal(t, hookErr, <-done, "Run returns the result of Shutdown")
+	assert.Equal(t, hookErr, s.Shutdown(ctx), "later calls return the same result")
+}
+
+type failingListener struct {
+	net.Listener
+	err error
+}
+
+func (l failingListener) Accept() (net.Conn, error) {
+	return nil, l.err
+}
+
+func TestServer_ListenerFails(t *testing.T) {
+	s, lis, stop := startServer(t, &pingService{})
+	defer stop()
+	defer lis.Close()
+	lisErr := errors.New("accept failed")
+	err := s.Run(context.Background(), failingListener{lis, lisErr})
+	assert.Equal(t, lisErr, err)
+}
+
+func TestServer_Listeners(t *testing.T) {
+	s, internal, stop := startServer(t, &pingService{})
+	defer stop()
+	ca := newTestCA(t)
+	external, err := proxy.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	dir, err := ioutil.TempDir("", "server")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "proxy.sock")
+	local, err := proxy.Listen("unix:" + socket)
+	require.NoError(t, err)
+
+	s.AddListener(proxy.ServerListener{Listener: internal})
+	s.AddListener(proxy.ServerListener{
+		Listener: external,
+		TLS: &tls.Config{
+			Certificates: []tls.Certificate{ca.issue(nil, "proxy.test")},
+			ClientCAs:    ca.pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		},
+		Methods:    []string{"/vgough.testproto.TestService/PingEmpty"},
+		RateLimits: []proxy.RateLimit{{Limiter: proxy.NewTokenBucketLimiter(0.001, 1)}},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx, local) }()
+
+	internalConn, err := grpc.Dial(internal.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer internalConn.Close()
+	externalConn, err := grpc.Dial(external.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+		ServerName:   "proxy.test",
+		RootCAs:      ca.pool,
+		Certificates: []tls.Certificate{ca.issue(nil, "client.test")},
+	})))
+	require.NoError(t, err)
+	defer externalConn.Close()
+	localConn, err := grpc.Dial("unix:"+socket, grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socket)
+	}))
+	require.NoError(t, err)
+	defer localConn.Close()
+
+	internalClient := pb.NewTestServiceClient(internalConn)
+	externalClient := pb.NewTestServiceClient(externalConn)
+	_, err = externalClient.PingEmpty(ctx, &pb.Empty{})
+	require.NoError(t, err)
+	_, err = externalClient.Ping(ctx, &pb.PingRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "the method is not allowed on the external listener")
+	_, err = externalClient.PingEmpty(ctx, &pb.Empty{})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "the external listener is rate limited")
+
+	for i := 0; i < 3; i++ {
+		_, err = internalClient.PingEmpty(ctx, &pb.Empty{})
+		require.NoError(t, err, "the internal listener is not limited")
+		_, err = internalClient.Ping(ctx, &pb.PingRequest{})
+		require.NoError(t, err)
+	}
+	_, err = pb.NewTestServiceClient(localConn).Ping(ctx, &pb.PingRequest{})
+	require.NoError(t, err, "listeners passed to Run are served too")
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestServer_ListenerMethodsTunnel(t *testing.T) {
+	var dials int32
+	dial := func(ctx context.Context) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return nil, errors.New("dialed")
+	}
+	director := func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+		return ctx, nil, proxy.Direction{}, status.Error(codes.Unavailable, "no backend")
+	}
+	s := proxy.NewServer(director, []proxy.Option{proxy.WithTunnel(tunnelMethod, dial)})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s.AddListener(proxy.ServerListener{
+		Listener: lis,
+		Methods:  []string{"/vgough.testproto.TestService/PingEmpty"},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = proxy.DialTunnel(ctx, conn, tunnelMethod)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "tunnels are restricted too")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&dials))
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+// handshakeCreds are transport credentials which count server handshakes
+// and leave the connection as is.
+type handshakeCreds struct {
+	handshakes int32
+}
+
+func (c *handshakeCreds) ClientHandshake(ctx context.Context, addr string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return conn, nil, nil
+}
+
+func (c *handshakeCreds) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	atomic.AddInt32(&c.handshakes, 1)
+	return conn, nil, nil
+}
+
+func (c *handshakeCreds) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "test"}
+}
+
+func (c *handshakeCreds) Clone() credentials.TransportCredentials { return c }
+
+func (c *handshakeCreds) OverrideServerName(string) error { return nil }
+
+func TestServer_ListenerCredentials(t *testing.T) {
+	s, lis, stop := startServer(t, &pingService{})
+	defer stop()
+	creds := &handshakeCreds{}
+	s.AddListener(proxy.ServerListener{Listener: lis, Credentials: creds})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = pb.NewTestServiceClient(conn).Ping(ctx, &pb.PingRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&creds.handshakes), "the listener's credentials secure its connections")
+	cancel()
+	assert.NoError(t, <-done)
+}
@@ -0,0 +1,145 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// defaultShadowTimeout bounds shadow calls when no timeout is configured.
+	defaultShadowTimeout = 30 * time.Second
+
+	// shadowBuffer is the number of client messages queued per shadow before
+	// the shadow is abandoned.
+	shadowBuffer = 64
+)
+
+// WithShadowTimeout limits the duration of calls to shadow backends. Shadow
+// calls are not cancelled when the primary call completes, so that shadows
+// observe the full request, and are instead bounded by this timeout. The
+// default is 30 seconds.
+func WithShadowTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.shadowTimeout = d
+	}
+}
+
+// shadowServerStream is a ServerStream which copies every message received
+// from the client to a set of shadow backends.
+//
+// Copies are sent asynchronously and responses from shadows are discarded. A
+// shadow which cannot keep up with the client is abandoned rather than
+// slowing down the primary call.
+type shadowServerStream struct {
+	grpc.ServerStream
+	shadows []chan *frame
+	targets []string
+	closed  bool
+	method  string
+	logger  Logger
+}
+
+// newShadowServerStream starts a call to each shadow backend and returns a
+// ServerStream which feeds them the messages received from in.
+//
+// The shadow calls use the outgoing metadata from ctx, but are not cancelled
+// along with it.
+func newShadowServerStream(ctx context.Context, in grpc.ServerStream, conns []*grpc.ClientConn, timeout time.Duration, logger Logger, method string, callOpts ...grpc.CallOption) *shadowServerStream {
+	if timeout <= 0 {
+		timeout = defaultShadowTimeout
+	}
+	shadowCtx := context.Background()
+	if md, ok := metadata.FromOutgoingContext(ctx); ok {
+		shadowCtx = metadata.NewOutgoingContext(shadowCtx, md)
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+
+	s := &shadowServerStream{ServerStream: in, method: method, logger: logger}
+	for _, conn := range conns {
+		frames := make(chan *frame, shadowBuffer)
+		s.shadows = append(s.shadows, frames)
+		s.targets = append(s.targets, conn.Target())
+		go runShadow(shadowCtx, timeout, conn, logger, method, frames, callOpts)
+	}
+	return s
+}
+
+func (s *shadowServerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if s.closed {
+		return err
+	}
+	if err != nil {
+		s.close()
+		return err
+	}
+	if f, ok := m.(*frame); ok {
+		for i, frames := range s.shadows {
+			if frames == nil {
+				continue
+			}
+			select {
+			case frames <- &frame{payload: f.payload}:
+			default:
+				// The shadow is too slow; give up on it.
+				close(frames)
+				s.shadows[i] = nil
+				s.logger.Warn("shadow abandoned", "method", s.method, "backend", s.targets[i], "buffered", shadowBuffer)
+			}
+		}
+	}
+	return nil
+}
+
+// close signals the end of the client messages to all shadows.
+func (s *shadowServerStream) close() {
+	s.closed = true
+	for _, frames := range s.shadows {
+		if frames != nil {
+			close(frames)
+		}
+	}
+}
+
+// runShadow forwards frames to a shadow backend until the channel is closed,
+// then waits for the shadow response, which is discarded.
+func runShadow(ctx context.Context, timeout time.Duration, conn *grpc.ClientConn, logger Logger, method string, frames chan *frame, callOpts []grpc.CallOption) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	out, err := grpc.NewClientStream(ctx, clientStreamDescForProxying, conn, method, callOpts...)
+	if err != nil {
+		logger.Warn("shadow stream failed", "method", method, "backend", conn.Target(), "error", err)
+		// Drain the frames, so that the shadow is not abandoned.
+		for range frames {
+		}
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var f frame
+		for out.RecvMsg(&f) == nil {
+		}
+	}()
+
+	// Keep draining the frames after a failed send, so that the shadow is
+	// not abandoned.
+	var sendErr error
+	for f := range frames {
+		if sendErr == nil {
+			sendErr = out.SendMsg(f)
+		}
+	}
+	out.CloseSend()
+	<-done
+}
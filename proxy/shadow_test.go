@@ -0,0 +1,93 @@
+package proxy_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestShadow_ReceivesCopyWithoutAffectingClient(t *testing.T) {
+	seen := make(chan string, 1)
+	shadow := &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			seen <- ping.Value
+			return nil, status.Error(codes.Internal, "shadow is broken")
+		},
+	}
+	shadowServer, shadowConn := startBackend(t, shadow)
+	defer shadowServer.Stop()
+	defer shadowConn.Close()
+
+	env := newTestEnvWithDirector(t, &pingService{}, func(backend *grpc.ClientConn) proxy.StreamDirector {
+		return func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+			return ctx, nil, proxy.Direction{
+				BackendConn: backend,
+				Shadows:     []*grpc.ClientConn{shadowConn},
+			}, nil
+		}
+	})
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	out, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err, "shadow errors must not reach the client")
+	assert.Equal(t, "foo", out.Value)
+
+	select {
+	case v := <-seen:
+		assert.Equal(t, "foo", v)
+	case <-time.After(5 * time.Second):
+		t.Fatal("shadow backend never received the request")
+	}
+}
+
+func TestShadow_FailedShadowIsNotAbandoned(t *testing.T) {
+	shadow := &pingService{
+		pingStream: func(stream pb.TestService_PingStreamServer) error {
+			return status.Error(codes.Internal, "shadow is broken")
+		},
+	}
+	shadowServer, shadowConn := startBackend(t, shadow)
+	defer shadowServer.Stop()
+	defer shadowConn.Close()
+
+	rec := &logRecorder{}
+	env := newTestEnvWithDirector(t, &pingService{}, func(backend *grpc.ClientConn) proxy.StreamDirector {
+		return func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+			return ctx, nil, proxy.Direction{
+				BackendConn: backend,
+				Shadows:     []*grpc.ClientConn{shadowConn},
+			}, nil
+		}
+	}, proxy.WithLogger(rec.logger()))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	stream, err := env.client.PingStream(ctx)
+	require.NoError(t, err)
+	for i := 0; i < 200; i++ {
+		require.NoError(t, stream.Send(&pb.PingRequest{Value: "foo"}))
+		_, err := stream.Recv()
+		require.NoError(t, err)
+		if i == 0 {
+			// Let the shadow fail before the rest is sent.
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	require.NoError(t, stream.CloseSend())
+
+	for _, r := range rec.get() {
+		assert.NotEqual(t, "shadow abandoned", r.msg, "a failed shadow must keep draining the client messages")
+	}
+}
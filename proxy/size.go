@@ -0,0 +1,61 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// WithMaxRecvSize limits the size of messages received from clients. Larger
+// messages fail the stream with codes.ResourceExhausted before they reach the
+// backend. Directors may override the limit with Direction.MaxRecvSize.
+func WithMaxRecvSize(n int) Option {
+	return func(o *options) {
+		o.maxRecvSize = n
+	}
+}
+
+// WithMaxSendSize limits the size of messages sent to clients. Larger
+// messages from the backend fail the stream with codes.ResourceExhausted.
+// Directors may override the limit with Direction.MaxSendSize.
+func WithMaxSendSize(n int) Option {
+	return func(o *options) {
+		o.maxSendSize = n
+	}
+}
+
+// sizeLimitedServerStream enforces message size limits on the client side of
+// the proxy. A limit of zero or less means no limit.
+type sizeLimitedServerStream struct {
+	grpc.ServerStream
+	maxRecv, maxSend int
+}
+
+func (s *sizeLimitedServerStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if f, ok := m.(*frame); ok && s.maxRecv > 0 && len(f.payload) > s.maxRecv {
+		return status.Errorf(codes.ResourceExhausted, "received message larger than max (%d vs. %d)", len(f.payload), s.maxRecv)
+	}
+	return nil
+}
+
+func (s *sizeLimitedServerStream) SendMsg(m interface{}) error {
+	if f, ok := m.(*frame); ok && s.maxSend > 0 && len(f.payload) > s.maxSend {
+		return status.Errorf(codes.ResourceExhausted, "trying to send message larger than max (%d vs. %d)", len(f.payload), s.maxSend)
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+// pickLimit returns the per-call limit if set, otherwise the default.
+func pickLimit(call, def int) int {
+	if call != 0 {
+		return call
+	}
+	return def
+}
@@ -0,0 +1,69 @@
+package proxy_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestMaxRecvSize(t *testing.T) {
+	env := newTestEnv(t, &pingService{}, proxy.WithMaxRecvSize(64))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	out, err := env.client.Ping(ctx, &pb.PingRequest{Value: "small"})
+	require.NoError(t, err)
+	assert.Equal(t, "small", out.Value)
+
+	_, err = env.client.Ping(ctx, &pb.PingRequest{Value: strings.Repeat("x", 100)})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestMaxSendSize(t *testing.T) {
+	svc := &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			return &pb.PingResponse{Value: strings.Repeat("x", 100)}, nil
+		},
+	}
+	env := newTestEnv(t, svc, proxy.WithMaxSendSize(64))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "small"})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestMaxSizeDirectorOverride(t *testing.T) {
+	mkDirector := func(backend *grpc.ClientConn) proxy.StreamDirector {
+		return func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+			dir := proxy.Direction{BackendConn: backend}
+			if strings.HasSuffix(method, "/Ping") {
+				dir.MaxRecvSize = -1
+			}
+			return ctx, nil, dir, nil
+		}
+	}
+	env := newTestEnvWithDirector(t, &pingService{}, mkDirector, proxy.WithMaxRecvSize(64))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	big := strings.Repeat("x", 100)
+	out, err := env.client.Ping(ctx, &pb.PingRequest{Value: big})
+	require.NoError(t, err, "Ping is exempt from the limit")
+	assert.Equal(t, big, out.Value)
+
+	_, err = env.client.PingError(ctx, &pb.PingRequest{Value: big})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
@@ -0,0 +1,27 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+/*
+Package spiffe provides workload identity for the proxy from the SPIFFE
+Workload API, as served by a SPIRE agent.
+
+An X509Source streams X.509 SVIDs and trust bundles from the Workload API
+and keeps the latest ones. Its credentials present the current SVID and
+verify peers against the current bundles on every handshake, so rotated
+certificates are used without redialing or restarting.
+
+	src := spiffe.NewX509Source("")
+	go src.Run(ctx)
+	if err := src.WaitReady(ctx); err != nil {
+		...
+	}
+	registry.Add("users", proxy.BackendConfig{
+		Address:     "users:443",
+		Credentials: src.ClientCredentials(spiffe.AllowID("spiffe://example.org/users")),
+	})
+
+Peers are authenticated by their SPIFFE ID, not their DNS name, as is usual
+in a service mesh.
+*/
+package spiffe
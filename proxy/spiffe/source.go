@@ -0,0 +1,241 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package spiffe
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// EndpointSocketEnv is the environment variable holding the address of the
+// Workload API.
+const EndpointSocketEnv = "SPIFFE_ENDPOINT_SOCKET"
+
+// SVID is an X.509 SVID of the workload with the trust bundles to verify
+// peers with.
+type SVID struct {
+	// ID is the SPIFFE ID of the workload.
+	ID string
+	// Certificates holds the certificate chain, leaf first.
+	Certificates []*x509.Certificate
+	PrivateKey   crypto.Signer
+
+	// Bundles holds the CA certificates of each trust domain, keyed by
+	// trust domain name, including the trust domain of the SVID.
+	Bundles map[string]*x509.CertPool
+}
+
+// TLSCertificate returns the SVID as a certificate for crypto/tls.
+func (s *SVID) TLSCertificate() *tls.Certificate {
+	cert := &tls.Certificate{PrivateKey: s.PrivateKey, Leaf: s.Certificates[0]}
+	for _, c := range s.Certificates {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert
+}
+
+// X509Source keeps the latest X.509 SVID of the workload, streamed from the
+// Workload API.
+//
+// An X509Source is safe for concurrent use.
+type X509Source struct {
+	// OnError, if set, is called when the Workload API stream fails or
+	// sends an SVID which cannot be used. The current SVID is kept.
+	OnError func(error)
+	// RetryDelay is the wait before the stream is opened again after an
+	// error. If zero, one second is used.
+	RetryDelay time.Duration
+	// OnUpdate, if set, is called after every new SVID.
+	OnUpdate func(*SVID)
+
+	addr string
+
+	mu    sync.Mutex
+	svid  *SVID
+	ready chan struct{}
+}
+
+// NewX509Source returns an X509Source using the Workload API at addr, such
+// as "unix:///run/spire/sockets/agent.sock" or "tcp://127.0.0.1:8081". An
+// empty addr is taken from the SPIFFE_ENDPOINT_SOCKET environment variable.
+func NewX509Source(addr string) *X509Source {
+	if addr == "" {
+		addr = os.Getenv(EndpointSocketEnv)
+	}
+	return &X509Source{addr: addr, ready: make(chan struct{})}
+}
+
+// Run streams SVIDs from the Workload API until ctx is done, reconnecting
+// after errors.
+func (s *X509Source) Run(ctx context.Context) {
+	delay := s.RetryDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	for {
+		err := s.stream(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil && s.OnError != nil {
+			s.OnError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// WaitReady waits until the first SVID is received, or ctx is done.
+func (s *X509Source) WaitReady(ctx context.Context) error {
+	select {
+	case <-s.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SVID returns the current SVID, or nil if none was received yet.
+func (s *X509Source) SVID() *SVID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.svid
+}
+
+func (s *X509Source) stream(ctx context.Context) error {
+	network, address, err := parseAddr(s.addr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, address,
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		}))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx = metadata.AppendToOutgoingContext(ctx, WorkloadHeader, "true")
+	stream, err := conn.NewStream(ctx, fetchX509SVIDDesc, FetchX509SVIDMethod)
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(&X509SVIDRequest{}); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	for {
+		resp := &X509SVIDResponse{}
+		if err := stream.RecvMsg(resp); err != nil {
+			return err
+		}
+		svid, err := parseResponse(resp)
+		if err != nil {
+			if s.OnError != nil {
+				s.OnError(err)
+			}
+			continue
+		}
+		s.update(svid)
+	}
+}
+
+func (s *X509Source) update(svid *SVID) {
+	s.mu.Lock()
+	first := s.svid == nil
+	s.svid = svid
+	s.mu.Unlock()
+	if first {
+		close(s.ready)
+	}
+	if s.OnUpdate != nil {
+		s.OnUpdate(svid)
+	}
+}
+
+// parseAddr splits a Workload API address into network and address.
+func parseAddr(addr string) (network, address string, err error) {
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		return "unix", strings.TrimPrefix(addr, "unix://"), nil
+	case strings.HasPrefix(addr, "tcp://"):
+		return "tcp", strings.TrimPrefix(addr, "tcp://"), nil
+	case addr == "":
+		return "", "", fmt.Errorf("spiffe: no Workload API address, set %s", EndpointSocketEnv)
+	}
+	return "", "", fmt.Errorf("spiffe: unsupported Workload API address %q", addr)
+}
+
+// parseResponse returns the default SVID of resp, which is the first one.
+func parseResponse(resp *X509SVIDResponse) (*SVID, error) {
+	if len(resp.SVIDs) == 0 {
+		return nil, errors.New("spiffe: response holds no SVID")
+	}
+	in := resp.SVIDs[0]
+	certs, err := x509.ParseCertificates(in.X509SVID)
+	if err != nil {
+		return nil, fmt.Errorf("spiffe: parsing SVID of %s: %v", in.SpiffeID, err)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("spiffe: SVID of %s holds no certificate", in.SpiffeID)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(in.X509SVIDKey)
+	if err != nil {
+		return nil, fmt.Errorf("spiffe: parsing key of %s: %v", in.SpiffeID, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("spiffe: unsupported key type %T", key)
+	}
+	td, err := trustDomain(in.SpiffeID)
+	if err != nil {
+		return nil, err
+	}
+	svid := &SVID{ID: in.SpiffeID, Certificates: certs, PrivateKey: signer, Bundles: make(map[string]*x509.CertPool)}
+	if svid.Bundles[td], err = parseBundle(in.Bundle); err != nil {
+		return nil, fmt.Errorf("spiffe: parsing bundle of %s: %v", td, err)
+	}
+	for id, der := range resp.FederatedBundles {
+		ftd := strings.TrimPrefix(id, "spiffe://")
+		if svid.Bundles[ftd], err = parseBundle(der); err != nil {
+			return nil, fmt.Errorf("spiffe: parsing bundle of %s: %v", ftd, err)
+		}
+	}
+	return svid, nil
+}
+
+func parseBundle(der []byte) (*x509.CertPool, error) {
+	certs, err := x509.ParseCertificates(der)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	for _, c := range certs {
+		pool.AddCert(c)
+	}
+	return pool, nil
+}
@@ -0,0 +1,282 @@
+package spiffe_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy/spiffe"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// testCA issues SVIDs of one trust domain.
+type testCA struct {
+	t    *testing.T
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, td string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: td},
+		URIs:                  []*url.URL{{Scheme: "spiffe", Host: td}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{t: t, cert: cert, key: key}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// issue returns the leaf certificate and PKCS#8 key of an SVID for id.
+func (ca *testCA) issue(id string) (*x509.Certificate, *ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(ca.t, err)
+	u, err := url.Parse(id)
+	require.NoError(ca.t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		URIs:         []*url.URL{u},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(ca.t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(ca.t, err)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(ca.t, err)
+	return cert, key, pkcs8
+}
+
+func (ca *testCA) response(id string) *spiffe.X509SVIDResponse {
+	cert, _, key := ca.issue(id)
+	return &spiffe.X509SVIDResponse{SVIDs: []*spiffe.X509SVID{{
+		SpiffeID:    id,
+		X509SVID:    cert.Raw,
+		X509SVIDKey: key,
+		Bundle:      ca.cert.Raw,
+	}}}
+}
+
+// startWorkloadAPI serves FetchX509SVID on a unix socket, sending the
+// responses pushed to updates.
+func startWorkloadAPI(t *testing.T, updates <-chan *spiffe.X509SVIDResponse) (string, func()) {
+	dir, err := ioutil.TempDir("", "spiffe")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "agent.sock")
+	lis, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "SpiffeWorkloadAPI",
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "FetchX509SVID",
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				md, _ := metadata.FromIncomingContext(stream.Context())
+				if v := md.Get(spiffe.WorkloadHeader); len(v) != 1 || v[0] != "true" {
+					return status.Error(codes.InvalidArgument, "missing security header")
+				}
+				if err := stream.RecvMsg(&spiffe.X509SVIDRequest{}); err != nil {
+					return err
+				}
+				for {
+					select {
+					case <-stream.Context().Done():
+						return nil
+					case resp := <-updates:
+						if err := stream.SendMsg(resp); err != nil {
+							return err
+						}
+					}
+				}
+			},
+		}},
+	}, &struct{}{})
+	go server.Serve(lis)
+	return "unix://" + path, func() {
+		server.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+// peerIDService answers pings with the SPIFFE ID of the caller.
+type peerIDService struct {
+	pb.TestServiceServer
+}
+
+func (s *peerIDService) Ping(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "no peer")
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "no peer certificate")
+	}
+	id, err := spiffe.IDFromCertificate(info.State.PeerCertificates[0])
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	return &pb.PingResponse{Value: id}, nil
+}
+
+// startBackend starts a TLS backend for id, which requires client
+// certificates of ca and answers with the SPIFFE ID of the client.
+func startBackend(t *testing.T, ca *testCA, id string) (*grpc.Server, string) {
+	cert, key, _ := ca.issue(id)
+	creds := credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}},
+		ClientCAs:    ca.pool(),
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer(grpc.Creds(creds))
+	pb.RegisterTestServiceServer(server, &peerIDService{})
+	go server.Serve(lis)
+	return server, lis.Addr().String()
+}
+
+func ping(t *testing.T, addr string, creds credentials.TransportCredentials) (string, error) {
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(creds))
+	require.NoError(t, err)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := pb.NewTestServiceClient(conn).Ping(ctx, &pb.PingRequest{}, grpc.WaitForReady(false))
+	if err != nil {
+		return "", err
+	}
+	return out.Value, nil
+}
+
+func TestX509Source(t *testing.T) {
+	ca := newTestCA(t, "example.org")
+	updates := make(chan *spiffe.X509SVIDResponse, 1)
+	addr, stop := startWorkloadAPI(t, updates)
+	defer stop()
+
+	backend, backendAddr := startBackend(t, ca, "spiffe://example.org/backend")
+	defer backend.Stop()
+
+	src := spiffe.NewX509Source(addr)
+	rotated := make(chan string, 2)
+	src.OnUpdate = func(svid *spiffe.SVID) { rotated <- svid.ID }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go src.Run(ctx)
+
+	updates <- ca.response("spiffe://example.org/proxy")
+	waitCtx, waitCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer waitCancel()
+	require.NoError(t, src.WaitReady(waitCtx))
+	assert.Equal(t, "spiffe://example.org/proxy", <-rotated)
+	assert.Equal(t, "spiffe://example.org/proxy", src.SVID().ID)
+
+	id, err := ping(t, backendAddr, src.ClientCredentials(spiffe.AllowID("spiffe://example.org/backend")))
+	require.NoError(t, err)
+	assert.Equal(t, "spiffe://example.org/proxy", id, "backend must see the SVID of the proxy")
+
+	_, err = ping(t, backendAddr, src.ClientCredentials(spiffe.AllowID("spiffe://example.org/other")))
+	assert.Error(t, err, "unauthorized servers must be rejected")
+
+	updates <- ca.response("spiffe://example.org/proxy-rotated")
+	assert.Equal(t, "spiffe://example.org/proxy-rotated", <-rotated)
+	id, err = ping(t, backendAddr, src.ClientCredentials(spiffe.AllowTrustDomain("example.org")))
+	require.NoError(t, err)
+	assert.Equal(t, "spiffe://example.org/proxy-rotated", id, "new connections must use the rotated SVID")
+}
+
+func TestServerCredentials(t *testing.T) {
+	ca := newTestCA(t, "example.org")
+	updates := make(chan *spiffe.X509SVIDResponse, 1)
+	addr, stop := startWorkloadAPI(t, updates)
+	defer stop()
+
+	src := spiffe.NewX509Source(addr)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go src.Run(ctx)
+	updates <- ca.response("spiffe://example.org/proxy")
+	waitCtx, waitCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer waitCancel()
+	require.NoError(t, src.WaitReady(waitCtx))
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer(grpc.Creds(src.ServerCredentials(spiffe.AllowTrustDomain("example.org"))))
+	pb.RegisterTestServiceServer(server, &peerIDService{})
+	go server.Serve(lis)
+	defer server.Stop()
+
+	clientCredentials := func(ca *testCA, id string) credentials.TransportCredentials {
+		cert, key, _ := ca.issue(id)
+		return credentials.NewTLS(&tls.Config{
+			Certificates:       []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}},
+			InsecureSkipVerify: true,
+		})
+	}
+	_, err = ping(t, lis.Addr().String(), clientCredentials(ca, "spiffe://example.org/client"))
+	assert.NoError(t, err)
+
+	foreign := newTestCA(t, "other.org")
+	_, err = ping(t, lis.Addr().String(), clientCredentials(foreign, "spiffe://other.org/client"))
+	assert.Error(t, err, "clients of unknown trust domains must be rejected")
+}
+
+func TestVerify(t *testing.T) {
+	ca := newTestCA(t, "example.org")
+	cert, _, _ := ca.issue("spiffe://example.org/workload")
+	bundles := map[string]*x509.CertPool{"example.org": ca.pool()}
+	id, err := spiffe.Verify(bundles, [][]byte{cert.Raw})
+	require.NoError(t, err)
+	assert.Equal(t, "spiffe://example.org/workload", id)
+
+	other := newTestCA(t, "example.org")
+	forged, _, _ := other.issue("spiffe://example.org/workload")
+	_, err = spiffe.Verify(bundles, [][]byte{forged.Raw})
+	assert.Error(t, err, "certificates of another CA must be rejected")
+
+	_, err = spiffe.Verify(bundles, nil)
+	assert.Error(t, err)
+}
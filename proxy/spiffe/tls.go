@@ -0,0 +1,160 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package spiffe
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// Authorizer decides whether a peer with the given SPIFFE ID may connect.
+type Authorizer func(id string) error
+
+// AllowAny authorizes every peer with an SVID of a known trust domain.
+func AllowAny() Authorizer {
+	return func(string) error { return nil }
+}
+
+// AllowID authorizes peers with one of the given SPIFFE IDs.
+func AllowID(ids ...string) Authorizer {
+	return func(id string) error {
+		for _, allowed := range ids {
+			if id == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("spiffe: peer %s is not authorized", id)
+	}
+}
+
+// AllowTrustDomain authorizes peers of the given trust domain, such as
+// "example.org".
+func AllowTrustDomain(td string) Authorizer {
+	return func(id string) error {
+		if peerTD, err := trustDomain(id); err != nil || peerTD != td {
+			return fmt.Errorf("spiffe: peer %s is not in trust domain %s", id, td)
+		}
+		return nil
+	}
+}
+
+// ClientCredentials returns credentials for dialing backends, presenting the
+// current SVID and accepting servers authorized by authorize.
+func (s *X509Source) ClientCredentials(authorize Authorizer) credentials.TransportCredentials {
+	return credentials.NewTLS(&tls.Config{
+		// Verification is done by VerifyPeerCertificate, as SPIFFE IDs
+		// take the place of server names.
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return s.certificate()
+		},
+		VerifyPeerCertificate: s.verifier(authorize),
+	})
+}
+
+// ServerCredentials returns credentials for the proxy server, presenting the
+// current SVID and requiring clients authorized by authorize.
+func (s *X509Source) ServerCredentials(authorize Authorizer) credentials.TransportCredentials {
+	return credentials.NewTLS(&tls.Config{
+		ClientAuth: tls.RequireAnyClientCert,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return s.certificate()
+		},
+		VerifyPeerCertificate: s.verifier(authorize),
+	})
+}
+
+func (s *X509Source) certificate() (*tls.Certificate, error) {
+	svid := s.SVID()
+	if svid == nil {
+		return nil, errors.New("spiffe: no SVID received yet")
+	}
+	return svid.TLSCertificate(), nil
+}
+
+func (s *X509Source) verifier(authorize Authorizer) func([][]byte, [][]*x509.Certificate) error {
+	return func(raw [][]byte, _ [][]*x509.Certificate) error {
+		svid := s.SVID()
+		if svid == nil {
+			return errors.New("spiffe: no trust bundle received yet")
+		}
+		id, err := Verify(svid.Bundles, raw)
+		if err != nil {
+			return err
+		}
+		return authorize(id)
+	}
+}
+
+// Verify verifies the ASN.1 DER encoded certificate chain of a peer against
+// the bundles of its trust domain, and returns its SPIFFE ID.
+func Verify(bundles map[string]*x509.CertPool, raw [][]byte) (string, error) {
+	if len(raw) == 0 {
+		return "", errors.New("spiffe: peer presented no certificate")
+	}
+	certs := make([]*x509.Certificate, len(raw))
+	for i, der := range raw {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return "", fmt.Errorf("spiffe: parsing peer certificate: %v", err)
+		}
+		certs[i] = c
+	}
+	id, err := IDFromCertificate(certs[0])
+	if err != nil {
+		return "", err
+	}
+	td, _ := trustDomain(id)
+	roots, ok := bundles[td]
+	if !ok {
+		return "", fmt.Errorf("spiffe: no bundle for trust domain %s", td)
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err = certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return "", fmt.Errorf("spiffe: verifying %s: %v", id, err)
+	}
+	return id, nil
+}
+
+// IDFromCertificate returns the SPIFFE ID of an X.509 SVID, which is its
+// only URI SAN.
+func IDFromCertificate(c *x509.Certificate) (string, error) {
+	if len(c.URIs) != 1 || c.URIs[0].Scheme != "spiffe" {
+		return "", errors.New("spiffe: certificate must have exactly one SPIFFE ID URI")
+	}
+	id := c.URIs[0].String()
+	if _, err := trustDomain(id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// trustDomain returns the trust domain of a SPIFFE ID.
+func trustDomain(id string) (string, error) {
+	rest := strings.TrimPrefix(id, "spiffe://")
+	if rest == id {
+		return "", fmt.Errorf("spiffe: invalid SPIFFE ID %q", id)
+	}
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		rest = rest[:i]
+	}
+	if rest == "" {
+		return "", fmt.Errorf("spiffe: invalid SPIFFE ID %q", id)
+	}
+	return rest, nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package spiffe
+
+import (
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+)
+
+// The messages of the X.509 part of the Workload API, from workload.proto
+// of the SPIFFE specification. They are few enough to be written by hand.
+
+// FetchX509SVIDMethod is the full name of the Workload API method streaming
+// X.509 SVIDs.
+const FetchX509SVIDMethod = "/SpiffeWorkloadAPI/FetchX509SVID"
+
+// WorkloadHeader is the metadata key that must be set to "true" on calls to
+// the Workload API.
+const WorkloadHeader = "workload.spiffe.io"
+
+// X509SVIDRequest is the request of FetchX509SVID.
+type X509SVIDRequest struct{}
+
+func (m *X509SVIDRequest) Reset()         { *m = X509SVIDRequest{} }
+func (m *X509SVIDRequest) String() string { return proto.CompactTextString(m) }
+func (*X509SVIDRequest) ProtoMessage()    {}
+
+// X509SVIDResponse is a response of FetchX509SVID, holding the current
+// SVIDs of the workload.
+type X509SVIDResponse struct {
+	SVIDs []*X509SVID `protobuf:"bytes,1,rep,name=svids,proto3"`
+	// CRL holds ASN.1 DER encoded certificate revocation lists.
+	CRL [][]byte `protobuf:"bytes,2,rep,name=crl,proto3"`
+	// FederatedBundles holds the ASN.1 DER encoded CA certificates of
+	// federated trust domains, keyed by trust domain ID.
+	FederatedBundles map[string][]byte `protobuf:"bytes,3,rep,name=federated_bundles,json=federatedBundles,proto3" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *X509SVIDResponse) Reset()         { *m = X509SVIDResponse{} }
+func (m *X509SVIDResponse) String() string { return proto.CompactTextString(m) }
+func (*X509SVIDResponse) ProtoMessage()    {}
+
+// X509SVID is one SVID of the workload.
+type X509SVID struct {
+	// SpiffeID is the SPIFFE ID of the SVID.
+	SpiffeID string `protobuf:"bytes,1,opt,name=spiffe_id,json=spiffeId,proto3"`
+	// X509SVID holds the ASN.1 DER encoded certificate chain, leaf first.
+	X509SVID []byte `protobuf:"bytes,2,opt,name=x509_svid,json=x509Svid,proto3"`
+	// X509SVIDKey holds the PKCS#8 DER encoded private key.
+	X509SVIDKey []byte `protobuf:"bytes,3,opt,name=x509_svid_key,json=x509SvidKey,proto3"`
+	// Bundle holds the ASN.1 DER encoded CA certificates of the trust
+	// domain of the SVID.
+	Bundle []byte `protobuf:"bytes,4,opt,name=bundle,proto3"`
+}
+
+func (m *X509SVID) Reset()         { *m = X509SVID{} }
+func (m *X509SVID) String() string { return proto.CompactTextString(m) }
+func (*X509SVID) ProtoMessage()    {}
+
+var fetchX509SVIDDesc = &grpc.StreamDesc{
+	StreamName:    "FetchX509SVID",
+	ServerStreams: true,
+}
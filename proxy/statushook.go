@@ -0,0 +1,70 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// StatusHook inspects or rewrites the final status and trailers of a call
+// before they are sent to the client. Successful calls have a status with
+// codes.OK. The hook receives a copy of the trailers, which it may modify in
+// place, and returns the status and trailers to send. Returning an OK status
+// for a failed call makes it succeed, and the reverse.
+type StatusHook func(ctx context.Context, st *status.Status, trailer metadata.MD) (*status.Status, metadata.MD)
+
+// WithStatusHook adds a hook for the final status of calls. Hooks run in the
+// order they were added, after the error mappers, and see the trailers set
+// by the backend and every other option. Access logs, metrics and traces
+// record the status before the hooks.
+func WithStatusHook(h StatusHook) Option {
+	return func(o *options) {
+		o.statusHooks = append(o.statusHooks, h)
+	}
+}
+
+// trailerBufferServerStream holds back trailers, so that they can be given
+// to the status hooks along with the final status.
+type trailerBufferServerStream struct {
+	grpc.ServerStream
+
+	mu      sync.Mutex
+	trailer metadata.MD
+}
+
+func (s *trailerBufferServerStream) SetTrailer(md metadata.MD) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trailer = metadata.Join(s.trailer, md)
+}
+
+// finish runs the status hooks for err, sets the resulting trailers and
+// returns the resulting error.
+func (s *trailerBufferServerStream) finish(hooks []StatusHook, err error) error {
+	s.mu.Lock()
+	trailer := s.trailer.Copy()
+	s.mu.Unlock()
+	st := status.Convert(err)
+	ctx := s.Context()
+	for _, h := range hooks {
+		st, trailer = h(ctx, st, trailer)
+		if st == nil {
+			st = status.New(codes.OK, "")
+		}
+		if trailer == nil {
+			trailer = metadata.MD{}
+		}
+	}
+	if len(trailer) != 0 {
+		s.ServerStream.SetTrailer(trailer)
+	}
+	return st.Err()
+}
@@ -0,0 +1,88 @@
+package proxy_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestStatusHook_Rewrite(t *testing.T) {
+	l := &recordingLogger{}
+	svc := &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			grpc.SetTrailer(ctx, metadata.Pairs("backend-trailer", "1"))
+			if ping.Value == "fail" {
+				return nil, status.Error(codes.Internal, "internal detail")
+			}
+			return &pb.PingResponse{Value: ping.Value}, nil
+		},
+	}
+	var seen []codes.Code
+	hook := func(ctx context.Context, st *status.Status, trailer metadata.MD) (*status.Status, metadata.MD) {
+		seen = append(seen, st.Code())
+		trailer.Set("error-id", "e-42")
+		if st.Code() == codes.Internal {
+			return status.New(codes.Unavailable, "try again"), trailer
+		}
+		return st, trailer
+	}
+	env := newTestEnv(t, svc, proxy.WithStatusHook(hook), proxy.WithAccessLogger(l))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	var trailer metadata.MD
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "fail"}, grpc.Trailer(&trailer))
+	assert.Equal(t, status.Error(codes.Unavailable, "try again"), err)
+	assert.Equal(t, []string{"e-42"}, trailer.Get("error-id"))
+	assert.Equal(t, []string{"1"}, trailer.Get("backend-trailer"), "backend trailers are kept")
+
+	trailer = nil
+	resp, err := env.client.Ping(ctx, &pb.PingRequest{Value: "ok"}, grpc.Trailer(&trailer))
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", resp.Value)
+	assert.Equal(t, []string{"e-42"}, trailer.Get("error-id"), "hooks also run for successful calls")
+
+	assert.Equal(t, []codes.Code{codes.Internal, codes.OK}, seen)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if assert.Len(t, l.ends, 2) {
+		assert.Equal(t, codes.Internal, l.ends[0].Code, "access logs see the original status")
+	}
+}
+
+func TestStatusHook_Order(t *testing.T) {
+	svc := &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			return nil, status.Error(codes.Internal, "internal detail")
+		},
+	}
+	var got []string
+	mapper := func(ctx context.Context, src proxy.ErrorSource, err error) error {
+		got = append(got, "mapper")
+		return status.Error(codes.Aborted, "mapped")
+	}
+	hook := func(name string) proxy.StatusHook {
+		return func(ctx context.Context, st *status.Status, trailer metadata.MD) (*status.Status, metadata.MD) {
+			got = append(got, name+":"+st.Message())
+			return status.New(st.Code(), name), nil
+		}
+	}
+	env := newTestEnv(t, svc, proxy.WithStatusHook(hook("first")), proxy.WithErrorMapper(mapper),
+		proxy.WithStatusHook(hook("second")))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	_, err := env.client.Ping(ctx, &pb.PingRequest{})
+	assert.Equal(t, status.Error(codes.Aborted, "second"), err)
+	assert.Equal(t, []string{"mapper", "first:mapped", "second:first"}, got)
+}
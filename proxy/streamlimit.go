@@ -0,0 +1,115 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// StreamLimits caps the lifetime and the messages of streams. Zero fields
+// are not limited.
+type StreamLimits struct {
+	// MaxDuration ends streams older than this. The backend call is
+	// cancelled and the client gets codes.DeadlineExceeded.
+	MaxDuration time.Duration
+
+	// MaxRequests limits the messages the client may send. On the next
+	// message the proxy half-closes the stream to the backend, which may
+	// still finish its responses, and the client then gets
+	// codes.ResourceExhausted.
+	MaxRequests int
+
+	// MaxResponses limits the messages the backend may send. The next
+	// message cancels the backend call and the client gets
+	// codes.ResourceExhausted.
+	MaxResponses int
+}
+
+// WithStreamLimits limits the duration and the messages of every stream,
+// see also MethodPolicy.StreamLimits.
+func WithStreamLimits(l StreamLimits) Option {
+	return func(o *options) {
+		o.streamLimits = &l
+	}
+}
+
+// limitedServerStream enforces StreamLimits on a stream.
+type limitedServerStream struct {
+	grpc.ServerStream
+	limits *StreamLimits
+
+	// requests and responses are only used by the goroutine copying the
+	// direction.
+	requests, responses int
+
+	mu    sync.Mutex
+	err   error
+	timer *time.Timer
+}
+
+// limitStream applies limits to ss, calling cancel to stop the backend call
+// when the maximum duration is reached.
+func limitStream(ss grpc.ServerStream, limits *StreamLimits, cancel context.CancelFunc) *limitedServerStream {
+	s := &limitedServerStream{ServerStream: ss, limits: limits}
+	if limits.MaxDuration > 0 {
+		s.timer = time.AfterFunc(limits.MaxDuration, func() {
+			s.fail(status.Errorf(codes.DeadlineExceeded, "stream exceeded the maximum duration of %v", limits.MaxDuration))
+			cancel()
+		})
+	}
+	return s
+}
+
+func (s *limitedServerStream) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *limitedServerStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if _, ok := m.(*frame); !ok || s.limits.MaxRequests <= 0 {
+		return nil
+	}
+	if s.requests++; s.requests > s.limits.MaxRequests {
+		s.fail(status.Errorf(codes.ResourceExhausted, "stream exceeded the maximum of %d request messages", s.limits.MaxRequests))
+		// Ending the input half-closes the backend stream.
+		return io.EOF
+	}
+	return nil
+}
+
+func (s *limitedServerStream) SendMsg(m interface{}) error {
+	if _, ok := m.(*frame); ok && s.limits.MaxResponses > 0 {
+		if s.responses++; s.responses > s.limits.MaxResponses {
+			err := status.Errorf(codes.ResourceExhausted, "stream exceeded the maximum of %d response messages", s.limits.MaxResponses)
+			s.fail(err)
+			return err
+		}
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+// stop stops the limits and returns the error of the limit which was hit,
+// if any.
+func (s *limitedServerStream) stop() error {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
@@ -0,0 +1,105 @@
+package proxy_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestStreamLimits_MaxRequests(t *testing.T) {
+	received := make(chan int, 1)
+	svc := &pingService{
+		pingStream: func(stream pb.TestService_PingStreamServer) error {
+			n := 0
+			for {
+				_, err := stream.Recv()
+				if err == io.EOF {
+					received <- n
+					// The backend may still answer after the half-close.
+					return stream.Send(&pb.PingResponse{Value: "done"})
+				}
+				if err != nil {
+					return err
+				}
+				n++
+			}
+		},
+	}
+	env := newTestEnv(t, svc, proxy.WithStreamLimits(proxy.StreamLimits{MaxRequests: 2}))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	stream, err := env.client.PingStream(ctx)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, stream.Send(&pb.PingRequest{Value: "x"}))
+	}
+	assert.Equal(t, 2, <-received, "the backend is half-closed after the maximum")
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, "done", resp.Value)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "2 request messages")
+
+	// Streams within the limit are not affected.
+	stream, err = env.client.PingStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.PingRequest{Value: "x"}))
+	require.NoError(t, stream.CloseSend())
+	<-received
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestStreamLimits_MaxResponses(t *testing.T) {
+	env := newTestEnv(t, &pingService{},
+		proxy.WithMethodPolicy("/vgough.testproto.TestService/PingList", proxy.MethodPolicy{
+			StreamLimits: &proxy.StreamLimits{MaxResponses: 3},
+		}))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	stream, err := env.client.PingList(ctx, &pb.PingRequest{Value: "x"})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := stream.Recv()
+		require.NoError(t, err)
+	}
+	_, err = stream.Recv()
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "3 response messages")
+
+	_, err = env.client.Ping(ctx, &pb.PingRequest{Value: "x"})
+	assert.NoError(t, err, "the policy only applies to its methods")
+}
+
+func TestStreamLimits_MaxDuration(t *testing.T) {
+	env := newTestEnv(t, &pingService{}, proxy.WithStreamLimits(proxy.StreamLimits{MaxDuration: 100 * time.Millisecond}))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	stream, err := env.client.PingStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.PingRequest{Value: "x"}))
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	start := time.Now()
+	_, err = stream.Recv()
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "maximum duration of 100ms")
+	assert.True(t, time.Since(start) < time.Second)
+}
@@ -0,0 +1,47 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const grpcContentType = "application/grpc"
+
+// ContentSubtype returns the content-subtype of the call handled with ctx,
+// the name of the codec the client encoded its messages with, such as
+// "json" for a content-type of application/grpc+json. It is empty if the
+// client did not name a codec, which means the messages are protobuf.
+//
+// The proxy forwards messages without decoding them, so any codec works:
+// calls are made to the backend with the content-subtype of the client,
+// and the client gets it back with the responses.
+func ContentSubtype(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, ct := range md.Get("content-type") {
+		if !strings.HasPrefix(ct, grpcContentType) {
+			continue
+		}
+		rest := ct[len(grpcContentType):]
+		if len(rest) > 1 && (rest[0] == '+' || rest[0] == ';') {
+			return strings.ToLower(rest[1:])
+		}
+		return ""
+	}
+	return ""
+}
+
+// contentSubtypeOption returns the call option which passes the
+// content-subtype of the client on to the backend, or nil if there is none.
+func contentSubtypeOption(serverCtx context.Context) grpc.CallOption {
+	if subtype := ContentSubtype(serverCtx); subtype != "" {
+		return grpc.CallContentSubtype(subtype)
+	}
+	return nil
+}
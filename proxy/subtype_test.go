@@ -0,0 +1,91 @@
+package proxy_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// jsonCodec encodes messages as JSON, registered under a name no real
+// codec uses.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := (&jsonpb.Marshaler{}).Marshal(&buf, v.(proto.Message))
+	return buf.Bytes(), err
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return jsonpb.Unmarshal(bytes.NewReader(data), v.(proto.Message))
+}
+
+func (jsonCodec) Name() string {
+	return "testjson"
+}
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+func TestContentSubtype_Passthrough(t *testing.T) {
+	var backendCT []string
+	svc := &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			md, _ := metadata.FromIncomingContext(ctx)
+			backendCT = md.Get("content-type")
+			return &pb.PingResponse{Value: ping.Value, Counter: 7}, nil
+		},
+	}
+	var directorSubtype string
+	env := newTestEnvWithDirector(t, svc, func(backend *grpc.ClientConn) proxy.StreamDirector {
+		return func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+			directorSubtype = proxy.ContentSubtype(ctx)
+			return ctx, nil, proxy.Direction{BackendConn: backend}, nil
+		}
+	})
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	var header metadata.MD
+	resp, err := env.client.Ping(ctx, &pb.PingRequest{Value: "json"}, grpc.CallContentSubtype("testjson"), grpc.Header(&header))
+	require.NoError(t, err, "the backend decodes the JSON of the client")
+	assert.Equal(t, "json", resp.Value)
+	assert.EqualValues(t, 7, resp.Counter)
+	assert.Equal(t, "testjson", directorSubtype)
+	assert.Equal(t, []string{"application/grpc+testjson"}, backendCT)
+	assert.Equal(t, []string{"application/grpc+testjson"}, header.Get("content-type"), "the client gets its codec back")
+
+	_, err = env.client.Ping(ctx, &pb.PingRequest{Value: "proto"})
+	require.NoError(t, err)
+	assert.Empty(t, directorSubtype)
+	assert.Equal(t, []string{"application/grpc"}, backendCT)
+}
+
+func TestContentSubtype(t *testing.T) {
+	for ct, want := range map[string]string{
+		"application/grpc":            "",
+		"application/grpc+proto":      "proto",
+		"application/grpc+JSON":       "json",
+		"application/grpc;codec":      "codec",
+		"application/grpc+":           "",
+		"application/json":            "",
+		"application/grpcweb+unknown": "",
+	} {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("content-type", ct))
+		assert.Equal(t, want, proxy.ContentSubtype(ctx), ct)
+	}
+	assert.Empty(t, proxy.ContentSubtype(context.Background()))
+}
@@ -0,0 +1,230 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// Switchover is a blue/green switch of a route from one backend to another,
+// see Router.Switch.
+type Switchover struct {
+	// Route is the name of the switched route.
+	Route string
+	// From is the backend the route used before the switch. It is empty if
+	// the route had a split.
+	From string
+	// To is the backend the route uses now.
+	To string
+	// Started is the time of the switch, and Deadline the end of its grace
+	// period.
+	Started  time.Time
+	Deadline time.Time
+
+	router *Router
+	done   chan struct{}
+
+	// Guarded by router.callsMu.
+	calls     map[*routedCall]struct{}
+	idle      chan struct{}
+	cancelled int
+}
+
+// SwitchoverStatus is the progress of a Switchover.
+type SwitchoverStatus struct {
+	Route, From, To string
+	Started         time.Time
+	Deadline        time.Time
+	// Remaining is the number of calls still in flight on the old backends.
+	Remaining int
+	// Cancelled is the number of calls cancelled at the deadline.
+	Cancelled int
+	// Done reports whether the old calls are all done.
+	Done bool
+}
+
+// routedCall is an in-flight call of a named route.
+type routedCall struct {
+	route   string
+	backend string
+	cancel  context.CancelFunc
+	sw      *Switchover
+}
+
+// track registers a call of a named route, so that a switchover can wait
+// for it and cancel it.
+func (r *Router) track(ctx context.Context, route, backend string, conn *grpc.ClientConn, done func(error)) (context.Context, context.CancelFunc, Direction, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	call := &routedCall{route: route, backend: backend, cancel: cancel}
+	r.callsMu.Lock()
+	if r.calls == nil {
+		r.calls = make(map[*routedCall]struct{})
+	}
+	r.calls[call] = struct{}{}
+	r.callsMu.Unlock()
+	var once sync.Once
+	return ctx, cancel, Direction{BackendConn: conn, Done: func(err error) {
+		once.Do(func() {
+			if done != nil {
+				done(err)
+			}
+			r.untrack(call)
+		})
+	}}, nil
+}
+
+func (r *Router) untrack(call *routedCall) {
+	r.callsMu.Lock()
+	defer r.callsMu.Unlock()
+	delete(r.calls, call)
+	if s := call.sw; s != nil {
+		delete(s.calls, call)
+		if len(s.calls) == 0 && s.idle != nil {
+			close(s.idle)
+			s.idle = nil
+		}
+	}
+}
+
+// Switch atomically sends all calls of the named route to backend to,
+// dropping any split of the route. Calls already in flight on the previous
+// backends may finish within grace, after which they are cancelled. The
+// returned Switchover reports the progress, see Status and Done.
+//
+// Only routes with a name track their calls. Replace discards the switch
+// along with the old routes, but does not stop the draining.
+func (r *Router) Switch(route, to string, grace time.Duration) (*Switchover, error) {
+	r.mu.Lock()
+	if _, ok := r.backends[to]; !ok {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("backend %q is not available", to)
+	}
+	var rt *Route
+	for i := range r.routes {
+		if r.routes[i].Name == route {
+			rt = &r.routes[i]
+			break
+		}
+	}
+	if rt == nil {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("no route named %q", route)
+	}
+	now := time.Now()
+	s := &Switchover{
+		Route:    route,
+		To:       to,
+		Started:  now,
+		Deadline: now.Add(grace),
+		router:   r,
+		done:     make(chan struct{}),
+		calls:    make(map[*routedCall]struct{}),
+		idle:     make(chan struct{}),
+	}
+	if len(rt.Split) == 0 && len(rt.MethodSplits) == 0 {
+		s.From = rt.Backend
+	}
+	// All routes with the name are switched, as SetSplit changes them all.
+	for i := range r.routes {
+		if r.routes[i].Name == route {
+			r.routes[i].Backend = to
+			r.routes[i].Split = nil
+			r.routes[i].MethodSplits = nil
+		}
+	}
+	// Calls are registered under the read lock, so none is missed here.
+	r.callsMu.Lock()
+	for call := range r.calls {
+		if call.route == route && call.backend != to && call.sw == nil {
+			call.sw = s
+			s.calls[call] = struct{}{}
+		}
+	}
+	if len(s.calls) == 0 {
+		close(s.idle)
+		s.idle = nil
+	}
+	idle := s.idle
+	if len(r.switchovers) == maxSwitchovers {
+		r.switchovers = append(r.switchovers[:0], r.switchovers[1:]...)
+	}
+	r.switchovers = append(r.switchovers, s)
+	r.callsMu.Unlock()
+	r.mu.Unlock()
+
+	go r.finishSwitch(s, idle, grace)
+	return s, nil
+}
+
+// finishSwitch waits for the old calls of s, and cancels those left after
+// grace.
+func (r *Router) finishSwitch(s *Switchover, idle <-chan struct{}, grace time.Duration) {
+	if idle != nil {
+		timer := time.NewTimer(grace)
+		select {
+		case <-idle:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	r.callsMu.Lock()
+	for call := range s.calls {
+		call.cancel()
+		s.cancelled++
+	}
+	r.callsMu.Unlock()
+	close(s.done)
+}
+
+// Done returns a channel which is closed once the calls on the previous
+// backends are done or cancelled.
+func (s *Switchover) Done() <-chan struct{} {
+	return s.done
+}
+
+// maxSwitchovers is the number of switchovers a Router remembers.
+const maxSwitchovers = 16
+
+// Switchovers returns the status of the latest switchovers of r, oldest
+// first.
+func (r *Router) Switchovers() []SwitchoverStatus {
+	r.callsMu.Lock()
+	defer r.callsMu.Unlock()
+	statuses := make([]SwitchoverStatus, len(r.switchovers))
+	for i, s := range r.switchovers {
+		statuses[i] = s.statusLocked()
+	}
+	return statuses
+}
+
+// Status returns the progress of s.
+func (s *Switchover) Status() SwitchoverStatus {
+	s.router.callsMu.Lock()
+	defer s.router.callsMu.Unlock()
+	return s.statusLocked()
+}
+
+func (s *Switchover) statusLocked() SwitchoverStatus {
+	st := SwitchoverStatus{
+		Route:     s.Route,
+		From:      s.From,
+		To:        s.To,
+		Started:   s.Started,
+		Deadline:  s.Deadline,
+		Remaining: len(s.calls),
+		Cancelled: s.cancelled,
+	}
+	select {
+	case <-s.done:
+		st.Done = true
+	default:
+	}
+	return st
+}
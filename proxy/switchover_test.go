@@ -0,0 +1,93 @@
+package proxy_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestRouter_Switch(t *testing.T) {
+	greenServer, greenConn := startBackend(t, namedService("green"))
+	defer greenServer.Stop()
+	defer greenConn.Close()
+
+	r := proxy.NewRouter()
+	env := newTestEnvWithDirector(t, namedService("blue"), func(backend *grpc.ClientConn) proxy.StreamDirector {
+		r.AddBackend("blue", backend)
+		r.AddBackend("green", greenConn)
+		r.AddRoute(proxy.Route{Name: "api", Backend: "blue"})
+		return r.Direct
+	})
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	openStream := func() pb.TestService_PingStreamClient {
+		stream, err := env.client.PingStream(ctx)
+		require.NoError(t, err)
+		require.NoError(t, stream.Send(&pb.PingRequest{Value: "x"}))
+		_, err = stream.Recv()
+		require.NoError(t, err)
+		return stream
+	}
+	finished := openStream()
+	lingering := openStream()
+
+	_, err := r.Switch("api", "missing", time.Second)
+	assert.Error(t, err, "unknown backend")
+	_, err = r.Switch("missing", "green", time.Second)
+	assert.Error(t, err, "unknown route")
+
+	sw, err := r.Switch("api", "green", 200*time.Millisecond)
+	require.NoError(t, err)
+	st := sw.Status()
+	assert.Equal(t, "blue", st.From)
+	assert.Equal(t, "green", st.To)
+	assert.Equal(t, 2, st.Remaining)
+
+	out, err := env.client.Ping(ctx, &pb.PingRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, "green", out.Value, "new calls go to the new backend")
+	assert.Equal(t, "green", r.Routes()[0].Backend)
+
+	// Old streams keep working during the grace period.
+	require.NoError(t, finished.Send(&pb.PingRequest{Value: "y"}))
+	_, err = finished.Recv()
+	require.NoError(t, err)
+	require.NoError(t, finished.CloseSend())
+	_, err = finished.Recv()
+	require.Error(t, err)
+
+	select {
+	case <-sw.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("switchover did not finish")
+	}
+	_, err = lingering.Recv()
+	assert.Equal(t, codes.Canceled, status.Code(err), "streams left after the grace period are cancelled")
+	st = sw.Status()
+	assert.True(t, st.Done)
+	assert.Equal(t, 1, st.Cancelled)
+
+	switches := r.Switchovers()
+	require.Len(t, switches, 1)
+	assert.Equal(t, "api", switches[0].Route)
+
+	// A switch without old calls is done at once.
+	sw, err = r.Switch("api", "blue", time.Hour)
+	require.NoError(t, err)
+	select {
+	case <-sw.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("switchover did not finish")
+	}
+	assert.Equal(t, 0, sw.Status().Cancelled)
+}
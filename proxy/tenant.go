@@ -0,0 +1,176 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+// Sources of the tenant of a call, see TenantConfig.
+const (
+	// TenantFromAuthority uses the host of the :authority of the call.
+	TenantFromAuthority = "authority"
+	// TenantFromMetadata uses the value of the metadata key named by Key.
+	TenantFromMetadata = "metadata"
+	// TenantFromClaim uses the Identity of the call, see WithAuthenticator.
+	// If Key is set it names the claim to use, otherwise Identity.Tenant is
+	// used.
+	TenantFromClaim = "claim"
+)
+
+// TenantConfig maps tenants to backends. It is usually loaded from a YAML
+// or JSON file with LoadTenantConfig, such as:
+//
+//	source: metadata
+//	key: x-tenant
+//	default: shared
+//	tenants:
+//	  acme: acme-cluster
+//	  globex: acme-cluster
+type TenantConfig struct {
+	// Source is where the tenant of a call comes from, one of
+	// TenantFromAuthority, TenantFromMetadata or TenantFromClaim.
+	Source string `yaml:"source" json:"source"`
+	// Key is the metadata key or claim holding the tenant.
+	Key string `yaml:"key" json:"key"`
+	// Tenants maps tenants to backend names.
+	Tenants map[string]string `yaml:"tenants" json:"tenants"`
+	// Default is the backend of unknown tenants. If empty, calls of unknown
+	// tenants are rejected with codes.PermissionDenied.
+	Default string `yaml:"default" json:"default"`
+}
+
+// Validate checks that the configuration is usable.
+func (c *TenantConfig) Validate() error {
+	switch c.Source {
+	case TenantFromAuthority, TenantFromClaim:
+	case TenantFromMetadata:
+		if c.Key == "" {
+			return fmt.Errorf("tenant source %q needs a key", c.Source)
+		}
+	default:
+		return fmt.Errorf("unknown tenant source %q", c.Source)
+	}
+	for tenant, backend := range c.Tenants {
+		if backend == "" {
+			return fmt.Errorf("tenant %q has no backend", tenant)
+		}
+	}
+	return nil
+}
+
+// LoadTenantConfig reads and validates a TenantConfig from a YAML or JSON
+// file.
+func LoadTenantConfig(path string) (*TenantConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg TenantConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed parsing %s: %v", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid tenant config %s: %v", path, err)
+	}
+	return &cfg, nil
+}
+
+// TenantRouter picks the backend of a call by its tenant. Its configuration
+// may be replaced at any time, see Update and ReloadFile.
+//
+// Use it with BackendRegistry.Director:
+//
+//	director := registry.Director(tenants.Pick)
+type TenantRouter struct {
+	mu  sync.RWMutex
+	cfg *TenantConfig
+}
+
+// NewTenantRouter returns a TenantRouter using cfg.
+func NewTenantRouter(cfg *TenantConfig) (*TenantRouter, error) {
+	t := &TenantRouter{}
+	if err := t.Update(cfg); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Update replaces the configuration. An invalid configuration is rejected
+// and the previous one stays in use.
+func (t *TenantRouter) Update(cfg *TenantConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cfg = cfg
+	return nil
+}
+
+// ReloadFile loads the configuration from path and applies it with Update.
+func (t *TenantRouter) ReloadFile(path string) error {
+	cfg, err := LoadTenantConfig(path)
+	if err != nil {
+		return err
+	}
+	return t.Update(cfg)
+}
+
+// Pick returns the backend name for the tenant of a call.
+func (t *TenantRouter) Pick(ctx context.Context, method string) (string, error) {
+	t.mu.RLock()
+	cfg := t.cfg
+	t.mu.RUnlock()
+
+	tenant := cfg.tenant(ctx)
+	if backend, ok := cfg.Tenants[tenant]; ok && tenant != "" {
+		return backend, nil
+	}
+	if cfg.Default != "" {
+		return cfg.Default, nil
+	}
+	if tenant == "" {
+		return "", status.Error(codes.PermissionDenied, "no tenant")
+	}
+	return "", status.Errorf(codes.PermissionDenied, "unknown tenant %q", tenant)
+}
+
+func (c *TenantConfig) tenant(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	switch c.Source {
+	case TenantFromAuthority:
+		if values := md.Get(":authority"); len(values) != 0 {
+			if host, _, err := net.SplitHostPort(values[0]); err == nil {
+				return host
+			}
+			return values[0]
+		}
+	case TenantFromMetadata:
+		if values := md.Get(c.Key); len(values) != 0 {
+			return values[0]
+		}
+	case TenantFromClaim:
+		id, ok := IdentityFromContext(ctx)
+		if !ok {
+			return ""
+		}
+		if c.Key == "" {
+			return id.Tenant
+		}
+		v, _ := id.Claims[c.Key].(string)
+		return v
+	}
+	return ""
+}
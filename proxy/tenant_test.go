@@ -0,0 +1,86 @@
+package proxy_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func writeFile(t *testing.T, dir, name, data string) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+	return path
+}
+
+func TestTenantRouter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tenant")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := writeFile(t, dir, "tenants.yaml", `
+source: metadata
+key: x-tenant
+tenants:
+  acme: cluster-a
+  globex: cluster-b
+`)
+	cfg, err := proxy.LoadTenantConfig(path)
+	require.NoError(t, err)
+	tenants, err := proxy.NewTenantRouter(cfg)
+	require.NoError(t, err)
+
+	pick := func(md ...string) (string, error) {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(md...))
+		return tenants.Pick(ctx, "/svc/Method")
+	}
+	backend, err := pick("x-tenant", "globex")
+	require.NoError(t, err)
+	assert.Equal(t, "cluster-b", backend)
+
+	_, err = pick("x-tenant", "initech")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	json := writeFile(t, dir, "tenants.json", `{"source": "authority", "tenants": {"acme.example.com": "cluster-a"}, "default": "shared"}`)
+	require.NoError(t, tenants.ReloadFile(json))
+	backend, err = pick(":authority", "acme.example.com:443")
+	require.NoError(t, err)
+	assert.Equal(t, "cluster-a", backend)
+	backend, err = pick(":authority", "other.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "shared", backend)
+
+	broken := writeFile(t, dir, "broken.yaml", "source: cookie\n")
+	assert.Error(t, tenants.ReloadFile(broken))
+	backend, err = pick(":authority", "acme.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "cluster-a", backend, "invalid config is not applied")
+}
+
+func TestTenantRouter_Claims(t *testing.T) {
+	tenants, err := proxy.NewTenantRouter(&proxy.TenantConfig{
+		Source:  proxy.TenantFromClaim,
+		Key:     "org",
+		Tenants: map[string]string{"acme": "cluster-a"},
+	})
+	require.NoError(t, err)
+
+	ctx := proxy.NewContextWithIdentity(context.Background(), &proxy.Identity{
+		Subject: "alice",
+		Claims:  map[string]interface{}{"org": "acme"},
+	})
+	backend, err := tenants.Pick(ctx, "/svc/Method")
+	require.NoError(t, err)
+	assert.Equal(t, "cluster-a", backend)
+
+	_, err = tenants.Pick(context.Background(), "/svc/Method")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
@@ -0,0 +1,208 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxytesting
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+const (
+	// EchoPrefix is the prefix of request metadata keys which the Backend
+	// returns in the header and trailer of every call.
+	EchoPrefix = "x-echo-"
+
+	// ListResponses is the number of responses of PingList.
+	ListResponses = 10
+
+	// Hang makes Ping and PingStream block until the call is canceled,
+	// when sent as the request value.
+	Hang = "hang"
+
+	// Fail makes PingStream fail with codes.Aborted, when sent as the
+	// request value.
+	Fail = "fail"
+)
+
+// Backend is an in-memory TestService server:
+//
+//   - PingEmpty answers with an empty value.
+//   - Ping echoes the value of the request, or blocks until the call is
+//     canceled if the value is Hang.
+//   - PingError fails with codes.FailedPrecondition, with the value of the
+//     request as message.
+//   - PingList answers with ListResponses copies of the value, counted from
+//     zero.
+//   - PingStream echoes every request, counted from zero, until the client
+//     half-closes. A Hang value blocks until the call is canceled, a Fail
+//     value fails the call with codes.Aborted.
+//
+// Request metadata with keys starting with EchoPrefix is returned in the
+// response header and trailer of every method. Calls which end because
+// they were canceled or their deadline expired are reported by Canceled.
+type Backend struct {
+	lis      *proxy.InProcessListener
+	server   *grpc.Server
+	conn     *grpc.ClientConn
+	canceled chan error
+}
+
+// NewBackend starts a Backend.
+func NewBackend() *Backend {
+	lis := proxy.NewInProcessListener()
+	conn, err := grpc.Dial("inprocess",
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(lis.DialContext),
+		proxy.DialOption())
+	if err != nil {
+		// Dial does not connect, so it only fails on invalid options.
+		panic(err)
+	}
+	return serveBackend(lis, conn)
+}
+
+// serveBackend starts a Backend on lis, which conn is connected to.
+func serveBackend(lis *proxy.InProcessListener, conn *grpc.ClientConn) *Backend {
+	b := &Backend{
+		lis:      lis,
+		server:   grpc.NewServer(),
+		conn:     conn,
+		canceled: make(chan error, 100),
+	}
+	pb.RegisterTestServiceServer(b.server, &backendService{b: b})
+	go b.server.Serve(b.lis)
+	return b
+}
+
+// Conn returns a connection to the backend which uses the proxy codec, as
+// directors return it.
+func (b *Backend) Conn() *grpc.ClientConn {
+	return b.conn
+}
+
+// Listener returns the listener the backend serves on.
+func (b *Backend) Listener() *proxy.InProcessListener {
+	return b.lis
+}
+
+// Canceled receives the context error of every call which ended because
+// it was canceled or its deadline expired.
+func (b *Backend) Canceled() <-chan error {
+	return b.canceled
+}
+
+// Close stops the backend.
+func (b *Backend) Close() {
+	b.conn.Close()
+	b.server.Stop()
+}
+
+// wait blocks until ctx is done and reports the cancellation.
+func (b *Backend) wait(ctx context.Context) error {
+	<-ctx.Done()
+	return b.ended(ctx)
+}
+
+// ended reports the cancellation of a call which ended with ctx.
+func (b *Backend) ended(ctx context.Context) error {
+	select {
+	case b.canceled <- ctx.Err():
+	default:
+	}
+	return status.FromContextError(ctx.Err()).Err()
+}
+
+// echoMetadata returns the request metadata to echo, or nil.
+func echoMetadata(ctx context.Context) metadata.MD {
+	in, _ := metadata.FromIncomingContext(ctx)
+	var md metadata.MD
+	for k, v := range in {
+		if strings.HasPrefix(k, EchoPrefix) {
+			if md == nil {
+				md = metadata.MD{}
+			}
+			md[k] = v
+		}
+	}
+	return md
+}
+
+type backendService struct {
+	b *Backend
+}
+
+func (s *backendService) echo(ctx context.Context) {
+	if md := echoMetadata(ctx); md != nil {
+		grpc.SetHeader(ctx, md)
+		grpc.SetTrailer(ctx, md)
+	}
+}
+
+func (s *backendService) PingEmpty(ctx context.Context, _ *pb.Empty) (*pb.PingResponse, error) {
+	s.echo(ctx)
+	return &pb.PingResponse{}, nil
+}
+
+func (s *backendService) Ping(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+	s.echo(ctx)
+	if ping.Value == Hang {
+		return nil, s.b.wait(ctx)
+	}
+	return &pb.PingResponse{Value: ping.Value}, nil
+}
+
+func (s *backendService) PingError(ctx context.Context, ping *pb.PingRequest) (*pb.Empty, error) {
+	s.echo(ctx)
+	return nil, status.Error(codes.FailedPrecondition, ping.Value)
+}
+
+func (s *backendService) PingList(ping *pb.PingRequest, stream pb.TestService_PingListServer) error {
+	s.echo(stream.Context())
+	for i := 0; i < ListResponses; i++ {
+		if err := stream.Send(&pb.PingResponse{Value: ping.Value, Counter: int32(i)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *backendService) PingStream(stream pb.TestService_PingStreamServer) error {
+	if md := echoMetadata(stream.Context()); md != nil {
+		if err := stream.SendHeader(md); err != nil {
+			return err
+		}
+		stream.SetTrailer(md)
+	}
+	for i := 0; ; i++ {
+		ping, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if stream.Context().Err() != nil {
+				return s.b.ended(stream.Context())
+			}
+			return err
+		}
+		switch ping.Value {
+		case Hang:
+			return s.b.wait(stream.Context())
+		case Fail:
+			return status.Error(codes.Aborted, "failed on request")
+		}
+		if err := stream.Send(&pb.PingResponse{Value: ping.Value, Counter: int32(i)}); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxytesting
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// testTimeout bounds every conformance test.
+const testTimeout = 10 * time.Second
+
+// ConformanceTest is an end-to-end test of a Harness.
+type ConformanceTest struct {
+	Name string
+	Run  func(t *testing.T, h *Harness)
+}
+
+// ConformanceTests are the tests run by RunConformance.
+var ConformanceTests = []ConformanceTest{
+	{"Unary", testUnary},
+	{"Metadata", testMetadata},
+	{"StreamMetadata", testStreamMetadata},
+	{"ErrorTrailers", testErrorTrailers},
+	{"LargeMessages", testLargeMessages},
+	{"ServerStream", testServerStream},
+	{"BidiHalfClose", testBidiHalfClose},
+	{"StreamError", testStreamError},
+	{"Deadline", testDeadline},
+	{"ClientCancel", testClientCancel},
+}
+
+// RunConformance runs ConformanceTests as subtests of t, each with a new
+// Harness created with mkDirector and opts.
+func RunConformance(t *testing.T, mkDirector func(backend *grpc.ClientConn) proxy.StreamDirector, opts ...proxy.Option) {
+	for _, ct := range ConformanceTests {
+		ct := ct
+		t.Run(ct.Name, func(t *testing.T) {
+			h := NewHarness(mkDirector, opts...)
+			defer h.Close()
+			ct.Run(t, h)
+		})
+	}
+}
+
+// Context returns a context for the calls of a single test, which expires
+// after the timeout of the conformance tests.
+func Context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), testTimeout)
+}
+
+func testUnary(t *testing.T, h *Harness) {
+	ctx, cancel := Context()
+	defer cancel()
+	resp, err := h.Client.Ping(ctx, &pb.PingRequest{Value: "hello"})
+	require.NoError(t, err)
+	assert.Equal(t, "hello", resp.Value)
+	_, err = h.Client.PingEmpty(ctx, &pb.Empty{})
+	assert.NoError(t, err)
+}
+
+func testMetadata(t *testing.T, h *Harness) {
+	ctx, cancel := Context()
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, EchoPrefix+"one", "1")
+	var header, trailer metadata.MD
+	_, err := h.Client.Ping(ctx, &pb.PingRequest{Value: "md"}, grpc.Header(&header), grpc.Trailer(&trailer))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1"}, header.Get(EchoPrefix+"one"), "request metadata reaches the backend, and the response header the client")
+	assert.Equal(t, []string{"1"}, trailer.Get(EchoPrefix+"one"), "the response trailer reaches the client")
+}
+
+func testStreamMetadata(t *testing.T, h *Harness) {
+	ctx, cancel := Context()
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, EchoPrefix+"stream", "yes", EchoPrefix+"data-bin", "\x00\xff")
+	stream, err := h.Client.PingStream(ctx)
+	require.NoError(t, err)
+	header, err := stream.Header()
+	require.NoError(t, err, "the header is sent before any response")
+	assert.Equal(t, []string{"yes"}, header.Get(EchoPrefix+"stream"))
+	assert.Equal(t, []string{"\x00\xff"}, header.Get(EchoPrefix+"data-bin"), "binary metadata is kept")
+	require.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+	assert.Equal(t, []string{"yes"}, stream.Trailer().Get(EchoPrefix+"stream"))
+}
+
+func testErrorTrailers(t *testing.T, h *Harness) {
+	ctx, cancel := Context()
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, EchoPrefix+"err", "e")
+	var trailer metadata.MD
+	_, err := h.Client.PingError(ctx, &pb.PingRequest{Value: "bad things"}, grpc.Trailer(&trailer))
+	assert.Equal(t, status.Error(codes.FailedPrecondition, "bad things"), err, "the backend status reaches the client unchanged")
+	assert.Equal(t, []string{"e"}, trailer.Get(EchoPrefix+"err"), "trailers are kept with errors")
+}
+
+func testLargeMessages(t *testing.T, h *Harness) {
+	ctx, cancel := Context()
+	defer cancel()
+	large := strings.Repeat("x", 3<<20)
+	resp, err := h.Client.Ping(ctx, &pb.PingRequest{Value: large})
+	require.NoError(t, err)
+	assert.Equal(t, len(large), len(resp.Value))
+
+	stream, err := h.Client.PingStream(ctx)
+	require.NoError(t, err)
+	chunk := strings.Repeat("y", 512<<10)
+	go func() {
+		for i := 0; i < 8; i++ {
+			if err := stream.Send(&pb.PingRequest{Value: chunk}); err != nil {
+				return
+			}
+		}
+		stream.CloseSend()
+	}()
+	for i := 0; i < 8; i++ {
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, len(chunk), len(resp.Value))
+	}
+	_, err = stream.Recv()
+	assert.Equal(t, io.EOF, err)
+}
+
+func testServerStream(t *testing.T, h *Harness) {
+	ctx, cancel := Context()
+	defer cancel()
+	stream, err := h.Client.PingList(ctx, &pb.PingRequest{Value: "list"})
+	require.NoError(t, err)
+	for i := 0; i < ListResponses; i++ {
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, "list", resp.Value)
+		assert.EqualValues(t, i, resp.Counter, "responses keep their order")
+	}
+	_, err = stream.Recv()
+	assert.Equal(t, io.EOF, err)
+}
+
+func testBidiHalfClose(t *testing.T, h *Harness) {
+	ctx, cancel := Context()
+	defer cancel()
+	stream, err := h.Client.PingStream(ctx)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, stream.Send(&pb.PingRequest{Value: fmt.Sprint(i)}))
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprint(i), resp.Value)
+	}
+	for i := 3; i < 6; i++ {
+		require.NoError(t, stream.Send(&pb.PingRequest{Value: fmt.Sprint(i)}))
+	}
+	require.NoError(t, stream.CloseSend())
+	for i := 3; i < 6; i++ {
+		resp, err := stream.Recv()
+		require.NoError(t, err, "responses after the half-close are forwarded")
+		assert.Equal(t, fmt.Sprint(i), resp.Value)
+	}
+	_, err = stream.Recv()
+	assert.Equal(t, io.EOF, err, "the half-close reaches the backend")
+}
+
+func testStreamError(t *testing.T, h *Harness) {
+	ctx, cancel := Context()
+	defer cancel()
+	stream, err := h.Client.PingStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.PingRequest{Value: "ok"}))
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.PingRequest{Value: Fail}))
+	_, err = stream.Recv()
+	assert.Equal(t, status.Error(codes.Aborted, "failed on request"), err)
+}
+
+func testDeadline(t *testing.T, h *Harness) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := h.Client.Ping(ctx, &pb.PingRequest{Value: Hang})
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assertCanceled(t, h)
+}
+
+func testClientCancel(t *testing.T, h *Harness) {
+	ctx, cancel := Context()
+	defer cancel()
+	stream, err := h.Client.PingStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.PingRequest{Value: "ok"}))
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.PingRequest{Value: Hang}))
+	cancel()
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Canceled, status.Code(err))
+	assertCanceled(t, h)
+}
+
+// assertCanceled checks that the backend call ends promptly.
+func assertCanceled(t *testing.T, h *Harness) {
+	select {
+	case <-h.Backend.Canceled():
+	case <-time.After(time.Second):
+		t.Error("the backend call must end with the client call")
+	}
+}
@@ -0,0 +1,27 @@
+package proxytesting_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	proxytesting "github.com/mkxxx/grpc-proxy/proxy/testing"
+	"google.golang.org/grpc"
+)
+
+func TestConformance_Direction(t *testing.T) {
+	proxytesting.RunConformance(t, func(backend *grpc.ClientConn) proxy.StreamDirector {
+		return func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+			return ctx, nil, proxy.Direction{BackendConn: backend}, nil
+		}
+	})
+}
+
+func TestConformance_Router(t *testing.T) {
+	proxytesting.RunConformance(t, func(backend *grpc.ClientConn) proxy.StreamDirector {
+		router := proxy.NewRouter()
+		router.AddBackend("test", backend)
+		router.AddRoute(proxy.Route{MethodPrefix: "/vgough.testproto.TestService/", Backend: "test"})
+		return router.Direct
+	}, proxy.WithFlowControl(proxy.BackendToClient, proxy.FlowControl{Buffer: 4}))
+}
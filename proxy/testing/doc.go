@@ -0,0 +1,27 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+/*
+Package proxytesting helps authors of directors and options test that calls
+are proxied faithfully.
+
+A Backend is an in-memory server of the TestService in the testservice
+package, and a Harness connects a client through a proxy handler to it,
+over in-memory connections rather than sockets. RunConformance runs a table
+of end-to-end tests against a director, covering metadata, trailers, large
+messages, streaming, errors, deadlines and cancellations:
+
+	func TestDirector(t *testing.T) {
+		proxytesting.RunConformance(t, func(backend *grpc.ClientConn) proxy.StreamDirector {
+			return newMyDirector(backend)
+		})
+	}
+
+The director must send the calls of the TestService to the given backend
+connection, and may call other backends for other methods.
+
+The package is named proxytesting so that it can be imported along with
+the standard testing package.
+*/
+package proxytesting
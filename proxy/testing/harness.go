@@ -0,0 +1,51 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxytesting
+
+import (
+	"context"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"google.golang.org/grpc"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// Harness connects a client through a proxy handler to a Backend, over
+// in-memory connections.
+type Harness struct {
+	// Backend serves the calls of the TestService.
+	Backend *Backend
+	// ClientConn is the connection of Client to the proxy.
+	ClientConn *grpc.ClientConn
+	// Client calls the TestService through the proxy.
+	Client pb.TestServiceClient
+
+	proxy *proxy.TestProxy
+}
+
+// NewHarness starts a Backend and a proxy server, whose handler directs
+// calls with the director returned by mkDirector for the backend
+// connection, configured with opts.
+func NewHarness(mkDirector func(backend *grpc.ClientConn) proxy.StreamDirector, opts ...proxy.Option) *Harness {
+	// The director is only called once the harness is returned.
+	var director proxy.StreamDirector
+	tp := proxy.NewTestProxy(func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+		return director(ctx, method)
+	}, opts...)
+	director = mkDirector(tp.BackendConn)
+	return &Harness{
+		Backend:    serveBackend(tp.Backend, tp.BackendConn),
+		ClientConn: tp.ClientConn,
+		Client:     pb.NewTestServiceClient(tp.ClientConn),
+		proxy:      tp,
+	}
+}
+
+// Close stops the proxy and the backend.
+func (h *Harness) Close() {
+	h.proxy.Close()
+	h.Backend.Close()
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+)
+
+// TestProxy is a proxy whose client and backend connections are in-memory
+// pipes, for fast unit tests of applications which embed the package:
+//
+//	tp := proxy.NewTestProxy(nil)
+//	defer tp.Close()
+//	backend := grpc.NewServer()
+//	pb.RegisterOrderServiceServer(backend, fakeOrders)
+//	go backend.Serve(tp.Backend)
+//	defer backend.Stop()
+//	client := pb.NewOrderServiceClient(tp.ClientConn)
+type TestProxy struct {
+	// Backend is the listener of the backend server, which the test
+	// serves.
+	Backend *InProcessListener
+	// BackendConn is a connection to Backend using the proxy codec, for
+	// directors.
+	BackendConn *grpc.ClientConn
+	// ClientConn is a connection to the proxy.
+	ClientConn *grpc.ClientConn
+
+	lis    *InProcessListener
+	server *grpc.Server
+}
+
+// NewTestProxy starts a proxy which directs calls with director, through the
+// handler of TransparentHandler configured with opts. If director is nil,
+// all calls go to BackendConn. A director may refer to the returned
+// TestProxy, since it is only called once the proxy is returned.
+func NewTestProxy(director StreamDirector, opts ...Option) *TestProxy {
+	tp := &TestProxy{
+		Backend: NewInProcessListener(),
+		lis:     NewInProcessListener(),
+	}
+	tp.BackendConn = tp.dial(tp.Backend, DialOption())
+	if director == nil {
+		director = func(ctx context.Context, method string) (context.Context, context.CancelFunc, Direction, error) {
+			return ctx, nil, Direction{BackendConn: tp.BackendConn}, nil
+		}
+	}
+	tp.server = grpc.NewServer(
+		ServerOption(),
+		grpc.UnknownServiceHandler(TransparentHandler(director, opts...)),
+	)
+	go tp.server.Serve(tp.lis)
+	tp.ClientConn = tp.dial(tp.lis)
+	return tp
+}
+
+// Dial returns a new connection to the proxy, for clients which need their
+// own dial options.
+func (tp *TestProxy) Dial(opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	opts = append([]grpc.DialOption{grpc.WithInsecure(), grpc.WithContextDialer(tp.lis.DialContext)}, opts...)
+	return grpc.Dial("testproxy", opts...)
+}
+
+func (tp *TestProxy) dial(lis *InProcessListener, opts ...grpc.DialOption) *grpc.ClientConn {
+	opts = append([]grpc.DialOption{grpc.WithInsecure(), grpc.WithContextDialer(lis.DialContext)}, opts...)
+	conn, err := grpc.Dial("inprocess", opts...)
+	if err != nil {
+		// Dial does not connect, so it only fails on invalid options.
+		panic(err)
+	}
+	return conn
+}
+
+// Close stops the proxy and closes its connections. The backend server is
+// stopped by the test.
+func (tp *TestProxy) Close() {
+	tp.ClientConn.Close()
+	tp.server.Stop()
+	tp.BackendConn.Close()
+}
@@ -0,0 +1,75 @@
+package proxy_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestNewTestProxy(t *testing.T) {
+	tp := proxy.NewTestProxy(nil)
+	defer tp.Close()
+	backend := grpc.NewServer()
+	pb.RegisterTestServiceServer(backend, &pingService{})
+	go backend.Serve(tp.Backend)
+	defer backend.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := pb.NewTestServiceClient(tp.ClientConn)
+	resp, err := client.Ping(ctx, &pb.PingRequest{Value: "in memory"})
+	require.NoError(t, err)
+	assert.Equal(t, "in memory", resp.Value)
+
+	stream, err := client.PingList(ctx, &pb.PingRequest{Value: "list"})
+	require.NoError(t, err)
+	n := 0
+	for {
+		if _, err = stream.Recv(); err != nil {
+			break
+		}
+		n++
+	}
+	assert.Equal(t, countListResponses, n)
+}
+
+func TestNewTestProxy_DirectorAndOptions(t *testing.T) {
+	var tp *proxy.TestProxy
+	tp = proxy.NewTestProxy(func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+		if method != "/vgough.testproto.TestService/Ping" {
+			return ctx, nil, proxy.Direction{}, status.Error(codes.Unimplemented, "not routed")
+		}
+		return ctx, nil, proxy.Direction{BackendConn: tp.BackendConn}, nil
+	}, proxy.WithResponseHeaderHook(func(ctx context.Context, md metadata.MD) metadata.MD {
+		md.Set("x-proxied", "yes")
+		return md
+	}))
+	defer tp.Close()
+	backend := grpc.NewServer()
+	pb.RegisterTestServiceServer(backend, &pingService{})
+	go backend.Serve(tp.Backend)
+	defer backend.Stop()
+
+	conn, err := tp.Dial()
+	require.NoError(t, err)
+	defer conn.Close()
+	client := pb.NewTestServiceClient(conn)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var header metadata.MD
+	_, err = client.Ping(ctx, &pb.PingRequest{Value: "x"}, grpc.Header(&header))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"yes"}, header.Get("x-proxied"))
+	_, err = client.PingEmpty(ctx, &pb.Empty{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
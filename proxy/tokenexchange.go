@@ -0,0 +1,265 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Token types and grant type of OAuth 2.0 Token Exchange, RFC 8693.
+const (
+	TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+	TokenTypeJWT         = "urn:ietf:params:oauth:token-type:jwt"
+
+	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+)
+
+// maxExchangedTokens bounds the cache of a TokenExchanger.
+const maxExchangedTokens = 10000
+
+// TokenExchanger exchanges the bearer tokens of clients for tokens scoped to
+// a backend at a security token service, following OAuth 2.0 Token
+// Exchange (RFC 8693), so that backends never see the client tokens.
+//
+// Exchanged tokens are cached per client token and audience until shortly
+// before they expire:
+//
+//	sts := proxy.NewTokenExchanger("https://sts.example.com/token")
+//	router.AddRoute(proxy.Route{MethodPrefix: "/users.", Backend: "users",
+//		Credentials: sts.Credentials("users-api", "users.read")})
+type TokenExchanger struct {
+	endpoint string
+
+	// Client sends requests to the token service. Defaults to
+	// http.DefaultClient.
+	Client *http.Client
+
+	// ClientID and ClientSecret, if set, authenticate the proxy to the
+	// token service with HTTP basic authentication.
+	ClientID     string
+	ClientSecret string
+
+	// SubjectTokenType is the type of the client tokens. Defaults to
+	// TokenTypeAccessToken.
+	SubjectTokenType string
+
+	// RequestedTokenType, if set, is the type of token requested.
+	RequestedTokenType string
+
+	// RefreshMargin is how long before its expiry an exchanged token is
+	// exchanged again. Defaults to 30 seconds.
+	RefreshMargin time.Duration
+
+	// AllowInsecure sends exchanged tokens to backends over insecure
+	// connections.
+	AllowInsecure bool
+
+	mu     sync.Mutex
+	tokens map[exchangeKey]*exchangedToken
+}
+
+// exchangeKey identifies an exchanged token by a hash of the client token
+// and the audience and scope it was exchanged for.
+type exchangeKey [sha256.Size]byte
+
+type exchangedToken struct {
+	mu    sync.Mutex
+	token *Token
+}
+
+// NewTokenExchanger returns a TokenExchanger using the token endpoint of a
+// security token service.
+func NewTokenExchanger(endpoint string) *TokenExchanger {
+	return &TokenExchanger{
+		endpoint:         endpoint,
+		Client:           http.DefaultClient,
+		SubjectTokenType: TokenTypeAccessToken,
+		RefreshMargin:    30 * time.Second,
+		tokens:           make(map[exchangeKey]*exchangedToken),
+	}
+}
+
+// Credentials returns PerRPCCredentials replacing the bearer token of the
+// client with its exchange for audience and the space separated scope, for
+// Route.Credentials or Direction.Credentials. Calls without a client token
+// fail with codes.Unauthenticated.
+func (e *TokenExchanger) Credentials(audience, scope string) credentials.PerRPCCredentials {
+	return &exchangeCredentials{e: e, audience: audience, scope: scope}
+}
+
+type exchangeCredentials struct {
+	e        *TokenExchanger
+	audience string
+	scope    string
+}
+
+func (c *exchangeCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	subject, ok := bearerToken(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+	tok, err := c.e.Exchange(ctx, subject, c.audience, c.scope)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"authorization": "Bearer " + tok.AccessToken}, nil
+}
+
+func (c *exchangeCredentials) RequireTransportSecurity() bool {
+	return !c.e.AllowInsecure
+}
+
+// bearerToken returns the bearer token of the incoming metadata of ctx.
+func bearerToken(ctx context.Context) (string, bool) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		if len(v) > 7 && strings.EqualFold(v[:7], "bearer ") {
+			return strings.TrimSpace(v[7:]), true
+		}
+	}
+	return "", false
+}
+
+// Exchange returns a token for audience and scope in exchange for the client
+// token subject, from the cache if possible.
+func (e *TokenExchanger) Exchange(ctx context.Context, subject, audience, scope string) (*Token, error) {
+	entry := e.entry(exchangeKey(sha256.Sum256([]byte(subject + "\x00" + audience + "\x00" + scope))))
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if tok := entry.token; tok != nil && (tok.Expiry.IsZero() || time.Now().Add(e.RefreshMargin).Before(tok.Expiry)) {
+		return tok, nil
+	}
+	tok, err := e.exchange(ctx, subject, audience, scope)
+	if err != nil {
+		return nil, err
+	}
+	entry.token = tok
+	return tok, nil
+}
+
+// entry returns the cache entry for key, evicting expired tokens when the
+// cache is full.
+func (e *TokenExchanger) entry(key exchangeKey) *exchangedToken {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if entry, ok := e.tokens[key]; ok {
+		return entry
+	}
+	if len(e.tokens) >= maxExchangedTokens {
+		now := time.Now()
+		for k, entry := range e.tokens {
+			entry.mu.Lock()
+			expired := entry.token != nil && !entry.token.Expiry.IsZero() && now.After(entry.token.Expiry)
+			entry.mu.Unlock()
+			if expired {
+				delete(e.tokens, k)
+			}
+		}
+		// Without expired tokens, drop an arbitrary one.
+		for k := range e.tokens {
+			if len(e.tokens) < maxExchangedTokens {
+				break
+			}
+			delete(e.tokens, k)
+		}
+	}
+	entry := &exchangedToken{}
+	e.tokens[key] = entry
+	return entry
+}
+
+// exchangeResponse is the response of a token service, RFC 8693 section
+// 2.2.
+type exchangeResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (e *TokenExchanger) exchange(ctx context.Context, subject, audience, scope string) (*Token, error) {
+	form := url.Values{
+		"grant_type":         {grantTypeTokenExchange},
+		"subject_token":      {subject},
+		"subject_token_type": {e.SubjectTokenType},
+	}
+	if audience != "" {
+		form.Set("audience", audience)
+	}
+	if scope != "" {
+		form.Set("scope", scope)
+	}
+	if e.RequestedTokenType != "" {
+		form.Set("requested_token_type", e.RequestedTokenType)
+	}
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "invalid token exchange request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if e.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(e.ClientID), url.QueryEscape(e.ClientSecret))
+	}
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "token exchange failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "token exchange failed: %v", err)
+	}
+	var r exchangeResponse
+	jsonErr := json.Unmarshal(body, &r)
+	if resp.StatusCode != http.StatusOK {
+		return nil, exchangeError(resp.StatusCode, &r)
+	}
+	if jsonErr != nil || r.AccessToken == "" {
+		return nil, status.Error(codes.Unavailable, "token exchange failed: invalid response")
+	}
+	tok := &Token{AccessToken: r.AccessToken, TokenType: "Bearer"}
+	if r.ExpiresIn > 0 {
+		tok.Expiry = time.Now().Add(time.Duration(r.ExpiresIn) * time.Second)
+	}
+	return tok, nil
+}
+
+// exchangeError maps an error response of the token service, RFC 6749
+// section 5.2, to a status.
+func exchangeError(httpStatus int, r *exchangeResponse) error {
+	code := codes.Unavailable
+	switch r.Error {
+	case "invalid_grant", "invalid_request":
+		code = codes.Unauthenticated
+	case "invalid_target", "invalid_scope", "unauthorized_client":
+		code = codes.PermissionDenied
+	}
+	msg := r.Error
+	if r.ErrorDescription != "" {
+		msg += ": " + r.ErrorDescription
+	}
+	if msg == "" {
+		msg = fmt.Sprintf("HTTP status %d", httpStatus)
+	}
+	return status.Errorf(code, "token exchange failed: %s", msg)
+}
@@ -0,0 +1,115 @@
+package proxy_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// startSTS starts a token service exchanging tokens for "<audience>-<token>"
+// and counts the exchanges.
+func startSTS(t *testing.T, exchanges *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(exchanges, 1)
+		id, secret, _ := r.BasicAuth()
+		assert.Equal(t, "proxy", id)
+		assert.Equal(t, "s3cret", secret)
+		assert.Equal(t, "urn:ietf:params:oauth:grant-type:token-exchange", r.PostFormValue("grant_type"))
+		assert.Equal(t, proxy.TokenTypeAccessToken, r.PostFormValue("subject_token_type"))
+		assert.Equal(t, "read", r.PostFormValue("scope"))
+		w.Header().Set("Content-Type", "application/json")
+		subject := r.PostFormValue("subject_token")
+		if subject == "revoked" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "token revoked"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":      r.PostFormValue("audience") + "-" + subject,
+			"issued_token_type": proxy.TokenTypeAccessToken,
+			"token_type":        "Bearer",
+			"expires_in":        3600,
+		})
+	}))
+}
+
+func TestTokenExchanger(t *testing.T) {
+	var exchanges int32
+	sts := startSTS(t, &exchanges)
+	defer sts.Close()
+	ex := proxy.NewTokenExchanger(sts.URL)
+	ex.ClientID, ex.ClientSecret = "proxy", "s3cret"
+	ex.AllowInsecure = true
+	mkDirector := func(backend *grpc.ClientConn) proxy.StreamDirector {
+		return func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+			return ctx, nil, proxy.Direction{BackendConn: backend, Credentials: ex.Credentials("users", "read")}, nil
+		}
+	}
+	env := newTestEnvWithDirector(t, authorizationService(), mkDirector)
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+	ping := func(token string) (string, error) {
+		ctx := ctx
+		if token != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+		}
+		out, err := env.client.Ping(ctx, &pb.PingRequest{})
+		if err != nil {
+			return "", err
+		}
+		return out.Value, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		got, err := ping("alice")
+		require.NoError(t, err)
+		assert.Equal(t, "Bearer users-alice", got, "the client token is replaced")
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&exchanges), "exchanged tokens are cached")
+	got, err := ping("bob")
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer users-bob", got)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&exchanges), "tokens are cached per user")
+
+	_, err = ping("revoked")
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "token revoked")
+	_, err = ping("")
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestTokenExchanger_Exchange(t *testing.T) {
+	var exchanges int32
+	sts := startSTS(t, &exchanges)
+	defer sts.Close()
+	ex := proxy.NewTokenExchanger(sts.URL)
+	ex.ClientID, ex.ClientSecret = "proxy", "s3cret"
+
+	a, err := ex.Exchange(context.Background(), "alice", "users", "read")
+	require.NoError(t, err)
+	b, err := ex.Exchange(context.Background(), "alice", "orders", "read")
+	require.NoError(t, err)
+	assert.Equal(t, "users-alice", a.AccessToken)
+	assert.Equal(t, "orders-alice", b.AccessToken, "tokens are cached per audience")
+	assert.False(t, a.Expiry.IsZero())
+
+	ex.RefreshMargin = 2 * time.Hour
+	_, err = ex.Exchange(context.Background(), "alice", "users", "read")
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&exchanges), "tokens are exchanged again before they expire")
+}
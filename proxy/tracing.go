@@ -0,0 +1,134 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const tracerName = "github.com/mkxxx/grpc-proxy/proxy"
+
+// WithTracerProvider enables OpenTelemetry tracing of proxied streams.
+//
+// The trace context is extracted from the incoming metadata and a span is
+// started for every stream, which is available to the director through the
+// stream context. The span context is injected into the outgoing metadata,
+// so backend spans become children of the proxy span.
+//
+// Propagation uses the global propagator unless WithPropagator is given.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(o *options) {
+		if o.tracing == nil {
+			o.tracing = &tracing{}
+		}
+		o.tracing.tracer = tp.Tracer(tracerName)
+	}
+}
+
+// WithPropagator sets the propagator used to extract and inject trace
+// context when tracing is enabled.
+func WithPropagator(p propagation.TextMapPropagator) Option {
+	return func(o *options) {
+		if o.tracing == nil {
+			o.tracing = &tracing{}
+		}
+		o.tracing.propagator = p
+	}
+}
+
+type tracing struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+func (t *tracing) prop() propagation.TextMapPropagator {
+	if t.propagator != nil {
+		return t.propagator
+	}
+	return otel.GetTextMapPropagator()
+}
+
+// start starts the span of a stream. The returned function ends the span
+// with the result of the stream.
+func (t *tracing) start(ps *proxiedStream, in grpc.ServerStream) (grpc.ServerStream, func(error)) {
+	ctx := in.Context()
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		ctx = t.prop().Extract(ctx, metadataCarrier(md))
+	}
+	service, method := splitMethodName(ps.method)
+	ctx, span := t.tracer.Start(ctx, strings.TrimPrefix(ps.method, "/"),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "grpc"),
+			attribute.String("rpc.service", service),
+			attribute.String("rpc.method", method),
+		))
+
+	end := func(err error) {
+		if ps.backend != "" {
+			span.SetAttributes(attribute.String("net.peer.name", ps.backend))
+		}
+		code := status.Code(err)
+		span.SetAttributes(attribute.Int64("rpc.grpc.status_code", int64(code)))
+		if err != nil {
+			span.SetStatus(otelcodes.Error, status.Convert(err).Message())
+		}
+		span.End()
+	}
+	return &contextServerStream{ServerStream: in, ctx: ctx}, end
+}
+
+// inject adds the trace context of the current stream to the outgoing
+// metadata of clientCtx.
+func (t *tracing) inject(serverCtx, clientCtx context.Context) context.Context {
+	md, _ := metadata.FromOutgoingContext(clientCtx)
+	md = md.Copy()
+	spanCtx := trace.ContextWithSpan(clientCtx, trace.SpanFromContext(serverCtx))
+	t.prop().Inject(spanCtx, metadataCarrier(md))
+	return metadata.NewOutgoingContext(clientCtx, md)
+}
+
+// splitMethodName splits a full method name of the form "/service/method".
+func splitMethodName(fullMethod string) (string, string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if i := strings.Index(fullMethod, "/"); i >= 0 {
+		return fullMethod[:i], fullMethod[i+1:]
+	}
+	return "unknown", "unknown"
+}
+
+// metadataCarrier adapts metadata.MD to a propagation.TextMapCarrier.
+type metadataCarrier metadata.MD
+
+var _ propagation.TextMapCarrier = metadataCarrier{}
+
+func (c metadataCarrier) Get(key string) string {
+	if v := metadata.MD(c).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,63 @@
+package proxy_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestTracing_PropagatesSpanToBackend(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prop := propagation.TraceContext{}
+
+	var backendSpan trace.SpanContext
+	svc := &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			md, _ := metadata.FromIncomingContext(ctx)
+			carrier := propagation.HeaderCarrier{}
+			carrier.Set("traceparent", md.Get("traceparent")[0])
+			ctx = prop.Extract(ctx, carrier)
+			backendSpan = trace.SpanContextFromContext(ctx)
+			return &pb.PingResponse{Value: ping.Value}, nil
+		},
+	}
+	env := newTestEnv(t, svc, proxy.WithTracerProvider(tp), proxy.WithPropagator(prop))
+	defer env.Close()
+
+	// Start a client span whose context is sent to the proxy.
+	ctx, cancel := env.ctx()
+	defer cancel()
+	ctx, clientSpan := tp.Tracer("test").Start(ctx, "client")
+	carrier := propagation.HeaderCarrier{}
+	prop.Inject(ctx, carrier)
+	ctx = metadata.NewOutgoingContext(ctx, metadata.Pairs("traceparent", carrier.Get("traceparent")))
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err)
+	clientSpan.End()
+
+	var proxySpan sdktrace.ReadOnlySpan
+	for _, s := range recorder.Ended() {
+		if s.Name() == "vgough.testproto.TestService/Ping" {
+			proxySpan = s
+		}
+	}
+	require.NotNil(t, proxySpan, "proxy must record a span for the stream")
+	assert.Equal(t, clientSpan.SpanContext().TraceID(), proxySpan.SpanContext().TraceID())
+	assert.Equal(t, clientSpan.SpanContext().SpanID(), proxySpan.Parent().SpanID())
+	assert.Equal(t, proxySpan.SpanContext().TraceID(), backendSpan.TraceID(), "backend must receive the proxy trace")
+	assert.Equal(t, proxySpan.SpanContext().SpanID(), backendSpan.SpanID(), "backend parent must be the proxy span")
+	assert.Contains(t, proxySpan.Attributes(), attribute.String("net.peer.name", env.backendConn.Target()))
+	assert.Contains(t, proxySpan.Attributes(), attribute.String("rpc.method", "Ping"))
+}
@@ -0,0 +1,83 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"sort"
+	"sync"
+)
+
+// StreamTracker counts the in-flight streams of one or more proxy handlers
+// by method and backend. The zero value is ready to use.
+type StreamTracker struct {
+	mu     sync.Mutex
+	active map[streamKey]int
+}
+
+type streamKey struct {
+	method, backend string
+}
+
+// StreamCount is the number of in-flight streams of a method to a backend.
+type StreamCount struct {
+	Method  string
+	Backend string
+	Active  int
+}
+
+// WithStreamTracker registers the handler's streams with t once they are
+// directed to a backend.
+func WithStreamTracker(t *StreamTracker) Option {
+	return func(o *options) {
+		o.tracker = t
+	}
+}
+
+// start counts ps as in flight until the returned function is called.
+func (t *StreamTracker) start(ps *proxiedStream) func() {
+	key := streamKey{method: ps.method, backend: ps.backend}
+	t.mu.Lock()
+	if t.active == nil {
+		t.active = make(map[streamKey]int)
+	}
+	t.active[key]++
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.active[key]--; t.active[key] <= 0 {
+			delete(t.active, key)
+		}
+	}
+}
+
+// Streams returns the in-flight stream counts, ordered by method and
+// backend.
+func (t *StreamTracker) Streams() []StreamCount {
+	t.mu.Lock()
+	counts := make([]StreamCount, 0, len(t.active))
+	for key, n := range t.active {
+		counts = append(counts, StreamCount{Method: key.method, Backend: key.backend, Active: n})
+	}
+	t.mu.Unlock()
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Method != counts[j].Method {
+			return counts[i].Method < counts[j].Method
+		}
+		return counts[i].Backend < counts[j].Backend
+	})
+	return counts
+}
+
+// Active returns the total number of in-flight streams.
+func (t *StreamTracker) Active() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, c := range t.active {
+		n += c
+	}
+	return n
+}
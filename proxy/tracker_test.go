@@ -0,0 +1,39 @@
+package proxy_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+func TestStreamTracker(t *testing.T) {
+	tracker := &proxy.StreamTracker{}
+	env := newTestEnv(t, &pingService{}, proxy.WithStreamTracker(tracker))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	stream, err := env.client.PingStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.PingRequest{Value: "foo"}))
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	assert.Equal(t, []proxy.StreamCount{{
+		Method:  "/vgough.testproto.TestService/PingStream",
+		Backend: env.backendConn.Target(),
+		Active:  1,
+	}}, tracker.Streams())
+	assert.Equal(t, 1, tracker.Active())
+
+	require.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	require.Error(t, err)
+	assert.Eventually(t, func() bool { return tracker.Active() == 0 }, time.Second, time.Millisecond)
+	assert.Empty(t, tracker.Streams())
+}
@@ -0,0 +1,684 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// defaultTranscoderMaxBodySize is the request body size limit of a
+// Transcoder when MaxBodySize is not set.
+const defaultTranscoderMaxBodySize = 4 << 20
+
+// Transcoder is an http.Handler which maps HTTP/JSON requests to proxied gRPC
+// calls, following the google.api.http annotations of registered services.
+// Calls go through the given stream handler, so they share the director and
+// backends of native gRPC clients.
+//
+// Unary and server streaming methods are supported. Server streaming
+// responses are written as one JSON object per line.
+//
+// Backend headers are returned as Grpc-Metadata-<key> HTTP headers, and
+// trailers of unary calls as Grpc-Trailer-<key> headers.
+type Transcoder struct {
+	handler grpc.StreamHandler
+
+	// MessageType returns the Go type of a message by its full name. It
+	// defaults to the registry of github.com/golang/protobuf/proto. Request
+	// and response messages of registered methods must be known to it.
+	MessageType func(name string) reflect.Type
+
+	// Marshaler formats JSON responses. It defaults to using the original
+	// proto field names.
+	Marshaler *jsonpb.Marshaler
+
+	// MaxBodySize limits the size of request bodies. Larger requests fail
+	// with codes.ResourceExhausted. It defaults to 4 MiB, as the message
+	// size limit of gRPC servers.
+	MaxBodySize int64
+
+	mu     sync.RWMutex
+	routes []*httpRoute
+}
+
+// NewTranscoder returns a Transcoder serving calls with h, which is usually
+// the result of TransparentHandler.
+func NewTranscoder(h grpc.StreamHandler) *Transcoder {
+	return &Transcoder{
+		handler:     h,
+		MessageType: proto.MessageType,
+		Marshaler:   &jsonpb.Marshaler{OrigName: true},
+	}
+}
+
+// RegisterFile registers the annotated services of a proto file compiled
+// into the program with github.com/golang/protobuf.
+func (t *Transcoder) RegisterFile(filename string) error {
+	gz := proto.FileDescriptor(filename)
+	if gz == nil {
+		return fmt.Errorf("proto file %q is not registered", filename)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(gz))
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return err
+	}
+	var fd descriptor.FileDescriptorProto
+	if err := proto.Unmarshal(b, &fd); err != nil {
+		return err
+	}
+	return t.RegisterFileDescriptor(&fd)
+}
+
+// RegisterFileDescriptor registers the methods of fd which have a
+// google.api.http annotation. Client streaming methods cannot be transcoded
+// and are rejected.
+func (t *Transcoder) RegisterFileDescriptor(fd *descriptor.FileDescriptorProto) error {
+	var routes []*httpRoute
+	for _, sd := range fd.GetService() {
+		service := sd.GetName()
+		if fd.GetPackage() != "" {
+			service = fd.GetPackage() + "." + service
+		}
+		for _, md := range sd.GetMethod() {
+			if md.GetOptions() == nil || !proto.HasExtension(md.GetOptions(), annotations.E_Http) {
+				continue
+			}
+			ext, err := proto.GetExtension(md.GetOptions(), annotations.E_Http)
+			if err != nil {
+				return err
+			}
+			method := "/" + service + "/" + md.GetName()
+			if md.GetClientStreaming() {
+				return fmt.Errorf("client streaming method %s cannot be transcoded", method)
+			}
+			in := t.MessageType(strings.TrimPrefix(md.GetInputType(), "."))
+			out := t.MessageType(strings.TrimPrefix(md.GetOutputType(), "."))
+			if in == nil || out == nil {
+				return fmt.Errorf("message types of method %s are not registered", method)
+			}
+			rule := ext.(*annotations.HttpRule)
+			for _, r := range append([]*annotations.HttpRule{rule}, rule.GetAdditionalBindings()...) {
+				route, err := newHTTPRoute(r, method, in.Elem(), out.Elem(), md.GetServerStreaming())
+				if err != nil {
+					return fmt.Errorf("method %s: %v", method, err)
+				}
+				routes = append(routes, route)
+			}
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.routes = append(t.routes, routes...)
+	return nil
+}
+
+// httpRoute maps an HTTP binding to a gRPC method.
+type httpRoute struct {
+	verb         string
+	tmpl         *pathTemplate
+	method       string
+	in, out      reflect.Type
+	body         string
+	responseBody string
+	streaming    bool
+}
+
+func newHTTPRoute(rule *annotations.HttpRule, method string, in, out reflect.Type, streaming bool) (*httpRoute, error) {
+	route := &httpRoute{
+		method:       method,
+		in:           in,
+		out:          out,
+		body:         rule.GetBody(),
+		responseBody: rule.GetResponseBody(),
+		streaming:    streaming,
+	}
+	var path string
+	switch p := rule.GetPattern().(type) {
+	case *annotations.HttpRule_Get:
+		route.verb, path = http.MethodGet, p.Get
+	case *annotations.HttpRule_Put:
+		route.verb, path = http.MethodPut, p.Put
+	case *annotations.HttpRule_Post:
+		route.verb, path = http.MethodPost, p.Post
+	case *annotations.HttpRule_Delete:
+		route.verb, path = http.MethodDelete, p.Delete
+	case *annotations.HttpRule_Patch:
+		route.verb, path = http.MethodPatch, p.Patch
+	case *annotations.HttpRule_Custom:
+		route.verb, path = p.Custom.GetKind(), p.Custom.GetPath()
+	default:
+		return nil, fmt.Errorf("http rule has no pattern")
+	}
+	tmpl, err := parsePathTemplate(path)
+	if err != nil {
+		return nil, err
+	}
+	route.tmpl = tmpl
+	return route, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (t *Transcoder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route, vars, err := t.match(r)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	payload, err := t.decodeRequest(route, r, vars)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	s := &transcodedStream{t: t, route: route, w: w, request: payload}
+	s.ctx, s.cancel, err = httpStreamContext(r, route.method, s)
+	if err == nil {
+		err = t.handler(nil, s)
+	}
+	s.finish(err)
+}
+
+func (t *Transcoder) match(r *http.Request) (*httpRoute, map[string]string, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	found := false
+	for _, route := range t.routes {
+		vars, ok := route.tmpl.match(r.URL.EscapedPath())
+		if !ok {
+			continue
+		}
+		if route.verb == r.Method {
+			return route, vars, nil
+		}
+		found = true
+	}
+	if found {
+		return nil, nil, errMethodNotAllowed
+	}
+	return nil, nil, status.Errorf(codes.NotFound, "no method is bound to %s", r.URL.Path)
+}
+
+// errMethodNotAllowed is reported as HTTP status 405.
+var errMethodNotAllowed = status.Error(codes.Unimplemented, "method not allowed")
+
+// decodeRequest builds the binary request message from the JSON body, the
+// path variables and the query parameters.
+func (t *Transcoder) decodeRequest(route *httpRoute, r *http.Request, vars map[string]string) ([]byte, error) {
+	fields := make(map[string]interface{})
+	if route.body != "" {
+		max := t.MaxBodySize
+		if max <= 0 {
+			max = defaultTranscoderMaxBodySize
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "failed reading body: %v", err)
+		}
+		if int64(len(body)) > max {
+			return nil, status.Errorf(codes.ResourceExhausted, "request body larger than max (%d bytes)", max)
+		}
+		if len(bytes.TrimSpace(body)) != 0 {
+			if route.body == "*" {
+				dec := json.NewDecoder(bytes.NewReader(body))
+				dec.UseNumber()
+				if err := dec.Decode(&fields); err != nil {
+					return nil, status.Errorf(codes.InvalidArgument, "invalid JSON body: %v", err)
+				}
+			} else {
+				setField(fields, strings.Split(route.body, "."), json.RawMessage(body))
+			}
+		}
+	}
+	for name, v := range vars {
+		path := strings.Split(name, ".")
+		setField(fields, path, fieldValue(route.in, path, []string{v}))
+	}
+	if route.body != "*" {
+		for name, values := range r.URL.Query() {
+			if _, ok := vars[name]; ok || name == route.body {
+				continue
+			}
+			path := strings.Split(name, ".")
+			setField(fields, path, fieldValue(route.in, path, values))
+		}
+	}
+
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid request: %v", err)
+	}
+	msg := reflect.New(route.in).Interface().(proto.Message)
+	u := jsonpb.Unmarshaler{AllowUnknownFields: true}
+	if err := u.Unmarshal(bytes.NewReader(b), msg); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid request: %v", err)
+	}
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed encoding request: %v", err)
+	}
+	return payload, nil
+}
+
+// setField sets a nested field of a JSON object.
+func setField(fields map[string]interface{}, path []string, v interface{}) {
+	for _, name := range path[:len(path)-1] {
+		next, ok := fields[name].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			fields[name] = next
+		}
+		fields = next
+	}
+	fields[path[len(path)-1]] = v
+}
+
+// fieldValue converts string values of a path variable or query parameter to
+// the JSON value expected for the field. Numbers and enums are accepted as
+// strings by jsonpb, so only booleans and repeated fields need care.
+func fieldValue(t reflect.Type, path []string, values []string) interface{} {
+	ft := fieldType(t, path)
+	repeated := ft != nil && ft.Kind() == reflect.Slice && ft.Elem().Kind() != reflect.Uint8
+	if repeated {
+		ft = ft.Elem()
+	}
+	convert := func(v string) interface{} {
+		if ft != nil && ft.Kind() == reflect.Bool {
+			if b, err := strconv.ParseBool(v); err == nil {
+				return b
+			}
+		}
+		return v
+	}
+	if !repeated {
+		return convert(values[len(values)-1])
+	}
+	out := make([]interface{}, len(values))
+	for i, v := range values {
+		out[i] = convert(v)
+	}
+	return out
+}
+
+// fieldType returns the Go type of a nested message field, or nil if it is
+// unknown.
+func fieldType(t reflect.Type, path []string) reflect.Type {
+	for i, name := range path {
+		if t.Kind() != reflect.Struct {
+			return nil
+		}
+		props := proto.GetProperties(t)
+		var ft reflect.Type
+		for j, p := range props.Prop {
+			if p.OrigName == name || p.JSONName == name {
+				ft = t.Field(j).Type
+				break
+			}
+		}
+		if ft == nil {
+			return nil
+		}
+		if i == len(path)-1 {
+			return ft
+		}
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		t = ft
+	}
+	return nil
+}
+
+// transcodedStream adapts an HTTP/JSON exchange to a grpc.ServerStream.
+type transcodedStream struct {
+	t       *Transcoder
+	route   *httpRoute
+	w       http.ResponseWriter
+	ctx     context.Context
+	cancel  context.CancelFunc
+	request []byte
+
+	mu         sync.Mutex
+	recvd      bool
+	header     metadata.MD
+	trailer    metadata.MD
+	headerSent bool
+	response   []byte
+	done       bool
+}
+
+func (s *transcodedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *transcodedStream) SetHeader(md metadata.MD) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.headerSent {
+		return status.Error(codes.Internal, "header already sent")
+	}
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+// SendHeader only records the header, it is written along with the first
+// response.
+func (s *transcodedStream) SendHeader(md metadata.MD) error {
+	return s.SetHeader(md)
+}
+
+func (s *transcodedStream) SetTrailer(md metadata.MD) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trailer = metadata.Join(s.trailer, md)
+}
+
+func (s *transcodedStream) RecvMsg(m interface{}) error {
+	f, ok := m.(*frame)
+	if !ok {
+		return status.Errorf(codes.Internal, "unexpected message type %T", m)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The request is read before the handler runs, so the body is never
+	// used here, which may happen after ServeHTTP returned.
+	if s.recvd || s.done {
+		return io.EOF
+	}
+	s.recvd = true
+	f.payload = s.request
+	return nil
+}
+
+func (s *transcodedStream) SendMsg(m interface{}) error {
+	f, ok := m.(*frame)
+	if !ok {
+		return status.Errorf(codes.Internal, "unexpected message type %T", m)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return status.Error(codes.Canceled, "stream is done")
+	}
+	if !s.route.streaming {
+		if s.response != nil {
+			return status.Error(codes.Internal, "unary method sent multiple responses")
+		}
+		s.response = f.payload
+		return nil
+	}
+	out, err := s.t.encodeResponse(s.route, f.payload)
+	if err != nil {
+		return err
+	}
+	s.writeHeaderLocked(http.StatusOK, false)
+	if _, err := s.w.Write(append(out, '\n')); err != nil {
+		return status.Errorf(codes.Unavailable, "failed writing to client: %v", err)
+	}
+	if fl, ok := s.w.(http.Flusher); ok {
+		fl.Flush()
+	}
+	return nil
+}
+
+func (s *transcodedStream) writeHeaderLocked(code int, trailers bool) {
+	if s.headerSent {
+		return
+	}
+	s.headerSent = true
+	h := s.w.Header()
+	h.Set("Content-Type", "application/json")
+	for k, values := range s.header {
+		for _, v := range values {
+			h.Add("Grpc-Metadata-"+k, encodeMetadataValue(k, v))
+		}
+	}
+	if trailers {
+		for k, values := range s.trailer {
+			for _, v := range values {
+				h.Add("Grpc-Trailer-"+k, encodeMetadataValue(k, v))
+			}
+		}
+	}
+	s.w.WriteHeader(code)
+}
+
+// finish writes the response or the error of the call.
+func (s *transcodedStream) finish(err error) {
+	s.cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done = true
+
+	if err == nil && !s.route.streaming {
+		var out []byte
+		if s.response == nil {
+			err = status.Error(codes.Internal, "unary method sent no response")
+		} else if out, err = s.t.encodeResponse(s.route, s.response); err == nil {
+			s.writeHeaderLocked(http.StatusOK, true)
+			s.w.Write(out)
+			return
+		}
+	}
+	if err == nil {
+		s.writeHeaderLocked(http.StatusOK, false)
+		return
+	}
+	if s.headerSent {
+		// A streaming response already started, report the error in band.
+		b, _ := json.Marshal(map[string]interface{}{"error": httpErrorBody(err)})
+		s.w.Write(append(b, '\n'))
+		return
+	}
+	s.writeHeaderLocked(HTTPStatusFromCode(status.Code(err)), true)
+	b, _ := json.Marshal(httpErrorBody(err))
+	s.w.Write(b)
+}
+
+// encodeResponse converts a binary response message to JSON.
+func (t *Transcoder) encodeResponse(route *httpRoute, payload []byte) ([]byte, error) {
+	msg := reflect.New(route.out).Interface().(proto.Message)
+	if err := proto.Unmarshal(payload, msg); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed decoding response: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := t.Marshaler.Marshal(&buf, msg); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed encoding response: %v", err)
+	}
+	if route.responseBody == "" {
+		return buf.Bytes(), nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed encoding response: %v", err)
+	}
+	if v, ok := fields[route.responseBody]; ok {
+		return v, nil
+	}
+	return []byte("null"), nil
+}
+
+func httpErrorBody(err error) map[string]interface{} {
+	st := status.Convert(err)
+	return map[string]interface{}{
+		"code":    int(st.Code()),
+		"message": st.Message(),
+	}
+}
+
+func writeHTTPError(w http.ResponseWriter, err error) {
+	code := HTTPStatusFromCode(status.Code(err))
+	if err == errMethodNotAllowed {
+		code = http.StatusMethodNotAllowed
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	b, _ := json.Marshal(httpErrorBody(err))
+	w.Write(b)
+}
+
+// HTTPStatusFromCode returns the HTTP status code conventionally used for a
+// gRPC status code.
+func HTTPStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// pathTemplate is a parsed google.api.http path template, such as
+// "/v1/{name=shelves/*}/books/{book}:verb".
+type pathTemplate struct {
+	segments []string
+	vars     []templateVar
+	verb     string
+}
+
+// templateVar captures the path segments [start, end) into a field. An end
+// of -1 extends to the end of the path.
+type templateVar struct {
+	field      string
+	start, end int
+}
+
+func parsePathTemplate(tmpl string) (*pathTemplate, error) {
+	if !strings.HasPrefix(tmpl, "/") {
+		return nil, fmt.Errorf("path template %q must start with /", tmpl)
+	}
+	t := &pathTemplate{}
+	rest := tmpl[1:]
+	if i := strings.LastIndex(rest, ":"); i >= 0 && i > strings.LastIndex(rest, "/") && i > strings.LastIndex(rest, "}") {
+		rest, t.verb = rest[:i], rest[i+1:]
+	}
+	for len(rest) > 0 {
+		if rest[0] == '{' {
+			end := strings.IndexByte(rest, '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated variable in path template %q", tmpl)
+			}
+			field, pattern := rest[1:end], "*"
+			if i := strings.IndexByte(field, '='); i >= 0 {
+				field, pattern = field[:i], field[i+1:]
+			}
+			v := templateVar{field: field, start: len(t.segments)}
+			t.segments = append(t.segments, strings.Split(pattern, "/")...)
+			v.end = len(t.segments)
+			if t.segments[v.end-1] == "**" {
+				v.end = -1
+			}
+			t.vars = append(t.vars, v)
+			rest = rest[end+1:]
+		} else {
+			end := strings.IndexByte(rest, '/')
+			if end < 0 {
+				end = len(rest)
+			}
+			t.segments = append(t.segments, rest[:end])
+			rest = rest[end:]
+		}
+		rest = strings.TrimPrefix(rest, "/")
+	}
+	for i, seg := range t.segments {
+		if seg == "**" && i != len(t.segments)-1 {
+			return nil, fmt.Errorf("** must be the last segment of path template %q", tmpl)
+		}
+	}
+	return t, nil
+}
+
+// match matches an escaped URL path against the template and returns the
+// values of its variables.
+func (t *pathTemplate) match(path string) (map[string]string, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	path = path[1:]
+	if t.verb != "" {
+		if !strings.HasSuffix(path, ":"+t.verb) {
+			return nil, false
+		}
+		path = path[:len(path)-len(t.verb)-1]
+	}
+	var segs []string
+	if path != "" {
+		segs = strings.Split(path, "/")
+	}
+	for i, seg := range segs {
+		unescaped, err := url.PathUnescape(seg)
+		if err != nil {
+			return nil, false
+		}
+		segs[i] = unescaped
+	}
+
+	for i, want := range t.segments {
+		if want == "**" {
+			break
+		}
+		if i >= len(segs) || (want != "*" && want != segs[i]) {
+			return nil, false
+		}
+	}
+	if n := len(t.segments); n == 0 || t.segments[n-1] != "**" {
+		if len(segs) != n {
+			return nil, false
+		}
+	}
+
+	vars := make(map[string]string, len(t.vars))
+	for _, v := range t.vars {
+		end := v.end
+		if end < 0 {
+			end = len(segs)
+		}
+		vars[v.field] = strings.Join(segs[v.start:end], "/")
+	}
+	return vars, true
+}
@@ -0,0 +1,159 @@
+package proxy_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gogoproto "github.com/gogo/protobuf/proto"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// annotatedTestService returns the descriptor of the TestService with HTTP
+// bindings added to its methods.
+func annotatedTestService(t *testing.T) *descriptor.FileDescriptorProto {
+	zr, err := gzip.NewReader(bytes.NewReader(gogoproto.FileDescriptor("test.proto")))
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(zr)
+	require.NoError(t, err)
+	var fd descriptor.FileDescriptorProto
+	require.NoError(t, proto.Unmarshal(b, &fd))
+
+	rules := map[string]*annotations.HttpRule{
+		"Ping": {
+			Pattern: &annotations.HttpRule_Get{Get: "/v1/ping/{value}"},
+			AdditionalBindings: []*annotations.HttpRule{
+				{Pattern: &annotations.HttpRule_Post{Post: "/v1/ping"}, Body: "*"},
+			},
+		},
+		"PingEmpty": {Pattern: &annotations.HttpRule_Get{Get: "/v1/empty"}, ResponseBody: "Value"},
+		"PingError": {Pattern: &annotations.HttpRule_Post{Post: "/v1/{value=errors/**}:fail"}},
+		"PingList":  {Pattern: &annotations.HttpRule_Get{Get: "/v1/list"}},
+	}
+	for _, m := range fd.Service[0].Method {
+		if rule, ok := rules[m.GetName()]; ok {
+			m.Options = &descriptor.MethodOptions{}
+			require.NoError(t, proto.SetExtension(m.Options, annotations.E_Http, rule))
+		}
+	}
+	return &fd
+}
+
+func newTranscoderEnv(t *testing.T, svc pb.TestServiceServer) (*testEnv, *httptest.Server) {
+	env := newTestEnv(t, svc)
+	tc := proxy.NewTranscoder(proxy.TransparentHandler(env.director))
+	tc.MessageType = gogoproto.MessageType
+	require.NoError(t, tc.RegisterFileDescriptor(annotatedTestService(t)))
+	return env, httptest.NewServer(tc)
+}
+
+func doJSON(t *testing.T, method, url, body string) (*http.Response, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(b)
+}
+
+func TestTranscoder_Unary(t *testing.T) {
+	env, server := newTranscoderEnv(t, metadataService())
+	defer env.Close()
+	defer server.Close()
+
+	resp, body := doJSON(t, http.MethodGet, server.URL+"/v1/ping/hello%20world", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+	assert.JSONEq(t, `{"Value":"hello world"}`, body)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "h", resp.Header.Get("Grpc-Metadata-X-Header"))
+	assert.Equal(t, "t", resp.Header.Get("Grpc-Trailer-X-Trailer"))
+
+	resp, body = doJSON(t, http.MethodPost, server.URL+"/v1/ping", `{"value":"posted"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+	assert.JSONEq(t, `{"Value":"posted"}`, body)
+
+	resp, body = doJSON(t, http.MethodGet, server.URL+"/v1/empty", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+	assert.Equal(t, `"I like kittens."`, body)
+}
+
+func TestTranscoder_Errors(t *testing.T) {
+	env := newTestEnvWithDirector(t, &pingService{}, func(backend *grpc.ClientConn) proxy.StreamDirector {
+		return func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+			if strings.HasSuffix(method, "/PingError") {
+				return ctx, nil, proxy.Direction{}, status.Error(codes.PermissionDenied, "denied")
+			}
+			return ctx, nil, proxy.Direction{BackendConn: backend}, nil
+		}
+	})
+	defer env.Close()
+	tc := proxy.NewTranscoder(proxy.TransparentHandler(env.director))
+	tc.MessageType = gogoproto.MessageType
+	tc.MaxBodySize = 64
+	require.NoError(t, tc.RegisterFileDescriptor(annotatedTestService(t)))
+	server := httptest.NewServer(tc)
+	defer server.Close()
+
+	resp, body := doJSON(t, http.MethodPost, server.URL+"/v1/errors/a/b:fail", "")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.JSONEq(t, `{"code":7,"message":"denied"}`, body)
+
+	resp, _ = doJSON(t, http.MethodGet, server.URL+"/v2/nothing", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = doJSON(t, http.MethodDelete, server.URL+"/v1/empty", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	resp, _ = doJSON(t, http.MethodPost, server.URL+"/v1/ping", `{not json`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, _ = doJSON(t, http.MethodPost, server.URL+"/v1/ping", `{"value":"`+strings.Repeat("x", 64)+`"}`)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "body over the limit")
+}
+
+func TestTranscoder_ServerStream(t *testing.T) {
+	env, server := newTranscoderEnv(t, &pingService{})
+	defer env.Close()
+	defer server.Close()
+
+	resp, body := doJSON(t, http.MethodGet, server.URL+"/v1/list?value=foo", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	require.Len(t, lines, countListResponses)
+	var last map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &last))
+	assert.Equal(t, "foo", last["Value"])
+	assert.EqualValues(t, countListResponses-1, last["counter"])
+}
+
+func TestTranscoder_RejectsClientStreaming(t *testing.T) {
+	fd := annotatedTestService(t)
+	for _, m := range fd.Service[0].Method {
+		if m.GetName() == "PingStream" {
+			m.Options = &descriptor.MethodOptions{}
+			require.NoError(t, proto.SetExtension(m.Options, annotations.E_Http,
+				&annotations.HttpRule{Pattern: &annotations.HttpRule_Post{Post: "/v1/stream"}}))
+		}
+	}
+	tc := proxy.NewTranscoder(nil)
+	tc.MessageType = gogoproto.MessageType
+	assert.Error(t, tc.RegisterFileDescriptor(fd))
+}
@@ -0,0 +1,153 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+)
+
+// FrameInfo describes a frame passed to a FrameTransformer.
+type FrameInfo struct {
+	// Method is the full method name requested by the client.
+	Method string
+	// Direction is the direction the frame is forwarded in.
+	Direction FrameDirection
+	// Seq numbers the frames a transformer sees in one direction of a
+	// stream, starting at 0.
+	Seq int
+}
+
+// FrameTransformer rewrites frames in flight, for example to redact fields
+// or to adapt messages between versions of a backend schema.
+//
+// For each frame it returns the frames to forward in its place, so a frame
+// may also be dropped or split. Frames of one direction of a stream are
+// transformed one at a time and in order, and the returned frames are
+// forwarded in the order given, before any later frame. Returning an error
+// aborts the stream; errors created with the status package are returned
+// to the client as is.
+type FrameTransformer interface {
+	TransformFrame(ctx context.Context, info FrameInfo, payload []byte) ([][]byte, error)
+}
+
+// FrameTransformerFunc is a function implementing FrameTransformer.
+type FrameTransformerFunc func(ctx context.Context, info FrameInfo, payload []byte) ([][]byte, error)
+
+// TransformFrame implements FrameTransformer.
+func (f FrameTransformerFunc) TransformFrame(ctx context.Context, info FrameInfo, payload []byte) ([][]byte, error) {
+	return f(ctx, info, payload)
+}
+
+// WithFrameTransformer adds transformers which are run for every frame. It
+// may be used multiple times. Transformers and stream interceptors are
+// chained in the order given, the frames returned by each are passed to the
+// next one.
+func WithFrameTransformer(transformers ...FrameTransformer) Option {
+	return func(o *options) {
+		o.transformers = append(o.transformers, transformers...)
+	}
+}
+
+// interceptorTransformer adapts a StreamInterceptor to a FrameTransformer
+// which returns one frame for each frame.
+func interceptorTransformer(i StreamInterceptor) FrameTransformer {
+	return FrameTransformerFunc(func(ctx context.Context, info FrameInfo, payload []byte) ([][]byte, error) {
+		payload, err := i(ctx, info.Method, info.Direction, payload)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{payload}, nil
+	})
+}
+
+// transformedServerStream applies transformers to the frames received from
+// and sent to the client. Wrapping the server side of the proxy means that
+// the transformers see every frame, whichever way the backend call is made.
+//
+// Each direction is only used by one goroutine at a time, so its state
+// needs no locking.
+type transformedServerStream struct {
+	grpc.ServerStream
+	method       string
+	transformers []FrameTransformer
+	// seq holds the frame counts of each transformer, per direction.
+	seq [2][]int
+	// pending holds client frames left over after a split.
+	pending [][]byte
+	// out is reused to send transformed frames to the client.
+	out frame
+}
+
+func newTransformedServerStream(ss grpc.ServerStream, method string, transformers []FrameTransformer) *transformedServerStream {
+	s := &transformedServerStream{ServerStream: ss, method: method, transformers: transformers}
+	for dir := range s.seq {
+		s.seq[dir] = make([]int, len(transformers))
+	}
+	return s
+}
+
+// transform runs a frame through the chain of transformers.
+func (s *transformedServerStream) transform(dir FrameDirection, payload []byte) ([][]byte, error) {
+	ctx := s.Context()
+	frames := [][]byte{payload}
+	for i, t := range s.transformers {
+		var next [][]byte
+		for _, p := range frames {
+			info := FrameInfo{Method: s.method, Direction: dir, Seq: s.seq[dir][i]}
+			s.seq[dir][i]++
+			out, err := t.TransformFrame(ctx, info, p)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, out...)
+		}
+		if frames = next; len(frames) == 0 {
+			break
+		}
+	}
+	return frames, nil
+}
+
+func (s *transformedServerStream) RecvMsg(m interface{}) error {
+	f, ok := m.(*frame)
+	if !ok {
+		return s.ServerStream.RecvMsg(m)
+	}
+	for len(s.pending) == 0 {
+		if err := s.ServerStream.RecvMsg(f); err != nil {
+			return err
+		}
+		frames, err := s.transform(ClientToBackend, f.payload)
+		if err != nil {
+			return err
+		}
+		s.pending = frames
+	}
+	f.payload = s.pending[0]
+	s.pending = s.pending[1:]
+	return nil
+}
+
+func (s *transformedServerStream) SendMsg(m interface{}) error {
+	f, ok := m.(*frame)
+	if !ok {
+		return s.ServerStream.SendMsg(m)
+	}
+	frames, err := s.transform(BackendToClient, f.payload)
+	if err != nil {
+		return err
+	}
+	for _, p := range frames {
+		s.out.payload = p
+		err := s.ServerStream.SendMsg(&s.out)
+		s.out.payload = nil
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
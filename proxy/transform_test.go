@@ -0,0 +1,141 @@
+package proxy_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// splitRequests drops requests for "drop" and splits "split:a,b" into one
+// request per value.
+var splitRequests = proxy.FrameTransformerFunc(func(ctx context.Context, info proxy.FrameInfo, payload []byte) ([][]byte, error) {
+	if info.Direction != proxy.ClientToBackend {
+		return [][]byte{payload}, nil
+	}
+	req := &pb.PingRequest{}
+	if err := proto.Unmarshal(payload, req); err != nil {
+		return nil, err
+	}
+	switch {
+	case req.Value == "drop":
+		return nil, nil
+	case strings.HasPrefix(req.Value, "split:"):
+		var frames [][]byte
+		for _, v := range strings.Split(strings.TrimPrefix(req.Value, "split:"), ",") {
+			b, err := proto.Marshal(&pb.PingRequest{Value: v})
+			if err != nil {
+				return nil, err
+			}
+			frames = append(frames, b)
+		}
+		return frames, nil
+	}
+	return [][]byte{payload}, nil
+})
+
+func TestFrameTransformer_StreamOrdering(t *testing.T) {
+	upper := func(ctx context.Context, method string, dir proxy.FrameDirection, payload []byte) ([]byte, error) {
+		if dir != proxy.BackendToClient {
+			return payload, nil
+		}
+		resp := &pb.PingResponse{}
+		if err := proto.Unmarshal(payload, resp); err != nil {
+			return nil, err
+		}
+		resp.Value = strings.ToUpper(resp.Value)
+		return proto.Marshal(resp)
+	}
+	numberResponses := proxy.FrameTransformerFunc(func(ctx context.Context, info proxy.FrameInfo, payload []byte) ([][]byte, error) {
+		if info.Direction != proxy.BackendToClient {
+			return [][]byte{payload}, nil
+		}
+		resp := &pb.PingResponse{}
+		if err := proto.Unmarshal(payload, resp); err != nil {
+			return nil, err
+		}
+		resp.Value = fmt.Sprintf("%d:%s", info.Seq, resp.Value)
+		b, err := proto.Marshal(resp)
+		return [][]byte{b}, err
+	})
+	env := newTestEnv(t, &pingService{},
+		proxy.WithFrameTransformer(splitRequests),
+		proxy.WithStreamInterceptor(upper),
+		proxy.WithFrameTransformer(numberResponses))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	stream, err := env.client.PingStream(ctx)
+	require.NoError(t, err)
+	for _, v := range []string{"a", "drop", "split:b,c", "d"} {
+		require.NoError(t, stream.Send(&pb.PingRequest{Value: v}))
+	}
+	require.NoError(t, stream.CloseSend())
+
+	var got []string
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		assert.EqualValues(t, len(got), resp.Counter, "backend must see the frames in order")
+		got = append(got, resp.Value)
+	}
+	assert.Equal(t, []string{"0:A", "1:B", "2:C", "3:D"}, got,
+		"transformers must run in the order given, together with interceptors")
+}
+
+func TestFrameTransformer_DropsResponses(t *testing.T) {
+	dropOdd := proxy.FrameTransformerFunc(func(ctx context.Context, info proxy.FrameInfo, payload []byte) ([][]byte, error) {
+		if info.Direction == proxy.BackendToClient && info.Seq%2 == 1 {
+			return nil, nil
+		}
+		return [][]byte{payload}, nil
+	})
+	env := newTestEnv(t, &pingService{}, proxy.WithFrameTransformer(dropOdd))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	stream, err := env.client.PingList(ctx, &pb.PingRequest{Value: "foo"})
+	require.NoError(t, err)
+	var counters []int32
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		counters = append(counters, resp.Counter)
+	}
+	var want []int32
+	for i := int32(0); i < countListResponses; i += 2 {
+		want = append(want, i)
+	}
+	assert.Equal(t, want, counters)
+}
+
+func TestFrameTransformer_ErrorAbortsStream(t *testing.T) {
+	reject := proxy.FrameTransformerFunc(func(ctx context.Context, info proxy.FrameInfo, payload []byte) ([][]byte, error) {
+		return nil, status.Error(codes.InvalidArgument, "schema mismatch")
+	})
+	env := newTestEnv(t, &pingService{}, proxy.WithFrameTransformer(reject))
+	defer env.Close()
+
+	ctx, cancel := env.ctx()
+	defer cancel()
+	_, err := env.client.Ping(ctx, &pb.PingRequest{Value: "foo"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
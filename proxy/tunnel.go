@@ -0,0 +1,299 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// tunnelChunkSize is the largest message of a tunnel.
+const tunnelChunkSize = 32 << 10
+
+// TunnelDialer opens the backend connection of a tunnel. It is called after
+// the authenticator and the ACL, so it may pick the target by the client
+// identity or metadata.
+type TunnelDialer func(ctx context.Context) (net.Conn, error)
+
+// TCPTunnel returns a TunnelDialer connecting to a fixed TCP address, such as
+// "db.internal:5432".
+func TCPTunnel(address string) TunnelDialer {
+	return func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", address)
+	}
+}
+
+// WithTunnel serves calls to method as byte tunnels instead of proxying
+// them to a gRPC backend, for tunneling databases or SSH through an
+// authenticated gateway. Each client message is written to the connection
+// opened by dial, and the bytes read from it are sent back as messages. The
+// messages are raw bytes rather than protobuf, see DialTunnel.
+//
+// The call ends with OK when the backend closes the connection. When the
+// client closes its side of the stream, the write side of the connection is
+// closed if it supports CloseWrite, as TCP connections do.
+func WithTunnel(method string, dial TunnelDialer) Option {
+	return func(o *options) {
+		if o.tunnels == nil {
+			o.tunnels = make(map[string]TunnelDialer)
+		}
+		o.tunnels[method] = dial
+	}
+}
+
+// tunnel copies bytes between the client stream and the backend connection
+// until either ends.
+func (h *handler) tunnel(ps *proxiedStream, serverStream grpc.ServerStream, dial TunnelDialer) error {
+	ps.errSource = ErrorSourceDirector
+	conn, err := dial(serverStream.Context())
+	if err != nil {
+		if _, ok := status.FromError(err); !ok {
+			err = status.Errorf(codes.Unavailable, "failed to open tunnel: %v", err)
+		}
+		return err
+	}
+	defer conn.Close()
+	ps.errSource = ErrorSourceBackend
+	ps.backend = conn.RemoteAddr().String()
+	ps.info.setBackend(ps.backend)
+	if h.opts.tracker != nil {
+		defer h.opts.tracker.start(ps)()
+	}
+	if h.opts.metrics != nil {
+		serverStream = h.opts.metrics.start(ps, serverStream)
+	}
+	if h.opts.accessLog != nil {
+		serverStream = startAccessLog(h.opts.accessLog, ps, serverStream)
+	}
+	// Send the header at once, so DialTunnel knows the tunnel is open.
+	if err := serverStream.SendHeader(nil); err != nil {
+		return err
+	}
+
+	errc := make(chan error, 2)
+	go func() {
+		for {
+			f := &frame{}
+			if err := serverStream.RecvMsg(f); err == io.EOF {
+				if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+					cw.CloseWrite()
+				}
+				return
+			} else if err != nil {
+				errc <- err
+				return
+			}
+			if _, err := conn.Write(f.payload); err != nil {
+				errc <- status.Errorf(codes.Unavailable, "failed writing to tunnel: %v", err)
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			// The transport may still hold a sent message, so each one gets
+			// its own buffer.
+			buf := make([]byte, tunnelChunkSize)
+			n, err := conn.Read(buf)
+			if n > 0 {
+				if sendErr := serverStream.SendMsg(&frame{payload: buf[:n]}); sendErr != nil {
+					errc <- sendErr
+					return
+				}
+			}
+			if err == io.EOF {
+				errc <- nil
+				return
+			} else if err != nil {
+				errc <- status.Errorf(codes.Unavailable, "failed reading from tunnel: %v", err)
+				return
+			}
+		}
+	}()
+	return <-errc
+}
+
+// DialTunnel opens a tunnel by calling method on a proxy serving it with
+// WithTunnel, and returns it as a net.Conn. Failures to open the tunnel are
+// returned as the status error of the call.
+//
+// Read deadlines are supported, write deadlines are ignored. Cancelling ctx
+// closes the tunnel.
+func DialTunnel(ctx context.Context, conn *grpc.ClientConn, method string, opts ...grpc.CallOption) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	opts = append([]grpc.CallOption{grpc.ForceCodec(Codec())}, opts...)
+	stream, err := grpc.NewClientStream(ctx, clientStreamDescForProxying, conn, method, opts...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	header, err := stream.Header()
+	if err == nil && header == nil {
+		// A call without header failed before the tunnel was open.
+		err = stream.RecvMsg(&frame{})
+		if err == io.EOF {
+			err = status.Error(codes.Unavailable, "tunnel closed")
+		}
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	c := &tunnelConn{
+		stream: stream,
+		cancel: cancel,
+		addr:   tunnelAddr(conn.Target() + method),
+		chunks: make(chan []byte),
+		done:   make(chan struct{}),
+	}
+	go c.receive()
+	return c, nil
+}
+
+// tunnelConn is the client side of a tunnel.
+type tunnelConn struct {
+	stream grpc.ClientStream
+	cancel context.CancelFunc
+	addr   tunnelAddr
+
+	// chunks delivers received messages until it is closed, after which
+	// recvErr holds the end of the stream.
+	chunks  chan []byte
+	recvErr error
+	done    chan struct{}
+	once    sync.Once
+
+	readMu sync.Mutex
+	buf    []byte
+
+	writeMu sync.Mutex
+
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *tunnelConn) receive() {
+	defer close(c.chunks)
+	for {
+		f := &frame{}
+		if err := c.stream.RecvMsg(f); err != nil {
+			c.recvErr = err
+			return
+		}
+		select {
+		case c.chunks <- f.payload:
+		case <-c.done:
+			c.recvErr = errTunnelClosed
+			return
+		}
+	}
+}
+
+var errTunnelClosed = errors.New("tunnel is closed")
+
+func (c *tunnelConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if len(c.buf) == 0 {
+		var timeout <-chan time.Time
+		c.mu.Lock()
+		deadline := c.readDeadline
+		c.mu.Unlock()
+		if !deadline.IsZero() {
+			t := time.NewTimer(time.Until(deadline))
+			defer t.Stop()
+			timeout = t.C
+		}
+		select {
+		case chunk, ok := <-c.chunks:
+			if !ok {
+				return 0, c.recvErr
+			}
+			c.buf = chunk
+		case <-timeout:
+			return 0, tunnelTimeout{}
+		}
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *tunnelConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	written := 0
+	for written < len(b) {
+		n := len(b) - written
+		if n > tunnelChunkSize {
+			n = tunnelChunkSize
+		}
+		// Copy the chunk, the transport may send it after SendMsg returns.
+		chunk := append([]byte(nil), b[written:written+n]...)
+		if err := c.stream.SendMsg(&frame{payload: chunk}); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite closes the client side of the stream, so the proxy closes the
+// write side of the backend connection.
+func (c *tunnelConn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.stream.CloseSend()
+}
+
+func (c *tunnelConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.cancel()
+	})
+	return nil
+}
+
+func (c *tunnelConn) LocalAddr() net.Addr  { return c.addr }
+func (c *tunnelConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *tunnelConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the deadline of the next Read. A Read already waiting
+// keeps its deadline.
+func (c *tunnelConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *tunnelConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// tunnelAddr is the address of a tunnel, the proxy target and method.
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "grpc-tunnel" }
+func (a tunnelAddr) String() string  { return string(a) }
+
+// tunnelTimeout is the net.Error of reads past the deadline.
+type tunnelTimeout struct{}
+
+func (tunnelTimeout) Error() string   { return "i/o timeout" }
+func (tunnelTimeout) Timeout() bool   { return true }
+func (tunnelTimeout) Temporary() bool { return true }
@@ -0,0 +1,122 @@
+package proxy_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const tunnelMethod = "/tunnel.Tunnel/Connect"
+
+// startUpperServer starts a TCP server which writes back what it reads in
+// upper case, until the client closes its write side.
+func startUpperServer(t *testing.T) net.Listener {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b, _ := ioutil.ReadAll(conn)
+				conn.Write([]byte(strings.ToUpper(string(b))))
+			}()
+		}
+	}()
+	return lis
+}
+
+func TestTunnel(t *testing.T) {
+	backend := startUpperServer(t)
+	defer backend.Close()
+	env := newTestEnv(t, &pingService{},
+		proxy.WithAuthenticator(tokenAuth),
+		proxy.WithTunnel(tunnelMethod, proxy.TCPTunnel(backend.Addr().String())))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	_, err := proxy.DialTunnel(ctx, env.clientConn, tunnelMethod)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "tunnels are authenticated")
+
+	conn, err := proxy.DialTunnel(metadata.AppendToOutgoingContext(ctx, "authorization", "alice"), env.clientConn, tunnelMethod)
+	require.NoError(t, err)
+	defer conn.Close()
+	data := strings.Repeat("hello tunnel ", 10000)
+	_, err = conn.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, conn.(interface{ CloseWrite() error }).CloseWrite())
+	out, err := ioutil.ReadAll(conn)
+	require.NoError(t, err, "the tunnel ends cleanly when the backend closes")
+	assert.Equal(t, strings.ToUpper(data), string(out))
+
+	_, err = env.client.PingEmpty(ctx, nil)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "other methods are proxied as usual")
+}
+
+func TestTunnel_DialError(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := lis.Addr().String()
+	lis.Close()
+	env := newTestEnv(t, &pingService{}, proxy.WithTunnel(tunnelMethod, proxy.TCPTunnel(addr)))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	_, err = proxy.DialTunnel(ctx, env.clientConn, tunnelMethod)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestTunnel_ReadDeadline(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer backend.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	env := newTestEnv(t, &pingService{}, proxy.WithTunnel(tunnelMethod, proxy.TCPTunnel(backend.Addr().String())))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	conn, err := proxy.DialTunnel(ctx, env.clientConn, tunnelMethod)
+	require.NoError(t, err)
+	defer conn.Close()
+	server := <-accepted
+	defer server.Close()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(20*time.Millisecond)))
+	_, err = conn.Read(make([]byte, 1))
+	netErr, ok := err.(net.Error)
+	require.True(t, ok, "got %v", err)
+	assert.True(t, netErr.Timeout())
+
+	require.NoError(t, conn.SetReadDeadline(time.Time{}))
+	server.Write([]byte("x"))
+	b := make([]byte, 1)
+	_, err = io.ReadFull(conn, b)
+	require.NoError(t, err)
+	assert.Equal(t, "x", string(b))
+
+	server.Close()
+	_, err = conn.Read(b)
+	assert.Equal(t, io.EOF, err)
+}
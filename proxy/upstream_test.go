@@ -0,0 +1,197 @@
+package proxy_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// egressProxy is a minimal SOCKS5 or HTTP CONNECT proxy which records the
+// targets it connects to.
+type egressProxy struct {
+	lis     net.Listener
+	targets chan string
+	user    string
+	pass    string
+}
+
+func startEgressProxy(t *testing.T, serve func(*egressProxy, net.Conn) (string, error), user, pass string) *egressProxy {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	p := &egressProxy{lis: lis, targets: make(chan string, 10), user: user, pass: pass}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				target, err := serve(p, conn)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				p.targets <- target
+			}()
+		}
+	}()
+	return p
+}
+
+// pipe connects conn to target until either side closes.
+func pipe(conn, backend net.Conn) {
+	go func() {
+		io.Copy(backend, conn)
+		backend.Close()
+	}()
+	io.Copy(conn, backend)
+	conn.Close()
+}
+
+func serveSOCKS5(p *egressProxy, conn net.Conn) (string, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return "", err
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	if p.user != "" {
+		conn.Write([]byte{5, 2})
+		var ver, ulen [1]byte
+		io.ReadFull(conn, ver[:])
+		io.ReadFull(conn, ulen[:])
+		user := make([]byte, ulen[0])
+		io.ReadFull(conn, user)
+		var plen [1]byte
+		io.ReadFull(conn, plen[:])
+		pass := make([]byte, plen[0])
+		io.ReadFull(conn, pass)
+		if string(user) != p.user || string(pass) != p.pass {
+			conn.Write([]byte{1, 1})
+			return "", fmt.Errorf("bad credentials")
+		}
+		conn.Write([]byte{1, 0})
+	} else {
+		conn.Write([]byte{5, 0})
+	}
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return "", err
+	}
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 3:
+		var l [1]byte
+		io.ReadFull(conn, l[:])
+		name := make([]byte, l[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	}
+	var port [2]byte
+	io.ReadFull(conn, port[:])
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+	backend, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return "", err
+	}
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	go pipe(conn, backend)
+	return target, nil
+}
+
+func serveCONNECT(p *egressProxy, conn net.Conn) (string, error) {
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return "", err
+	}
+	if p.user != "" {
+		if user, pass, ok := (&http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}).BasicAuth(); !ok || user != p.user || pass != p.pass {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return "", fmt.Errorf("bad credentials")
+		}
+	}
+	backend, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return "", err
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go pipe(conn, backend)
+	return req.Host, nil
+}
+
+func startPingBackend(t *testing.T) (net.Listener, func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	pb.RegisterTestServiceServer(server, &pingService{})
+	go server.Serve(lis)
+	return lis, server.Stop
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	backendLis, stop := startPingBackend(t)
+	defer stop()
+	for _, tc := range []struct {
+		name   string
+		scheme string
+		serve  func(*egressProxy, net.Conn) (string, error)
+	}{
+		{"socks5", "socks5", serveSOCKS5},
+		{"connect", "http", serveCONNECT},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			egress := startEgressProxy(t, tc.serve, "alice", "s3cret")
+			defer egress.lis.Close()
+
+			up, err := proxy.ParseUpstreamProxy(fmt.Sprintf("%s://alice:s3cret@%s", tc.scheme, egress.lis.Addr()))
+			require.NoError(t, err)
+			cfg := proxy.BackendConfig{Address: backendLis.Addr().String(), UpstreamProxy: up}
+			conn, err := cfg.Dial()
+			require.NoError(t, err)
+			defer conn.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			resp, err := pb.NewTestServiceClient(conn).Ping(ctx, &pb.PingRequest{Value: "through egress"})
+			require.NoError(t, err)
+			assert.Equal(t, "through egress", resp.Value)
+			assert.Equal(t, backendLis.Addr().String(), <-egress.targets)
+
+			bad, err := proxy.ParseUpstreamProxy(fmt.Sprintf("%s://alice:wrong@%s", tc.scheme, egress.lis.Addr()))
+			require.NoError(t, err)
+			_, err = bad.DialContext(ctx, backendLis.Addr().String())
+			assert.Error(t, err, "the credentials are checked")
+		})
+	}
+}
+
+func TestParseUpstreamProxy(t *testing.T) {
+	for _, bad := range []string{"ftp://egress:21", "socks5://", "::"} {
+		_, err := proxy.ParseUpstreamProxy(bad)
+		assert.Error(t, err, bad)
+	}
+	_, err := proxy.ParseUpstreamProxy("socks5://egress")
+	assert.NoError(t, err)
+}
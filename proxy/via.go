@@ -0,0 +1,79 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Via is the metadata key listing the proxies a call passed through, see
+// WithVia.
+const Via = "Via"
+
+// ViaPolicy detects routing loops in chains of proxies, where proxies route
+// calls to other proxies. Each proxy appends its name to the Via metadata
+// of the calls it forwards, and rejects calls which already passed through
+// it, or through too many proxies, with codes.FailedPrecondition.
+type ViaPolicy struct {
+	// Name identifies the proxy in the Via metadata, and must be unique
+	// among the proxies of a chain. It defaults to the host name.
+	Name string
+
+	// MaxHops limits the number of proxies a call may pass through,
+	// including this one. Zero means no limit.
+	MaxHops int
+}
+
+// WithVia adds the proxy to the Via metadata of the calls it forwards, and
+// rejects looping calls, see ViaPolicy.
+func WithVia(p ViaPolicy) Option {
+	if p.Name == "" {
+		p.Name, _ = os.Hostname()
+	}
+	return func(o *options) {
+		o.via = &p
+	}
+}
+
+// check rejects calls from serverCtx which passed through the proxy or
+// through too many proxies.
+func (p *ViaPolicy) check(serverCtx context.Context) error {
+	md, _ := metadata.FromIncomingContext(serverCtx)
+	hops := viaChain(md)
+	for _, name := range hops {
+		if name == p.Name {
+			return status.Errorf(codes.FailedPrecondition, "routing loop: call already passed through %s (via %s)", p.Name, strings.Join(hops, ", "))
+		}
+	}
+	if p.MaxHops > 0 && len(hops) >= p.MaxHops {
+		return status.Errorf(codes.FailedPrecondition, "call passed through more than %d proxies (via %s)", p.MaxHops, strings.Join(hops, ", "))
+	}
+	return nil
+}
+
+// apply adds the proxy to the Via metadata of the backend call.
+func (p *ViaPolicy) apply(clientCtx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(clientCtx, Via, p.Name)
+}
+
+// viaChain returns the proxies listed in the Via metadata of md, oldest
+// first.
+func viaChain(md metadata.MD) []string {
+	var hops []string
+	for _, v := range md[strings.ToLower(Via)] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); len(name) != 0 {
+				hops = append(hops, name)
+			}
+		}
+	}
+	return hops
+}
@@ -0,0 +1,68 @@
+package proxy_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+// viaService returns the Via metadata received by the backend.
+func viaService() *pingService {
+	return &pingService{
+		ping: func(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+			md, _ := metadata.FromIncomingContext(ctx)
+			return &pb.PingResponse{Value: strings.Join(md.Get(proxy.Via), ",")}, nil
+		},
+	}
+}
+
+func TestVia(t *testing.T) {
+	env := newTestEnv(t, viaService(), proxy.WithVia(proxy.ViaPolicy{Name: "edge", MaxHops: 3}))
+	defer env.Close()
+	ctx, cancel := env.ctx()
+	defer cancel()
+
+	out, err := env.client.Ping(ctx, &pb.PingRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, "edge", out.Value)
+
+	out, err = env.client.Ping(metadata.AppendToOutgoingContext(ctx, proxy.Via, "lb"), &pb.PingRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, "lb,edge", out.Value, "the proxy is appended to the chain")
+
+	_, err = env.client.Ping(metadata.AppendToOutgoingContext(ctx, proxy.Via, "lb, edge, mesh"), &pb.PingRequest{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "loop")
+
+	_, err = env.client.Ping(metadata.AppendToOutgoingContext(ctx, proxy.Via, "a", proxy.Via, "b, c"), &pb.PingRequest{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "too many hops")
+}
+
+func TestVia_Chain(t *testing.T) {
+	inner := newTestEnv(t, viaService(), proxy.WithVia(proxy.ViaPolicy{Name: "inner"}))
+	defer inner.Close()
+	innerConn, err := grpc.Dial(inner.clientConn.Target(), grpc.WithInsecure(), proxy.DialOption())
+	require.NoError(t, err)
+	defer innerConn.Close()
+	outer := newTestEnvWithDirector(t, viaService(), func(*grpc.ClientConn) proxy.StreamDirector {
+		return func(ctx context.Context, method string) (context.Context, context.CancelFunc, proxy.Direction, error) {
+			return ctx, nil, proxy.Direction{BackendConn: innerConn}, nil
+		}
+	}, proxy.WithVia(proxy.ViaPolicy{Name: "outer"}))
+	defer outer.Close()
+	ctx, cancel := outer.ctx()
+	defer cancel()
+
+	out, err := outer.client.Ping(ctx, &pb.PingRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, "outer,inner", out.Value)
+}
@@ -0,0 +1,401 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package xds
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/mkxxx/grpc-proxy/proxy"
+	rpc "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	clusterType  = "type.googleapis.com/envoy.api.v2.Cluster"
+	endpointType = "type.googleapis.com/envoy.api.v2.ClusterLoadAssignment"
+)
+
+// Client keeps the backends of a proxy.Router in sync with the clusters and
+// endpoints of an xDS management server.
+//
+// Only endpoints which are healthy, or whose health is unknown, receive
+// calls. Of the localities of a cluster, only those of the highest priority
+// with such endpoints are used.
+type Client struct {
+	// Node identifies the proxy to the management server.
+	Node *core.Node
+	// Dial connects to an endpoint of a cluster. If nil, endpoints are
+	// dialed insecurely with the proxy codec.
+	Dial func(cluster, address string) (*grpc.ClientConn, error)
+	// RetryDelay is the wait before the discovery stream is opened again
+	// after it failed. If zero, one second is used.
+	RetryDelay time.Duration
+
+	conn   *grpc.ClientConn
+	router *proxy.Router
+
+	mu       sync.Mutex
+	clusters map[string]*cluster
+	conns    map[string]*sharedConn
+}
+
+type cluster struct {
+	name string
+	// service is the EDS name of the cluster, empty for clusters with
+	// static endpoints.
+	service  string
+	policy   v2.Cluster_LbPolicy
+	balancer proxy.Balancer
+	// endpoints are the connection keys of the current endpoints.
+	endpoints []string
+	weights   map[string]int
+}
+
+type sharedConn struct {
+	conn *grpc.ClientConn
+	refs int
+}
+
+// NewClient returns a Client using the management server on conn, which
+// must not use the proxy codec, to configure router.
+func NewClient(conn *grpc.ClientConn, router *proxy.Router) *Client {
+	return &Client{
+		conn:     conn,
+		router:   router,
+		clusters: make(map[string]*cluster),
+		conns:    make(map[string]*sharedConn),
+	}
+}
+
+// Run subscribes to the management server until ctx is done, opening the
+// stream again whenever it fails. Backends stay in place while the stream
+// is down.
+func (c *Client) Run(ctx context.Context) error {
+	delay := c.RetryDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	for {
+		c.stream(ctx)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Close removes all discovered backends from the router and closes their
+// connections.
+func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, cl := range c.clusters {
+		c.router.RemoveBackend(name)
+		c.release(cl.endpoints)
+	}
+	c.clusters = make(map[string]*cluster)
+}
+
+// subscription tracks the state of one resource type on a stream.
+type subscription struct {
+	version string
+	nonce   string
+	names   []string
+}
+
+func (c *Client) stream(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := discovery.NewAggregatedDiscoveryServiceClient(c.conn).StreamAggregatedResources(ctx)
+	if err != nil {
+		return err
+	}
+	var cds, eds subscription
+	send := func(typeURL string, sub *subscription, nackErr error) error {
+		req := &v2.DiscoveryRequest{
+			VersionInfo:   sub.version,
+			Node:          c.Node,
+			ResourceNames: sub.names,
+			TypeUrl:       typeURL,
+			ResponseNonce: sub.nonce,
+		}
+		if nackErr != nil {
+			req.ErrorDetail = &rpc.Status{Code: int32(codes.InvalidArgument), Message: nackErr.Error()}
+		}
+		return stream.Send(req)
+	}
+	if err := send(clusterType, &cds, nil); err != nil {
+		return err
+	}
+
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		switch resp.GetTypeUrl() {
+		case clusterType:
+			cds.nonce = resp.GetNonce()
+			clusters, err := parseClusters(resp)
+			if err != nil {
+				if err := send(clusterType, &cds, err); err != nil {
+					return err
+				}
+				continue
+			}
+			cds.version = resp.GetVersionInfo()
+			services := c.updateClusters(clusters)
+			if err := send(clusterType, &cds, nil); err != nil {
+				return err
+			}
+			if !equalStrings(services, eds.names) {
+				eds.names = services
+				if err := send(endpointType, &eds, nil); err != nil {
+					return err
+				}
+			}
+		case endpointType:
+			eds.nonce = resp.GetNonce()
+			assignments, err := parseAssignments(resp)
+			if err != nil {
+				if err := send(endpointType, &eds, err); err != nil {
+					return err
+				}
+				continue
+			}
+			eds.version = resp.GetVersionInfo()
+			for _, cla := range assignments {
+				c.updateEndpoints(cla.GetClusterName(), cla)
+			}
+			if err := send(endpointType, &eds, nil); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func parseClusters(resp *v2.DiscoveryResponse) ([]*v2.Cluster, error) {
+	var clusters []*v2.Cluster
+	for _, res := range resp.GetResources() {
+		cl := &v2.Cluster{}
+		if err := ptypes.UnmarshalAny(res, cl); err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, cl)
+	}
+	return clusters, nil
+}
+
+func parseAssignments(resp *v2.DiscoveryResponse) ([]*v2.ClusterLoadAssignment, error) {
+	var assignments []*v2.ClusterLoadAssignment
+	for _, res := range resp.GetResources() {
+		cla := &v2.ClusterLoadAssignment{}
+		if err := ptypes.UnmarshalAny(res, cla); err != nil {
+			return nil, err
+		}
+		assignments = append(assignments, cla)
+	}
+	return assignments, nil
+}
+
+// updateClusters replaces the set of clusters, and returns the sorted EDS
+// names to subscribe to.
+func (c *Client) updateClusters(clusters []*v2.Cluster) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seen := make(map[string]bool)
+	services := make(map[string]bool)
+	for _, def := range clusters {
+		name := def.GetName()
+		seen[name] = true
+		var service string
+		if def.GetType() == v2.Cluster_EDS {
+			service = def.GetEdsClusterConfig().GetServiceName()
+			if service == "" {
+				service = name
+			}
+			services[service] = true
+		}
+
+		cl, ok := c.clusters[name]
+		switch {
+		case !ok:
+			cl = &cluster{name: name, policy: def.GetLbPolicy()}
+			cl.balancer = newBalancer(cl.policy, nil)
+			c.clusters[name] = cl
+			c.router.AddBalancedBackend(name, cl.balancer)
+		case cl.policy != def.GetLbPolicy():
+			cl.policy = def.GetLbPolicy()
+			cl.balancer = newBalancer(cl.policy, c.endpoints(cl))
+			c.router.AddBalancedBackend(name, cl.balancer)
+		}
+		cl.service = service
+		if service == "" {
+			c.applyAssignment(cl, def.GetLoadAssignment())
+		}
+	}
+	for name, cl := range c.clusters {
+		if !seen[name] {
+			c.router.RemoveBackend(name)
+			c.release(cl.endpoints)
+			delete(c.clusters, name)
+		}
+	}
+
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newBalancer(policy v2.Cluster_LbPolicy, eps []proxy.Endpoint) proxy.Balancer {
+	if policy == v2.Cluster_LEAST_REQUEST {
+		return proxy.NewLeastStreamsBalancer(eps...)
+	}
+	return proxy.NewWeightedBalancer(eps...)
+}
+
+func (c *Client) updateEndpoints(service string, cla *v2.ClusterLoadAssignment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, cl := range c.clusters {
+		if cl.service == service {
+			c.applyAssignment(cl, cla)
+		}
+	}
+}
+
+// applyAssignment replaces the endpoints of cl.
+func (c *Client) applyAssignment(cl *cluster, cla *v2.ClusterLoadAssignment) {
+	addrs, weights := usableEndpoints(cla)
+	var keys []string
+	for _, addr := range addrs {
+		key := cl.name + "|" + addr
+		if err := c.acquire(cl.name, addr, key); err != nil {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	old := cl.endpoints
+	cl.endpoints = keys
+	cl.weights = make(map[string]int, len(keys))
+	for i, key := range keys {
+		cl.weights[key] = weights[i]
+	}
+	cl.balancer.Update(c.endpoints(cl))
+	c.release(old)
+}
+
+func (c *Client) endpoints(cl *cluster) []proxy.Endpoint {
+	eps := make([]proxy.Endpoint, 0, len(cl.endpoints))
+	for _, key := range cl.endpoints {
+		eps = append(eps, proxy.Endpoint{Conn: c.conns[key].conn, Weight: cl.weights[key]})
+	}
+	return eps
+}
+
+// usableEndpoints returns the addresses and weights of the healthy
+// endpoints of the highest priority which has any.
+func usableEndpoints(cla *v2.ClusterLoadAssignment) ([]string, []int) {
+	type candidate struct {
+		addr   string
+		weight int
+	}
+	byPriority := make(map[uint32][]candidate)
+	for _, locality := range cla.GetEndpoints() {
+		for _, lbe := range locality.GetLbEndpoints() {
+			switch lbe.GetHealthStatus() {
+			case core.HealthStatus_UNKNOWN, core.HealthStatus_HEALTHY:
+			default:
+				continue
+			}
+			sa := lbe.GetEndpoint().GetAddress().GetSocketAddress()
+			if sa == nil {
+				continue
+			}
+			addr := net.JoinHostPort(sa.GetAddress(), strconv.Itoa(int(sa.GetPortValue())))
+			weight := 1
+			if w := lbe.GetLoadBalancingWeight(); w != nil {
+				weight = int(w.GetValue())
+			}
+			p := locality.GetPriority()
+			byPriority[p] = append(byPriority[p], candidate{addr, weight})
+		}
+	}
+	if len(byPriority) == 0 {
+		return nil, nil
+	}
+	best := ^uint32(0)
+	for p := range byPriority {
+		if p < best {
+			best = p
+		}
+	}
+	var addrs []string
+	var weights []int
+	for _, c := range byPriority[best] {
+		addrs = append(addrs, c.addr)
+		weights = append(weights, c.weight)
+	}
+	return addrs, weights
+}
+
+func (c *Client) acquire(cluster, addr, key string) error {
+	if sc, ok := c.conns[key]; ok {
+		sc.refs++
+		return nil
+	}
+	dial := c.Dial
+	if dial == nil {
+		dial = func(_, address string) (*grpc.ClientConn, error) {
+			return (&proxy.BackendConfig{Address: address}).Dial()
+		}
+	}
+	conn, err := dial(cluster, addr)
+	if err != nil {
+		return err
+	}
+	c.conns[key] = &sharedConn{conn: conn, refs: 1}
+	return nil
+}
+
+func (c *Client) release(keys []string) {
+	for _, key := range keys {
+		sc, ok := c.conns[key]
+		if !ok {
+			continue
+		}
+		if sc.refs--; sc.refs == 0 {
+			sc.conn.Close()
+			delete(c.conns, key)
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,234 @@
+package xds_test
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/mkxxx/grpc-proxy/proxy"
+	"github.com/mkxxx/grpc-proxy/proxy/xds"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/mkxxx/grpc-proxy/testservice"
+)
+
+const (
+	clusterType  = "type.googleapis.com/envoy.api.v2.Cluster"
+	endpointType = "type.googleapis.com/envoy.api.v2.ClusterLoadAssignment"
+)
+
+// managementServer pushes the responses sent on its channel to the client,
+// and records the requests it receives.
+type managementServer struct {
+	responses chan *v2.DiscoveryResponse
+	requests  chan *v2.DiscoveryRequest
+}
+
+func (s *managementServer) StreamAggregatedResources(stream discovery.AggregatedDiscoveryService_StreamAggregatedResourcesServer) error {
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			s.requests <- req
+		}
+	}()
+	for {
+		select {
+		case resp := <-s.responses:
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (s *managementServer) DeltaAggregatedResources(discovery.AggregatedDiscoveryService_DeltaAggregatedResourcesServer) error {
+	return status.Error(codes.Unimplemented, "")
+}
+
+// next returns the next request of the given type.
+func (s *managementServer) next(t *testing.T, typeURL string) *v2.DiscoveryRequest {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case req := <-s.requests:
+			if req.GetTypeUrl() == typeURL {
+				return req
+			}
+		case <-timeout:
+			t.Fatalf("no %s request", typeURL)
+		}
+	}
+}
+
+func resources(t *testing.T, msgs ...proto.Message) []*any.Any {
+	var out []*any.Any
+	for _, m := range msgs {
+		a, err := ptypes.MarshalAny(m)
+		require.NoError(t, err)
+		out = append(out, a)
+	}
+	return out
+}
+
+func assignment(name string, addrs ...string) *v2.ClusterLoadAssignment {
+	var eps []*endpoint.LbEndpoint
+	for _, addr := range addrs {
+		host, port, _ := net.SplitHostPort(addr)
+		p, _ := strconv.Atoi(port)
+		eps = append(eps, &endpoint.LbEndpoint{
+			HostIdentifier: &endpoint.LbEndpoint_Endpoint{Endpoint: &endpoint.Endpoint{
+				Address: &core.Address{Address: &core.Address_SocketAddress{SocketAddress: &core.SocketAddress{
+					Address:       host,
+					PortSpecifier: &core.SocketAddress_PortValue{PortValue: uint32(p)},
+				}}},
+			}},
+		})
+	}
+	return &v2.ClusterLoadAssignment{
+		ClusterName: name,
+		Endpoints:   []*endpoint.LocalityLbEndpoints{{LbEndpoints: eps}},
+	}
+}
+
+type namedService struct {
+	pb.TestServiceServer
+	name string
+}
+
+func (s *namedService) Ping(ctx context.Context, ping *pb.PingRequest) (*pb.PingResponse, error) {
+	return &pb.PingResponse{Value: s.name}, nil
+}
+
+func listen(t *testing.T, server *grpc.Server) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(lis)
+	return lis.Addr().String()
+}
+
+func startBackend(t *testing.T, name string) (*grpc.Server, string) {
+	server := grpc.NewServer()
+	pb.RegisterTestServiceServer(server, &namedService{name: name})
+	return server, listen(t, server)
+}
+
+func TestClient(t *testing.T) {
+	blue, blueAddr := startBackend(t, "blue")
+	defer blue.Stop()
+	green, greenAddr := startBackend(t, "green")
+	defer green.Stop()
+
+	ms := &managementServer{responses: make(chan *v2.DiscoveryResponse, 10), requests: make(chan *v2.DiscoveryRequest, 100)}
+	xdsServer := grpc.NewServer()
+	discovery.RegisterAggregatedDiscoveryServiceServer(xdsServer, ms)
+	xdsAddr := listen(t, xdsServer)
+	defer xdsServer.Stop()
+	xdsConn, err := grpc.Dial(xdsAddr, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer xdsConn.Close()
+
+	router := proxy.NewRouter()
+	router.AddRoute(proxy.Route{Backend: "svc"})
+	client := xds.NewClient(xdsConn, router)
+	client.Node = &core.Node{Id: "proxy-1"}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go client.Run(ctx)
+
+	proxySrv := grpc.NewServer(
+		proxy.ServerOption(),
+		grpc.UnknownServiceHandler(proxy.TransparentHandler(router.Direct)),
+	)
+	proxyAddr := listen(t, proxySrv)
+	defer proxySrv.Stop()
+	conn, err := grpc.Dial(proxyAddr, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	ping := func() string {
+		out, err := pb.NewTestServiceClient(conn).Ping(ctx, &pb.PingRequest{})
+		if err != nil {
+			return status.Code(err).String()
+		}
+		return out.Value
+	}
+
+	req := ms.next(t, clusterType)
+	assert.Equal(t, "proxy-1", req.GetNode().GetId())
+	ms.responses <- &v2.DiscoveryResponse{
+		VersionInfo: "1",
+		Nonce:       "c1",
+		TypeUrl:     clusterType,
+		Resources: resources(t, &v2.Cluster{
+			Name:                 "svc",
+			ClusterDiscoveryType: &v2.Cluster_Type{Type: v2.Cluster_EDS},
+			EdsClusterConfig:     &v2.Cluster_EdsClusterConfig{ServiceName: "svc-eds"},
+		}),
+	}
+	ack := ms.next(t, clusterType)
+	assert.Equal(t, "1", ack.GetVersionInfo())
+	assert.Equal(t, "c1", ack.GetResponseNonce())
+	edsReq := ms.next(t, endpointType)
+	assert.Equal(t, []string{"svc-eds"}, edsReq.GetResourceNames())
+
+	ms.responses <- &v2.DiscoveryResponse{
+		VersionInfo: "1", Nonce: "e1", TypeUrl: endpointType,
+		Resources: resources(t, assignment("svc-eds", blueAddr)),
+	}
+	assert.Eventually(t, func() bool { return ping() == "blue" }, 5*time.Second, 10*time.Millisecond)
+
+	ms.responses <- &v2.DiscoveryResponse{
+		VersionInfo: "2", Nonce: "e2", TypeUrl: endpointType,
+		Resources: resources(t, assignment("svc-eds", greenAddr)),
+	}
+	assert.Eventually(t, func() bool { return ping() == "green" }, 5*time.Second, 10*time.Millisecond)
+
+	ms.responses <- &v2.DiscoveryResponse{VersionInfo: "2", Nonce: "c2", TypeUrl: clusterType}
+	assert.Eventually(t, func() bool { return ping() == codes.Unavailable.String() }, 5*time.Second, 10*time.Millisecond,
+		"removed clusters are removed from the router")
+}
+
+func TestClientNack(t *testing.T) {
+	ms := &managementServer{responses: make(chan *v2.DiscoveryResponse, 10), requests: make(chan *v2.DiscoveryRequest, 100)}
+	xdsServer := grpc.NewServer()
+	discovery.RegisterAggregatedDiscoveryServiceServer(xdsServer, ms)
+	xdsAddr := listen(t, xdsServer)
+	defer xdsServer.Stop()
+	xdsConn, err := grpc.Dial(xdsAddr, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer xdsConn.Close()
+
+	client := xds.NewClient(xdsConn, proxy.NewRouter())
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go client.Run(ctx)
+
+	ms.next(t, clusterType)
+	ms.responses <- &v2.DiscoveryResponse{
+		VersionInfo: "1", Nonce: "bad", TypeUrl: clusterType,
+		Resources: []*any.Any{{TypeUrl: clusterType, Value: []byte("garbage")}},
+	}
+	nack := ms.next(t, clusterType)
+	assert.Equal(t, "", nack.GetVersionInfo(), "the rejected version is not acknowledged")
+	assert.Equal(t, "bad", nack.GetResponseNonce())
+	assert.NotNil(t, nack.GetErrorDetail())
+}
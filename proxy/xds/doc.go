@@ -0,0 +1,14 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+/*
+Package xds discovers proxy backends from an xDS management server, such as
+the control plane of a service mesh.
+
+A Client subscribes to clusters (CDS) and their endpoints (EDS) over the
+aggregated discovery service, and keeps one backend of a proxy.Router per
+cluster, named after the cluster. Routes are not discovered, they are added
+to the Router as usual and refer to clusters by name.
+*/
+package xds
@@ -0,0 +1,78 @@
+// Copyright 2018 Valient Gough
+// All Rights Reserved.
+// See LICENSE for licensing terms.
+
+// Package zstd registers a zstd compressor with gRPC, like
+// google.golang.org/grpc/encoding/gzip does for gzip. Importing the package
+// is enough for servers to accept zstd compressed messages, clients use it
+// with grpc.UseCompressor(zstd.Name).
+package zstd
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/grpc/encoding"
+)
+
+// Name is the name the compressor is registered under.
+const Name = "zstd"
+
+func init() {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		panic(err)
+	}
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		panic(err)
+	}
+	encoding.RegisterCompressor(&compressor{enc: enc, dec: dec})
+}
+
+// compressor encodes whole messages with shared encoders, whose EncodeAll
+// and DecodeAll methods are safe for concurrent use. gRPC hands over full
+// messages anyway, and streaming readers would leak their goroutines as
+// gRPC never closes them.
+type compressor struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+func (c *compressor) Name() string {
+	return Name
+}
+
+func (c *compressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return &writer{enc: c.enc, w: w}, nil
+}
+
+func (c *compressor) Decompress(r io.Reader) (io.Reader, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	out, err := c.dec.DecodeAll(b, nil)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(out), nil
+}
+
+// writer buffers a message and compresses it on Close.
+type writer struct {
+	enc *zstd.Encoder
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *writer) Close() error {
+	_, err := w.w.Write(w.enc.EncodeAll(w.buf.Bytes(), nil))
+	return err
+}
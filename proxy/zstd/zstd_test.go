@@ -0,0 +1,36 @@
+package zstd_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/mkxxx/grpc-proxy/proxy/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/encoding"
+)
+
+func TestCompressor(t *testing.T) {
+	c := encoding.GetCompressor(zstd.Name)
+	require.NotNil(t, c, "importing the package must register the compressor")
+
+	msg := []byte(strings.Repeat("compressible ", 100))
+	var buf bytes.Buffer
+	w, err := c.Compress(&buf)
+	require.NoError(t, err)
+	_, err = w.Write(msg)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	assert.True(t, buf.Len() < len(msg))
+
+	r, err := c.Decompress(&buf)
+	require.NoError(t, err)
+	out, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, msg, out)
+
+	_, err = c.Decompress(strings.NewReader("not zstd"))
+	assert.Error(t, err)
+}